@@ -0,0 +1,188 @@
+package heimdall
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// defaultVersionHeaders are the response headers the versions a server
+// supports are read from, unless VersionsAdvertisedIn names others
+var defaultVersionHeaders = []string{"X-Supported-Versions", "X-API-Supported-Versions", "Supported-Versions"}
+
+// ErrAPIVersionRejected is returned with the response when the server
+// refused the API version the client pins
+type ErrAPIVersionRejected struct {
+	// Version is the version the request was sent with
+	Version string
+	// StatusCode is the status of the response
+	StatusCode int
+	// Supported are the versions the server advertised, if any
+	Supported []string
+}
+
+func (e *ErrAPIVersionRejected) Error() string {
+	if len(e.Supported) == 0 {
+		return fmt.Sprintf("API version %s rejected with status %d", e.Version, e.StatusCode)
+	}
+
+	return fmt.Sprintf("API version %s rejected with status %d, supported versions: %s", e.Version, e.StatusCode, strings.Join(e.Supported, ", "))
+}
+
+// VersionStrategy pins the API version of requests and recognizes responses
+// refusing it
+type VersionStrategy interface {
+	// Version returns the version pinned
+	Version() string
+	// Apply pins the version on request. It is given a copy of the request
+	// headers, which it may change.
+	Apply(request *http.Request)
+	// Rejected reports whether response refuses the version, and the
+	// versions the server advertised
+	Rejected(response *Response) (bool, []string)
+}
+
+// VersionOption configures how a built-in VersionStrategy recognizes a
+// rejected version
+type VersionOption func(*versionRejection)
+
+// VersionRejectedWhen makes marker recognize rejections beyond 406 Not
+// Acceptable and 415 Unsupported Media Type, such as those answered with
+// 400 and an error code in the body
+func VersionRejectedWhen(marker func(response *Response) bool) VersionOption {
+	return func(r *versionRejection) {
+		r.marker = marker
+	}
+}
+
+// VersionsAdvertisedIn reads the versions a server supports from the
+// headers named, in place of X-Supported-Versions, X-API-Supported-Versions
+// and Supported-Versions
+func VersionsAdvertisedIn(headers ...string) VersionOption {
+	return func(r *versionRejection) {
+		r.headers = headers
+	}
+}
+
+// versionRejection recognizes the responses refusing a version
+type versionRejection struct {
+	marker  func(response *Response) bool
+	headers []string
+}
+
+func newVersionRejection(opts []VersionOption) versionRejection {
+	r := versionRejection{headers: defaultVersionHeaders}
+	for _, opt := range opts {
+		opt(&r)
+	}
+
+	return r
+}
+
+// rejected reports whether response is a 406, a 415 or matches the marker,
+// along with the comma separated versions of the advertising headers
+func (r versionRejection) rejected(response *Response) (bool, []string) {
+	status := response.statusCode
+	if status != http.StatusNotAcceptable && status != http.StatusUnsupportedMediaType && (r.marker == nil || !r.marker(response)) {
+		return false, nil
+	}
+
+	var supported []string
+	for _, name := range r.headers {
+		for _, value := range response.headers.Values(name) {
+			for _, version := range strings.Split(value, ",") {
+				if version = strings.TrimSpace(version); version != "" {
+					supported = append(supported, version)
+				}
+			}
+		}
+	}
+
+	return true, supported
+}
+
+type headerVersion struct {
+	versionRejection
+	header  string
+	version string
+}
+
+// HeaderVersion pins version in the request header named, such as
+// Accept-Version or X-API-Version. Requests setting the header keep theirs.
+func HeaderVersion(header, version string, opts ...VersionOption) VersionStrategy {
+	return &headerVersion{versionRejection: newVersionRejection(opts), header: header, version: version}
+}
+
+func (v *headerVersion) Version() string {
+	return v.version
+}
+
+func (v *headerVersion) Apply(request *http.Request) {
+	if request.Header.Get(v.header) == "" {
+		request.Header.Set(v.header, v.version)
+	}
+}
+
+func (v *headerVersion) Rejected(response *Response) (bool, []string) {
+	return v.rejected(response)
+}
+
+type mediaTypeVersion struct {
+	versionRejection
+	version   string
+	mediaType string
+}
+
+// MediaTypeVersion pins version in the vendor media type
+// application/vnd.{vendor}.v{version}+json, asked for in the Accept header
+// and declared as the Content-Type of JSON request bodies. Requests asking
+// for or sending other media types than JSON keep theirs.
+func MediaTypeVersion(vendor, version string, opts ...VersionOption) VersionStrategy {
+	return &mediaTypeVersion{
+		versionRejection: newVersionRejection(opts),
+		version:          version,
+		mediaType:        "application/vnd." + vendor + ".v" + version + "+json",
+	}
+}
+
+func (v *mediaTypeVersion) Version() string {
+	return v.version
+}
+
+func (v *mediaTypeVersion) Apply(request *http.Request) {
+	if accept := mediaType(request.Header.Get("Accept")); accept == "" || accept == "application/json" || accept == "*/*" {
+		request.Header.Set("Accept", v.mediaType)
+	}
+	if mediaType(request.Header.Get("Content-Type")) == "application/json" {
+		request.Header.Set("Content-Type", v.mediaType)
+	}
+}
+
+func (v *mediaTypeVersion) Rejected(response *Response) (bool, []string) {
+	return v.rejected(response)
+}
+
+// pinAPIVersion applies strategy, if any, to a copy of the request headers
+func pinAPIVersion(request *http.Request, strategy VersionStrategy) {
+	if strategy == nil {
+		return
+	}
+
+	request.Header = copyHeader(request.Header)
+	strategy.Apply(request)
+}
+
+// apiVersionRejected returns an *ErrAPIVersionRejected when strategy finds
+// response to refuse its version
+func apiVersionRejected(strategy VersionStrategy, response Response) (err error) {
+	if strategy == nil || response.statusCode == 0 {
+		return nil
+	}
+	defer recoverCallback("version strategy", &err)
+
+	if rejected, supported := strategy.Rejected(&response); rejected {
+		return &ErrAPIVersionRejected{Version: strategy.Version(), StatusCode: response.statusCode, Supported: supported}
+	}
+
+	return nil
+}
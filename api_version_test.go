@@ -0,0 +1,132 @@
+package heimdall
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// versionedServer serves the versions listed by the Accept-Version header,
+// or by the vendor media type of the Accept header, echoing the version and
+// Content-Type received. Other versions are answered with 406 and the
+// supported versions.
+func versionedServer(supported ...string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		version := r.Header.Get("Accept-Version")
+		if accept := r.Header.Get("Accept"); strings.HasPrefix(accept, "application/vnd.orders.v") {
+			version = strings.TrimSuffix(strings.TrimPrefix(accept, "application/vnd.orders.v"), "+json")
+		}
+		for _, v := range supported {
+			if v == version {
+				w.Write([]byte(version + " " + r.Header.Get("Content-Type")))
+				return
+			}
+		}
+
+		w.Header().Set("X-Supported-Versions", strings.Join(supported, ", "))
+		w.WriteHeader(http.StatusNotAcceptable)
+	}))
+}
+
+func TestHeaderVersionIsSentWithEveryRequest(t *testing.T) {
+	server := versionedServer("1", "2")
+	defer server.Close()
+
+	for kind, newClient := range retryClients {
+		client := newClient("api_version_"+kind, realClock{})
+		client.SetAPIVersion(HeaderVersion("Accept-Version", "2"))
+
+		headers := http.Header{}
+		response, err := client.Get(server.URL, headers)
+		require.NoError(t, err, kind)
+		assert.Equal(t, "2 ", string(response.Body()), kind)
+		assert.Empty(t, headers, "%s: the caller's headers are left as they are", kind)
+
+		response, err = client.Get(server.URL, http.Header{"Accept-Version": {"1"}})
+		require.NoError(t, err, kind)
+		assert.Equal(t, "1 ", string(response.Body()), "%s: requests setting the header keep theirs", kind)
+
+		response, err = derive(client).Get(server.URL, http.Header{})
+		require.NoError(t, err, kind)
+		assert.Equal(t, "2 ", string(response.Body()), "%s: derived clients keep the version", kind)
+	}
+}
+
+func TestMediaTypeVersionIsSentWithEveryRequest(t *testing.T) {
+	server := versionedServer("3")
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+	client.SetAPIVersion(MediaTypeVersion("orders", "3"))
+
+	response, err := client.Post(server.URL, bytes.NewReader([]byte(`{}`)), http.Header{
+		"Accept":       {"application/json"},
+		"Content-Type": {"application/json; charset=utf-8"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "3 application/vnd.orders.v3+json", string(response.Body()))
+
+	response, err = client.Post(server.URL, bytes.NewReader([]byte("a")), http.Header{"Content-Type": {"text/plain"}})
+	require.NoError(t, err)
+	assert.Equal(t, "3 text/plain", string(response.Body()), "bodies other than JSON keep their media type")
+
+	_, err = client.Get(server.URL, http.Header{"Accept": {"text/csv"}})
+	var rejected *ErrAPIVersionRejected
+	assert.True(t, errors.As(err, &rejected), "requests asking for other media types keep theirs: %v", err)
+}
+
+func TestRejectedVersionsFailTheRequest(t *testing.T) {
+	server := versionedServer("3", "4")
+	defer server.Close()
+
+	for kind, newClient := range retryClients {
+		client := newClient("api_version_rejected_"+kind, realClock{})
+		client.SetAPIVersion(HeaderVersion("Accept-Version", "2"))
+
+		response, err := client.Get(server.URL, http.Header{})
+		var rejected *ErrAPIVersionRejected
+		require.True(t, errors.As(err, &rejected), "%s: %v", kind, err)
+		assert.Equal(t, &ErrAPIVersionRejected{Version: "2", StatusCode: http.StatusNotAcceptable, Supported: []string{"3", "4"}}, rejected, kind)
+		assert.EqualError(t, err, "API version 2 rejected with status 406, supported versions: 3, 4", kind)
+		assert.Equal(t, http.StatusNotAcceptable, response.StatusCode(), "%s: the response is returned with the error", kind)
+
+		client.SetAPIVersion(nil)
+		response, err = client.Get(server.URL, http.Header{})
+		require.NoError(t, err, "%s: without a strategy a 406 is returned as any other response", kind)
+		assert.Equal(t, http.StatusNotAcceptable, response.StatusCode(), kind)
+	}
+}
+
+func TestVersionRejectionMarkerAndHeaders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("API-Versions", "2024-01-01,2024-06-01")
+		w.Header().Add("API-Versions", "2025-01-01")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"code":"unsupported_version"}`))
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+	client.SetAPIVersion(HeaderVersion("X-API-Version", "2023-01-01",
+		VersionRejectedWhen(func(response *Response) bool {
+			return bytes.Contains(response.Body(), []byte("unsupported_version"))
+		}),
+		VersionsAdvertisedIn("API-Versions"),
+	))
+
+	_, err := client.Get(server.URL, http.Header{})
+	var rejected *ErrAPIVersionRejected
+	require.True(t, errors.As(err, &rejected), "%v", err)
+	assert.Equal(t, http.StatusBadRequest, rejected.StatusCode)
+	assert.Equal(t, []string{"2024-01-01", "2024-06-01", "2025-01-01"}, rejected.Supported)
+
+	client.SetAPIVersion(HeaderVersion("X-API-Version", "2023-01-01"))
+	_, err = client.Get(server.URL, http.Header{})
+	assert.NoError(t, err, "a 400 without the marker is not a rejection")
+}
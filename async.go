@@ -0,0 +1,150 @@
+package heimdall
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAsyncQueueSize int = 1024
+	defaultAsyncWorkers   int = 4
+)
+
+// ErrQueueFull is returned by PostAsync when the async queue has no room
+// for another job, which is dropped, and for an attempt over the adaptive
+// concurrency limit finding the queue set with WithConcurrencyQueue full.
+type ErrQueueFull struct {
+	Capacity int
+	// Waited is how long the attempt was queued, always zero as a full queue
+	// turns attempts away at once
+	Waited time.Duration
+
+	// concurrency is set for the concurrency queue
+	concurrency bool
+}
+
+func (e *ErrQueueFull) Error() string {
+	if e.concurrency {
+		return fmt.Sprintf("concurrency queue full: %d attempts waiting", e.Capacity)
+	}
+
+	return fmt.Sprintf("async queue full: %d jobs pending", e.Capacity)
+}
+
+type asyncJob struct {
+	url     string
+	body    []byte
+	headers http.Header
+}
+
+// asyncQueue runs queued POSTs on a fixed pool of workers, which are started
+// with the first job
+type asyncQueue struct {
+	jobs    chan asyncJob
+	workers int
+	post    func(job asyncJob)
+	dropped func()
+
+	start sync.Once
+
+	mu      sync.Mutex
+	pending int
+	idle    chan struct{}
+	closed  bool
+}
+
+func newAsyncQueue(size, workers int, post func(job asyncJob), dropped func()) *asyncQueue {
+	if size < 1 {
+		size = defaultAsyncQueueSize
+	}
+	if workers < 1 {
+		workers = defaultAsyncWorkers
+	}
+
+	return &asyncQueue{
+		jobs:    make(chan asyncJob, size),
+		workers: workers,
+		post:    post,
+		dropped: dropped,
+	}
+}
+
+// enqueue queues a copy of the job, failing immediately when the queue is full
+func (q *asyncQueue) enqueue(url string, body []byte, headers http.Header) error {
+	q.start.Do(func() {
+		for i := 0; i < q.workers; i++ {
+			go q.work()
+		}
+	})
+
+	job := asyncJob{
+		url:     url,
+		body:    append([]byte(nil), body...),
+		headers: copyHeader(headers),
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrClientClosed
+	}
+	select {
+	case q.jobs <- job:
+	default:
+		q.dropped()
+		return &ErrQueueFull{Capacity: cap(q.jobs)}
+	}
+
+	if q.pending == 0 {
+		q.idle = make(chan struct{})
+	}
+	q.pending++
+
+	return nil
+}
+
+func (q *asyncQueue) work() {
+	for job := range q.jobs {
+		q.post(job)
+
+		q.mu.Lock()
+		q.pending--
+		if q.pending == 0 {
+			close(q.idle)
+		}
+		q.mu.Unlock()
+	}
+}
+
+// flush waits until every queued job has been sent, or ctx is done
+func (q *asyncQueue) flush(ctx context.Context) error {
+	q.mu.Lock()
+	if q.pending == 0 {
+		q.mu.Unlock()
+		return nil
+	}
+	idle := q.idle
+	q.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// close stops the workers once the jobs queued are sent
+func (q *asyncQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.closed {
+		q.closed = true
+		close(q.jobs)
+	}
+}
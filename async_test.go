@@ -0,0 +1,130 @@
+package heimdall
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPostAsyncDeliversEveryJob(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		assert.Equal(t, "analytics", r.Header.Get("X-Source"))
+
+		mu.Lock()
+		received = append(received, string(body))
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(1000, WithAsyncQueue(100, 8))
+
+	headers := http.Header{}
+	headers.Set("X-Source", "analytics")
+
+	var expected []string
+	for i := 0; i < 50; i++ {
+		body := fmt.Sprintf(`{ "event": %d }`, i)
+		expected = append(expected, body)
+		require.NoError(t, client.PostAsync(server.URL, []byte(body), headers))
+	}
+
+	require.NoError(t, client.Flush(context.Background()))
+
+	sort.Strings(expected)
+	sort.Strings(received)
+	assert.Equal(t, expected, received)
+}
+
+func TestPostAsyncRetriesThroughHystrixClient(t *testing.T) {
+	var mu sync.Mutex
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	client := NewHystrixHTTPClient(1000, NewHystrixConfig("async_command", HystrixCommandConfig{}))
+	client.SetRetryCount(1)
+
+	require.NoError(t, client.PostAsync(server.URL, []byte("{}"), http.Header{}))
+	require.NoError(t, client.Flush(context.Background()))
+
+	assert.Equal(t, 2, attempts)
+}
+
+func TestFlushWaitsForInFlightJobs(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(5000)
+	require.NoError(t, client.PostAsync(server.URL, nil, http.Header{}))
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, client.Flush(ctx))
+
+	close(release)
+	assert.NoError(t, client.Flush(context.Background()))
+}
+
+func TestFlushWithNothingQueuedReturnsImmediately(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	assert.NoError(t, NewHTTPClient(100).Flush(ctx))
+}
+
+func TestPostAsyncReturnsErrQueueFullWhenQueueOverflows(t *testing.T) {
+	prefix := uniqueName("heimdall_async_test")
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(5000, WithAsyncQueue(1, 1))
+	client.EnableExpvar(prefix)
+
+	require.NoError(t, client.PostAsync(server.URL, nil, http.Header{}))
+	<-started
+	require.NoError(t, client.PostAsync(server.URL, nil, http.Header{}))
+
+	begin := time.Now()
+	err := client.PostAsync(server.URL, nil, http.Header{})
+	assert.True(t, time.Since(begin) < 100*time.Millisecond, "a full queue should not block")
+
+	queueFull, ok := err.(*ErrQueueFull)
+	require.True(t, ok, "expected *ErrQueueFull, got %T", err)
+	assert.Equal(t, 1, queueFull.Capacity)
+	assert.Equal(t, "1", expvar.Get(prefix+".async_dropped").String())
+
+	close(release)
+	require.NoError(t, client.Flush(context.Background()))
+}
@@ -0,0 +1,80 @@
+package heimdall
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// sendAttempt sends request once through doer and reads its response with
+// settings. An answer with an error status fails it with an error made from
+// serverError and the status, which differs between the clients. abort is
+// the error of the maintenance monitor, which ends the request at once.
+// request is the clone made for the attempt, which sendAttempt may change.
+func sendAttempt(doer Doer, request *http.Request, attempt int, settings attemptSettings, options clientOptions, serverError string) (hr Response, abort, err error) {
+	began := options.clock.Now()
+	overrideHost(request, options)
+
+	response, err := doer.Do(request)
+	if err != nil {
+		return hr, nil, markHTTP2Error(err)
+	}
+
+	options.tls.inspect(response, request, options.clock.Now(), settings.expvar)
+
+	hr.hasBody = expectsBody(request.Method, response.StatusCode)
+	if hr.hasBody {
+		hr.body, hr.spool, err = options.spooling.read(response, readWholeBody(response, attempt, settings.retryCount), settings.drainLimit, settings.strictContentLength)
+	} else {
+		closeBody(response)
+	}
+	if err != nil {
+		err = markHTTP2Error(err)
+		options.http2Downgrade.observe(request, err, options.clock.Now())
+		return Response{}, nil, err
+	}
+
+	hr.statusCode = response.StatusCode
+	hr.headers = response.Header
+	hr.trailers = responseTrailers(response)
+	hr.finalURL = responseURL(response, request)
+	if options.charsetDecoding {
+		hr.decodeCharset(response.Header.Get("Content-Type"))
+	}
+
+	if err := settings.maintenance.observe(request.URL.Host, &hr, options.clock.Now()); err != nil {
+		return hr, err, nil
+	}
+	if response.StatusCode >= http.StatusInternalServerError {
+		return hr, nil, fmt.Errorf(serverError, response.StatusCode)
+	}
+	if err := classifyAttempt(settings.classifier, &hr, options.clock.Now().Sub(began)); err != nil {
+		return hr, nil, err
+	}
+	if err := settings.bodyRetry.check(&hr); err != nil {
+		return hr, nil, err
+	}
+
+	return hr, nil, nil
+}
+
+// attemptOutcomeOf returns the outcome of an attempt that got response and
+// failed with cause, reporting err, which is cause unless the attempt ran
+// inside a hystrix command
+func attemptOutcomeOf(response Response, cause, err error, options clientOptions) attemptOutcome {
+	if forbidden := forbiddenHostError(cause); forbidden != nil {
+		return attemptOutcome{response: response, abort: forbidden}
+	}
+	if tooMany := tooManyRedirectsError(cause); tooMany != nil {
+		return attemptOutcome{response: response, abort: tooMany}
+	}
+	if malformed := malformedResponseError(cause); malformed != nil {
+		return malformedOutcome(malformed, options)
+	}
+
+	outcome := attemptOutcome{response: response, err: err, cause: cause}
+	if response.statusCode >= http.StatusInternalServerError {
+		outcome.cause = nil
+	}
+
+	return outcome
+}
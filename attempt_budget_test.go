@@ -0,0 +1,105 @@
+package heimdall
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gojektech/heimdall/fakeclock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFitBackoff(t *testing.T) {
+	start := time.Now()
+	cases := map[string]struct {
+		deadline time.Duration
+		budget   time.Duration
+		interval time.Duration
+
+		wait time.Duration
+		fits bool
+	}{
+		"fits_whole_wait":        {deadline: 10 * time.Second, budget: 2 * time.Second, interval: 5 * time.Second, wait: 5 * time.Second, fits: true},
+		"truncated_for_budget":   {deadline: 10 * time.Second, budget: 3 * time.Second, interval: 8 * time.Second, wait: 7 * time.Second, fits: true},
+		"truncated_to_deadline":  {deadline: 4 * time.Second, interval: 8 * time.Second, wait: 4 * time.Second, fits: true},
+		"no_wait_at_budget":      {deadline: 3 * time.Second, budget: 3 * time.Second, interval: time.Second, wait: 0, fits: true},
+		"skipped_below_budget":   {deadline: 2 * time.Second, budget: 3 * time.Second, interval: time.Second, fits: false},
+		"past_deadline_no_floor": {deadline: -time.Second, interval: time.Second, wait: 0, fits: true},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithDeadline(context.Background(), start.Add(tc.deadline))
+			defer cancel()
+			request, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+			hooks := retryHooks{clock: fakeclock.New(start), minAttemptBudget: tc.budget}
+
+			wait, left, fits := hooks.fitBackoff(request.WithContext(ctx), tc.interval)
+
+			assert.Equal(t, tc.fits, fits)
+			assert.Equal(t, tc.deadline, left)
+			if fits {
+				assert.Equal(t, tc.wait, wait)
+			}
+		})
+	}
+}
+
+func TestFitBackoffWithoutDeadline(t *testing.T) {
+	request, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	hooks := retryHooks{clock: fakeclock.New(time.Now()), minAttemptBudget: time.Second}
+
+	wait, _, fits := hooks.fitBackoff(request, time.Minute)
+
+	assert.True(t, fits)
+	assert.Equal(t, time.Minute, wait)
+}
+
+func TestClientsSkipFinalAttemptBelowBudget(t *testing.T) {
+	for kind, newClient := range retryClients {
+		t.Run(kind, func(t *testing.T) {
+			start := time.Now()
+			clock := fakeclock.New(start)
+
+			var calls int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&calls, 1)
+				clock.Advance(time.Second)
+				w.WriteHeader(http.StatusInternalServerError)
+			}))
+			defer server.Close()
+
+			client := newClient("attempt_budget_"+kind, clock)
+			client.SetRetryCount(3)
+			client.SetRetrier(NewRetrier(NewConstantBackoff(8000)))
+			client.SetMinAttemptBudget(3 * time.Second)
+
+			ctx, cancel := context.WithDeadline(context.Background(), start.Add(10*time.Second))
+			defer cancel()
+			request, err := http.NewRequest(http.MethodGet, server.URL, nil)
+			require.NoError(t, err)
+
+			response, err := client.Do(request.WithContext(ctx))
+
+			var done *ErrContextDone
+			require.True(t, errors.As(err, &done), "%v", err)
+			assert.True(t, errors.Is(err, context.DeadlineExceeded))
+			assert.True(t, done.Timeout())
+			assert.Contains(t, err.Error(), "skipped final attempt")
+			assert.Equal(t, 3, done.Attempts)
+			assert.Equal(t, http.StatusInternalServerError, done.LastResponse.StatusCode())
+			assert.Equal(t, http.StatusInternalServerError, response.StatusCode())
+
+			// The constant backoff retries at once first. 8s are left after the
+			// second attempt, so the 8s wait is cut to 5s to leave 3s, and the 2s
+			// left after the third attempt are too few for the fourth.
+			assert.Equal(t, []time.Duration{0, 5 * time.Second}, clock.Sleeps())
+			assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+		})
+	}
+}
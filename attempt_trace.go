@@ -0,0 +1,60 @@
+package heimdall
+
+import "time"
+
+// RequestTrace lists the attempts made for a request, for logging the whole
+// retry history of a request as one record. Its JSON field names are stable.
+type RequestTrace struct {
+	// RequestID is the ID shared by the attempts, as Response.RequestID
+	RequestID string `json:"request_id"`
+	// Attempts are the attempts sent, at most one more than the retry count
+	Attempts []AttemptTrace `json:"attempts"`
+}
+
+// AttemptTrace describes one attempt of a request
+type AttemptTrace struct {
+	// Attempt is the number of the attempt, 0 for the first
+	Attempt  int       `json:"attempt"`
+	Start    time.Time `json:"start"`
+	Duration Duration  `json:"duration"`
+	// StatusCode is the status the server answered with, 0 when the attempt
+	// got no response
+	StatusCode int `json:"status_code,omitempty"`
+	// Error is the message of the error failing the attempt, if any
+	Error string `json:"error,omitempty"`
+	// Backoff is the wait applied after the attempt before the next one
+	Backoff Duration `json:"backoff,omitempty"`
+	// Fallback reports whether the hystrix fallback ran for the attempt, as it
+	// does for failed and rejected attempts
+	Fallback bool `json:"fallback,omitempty"`
+	// Phases break the attempt down by phase when the client was made with
+	// WithPhaseTimings and the attempt reached the network
+	Phases *PhaseTimings `json:"phases,omitempty"`
+	// Sent is the request the attempt sent when the client was made with
+	// WithSentRequests and the attempt reached the transport
+	Sent *SentRequestInfo `json:"sent,omitempty"`
+	// Redirects are the redirects the attempt followed
+	Redirects []RedirectHop `json:"redirects,omitempty"`
+	// ConnectFailure reports whether the attempt failed before getting a
+	// connection, and was retried with the connect failure retrier. Only
+	// attempts followed by a retry are classified.
+	ConnectFailure bool `json:"connect_failure,omitempty"`
+}
+
+// newAttemptTrace describes an attempt begun at start with outcome
+func newAttemptTrace(attempt int, start, end time.Time, outcome attemptOutcome) AttemptTrace {
+	trace := AttemptTrace{
+		Attempt:    attempt,
+		Start:      start,
+		Duration:   Duration(end.Sub(start)),
+		StatusCode: outcome.response.statusCode,
+		Fallback:   outcome.fallback,
+	}
+	if outcome.abort != nil {
+		trace.Error = outcome.abort.Error()
+	} else if outcome.err != nil {
+		trace.Error = outcome.err.Error()
+	}
+
+	return trace
+}
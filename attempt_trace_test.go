@@ -0,0 +1,114 @@
+package heimdall
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gojektech/heimdall/fakeclock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failingServer answers the first failures requests with a 503
+func failingServer(failures int32) *httptest.Server {
+	var calls int32
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+}
+
+func TestClientsTraceAttempts(t *testing.T) {
+	for kind, newClient := range retryClients {
+		t.Run(kind, func(t *testing.T) {
+			server := failingServer(2)
+			defer server.Close()
+
+			start := time.Date(2018, time.January, 19, 22, 0, 0, 0, time.UTC)
+			clock := fakeclock.New(start)
+			client := newClient("attempt_trace_"+kind, clock)
+			client.SetRetryCount(3)
+			client.SetRetrier(NewRetrier(NewLinearBackoff(10*time.Millisecond, time.Second)))
+
+			response, err := client.Get(server.URL, http.Header{})
+			require.NoError(t, err)
+
+			trace := response.Trace()
+			assert.Equal(t, response.RequestID(), trace.RequestID)
+			require.Len(t, trace.Attempts, 3)
+
+			for i, attempt := range trace.Attempts {
+				assert.Equal(t, i, attempt.Attempt)
+			}
+			assert.Equal(t, []int{503, 503, 200}, []int{trace.Attempts[0].StatusCode, trace.Attempts[1].StatusCode, trace.Attempts[2].StatusCode})
+			assert.Equal(t, []Duration{0, Duration(10 * time.Millisecond), 0}, []Duration{trace.Attempts[0].Backoff, trace.Attempts[1].Backoff, trace.Attempts[2].Backoff})
+			assert.Equal(t, []time.Time{start, start, start.Add(10 * time.Millisecond)}, []time.Time{trace.Attempts[0].Start, trace.Attempts[1].Start, trace.Attempts[2].Start})
+			assert.Contains(t, trace.Attempts[0].Error, "503")
+			assert.Equal(t, "", trace.Attempts[2].Error)
+			assert.Equal(t, kind == "hystrix", trace.Attempts[0].Fallback)
+			assert.False(t, trace.Attempts[2].Fallback)
+		})
+	}
+}
+
+func TestTraceOfExhaustedRequestIsBoundedByRetryCount(t *testing.T) {
+	server := failingServer(100)
+	defer server.Close()
+
+	client := NewHTTPClient(1000, WithClock(fakeclock.New(time.Now())))
+	client.SetRetryCount(4)
+	client.SetRetrier(NewRetrier(NewConstantBackoff(5)))
+
+	response, err := client.Get(server.URL, http.Header{})
+	require.Error(t, err)
+
+	attempts := response.Trace().Attempts
+	require.Len(t, attempts, 5)
+	assert.Equal(t, Duration(0), attempts[4].Backoff, "no wait follows the final attempt")
+	for _, attempt := range attempts {
+		assert.Equal(t, http.StatusServiceUnavailable, attempt.StatusCode)
+	}
+}
+
+func TestTraceRecordsTransportErrors(t *testing.T) {
+	server := failingServer(0)
+	server.Close()
+
+	client := NewHTTPClient(1000)
+	client.SetRetryCount(1)
+
+	response, err := client.Get(server.URL, http.Header{})
+	require.Error(t, err)
+
+	attempts := response.Trace().Attempts
+	require.Len(t, attempts, 2)
+	assert.Equal(t, 0, attempts[0].StatusCode)
+	assert.Contains(t, attempts[0].Error, "connect")
+}
+
+func TestTraceMarshalsToJSON(t *testing.T) {
+	start := time.Date(2018, time.January, 19, 22, 0, 0, 0, time.UTC)
+	trace := RequestTrace{
+		RequestID: "f00d",
+		Attempts: []AttemptTrace{
+			{Attempt: 0, Start: start, Duration: Duration(40 * time.Millisecond), StatusCode: 503, Error: "server error: 503", Backoff: Duration(100 * time.Millisecond), Fallback: true},
+			{Attempt: 1, Start: start.Add(140 * time.Millisecond), Duration: Duration(30 * time.Millisecond), StatusCode: 200},
+		},
+	}
+
+	data, err := json.Marshal(trace)
+	require.NoError(t, err)
+
+	assert.JSONEq(t, `{
+		"request_id": "f00d",
+		"attempts": [
+			{"attempt": 0, "start": "2018-01-19T22:00:00Z", "duration": "40ms", "status_code": 503, "error": "server error: 503", "backoff": "100ms", "fallback": true},
+			{"attempt": 1, "start": "2018-01-19T22:00:00.14Z", "duration": "30ms", "status_code": 200}
+		]
+	}`, string(data))
+}
@@ -0,0 +1,253 @@
+package heimdall
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultAuditBufferSize        = 1024
+	defaultAuditCorrelationHeader = "X-Correlation-ID"
+)
+
+// AuditRecord describes one attempt sent over the network, for audit logs
+type AuditRecord struct {
+	Time       time.Time     `json:"time"`
+	Method     string        `json:"method"`
+	URL        string        `json:"url"`
+	StatusCode int           `json:"status_code,omitempty"`
+	Error      string        `json:"error,omitempty"`
+	Duration   time.Duration `json:"duration_ns"`
+	// BytesOut is the length of the request body, and BytesIn the number of
+	// response body bytes read by the client
+	BytesOut      int64  `json:"bytes_out"`
+	BytesIn       int64  `json:"bytes_in"`
+	CorrelationID string `json:"correlation_id,omitempty"`
+	// RequestID links the attempts of one request, numbered by Attempt from 1
+	RequestID string `json:"request_id,omitempty"`
+	Attempt   int    `json:"attempt,omitempty"`
+}
+
+// AuditOption configures optional behaviour of an audit log
+type AuditOption func(*auditLog)
+
+// WithAuditStripQuery removes the query string and fragment from recorded URLs
+func WithAuditStripQuery() AuditOption {
+	return func(a *auditLog) {
+		a.stripQuery = true
+	}
+}
+
+// WithAuditHashURL records the hex SHA-256 of each URL instead of the URL,
+// after the query string is stripped if WithAuditStripQuery is given too
+func WithAuditHashURL() AuditOption {
+	return func(a *auditLog) {
+		a.hashURL = true
+	}
+}
+
+// WithAuditExcludeHosts records no attempts to hosts matching one of the
+// patterns, given as for SetAllowedHosts
+func WithAuditExcludeHosts(patterns ...string) AuditOption {
+	return func(a *auditLog) {
+		for _, pattern := range patterns {
+			a.excludeHosts = append(a.excludeHosts, strings.ToLower(pattern))
+		}
+	}
+}
+
+// WithAuditCorrelationHeader reads the correlation ID of each request from
+// the named header, X-Correlation-ID by default
+func WithAuditCorrelationHeader(name string) AuditOption {
+	return func(a *auditLog) {
+		a.correlationHeader = name
+	}
+}
+
+// WithAuditBuffer sets how many records may wait for the sink, 1024 by
+// default. Records arriving while the buffer is full are dropped.
+func WithAuditBuffer(size int) AuditOption {
+	return func(a *auditLog) {
+		a.bufferSize = size
+	}
+}
+
+// NewAuditJSONSink returns a sink for EnableAuditLog writing each record to w
+// as a line of JSON
+func NewAuditJSONSink(w io.Writer) func(AuditRecord) {
+	var mu sync.Mutex
+	encoder := json.NewEncoder(w)
+
+	return func(record AuditRecord) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		encoder.Encode(record)
+	}
+}
+
+// auditLog hands sampled records to a sink from a goroutine of its own, so
+// that a slow sink never holds up requests
+type auditLog struct {
+	sink       func(AuditRecord)
+	sampleRate float64
+	random     func() float64
+	clock      Clock
+	onDrop     func()
+
+	stripQuery        bool
+	hashURL           bool
+	excludeHosts      []string
+	correlationHeader string
+	bufferSize        int
+
+	records chan AuditRecord
+	dropped int64
+}
+
+func newAuditLog(sink func(AuditRecord), sampleRate float64, clock Clock, onDrop func(), opts []AuditOption) *auditLog {
+	a := &auditLog{
+		sink:              sink,
+		sampleRate:        sampleRate,
+		random:            rand.Float64,
+		clock:             clock,
+		onDrop:            onDrop,
+		correlationHeader: defaultAuditCorrelationHeader,
+		bufferSize:        defaultAuditBufferSize,
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+
+	a.records = make(chan AuditRecord, a.bufferSize)
+	go a.run()
+
+	return a
+}
+
+func (a *auditLog) run() {
+	for record := range a.records {
+		a.sink(record)
+	}
+}
+
+// wrap returns next recording the sampled attempts it sends. It returns next
+// itself when no audit log is enabled.
+func (a *auditLog) wrap(next Doer) Doer {
+	if a == nil {
+		return next
+	}
+
+	return DoerFunc(func(request *http.Request) (*http.Response, error) {
+		if !a.sampled(request) {
+			return next.Do(request)
+		}
+
+		record := AuditRecord{
+			Time:          a.clock.Now(),
+			Method:        request.Method,
+			URL:           a.recordedURL(request),
+			BytesOut:      request.ContentLength,
+			CorrelationID: request.Header.Get(a.correlationHeader),
+			RequestID:     RequestIDFromContext(request.Context()),
+			Attempt:       RequestAttemptFromContext(request.Context()),
+		}
+		if record.BytesOut < 0 {
+			record.BytesOut = 0
+		}
+
+		response, err := next.Do(request)
+		record.Duration = a.clock.Now().Sub(record.Time)
+		if err != nil {
+			record.Error = err.Error()
+			a.emit(record)
+			return response, err
+		}
+
+		record.StatusCode = response.StatusCode
+		if response.Body == nil {
+			a.emit(record)
+			return response, err
+		}
+
+		// The record is emitted once the client is done with the body, so
+		// that it counts the bytes actually read
+		response.Body = &auditBody{ReadCloser: response.Body, done: func(read int64) {
+			record.BytesIn = read
+			a.emit(record)
+		}}
+
+		return response, nil
+	})
+}
+
+func (a *auditLog) sampled(request *http.Request) bool {
+	host := strings.ToLower(request.URL.Hostname())
+	for _, pattern := range a.excludeHosts {
+		if hostMatches(pattern, host) {
+			return false
+		}
+	}
+
+	return a.sampleRate >= 1 || (a.sampleRate > 0 && a.random() < a.sampleRate)
+}
+
+func (a *auditLog) recordedURL(request *http.Request) string {
+	u := *request.URL
+	u.User = nil
+	if a.stripQuery {
+		u.RawQuery = ""
+		u.Fragment = ""
+	}
+
+	recorded := u.String()
+	if a.hashURL {
+		sum := sha256.Sum256([]byte(recorded))
+		return hex.EncodeToString(sum[:])
+	}
+
+	return recorded
+}
+
+// emit queues record for the sink, dropping it when the buffer is full
+func (a *auditLog) emit(record AuditRecord) {
+	select {
+	case a.records <- record:
+	default:
+		atomic.AddInt64(&a.dropped, 1)
+		if a.onDrop != nil {
+			a.onDrop()
+		}
+	}
+}
+
+// auditBody counts the bytes read from a response body, reporting them once
+// the body is closed
+type auditBody struct {
+	io.ReadCloser
+	read int64
+	once sync.Once
+	done func(read int64)
+}
+
+func (b *auditBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+
+	return n, err
+}
+
+func (b *auditBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { b.done(b.read) })
+
+	return err
+}
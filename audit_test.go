@@ -0,0 +1,226 @@
+package heimdall
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// auditRecords collects the records handed to its sink
+type auditRecords struct {
+	mu      sync.Mutex
+	records []AuditRecord
+}
+
+func (r *auditRecords) sink(record AuditRecord) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.records = append(r.records, record)
+}
+
+// wait returns the records once count have arrived
+func (r *auditRecords) wait(t *testing.T, count int) []AuditRecord {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		r.mu.Lock()
+		records := append([]AuditRecord(nil), r.records...)
+		r.mu.Unlock()
+
+		if len(records) >= count || time.Now().After(deadline) {
+			require.Len(t, records, count)
+			return records
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAuditLogRecordsAttempts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	}))
+	defer server.Close()
+
+	records := &auditRecords{}
+	client := NewHTTPClient(1000)
+	client.EnableAuditLog(records.sink, 1)
+
+	before := time.Now()
+	_, err := client.Post(server.URL+"/v1/users?token=secret", strings.NewReader(`{"name": "x"}`), http.Header{
+		"X-Correlation-Id": []string{"abc-123"},
+	})
+	require.NoError(t, err)
+
+	record := records.wait(t, 1)[0]
+	assert.False(t, record.Time.Before(before))
+	assert.Equal(t, http.MethodPost, record.Method)
+	assert.Equal(t, server.URL+"/v1/users?token=secret", record.URL)
+	assert.Equal(t, http.StatusCreated, record.StatusCode)
+	assert.Equal(t, int64(13), record.BytesOut)
+	assert.Equal(t, int64(7), record.BytesIn)
+	assert.Equal(t, "abc-123", record.CorrelationID)
+	assert.True(t, record.Duration > 0)
+	assert.Empty(t, record.Error)
+}
+
+func TestAuditLogRecordsEveryAttemptIncludingFailures(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	records := &auditRecords{}
+	client := NewHystrixHTTPClient(1000, NewHystrixConfig("audit_log_command", HystrixCommandConfig{
+		Timeout:                1000,
+		MaxConcurrentRequests:  10,
+		RequestVolumeThreshold: 100,
+	}))
+	client.SetRetryCount(1)
+	client.EnableAuditLog(records.sink, 1, WithAuditCorrelationHeader("X-Request-Id"))
+
+	_, err := client.Get(server.URL, http.Header{"X-Request-Id": []string{"req-1"}})
+	require.NoError(t, err)
+
+	_, err = client.Get("http://127.0.0.1:1/unreachable", http.Header{})
+	require.Error(t, err)
+
+	got := records.wait(t, 4)
+	assert.Equal(t, http.StatusServiceUnavailable, got[0].StatusCode)
+	assert.Equal(t, http.StatusOK, got[1].StatusCode)
+	assert.Equal(t, "req-1", got[1].CorrelationID)
+	assert.Equal(t, 0, got[2].StatusCode)
+	assert.NotEmpty(t, got[2].Error)
+}
+
+func TestAuditLogURLOptions(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	records := &auditRecords{}
+	client := NewHTTPClient(1000)
+	client.EnableAuditLog(records.sink, 1, WithAuditStripQuery())
+
+	authenticated := strings.Replace(server.URL, "http://", "http://user:password@", 1)
+	_, err := client.Get(authenticated+"/search?q=private#top", http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, server.URL+"/search", records.wait(t, 1)[0].URL)
+
+	hashed := &auditRecords{}
+	client.EnableAuditLog(hashed.sink, 1, WithAuditStripQuery(), WithAuditHashURL())
+	_, err = client.Get(server.URL+"/search?q=private", http.Header{})
+	require.NoError(t, err)
+	record := hashed.wait(t, 1)[0]
+	assert.Len(t, record.URL, 64)
+	assert.NotContains(t, record.URL, "search")
+}
+
+func TestAuditLogExcludesHosts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	records := &auditRecords{}
+	client := NewHTTPClient(1000)
+	client.EnableAuditLog(records.sink, 1, WithAuditExcludeHosts("127.0.0.*"))
+
+	_, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+
+	localhost := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+	_, err = client.Get(localhost, http.Header{})
+	require.NoError(t, err)
+
+	got := records.wait(t, 1)
+	assert.Equal(t, localhost, got[0].URL)
+}
+
+func TestAuditLogSamplesRequests(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	var recorded int64
+	client := NewHTTPClient(1000, WithKeepAlive())
+	client.EnableAuditLog(func(AuditRecord) { atomic.AddInt64(&recorded, 1) }, 0.25, WithAuditBuffer(1000))
+	client.current.audit.random = rand.New(rand.NewSource(1)).Float64
+
+	for i := 0; i < 1000; i++ {
+		_, err := client.Get(server.URL, http.Header{})
+		require.NoError(t, err)
+	}
+
+	require.Eventually(t, func() bool { return len(client.current.audit.records) == 0 }, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+
+	assert.InDelta(t, 250, atomic.LoadInt64(&recorded), 50)
+
+	client.EnableAuditLog(func(AuditRecord) { t.Error("nothing should be sampled") }, 0)
+	_, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+}
+
+func TestAuditLogDropsRecordsForSlowSink(t *testing.T) {
+	prefix := uniqueName("heimdall_audit_test")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	release := make(chan struct{})
+	defer close(release)
+
+	client := NewHTTPClient(1000)
+	client.EnableExpvar(prefix)
+	entered := make(chan struct{}, 10)
+	client.EnableAuditLog(func(AuditRecord) {
+		entered <- struct{}{}
+		<-release
+	}, 1, WithAuditBuffer(2))
+
+	began := time.Now()
+	_, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+	<-entered
+
+	for i := 0; i < 9; i++ {
+		_, err := client.Get(server.URL, http.Header{})
+		require.NoError(t, err)
+	}
+
+	assert.True(t, time.Since(began) < time.Second, "a slow sink should not hold up requests")
+	// One record is held by the blocked sink and two wait in the buffer
+	assert.Equal(t, int64(7), atomic.LoadInt64(&client.current.audit.dropped))
+	assert.Equal(t, "7", expvar.Get(prefix+".audit_dropped").String())
+}
+
+func TestAuditJSONSinkWritesJSONLines(t *testing.T) {
+	var out bytes.Buffer
+	sink := NewAuditJSONSink(&out)
+
+	sink(AuditRecord{Method: http.MethodGet, URL: "https://example.com", StatusCode: 200, BytesIn: 5})
+	sink(AuditRecord{Method: http.MethodPost, URL: "https://example.com", Error: "boom"})
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 2)
+
+	var first map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &first))
+	assert.Equal(t, "GET", first["method"])
+	assert.Equal(t, float64(200), first["status_code"])
+	assert.Equal(t, float64(5), first["bytes_in"])
+	assert.Contains(t, lines[1], `"error":"boom"`)
+}
@@ -2,6 +2,8 @@ package heimdall
 
 import (
 	"math"
+	"math/rand"
+	"sync"
 	"time"
 )
 
@@ -10,6 +12,48 @@ type Backoff interface {
 	Next(retry int) time.Duration
 }
 
+// BackoffOption configures optional behaviour of a backoff strategy
+type BackoffOption func(*backoffOptions)
+
+type backoffOptions struct {
+	jitter float64
+	random func() float64
+}
+
+func newBackoffOptions(opts []BackoffOption) backoffOptions {
+	options := backoffOptions{
+		random: rand.Float64,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	return options
+}
+
+// WithBackoffJitter spreads each interval uniformly within the given fraction
+// of itself, so 0.2 turns a 1s interval into anything between 800ms and 1.2s.
+// The fraction is clamped to [0, 1] and jittered intervals never exceed the cap.
+func WithBackoffJitter(fraction float64) BackoffOption {
+	return func(options *backoffOptions) {
+		options.jitter = math.Max(0, math.Min(fraction, 1))
+	}
+}
+
+// apply jitters interval and caps it at maxInterval
+func (o backoffOptions) apply(interval, maxInterval time.Duration) time.Duration {
+	if o.jitter > 0 {
+		spread := float64(interval) * o.jitter
+		interval = time.Duration(float64(interval) - spread + 2*spread*o.random())
+	}
+
+	if interval > maxInterval || interval < 0 {
+		return maxInterval
+	}
+
+	return interval
+}
+
 type constantBackoff struct {
 	backoffInterval int64
 }
@@ -51,3 +95,141 @@ func (eb *exponentialBackoff) Next(retry int) time.Duration {
 
 	return time.Duration(math.Min(eb.initialTimeout+math.Pow(eb.exponentFactor, float64(retry)), eb.maxTimeout)) * time.Millisecond
 }
+
+type linearBackoff struct {
+	step        time.Duration
+	maxInterval time.Duration
+	options     backoffOptions
+}
+
+// NewLinearBackoff returns an instance of LinearBackoff, which waits step,
+// 2*step, 3*step and so on, capped at maxInterval
+func NewLinearBackoff(step, maxInterval time.Duration, opts ...BackoffOption) Backoff {
+	return &linearBackoff{
+		step:        step,
+		maxInterval: maxInterval,
+		options:     newBackoffOptions(opts),
+	}
+}
+
+// Next returns next time for retrying operation with linear strategy
+func (lb *linearBackoff) Next(retry int) time.Duration {
+	if retry <= 0 || lb.step <= 0 {
+		return 0 * time.Millisecond
+	}
+
+	if int64(retry) > int64(lb.maxInterval/lb.step) {
+		return lb.options.apply(lb.maxInterval, lb.maxInterval)
+	}
+
+	return lb.options.apply(time.Duration(retry)*lb.step, lb.maxInterval)
+}
+
+type fibonacciBackoff struct {
+	baseInterval time.Duration
+	maxInterval  time.Duration
+	options      backoffOptions
+}
+
+// NewFibonacciBackoff returns an instance of FibonacciBackoff, which waits
+// baseInterval times the Fibonacci sequence (1, 1, 2, 3, 5, ...), capped at
+// maxInterval
+func NewFibonacciBackoff(baseInterval, maxInterval time.Duration, opts ...BackoffOption) Backoff {
+	return &fibonacciBackoff{
+		baseInterval: baseInterval,
+		maxInterval:  maxInterval,
+		options:      newBackoffOptions(opts),
+	}
+}
+
+// Next returns next time for retrying operation with fibonacci strategy
+func (fb *fibonacciBackoff) Next(retry int) time.Duration {
+	if retry <= 0 || fb.baseInterval <= 0 {
+		return 0 * time.Millisecond
+	}
+
+	limit := int64(fb.maxInterval / fb.baseInterval)
+	previous, current := int64(0), int64(1)
+	for i := 1; i < retry && current <= limit; i++ {
+		if previous > limit-current {
+			current = limit + 1
+			break
+		}
+		previous, current = current, previous+current
+	}
+
+	if current > limit {
+		return fb.options.apply(fb.maxInterval, fb.maxInterval)
+	}
+
+	return fb.options.apply(time.Duration(current)*fb.baseInterval, fb.maxInterval)
+}
+
+// BackoffFactory is implemented by backoffs that keep state between the
+// retries of a single request. Retriers ask it for a fresh backoff per request
+// so that concurrent requests never share that state.
+type BackoffFactory interface {
+	NewRequestBackoff() Backoff
+}
+
+type decorrelatedJitterBackoff struct {
+	baseInterval time.Duration
+	maxInterval  time.Duration
+	random       func(n int64) int64
+
+	mu       sync.Mutex
+	previous time.Duration
+}
+
+// NewDecorrelatedJitterBackoff returns an instance of DecorrelatedJitterBackoff,
+// which sleeps for a random interval between baseInterval and three times the
+// previous sleep, capped at maxInterval
+func NewDecorrelatedJitterBackoff(baseInterval, maxInterval time.Duration) Backoff {
+	if maxInterval < baseInterval {
+		maxInterval = baseInterval
+	}
+
+	return &decorrelatedJitterBackoff{
+		baseInterval: baseInterval,
+		maxInterval:  maxInterval,
+		random:       rand.Int63n,
+	}
+}
+
+// NewRequestBackoff returns a copy of the backoff with no previous sleep
+func (db *decorrelatedJitterBackoff) NewRequestBackoff() Backoff {
+	return &decorrelatedJitterBackoff{
+		baseInterval: db.baseInterval,
+		maxInterval:  db.maxInterval,
+		random:       db.random,
+	}
+}
+
+// Next returns next time for retrying operation with decorrelated jitter strategy
+func (db *decorrelatedJitterBackoff) Next(retry int) time.Duration {
+	if retry <= 0 {
+		return 0 * time.Millisecond
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	previous := db.previous
+	if previous < db.baseInterval {
+		previous = db.baseInterval
+	}
+
+	upper := db.maxInterval
+	if previous <= db.maxInterval/3 {
+		upper = previous * 3
+	}
+
+	sleep := db.baseInterval
+	if upper > db.baseInterval {
+		sleep += time.Duration(db.random(int64(upper-db.baseInterval) + 1))
+	}
+
+	db.previous = sleep
+
+	return sleep
+}
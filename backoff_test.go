@@ -1,10 +1,12 @@
 package heimdall
 
 import (
+	"math"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestExponentialBackoffNextTime(t *testing.T) {
@@ -48,3 +50,178 @@ func TestConstantBackoffWhenRetryIsZero(t *testing.T) {
 
 	assert.Equal(t, 0*time.Millisecond, constantBackoff.Next(0))
 }
+
+func TestDecorrelatedJitterBackoffStaysWithinBounds(t *testing.T) {
+	base := 10 * time.Millisecond
+	max := 500 * time.Millisecond
+
+	for sample := 0; sample < 1000; sample++ {
+		backoff := NewDecorrelatedJitterBackoff(base, max).(BackoffFactory).NewRequestBackoff()
+
+		previous := base
+		for retry := 1; retry <= 10; retry++ {
+			sleep := backoff.Next(retry)
+
+			upper := previous * 3
+			if upper > max {
+				upper = max
+			}
+			require.True(t, sleep >= base, "sleep %v below base", sleep)
+			require.True(t, sleep <= upper, "sleep %v above %v", sleep, upper)
+
+			previous = sleep
+		}
+	}
+}
+
+func TestDecorrelatedJitterBackoffIsUniformlyDistributed(t *testing.T) {
+	base := 100 * time.Millisecond
+	factory := NewDecorrelatedJitterBackoff(base, time.Minute).(BackoffFactory)
+
+	samples := 20000
+	buckets := make([]int, 4)
+	var total time.Duration
+	for i := 0; i < samples; i++ {
+		sleep := factory.NewRequestBackoff().Next(1)
+		total += sleep
+
+		// The first sleep is drawn from [base, 3*base]
+		bucket := int((sleep - base) * 4 / (2*base + 1))
+		buckets[bucket]++
+	}
+
+	mean := total / time.Duration(samples)
+	assert.InDelta(t, float64(2*base), float64(mean), float64(base)/20)
+
+	for _, count := range buckets {
+		assert.InDelta(t, samples/4, count, float64(samples)/40)
+	}
+}
+
+func TestDecorrelatedJitterBackoffIsCappedWithoutOverflow(t *testing.T) {
+	max := time.Duration(math.MaxInt64)
+	backoff := NewDecorrelatedJitterBackoff(time.Hour, max).(*decorrelatedJitterBackoff)
+	backoff.random = func(n int64) int64 { return n - 1 }
+
+	for retry := 1; retry <= 50; retry++ {
+		assert.True(t, backoff.Next(retry) > 0)
+	}
+	assert.Equal(t, max, backoff.Next(51))
+}
+
+func TestDecorrelatedJitterBackoffWhenRetryIsZero(t *testing.T) {
+
+	backoff := NewDecorrelatedJitterBackoff(2*time.Millisecond, 10*time.Millisecond)
+
+	assert.Equal(t, 0*time.Millisecond, backoff.Next(0))
+}
+
+func TestDecorrelatedJitterBackoffWithMaxBelowBase(t *testing.T) {
+
+	backoff := NewDecorrelatedJitterBackoff(20*time.Millisecond, 10*time.Millisecond)
+
+	assert.Equal(t, 20*time.Millisecond, backoff.Next(1))
+	assert.Equal(t, 20*time.Millisecond, backoff.Next(2))
+}
+
+func TestLinearBackoffNextTime(t *testing.T) {
+	backoff := NewLinearBackoff(time.Second, 5*time.Second)
+
+	tests := []struct {
+		retry    int
+		expected time.Duration
+	}{
+		{0, 0},
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 3 * time.Second},
+		{5, 5 * time.Second},
+		{6, 5 * time.Second},
+		{math.MaxInt32, 5 * time.Second},
+		{math.MaxInt64, 5 * time.Second},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, backoff.Next(test.retry), "retry %d", test.retry)
+	}
+}
+
+func TestLinearBackoffWithoutOverflowForLargeCaps(t *testing.T) {
+	backoff := NewLinearBackoff(time.Hour, time.Duration(math.MaxInt64))
+
+	assert.Equal(t, time.Duration(math.MaxInt64), backoff.Next(math.MaxInt64))
+	assert.Equal(t, 1000*time.Hour, backoff.Next(1000))
+}
+
+func TestFibonacciBackoffNextTime(t *testing.T) {
+	backoff := NewFibonacciBackoff(10*time.Millisecond, time.Second)
+
+	tests := []struct {
+		retry    int
+		expected time.Duration
+	}{
+		{0, 0},
+		{1, 10 * time.Millisecond},
+		{2, 10 * time.Millisecond},
+		{3, 20 * time.Millisecond},
+		{4, 30 * time.Millisecond},
+		{5, 50 * time.Millisecond},
+		{6, 80 * time.Millisecond},
+		{11, 890 * time.Millisecond},
+		{12, time.Second},
+		{math.MaxInt64, time.Second},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, backoff.Next(test.retry), "retry %d", test.retry)
+	}
+}
+
+func TestFibonacciBackoffWithoutOverflowForLargeCaps(t *testing.T) {
+	max := time.Duration(math.MaxInt64)
+	backoff := NewFibonacciBackoff(time.Nanosecond, max)
+
+	assert.Equal(t, time.Duration(7540113804746346429), backoff.Next(92))
+	assert.Equal(t, max, backoff.Next(93))
+	assert.Equal(t, max, backoff.Next(math.MaxInt64))
+}
+
+func TestBackoffJitterStaysWithinFraction(t *testing.T) {
+	backoffs := map[string]Backoff{
+		"linear":    NewLinearBackoff(time.Second, time.Minute, WithBackoffJitter(0.25)),
+		"fibonacci": NewFibonacciBackoff(time.Second, time.Minute, WithBackoffJitter(0.25)),
+	}
+
+	for name, backoff := range backoffs {
+		var lowest, highest time.Duration = time.Hour, 0
+		for i := 0; i < 1000; i++ {
+			sleep := backoff.Next(4)
+			if sleep < lowest {
+				lowest = sleep
+			}
+			if sleep > highest {
+				highest = sleep
+			}
+		}
+
+		// Linear waits 4s and fibonacci 3s on the fourth retry
+		expected := 4 * time.Second
+		if name == "fibonacci" {
+			expected = 3 * time.Second
+		}
+		assert.True(t, lowest >= expected*3/4, "%s: %v below jitter range", name, lowest)
+		assert.True(t, highest <= expected*5/4, "%s: %v above jitter range", name, highest)
+		assert.True(t, highest-lowest > expected/4, "%s: intervals are not spread", name)
+	}
+}
+
+func TestBackoffJitterNeverExceedsCap(t *testing.T) {
+	backoff := NewLinearBackoff(time.Second, 2*time.Second, WithBackoffJitter(1)).(*linearBackoff)
+	backoff.options.random = func() float64 { return 1 }
+
+	assert.Equal(t, 2*time.Second, backoff.Next(2))
+	assert.Equal(t, 2*time.Second, backoff.Next(math.MaxInt64))
+
+	backoff.options.random = func() float64 { return 0 }
+	assert.Equal(t, time.Duration(0), backoff.Next(1))
+}
@@ -0,0 +1,161 @@
+package heimdall
+
+import (
+	"context"
+	"net/http"
+	"unicode/utf8"
+)
+
+type baggageKey struct{}
+
+// ContextWithBaggage returns a copy of ctx carrying value for the header
+// named, such as W3C baggage, which clients propagating the header with
+// SetBaggagePropagation set on the requests sent with the context. An empty
+// value stops the header from being propagated.
+func ContextWithBaggage(ctx context.Context, name, value string) context.Context {
+	parent, _ := ctx.Value(baggageKey{}).(map[string]string)
+	values := make(map[string]string, len(parent)+1)
+	for key, v := range parent {
+		values[key] = v
+	}
+
+	name = http.CanonicalHeaderKey(name)
+	if value == "" {
+		delete(values, name)
+	} else {
+		values[name] = value
+	}
+
+	return context.WithValue(ctx, baggageKey{}, values)
+}
+
+// BaggageFromContext returns the value ctx carries for the header named, if
+// any
+func BaggageFromContext(ctx context.Context, name string) string {
+	values, _ := ctx.Value(baggageKey{}).(map[string]string)
+	return values[http.CanonicalHeaderKey(name)]
+}
+
+// BaggageOption configures how SetBaggagePropagation treats oversized values
+type BaggageOption func(*baggagePropagation)
+
+// WithBaggageValueLimit makes values longer than n bytes oversized, on top of
+// those too long to fit the budget on their own
+func WithBaggageValueLimit(n int) BaggageOption {
+	return func(p *baggagePropagation) {
+		p.valueLimit = n
+	}
+}
+
+// WithBaggageTruncation truncates oversized values to fit, ending them with
+// marker, instead of dropping them. Values none of which fits beside the
+// marker are dropped still.
+func WithBaggageTruncation(marker string) BaggageOption {
+	return func(p *baggagePropagation) {
+		p.truncate = true
+		p.marker = marker
+	}
+}
+
+// baggagePropagation sets the allowed headers the context of a request
+// carries on the request, within a budget
+type baggagePropagation struct {
+	// allowlist are the canonical names of the headers, highest priority first
+	allowlist  []string
+	maxTotal   int
+	valueLimit int
+	truncate   bool
+	marker     string
+}
+
+func newBaggagePropagation(allowlist []string, maxTotalBytes int, opts []BaggageOption) *baggagePropagation {
+	if len(allowlist) == 0 {
+		return nil
+	}
+
+	p := &baggagePropagation{maxTotal: maxTotalBytes}
+	seen := make(map[string]bool, len(allowlist))
+	for _, name := range allowlist {
+		if name = http.CanonicalHeaderKey(name); !seen[name] {
+			seen[name] = true
+			p.allowlist = append(p.allowlist, name)
+		}
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	return p
+}
+
+type baggageEntry struct {
+	name  string
+	value string
+}
+
+func (e baggageEntry) size() int {
+	return len(e.name) + len(e.value)
+}
+
+// apply sets the headers the context of request carries on a copy of its
+// headers, dropping the entries of lowest priority until they fit the budget.
+// Headers the request sets keep their value.
+func (p *baggagePropagation) apply(request *http.Request) {
+	if p == nil {
+		return
+	}
+	values, _ := request.Context().Value(baggageKey{}).(map[string]string)
+	if len(values) == 0 {
+		return
+	}
+
+	var entries []baggageEntry
+	total := 0
+	for _, name := range p.allowlist {
+		value, ok := values[name]
+		if !ok || len(request.Header.Values(name)) > 0 {
+			continue
+		}
+		if value, ok = p.fit(name, value); ok {
+			entries = append(entries, baggageEntry{name: name, value: value})
+			total += len(name) + len(value)
+		}
+	}
+	for p.maxTotal > 0 && total > p.maxTotal {
+		total -= entries[len(entries)-1].size()
+		entries = entries[:len(entries)-1]
+	}
+	if len(entries) == 0 {
+		return
+	}
+
+	request.Header = copyHeader(request.Header)
+	for _, entry := range entries {
+		request.Header.Set(entry.name, entry.value)
+	}
+}
+
+// fit returns value when it is not oversized, and otherwise value truncated
+// to the longest value allowed or false, as the policy says
+func (p *baggagePropagation) fit(name, value string) (string, bool) {
+	limit, limited := p.valueLimit, p.valueLimit > 0
+	if p.maxTotal > 0 && (!limited || p.maxTotal-len(name) < limit) {
+		limit, limited = p.maxTotal-len(name), true
+	}
+	if !limited || len(value) <= limit {
+		return value, true
+	}
+	if !p.truncate {
+		return "", false
+	}
+
+	cut := limit - len(p.marker)
+	for cut > 0 && !utf8.RuneStart(value[cut]) {
+		cut--
+	}
+	if cut <= 0 {
+		return "", false
+	}
+
+	return value[:cut] + p.marker, true
+}
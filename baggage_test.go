@@ -0,0 +1,192 @@
+package heimdall
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// baggageServer records the headers of every request, answering the first
+// failures with 503
+type baggageServer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	headers []http.Header
+}
+
+func newBaggageServer(failures int) *baggageServer {
+	s := &baggageServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		s.headers = append(s.headers, r.Header.Clone())
+		if len(s.headers) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+
+	return s
+}
+
+func (s *baggageServer) received() []http.Header {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.headers
+}
+
+func getWithContext(t *testing.T, client testClient, ctx context.Context, url string, headers http.Header) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	require.NoError(t, err)
+	request.Header = headers
+
+	_, err = client.Do(request)
+	require.NoError(t, err)
+}
+
+func TestBaggageIsPropagatedOnEveryAttempt(t *testing.T) {
+	for kind, newClient := range retryClients {
+		server := newBaggageServer(1)
+		defer server.Close()
+
+		client := newClient("baggage_attempts_"+kind, realClock{})
+		client.SetRetryCount(1)
+		client.SetBaggagePropagation([]string{"baggage", "X-Tenant-Context"}, 0)
+
+		ctx := ContextWithBaggage(context.Background(), "Baggage", "user=42,region=eu")
+		ctx = ContextWithBaggage(ctx, "x-tenant-context", "acme")
+		ctx = ContextWithBaggage(ctx, "X-Other", "not allowed")
+		headers := http.Header{}
+		getWithContext(t, client, ctx, server.URL, headers)
+
+		received := server.received()
+		require.Len(t, received, 2, kind)
+		for _, h := range received {
+			assert.Equal(t, "user=42,region=eu", h.Get("Baggage"), kind)
+			assert.Equal(t, "acme", h.Get("X-Tenant-Context"), kind)
+			assert.Empty(t, h.Get("X-Other"), "%s: headers not allowed are not sent", kind)
+		}
+		assert.Empty(t, headers, "%s: the headers of the caller are left alone", kind)
+	}
+}
+
+func TestBaggageIsAbsentWhenTheContextCarriesNone(t *testing.T) {
+	server := newBaggageServer(0)
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+	client.SetBaggagePropagation([]string{"Baggage"}, 100)
+	getWithContext(t, client, context.Background(), server.URL, http.Header{})
+	_, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+
+	emptied := ContextWithBaggage(ContextWithBaggage(context.Background(), "Baggage", "a=1"), "Baggage", "")
+	getWithContext(t, client, emptied, server.URL, http.Header{})
+
+	for _, h := range server.received() {
+		_, ok := h["Baggage"]
+		assert.False(t, ok, "no header is sent, not even an empty one")
+	}
+}
+
+func TestBaggageBudgetDropsTheLowestPriorityFirst(t *testing.T) {
+	ctx := ContextWithBaggage(context.Background(), "A", strings.Repeat("a", 9))
+	ctx = ContextWithBaggage(ctx, "B", strings.Repeat("b", 9))
+	ctx = ContextWithBaggage(ctx, "C", strings.Repeat("c", 9))
+
+	for name, tc := range map[string]struct {
+		allowlist []string
+		budget    int
+		want      []string
+	}{
+		"everything fits":     {allowlist: []string{"A", "B", "C"}, budget: 30, want: []string{"A", "B", "C"}},
+		"the last is dropped": {allowlist: []string{"A", "B", "C"}, budget: 29, want: []string{"A", "B"}},
+		"priority is kept":    {allowlist: []string{"C", "A", "B"}, budget: 20, want: []string{"C", "A"}},
+		"only the first fits": {allowlist: []string{"B", "C", "A"}, budget: 19, want: []string{"B"}},
+		"missing are skipped": {allowlist: []string{"D", "C", "B"}, budget: 20, want: []string{"C", "B"}},
+		"no budget":           {allowlist: []string{"A", "B", "C"}, budget: 0, want: []string{"A", "B", "C"}},
+	} {
+		server := newBaggageServer(0)
+		client := NewHTTPClient(1000)
+		client.SetBaggagePropagation(tc.allowlist, tc.budget)
+		getWithContext(t, client, ctx, server.URL, http.Header{})
+		server.Close()
+
+		var sent []string
+		for _, header := range tc.allowlist {
+			if server.received()[0].Get(header) != "" {
+				sent = append(sent, header)
+			}
+		}
+		assert.Equal(t, tc.want, sent, name)
+	}
+}
+
+func TestOversizedBaggageIsDroppedOrTruncated(t *testing.T) {
+	ctx := ContextWithBaggage(context.Background(), "Baggage", "user=42,session=0123456789")
+	ctx = ContextWithBaggage(ctx, "X-Small", "ok")
+
+	for name, tc := range map[string]struct {
+		budget int
+		opts   []BaggageOption
+		want   string
+	}{
+		"dropped by default":         {budget: 20},
+		"truncated to the budget":    {budget: 20, opts: []BaggageOption{WithBaggageTruncation("…")}, want: "user=42,se…"},
+		"truncated without a marker": {budget: 20, opts: []BaggageOption{WithBaggageTruncation("")}, want: "user=42,sessi"},
+		"over the value limit":       {budget: 100, opts: []BaggageOption{WithBaggageValueLimit(10)}},
+		"truncated to the limit":     {budget: 100, opts: []BaggageOption{WithBaggageValueLimit(10), WithBaggageTruncation("~")}, want: "user=42,s~"},
+		"marker too long":            {budget: 20, opts: []BaggageOption{WithBaggageTruncation(strings.Repeat("~", 13))}},
+		"within the limit":           {budget: 100, opts: []BaggageOption{WithBaggageValueLimit(26)}, want: "user=42,session=0123456789"},
+	} {
+		server := newBaggageServer(0)
+		client := NewHTTPClient(1000)
+		client.SetBaggagePropagation([]string{"Baggage", "X-Small"}, tc.budget, tc.opts...)
+		getWithContext(t, client, ctx, server.URL, http.Header{})
+		server.Close()
+
+		received := server.received()[0]
+		assert.Equal(t, tc.want, received.Get("Baggage"), name)
+		if tc.budget < 100 && tc.want != "" {
+			assert.Empty(t, received.Get("X-Small"), "%s: a truncated value may take the whole budget", name)
+		} else {
+			assert.Equal(t, "ok", received.Get("X-Small"), "%s: smaller values are still sent", name)
+		}
+	}
+}
+
+func TestBaggageTruncationKeepsRunesWhole(t *testing.T) {
+	propagation := newBaggagePropagation([]string{"Baggage"}, 0, []BaggageOption{WithBaggageValueLimit(5), WithBaggageTruncation(".")})
+
+	value, ok := propagation.fit("Baggage", "ab€cd")
+	assert.True(t, ok)
+	assert.Equal(t, "ab.", value, "the euro sign, 3 bytes long, does not fit whole")
+}
+
+func TestBaggageSetOnTheRequestWins(t *testing.T) {
+	server := newBaggageServer(0)
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+	client.SetBaggagePropagation([]string{"Baggage", "X-Context"}, 30)
+	derived := client.Derive()
+	client.SetBaggagePropagation(nil, 0)
+
+	ctx := ContextWithBaggage(context.Background(), "Baggage", "from=context")
+	ctx = ContextWithBaggage(ctx, "X-Context", "1")
+	getWithContext(t, derived, ctx, server.URL, http.Header{"Baggage": {"from=request"}})
+	getWithContext(t, client, ctx, server.URL, http.Header{})
+
+	received := server.received()
+	assert.Equal(t, []string{"from=request"}, received[0].Values("Baggage"))
+	assert.Equal(t, "1", received[0].Get("X-Context"), "the derived client keeps the propagation")
+	assert.Empty(t, received[1].Get("Baggage"), "an empty allowlist propagates nothing")
+	assert.Equal(t, "from=context", BaggageFromContext(ctx, "baggage"))
+}
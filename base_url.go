@@ -0,0 +1,97 @@
+package heimdall
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// baseURL resolves relative request URLs against the base set with SetBaseURL
+type baseURL struct {
+	mu   sync.RWMutex
+	base *url.URL
+	err  error
+}
+
+func (b *baseURL) set(raw string) {
+	var base *url.URL
+	var err error
+	if raw != "" {
+		base, err = url.Parse(raw)
+		if err == nil && (base.Scheme == "" || base.Host == "") {
+			err = errors.Errorf("base URL %q is not absolute", raw)
+		}
+		if err != nil {
+			base = nil
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.base, b.err = base, err
+}
+
+// clone returns a copy of b which can be set independently
+func (b *baseURL) clone() *baseURL {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return &baseURL{base: b.base, err: b.err}
+}
+
+// resolve returns u joined onto the base URL. Absolute URLs, and every URL
+// while no base is set, are returned unchanged. The base path is kept as a
+// prefix of the relative path, and query parameters of both are merged with
+// those of u taking precedence.
+func (b *baseURL) resolve(u *url.URL) (*url.URL, error) {
+	if u.IsAbs() || u.Host != "" {
+		return u, nil
+	}
+
+	b.mu.RLock()
+	base, err := b.base, b.err
+	b.mu.RUnlock()
+
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid base URL")
+	}
+	if base == nil {
+		return u, nil
+	}
+
+	resolved := *base
+	resolved.Path = joinURLPath(base.Path, u.Path)
+	resolved.RawPath = ""
+	if base.RawPath != "" || u.RawPath != "" {
+		resolved.RawPath = joinURLPath(base.EscapedPath(), u.EscapedPath())
+	}
+	resolved.RawQuery = mergeQuery(base.RawQuery, u.RawQuery)
+	resolved.Fragment = u.Fragment
+
+	return &resolved, nil
+}
+
+func joinURLPath(base, relative string) string {
+	if relative == "" {
+		return base
+	}
+
+	return strings.TrimRight(base, "/") + "/" + strings.TrimLeft(relative, "/")
+}
+
+func mergeQuery(base, relative string) string {
+	if base == "" || relative == "" {
+		return base + relative
+	}
+
+	merged, _ := url.ParseQuery(base)
+	overrides, _ := url.ParseQuery(relative)
+	for key, values := range overrides {
+		merged[key] = values
+	}
+
+	return merged.Encode()
+}
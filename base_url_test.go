@@ -0,0 +1,146 @@
+package heimdall
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBaseURLResolve(t *testing.T) {
+	tests := []struct {
+		name     string
+		base     string
+		url      string
+		expected string
+	}{
+		{"no base", "", "/v1/users", "/v1/users"},
+		{"leading slash", "http://api.example.com", "/v1/users/42", "http://api.example.com/v1/users/42"},
+		{"no leading slash", "http://api.example.com", "v1/users/42", "http://api.example.com/v1/users/42"},
+		{"base trailing slash", "http://api.example.com/", "/v1/users", "http://api.example.com/v1/users"},
+		{"base path prefix", "http://api.example.com/service/", "/v1/users", "http://api.example.com/service/v1/users"},
+		{"base path without slash", "http://api.example.com/service", "v1/users", "http://api.example.com/service/v1/users"},
+		{"relative trailing slash", "http://api.example.com/service", "/v1/users/", "http://api.example.com/service/v1/users/"},
+		{"empty relative path", "http://api.example.com/service?key=1", "", "http://api.example.com/service?key=1"},
+		{"base query", "http://api.example.com?key=secret", "/v1/users", "http://api.example.com/v1/users?key=secret"},
+		{"relative query", "http://api.example.com", "/v1/users?page=2", "http://api.example.com/v1/users?page=2"},
+		{"merged query", "http://api.example.com?key=secret&page=1", "/v1/users?page=2&sort=name", "http://api.example.com/v1/users?key=secret&page=2&sort=name"},
+		{"escaped path", "http://api.example.com/a%2Fb", "/c%20d", "http://api.example.com/a%2Fb/c%20d"},
+		{"fragment", "http://api.example.com", "/docs#intro", "http://api.example.com/docs#intro"},
+		{"absolute override", "http://api.example.com/service", "https://other.example.com/v2?x=1", "https://other.example.com/v2?x=1"},
+		{"scheme relative override", "http://api.example.com", "//other.example.com/v2", "//other.example.com/v2"},
+	}
+
+	for _, test := range tests {
+		b := &baseURL{}
+		b.set(test.base)
+
+		u, err := url.Parse(test.url)
+		require.NoError(t, err, test.name)
+
+		resolved, err := b.resolve(u)
+		require.NoError(t, err, test.name)
+		assert.Equal(t, test.expected, resolved.String(), test.name)
+	}
+}
+
+func TestBaseURLRejectsRelativeBase(t *testing.T) {
+	b := &baseURL{}
+	b.set("api.example.com/v1")
+
+	_, err := b.resolve(&url.URL{Path: "/users"})
+	require.Error(t, err)
+	assert.Equal(t, `invalid base URL: base URL "api.example.com/v1" is not absolute`, err.Error())
+
+	resolved, err := b.resolve(&url.URL{Scheme: "http", Host: "example.com", Path: "/users"})
+	require.NoError(t, err, "absolute URLs do not need the base")
+	assert.Equal(t, "http://example.com/users", resolved.String())
+}
+
+func testRelativeRequests(t *testing.T, client testClient) {
+	var paths []string
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.RequestURI())
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	client.SetBaseURL(server.URL + "/api/?key=secret")
+
+	_, err := client.Get("/v1/users/42", nil)
+	require.NoError(t, err)
+
+	_, err = client.Delete("v1/users/42?soft=true", nil)
+	require.NoError(t, err)
+
+	request, err := http.NewRequest(http.MethodGet, "/v1/users", nil)
+	require.NoError(t, err)
+	_, err = client.Do(request)
+	require.NoError(t, err)
+	assert.Equal(t, "/v1/users", request.URL.String(), "the caller's request keeps its URL")
+
+	assert.Equal(t, []string{
+		"/api/v1/users/42?key=secret",
+		"/api/v1/users/42?key=secret&soft=true",
+		"/api/v1/users?key=secret",
+	}, paths)
+}
+
+func TestHTTPClientResolvesRelativeURLsAgainstBase(t *testing.T) {
+	testRelativeRequests(t, NewHTTPClient(100))
+}
+
+func TestHystrixHTTPClientResolvesRelativeURLsAgainstBase(t *testing.T) {
+	testRelativeRequests(t, NewHystrixHTTPClient(100, NewHystrixConfig("base_url_command", HystrixCommandConfig{})))
+}
+
+func TestGetSSEResolvesRelativeURLAgainstBase(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/stream/events", r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(100)
+	client.SetBaseURL(server.URL + "/stream")
+
+	_, _, err := client.GetSSE(context.Background(), "/events", nil)
+	require.Error(t, err)
+	assert.Equal(t, "SSE - unexpected status code: 204", err.Error())
+}
+
+func TestHTTPClientBaseURLCanChangeDuringRequests(t *testing.T) {
+	first := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer first.Close()
+	second := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer second.Close()
+
+	client := NewHTTPClient(1000)
+	client.SetBaseURL(first.URL)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := client.Get("/ping", nil)
+			assert.NoError(t, err)
+		}()
+		go func(i int) {
+			defer wg.Done()
+			if i%2 == 0 {
+				client.SetBaseURL(second.URL)
+			} else {
+				client.SetBaseURL(first.URL)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
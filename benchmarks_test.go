@@ -0,0 +1,186 @@
+package heimdall
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	allocTolerance = flag.Float64("alloc-tolerance", 25, "percentage by which allocations per op may exceed the stored baseline")
+	updateBaseline = flag.Bool("update-baseline", false, "rewrite the stored benchmark baseline with the current allocations per op")
+)
+
+const benchmarkBaselineFile = "bench_baseline.json"
+
+// guardedBenchmarks are compared against the stored baseline by
+// TestBenchmarkAllocationsWithinBaseline
+var guardedBenchmarks = map[string]func(b *testing.B){
+	"SmallGet":           benchmarkSmallGet,
+	"LargeBodyRead":      benchmarkLargeBodyRead,
+	"RetryFailingServer": benchmarkRetryFailingServer,
+	"HystrixSmallGet":    benchmarkHystrixSmallGet,
+}
+
+func BenchmarkSmallGet(b *testing.B)           { benchmarkSmallGet(b) }
+func BenchmarkLargeBodyRead(b *testing.B)      { benchmarkLargeBodyRead(b) }
+func BenchmarkConcurrentFanOut(b *testing.B)   { benchmarkConcurrentFanOut(b) }
+func BenchmarkRetryFailingServer(b *testing.B) { benchmarkRetryFailingServer(b) }
+func BenchmarkHystrixSmallGet(b *testing.B)    { benchmarkHystrixSmallGet(b) }
+
+func benchmarkGet(b *testing.B, client Client, handler http.HandlerFunc) {
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := client.Get(server.URL, http.Header{}); err != nil && !isRetriesExhausted(err) {
+			b.Fatal(err)
+		}
+	}
+}
+
+func isRetriesExhausted(err error) bool {
+	_, ok := err.(*RetriesExhaustedError)
+	return ok
+}
+
+func smallBodyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(`{ "response": "ok" }`))
+}
+
+func benchmarkSmallGet(b *testing.B) {
+	benchmarkGet(b, NewHTTPClient(1000, WithKeepAlive()), smallBodyHandler)
+}
+
+func benchmarkLargeBodyRead(b *testing.B) {
+	body := bytes.Repeat([]byte("x"), 1<<20)
+	b.SetBytes(int64(len(body)))
+
+	benchmarkGet(b, NewHTTPClient(5000, WithKeepAlive()), func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	})
+}
+
+func benchmarkRetryFailingServer(b *testing.B) {
+	client := NewHTTPClient(1000, WithKeepAlive())
+	client.SetRetryCount(2)
+
+	benchmarkGet(b, client, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+}
+
+func benchmarkHystrixSmallGet(b *testing.B) {
+	client := NewHystrixHTTPClient(1000, NewHystrixConfig("benchmark_command", HystrixCommandConfig{
+		Timeout:               1000,
+		MaxConcurrentRequests: 1000,
+	}), WithKeepAlive())
+
+	benchmarkGet(b, client, smallBodyHandler)
+}
+
+func benchmarkConcurrentFanOut(b *testing.B) {
+	server := httptest.NewServer(http.HandlerFunc(smallBodyHandler))
+	defer server.Close()
+
+	client := NewHTTPClient(5000, WithKeepAlive())
+	fanOut := 100
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		var wg sync.WaitGroup
+		wg.Add(fanOut)
+		for j := 0; j < fanOut; j++ {
+			go func() {
+				defer wg.Done()
+				if _, err := client.Get(server.URL, http.Header{}); err != nil {
+					b.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+// TestBenchmarkAllocationsWithinBaseline runs the guarded benchmarks and fails
+// when allocations per op exceed the stored baseline by more than
+// -alloc-tolerance percent. Run with -update-baseline to record new numbers.
+func TestBenchmarkAllocationsWithinBaseline(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping benchmarks in short mode")
+	}
+
+	// A fixed iteration count keeps the guard quick while still averaging out
+	// one-off allocations such as connection setup
+	benchtime := flag.Lookup("test.benchtime").Value.String()
+	flag.Set("test.benchtime", "200x")
+	defer flag.Set("test.benchtime", benchtime)
+
+	path := filepath.Join("testdata", benchmarkBaselineFile)
+
+	current := map[string]int64{}
+	for name, benchmark := range guardedBenchmarks {
+		current[name] = testing.Benchmark(benchmark).AllocsPerOp()
+	}
+
+	if *updateBaseline {
+		data, err := json.MarshalIndent(current, "", "  ")
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(path, append(data, '\n'), 0644))
+		return
+	}
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+
+	baseline := map[string]int64{}
+	require.NoError(t, json.Unmarshal(data, &baseline))
+
+	for _, regression := range allocationRegressions(baseline, current, *allocTolerance) {
+		t.Error(regression)
+	}
+}
+
+// allocationRegressions lists the benchmarks whose allocations per op exceed
+// their baseline by more than tolerance percent
+func allocationRegressions(baseline, current map[string]int64, tolerance float64) []string {
+	var regressions []string
+	for name, allocs := range current {
+		expected, ok := baseline[name]
+		if !ok {
+			continue
+		}
+
+		limit := float64(expected) * (1 + tolerance/100)
+		if float64(allocs) > limit {
+			regressions = append(regressions, name+": "+strconv.FormatInt(allocs, 10)+" allocs/op, baseline "+strconv.FormatInt(expected, 10))
+		}
+	}
+	sort.Strings(regressions)
+
+	return regressions
+}
+
+func TestAllocationRegressionsRespectTolerance(t *testing.T) {
+	baseline := map[string]int64{"SmallGet": 100, "LargeBodyRead": 40}
+	current := map[string]int64{"SmallGet": 110, "LargeBodyRead": 52, "Unknown": 999}
+
+	require.Empty(t, allocationRegressions(baseline, current, 30))
+	require.Equal(t, []string{"LargeBodyRead: 52 allocs/op, baseline 40"}, allocationRegressions(baseline, current, 20))
+	require.Equal(t, []string{"LargeBodyRead: 52 allocs/op, baseline 40", "SmallGet: 110 allocs/op, baseline 100"}, allocationRegressions(baseline, current, 5))
+}
@@ -0,0 +1,105 @@
+package heimdall
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+const defaultDrainLimit int64 = 4 << 10
+
+// ErrTruncatedBody is returned when the body of a response read in full is
+// shorter than the Content-Length of the response, or a chunked body ends
+// before its last chunk, as when a proxy closes the connection early. Attempts
+// failing with it are retried. It unwraps to io.ErrUnexpectedEOF.
+type ErrTruncatedBody struct {
+	// Expected is the Content-Length of the response, -1 for a body of
+	// unknown length such as a chunked one
+	Expected int64
+	// Got is the number of bytes read
+	Got int64
+}
+
+func (e *ErrTruncatedBody) Error() string {
+	if e.Expected < 0 {
+		return fmt.Sprintf("truncated body: ended after %d bytes", e.Got)
+	}
+
+	return fmt.Sprintf("truncated body: read %d of the %d bytes of Content-Length", e.Got, e.Expected)
+}
+
+// Unwrap returns io.ErrUnexpectedEOF
+func (e *ErrTruncatedBody) Unwrap() error {
+	return io.ErrUnexpectedEOF
+}
+
+// readBody reads and closes the body of response. When the body is only
+// kept for the error of a retried attempt, at most limit bytes are read, so
+// that a small body leaves the connection reusable while a large one is cut
+// short: closing a body with unread bytes makes the transport drop the
+// connection rather than read on. Bodies read in full fail with an
+// *ErrTruncatedBody when strict and cut short.
+func readBody(response *http.Response, whole bool, limit int64, strict bool) ([]byte, error) {
+	if response.Body == nil {
+		return nil, nil
+	}
+	defer response.Body.Close()
+
+	if !whole {
+		return ioutil.ReadAll(io.LimitReader(response.Body, limit))
+	}
+
+	body, err := ioutil.ReadAll(response.Body)
+	return body, checkBodyLength(response, int64(len(body)), err, strict)
+}
+
+// checkBodyLength returns the error of reading got bytes of the body of
+// response with err, an *ErrTruncatedBody when strict and the body was cut
+// short
+func checkBodyLength(response *http.Response, got int64, err error, strict bool) error {
+	if !strict {
+		return err
+	}
+
+	switch {
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return &ErrTruncatedBody{Expected: response.ContentLength, Got: got}
+	case err == nil && got < response.ContentLength:
+		// The transport checks the length itself, but transports swapped in
+		// and middlewares may not
+		return &ErrTruncatedBody{Expected: response.ContentLength, Got: got}
+	}
+
+	return err
+}
+
+// closeBody closes the body of response, if it has one, without reading it
+func closeBody(response *http.Response) {
+	if response.Body != nil {
+		response.Body.Close()
+	}
+}
+
+// expectsBody reports whether a response with statusCode to a request with
+// method may carry a body. Responses to HEAD, informational responses, 204
+// and 304 never do, so their bodies are not read.
+func expectsBody(method string, statusCode int) bool {
+	switch {
+	case method == http.MethodHead:
+		return false
+	case statusCode >= 100 && statusCode < 200:
+		return false
+	case statusCode == http.StatusNoContent || statusCode == http.StatusNotModified:
+		return false
+	}
+
+	return true
+}
+
+// readWholeBody reports whether the body of an attempt is read in full. Error
+// bodies of attempts that will be retried are truncated to the drain limit.
+func readWholeBody(response *http.Response, attempt, retryCount int) bool {
+	return response.StatusCode < http.StatusInternalServerError || attempt >= retryCount
+}
@@ -0,0 +1,135 @@
+package heimdall
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrBodyBudgetExceeded is returned, without sending any attempt, when the
+// body of a request does not fit in the budget set with
+// SetMaxInFlightBodyBytes, either because it is larger than the whole budget
+// or because the bodies of other requests did not leave room for it within
+// the wait set with WithBodyBudgetWait
+type ErrBodyBudgetExceeded struct {
+	// Size is the Content-Length of the request body
+	Size int64
+	// Budget is the budget of the client, InFlight the bytes of the bodies of
+	// the other requests when the request gave up
+	Budget   int64
+	InFlight int64
+}
+
+func (e *ErrBodyBudgetExceeded) Error() string {
+	return fmt.Sprintf("request body of %d bytes exceeds the in-flight body budget of %d bytes with %d bytes in flight", e.Size, e.Budget, e.InFlight)
+}
+
+// WithBodyBudgetWait lets requests whose bodies do not fit in the budget set
+// with SetMaxInFlightBodyBytes wait up to wait for other requests to finish,
+// rather than failing at once
+func WithBodyBudgetWait(wait time.Duration) Option {
+	return func(options *clientOptions) {
+		options.bodyBudgetWait = wait
+	}
+}
+
+// bodyBudget bounds the bytes of the bodies of the requests of a client in
+// flight
+type bodyBudget struct {
+	mu       sync.Mutex
+	max      int64
+	inFlight int64
+	// released is closed, and replaced, whenever room is freed or the budget
+	// is raised
+	released chan struct{}
+}
+
+func newBodyBudget() *bodyBudget {
+	return &bodyBudget{released: make(chan struct{})}
+}
+
+// set replaces the budget, zero or less for none
+func (b *bodyBudget) set(max int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.max = max
+	b.wake()
+}
+
+// clone returns a budget of the same size with nothing in flight
+func (b *bodyBudget) clone() *bodyBudget {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return &bodyBudget{max: b.max, released: make(chan struct{})}
+}
+
+// reserve takes room for the body of request, waiting up to wait on clock
+// for it, and returns the bytes to hand back to release once the request has
+// finished. Bodies are counted by their Content-Length: those buffered by
+// http.NewRequest have theirs set, while streamed bodies of unknown length
+// take no room.
+func (b *bodyBudget) reserve(request *http.Request, wait time.Duration, clock Clock) (int64, error) {
+	size := request.ContentLength
+	if size <= 0 || request.Body == nil || request.Body == http.NoBody {
+		return 0, nil
+	}
+
+	var deadline <-chan time.Time
+	b.mu.Lock()
+	for b.max > 0 && b.inFlight+size > b.max {
+		if size > b.max || wait <= 0 {
+			defer b.mu.Unlock()
+			return 0, &ErrBodyBudgetExceeded{Size: size, Budget: b.max, InFlight: b.inFlight}
+		}
+		if deadline == nil {
+			var stop func() bool
+			deadline, stop = clock.NewTimer(wait)
+			defer stop()
+		}
+		released := b.released
+		b.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-deadline:
+			wait = 0
+		case <-request.Context().Done():
+			return 0, &ErrContextDone{err: request.Context().Err()}
+		}
+		b.mu.Lock()
+	}
+	b.inFlight += size
+	b.mu.Unlock()
+
+	return size, nil
+}
+
+// release frees the room taken by reserve
+func (b *bodyBudget) release(size int64) {
+	if size == 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.inFlight -= size
+	b.wake()
+}
+
+// wake lets the requests waiting for room check again. b.mu must be held.
+func (b *bodyBudget) wake() {
+	close(b.released)
+	b.released = make(chan struct{})
+}
+
+// snapshot returns the bytes of the bodies in flight
+func (b *bodyBudget) snapshot() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.inFlight
+}
@@ -0,0 +1,124 @@
+package heimdall
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBodyBudgetQueuesLargeUploads(t *testing.T) {
+	var mu sync.Mutex
+	var inFlight, maxInFlight int64
+	arrived := make(chan struct{}, 8)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		inFlight += int64(len(body))
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+
+		arrived <- struct{}{}
+		<-release
+
+		mu.Lock()
+		inFlight -= int64(len(body))
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(5000, WithBodyBudgetWait(5*time.Second))
+	client.SetMaxInFlightBodyBytes(3000)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := client.Post(server.URL, bytes.NewReader(make([]byte, 1000)), http.Header{})
+			assert.NoError(t, err)
+		}()
+	}
+
+	for i := 0; i < 3; i++ {
+		<-arrived
+	}
+	select {
+	case <-arrived:
+		t.Fatal("a fourth upload was sent over the budget")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Equal(t, int64(3000), client.Stats().BodyBytesInFlight)
+
+	for i := 0; i < 8; i++ {
+		release <- struct{}{}
+		if i < 5 {
+			<-arrived
+		}
+	}
+	wg.Wait()
+
+	assert.Equal(t, int64(3000), maxInFlight, "queued uploads go out as others complete, never over the budget")
+	assert.Equal(t, int64(0), client.Stats().BodyBytesInFlight)
+}
+
+func TestBodyBudgetRejections(t *testing.T) {
+	block := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-block
+		}
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(5000)
+	client.SetMaxInFlightBodyBytes(100)
+
+	_, err := client.Post(server.URL, strings.NewReader(strings.Repeat("x", 101)), http.Header{})
+	assert.Equal(t, &ErrBodyBudgetExceeded{Size: 101, Budget: 100}, err, "a body larger than the budget never fits")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := client.Post(server.URL+"/slow", strings.NewReader(strings.Repeat("x", 60)), http.Header{})
+		assert.NoError(t, err)
+	}()
+	require.Eventually(t, func() bool { return client.Stats().BodyBytesInFlight == 60 }, time.Second, time.Millisecond)
+
+	_, err = client.Post(server.URL, strings.NewReader(strings.Repeat("x", 50)), http.Header{})
+	assert.EqualError(t, err, "request body of 50 bytes exceeds the in-flight body budget of 100 bytes with 60 bytes in flight", "without a wait, the request fails at once")
+	assert.Equal(t, int64(2), client.Stats().Outcomes[OutcomeClientError])
+
+	_, err = client.Post(server.URL, ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 500))), http.Header{})
+	assert.NoError(t, err, "streamed bodies of unknown length are not counted")
+
+	_, err = client.Derive().Post(server.URL, strings.NewReader(strings.Repeat("x", 60)), http.Header{})
+	require.NoError(t, err, "derived clients count their bodies on their own")
+
+	for wait, want := range map[time.Duration]interface{}{20 * time.Millisecond: &ErrBodyBudgetExceeded{}, time.Minute: &ErrContextDone{}} {
+		waiting := client.Derive(WithBodyBudgetWait(wait))
+		go waiting.Post(server.URL+"/slow", strings.NewReader(strings.Repeat("x", 60)), http.Header{})
+		require.Eventually(t, func() bool { return waiting.Stats().BodyBytesInFlight == 60 }, time.Second, time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		request, err := http.NewRequest(http.MethodPost, server.URL, strings.NewReader(strings.Repeat("x", 50)))
+		require.NoError(t, err)
+		_, err = waiting.Do(request.WithContext(ctx))
+		cancel()
+		assert.IsType(t, want, err, "the wait or the context runs out first: %v", err)
+	}
+
+	close(block)
+	<-done
+}
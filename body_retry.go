@@ -0,0 +1,71 @@
+package heimdall
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// ErrRetryableBody fails an attempt whose body the body retry predicate
+// flagged, such as a 200 carrying {"status":"RETRY_LATER"}
+type ErrRetryableBody struct {
+	// StatusCode is the status of the flagged response
+	StatusCode int
+}
+
+func (e *ErrRetryableBody) Error() string {
+	return fmt.Sprintf("response body flagged for retry: status %d", e.StatusCode)
+}
+
+// bodyRetryPredicate flags the attempts whose body asks for a retry
+type bodyRetryPredicate struct {
+	maxInspectBytes int
+	fn              func(statusCode int, body []byte) bool
+}
+
+func newBodyRetryPredicate(maxInspectBytes int, fn func(statusCode int, body []byte) bool) *bodyRetryPredicate {
+	if fn == nil {
+		return nil
+	}
+
+	return &bodyRetryPredicate{maxInspectBytes: maxInspectBytes, fn: fn}
+}
+
+// check asks the predicate whether response fails its attempt, returning an
+// *ErrRetryableBody when it does
+func (p *bodyRetryPredicate) check(response *Response) (err error) {
+	if p == nil {
+		return nil
+	}
+	defer recoverCallback("body retry predicate", &err)
+
+	if p.fn(response.statusCode, p.inspected(response)) {
+		return &ErrRetryableBody{StatusCode: response.statusCode}
+	}
+
+	return nil
+}
+
+// inspected returns the start of the body of response the predicate is
+// given, leaving the body itself whole
+func (p *bodyRetryPredicate) inspected(response *Response) []byte {
+	if response.spool == nil {
+		body := response.body
+		if p.maxInspectBytes > 0 && len(body) > p.maxInspectBytes {
+			body = body[:p.maxInspectBytes]
+		}
+		return body[:len(body):len(body)]
+	}
+	if p.maxInspectBytes <= 0 {
+		return response.spool.bytes()
+	}
+
+	reader, err := response.spool.open()
+	if err != nil {
+		return nil
+	}
+	defer reader.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(reader, int64(p.maxInspectBytes)))
+
+	return body
+}
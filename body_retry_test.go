@@ -0,0 +1,192 @@
+package heimdall
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/afex/hystrix-go/hystrix"
+	"github.com/gojektech/heimdall/fakeclock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const retryLater = `{"status":"RETRY_LATER"}`
+
+// retryLaterServer answers 200 with an embedded RETRY_LATER to the first
+// embedded requests, and with a clean body to the others
+func retryLaterServer(embedded int32, calls *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n := atomic.AddInt32(calls, 1); n <= embedded {
+			fmt.Fprint(w, retryLater)
+			return
+		}
+		fmt.Fprint(w, `{"status":"OK","items":[1,2,3]}`)
+	}))
+}
+
+// embeddedRetry flags bodies asking for a retry
+func embeddedRetry(statusCode int, body []byte) bool {
+	return bytes.Contains(body, []byte("RETRY_LATER"))
+}
+
+func TestClientsRetryBodiesAskingForRetries(t *testing.T) {
+	for kind, newClient := range retryClients {
+		t.Run(kind, func(t *testing.T) {
+			var calls int32
+			server := retryLaterServer(2, &calls)
+			defer server.Close()
+
+			clock := fakeclock.New(time.Now())
+			client := newClient("body_retry_"+kind, clock)
+			client.SetRetryCount(3)
+			client.SetRetrier(&fixedRetrier{interval: time.Second})
+			client.SetBodyRetryPredicate(1024, embeddedRetry)
+
+			response, err := client.Get(server.URL, http.Header{})
+			require.NoError(t, err)
+			assert.Equal(t, `{"status":"OK","items":[1,2,3]}`, string(response.Body()), "the final body is clean and whole")
+			assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+			assert.Equal(t, []time.Duration{time.Second, time.Second}, clock.Sleeps(), "flagged attempts are retried with backoff")
+
+			attempts := response.Trace().Attempts
+			require.Len(t, attempts, 3)
+			assert.Contains(t, attempts[0].Error, "response body flagged for retry: status 200")
+		})
+	}
+}
+
+func TestFinalFlaggedBodiesAreReturnedWhole(t *testing.T) {
+	for kind, newClient := range retryClients {
+		t.Run(kind, func(t *testing.T) {
+			var calls int32
+			server := retryLaterServer(10, &calls)
+			defer server.Close()
+
+			var inspected [][]byte
+			client := newClient("body_retry_final_"+kind, realClock{})
+			client.SetRetryCount(1)
+			client.SetBodyRetryPredicate(12, func(statusCode int, body []byte) bool {
+				assert.Equal(t, http.StatusOK, statusCode)
+				inspected = append(inspected, append([]byte(nil), body...))
+				return true
+			})
+
+			response, err := client.Get(server.URL, http.Header{})
+			var retryable *ErrRetryableBody
+			require.True(t, errors.As(err, &retryable), "%v", err)
+			assert.Equal(t, http.StatusOK, retryable.StatusCode)
+			assert.Equal(t, retryLater, string(response.Body()), "the inspected body is whole")
+			assert.Equal(t, [][]byte{[]byte(retryLater[:12]), []byte(retryLater[:12])}, inspected, "only maxInspectBytes are inspected")
+		})
+	}
+}
+
+func TestBodyRetryPredicateInspectsSpooledBodies(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			fmt.Fprint(w, retryLater+strings.Repeat(" ", 100))
+			return
+		}
+		fmt.Fprint(w, strings.Repeat("x", 100))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+
+	client := NewHTTPClient(1000, WithBodySpooling(spoolThreshold, dir))
+	client.SetRetryCount(1)
+	client.SetBodyRetryPredicate(len(retryLater), embeddedRetry)
+
+	response, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+	assert.True(t, response.Spooled())
+	assert.Equal(t, strings.Repeat("x", 100), string(response.Body()))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	require.NoError(t, response.Close())
+	assert.Empty(t, spoolFiles(t, dir), "the file of the flagged attempt is removed")
+}
+
+func TestHystrixCircuitOpensOnFlaggedBodies(t *testing.T) {
+	var calls int32
+	server := retryLaterServer(100, &calls)
+	defer server.Close()
+
+	client := NewHystrixHTTPClient(1000, NewHystrixConfig(uniqueName("body_retry_circuit_command"), HystrixCommandConfig{
+		Timeout:                1000,
+		MaxConcurrentRequests:  10,
+		RequestVolumeThreshold: 5,
+		ErrorPercentThreshold:  50,
+		SleepWindow:            60000,
+	}))
+	client.SetBodyRetryPredicate(0, embeddedRetry)
+
+	for i := 0; i < 5; i++ {
+		_, err := client.Get(server.URL, http.Header{})
+		require.Error(t, err)
+	}
+
+	_, err := client.Get(server.URL, http.Header{})
+	assert.True(t, errors.Is(err, hystrix.ErrCircuitOpen), "%v", err)
+	assert.Equal(t, int32(5), atomic.LoadInt32(&calls))
+}
+
+func TestBodyRetryPredicateSkipsServerErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, retryLater)
+	}))
+	defer server.Close()
+
+	inspected := 0
+	client := NewHTTPClient(1000)
+	client.SetBodyRetryPredicate(0, func(int, []byte) bool {
+		inspected++
+		return true
+	})
+
+	_, err := client.Get(server.URL, http.Header{})
+	assert.Error(t, err)
+	assert.Zero(t, inspected, "5xx answers fail without asking the predicate")
+}
+
+func TestBodyRetryPredicatePanicFailsAttempt(t *testing.T) {
+	var calls int32
+	server := retryLaterServer(0, &calls)
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+	client.SetBodyRetryPredicate(0, func(int, []byte) bool {
+		panic("predicate bug")
+	})
+
+	_, err := client.Get(server.URL, http.Header{})
+	var panicked *ErrCallbackPanic
+	require.True(t, errors.As(err, &panicked), "%v", err)
+	assert.Equal(t, "body retry predicate", panicked.Callback)
+}
+
+func TestBodyRetryPredicateCanBeRemoved(t *testing.T) {
+	var calls int32
+	server := retryLaterServer(10, &calls)
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+	client.SetBodyRetryPredicate(0, embeddedRetry)
+	derived := client.Derive()
+	client.SetBodyRetryPredicate(0, nil)
+
+	response, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, retryLater, string(response.Body()))
+
+	_, err = derived.Get(server.URL, http.Header{})
+	var retryable *ErrRetryableBody
+	assert.True(t, errors.As(err, &retryable), "the derived client keeps the predicate: %v", err)
+}
@@ -0,0 +1,208 @@
+package heimdall
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"runtime"
+	"sync"
+)
+
+// ErrBodyClosed is returned when reading a spooled body after Response.Close
+// removed its file
+var ErrBodyClosed = errors.New("response body closed")
+
+// bodySpooling writes bodies longer than threshold to temporary files in dir
+type bodySpooling struct {
+	threshold int64
+	dir       string
+}
+
+// WithBodySpooling keeps response bodies of up to threshold bytes in memory
+// and writes longer ones to temporary files in dir, the default directory for
+// temporary files when empty, so that the occasional huge body does not have
+// to fit in memory.
+//
+// Response.BodyReader reads a spooled body from its file, each reader with a
+// handle of its own, and Response.Body reads the whole file into memory on
+// every call, returning nil once it cannot. Both are safe for concurrent use.
+// Response.Close removes the file, which copies of the response share:
+// readers opened before keep reading until they are closed or reach the end,
+// while those opened after fail with ErrBodyClosed. Files of responses never
+// closed are removed once the responses are garbage collected, as are those
+// of attempts that were retried. Spooled bodies are not transcoded by
+// WithCharsetDecoding, which flags their charset as unsupported, and are read
+// into memory when a response is cached, deduplicated or compared.
+func WithBodySpooling(threshold int64, dir string) Option {
+	return func(options *clientOptions) {
+		options.spooling = &bodySpooling{threshold: threshold, dir: dir}
+	}
+}
+
+// read reads and closes the body of response as readBody does, spooling it to
+// a file when it is read in full and longer than the threshold
+func (s *bodySpooling) read(response *http.Response, whole bool, limit int64, strict bool) ([]byte, *spooledBody, error) {
+	if s == nil || !whole || response.Body == nil {
+		body, err := readBody(response, whole, limit, strict)
+		return body, nil, err
+	}
+	defer response.Body.Close()
+
+	head, err := ioutil.ReadAll(io.LimitReader(response.Body, s.threshold+1))
+	if err != nil || int64(len(head)) <= s.threshold {
+		return head, nil, checkBodyLength(response, int64(len(head)), err, strict)
+	}
+
+	file, err := ioutil.TempFile(s.dir, "heimdall-body-*")
+	if err != nil {
+		return nil, nil, err
+	}
+	size, err := io.Copy(file, io.MultiReader(bytes.NewReader(head), response.Body))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err := checkBodyLength(response, size, err, strict); err != nil {
+		os.Remove(file.Name())
+		return nil, nil, err
+	}
+
+	return nil, newSpooledBody(file.Name(), size), nil
+}
+
+// spooledBody is a body written to a temporary file, removed once the
+// response is closed and the readers open on it are done
+type spooledBody struct {
+	path string
+	size int64
+
+	mu      sync.Mutex
+	closed  bool
+	readers int
+	removed bool
+}
+
+func newSpooledBody(path string, size int64) *spooledBody {
+	spool := &spooledBody{path: path, size: size}
+	runtime.SetFinalizer(spool, (*spooledBody).finalize)
+
+	return spool
+}
+
+// open returns a reader of the file, failing once it is closed
+func (s *spooledBody) open() (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, ErrBodyClosed
+	}
+	file, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	s.readers++
+
+	return &spoolReader{file: file, spool: s}, nil
+}
+
+// bytes reads the whole file, nil when it cannot be read
+func (s *spooledBody) bytes() []byte {
+	reader, err := s.open()
+	if err != nil {
+		return nil
+	}
+	defer reader.Close()
+
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil
+	}
+
+	return body
+}
+
+// close removes the file once no reader is left on it
+func (s *spooledBody) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	return s.removeIfUnread()
+}
+
+// finalize removes the file of a spool no longer referenced, and so no
+// longer read by anyone
+func (s *spooledBody) finalize() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	s.readers = 0
+	s.removeIfUnread()
+}
+
+// done releases a reader, removing the file if it was closed meanwhile
+func (s *spooledBody) done() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.readers--
+	s.removeIfUnread()
+}
+
+func (s *spooledBody) removeIfUnread() error {
+	if !s.closed || s.readers > 0 || s.removed {
+		return nil
+	}
+	s.removed = true
+
+	if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// spoolReader reads a spooled body, releasing its file when closed or read to
+// its end
+type spoolReader struct {
+	mu    sync.Mutex
+	file  *os.File
+	spool *spooledBody
+}
+
+func (r *spoolReader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		return 0, io.EOF
+	}
+	n, err := r.file.Read(p)
+	if err == io.EOF {
+		r.release()
+	}
+
+	return n, err
+}
+
+// Close closes the file, after which reads return io.EOF
+func (r *spoolReader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.release()
+}
+
+func (r *spoolReader) release() error {
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	r.spool.done()
+
+	return err
+}
@@ -0,0 +1,176 @@
+package heimdall
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const spoolThreshold = 64
+
+// sizedServer answers /{n} with a body of n bytes
+func sizedServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		w.Write([]byte(strings.Repeat("x", n)))
+	}))
+}
+
+// spoolFiles returns the names of the files in dir
+func spoolFiles(t *testing.T, dir string) []string {
+	entries, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+
+	return names
+}
+
+func TestBodiesOverTheThresholdAreSpooled(t *testing.T) {
+	server := sizedServer()
+	defer server.Close()
+
+	for kind := range retryClients {
+		dir := t.TempDir()
+		var client Client
+		if kind == "http" {
+			client = NewHTTPClient(1000, WithBodySpooling(spoolThreshold, dir))
+		} else {
+			client = NewHystrixHTTPClient(1000, NewHystrixConfig("body_spooling_"+kind, HystrixCommandConfig{Timeout: 1000}), WithBodySpooling(spoolThreshold, dir))
+		}
+
+		for _, size := range []int{0, spoolThreshold - 1, spoolThreshold} {
+			response, err := client.Get(server.URL+"/"+strconv.Itoa(size), http.Header{})
+			require.NoError(t, err, kind)
+			assert.False(t, response.Spooled(), "%s: %d bytes stay in memory", kind, size)
+			assert.Len(t, response.Body(), size, kind)
+			assert.NoError(t, response.Close(), kind)
+		}
+		assert.Empty(t, spoolFiles(t, dir), kind)
+
+		response, err := client.Get(server.URL+"/"+strconv.Itoa(spoolThreshold+1), http.Header{})
+		require.NoError(t, err, kind)
+		assert.True(t, response.Spooled(), kind)
+		assert.Len(t, spoolFiles(t, dir), 1, "%s: the body is written to a file in the directory", kind)
+		assert.Equal(t, strings.Repeat("x", spoolThreshold+1), string(response.Body()), "%s: Body reads the file", kind)
+		read, err := ioutil.ReadAll(response.BodyReader())
+		require.NoError(t, err, kind)
+		assert.Len(t, read, spoolThreshold+1, kind)
+
+		require.NoError(t, response.Close(), kind)
+		assert.Empty(t, spoolFiles(t, dir), "%s: Close removes the file", kind)
+		assert.NoError(t, response.Close(), "%s: closing again is harmless", kind)
+		assert.Nil(t, response.Body(), kind)
+		_, err = ioutil.ReadAll(response.BodyReader())
+		assert.True(t, errors.Is(err, ErrBodyClosed), "%s: %v", kind, err)
+	}
+}
+
+func TestSpooledBodiesOutliveCloseWhileRead(t *testing.T) {
+	server := sizedServer()
+	defer server.Close()
+	dir := t.TempDir()
+
+	response, err := NewHTTPClient(1000, WithBodySpooling(spoolThreshold, dir)).Get(server.URL+"/1000", http.Header{})
+	require.NoError(t, err)
+
+	copied := response
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			read, err := ioutil.ReadAll(copied.BodyReader())
+			assert.NoError(t, err)
+			assert.Len(t, read, 1000)
+		}()
+	}
+	wg.Wait()
+
+	reader := response.BodyReader()
+	head := make([]byte, 10)
+	_, err = io.ReadFull(reader, head)
+	require.NoError(t, err)
+
+	require.NoError(t, copied.Close(), "closing any copy closes the body")
+	assert.Len(t, spoolFiles(t, dir), 1, "the file is kept for the open reader")
+	_, err = ioutil.ReadAll(response.BodyReader())
+	assert.True(t, errors.Is(err, ErrBodyClosed), "readers cannot be opened after Close: %v", err)
+
+	rest, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Len(t, rest, 990)
+	assert.Empty(t, spoolFiles(t, dir), "the file is removed once the last reader is done")
+}
+
+func TestSpooledBodiesOfRetriedAttemptsAreRemoved(t *testing.T) {
+	server := sizedServer()
+	defer server.Close()
+	dir := t.TempDir()
+
+	client := NewHTTPClient(1000, WithBodySpooling(spoolThreshold, dir))
+	client.SetRetryCount(2)
+	client.SetFailureClassifier(func(*Response, time.Duration) bool { return true })
+
+	response, err := client.Get(server.URL+"/1000", http.Header{})
+	require.Error(t, err)
+	assert.Len(t, spoolFiles(t, dir), 1, "only the body of the last attempt is kept")
+	assert.Len(t, response.Body(), 1000)
+
+	require.NoError(t, response.Close())
+	assert.Empty(t, spoolFiles(t, dir))
+}
+
+func TestSpooledBodiesAreRemovedWhenCollected(t *testing.T) {
+	server := sizedServer()
+	defer server.Close()
+	dir := t.TempDir()
+
+	response, err := NewHTTPClient(1000, WithBodySpooling(spoolThreshold, dir)).Get(server.URL+"/1000", http.Header{})
+	require.NoError(t, err)
+	require.True(t, response.Spooled())
+	response = Response{}
+
+	assert.Eventually(t, func() bool {
+		runtime.GC()
+		return len(spoolFiles(t, dir)) == 0
+	}, time.Second, 10*time.Millisecond, "the finalizer removes the file of a response never closed")
+}
+
+func TestTruncatedSpooledBodiesLeaveNoFile(t *testing.T) {
+	dir := t.TempDir()
+	url, _ := rawResponseServer(t, shortResponse)
+
+	_, err := NewHTTPClient(1000, WithBodySpooling(4, dir)).Get(url, http.Header{})
+	var truncated *ErrTruncatedBody
+	require.True(t, errors.As(err, &truncated), "%v", err)
+	assert.Equal(t, &ErrTruncatedBody{Expected: 20, Got: 8}, truncated)
+	assert.Empty(t, spoolFiles(t, dir))
+}
+
+func TestSpooledBodiesAreReadIntoCachedResponses(t *testing.T) {
+	server := sizedServer()
+	defer server.Close()
+
+	response, err := NewHTTPClient(1000, WithBodySpooling(spoolThreshold, t.TempDir())).Get(server.URL+"/1000", http.Header{})
+	require.NoError(t, err)
+
+	cached := NewCachedResponse(response, time.Time{})
+	require.NoError(t, response.Close())
+	assert.Len(t, cached.Body, 1000)
+	assert.False(t, cached.Response().Spooled())
+}
@@ -0,0 +1,356 @@
+package heimdall
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tracedGet sends a GET through client, counting the fresh connections its
+// attempts were sent on
+func tracedGet(t *testing.T, client testClient, url string, fresh *int32) (Response, error) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if !info.Reused {
+				atomic.AddInt32(fresh, 1)
+			}
+		},
+	}
+
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+
+	return client.Do(request.WithContext(httptrace.WithClientTrace(context.Background(), trace)))
+}
+
+func errorBodyServer(body []byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(body)
+	}))
+}
+
+func TestHTTPClientReusesConnectionsAcrossFailedRequests(t *testing.T) {
+	server := errorBodyServer([]byte(`{ "error": "unavailable" }`))
+	defer server.Close()
+
+	client := NewHTTPClient(1000, WithKeepAlive())
+	client.SetRetryCount(3)
+
+	var fresh int32
+	for i := 0; i < 20; i++ {
+		response, err := tracedGet(t, client, server.URL, &fresh)
+		require.Error(t, err)
+		assert.Equal(t, `{ "error": "unavailable" }`, string(response.Body()))
+	}
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fresh))
+}
+
+func TestHystrixHTTPClientReusesConnectionsAcrossFailedRequests(t *testing.T) {
+	server := errorBodyServer([]byte(`{ "error": "unavailable" }`))
+	defer server.Close()
+
+	client := NewHystrixHTTPClient(1000, NewHystrixConfig("drain_command", HystrixCommandConfig{
+		Timeout:                1000,
+		ErrorPercentThreshold:  100,
+		RequestVolumeThreshold: 1000,
+	}), WithKeepAlive())
+	client.SetRetryCount(3)
+
+	var fresh int32
+	for i := 0; i < 10; i++ {
+		_, err := tracedGet(t, client, server.URL, &fresh)
+		require.Error(t, err)
+	}
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fresh))
+}
+
+func TestHTTPClientClosesConnectionWhenErrorBodyExceedsDrainLimit(t *testing.T) {
+	huge := bytes.Repeat([]byte("x"), 1<<20)
+	server := errorBodyServer(huge)
+	defer server.Close()
+
+	client := NewHTTPClient(1000, WithKeepAlive())
+	client.SetRetryCount(2)
+	client.SetDrainLimit(1 << 10)
+
+	var fresh int32
+	response, err := tracedGet(t, client, server.URL, &fresh)
+	require.Error(t, err)
+
+	assert.Equal(t, int32(3), atomic.LoadInt32(&fresh), "every truncated attempt should drop its connection")
+	assert.Equal(t, huge, response.Body(), "the final attempt should be read in full")
+}
+
+func TestHTTPClientTruncatesErrorBodiesOfRetriedAttempts(t *testing.T) {
+	count := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count++
+		if count == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("0123456789"))
+			return
+		}
+
+		conn, _, err := w.(http.Hijacker).Hijack()
+		require.NoError(t, err)
+		conn.Close()
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+	client.SetRetryCount(1)
+	client.SetDrainLimit(4)
+
+	_, err := client.Get(server.URL, http.Header{})
+
+	exhausted, ok := err.(*RetriesExhaustedError)
+	require.True(t, ok, "error should be a RetriesExhaustedError")
+	assert.Equal(t, "0123", string(exhausted.LastResponse.Body()))
+}
+
+func TestHTTPClientOpensConnectionPerRequestWithoutKeepAlive(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+
+	var fresh int32
+	for i := 0; i < 3; i++ {
+		_, err := tracedGet(t, client, server.URL, &fresh)
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, int32(3), atomic.LoadInt32(&fresh))
+}
+
+// nilBodyDoer answers every attempt with status and a nil Body, as a custom
+// transport or middleware might
+func nilBodyDoer(status int) Middleware {
+	return func(next Doer) Doer {
+		return DoerFunc(func(request *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: status, Header: http.Header{}}, nil
+		})
+	}
+}
+
+func TestClientsSkipBodiesThatMustBeAbsent(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/no-content":
+			w.WriteHeader(http.StatusNoContent)
+		case "/not-modified":
+			w.WriteHeader(http.StatusNotModified)
+		case "/empty":
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.Header().Set("Content-Length", "4")
+			w.Write([]byte("body"))
+		}
+	}))
+	defer server.Close()
+
+	clients := map[string]testClient{
+		"http":    NewHTTPClient(1000),
+		"hystrix": NewHystrixHTTPClient(1000, NewHystrixConfig("bodyless_responses_command", HystrixCommandConfig{Timeout: 1000})),
+	}
+
+	for name, client := range clients {
+		for path, status := range map[string]int{"/no-content": http.StatusNoContent, "/not-modified": http.StatusNotModified} {
+			response, err := client.Get(server.URL+path, http.Header{})
+			require.NoError(t, err, name)
+			assert.Equal(t, status, response.StatusCode(), name)
+			assert.False(t, response.HasBody(), "%s %s", name, path)
+			assert.Empty(t, response.Body(), name)
+		}
+
+		request, err := http.NewRequest(http.MethodHead, server.URL+"/body", nil)
+		require.NoError(t, err)
+		response, err := client.Do(request)
+		require.NoError(t, err, name)
+		assert.Equal(t, "4", response.Headers().Get("Content-Length"), name)
+		assert.False(t, response.HasBody(), name)
+
+		response, err = client.Get(server.URL+"/empty", http.Header{})
+		require.NoError(t, err, name)
+		assert.True(t, response.HasBody(), "an empty 200 body is still a body")
+		assert.Empty(t, response.Body(), name)
+
+		response, err = client.Get(server.URL+"/body", http.Header{})
+		require.NoError(t, err, name)
+		assert.True(t, response.HasBody(), name)
+		assert.Equal(t, "body", string(response.Body()), name)
+	}
+}
+
+func TestClientsHandleNilResponseBodies(t *testing.T) {
+	clients := map[string]testClient{
+		"http":    NewHTTPClient(1000),
+		"hystrix": NewHystrixHTTPClient(1000, NewHystrixConfig("nil_body_command", HystrixCommandConfig{Timeout: 1000})),
+	}
+
+	for name, client := range clients {
+		client.Use(nilBodyDoer(http.StatusOK))
+
+		response, err := client.Get("http://upstream.local/", http.Header{})
+		require.NoError(t, err, name)
+		assert.Equal(t, http.StatusOK, response.StatusCode(), name)
+		assert.Nil(t, response.Body(), name)
+	}
+}
+
+func TestHTTPClientHandlesConnectionsClosedWithoutBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		require.NoError(t, err)
+		defer conn.Close()
+
+		if r.URL.Path == "/truncated" {
+			buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nshort")
+		} else {
+			buf.WriteString("HTTP/1.1 200 OK\r\nConnection: close\r\n\r\n")
+		}
+		buf.Flush()
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+
+	response, err := client.Get(server.URL+"/closed", http.Header{})
+	require.NoError(t, err)
+	assert.True(t, response.HasBody())
+	assert.Empty(t, response.Body())
+
+	_, err = client.Get(server.URL+"/truncated", http.Header{})
+	assert.Error(t, err)
+}
+
+// rawResponseServer answers the nth request it reads with the nth of
+// responses, written as they are, then closes the connection. The last
+// response answers any later requests.
+func rawResponseServer(t *testing.T, responses ...string) (string, *int32) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	var served int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+					return
+				}
+				n := int(atomic.AddInt32(&served, 1))
+				if n > len(responses) {
+					n = len(responses)
+				}
+				io.WriteString(conn, responses[n-1])
+			}(conn)
+		}
+	}()
+
+	return "http://" + listener.Addr().String(), &served
+}
+
+const (
+	shortResponse   = "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: 20\r\n\r\n{\"id\": 4"
+	fullResponse    = "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: 20\r\n\r\n{\"id\": 42, \"ab\": 12}"
+	chunkedResponse = "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n6\r\n{\"id\":\r\n"
+)
+
+func TestClientsFailTruncatedBodies(t *testing.T) {
+	for name, client := range map[string]testClient{
+		"http":    NewHTTPClient(1000),
+		"hystrix": NewHystrixHTTPClient(1000, NewHystrixConfig("truncated_body_command", HystrixCommandConfig{Timeout: 1000, ErrorPercentThreshold: 100})),
+	} {
+		for kind, tc := range map[string]struct {
+			response      string
+			expected, got int64
+			message       string
+		}{
+			"content length": {response: shortResponse, expected: 20, got: 8, message: "truncated body: read 8 of the 20 bytes of Content-Length"},
+			"chunked":        {response: chunkedResponse, expected: -1, got: 6, message: "truncated body: ended after 6 bytes"},
+		} {
+			url, _ := rawResponseServer(t, tc.response)
+			_, err := client.Get(url, http.Header{})
+
+			var truncated *ErrTruncatedBody
+			require.True(t, errors.As(err, &truncated), "%s %s: %v", name, kind, err)
+			assert.Equal(t, tc.expected, truncated.Expected, name+" "+kind)
+			assert.Equal(t, tc.got, truncated.Got, name+" "+kind)
+			assert.EqualError(t, truncated, tc.message)
+			assert.True(t, errors.Is(err, io.ErrUnexpectedEOF), name+" "+kind)
+		}
+	}
+}
+
+func TestClientsRetryTruncatedBodies(t *testing.T) {
+	for name, client := range map[string]testClient{
+		"http":    NewHTTPClient(1000),
+		"hystrix": NewHystrixHTTPClient(1000, NewHystrixConfig("truncated_body_retry_command", HystrixCommandConfig{Timeout: 1000, ErrorPercentThreshold: 100})),
+	} {
+		url, served := rawResponseServer(t, shortResponse, chunkedResponse, fullResponse)
+		client.SetRetryCount(2)
+		client.SetRetrier(NewRetrier(NewConstantBackoff(1)))
+
+		response, err := client.Get(url, http.Header{})
+		require.NoError(t, err, name)
+		assert.Equal(t, `{"id": 42, "ab": 12}`, string(response.Body()), name)
+		assert.Equal(t, int32(3), atomic.LoadInt32(served), name)
+	}
+}
+
+func TestStrictContentLengthChecksBodiesTheTransportDoesNot(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+	client.Use(func(next Doer) Doer {
+		return DoerFunc(func(request *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode:    http.StatusOK,
+				Header:        http.Header{},
+				ContentLength: 20,
+				Body:          ioutil.NopCloser(strings.NewReader(`{"id": 4`)),
+				Request:       request,
+			}, nil
+		})
+	})
+
+	_, err := client.Get(server.URL, http.Header{})
+	var truncated *ErrTruncatedBody
+	require.True(t, errors.As(err, &truncated), "%v", err)
+	assert.Equal(t, &ErrTruncatedBody{Expected: 20, Got: 8}, truncated)
+
+	client.SetStrictContentLength(false)
+	response, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, `{"id": 4`, string(response.Body()), "unchecked bodies are returned as read")
+
+	lenient := NewHTTPClient(1000)
+	lenient.SetStrictContentLength(false)
+	url, _ := rawResponseServer(t, shortResponse)
+	_, err = lenient.Derive().Get(url, http.Header{})
+	assert.False(t, errors.As(err, &truncated), "derived clients keep the setting")
+	assert.True(t, errors.Is(err, io.ErrUnexpectedEOF), "the transport still fails bodies it knows to be short: %v", err)
+}
@@ -0,0 +1,269 @@
+package heimdall
+
+import (
+	"sync"
+	"time"
+
+	"github.com/afex/hystrix-go/hystrix"
+)
+
+// CircuitHalfOpen is the state of a circuit whose sleep window has elapsed,
+// which lets a single request through to decide whether it closes
+const CircuitHalfOpen = "half_open"
+
+// defaultBreakerStateMaxAge is how old a BreakerState may be before
+// NewHystrixHTTPClientWithState discards it, unless WithBreakerStateMaxAge
+// says otherwise
+const defaultBreakerStateMaxAge = time.Minute
+
+// breakerWindowBuckets is the number of one second buckets failures are
+// counted over, the ten seconds of the hystrix rolling window
+const breakerWindowBuckets = 10
+
+// BreakerState is the state of the circuit of a hystrix client, exported with
+// ExportBreakerState and handed to NewHystrixHTTPClientWithState so that a
+// rebuilt client carries on where the old one stopped. It marshals to JSON as
+// it is, with its fields always in the same order and times in UTC, so it can
+// be persisted across a process restart.
+type BreakerState struct {
+	// Command is the hystrix command the state was exported from
+	Command string `json:"command,omitempty"`
+	// State is CircuitClosed, CircuitOpen or CircuitHalfOpen
+	State string `json:"state"`
+	// Requests and Failures are counted over the last ten seconds
+	Requests int `json:"requests"`
+	Failures int `json:"failures"`
+	// OpenedAt is when the circuit opened, or was last tested while open, and
+	// OpenUntil when its sleep window elapses. Both are nil for a closed circuit.
+	OpenedAt  *time.Time `json:"opened_at,omitempty"`
+	OpenUntil *time.Time `json:"open_until,omitempty"`
+	// ExportedAt is when the state was exported
+	ExportedAt time.Time `json:"exported_at"`
+}
+
+// NewHystrixHTTPClientWithState returns a HystrixHTTPClient, as
+// NewHystrixHTTPClient does, that starts from state instead of a closed
+// circuit. An open circuit keeps failing requests fast, as hystrix does, until
+// state.OpenUntil, then lets a single request through: its success closes the
+// circuit and its failure keeps it open for another sleep window. The failures
+// counted while closed are replayed into the hystrix circuit. State older than
+// a minute, or the age given with WithBreakerStateMaxAge, is discarded.
+func NewHystrixHTTPClientWithState(timeoutInMillis int, hystrixConfig HystrixConfig, state BreakerState, opts ...Option) *HystrixHTTPClient {
+	hhc := NewHystrixHTTPClient(timeoutInMillis, hystrixConfig, opts...)
+	hhc.breaker.restore(hhc.hystrixCommandName, state, hhc.options.breakerStateMaxAge)
+
+	return hhc
+}
+
+// WithBreakerStateMaxAge sets how old the state given to
+// NewHystrixHTTPClientWithState may be before it is discarded, one minute by
+// default
+func WithBreakerStateMaxAge(age time.Duration) Option {
+	return func(options *clientOptions) {
+		options.breakerStateMaxAge = age
+	}
+}
+
+// ExportBreakerState returns the state of the circuit of hhc, for
+// NewHystrixHTTPClientWithState
+func (hhc *HystrixHTTPClient) ExportBreakerState() BreakerState {
+	return hhc.breaker.export(hhc.hystrixCommandName)
+}
+
+// breakerTracker follows the hystrix circuit of a command, which hystrix-go
+// gives no way to read or set, from the outcomes of its requests, and keeps a
+// circuit handed over open by NewHystrixHTTPClientWithState open until its
+// sleep window elapses
+type breakerTracker struct {
+	mu          sync.Mutex
+	clock       Clock
+	sleepWindow time.Duration
+
+	buckets [breakerWindowBuckets]breakerBucket
+	// openedAt and openUntil are set while the circuit is open
+	openedAt  time.Time
+	openUntil time.Time
+	// inherited is set while the circuit handed over is open, when the
+	// tracker rather than hystrix fails requests fast, and testing while the
+	// request deciding whether it closes is running
+	inherited bool
+	testing   bool
+}
+
+type breakerBucket struct {
+	second   int64
+	requests int
+	failures int
+}
+
+func newBreakerTracker(config HystrixConfig, clock Clock) *breakerTracker {
+	sleepWindow := config.commandConfig.SleepWindow
+	if sleepWindow == 0 {
+		sleepWindow = hystrix.DefaultSleepWindow
+	}
+
+	return &breakerTracker{clock: clock, sleepWindow: time.Duration(sleepWindow) * time.Millisecond}
+}
+
+// allow reports whether a request may run the hystrix command, which it may
+// unless the circuit handed over is open
+func (t *breakerTracker) allow() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.inherited {
+		return true
+	}
+	if t.testing || t.clock.Now().Before(t.openUntil) {
+		return false
+	}
+
+	t.testing = true
+	return true
+}
+
+// gating reports whether the circuit handed over is failing requests fast
+func (t *breakerTracker) gating() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.inherited && t.clock.Now().Before(t.openUntil)
+}
+
+// observe records the outcome of a run of command: err is what hystrix.Do
+// returned and rejection the error it rejected the run with, if it did
+func (t *breakerTracker) observe(command string, err, rejection error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.clock.Now()
+	t.testing = false
+	if rejection != nil {
+		if rejection == hystrix.ErrCircuitOpen && t.openedAt.IsZero() {
+			t.open(now)
+		}
+		return
+	}
+
+	t.count(now, err != nil)
+	switch {
+	case err == nil:
+		t.openedAt, t.openUntil, t.inherited = time.Time{}, time.Time{}, false
+	case t.inherited:
+		t.open(now)
+	case circuitOpen(command):
+		// A failure once the sleep window elapsed was hystrix testing the
+		// circuit, which reopens it
+		if t.openedAt.IsZero() || !now.Before(t.openUntil) {
+			t.open(now)
+		}
+	}
+}
+
+func (t *breakerTracker) open(now time.Time) {
+	t.openedAt, t.openUntil = now, now.Add(t.sleepWindow)
+}
+
+func (t *breakerTracker) count(now time.Time, failed bool) {
+	bucket := &t.buckets[now.Unix()%breakerWindowBuckets]
+	if bucket.second != now.Unix() {
+		*bucket = breakerBucket{second: now.Unix()}
+	}
+
+	bucket.requests++
+	if failed {
+		bucket.failures++
+	}
+}
+
+// counts returns the requests and failures of the last ten seconds
+func (t *breakerTracker) counts(now time.Time) (int, int) {
+	requests, failures := 0, 0
+	for _, bucket := range t.buckets {
+		if now.Unix()-bucket.second < breakerWindowBuckets {
+			requests += bucket.requests
+			failures += bucket.failures
+		}
+	}
+
+	return requests, failures
+}
+
+func (t *breakerTracker) export(command string) BreakerState {
+	open := circuitOpen(command)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.clock.Now()
+	state := BreakerState{Command: command, State: CircuitClosed, ExportedAt: now.UTC()}
+	state.Requests, state.Failures = t.counts(now)
+	if !open && !t.inherited {
+		return state
+	}
+
+	// A circuit opened by a client sharing the command is open here too
+	openedAt, openUntil := t.openedAt, t.openUntil
+	if openedAt.IsZero() {
+		openedAt, openUntil = now, now.Add(t.sleepWindow)
+	}
+	state.State = CircuitOpen
+	if !now.Before(openUntil) {
+		state.State = CircuitHalfOpen
+	}
+	openedAt, openUntil = openedAt.UTC(), openUntil.UTC()
+	state.OpenedAt, state.OpenUntil = &openedAt, &openUntil
+
+	return state
+}
+
+// restore starts the tracker, and the counts of the hystrix circuit of
+// command, from state, unless it is older than maxAge
+func (t *breakerTracker) restore(command string, state BreakerState, maxAge time.Duration) {
+	if maxAge == 0 {
+		maxAge = defaultBreakerStateMaxAge
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.clock.Now()
+	if state.ExportedAt.IsZero() || now.Sub(state.ExportedAt) > maxAge {
+		return
+	}
+
+	bucket := &t.buckets[now.Unix()%breakerWindowBuckets]
+	*bucket = breakerBucket{second: now.Unix(), requests: state.Requests, failures: state.Failures}
+
+	if state.State == CircuitOpen || state.State == CircuitHalfOpen {
+		t.inherited = true
+		t.openUntil = now
+		if state.OpenUntil != nil {
+			t.openUntil = *state.OpenUntil
+		}
+		t.openedAt = t.openUntil.Add(-t.sleepWindow)
+		if state.OpenedAt != nil {
+			t.openedAt = *state.OpenedAt
+		}
+		return
+	}
+
+	// Replaying the counts of an open circuit would open the hystrix one
+	// with a sleep window starting now, so only those of a closed one are
+	circuit, _, err := hystrix.GetCircuit(command)
+	if err != nil {
+		return
+	}
+	for i := 0; i < state.Requests; i++ {
+		event := "success"
+		if i < state.Failures {
+			event = "failure"
+		}
+		circuit.ReportEvent([]string{event}, now, 0)
+	}
+}
+
+func circuitOpen(command string) bool {
+	circuit, _, err := hystrix.GetCircuit(command)
+	return err == nil && circuit.IsOpen()
+}
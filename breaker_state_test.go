@@ -0,0 +1,163 @@
+package heimdall
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gojektech/heimdall/fakeclock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func breakerStateConfig(command string) HystrixConfig {
+	return NewHystrixConfig(command, HystrixCommandConfig{
+		Timeout:                1000,
+		RequestVolumeThreshold: 3,
+		ErrorPercentThreshold:  50,
+		SleepWindow:            60000,
+	})
+}
+
+// openCircuit fails requests through a client of command until its circuit
+// opens, returning the client
+func openCircuit(t *testing.T, command string) *HystrixHTTPClient {
+	server := failingServer(100)
+	defer server.Close()
+
+	client := NewHystrixHTTPClient(1000, breakerStateConfig(command))
+	for i := 0; i < 3; i++ {
+		_, err := client.Get(server.URL, http.Header{})
+		require.Error(t, err)
+	}
+	require.Equal(t, CircuitOpen, client.Stats().Circuit)
+
+	return client
+}
+
+func TestRebuiltClientKeepsTheCircuitOpen(t *testing.T) {
+	command := uniqueName("breaker_state_old")
+	state := openCircuit(t, command).ExportBreakerState()
+	assert.Equal(t, command, state.Command)
+	assert.Equal(t, CircuitOpen, state.State)
+	assert.Equal(t, 3, state.Requests)
+	assert.Equal(t, 3, state.Failures)
+	require.NotNil(t, state.OpenedAt)
+	require.NotNil(t, state.OpenUntil)
+	assert.Equal(t, time.Minute, state.OpenUntil.Sub(*state.OpenedAt))
+
+	persisted, err := json.Marshal(state)
+	require.NoError(t, err)
+	var restored BreakerState
+	require.NoError(t, json.Unmarshal(persisted, &restored))
+
+	var hits int32
+	server := countingServer(&hits)
+	defer server.Close()
+
+	clock := fakeclock.New(time.Now())
+	client := NewHystrixHTTPClientWithState(1000, breakerStateConfig(uniqueName("breaker_state_new")), restored, WithClock(clock))
+
+	_, err = client.Get(server.URL, http.Header{})
+	var rejected *ErrHystrixRejected
+	require.True(t, errors.As(err, &rejected), "%v", err)
+	assert.True(t, rejected.CircuitOpen())
+	assert.Equal(t, int32(0), atomic.LoadInt32(&hits), "the upstream is protected until the sleep window elapses")
+	assert.Equal(t, CircuitOpen, client.Stats().Circuit)
+
+	clock.Advance(time.Minute)
+	assert.Equal(t, CircuitHalfOpen, client.ExportBreakerState().State)
+
+	_, err = client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits))
+
+	exported := client.ExportBreakerState()
+	assert.Equal(t, CircuitClosed, exported.State, "a successful test closes the circuit")
+	assert.Nil(t, exported.OpenUntil)
+	assert.Equal(t, CircuitClosed, client.Stats().Circuit)
+}
+
+func TestFailedTestKeepsTheHandedOverCircuitOpen(t *testing.T) {
+	clock := fakeclock.New(time.Now())
+	openedAt, openUntil := clock.Now().Add(-time.Minute), clock.Now()
+	state := BreakerState{State: CircuitOpen, Requests: 3, Failures: 3, OpenedAt: &openedAt, OpenUntil: &openUntil, ExportedAt: clock.Now()}
+
+	server := failingServer(100)
+	defer server.Close()
+
+	client := NewHystrixHTTPClientWithState(1000, breakerStateConfig("breaker_state_failed_test"), state, WithClock(clock))
+
+	_, err := client.Get(server.URL, http.Header{})
+	var rejected *ErrHystrixRejected
+	assert.False(t, errors.As(err, &rejected), "the sleep window has elapsed, so the request tests the circuit: %v", err)
+
+	_, err = client.Get(server.URL, http.Header{})
+	require.True(t, errors.As(err, &rejected), "%v", err)
+
+	exported := client.ExportBreakerState()
+	assert.Equal(t, CircuitOpen, exported.State)
+	assert.Equal(t, clock.Now().Add(time.Minute).UTC(), *exported.OpenUntil, "the sleep window restarts with the failed test")
+	assert.Equal(t, 4, exported.Requests)
+	assert.Equal(t, 4, exported.Failures)
+}
+
+func TestStaleBreakerStateIsDiscarded(t *testing.T) {
+	clock := fakeclock.New(time.Now())
+	openedAt, openUntil := clock.Now(), clock.Now().Add(time.Hour)
+	state := BreakerState{State: CircuitOpen, OpenedAt: &openedAt, OpenUntil: &openUntil, ExportedAt: clock.Now().Add(-2 * time.Minute)}
+
+	var hits int32
+	server := countingServer(&hits)
+	defer server.Close()
+
+	client := NewHystrixHTTPClientWithState(1000, breakerStateConfig("breaker_state_stale"), state, WithClock(clock))
+	_, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err, "state older than a minute is discarded")
+
+	client = NewHystrixHTTPClientWithState(1000, breakerStateConfig("breaker_state_kept"), state, WithClock(clock), WithBreakerStateMaxAge(5*time.Minute))
+	_, err = client.Get(server.URL, http.Header{})
+	require.Error(t, err)
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits))
+	assert.Equal(t, BreakerState{}, NewHTTPClient(1000).ExportBreakerState(), "clients without a circuit export nothing")
+}
+
+func TestClosedBreakerStateCarriesItsFailures(t *testing.T) {
+	state := BreakerState{State: CircuitClosed, Requests: 2, Failures: 2, ExportedAt: time.Now()}
+
+	server := failingServer(100)
+	defer server.Close()
+
+	client := NewHystrixHTTPClientWithState(1000, breakerStateConfig("breaker_state_closed"), state)
+	_, err := client.Get(server.URL, http.Header{})
+	require.Error(t, err)
+
+	assert.Equal(t, CircuitOpen, client.Stats().Circuit, "one more failure reaches the volume threshold")
+	assert.Equal(t, CircuitOpen, client.ExportBreakerState().State)
+}
+
+func TestBreakerStateJSON(t *testing.T) {
+	openedAt := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	openUntil := openedAt.Add(5 * time.Second)
+	state := BreakerState{
+		Command:    "users",
+		State:      CircuitOpen,
+		Requests:   20,
+		Failures:   12,
+		OpenedAt:   &openedAt,
+		OpenUntil:  &openUntil,
+		ExportedAt: openedAt.Add(time.Second),
+	}
+
+	encoded, err := json.Marshal(state)
+	require.NoError(t, err)
+	assert.Equal(t, `{"command":"users","state":"open","requests":20,"failures":12,"opened_at":"2024-03-01T12:00:00Z","open_until":"2024-03-01T12:00:05Z","exported_at":"2024-03-01T12:00:01Z"}`, string(encoded))
+
+	closed, err := json.Marshal(BreakerState{State: CircuitClosed, ExportedAt: openedAt})
+	require.NoError(t, err)
+	assert.Equal(t, `{"state":"closed","requests":0,"failures":0,"exported_at":"2024-03-01T12:00:00Z"}`, string(closed))
+}
@@ -0,0 +1,23 @@
+// Package brotlidecoder provides a heimdall.ContentDecoder for brotli
+// bodies.
+//
+// It lives outside the heimdall package so that clients which never receive
+// brotli do not depend on the decoder:
+//
+//	heimdall.RegisterContentDecoder(brotlidecoder.Encoding, brotlidecoder.Decode)
+package brotlidecoder
+
+import (
+	"io"
+	"io/ioutil"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Encoding is the content encoding the decoder is registered for
+const Encoding = "br"
+
+// Decode returns a reader of the decoded content of the brotli stream r
+func Decode(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(brotli.NewReader(r)), nil
+}
@@ -0,0 +1,50 @@
+package brotlidecoder
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/gojektech/heimdall"
+	"github.com/gojektech/heimdall/heimdalltest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const payload = `{"encoding":"br","items":[1,2,3]}` + "\n"
+
+func TestDecoderDecodesThroughClient(t *testing.T) {
+	fixture, err := ioutil.ReadFile("testdata/payload.br")
+	require.NoError(t, err)
+
+	var gzipped bytes.Buffer
+	writer := gzip.NewWriter(&gzipped)
+	writer.Write(fixture)
+	writer.Close()
+
+	require.NoError(t, heimdall.RegisterContentDecoder(Encoding, Decode))
+	defer heimdall.RegisterContentDecoder(Encoding, nil)
+
+	for encoding, body := range map[string][]byte{"br": fixture, "br, gzip": gzipped.Bytes()} {
+		t.Run(encoding, func(t *testing.T) {
+			server := heimdalltest.NewScriptedServer(t, heimdalltest.Step{
+				Body:    string(body),
+				Headers: http.Header{"Content-Encoding": {encoding}},
+				Assert: func(r *http.Request) error {
+					if accepted := r.Header.Get("Accept-Encoding"); accepted != "gzip, deflate, br" {
+						return fmt.Errorf("Accept-Encoding %q", accepted)
+					}
+					return nil
+				},
+			})
+
+			response, err := heimdall.NewHTTPClient(1000).Get(server.URL, http.Header{})
+			require.NoError(t, err)
+			assert.Equal(t, payload, string(response.Body()))
+			assert.Empty(t, response.Headers().Get("Content-Encoding"))
+		})
+	}
+}
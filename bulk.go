@@ -0,0 +1,219 @@
+package heimdall
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// BulkOptions configures how PostBulk splits items into chunks and sends them
+type BulkOptions struct {
+	// MaxBytes bounds the size of the body of a chunk, the JSON array of its
+	// items. Zero leaves it unbounded.
+	MaxBytes int
+	// MaxItems bounds the number of items of a chunk. Zero leaves it
+	// unbounded.
+	MaxItems int
+	// Concurrency is the number of chunks sent at once, one when less than 1
+	Concurrency int
+	// Header is sent with every chunk, whose Content-Type is always
+	// application/json
+	Header http.Header
+}
+
+// BulkChunk is the outcome of sending a chunk of the items given to PostBulk
+type BulkChunk struct {
+	// Start and End are the indices of the items of the chunk, items[Start:End]
+	Start, End int
+	// Response is the response to the chunk
+	Response Response
+	// Err is why the chunk failed: the error returned for it, or an
+	// *ErrBulkChunkRejected for a status of 400 or more. Nil when the chunk
+	// succeeded.
+	Err error
+}
+
+// BulkResult is the outcome of PostBulk, chunk by chunk
+type BulkResult struct {
+	// Chunks are the chunks sent, in the order of their items
+	Chunks []BulkChunk
+}
+
+// Failed returns the chunks that failed, in the order of their items
+func (r BulkResult) Failed() []BulkChunk {
+	var failed []BulkChunk
+	for _, chunk := range r.Chunks {
+		if chunk.Err != nil {
+			failed = append(failed, chunk)
+		}
+	}
+
+	return failed
+}
+
+// FailedItems returns the items of the chunks that failed, in order, for the
+// items given to PostBulk, so that they alone can be sent again
+func (r BulkResult) FailedItems(items []json.RawMessage) []json.RawMessage {
+	var failed []json.RawMessage
+	for _, chunk := range r.Failed() {
+		failed = append(failed, items[chunk.Start:chunk.End]...)
+	}
+
+	return failed
+}
+
+// ErrBulkItemTooLarge is returned by PostBulk, before anything is sent, for
+// an item that does not fit in a chunk of BulkOptions.MaxBytes on its own
+type ErrBulkItemTooLarge struct {
+	Index    int
+	Size     int
+	MaxBytes int
+}
+
+func (e *ErrBulkItemTooLarge) Error() string {
+	return fmt.Sprintf("bulk item %d of %d bytes does not fit in a chunk of %d bytes", e.Index, e.Size, e.MaxBytes)
+}
+
+// ErrBulkChunkRejected is the error of a chunk answered with a status of 400
+// or more that the client returned no error for
+type ErrBulkChunkRejected struct {
+	StatusCode int
+}
+
+func (e *ErrBulkChunkRejected) Error() string {
+	return fmt.Sprintf("bulk chunk rejected with status %d", e.StatusCode)
+}
+
+// ErrBulkFailed is returned by PostBulk when chunks failed. It unwraps to
+// the error of the first chunk that failed.
+type ErrBulkFailed struct {
+	Failed int
+	Chunks int
+
+	err error
+}
+
+func (e *ErrBulkFailed) Error() string {
+	return fmt.Sprintf("bulk - %d of %d chunks failed, the first with: %v", e.Failed, e.Chunks, e.err)
+}
+
+// Cause returns the error of the first chunk that failed
+func (e *ErrBulkFailed) Cause() error {
+	return e.err
+}
+
+// Unwrap returns the error of the first chunk that failed
+func (e *ErrBulkFailed) Unwrap() error {
+	return e.err
+}
+
+// PostBulk POSTs items to url through client as JSON arrays, split in order
+// into chunks within opts.MaxBytes and opts.MaxItems, with up to
+// opts.Concurrency chunks in flight. Every chunk is a request of its own, so
+// the retries of the client resend that chunk alone. The result reports the
+// items of every chunk and how it went, and an *ErrBulkFailed is returned
+// when chunks failed, so the failed items can be sent again with
+// BulkResult.FailedItems. Once ctx is done, chunks not yet sent fail with its
+// error.
+func PostBulk(ctx context.Context, client Client, url string, items []json.RawMessage, opts BulkOptions) (BulkResult, error) {
+	chunks, err := splitBulk(items, opts.MaxBytes, opts.MaxItems)
+	if err != nil {
+		return BulkResult{}, err
+	}
+
+	concurrency := opts.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, concurrency)
+	for i := range chunks {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			chunks[i].Err = ctx.Err()
+			continue
+		}
+
+		wg.Add(1)
+		go func(chunk *BulkChunk) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			chunk.Response, chunk.Err = postBulkChunk(ctx, client, url, items[chunk.Start:chunk.End], opts.Header)
+		}(&chunks[i])
+	}
+	wg.Wait()
+
+	result := BulkResult{Chunks: chunks}
+	if failed := result.Failed(); len(failed) > 0 {
+		return result, &ErrBulkFailed{Failed: len(failed), Chunks: len(chunks), err: failed[0].Err}
+	}
+
+	return result, nil
+}
+
+// splitBulk splits items, in order, into as few chunks as fit maxBytes and
+// maxItems
+func splitBulk(items []json.RawMessage, maxBytes, maxItems int) ([]BulkChunk, error) {
+	var chunks []BulkChunk
+	start, size := 0, 0
+	for i, item := range items {
+		if maxBytes > 0 && len(item)+2 > maxBytes {
+			return nil, &ErrBulkItemTooLarge{Index: i, Size: len(item), MaxBytes: maxBytes}
+		}
+
+		// The first item of a chunk comes with the brackets, the others with
+		// a comma
+		full := maxItems > 0 && i-start == maxItems
+		if i > start && (full || maxBytes > 0 && size+len(item)+1 > maxBytes) {
+			chunks = append(chunks, BulkChunk{Start: start, End: i})
+			start = i
+		}
+		if i == start {
+			size = len(item) + 2
+		} else {
+			size += len(item) + 1
+		}
+	}
+	if start < len(items) {
+		chunks = append(chunks, BulkChunk{Start: start, End: len(items)})
+	}
+
+	return chunks, nil
+}
+
+// postBulkChunk POSTs items to url as a JSON array
+func postBulkChunk(ctx context.Context, client Client, url string, items []json.RawMessage, header http.Header) (Response, error) {
+	var body bytes.Buffer
+	body.WriteByte('[')
+	for i, item := range items {
+		if i > 0 {
+			body.WriteByte(',')
+		}
+		body.Write(item)
+	}
+	body.WriteByte(']')
+
+	request, err := newRequest(http.MethodPost, url, bytes.NewReader(body.Bytes()))
+	if err != nil {
+		return Response{}, err
+	}
+	for name, values := range header {
+		request.Header[name] = append([]string(nil), values...)
+	}
+	request.Header.Set("Content-Type", jsonContentType)
+
+	response, err := SendRequest(client, request.WithContext(ctx))
+	if err == nil && response.StatusCode() >= http.StatusBadRequest {
+		err = &ErrBulkChunkRejected{StatusCode: response.StatusCode()}
+	}
+
+	return response, err
+}
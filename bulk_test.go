@@ -0,0 +1,218 @@
+package heimdall
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type bulkItem struct {
+	ID  int    `json:"id"`
+	Pad string `json:"pad"`
+}
+
+// bulkServer accepts JSON arrays of bulkItems of at most maxBytes and
+// maxItems, answering 413 to larger ones, and fails with 503 the arrays
+// holding an item whose ID is in poisoned
+type bulkServer struct {
+	*httptest.Server
+	maxBytes, maxItems int
+
+	mu       sync.Mutex
+	poisoned map[int]bool
+	received map[int]int
+	attempts []int
+}
+
+func newBulkServer(maxBytes, maxItems int, poisoned ...int) *bulkServer {
+	s := &bulkServer{maxBytes: maxBytes, maxItems: maxItems, poisoned: map[int]bool{}, received: map[int]int{}}
+	for _, id := range poisoned {
+		s.poisoned[id] = true
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var items []bulkItem
+		if err := json.Unmarshal(body, &items); err != nil || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if len(body) > s.maxBytes || len(items) > s.maxItems {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.attempts = append(s.attempts, items[0].ID)
+		for _, item := range items {
+			if s.poisoned[item.ID] {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		}
+		for _, item := range items {
+			s.received[item.ID]++
+		}
+		fmt.Fprintf(w, "%d", len(items))
+	}))
+
+	return s
+}
+
+func (s *bulkServer) heal() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.poisoned = map[int]bool{}
+}
+
+func bulkItems(n int) []json.RawMessage {
+	items := make([]json.RawMessage, n)
+	for i := range items {
+		items[i], _ = json.Marshal(bulkItem{ID: i, Pad: strings.Repeat("x", i%13)})
+	}
+
+	return items
+}
+
+func TestPostBulkSplitsWithinLimits(t *testing.T) {
+	server := newBulkServer(200, 7)
+	defer server.Close()
+
+	items := bulkItems(60)
+	result, err := PostBulk(context.Background(), NewHTTPClient(1000), server.URL, items, BulkOptions{MaxBytes: 200, MaxItems: 7, Concurrency: 4})
+	require.NoError(t, err)
+	assert.Empty(t, result.Failed())
+
+	end := 0
+	for _, chunk := range result.Chunks {
+		assert.Equal(t, end, chunk.Start, "chunks cover the items in order")
+		end = chunk.End
+		assert.Equal(t, http.StatusOK, chunk.Response.StatusCode())
+		assert.Equal(t, fmt.Sprint(chunk.End-chunk.Start), string(chunk.Response.Body()))
+	}
+	assert.Equal(t, len(items), end)
+
+	require.Len(t, server.received, len(items))
+	for id, times := range server.received {
+		assert.Equal(t, 1, times, "item %d", id)
+	}
+}
+
+func TestPostBulkFillsChunks(t *testing.T) {
+	items := []json.RawMessage{json.RawMessage(`1`), json.RawMessage(`22`), json.RawMessage(`3`), json.RawMessage(`4444`), json.RawMessage(`5`)}
+
+	for name, tc := range map[string]struct {
+		maxBytes, maxItems int
+		ranges             [][2]int
+	}{
+		"unbounded":       {ranges: [][2]int{{0, 5}}},
+		"by items":        {maxItems: 2, ranges: [][2]int{{0, 2}, {2, 4}, {4, 5}}},
+		"by bytes":        {maxBytes: 8, ranges: [][2]int{{0, 3}, {3, 5}}},
+		"exactly fitting": {maxBytes: 6, ranges: [][2]int{{0, 2}, {2, 3}, {3, 4}, {4, 5}}},
+		"whichever first": {maxBytes: 8, maxItems: 1, ranges: [][2]int{{0, 1}, {1, 2}, {2, 3}, {3, 4}, {4, 5}}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			chunks, err := splitBulk(items, tc.maxBytes, tc.maxItems)
+			require.NoError(t, err)
+
+			var ranges [][2]int
+			for _, chunk := range chunks {
+				ranges = append(ranges, [2]int{chunk.Start, chunk.End})
+			}
+			assert.Equal(t, tc.ranges, ranges)
+		})
+	}
+}
+
+func TestPostBulkReportsFailedChunks(t *testing.T) {
+	server := newBulkServer(1<<20, 5, 12)
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+	client.SetRetryCount(2)
+	client.SetRetrier(NewRetrier(NewConstantBackoff(1)))
+
+	items := bulkItems(23)
+	result, err := PostBulk(context.Background(), client, server.URL, items, BulkOptions{MaxItems: 5, Concurrency: 3})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "bulk - 1 of 5 chunks failed, the first with: server error: 503")
+
+	var bulkErr *ErrBulkFailed
+	require.True(t, errors.As(err, &bulkErr))
+	assert.Equal(t, 1, bulkErr.Failed)
+	assert.Equal(t, 5, bulkErr.Chunks)
+
+	failed := result.Failed()
+	require.Len(t, failed, 1)
+	assert.Equal(t, 10, failed[0].Start)
+	assert.Equal(t, 15, failed[0].End)
+	assert.Equal(t, items[10:15], result.FailedItems(items))
+
+	retried := 0
+	for _, first := range server.attempts {
+		if first == 10 {
+			retried++
+		}
+	}
+	assert.Equal(t, 3, retried, "the failing chunk is retried")
+	assert.Len(t, server.attempts, 7, "the other chunks are sent once")
+	assert.Len(t, server.received, 18)
+
+	server.heal()
+	result, err = PostBulk(context.Background(), client, server.URL, result.FailedItems(items), BulkOptions{MaxItems: 5})
+	require.NoError(t, err)
+	require.Len(t, result.Chunks, 1)
+	require.Len(t, server.received, len(items))
+	for id, times := range server.received {
+		assert.Equal(t, 1, times, "item %d", id)
+	}
+}
+
+func TestPostBulkReportsRejectedChunks(t *testing.T) {
+	server := newBulkServer(100, 100)
+	defer server.Close()
+
+	items := bulkItems(30)
+	result, err := PostBulk(context.Background(), NewHTTPClient(1000), server.URL, items, BulkOptions{MaxBytes: 400})
+	var rejected *ErrBulkChunkRejected
+	require.True(t, errors.As(err, &rejected), "%v", err)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rejected.StatusCode)
+	assert.Len(t, result.Failed(), len(result.Chunks))
+	assert.Equal(t, items, result.FailedItems(items))
+}
+
+func TestPostBulkRefusesItemsTooLarge(t *testing.T) {
+	server := newBulkServer(100, 100)
+	defer server.Close()
+
+	items := append(bulkItems(3), json.RawMessage(`"`+strings.Repeat("x", 100)+`"`))
+	_, err := PostBulk(context.Background(), NewHTTPClient(1000), server.URL, items, BulkOptions{MaxBytes: 100})
+	assert.EqualError(t, err, "bulk item 3 of 102 bytes does not fit in a chunk of 100 bytes")
+	assert.Empty(t, server.attempts, "nothing is sent")
+}
+
+func TestPostBulkStopsOnceTheContextIsDone(t *testing.T) {
+	server := newBulkServer(1<<20, 100)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result, err := PostBulk(ctx, NewHTTPClient(1000), server.URL, bulkItems(10), BulkOptions{MaxItems: 2})
+	assert.True(t, errors.Is(err, context.Canceled), "%v", err)
+	require.Len(t, result.Chunks, 5)
+	for _, chunk := range result.Chunks {
+		assert.Equal(t, context.Canceled, chunk.Err)
+	}
+	assert.Empty(t, server.attempts)
+}
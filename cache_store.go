@@ -0,0 +1,54 @@
+package heimdall
+
+import (
+	"net/http"
+	"time"
+)
+
+// CachedResponse is a response kept in a CacheStore
+type CachedResponse struct {
+	StatusCode int
+	Headers    http.Header
+	Body       []byte
+	// Expires is when the entry stops being served, never if zero
+	Expires time.Time
+}
+
+// NewCachedResponse returns an entry for response expiring at expires, never
+// if zero. The entry shares no memory with response.
+func NewCachedResponse(response Response, expires time.Time) CachedResponse {
+	cloned := response.clone()
+
+	return CachedResponse{
+		StatusCode: cloned.statusCode,
+		Headers:    cloned.headers,
+		Body:       cloned.body,
+		Expires:    expires,
+	}
+}
+
+// Response returns the response kept in the entry, sharing no memory with it
+func (c CachedResponse) Response() Response {
+	return Response{
+		statusCode: c.StatusCode,
+		headers:    c.Headers,
+		body:       c.Body,
+		hasBody:    expectsBody(http.MethodGet, c.StatusCode),
+	}.clone()
+}
+
+// Expired reports whether the entry is past its expiry at now
+func (c CachedResponse) Expired(now time.Time) bool {
+	return !c.Expires.IsZero() && !now.Before(c.Expires)
+}
+
+// CacheStore keeps cached responses by key. Implementations must be safe for
+// concurrent use, and should report an unreadable entry as a miss rather
+// than an error so that callers can fall back to the network.
+type CacheStore interface {
+	// Get returns the entry for key, and false if there is none or it has
+	// expired
+	Get(key string) (CachedResponse, bool, error)
+	Set(key string, response CachedResponse) error
+	Delete(key string) error
+}
@@ -0,0 +1,67 @@
+package heimdall
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"time"
+)
+
+// ErrCallbackPanic is returned when code supplied to a client panics while a
+// request is made: a request validator or mutator, a plugin, a retrier, a slow
+// request hook, the Func of a fallback chain step, or a middleware, Doer, audit
+// sink, TLSInfo callback, informational response hook, failure classifier or
+// raw request mutator sending an attempt. The panic is recovered so that it
+// fails the request, or the attempt, which hystrix and the failure detector
+// count as failed, instead of the process.
+type ErrCallbackPanic struct {
+	// Callback names the kind of code that panicked
+	Callback string
+	// Value is the value passed to panic
+	Value interface{}
+	// Stack is the stack of the panicking goroutine
+	Stack []byte
+}
+
+func (e *ErrCallbackPanic) Error() string {
+	return fmt.Sprintf("panic in %s: %v", e.Callback, e.Value)
+}
+
+// Unwrap returns the panic value when it is an error
+func (e *ErrCallbackPanic) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+// recoverCallback turns a panic of callback into an *ErrCallbackPanic stored
+// in err. It only recovers when deferred directly.
+func recoverCallback(callback string, err *error) {
+	if value := recover(); value != nil {
+		*err = &ErrCallbackPanic{Callback: callback, Value: value, Stack: debug.Stack()}
+	}
+}
+
+// recoveredAttempt runs attemptFn, failing the attempt when it panics
+func recoveredAttempt(attemptFn attemptFunc, request *http.Request, attempt int, lastResponse Response) (outcome attemptOutcome) {
+	var err error
+	defer func() {
+		if err != nil {
+			outcome = attemptOutcome{err: err, cause: err}
+		}
+	}()
+	defer recoverCallback("attempt", &err)
+
+	return attemptFn(request, attempt, lastResponse)
+}
+
+// nextInterval asks retrier for the wait before retry, after showing it the
+// response of the attempt that failed when it is an AttemptObserver
+func nextInterval(retrier Retriable, retry int, response Response) (interval time.Duration, err error) {
+	defer recoverCallback("retrier", &err)
+
+	if observer, ok := retrier.(AttemptObserver); ok {
+		observer.ObserveAttempt(retry, response.statusCode, copyHeader(response.headers))
+	}
+
+	return retrier.NextInterval(retry), nil
+}
@@ -0,0 +1,150 @@
+package heimdall
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/afex/hystrix-go/hystrix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type panickingBackoff struct{}
+
+func (panickingBackoff) Next(retry int) time.Duration {
+	panic("backoff exploded")
+}
+
+func panickingMiddleware(value interface{}) Middleware {
+	return func(next Doer) Doer {
+		return DoerFunc(func(request *http.Request) (*http.Response, error) {
+			panic(value)
+		})
+	}
+}
+
+func TestClientsRecoverPanickingCallbacks(t *testing.T) {
+	cases := map[string]struct {
+		setup    func(client testClient)
+		callback string
+		calls    int32
+	}{
+		"validator": {
+			setup: func(client testClient) {
+				client.SetRequestValidator(func(request *http.Request) error { panic("validator exploded") })
+			},
+			callback: "request validator",
+		},
+		"mutator": {
+			setup: func(client testClient) {
+				client.AddRequestMutator(RequestMutatorFunc(func(request *http.Request) error { panic("mutator exploded") }))
+			},
+			callback: "request mutator",
+		},
+		"middleware": {
+			setup: func(client testClient) {
+				client.Use(panickingMiddleware("middleware exploded"))
+			},
+			callback: "attempt",
+		},
+		"retrier": {
+			setup: func(client testClient) {
+				client.Use(func(next Doer) Doer {
+					return DoerFunc(func(request *http.Request) (*http.Response, error) {
+						next.Do(request)
+						return nil, io.ErrUnexpectedEOF
+					})
+				})
+				client.SetRetryCount(2)
+				client.SetRetrier(NewRetrier(panickingBackoff{}))
+			},
+			callback: "retrier",
+			calls:    1,
+		},
+	}
+
+	for name, tc := range cases {
+		for kind, newClient := range retryClients {
+			t.Run(name+"/"+kind, func(t *testing.T) {
+				var calls int32
+				server := countingServer(&calls)
+				defer server.Close()
+
+				client := newClient("callback_panic_"+name, realClock{})
+				tc.setup(client)
+
+				_, err := client.Get(server.URL, http.Header{})
+				require.Error(t, err)
+
+				var panicked *ErrCallbackPanic
+				require.True(t, errors.As(err, &panicked), "%v", err)
+				assert.Equal(t, tc.callback, panicked.Callback)
+				assert.Contains(t, err.Error(), "exploded")
+				assert.Contains(t, string(panicked.Stack), "callback_panic_test.go")
+				assert.Equal(t, tc.calls, atomic.LoadInt32(&calls))
+			})
+		}
+	}
+}
+
+func TestCallbackPanicIsRetriedAsFailedAttempt(t *testing.T) {
+	var calls int32
+	server := countingServer(&calls)
+	defer server.Close()
+
+	panics := int32(0)
+	client := NewHTTPClient(1000)
+	client.SetRetryCount(2)
+	client.Use(func(next Doer) Doer {
+		return DoerFunc(func(request *http.Request) (*http.Response, error) {
+			if atomic.AddInt32(&panics, 1) == 1 {
+				panic("first attempt exploded")
+			}
+			return next.Do(request)
+		})
+	})
+
+	response, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestHystrixCountsCallbackPanicAsFailure(t *testing.T) {
+	var calls int32
+	server := countingServer(&calls)
+	defer server.Close()
+
+	client := NewHystrixHTTPClient(1000, openOnFirstFailure(uniqueName("callback_panic_circuit_command")))
+	client.Use(panickingMiddleware(errors.New("plugin exploded")))
+
+	_, err := client.Get(server.URL, http.Header{})
+
+	var panicked *ErrCallbackPanic
+	require.True(t, errors.As(err, &panicked), "%v", err)
+	assert.EqualError(t, panicked.Unwrap(), "plugin exploded")
+
+	_, err = client.Get(server.URL, http.Header{})
+	assert.True(t, errors.Is(err, hystrix.ErrCircuitOpen), "%v", err)
+}
+
+func TestFailureDetectorCountsCallbackPanic(t *testing.T) {
+	var calls int32
+	server := countingServer(&calls)
+	defer server.Close()
+
+	detector, err := NewFailureDetector(FailureDetectorConfig{Window: time.Minute, Buckets: 6, ErrorPercentThreshold: 50}, realClock{})
+	require.NoError(t, err)
+	client := NewHTTPClient(1000, WithFailureDetector(detector))
+	client.Use(panickingMiddleware("middleware exploded"))
+
+	client.Get(server.URL, http.Header{})
+
+	snapshot := detector.Snapshot()
+	assert.Equal(t, 1, snapshot.Requests)
+	assert.Equal(t, 1, snapshot.Failures)
+}
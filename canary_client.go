@@ -0,0 +1,294 @@
+package heimdall
+
+import (
+	"context"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// CanaryClient is a Client splitting traffic between a stable and a canary
+// client, created with NewCanaryClient
+type CanaryClient struct {
+	stable Client
+	canary Client
+
+	percent      uint64
+	random       func() float64
+	stickyHeader string
+	fallback     bool
+}
+
+// CanaryOption configures optional behaviour of a canary client
+type CanaryOption func(*CanaryClient)
+
+// WithCanaryFallback retries requests that fail on the canary against stable
+func WithCanaryFallback() CanaryOption {
+	return func(cc *CanaryClient) {
+		cc.fallback = true
+	}
+}
+
+// WithCanaryStickyHeader routes requests by a hash of the named header, so
+// requests carrying the same value, such as a user ID, always reach the same
+// arm for a given percentage. Requests without the header are routed randomly.
+func WithCanaryStickyHeader(name string) CanaryOption {
+	return func(cc *CanaryClient) {
+		cc.stickyHeader = name
+	}
+}
+
+// NewCanaryClient returns a Client which sends percent (0-100) of requests to
+// canary and the rest to stable. SetRetryCount and SetRetrier are applied to
+// both clients, which are otherwise configured on their own, and EnableExpvar
+// publishes the metrics of each arm under "<prefix>.stable" and
+// "<prefix>.canary" so their error rates can be compared.
+func NewCanaryClient(stable, canary Client, percent float64, opts ...CanaryOption) *CanaryClient {
+	cc := &CanaryClient{
+		stable: stable,
+		canary: canary,
+		random: rand.Float64,
+	}
+	for _, opt := range opts {
+		opt(cc)
+	}
+	cc.SetPercent(percent)
+
+	return cc
+}
+
+// SetPercent changes the share of requests sent to the canary, taking effect
+// for requests started after the call
+func (cc *CanaryClient) SetPercent(percent float64) {
+	atomic.StoreUint64(&cc.percent, math.Float64bits(math.Max(0, math.Min(percent, 100))))
+}
+
+// Percent returns the share of requests sent to the canary
+func (cc *CanaryClient) Percent() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&cc.percent))
+}
+
+// routesToCanary decides which arm serves a request with headers
+func (cc *CanaryClient) routesToCanary(headers http.Header) bool {
+	percent := cc.Percent()
+
+	if cc.stickyHeader != "" {
+		if value := headers.Get(cc.stickyHeader); value != "" {
+			hash := fnv.New32a()
+			hash.Write([]byte(value))
+			return float64(hash.Sum32()%10000)/100 < percent
+		}
+	}
+
+	return cc.random()*100 < percent
+}
+
+// call runs request on the chosen arm, falling back to stable when enabled
+func (cc *CanaryClient) call(headers http.Header, request func(c Client) (Response, error)) (Response, error) {
+	if !cc.routesToCanary(headers) {
+		return request(cc.stable)
+	}
+
+	response, err := request(cc.canary)
+	if err != nil && cc.fallback {
+		return request(cc.stable)
+	}
+
+	return response, err
+}
+
+// bufferBody reads body when it may have to be sent twice
+func (cc *CanaryClient) bufferBody(body io.Reader) (func() io.Reader, error) {
+	if !cc.fallback {
+		return func() io.Reader { return body }, nil
+	}
+
+	data, err := readShadowBody(body)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() io.Reader { return shadowBody(data) }, nil
+}
+
+// Derive returns a canary client over clients derived from both arms,
+// starting from the current percentage and with the same options
+func (cc *CanaryClient) Derive(opts ...Option) Client {
+	derived := &CanaryClient{
+		stable:       deriveClient(cc.stable, opts),
+		canary:       deriveClient(cc.canary, opts),
+		random:       cc.random,
+		stickyHeader: cc.stickyHeader,
+		fallback:     cc.fallback,
+	}
+	derived.SetPercent(cc.Percent())
+
+	return derived
+}
+
+// With returns a view of cc setting the defaults of opts on every request
+// sent through it
+func (cc *CanaryClient) With(opts ...RequestOption) Client {
+	return newScopedClient(cc, requestDefaults{}, opts)
+}
+
+// SetRetryCount sets the retry count of both clients
+func (cc *CanaryClient) SetRetryCount(count int) {
+	cc.stable.SetRetryCount(count)
+	cc.canary.SetRetryCount(count)
+}
+
+// SetRetrier sets the retry strategy of both clients
+func (cc *CanaryClient) SetRetrier(retrier Retriable) {
+	cc.stable.SetRetrier(retrier)
+	cc.canary.SetRetrier(retrier)
+}
+
+// Stats returns the stats of the stable client. The stats of each arm are
+// returned by StableStats and CanaryStats.
+func (cc *CanaryClient) Stats() ClientStats {
+	return statsOf(cc.stable)
+}
+
+// StableStats returns the stats of the stable client
+func (cc *CanaryClient) StableStats() ClientStats {
+	return statsOf(cc.stable)
+}
+
+// CanaryStats returns the stats of the canary client
+func (cc *CanaryClient) CanaryStats() ClientStats {
+	return statsOf(cc.canary)
+}
+
+// EnableExpvar publishes the metrics of each arm under its own prefix, for
+// the arms that publish metrics
+func (cc *CanaryClient) EnableExpvar(prefix string) {
+	enableExpvar(cc.stable, prefix+".stable")
+	enableExpvar(cc.canary, prefix+".canary")
+}
+
+func enableExpvar(client Client, prefix string) {
+	if metrics, ok := client.(interface{ EnableExpvar(prefix string) }); ok {
+		metrics.EnableExpvar(prefix)
+	}
+}
+
+// Get makes a HTTP GET request through the chosen arm
+func (cc *CanaryClient) Get(url string, headers http.Header) (Response, error) {
+	return cc.call(headers, func(c Client) (Response, error) { return c.Get(url, headers) })
+}
+
+// Post makes a HTTP POST request through the chosen arm
+func (cc *CanaryClient) Post(url string, body io.Reader, headers http.Header) (Response, error) {
+	reader, err := cc.bufferBody(body)
+	if err != nil {
+		return Response{}, errors.Wrap(err, "POST - request body read failed")
+	}
+
+	return cc.call(headers, func(c Client) (Response, error) { return c.Post(url, reader(), headers) })
+}
+
+// Put makes a HTTP PUT request through the chosen arm
+func (cc *CanaryClient) Put(url string, body io.Reader, headers http.Header) (Response, error) {
+	reader, err := cc.bufferBody(body)
+	if err != nil {
+		return Response{}, errors.Wrap(err, "PUT - request body read failed")
+	}
+
+	return cc.call(headers, func(c Client) (Response, error) { return c.Put(url, reader(), headers) })
+}
+
+// Patch makes a HTTP PATCH request through the chosen arm
+func (cc *CanaryClient) Patch(url string, body io.Reader, headers http.Header) (Response, error) {
+	reader, err := cc.bufferBody(body)
+	if err != nil {
+		return Response{}, errors.Wrap(err, "PATCH - request body read failed")
+	}
+
+	return cc.call(headers, func(c Client) (Response, error) { return c.Patch(url, reader(), headers) })
+}
+
+// Delete makes a HTTP DELETE request through the chosen arm
+func (cc *CanaryClient) Delete(url string, headers http.Header) (Response, error) {
+	return cc.call(headers, func(c Client) (Response, error) { return c.Delete(url, headers) })
+}
+
+// Invoke makes a HTTP request with method through the chosen arm
+func (cc *CanaryClient) Invoke(method, url string, body io.Reader, headers http.Header) (Response, error) {
+	reader, err := cc.bufferBody(body)
+	if err != nil {
+		return Response{}, errors.Wrapf(err, "%s - request body read failed", method)
+	}
+
+	return cc.call(headers, func(c Client) (Response, error) { return invoke(c, method, url, reader(), headers) })
+}
+
+// Do sends the request through the chosen arm
+func (cc *CanaryClient) Do(request *http.Request) (Response, error) {
+	if !cc.fallback {
+		return cc.call(request.Header, func(c Client) (Response, error) { return SendRequest(c, request) })
+	}
+
+	data, err := readShadowBody(request.Body)
+	if err != nil {
+		return Response{}, errors.Wrap(err, "request body read failed")
+	}
+
+	return cc.call(request.Header, func(c Client) (Response, error) {
+		return SendRequest(c, withShadowBody(request.WithContext(request.Context()), data))
+	})
+}
+
+// NewRequest returns a builder for a request sent through the chosen arm
+func (cc *CanaryClient) NewRequest(method, template string) *RequestBuilder {
+	return newRequestBuilder(cc, method, template)
+}
+
+// PostAsync queues the request on the chosen arm, without fallback
+func (cc *CanaryClient) PostAsync(url string, body []byte, headers http.Header) error {
+	if cc.routesToCanary(headers) {
+		return postAsync(cc.canary, url, body, headers)
+	}
+
+	return postAsync(cc.stable, url, body, headers)
+}
+
+// Flush waits for the async queues of both clients
+func (cc *CanaryClient) Flush(ctx context.Context) error {
+	if err := flushClient(ctx, cc.stable); err != nil {
+		return err
+	}
+
+	return flushClient(ctx, cc.canary)
+}
+
+// Shutdown shuts both clients down, returning the error of the stable one
+// first
+func (cc *CanaryClient) Shutdown(ctx context.Context) error {
+	stableErr := shutdownClient(ctx, cc.stable)
+	canaryErr := shutdownClient(ctx, cc.canary)
+	if stableErr != nil {
+		return stableErr
+	}
+
+	return canaryErr
+}
+
+// GetSSE opens the event stream on the chosen arm
+func (cc *CanaryClient) GetSSE(ctx context.Context, url string, headers http.Header) (<-chan Event, func(), error) {
+	if !cc.routesToCanary(headers) {
+		return getSSE(ctx, cc.stable, url, headers)
+	}
+
+	events, cancel, err := getSSE(ctx, cc.canary, url, headers)
+	if err != nil && cc.fallback {
+		return getSSE(ctx, cc.stable, url, headers)
+	}
+
+	return events, cancel, err
+}
@@ -0,0 +1,176 @@
+package heimdall
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var _ Client = (*CanaryClient)(nil)
+
+func newArmClients() (Client, Client) {
+	return NewNoopClient(http.StatusOK, []byte("stable")), NewNoopClient(http.StatusCreated, []byte("canary"))
+}
+
+func countCanary(t *testing.T, client Client, requests int, headers func(i int) http.Header) int {
+	canary := 0
+	for i := 0; i < requests; i++ {
+		response, err := client.Get("http://example.com", headers(i))
+		require.NoError(t, err)
+		if response.StatusCode() == http.StatusCreated {
+			canary++
+		}
+	}
+
+	return canary
+}
+
+func noHeaders(i int) http.Header {
+	return http.Header{}
+}
+
+func TestCanaryClientSplitsTrafficByPercent(t *testing.T) {
+	stable, canary := newArmClients()
+	client := NewCanaryClient(stable, canary, 20)
+
+	routed := countCanary(t, client, 10000, noHeaders)
+
+	assert.InDelta(t, 2000, routed, 300)
+}
+
+func TestCanaryClientSetPercentAtRuntime(t *testing.T) {
+	stable, canary := newArmClients()
+	client := NewCanaryClient(stable, canary, 50)
+
+	client.SetPercent(0)
+	assert.Equal(t, 0, countCanary(t, client, 1000, noHeaders))
+
+	client.SetPercent(100)
+	assert.Equal(t, 1000, countCanary(t, client, 1000, noHeaders))
+
+	client.SetPercent(250)
+	assert.Equal(t, float64(100), client.Percent())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			client.SetPercent(float64(i * 10))
+		}(i)
+		go func() {
+			defer wg.Done()
+			client.Get("http://example.com", http.Header{})
+		}()
+	}
+	wg.Wait()
+}
+
+func TestCanaryClientStickyHeaderKeepsUsersOnOneArm(t *testing.T) {
+	stable, canary := newArmClients()
+	client := NewCanaryClient(stable, canary, 30, WithCanaryStickyHeader("X-User-ID"))
+
+	usersOnCanary := 0
+	for user := 0; user < 1000; user++ {
+		headers := func(i int) http.Header {
+			return http.Header{"X-User-Id": []string{fmt.Sprintf("user-%d", user)}}
+		}
+
+		routed := countCanary(t, client, 10, headers)
+		require.True(t, routed == 0 || routed == 10, "user-%d was split across arms", user)
+		if routed == 10 {
+			usersOnCanary++
+		}
+	}
+
+	assert.InDelta(t, 300, usersOnCanary, 60)
+
+	client.SetPercent(100)
+	assert.Equal(t, 1000, countCanary(t, client, 1000, func(i int) http.Header {
+		return http.Header{"X-User-Id": []string{fmt.Sprintf("user-%d", i)}}
+	}))
+}
+
+func canaryServers(t *testing.T) (*httptest.Server, *httptest.Server) {
+	stable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(append([]byte("stable:"), body...))
+	}))
+	canary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+
+	return stable, canary
+}
+
+// armClient sends every request to server, whatever URL it was made for
+func armClient(server *httptest.Server) Client {
+	client := NewHTTPClient(1000)
+	client.Use(func(next Doer) Doer {
+		return DoerFunc(func(request *http.Request) (*http.Response, error) {
+			request.URL.Host = server.Listener.Addr().String()
+			return next.Do(request)
+		})
+	})
+
+	return client
+}
+
+func TestCanaryClientFallsBackToStableWhenEnabled(t *testing.T) {
+	stableServer, canaryServer := canaryServers(t)
+	defer stableServer.Close()
+	defer canaryServer.Close()
+
+	client := NewCanaryClient(armClient(stableServer), armClient(canaryServer), 100, WithCanaryFallback())
+
+	response, err := client.Post("http://upstream.local/items", bytes.NewBufferString("payload"), http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, "stable:payload", string(response.Body()))
+
+	request, err := http.NewRequest(http.MethodPut, "http://upstream.local/items", bytes.NewBufferString("again"))
+	require.NoError(t, err)
+	response, err = client.Do(request)
+	require.NoError(t, err)
+	assert.Equal(t, "stable:again", string(response.Body()))
+}
+
+func TestCanaryClientReturnsCanaryErrorsWithoutFallback(t *testing.T) {
+	stableServer, canaryServer := canaryServers(t)
+	defer stableServer.Close()
+	defer canaryServer.Close()
+
+	client := NewCanaryClient(armClient(stableServer), armClient(canaryServer), 100)
+
+	response, err := client.Get("http://upstream.local/items", http.Header{})
+	require.Error(t, err)
+	assert.Equal(t, http.StatusInternalServerError, response.StatusCode())
+}
+
+func TestCanaryClientPublishesMetricsPerArm(t *testing.T) {
+	prefix := uniqueName("heimdall_canary_test")
+	stableServer, canaryServer := canaryServers(t)
+	defer stableServer.Close()
+	defer canaryServer.Close()
+
+	client := NewCanaryClient(armClient(stableServer), armClient(canaryServer), 50)
+	client.EnableExpvar(prefix)
+
+	for i := 0; i < 100; i++ {
+		client.Get("http://upstream.local/items", http.Header{})
+	}
+
+	stableRequests := expvar.Get(prefix + ".stable.requests").(*expvar.Int).Value()
+	canaryRequests := expvar.Get(prefix + ".canary.requests").(*expvar.Int).Value()
+
+	assert.Equal(t, int64(100), stableRequests+canaryRequests)
+	assert.Equal(t, "0", expvar.Get(prefix+".stable.errors").String())
+	assert.Equal(t, canaryRequests, expvar.Get(prefix+".canary.errors").(*expvar.Int).Value())
+}
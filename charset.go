@@ -0,0 +1,43 @@
+package heimdall
+
+import (
+	"mime"
+	"strings"
+
+	"golang.org/x/text/encoding/ianaindex"
+)
+
+// decodeCharset transcodes the body to UTF-8 according to the charset declared
+// by contentType. Charsets which cannot be decoded leave the body untouched and
+// are flagged on the response instead of failing the request, as are those of
+// bodies spooled to a file.
+func (hr *Response) decodeCharset(contentType string) {
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return
+	}
+
+	charset := strings.ToLower(strings.TrimSpace(params["charset"]))
+	if charset == "" {
+		return
+	}
+
+	hr.charset = charset
+	if charset == "utf-8" || charset == "utf8" || charset == "us-ascii" {
+		return
+	}
+
+	encoding, err := ianaindex.IANA.Encoding(charset)
+	if err != nil || encoding == nil || hr.spool != nil {
+		hr.charsetUnsupported = true
+		return
+	}
+
+	decoded, err := encoding.NewDecoder().Bytes(hr.body)
+	if err != nil {
+		hr.charsetUnsupported = true
+		return
+	}
+
+	hr.body = decoded
+}
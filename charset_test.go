@@ -0,0 +1,90 @@
+package heimdall
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func charsetServer(contentType string, body []byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Write(body)
+	}))
+}
+
+func TestHTTPClientDecodesLatin1Body(t *testing.T) {
+	// "café à la crème" in ISO-8859-1
+	latin1 := []byte{'c', 'a', 'f', 0xe9, ' ', 0xe0, ' ', 'l', 'a', ' ', 'c', 'r', 0xe8, 'm', 'e'}
+
+	server := charsetServer("text/plain; charset=ISO-8859-1", latin1)
+	defer server.Close()
+
+	client := NewHTTPClient(10, WithCharsetDecoding())
+
+	response, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+
+	assert.Equal(t, "café à la crème", string(response.Body()))
+	assert.Equal(t, "iso-8859-1", response.Charset())
+	assert.False(t, response.CharsetUnsupported())
+}
+
+func TestHystrixHTTPClientDecodesUTF16Body(t *testing.T) {
+	// `{"name":"ß"}` in UTF-16 with a little endian byte order mark
+	utf16 := []byte{0xff, 0xfe, '{', 0, '"', 0, 'n', 0, 'a', 0, 'm', 0, 'e', 0, '"', 0, ':', 0, '"', 0, 0xdf, 0, '"', 0, '}', 0}
+
+	server := charsetServer("application/json; charset=UTF-16", utf16)
+	defer server.Close()
+
+	client := NewHystrixHTTPClient(10, NewHystrixConfig("charset_command", HystrixCommandConfig{}), WithCharsetDecoding())
+
+	response, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+
+	assert.Equal(t, `{"name":"ß"}`, string(response.Body()))
+	assert.Equal(t, "utf-16", response.Charset())
+}
+
+func TestHTTPClientPassesThroughUnknownCharset(t *testing.T) {
+	server := charsetServer("text/plain; charset=x-made-up", []byte("raw \xff bytes"))
+	defer server.Close()
+
+	client := NewHTTPClient(10, WithCharsetDecoding())
+
+	response, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+
+	assert.Equal(t, []byte("raw \xff bytes"), response.Body())
+	assert.Equal(t, "x-made-up", response.Charset())
+	assert.True(t, response.CharsetUnsupported())
+}
+
+func TestHTTPClientLeavesUTF8BodyUntouched(t *testing.T) {
+	server := charsetServer("text/plain; charset=utf-8", []byte("café"))
+	defer server.Close()
+
+	client := NewHTTPClient(10, WithCharsetDecoding())
+
+	response, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+
+	assert.Equal(t, "café", string(response.Body()))
+	assert.False(t, response.CharsetUnsupported())
+}
+
+func TestHTTPClientDoesNotDecodeCharsetByDefault(t *testing.T) {
+	latin1 := []byte{'c', 'a', 'f', 0xe9}
+
+	server := charsetServer("text/plain; charset=ISO-8859-1", latin1)
+	defer server.Close()
+
+	response, err := NewHTTPClient(10).Get(server.URL, http.Header{})
+	require.NoError(t, err)
+
+	assert.Equal(t, latin1, response.Body())
+	assert.Equal(t, "", response.Charset())
+}
@@ -0,0 +1,367 @@
+package heimdall
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// checkBodyExcerpt is how much of a body a CheckResult keeps
+const checkBodyExcerpt = 512
+
+// CheckSpec describes a smoke test of an endpoint, such as GET /health
+// answering 200 within 300ms with a body containing "status":"ok"
+type CheckSpec struct {
+	// Name identifies the check in results, the method and URL when empty
+	Name string
+	// Method is the method of the request, GET when empty
+	Method string
+	// URL is the URL of the request, which may be relative to the base URL of
+	// the client
+	URL string
+	// RequestHeaders and RequestBody are sent with the request
+	RequestHeaders http.Header
+	RequestBody    []byte
+
+	// MaxLatency is the longest the request, retries included, may take, no
+	// limit when 0
+	MaxLatency time.Duration
+	// WantStatus is the status the response must have, any 2xx when 0
+	WantStatus int
+	// BodyContains are strings the body must contain
+	BodyContains []string
+	// JSONPath maps dot separated paths into the JSON body, such as "status"
+	// or "checks.0.name", to the values they must hold. Values are compared
+	// once encoded and decoded as JSON, so 1 matches 1.0.
+	JSONPath map[string]interface{}
+	// Headers maps response headers to the values they must have
+	Headers map[string]string
+}
+
+func (spec CheckSpec) name() string {
+	if spec.Name != "" {
+		return spec.Name
+	}
+
+	return spec.method() + " " + spec.URL
+}
+
+func (spec CheckSpec) method() string {
+	if spec.Method == "" {
+		return http.MethodGet
+	}
+
+	return spec.Method
+}
+
+// AssertionResult is the outcome of one assertion of a check
+type AssertionResult struct {
+	// Assertion names what was asserted, such as "status", "latency", "body
+	// contains", "json status" or "header Content-Type"
+	Assertion string
+	Passed    bool
+	Expected  string
+	Actual    string
+}
+
+// CheckResult is the outcome of a check, with enough of the response to tell
+// why it failed
+type CheckResult struct {
+	Name       string
+	Passed     bool
+	Assertions []AssertionResult
+
+	// Err is the error the client returned, if any. Requests answered with an
+	// error status still have their response checked.
+	Err        error
+	StatusCode int
+	Latency    time.Duration
+	RequestID  string
+	// Body is the start of the body of the response, and BodyTruncated
+	// whether there was more of it
+	Body          string
+	BodyTruncated bool
+}
+
+// String describes the result, and for a failed check every failed assertion,
+// the timing and the start of the body
+func (r CheckResult) String() string {
+	if r.Passed {
+		return fmt.Sprintf("PASS %s (%d in %v)", r.Name, r.StatusCode, r.Latency)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "FAIL %s (%d in %v, request %s)", r.Name, r.StatusCode, r.Latency, r.RequestID)
+	if r.Err != nil {
+		fmt.Fprintf(&b, "\n  error: %v", r.Err)
+	}
+	for _, assertion := range r.Assertions {
+		if !assertion.Passed {
+			fmt.Fprintf(&b, "\n  %s: want %s, got %s", assertion.Assertion, assertion.Expected, assertion.Actual)
+		}
+	}
+	if r.Body != "" {
+		body := r.Body
+		if r.BodyTruncated {
+			body += "…"
+		}
+		fmt.Fprintf(&b, "\n  body: %s", body)
+	}
+
+	return b.String()
+}
+
+// Check sends the request spec describes through client with ctx and checks
+// the response against every assertion of spec. A request failing without a
+// response fails every assertion. The latency is measured on clock, the real
+// clock when nil.
+func Check(ctx context.Context, client Client, spec CheckSpec, clock Clock) CheckResult {
+	result := CheckResult{Name: spec.name()}
+
+	request, err := http.NewRequestWithContext(ctx, spec.method(), spec.URL, bytes.NewReader(spec.RequestBody))
+	if err != nil {
+		result.Err = err
+		result.Assertions = checkAssertions(spec, nil, nil, 0)
+		return result
+	}
+	for name, values := range spec.RequestHeaders {
+		request.Header[name] = append([]string(nil), values...)
+	}
+
+	clock = clockOrReal(clock)
+	began := clock.Now()
+	response, err := SendRequest(client, request)
+	result.Latency = clock.Now().Sub(began)
+	result.Err = err
+	defer response.Close()
+
+	if response.StatusCode() == 0 {
+		result.Assertions = checkAssertions(spec, nil, nil, result.Latency)
+		return result
+	}
+	result.StatusCode = response.StatusCode()
+	result.RequestID = response.RequestID()
+	body := response.Body()
+	if len(body) > checkBodyExcerpt {
+		result.Body, result.BodyTruncated = string(body[:checkBodyExcerpt]), true
+	} else {
+		result.Body = string(body)
+	}
+
+	result.Assertions = checkAssertions(spec, &response, body, result.Latency)
+	result.Passed = true
+	for _, assertion := range result.Assertions {
+		result.Passed = result.Passed && assertion.Passed
+	}
+
+	return result
+}
+
+// checkAssertions checks response, with body, against spec, failing every
+// assertion when there is no response
+func checkAssertions(spec CheckSpec, response *Response, body []byte, latency time.Duration) []AssertionResult {
+	var assertions []AssertionResult
+	add := func(assertion, expected string, check func() (actual string, passed bool)) {
+		result := AssertionResult{Assertion: assertion, Expected: expected, Actual: "no response"}
+		if response != nil {
+			result.Actual, result.Passed = check()
+		}
+		assertions = append(assertions, result)
+	}
+
+	wantStatus := "2xx"
+	if spec.WantStatus != 0 {
+		wantStatus = strconv.Itoa(spec.WantStatus)
+	}
+	add("status", wantStatus, func() (string, bool) {
+		status := response.StatusCode()
+		if spec.WantStatus == 0 {
+			return strconv.Itoa(status), status >= 200 && status < 300
+		}
+		return strconv.Itoa(status), status == spec.WantStatus
+	})
+
+	if spec.MaxLatency > 0 {
+		add("latency", "at most "+spec.MaxLatency.String(), func() (string, bool) {
+			return latency.String(), latency <= spec.MaxLatency
+		})
+	}
+
+	for _, substring := range spec.BodyContains {
+		substring := substring
+		add("body contains", strconv.Quote(substring), func() (string, bool) {
+			if bytes.Contains(body, []byte(substring)) {
+				return strconv.Quote(substring), true
+			}
+			return "not found", false
+		})
+	}
+
+	paths := make([]string, 0, len(spec.JSONPath))
+	for path := range spec.JSONPath {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var document interface{}
+	var documentErr error
+	if response != nil && len(paths) > 0 {
+		documentErr = json.Unmarshal(body, &document)
+	}
+	for _, path := range paths {
+		path := path
+		expected, err := normalizeJSON(spec.JSONPath[path])
+		expectedJSON, _ := json.Marshal(expected)
+		add("json "+path, string(expectedJSON), func() (string, bool) {
+			if err != nil {
+				return "unencodable expected value: " + err.Error(), false
+			}
+			if documentErr != nil {
+				return "invalid JSON: " + documentErr.Error(), false
+			}
+			actual, found := lookupJSONPath(document, strings.Split(path, "."))
+			if !found {
+				return "missing", false
+			}
+			actualJSON, _ := json.Marshal(actual)
+			return string(actualJSON), reflect.DeepEqual(actual, expected)
+		})
+	}
+
+	names := make([]string, 0, len(spec.Headers))
+	for name := range spec.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		name := name
+		expected := spec.Headers[name]
+		add("header "+http.CanonicalHeaderKey(name), strconv.Quote(expected), func() (string, bool) {
+			values := response.Headers().Values(name)
+			if len(values) == 0 {
+				return "missing", false
+			}
+			return strconv.Quote(values[0]), values[0] == expected
+		})
+	}
+
+	return assertions
+}
+
+// normalizeJSON returns value as it decodes once encoded as JSON
+func normalizeJSON(value interface{}) (interface{}, error) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var normalized interface{}
+	err = json.Unmarshal(encoded, &normalized)
+
+	return normalized, err
+}
+
+// lookupJSONPath returns the value at path in a decoded JSON document, with
+// array elements addressed by index
+func lookupJSONPath(value interface{}, path []string) (interface{}, bool) {
+	for _, key := range path {
+		switch typed := value.(type) {
+		case map[string]interface{}:
+			child, ok := typed[key]
+			if !ok {
+				return nil, false
+			}
+			value = child
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(typed) {
+				return nil, false
+			}
+			value = typed[i]
+		default:
+			return nil, false
+		}
+	}
+
+	return value, true
+}
+
+// CheckReport aggregates the results of RunChecks
+type CheckReport struct {
+	// Results are the results of the checks, in the order of the specs
+	Results []CheckResult
+	Passed  int
+	Failed  int
+}
+
+// OK reports whether every check passed
+func (r CheckReport) OK() bool {
+	return r.Failed == 0
+}
+
+// Failures returns the results of the checks that failed
+func (r CheckReport) Failures() []CheckResult {
+	var failures []CheckResult
+	for _, result := range r.Results {
+		if !result.Passed {
+			failures = append(failures, result)
+		}
+	}
+
+	return failures
+}
+
+// String describes every result, one line per passed check, followed by a
+// count of the checks passed and failed
+func (r CheckReport) String() string {
+	lines := make([]string, 0, len(r.Results)+1)
+	for _, result := range r.Results {
+		lines = append(lines, result.String())
+	}
+	lines = append(lines, fmt.Sprintf("%d passed, %d failed", r.Passed, r.Failed))
+
+	return strings.Join(lines, "\n")
+}
+
+// RunChecks runs Check for every spec with client and ctx, with at most
+// concurrency checks in flight, and aggregates the results. Once ctx is done
+// the checks not yet run fail with its error. Latencies are measured on
+// clock, the real clock when nil.
+func RunChecks(ctx context.Context, client Client, specs []CheckSpec, concurrency int, clock Clock) CheckReport {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	results := make([]CheckResult, len(specs))
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, concurrency)
+	for i, spec := range specs {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int, spec CheckSpec) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			results[i] = Check(ctx, client, spec, clock)
+		}(i, spec)
+	}
+	wg.Wait()
+
+	report := CheckReport{Results: results}
+	for _, result := range results {
+		if result.Passed {
+			report.Passed++
+		} else {
+			report.Failed++
+		}
+	}
+
+	return report
+}
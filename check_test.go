@@ -0,0 +1,295 @@
+package heimdall
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// checkServer answers /health with a JSON status, /slow after 100ms, /down
+// with 503, /big with a long body and /echo-header with the X-Echo header
+// of the request
+func checkServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/health":
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("X-Version", "1.2.0")
+			fmt.Fprint(w, `{"status":"ok","uptime":42,"checks":[{"name":"db","ok":true}]}`)
+		case "/slow":
+			time.Sleep(100 * time.Millisecond)
+		case "/down":
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, `{"status":"maintenance"}`)
+		case "/big":
+			fmt.Fprint(w, strings.Repeat("x", 2*checkBodyExcerpt))
+		case "/echo-header":
+			fmt.Fprint(w, r.Header.Get("X-Echo"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+// assertions returns whether each assertion of result passed, by assertion
+func assertions(result CheckResult) map[string]bool {
+	passed := map[string]bool{}
+	for _, assertion := range result.Assertions {
+		passed[assertion.Assertion] = assertion.Passed
+	}
+
+	return passed
+}
+
+func TestCheckStatus(t *testing.T) {
+	server := checkServer()
+	defer server.Close()
+	client := NewHTTPClient(1000)
+
+	for name, tc := range map[string]struct {
+		spec   CheckSpec
+		passed bool
+		actual string
+	}{
+		"any 2xx by default":      {spec: CheckSpec{URL: server.URL + "/health"}, passed: true, actual: "200"},
+		"404 is not a 2xx":        {spec: CheckSpec{URL: server.URL + "/missing"}, actual: "404"},
+		"the status wanted":       {spec: CheckSpec{URL: server.URL + "/missing", WantStatus: http.StatusNotFound}, passed: true, actual: "404"},
+		"error statuses checked":  {spec: CheckSpec{URL: server.URL + "/down", WantStatus: http.StatusServiceUnavailable}, passed: true, actual: "503"},
+		"another status than 201": {spec: CheckSpec{URL: server.URL + "/health", WantStatus: http.StatusCreated}, actual: "200"},
+	} {
+		result := Check(context.Background(), client, tc.spec, nil)
+		require.Len(t, result.Assertions, 1, name)
+		assert.Equal(t, "status", result.Assertions[0].Assertion, name)
+		assert.Equal(t, tc.actual, result.Assertions[0].Actual, name)
+		assert.Equal(t, tc.passed, result.Passed, name)
+	}
+}
+
+func TestCheckLatency(t *testing.T) {
+	server := checkServer()
+	defer server.Close()
+	client := NewHTTPClient(1000)
+
+	result := Check(context.Background(), client, CheckSpec{URL: server.URL + "/slow", MaxLatency: 50 * time.Millisecond}, nil)
+	assert.False(t, result.Passed)
+	assert.False(t, assertions(result)["latency"])
+	assert.GreaterOrEqual(t, int64(result.Latency), int64(100*time.Millisecond))
+	assert.Equal(t, "at most 50ms", result.Assertions[1].Expected)
+	assert.Equal(t, result.Latency.String(), result.Assertions[1].Actual)
+
+	result = Check(context.Background(), client, CheckSpec{URL: server.URL + "/slow", MaxLatency: time.Second}, nil)
+	assert.True(t, result.Passed)
+}
+
+func TestCheckBodyContains(t *testing.T) {
+	server := checkServer()
+	defer server.Close()
+
+	result := Check(context.Background(), NewHTTPClient(1000), CheckSpec{
+		URL:          server.URL + "/health",
+		BodyContains: []string{`"status":"ok"`, "degraded"},
+	}, nil)
+	assert.False(t, result.Passed)
+	require.Len(t, result.Assertions, 3)
+	assert.True(t, result.Assertions[1].Passed)
+	assert.Equal(t, AssertionResult{Assertion: "body contains", Expected: `"degraded"`, Actual: "not found"}, result.Assertions[2])
+}
+
+func TestCheckJSONPath(t *testing.T) {
+	server := checkServer()
+	defer server.Close()
+	client := NewHTTPClient(1000)
+
+	result := Check(context.Background(), client, CheckSpec{
+		URL: server.URL + "/health",
+		JSONPath: map[string]interface{}{
+			"status":        "ok",
+			"uptime":        42,
+			"checks.0.name": "db",
+			"checks.0.ok":   true,
+			"checks.1.name": "cache",
+			"version":       "1.2.0",
+			"status.code":   200,
+			"checks":        []map[string]interface{}{{"name": "db", "ok": true}},
+		},
+	}, nil)
+	assert.False(t, result.Passed)
+	assert.Equal(t, map[string]bool{
+		"status":             true,
+		"json checks":        true,
+		"json checks.0.name": true,
+		"json checks.0.ok":   true,
+		"json checks.1.name": false,
+		"json status":        true,
+		"json status.code":   false,
+		"json uptime":        true,
+		"json version":       false,
+	}, assertions(result), "numbers match whatever their Go type")
+	for _, assertion := range result.Assertions {
+		if assertion.Assertion == "json version" {
+			assert.Equal(t, `"1.2.0"`, assertion.Expected)
+			assert.Equal(t, "missing", assertion.Actual)
+		}
+	}
+
+	result = Check(context.Background(), client, CheckSpec{URL: server.URL + "/big", JSONPath: map[string]interface{}{"status": "ok"}}, nil)
+	assert.False(t, result.Passed)
+	assert.Contains(t, result.Assertions[1].Actual, "invalid JSON")
+}
+
+func TestCheckHeaders(t *testing.T) {
+	server := checkServer()
+	defer server.Close()
+
+	result := Check(context.Background(), NewHTTPClient(1000), CheckSpec{
+		URL: server.URL + "/health",
+		Headers: map[string]string{
+			"content-type": "application/json",
+			"X-Version":    "1.3.0",
+			"X-Missing":    "",
+		},
+	}, nil)
+	assert.False(t, result.Passed)
+	assert.Equal(t, []AssertionResult{
+		{Assertion: "status", Passed: true, Expected: "2xx", Actual: "200"},
+		{Assertion: "header X-Missing", Expected: `""`, Actual: "missing"},
+		{Assertion: "header X-Version", Expected: `"1.3.0"`, Actual: `"1.2.0"`},
+		{Assertion: "header Content-Type", Passed: true, Expected: `"application/json"`, Actual: `"application/json"`},
+	}, result.Assertions)
+}
+
+func TestCheckSendsTheRequestOfTheSpec(t *testing.T) {
+	server := checkServer()
+	defer server.Close()
+
+	result := Check(context.Background(), NewHTTPClient(1000), CheckSpec{
+		Name:           "echo",
+		Method:         http.MethodPost,
+		URL:            server.URL + "/echo-header",
+		RequestHeaders: http.Header{"X-Echo": {"hello"}},
+		RequestBody:    []byte("body"),
+		BodyContains:   []string{"hello"},
+	}, nil)
+	assert.True(t, result.Passed, result.String())
+	assert.Equal(t, "PASS echo (200 in "+result.Latency.String()+")", result.String())
+	assert.Equal(t, "GET "+server.URL, Check(context.Background(), NewHTTPClient(1000), CheckSpec{URL: server.URL}, nil).Name)
+}
+
+func TestFailedChecksCarryTheirContext(t *testing.T) {
+	server := checkServer()
+	defer server.Close()
+
+	result := Check(context.Background(), NewHTTPClient(1000), CheckSpec{URL: server.URL + "/big", BodyContains: []string{"y"}}, nil)
+	assert.False(t, result.Passed)
+	assert.Len(t, result.Body, checkBodyExcerpt)
+	assert.True(t, result.BodyTruncated)
+	assert.NotEmpty(t, result.RequestID)
+
+	description := result.String()
+	assert.Contains(t, description, "FAIL GET "+server.URL+"/big (200 in "+result.Latency.String())
+	assert.Contains(t, description, "request "+result.RequestID)
+	assert.Contains(t, description, `body contains: want "y", got not found`)
+	assert.Contains(t, description, "body: "+strings.Repeat("x", checkBodyExcerpt)+"…")
+
+	result = Check(context.Background(), NewHTTPClient(1000), CheckSpec{URL: server.URL + "/down"}, nil)
+	assert.Error(t, result.Err)
+	assert.Contains(t, result.String(), "error: ")
+	assert.Contains(t, result.String(), `body: {"status":"maintenance"}`)
+}
+
+func TestChecksWithoutResponseFailEveryAssertion(t *testing.T) {
+	result := Check(context.Background(), NewHTTPClient(1000), CheckSpec{
+		URL:          refusedURL(t),
+		MaxLatency:   time.Second,
+		BodyContains: []string{"ok"},
+		JSONPath:     map[string]interface{}{"status": "ok"},
+		Headers:      map[string]string{"X-Version": "1"},
+	}, nil)
+	assert.False(t, result.Passed)
+	assert.Error(t, result.Err)
+	assert.Zero(t, result.StatusCode)
+	require.Len(t, result.Assertions, 5)
+	for _, assertion := range result.Assertions {
+		assert.False(t, assertion.Passed, assertion.Assertion)
+		assert.Equal(t, "no response", assertion.Actual, assertion.Assertion)
+	}
+
+	result = Check(context.Background(), NewHTTPClient(1000), CheckSpec{URL: "://invalid"}, nil)
+	assert.False(t, result.Passed)
+	assert.Error(t, result.Err)
+}
+
+func TestRunChecksAggregatesResults(t *testing.T) {
+	server := checkServer()
+	defer server.Close()
+
+	report := RunChecks(context.Background(), NewHTTPClient(1000), []CheckSpec{
+		{Name: "health", URL: server.URL + "/health", BodyContains: []string{"ok"}},
+		{Name: "down", URL: server.URL + "/down"},
+		{Name: "slow", URL: server.URL + "/slow", MaxLatency: time.Second},
+		{Name: "missing", URL: server.URL + "/missing"},
+	}, 2, nil)
+
+	require.Len(t, report.Results, 4)
+	var names []string
+	for _, result := range report.Results {
+		names = append(names, result.Name)
+	}
+	assert.Equal(t, []string{"health", "down", "slow", "missing"}, names, "results keep the order of the specs")
+	assert.Equal(t, 2, report.Passed)
+	assert.Equal(t, 2, report.Failed)
+	assert.False(t, report.OK())
+	require.Len(t, report.Failures(), 2)
+	assert.Equal(t, "down", report.Failures()[0].Name)
+	assert.Equal(t, "missing", report.Failures()[1].Name)
+	assert.True(t, strings.HasSuffix(report.String(), "\n2 passed, 2 failed"), report.String())
+
+	report = RunChecks(context.Background(), NewHTTPClient(1000), []CheckSpec{{URL: server.URL + "/health"}}, 0, nil)
+	assert.True(t, report.OK())
+	assert.True(t, RunChecks(context.Background(), NewHTTPClient(1000), nil, 4, nil).OK(), "an empty suite passes")
+}
+
+func TestRunChecksBoundsConcurrency(t *testing.T) {
+	var inFlight, peak int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	specs := make([]CheckSpec, 12)
+	for i := range specs {
+		specs[i] = CheckSpec{URL: server.URL}
+	}
+	report := RunChecks(context.Background(), NewHTTPClient(1000), specs, 3, nil)
+	assert.True(t, report.OK())
+	assert.Equal(t, int32(3), atomic.LoadInt32(&peak))
+}
+
+func TestRunChecksFailOnceTheContextIsDone(t *testing.T) {
+	server := checkServer()
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	report := RunChecks(ctx, NewHTTPClient(1000), []CheckSpec{{URL: server.URL + "/health"}, {URL: server.URL + "/health"}}, 1, nil)
+	assert.Equal(t, 2, report.Failed)
+	for _, result := range report.Results {
+		assert.ErrorIs(t, result.Err, context.Canceled)
+	}
+}
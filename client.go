@@ -1,11 +1,25 @@
 package heimdall
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"net/http"
 )
 
 // Client Is a generic HTTP client interface
+//
+// A Response is valid whenever its StatusCode is non zero, even if err != nil:
+// when the server answers with an error status the status, headers and body
+// of the final attempt are returned alongside the error.
+//
+// Implementations of Client other than those of this package, such as caching
+// clients or tracing wrappers, should pass heimdalltest.TestClientConformance,
+// which checks the contract the built-in clients keep.
+//
+// The built-in clients, *HTTPClient and *HystrixHTTPClient, have more methods,
+// such as Do and the setters. The helpers and wrappers of this package use
+// those of a Client that has them, and do without them otherwise.
 type Client interface {
 	Get(url string, headers http.Header) (Response, error)
 	Post(url string, body io.Reader, headers http.Header) (Response, error)
@@ -16,3 +30,134 @@ type Client interface {
 	SetRetryCount(count int)
 	SetRetrier(retrier Retriable)
 }
+
+// ErrUnsupported is returned when a Client lacks a method that a helper or
+// wrapper of this package needs, such as PostAsync on a canary client over a
+// Client without one
+type ErrUnsupported struct {
+	// Method is the name of the missing method
+	Method string
+}
+
+func (e *ErrUnsupported) Error() string {
+	return fmt.Sprintf("heimdall: client does not support %s", e.Method)
+}
+
+// SendRequest sends request through the Do of client. A Client without Do
+// sends the standard methods through Get, Post, Put, Patch and Delete, which
+// drop the context of request.
+func SendRequest(client Client, request *http.Request) (Response, error) {
+	if doer, ok := client.(interface {
+		Do(request *http.Request) (Response, error)
+	}); ok {
+		return doer.Do(request)
+	}
+
+	url := request.URL.String()
+	switch request.Method {
+	case http.MethodGet:
+		return client.Get(url, request.Header)
+	case http.MethodPost:
+		return client.Post(url, bodyOf(request), request.Header)
+	case http.MethodPut:
+		return client.Put(url, bodyOf(request), request.Header)
+	case http.MethodPatch:
+		return client.Patch(url, bodyOf(request), request.Header)
+	case http.MethodDelete:
+		return client.Delete(url, request.Header)
+	}
+
+	return Response{}, &ErrUnsupported{Method: request.Method}
+}
+
+// bodyOf returns the body of request, nil when it has none
+func bodyOf(request *http.Request) io.Reader {
+	if request.Body == nil || request.Body == http.NoBody {
+		return nil
+	}
+
+	return request.Body
+}
+
+// invoke sends a request with method to url through client
+func invoke(client Client, method, url string, body io.Reader, headers http.Header) (Response, error) {
+	request, err := newMethodRequest(method, url, body)
+	if err != nil {
+		return Response{}, err
+	}
+	request.Header = headers
+
+	return SendRequest(client, request)
+}
+
+// postAsync queues a POST request on client, failing with an
+// *ErrUnsupported when client has no queue
+func postAsync(client Client, url string, body []byte, headers http.Header) error {
+	if queue, ok := client.(interface {
+		PostAsync(url string, body []byte, headers http.Header) error
+	}); ok {
+		return queue.PostAsync(url, body, headers)
+	}
+
+	return &ErrUnsupported{Method: "PostAsync"}
+}
+
+// flushClient waits for the queue of client, which has nothing to wait for
+// when it has no queue
+func flushClient(ctx context.Context, client Client) error {
+	if queue, ok := client.(interface {
+		Flush(ctx context.Context) error
+	}); ok {
+		return queue.Flush(ctx)
+	}
+
+	return nil
+}
+
+// shutdownClient shuts client down, which has nothing to wait for when it
+// cannot be shut down
+func shutdownClient(ctx context.Context, client Client) error {
+	if closer, ok := client.(interface {
+		Shutdown(ctx context.Context) error
+	}); ok {
+		return closer.Shutdown(ctx)
+	}
+
+	return nil
+}
+
+// getSSE opens an event stream through client, failing with an
+// *ErrUnsupported when client cannot stream
+func getSSE(ctx context.Context, client Client, url string, headers http.Header) (<-chan Event, func(), error) {
+	if streamer, ok := client.(interface {
+		GetSSE(ctx context.Context, url string, headers http.Header) (<-chan Event, func(), error)
+	}); ok {
+		return streamer.GetSSE(ctx, url, headers)
+	}
+
+	return nil, nil, &ErrUnsupported{Method: "GetSSE"}
+}
+
+// deriveClient returns client derived with opts, or client itself when it
+// cannot be derived
+func deriveClient(client Client, opts []Option) Client {
+	switch c := client.(type) {
+	case *HTTPClient:
+		return c.Derive(opts...)
+	case *HystrixHTTPClient:
+		return c.Derive(opts...)
+	case interface{ Derive(opts ...Option) Client }:
+		return c.Derive(opts...)
+	}
+
+	return client
+}
+
+// statsOf returns the stats of client, zero when it keeps none
+func statsOf(client Client) ClientStats {
+	if stats, ok := client.(interface{ Stats() ClientStats }); ok {
+		return stats.Stats()
+	}
+
+	return ClientStats{}
+}
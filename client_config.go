@@ -0,0 +1,438 @@
+package heimdall
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Backoff types accepted in BackoffConfig.Type
+const (
+	BackoffConstant           = "constant"
+	BackoffExponential        = "exponential"
+	BackoffLinear             = "linear"
+	BackoffFibonacci          = "fibonacci"
+	BackoffDecorrelatedJitter = "decorrelated_jitter"
+)
+
+// Duration is a time.Duration read from configuration either as a string
+// such as "1.5s" or as a number of milliseconds
+type Duration time.Duration
+
+// UnmarshalJSON reads a duration string or a number of milliseconds
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	return d.set(raw)
+}
+
+// UnmarshalYAML reads a duration string or a number of milliseconds
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw interface{}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	return d.set(raw)
+}
+
+// MarshalJSON writes the duration as a string such as "1.5s"
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) set(raw interface{}) error {
+	switch value := raw.(type) {
+	case string:
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+	case float64:
+		*d = Duration(value * float64(time.Millisecond))
+	case int:
+		*d = Duration(time.Duration(value) * time.Millisecond)
+	case nil:
+		*d = 0
+	default:
+		return fmt.Errorf("invalid duration %v", raw)
+	}
+
+	return nil
+}
+
+// ClientConfig describes a client as found in a service configuration file,
+// for NewClientFromConfig. Durations are strings such as "500ms" or numbers
+// of milliseconds.
+type ClientConfig struct {
+	// Timeout is the timeout of each attempt, and is required
+	Timeout    Duration       `json:"timeout" yaml:"timeout"`
+	RetryCount int            `json:"retry_count" yaml:"retry_count"`
+	Backoff    *BackoffConfig `json:"backoff,omitempty" yaml:"backoff,omitempty"`
+	// Hystrix, when set, makes a client running its requests under a
+	// hystrix command
+	Hystrix *HystrixClientConfig `json:"hystrix,omitempty" yaml:"hystrix,omitempty"`
+	BaseURL string               `json:"base_url,omitempty" yaml:"base_url,omitempty"`
+	// Headers are set on every request
+	Headers map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+	// MaxResponseBytes fails attempts whose response body is larger, when
+	// positive
+	MaxResponseBytes int64 `json:"max_response_bytes,omitempty" yaml:"max_response_bytes,omitempty"`
+}
+
+// BackoffConfig describes the backoff between retries
+type BackoffConfig struct {
+	// Type is one of constant, exponential, linear, fibonacci and
+	// decorrelated_jitter
+	Type string `json:"type" yaml:"type"`
+	// Interval is the interval of a constant backoff, the initial interval of
+	// an exponential one, the step of a linear one and the base interval of
+	// the others
+	Interval    Duration `json:"interval" yaml:"interval"`
+	MaxInterval Duration `json:"max_interval,omitempty" yaml:"max_interval,omitempty"`
+	// Factor is the growth factor of an exponential backoff, 2 by default
+	Factor float64 `json:"factor,omitempty" yaml:"factor,omitempty"`
+	// Jitter is the jitter fraction of linear and fibonacci backoffs
+	Jitter float64 `json:"jitter,omitempty" yaml:"jitter,omitempty"`
+}
+
+// HystrixClientConfig describes the hystrix command of a client
+type HystrixClientConfig struct {
+	CommandName string `json:"command_name" yaml:"command_name"`
+	// Timeout is the command timeout of each attempt, which must not be
+	// shorter than the client timeout
+	Timeout                Duration `json:"timeout" yaml:"timeout"`
+	MaxConcurrentRequests  int      `json:"max_concurrent_requests,omitempty" yaml:"max_concurrent_requests,omitempty"`
+	RequestVolumeThreshold int      `json:"request_volume_threshold,omitempty" yaml:"request_volume_threshold,omitempty"`
+	SleepWindow            Duration `json:"sleep_window,omitempty" yaml:"sleep_window,omitempty"`
+	ErrorPercentThreshold  int      `json:"error_percent_threshold,omitempty" yaml:"error_percent_threshold,omitempty"`
+}
+
+// ErrInvalidConfig is returned by NewClientFromConfig for a configuration
+// that cannot make a client. Field is the path of the offending field, as
+// named in the configuration file.
+type ErrInvalidConfig struct {
+	Field  string
+	Reason string
+}
+
+func (e *ErrInvalidConfig) Error() string {
+	return fmt.Sprintf("invalid client config: %s: %s", e.Field, e.Reason)
+}
+
+// NewClientFromConfig returns the client described by cfg, after validating
+// it. opts are passed on to the client constructor. The client is an
+// *HTTPClient, or a *HystrixHTTPClient when cfg has hystrix settings, whose
+// settings can later be changed in place with ApplyConfig.
+func NewClientFromConfig(cfg ClientConfig, opts ...Option) (Client, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	timeout := int(time.Duration(cfg.Timeout) / time.Millisecond)
+
+	var client interface {
+		Client
+		ApplyConfig(cfg ClientConfig) error
+	}
+	if cfg.Hystrix != nil {
+		client = NewHystrixHTTPClient(timeout, cfg.Hystrix.hystrixConfig(), opts...)
+	} else {
+		client = NewHTTPClient(timeout, opts...)
+	}
+
+	if err := client.ApplyConfig(cfg); err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// clientSettings are the settings of a client that its setters and
+// ApplyConfig change at runtime, guarded by the mutex of the client
+type clientSettings struct {
+	client     *http.Client
+	retryCount int
+	retrier    Retriable
+	// connectRetrier paces the retries of attempts that failed to connect
+	connectRetrier Retriable
+	drainLimit     int64
+
+	responseHeaderTimeout time.Duration
+	minAttemptBudget      time.Duration
+	strictContentLength   bool
+
+	requestMutators []RequestMutator
+	middlewares     []Middleware
+	// interceptors are those registered with UseResponseInterceptor
+	interceptors responseInterceptors
+	// configured are the middlewares of the config given to ApplyConfig
+	configured       []Middleware
+	requestValidator RequestValidator
+	plugins          plugins
+
+	expvar       *expvarMetrics
+	audit        *auditLog
+	slow         *slowRequestLog
+	deprecations *deprecationLog
+	maintenance  *maintenanceMonitor
+
+	classifier func(response *Response, attemptDuration time.Duration) bool
+	bodyRetry  *bodyRetryPredicate
+	apiVersion VersionStrategy
+	baggage    *baggagePropagation
+	rawMutator func(*http.Request)
+}
+
+// derive returns a copy of s for a client made with Derive, with its own
+// http.Client on the transport of s, its own copies of the lists and hooks
+// that count on their own
+func (s clientSettings) derive(options clientOptions, guard *hostGuard) clientSettings {
+	s.client = &http.Client{
+		Timeout:       options.httpTimeout(s.client.Timeout),
+		Transport:     s.client.Transport,
+		CheckRedirect: guard.checkRedirect,
+		Jar:           s.client.Jar,
+	}
+	s.requestMutators = append([]RequestMutator(nil), s.requestMutators...)
+	s.middlewares = append([]Middleware(nil), s.middlewares...)
+	s.interceptors = append(responseInterceptors(nil), s.interceptors...)
+	s.plugins = append(plugins(nil), s.plugins...)
+	s.slow = s.slow.clone()
+	s.deprecations = s.deprecations.clone()
+
+	return s
+}
+
+// attemptSettings are the settings a request reads once, as it starts, so
+// that setters and ApplyConfig can change them while requests are in flight
+type attemptSettings struct {
+	clientSettings
+	// redactor and stats are those of the client, which are never swapped
+	redactor *headerRedactor
+	stats    *clientStats
+}
+
+// newAttemptSettings returns the settings of a request starting with those
+// of a client, running the configured middlewares innermost, after those
+// registered with Use
+func newAttemptSettings(settings clientSettings, redactor *headerRedactor, stats *clientStats) attemptSettings {
+	settings.requestMutators = settings.requestMutators[:len(settings.requestMutators):len(settings.requestMutators)]
+	settings.interceptors = settings.interceptors[:len(settings.interceptors):len(settings.interceptors)]
+	settings.plugins = settings.plugins[:len(settings.plugins):len(settings.plugins)]
+	settings.middlewares = settings.middlewares[:len(settings.middlewares):len(settings.middlewares)]
+	if len(settings.configured) > 0 {
+		settings.middlewares = append(settings.middlewares, settings.configured...)
+	}
+	settings.configured = nil
+
+	return attemptSettings{clientSettings: settings, redactor: redactor, stats: stats}
+}
+
+// transportGrace is how long requests in flight on a swapped transport of a
+// client without a timeout may take before its idle connections are closed
+const transportGrace = 30 * time.Second
+
+// withTransport returns a client sharing the timeout, redirect policy and
+// cookie jar of client, sending through rt
+func withTransport(client *http.Client, rt http.RoundTripper) *http.Client {
+	return &http.Client{
+		Timeout:       client.Timeout,
+		Transport:     rt,
+		CheckRedirect: client.CheckRedirect,
+		Jar:           client.Jar,
+	}
+}
+
+// retireTransport closes the idle connections of the transport of old, the
+// client requests were sent with before a swap, once its requests in flight
+// have had their timeout to finish
+func retireTransport(old *http.Client, clock Clock) {
+	transport, ok := old.Transport.(interface{ CloseIdleConnections() })
+	if !ok {
+		return
+	}
+
+	grace := old.Timeout
+	if grace <= 0 {
+		grace = transportGrace
+	}
+	retired := clock.After(grace)
+	go func() {
+		<-retired
+		transport.CloseIdleConnections()
+	}()
+}
+
+// withTimeout returns a client sharing the transport, redirect policy and
+// cookie jar of client, with another timeout
+func withTimeout(client *http.Client, timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout:       timeout,
+		Transport:     client.Transport,
+		CheckRedirect: client.CheckRedirect,
+		Jar:           client.Jar,
+	}
+}
+
+// retrier returns the retrier for the backoff of cfg
+func (cfg ClientConfig) retrier() Retriable {
+	if cfg.Backoff == nil {
+		return NewNoRetrier()
+	}
+
+	return NewRetrier(cfg.Backoff.backoff())
+}
+
+// middlewares returns the middlewares setting the default headers and
+// enforcing the response size limit of cfg
+func (cfg ClientConfig) middlewares() []Middleware {
+	var middlewares []Middleware
+	if len(cfg.Headers) > 0 {
+		headers := http.Header{}
+		for name, value := range cfg.Headers {
+			headers.Set(name, value)
+		}
+		middlewares = append(middlewares, NewHeaderMiddleware(headers))
+	}
+	if cfg.MaxResponseBytes > 0 {
+		middlewares = append(middlewares, NewMaxResponseSizeMiddleware(cfg.MaxResponseBytes))
+	}
+
+	return middlewares
+}
+
+func invalidConfig(field, format string, args ...interface{}) error {
+	return &ErrInvalidConfig{Field: field, Reason: fmt.Sprintf(format, args...)}
+}
+
+func (cfg ClientConfig) validate() error {
+	switch {
+	case cfg.Timeout <= 0:
+		return invalidConfig("timeout", "must be positive")
+	case cfg.Timeout%Duration(time.Millisecond) != 0:
+		return invalidConfig("timeout", "must be a whole number of milliseconds, got %s", time.Duration(cfg.Timeout))
+	case cfg.RetryCount < 0:
+		return invalidConfig("retry_count", "must not be negative, got %d", cfg.RetryCount)
+	case cfg.MaxResponseBytes < 0:
+		return invalidConfig("max_response_bytes", "must not be negative, got %d", cfg.MaxResponseBytes)
+	}
+
+	if cfg.BaseURL != "" {
+		base, err := url.Parse(cfg.BaseURL)
+		if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+			return invalidConfig("base_url", "must be an absolute http or https URL, got %q", cfg.BaseURL)
+		}
+	}
+
+	for name := range cfg.Headers {
+		if name == "" {
+			return invalidConfig("headers", "header names must not be empty")
+		}
+	}
+
+	if cfg.Backoff != nil {
+		if err := cfg.Backoff.validate(); err != nil {
+			return err
+		}
+	}
+
+	if cfg.Hystrix != nil {
+		if err := cfg.Hystrix.validate(cfg.Timeout); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b BackoffConfig) validate() error {
+	switch b.Type {
+	case BackoffConstant, BackoffExponential, BackoffLinear, BackoffFibonacci, BackoffDecorrelatedJitter:
+	case "":
+		return invalidConfig("backoff.type", "is required")
+	default:
+		return invalidConfig("backoff.type", "unknown backoff type %q", b.Type)
+	}
+
+	switch {
+	case b.Interval <= 0:
+		return invalidConfig("backoff.interval", "must be positive")
+	case b.Type != BackoffConstant && b.MaxInterval <= 0:
+		return invalidConfig("backoff.max_interval", "is required for %s backoff", b.Type)
+	case b.Type != BackoffConstant && b.MaxInterval < b.Interval:
+		return invalidConfig("backoff.max_interval", "must not be shorter than backoff.interval")
+	case b.Type == BackoffConstant && b.MaxInterval != 0:
+		return invalidConfig("backoff.max_interval", "is not supported by constant backoff")
+	case b.Factor != 0 && b.Type != BackoffExponential:
+		return invalidConfig("backoff.factor", "is only supported by exponential backoff")
+	case b.Factor != 0 && b.Factor < 1:
+		return invalidConfig("backoff.factor", "must be at least 1, got %s", strconv.FormatFloat(b.Factor, 'g', -1, 64))
+	case b.Jitter != 0 && b.Type != BackoffLinear && b.Type != BackoffFibonacci:
+		return invalidConfig("backoff.jitter", "is not supported by %s backoff", b.Type)
+	case b.Jitter < 0 || b.Jitter > 1:
+		return invalidConfig("backoff.jitter", "must be between 0 and 1, got %s", strconv.FormatFloat(b.Jitter, 'g', -1, 64))
+	}
+
+	return nil
+}
+
+func (b BackoffConfig) backoff() Backoff {
+	interval, maxInterval := time.Duration(b.Interval), time.Duration(b.MaxInterval)
+
+	switch b.Type {
+	case BackoffConstant:
+		return NewConstantBackoff(int64(interval / time.Millisecond))
+	case BackoffExponential:
+		factor := b.Factor
+		if factor == 0 {
+			factor = defaultExponentFactor
+		}
+		return NewExponentialBackoff(interval, maxInterval, factor)
+	case BackoffLinear:
+		return NewLinearBackoff(interval, maxInterval, WithBackoffJitter(b.Jitter))
+	case BackoffFibonacci:
+		return NewFibonacciBackoff(interval, maxInterval, WithBackoffJitter(b.Jitter))
+	default:
+		return NewDecorrelatedJitterBackoff(interval, maxInterval)
+	}
+}
+
+func (h HystrixClientConfig) validate(timeout Duration) error {
+	switch {
+	case h.CommandName == "":
+		return invalidConfig("hystrix.command_name", "is required")
+	case h.Timeout <= 0:
+		return invalidConfig("hystrix.timeout", "must be positive")
+	case h.Timeout < timeout:
+		return invalidConfig("hystrix.timeout", "%s is shorter than the client timeout of %s, which could never be reached",
+			time.Duration(h.Timeout), time.Duration(timeout))
+	case h.MaxConcurrentRequests < 0:
+		return invalidConfig("hystrix.max_concurrent_requests", "must not be negative, got %d", h.MaxConcurrentRequests)
+	case h.RequestVolumeThreshold < 0:
+		return invalidConfig("hystrix.request_volume_threshold", "must not be negative, got %d", h.RequestVolumeThreshold)
+	case h.SleepWindow < 0:
+		return invalidConfig("hystrix.sleep_window", "must not be negative")
+	case h.ErrorPercentThreshold < 0 || h.ErrorPercentThreshold > 100:
+		return invalidConfig("hystrix.error_percent_threshold", "must be between 0 and 100, got %d", h.ErrorPercentThreshold)
+	}
+
+	return nil
+}
+
+func (h HystrixClientConfig) hystrixConfig() HystrixConfig {
+	return NewHystrixConfig(h.CommandName, HystrixCommandConfig{
+		Timeout:                int(time.Duration(h.Timeout) / time.Millisecond),
+		MaxConcurrentRequests:  h.MaxConcurrentRequests,
+		RequestVolumeThreshold: h.RequestVolumeThreshold,
+		SleepWindow:            int(time.Duration(h.SleepWindow) / time.Millisecond),
+		ErrorPercentThreshold:  h.ErrorPercentThreshold,
+	})
+}
@@ -0,0 +1,395 @@
+package heimdall
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func loadClientConfig(t *testing.T, name string) ClientConfig {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "client_config", name))
+	require.NoError(t, err)
+
+	var cfg ClientConfig
+	require.NoError(t, json.Unmarshal(data, &cfg))
+
+	return cfg
+}
+
+func TestClientConfigReadsDurations(t *testing.T) {
+	cfg := loadClientConfig(t, "hystrix.json")
+
+	assert.Equal(t, Duration(500*time.Millisecond), cfg.Timeout)
+	assert.Equal(t, Duration(10*time.Millisecond), cfg.Backoff.Interval)
+	assert.Equal(t, Duration(time.Second), cfg.Backoff.MaxInterval)
+	assert.Equal(t, Duration(5*time.Second), cfg.Hystrix.SleepWindow)
+
+	var d Duration
+	assert.Error(t, json.Unmarshal([]byte(`"soon"`), &d))
+	assert.Error(t, json.Unmarshal([]byte(`true`), &d))
+
+	data, err := json.Marshal(Duration(1500 * time.Millisecond))
+	require.NoError(t, err)
+	assert.Equal(t, `"1.5s"`, string(data))
+}
+
+func TestNewClientFromConfigBuildsHTTPClient(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		assert.Equal(t, "/v1/users/42", r.URL.Path)
+		assert.Equal(t, "billing", r.Header.Get("X-Client"))
+		assert.Equal(t, "application/json", r.Header.Get("Accept"))
+
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.URL.Query().Get("large") != "" {
+			w.Write([]byte(strings.Repeat("x", 17)))
+			return
+		}
+		w.Write([]byte(`{"id": 42}`))
+	}))
+	defer server.Close()
+
+	cfg := loadClientConfig(t, "plain.json")
+	cfg.BaseURL = server.URL + "/v1"
+
+	client, err := NewClientFromConfig(cfg)
+	require.NoError(t, err)
+
+	c := client.(*HTTPClient)
+	assert.Equal(t, 2*time.Second, c.current.client.Timeout)
+	assert.Equal(t, 2, c.current.retryCount)
+	assert.Equal(t, 5*time.Millisecond, c.current.retrier.NextInterval(1))
+
+	response, err := client.Get("/users/42", http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, `{"id": 42}`, string(response.Body()))
+	assert.Equal(t, 2, calls)
+
+	_, err = client.Get("/users/42?large=1", http.Header{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "response body larger than 16 bytes")
+}
+
+func TestNewClientFromConfigBuildsHystrixClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	client, err := NewClientFromConfig(loadClientConfig(t, "hystrix.json"))
+	require.NoError(t, err)
+
+	c, ok := client.(*HystrixHTTPClient)
+	require.True(t, ok)
+	assert.Equal(t, "client_config_command", c.hystrixCommandName)
+	assert.Equal(t, 500*time.Millisecond, c.current.client.Timeout)
+	assert.Equal(t, 3, c.current.retryCount)
+	assert.Equal(t, NewExponentialBackoff(10*time.Millisecond, time.Second, 1.5).Next(3), c.current.retrier.NextInterval(3))
+
+	response, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(response.Body()))
+}
+
+func TestNewClientFromConfigRejectsBadConfigs(t *testing.T) {
+	fixtures := map[string]string{
+		"unknown_backoff.json":       "backoff.type",
+		"short_hystrix_timeout.json": "hystrix.timeout",
+		"missing_timeout.json":       "timeout",
+		"inverted_backoff.json":      "backoff.max_interval",
+		"unsupported_jitter.json":    "backoff.jitter",
+		"relative_base_url.json":     "base_url",
+		"missing_command_name.json":  "hystrix.command_name",
+	}
+
+	for fixture, field := range fixtures {
+		client, err := NewClientFromConfig(loadClientConfig(t, fixture))
+		assert.Nil(t, client, fixture)
+
+		var invalid *ErrInvalidConfig
+		require.True(t, errors.As(err, &invalid), "%s: %v", fixture, err)
+		assert.Equal(t, field, invalid.Field, fixture)
+		assert.True(t, strings.HasPrefix(err.Error(), "invalid client config: "+field+": "), err.Error())
+	}
+}
+
+func TestApplyConfigSwapsSettingsAndKeepsTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path + " " + r.Header.Get("X-Client")))
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+	c := client
+	transport := c.current.client.Transport
+
+	cfg := loadClientConfig(t, "plain.json")
+	cfg.BaseURL = server.URL + "/v2"
+	cfg.Timeout = Duration(3 * time.Second)
+	cfg.MaxResponseBytes = 0
+	require.NoError(t, client.ApplyConfig(cfg))
+
+	assert.Equal(t, 3*time.Second, c.current.client.Timeout)
+	assert.True(t, transport == c.current.client.Transport, "the connection pool should be kept")
+	assert.Equal(t, 2, c.current.retryCount)
+
+	response, err := client.Get("/users", http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, "/v2/users billing", string(response.Body()))
+
+	// Applying again replaces the default headers rather than adding to them
+	cfg.Headers = nil
+	require.NoError(t, client.ApplyConfig(cfg))
+	response, err = client.Get("/users", http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, "/v2/users ", string(response.Body()))
+}
+
+func TestApplyConfigLeavesInFlightRequestsAlone(t *testing.T) {
+	var calls int32
+	blocked := make(chan struct{})
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(blocked)
+			<-release
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(5000)
+	client.SetRetryCount(1)
+
+	done := make(chan error)
+	go func() {
+		_, err := client.Get(server.URL, http.Header{})
+		done <- err
+	}()
+
+	<-blocked
+	require.NoError(t, client.ApplyConfig(ClientConfig{Timeout: Duration(time.Second)}))
+	close(release)
+
+	require.NoError(t, <-done, "the request should retry as configured when it started")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	_, err := client.Get(server.URL+"/fail", http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, 0, client.current.retryCount)
+}
+
+func TestApplyConfigRejectsChangesThatCannotBeMadeInPlace(t *testing.T) {
+	httpClient := NewHTTPClient(1000)
+	err := httpClient.ApplyConfig(loadClientConfig(t, "hystrix.json"))
+	assert.EqualError(t, err, "invalid client config: hystrix: cannot be added to a running client without a circuit breaker")
+
+	cfg := loadClientConfig(t, "hystrix.json")
+	client, err := NewClientFromConfig(cfg)
+	require.NoError(t, err)
+	hystrixClient := client.(*HystrixHTTPClient)
+
+	changed := cfg
+	command := *cfg.Hystrix
+	command.MaxConcurrentRequests = 5
+	changed.Hystrix = &command
+	changed.RetryCount = 7
+	err = hystrixClient.ApplyConfig(changed)
+	assert.EqualError(t, err, "invalid client config: hystrix: the command of a running client cannot change, derive a client with WithHystrixConfig instead")
+
+	changed.Hystrix = nil
+	assert.Error(t, hystrixClient.ApplyConfig(changed))
+	assert.Equal(t, 3, hystrixClient.current.retryCount, "a rejected config should change nothing")
+
+	cfg.RetryCount = 1
+	require.NoError(t, hystrixClient.ApplyConfig(cfg))
+	assert.Equal(t, 1, hystrixClient.current.retryCount)
+
+	var invalid *ErrInvalidConfig
+	require.True(t, errors.As(httpClient.ApplyConfig(loadClientConfig(t, "unknown_backoff.json")), &invalid))
+	assert.Equal(t, "backoff.type", invalid.Field)
+}
+
+func TestApplyConfigConcurrentlyWithRequests(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	clients := []testClient{
+		NewHTTPClient(1000),
+		NewHystrixHTTPClient(1000, NewHystrixConfig("apply_config_race_command", HystrixCommandConfig{Timeout: 2000, MaxConcurrentRequests: 100})),
+	}
+
+	for _, client := range clients {
+		var hystrixConfig *HystrixClientConfig
+		if _, ok := client.(*HystrixHTTPClient); ok {
+			hystrixConfig = &HystrixClientConfig{CommandName: "apply_config_race_command", Timeout: Duration(2 * time.Second), MaxConcurrentRequests: 100}
+		}
+
+		stop := make(chan struct{})
+		var applying sync.WaitGroup
+		applying.Add(1)
+		go func() {
+			defer applying.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				require.NoError(t, client.ApplyConfig(ClientConfig{
+					Timeout:    Duration(time.Duration(1000+i%500) * time.Millisecond),
+					RetryCount: i % 3,
+					Backoff:    &BackoffConfig{Type: BackoffConstant, Interval: Duration(time.Millisecond)},
+					Hystrix:    hystrixConfig,
+					Headers:    map[string]string{"X-Generation": strconv.Itoa(i)},
+				}))
+				time.Sleep(100 * time.Microsecond)
+			}
+		}()
+
+		var requests sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			requests.Add(1)
+			go func() {
+				defer requests.Done()
+				for j := 0; j < 10; j++ {
+					_, err := client.Get(server.URL, http.Header{})
+					assert.NoError(t, err)
+				}
+			}()
+		}
+
+		requests.Wait()
+		close(stop)
+		applying.Wait()
+	}
+}
+
+// settingsSetter has the setters changing the settings of a running client
+type settingsSetter interface {
+	SetRetryCount(count int)
+	SetRetrier(retrier Retriable)
+	SetConnectFailureRetrier(retrier Retriable)
+	SetDrainLimit(limit int64)
+	SetStrictContentLength(strict bool)
+	SetResponseHeaderTimeout(timeout time.Duration)
+	SetMinAttemptBudget(budget time.Duration)
+	SetSlowRequestHook(threshold time.Duration, maxPerMinute int, fn func(SlowRequestReport))
+	SetDeprecationHook(interval time.Duration, fn func(url string, info DeprecationInfo))
+	SetMaintenanceDetector(detector func(*Response) (inMaintenance bool, retryAt time.Time))
+	SetMaintenanceHook(fn func(MaintenanceEvent))
+	SetFailureClassifier(classifier func(response *Response, attemptDuration time.Duration) bool)
+	SetBodyRetryPredicate(maxInspectBytes int, fn func(statusCode int, body []byte) bool)
+	SetAPIVersion(strategy VersionStrategy)
+	SetBaggagePropagation(allowlist []string, maxTotalBytes int, opts ...BaggageOption)
+	AddRequestMutator(mutator RequestMutator)
+	SetRawRequestMutator(mutator func(*http.Request))
+	SetRequestValidator(validator RequestValidator)
+	AddPlugin(plugin Plugin)
+	Use(middlewares ...Middleware)
+	UseResponseInterceptor(interceptor ResponseInterceptor, opts ...InterceptorOption)
+	EnableExpvar(prefix string)
+	EnableAuditLog(sink func(AuditRecord), sampleRate float64, opts ...AuditOption)
+	SwapTransport(rt http.RoundTripper)
+}
+
+func TestSettersRunConcurrentlyWithRequests(t *testing.T) {
+	setters := []func(client settingsSetter, prefix string){
+		func(client settingsSetter, prefix string) { client.SetRetryCount(1) },
+		func(client settingsSetter, prefix string) { client.SetRetrier(NewRetrier(NewConstantBackoff(1))) },
+		func(client settingsSetter, prefix string) { client.SetConnectFailureRetrier(NewNoRetrier()) },
+		func(client settingsSetter, prefix string) { client.SetDrainLimit(1 << 16) },
+		func(client settingsSetter, prefix string) { client.SetStrictContentLength(true) },
+		func(client settingsSetter, prefix string) { client.SetResponseHeaderTimeout(time.Second) },
+		func(client settingsSetter, prefix string) { client.SetMinAttemptBudget(time.Millisecond) },
+		func(client settingsSetter, prefix string) {
+			client.SetSlowRequestHook(time.Hour, 0, func(SlowRequestReport) {})
+		},
+		func(client settingsSetter, prefix string) {
+			client.SetDeprecationHook(time.Minute, func(string, DeprecationInfo) {})
+		},
+		func(client settingsSetter, prefix string) {
+			client.SetMaintenanceDetector(func(*Response) (bool, time.Time) { return false, time.Time{} })
+		},
+		func(client settingsSetter, prefix string) { client.SetMaintenanceHook(func(MaintenanceEvent) {}) },
+		func(client settingsSetter, prefix string) {
+			client.SetFailureClassifier(func(*Response, time.Duration) bool { return false })
+		},
+		func(client settingsSetter, prefix string) {
+			client.SetBodyRetryPredicate(0, func(int, []byte) bool { return false })
+		},
+		func(client settingsSetter, prefix string) { client.SetAPIVersion(HeaderVersion("X-Api-Version", "1")) },
+		func(client settingsSetter, prefix string) { client.SetBaggagePropagation([]string{"baggage"}, 0) },
+		func(client settingsSetter, prefix string) {
+			client.AddRequestMutator(RequestMutatorFunc(func(*http.Request) error { return nil }))
+		},
+		func(client settingsSetter, prefix string) { client.SetRawRequestMutator(func(*http.Request) {}) },
+		func(client settingsSetter, prefix string) {
+			client.SetRequestValidator(func(*http.Request) error { return nil })
+		},
+		func(client settingsSetter, prefix string) { client.AddPlugin(&recordingPlugin{}) },
+		func(client settingsSetter, prefix string) { client.Use(func(next Doer) Doer { return next }) },
+		func(client settingsSetter, prefix string) {
+			client.UseResponseInterceptor(func(*Response) error { return nil })
+		},
+		func(client settingsSetter, prefix string) { client.EnableExpvar(prefix) },
+		func(client settingsSetter, prefix string) { client.EnableAuditLog(func(AuditRecord) {}, 1) },
+		func(client settingsSetter, prefix string) { client.SwapTransport(&http.Transport{}) },
+	}
+
+	for kind, newClient := range retryClients {
+		t.Run(kind, func(t *testing.T) {
+			var calls int32
+			server := countingServer(&calls)
+			defer server.Close()
+
+			client := newClient(t.Name(), realClock{})
+			prefix := "heimdall_setters_" + kind
+
+			var wg sync.WaitGroup
+			for _, set := range setters {
+				wg.Add(1)
+				go func(set func(client settingsSetter, prefix string)) {
+					defer wg.Done()
+					for i := 0; i < 10; i++ {
+						set(client.(settingsSetter), prefix)
+					}
+				}(set)
+			}
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < 10; j++ {
+						_, err := client.Get(server.URL, http.Header{})
+						assert.NoError(t, err)
+					}
+				}()
+			}
+
+			wg.Wait()
+			assert.Equal(t, int32(40), atomic.LoadInt32(&calls))
+		})
+	}
+}
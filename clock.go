@@ -0,0 +1,85 @@
+package heimdall
+
+import (
+	"context"
+	"time"
+)
+
+// Clock is the time source used for backoff sleeps, latency measurement and
+// background timers. The fakeclock package provides a manually driven
+// implementation for deterministic tests.
+type Clock interface {
+	Now() time.Time
+	// Sleep pauses for d, returning early with ctx.Err() if ctx is done
+	Sleep(ctx context.Context, d time.Duration) error
+	After(d time.Duration) <-chan time.Time
+	// NewTimer is After with a stop function, which releases the timer once it
+	// is no longer waited for and reports whether it had yet to fire
+	NewTimer(d time.Duration) (c <-chan time.Time, stop func() bool)
+}
+
+type realClock struct{}
+
+// Now returns the current time
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// Sleep pauses for d or until ctx is done
+func (realClock) Sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// After waits for d to elapse and then sends the current time
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// NewTimer returns the channel and the Stop method of a time.Timer
+func (realClock) NewTimer(d time.Duration) (<-chan time.Time, func() bool) {
+	timer := time.NewTimer(d)
+	return timer.C, timer.Stop
+}
+
+// clockOrReal returns clock, or the real clock when it is nil
+func clockOrReal(clock Clock) Clock {
+	if clock == nil {
+		return realClock{}
+	}
+
+	return clock
+}
+
+// withClockTimeout is context.WithTimeout with the timeout measured on
+// clock. The context of the real clock carries the deadline, while that of
+// another clock is cancelled once it has advanced by timeout.
+func withClockTimeout(ctx context.Context, clock Clock, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if _, real := clock.(realClock); real {
+		return context.WithTimeout(ctx, timeout)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	fired, stop := clock.NewTimer(timeout)
+	go func() {
+		defer stop()
+		select {
+		case <-fired:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
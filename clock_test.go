@@ -0,0 +1,85 @@
+package heimdall
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gojektech/heimdall/fakeclock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRealClockSleepReturnsEarlyWhenContextIsDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	began := time.Now()
+	err := realClock{}.Sleep(ctx, time.Minute)
+
+	assert.Equal(t, context.Canceled, err)
+	assert.True(t, time.Since(began) < time.Second)
+}
+
+func TestExponentialBackoffRetriesRunInstantlyWithFakeClock(t *testing.T) {
+	count := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	start := time.Date(2018, time.January, 19, 22, 0, 0, 0, time.UTC)
+	clock := fakeclock.New(start)
+
+	client := NewHTTPClient(100, WithClock(clock))
+	client.SetRetryCount(10)
+	client.SetRetrier(NewRetrier(NewExponentialBackoff(2*time.Millisecond, 10*time.Second, 2.0)))
+
+	began := time.Now()
+	_, err := client.Get(server.URL, http.Header{})
+	require.Error(t, err)
+
+	assert.Equal(t, 11, count)
+	assert.True(t, time.Since(began) < time.Second, "backoff should not sleep in real time")
+
+	ms := time.Millisecond
+	assert.Equal(t, []time.Duration{0, 4 * ms, 6 * ms, 10 * ms, 18 * ms, 34 * ms, 66 * ms, 130 * ms, 258 * ms, 514 * ms}, clock.Sleeps())
+	assert.Equal(t, start.Add(1040*ms), clock.Now())
+}
+
+func TestGetSSEReconnectWaitsOnClock(t *testing.T) {
+	connections := make(chan struct{}, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		connections <- struct{}{}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("retry: 30000\ndata: hello\n\n"))
+	}))
+	defer server.Close()
+
+	clock := fakeclock.New(time.Now())
+	client := NewHTTPClient(100, WithClock(clock))
+	client.SetRetryCount(1)
+
+	events, cancel, err := client.GetSSE(context.Background(), server.URL, nil)
+	require.NoError(t, err)
+	defer cancel()
+
+	receiveEvent(t, events)
+	<-connections
+
+	for clock.Timers() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Len(t, connections, 0, "should not reconnect before the retry interval elapses")
+
+	clock.Advance(30 * time.Second)
+
+	select {
+	case <-connections:
+	case <-time.After(time.Second):
+		assert.Fail(t, "did not reconnect once the retry interval elapsed")
+	}
+}
@@ -0,0 +1,186 @@
+package heimdall
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const jsonContentType = "application/json"
+
+// Codec encodes and decodes bodies of one content type, such as
+// "application/json". Register codecs on a client with RegisterCodec.
+type Codec interface {
+	ContentType() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// ErrUnsupportedContentType is returned when no codec is registered for the
+// content type of a body that has to be encoded or decoded
+type ErrUnsupportedContentType struct {
+	ContentType string
+}
+
+func (e *ErrUnsupportedContentType) Error() string {
+	return fmt.Sprintf("no codec registered for content type %q", e.ContentType)
+}
+
+type jsonCodec struct{}
+
+// NewJSONCodec returns the JSON codec every client has registered by default
+func NewJSONCodec() Codec {
+	return jsonCodec{}
+}
+
+func (jsonCodec) ContentType() string {
+	return jsonContentType
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// codecRegistry holds the codecs of a client keyed by media type
+type codecRegistry struct {
+	mu     sync.RWMutex
+	codecs map[string]Codec
+}
+
+func newCodecRegistry() *codecRegistry {
+	r := &codecRegistry{codecs: map[string]Codec{}}
+	r.register(NewJSONCodec())
+
+	return r
+}
+
+func (r *codecRegistry) register(codec Codec) {
+	codecs := map[string]Codec{}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for mediaType, registered := range r.codecs {
+		codecs[mediaType] = registered
+	}
+	codecs[mediaType(codec.ContentType())] = codec
+	r.codecs = codecs
+}
+
+// lookup returns the codec for contentType, ignoring parameters such as the
+// charset
+func (r *codecRegistry) lookup(contentType string) (Codec, error) {
+	r.mu.RLock()
+	codec, ok := r.codecs[mediaType(contentType)]
+	r.mu.RUnlock()
+
+	if !ok {
+		return nil, &ErrUnsupportedContentType{ContentType: contentType}
+	}
+
+	return codec, nil
+}
+
+// clone returns a registry with a copy of the codecs of r
+func (r *codecRegistry) clone() *codecRegistry {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return &codecRegistry{codecs: r.codecs}
+}
+
+func mediaType(contentType string) string {
+	parsed, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(contentType))
+	}
+
+	return parsed
+}
+
+// Send encodes in with the codec client has registered for contentType and
+// sends it with method to url, asking for the same content type in return.
+// A nil in sends no body. Unless out is nil, a non-empty response body is
+// decoded into it with the codec for the response Content-Type, or for
+// contentType when the response does not declare one. Decoding is skipped
+// when the request fails.
+func Send(client Client, method, url, contentType string, in, out interface{}, headers http.Header) (Response, error) {
+	codec, err := codecOf(client, contentType)
+	if err != nil {
+		return Response{}, err
+	}
+
+	var body io.Reader
+	if in != nil {
+		data, err := codec.Marshal(in)
+		if err != nil {
+			return Response{}, errors.Wrap(err, "request body encoding failed")
+		}
+		body = bytes.NewReader(data)
+	}
+
+	request, err := newRequest(method, url, body)
+	if err != nil {
+		return Response{}, err
+	}
+
+	request.Header = copyHeader(headers)
+	if in != nil {
+		request.Header.Set("Content-Type", codec.ContentType())
+	}
+	if request.Header.Get("Accept") == "" {
+		request.Header.Set("Accept", codec.ContentType())
+	}
+
+	response, err := SendRequest(client, request)
+	if err != nil || out == nil {
+		return response, err
+	}
+
+	return response, decodeWith(client, response, codec, out)
+}
+
+// Decode decodes the body of response into out with the codec client has
+// registered for the response Content-Type
+func Decode(client Client, response Response, out interface{}) error {
+	return decodeWith(client, response, nil, out)
+}
+
+func decodeWith(client Client, response Response, fallback Codec, out interface{}) error {
+	if len(response.Body()) == 0 {
+		return nil
+	}
+
+	codec := fallback
+	if contentType := response.headers.Get("Content-Type"); contentType != "" || codec == nil {
+		var err error
+		if codec, err = codecOf(client, contentType); err != nil {
+			return err
+		}
+	}
+
+	return errors.Wrap(codec.Unmarshal(response.Body(), out), "response body decoding failed")
+}
+
+// codecOf returns the codec client has registered for contentType, the JSON
+// codec alone when client registers none
+func codecOf(client Client, contentType string) (Codec, error) {
+	if codecs, ok := client.(interface {
+		Codec(contentType string) (Codec, error)
+	}); ok {
+		return codecs.Codec(contentType)
+	}
+
+	return newCodecRegistry().lookup(contentType)
+}
@@ -0,0 +1,155 @@
+package heimdall
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// reverseCodec is a toy codec storing strings reversed
+type reverseCodec struct{}
+
+func (reverseCodec) ContentType() string {
+	return "application/x-reverse"
+}
+
+func (reverseCodec) Marshal(v interface{}) ([]byte, error) {
+	return reverse([]byte(v.(string))), nil
+}
+
+func (reverseCodec) Unmarshal(data []byte, v interface{}) error {
+	*(v.(*string)) = string(reverse(data))
+	return nil
+}
+
+func reverse(data []byte) []byte {
+	reversed := make([]byte, len(data))
+	for i, b := range data {
+		reversed[len(data)-1-i] = b
+	}
+
+	return reversed
+}
+
+type codecPayload struct {
+	Name string `json:"name"`
+}
+
+func echoServer(responseType string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Request-Content-Type", r.Header.Get("Content-Type"))
+		w.Header().Set("X-Request-Accept", r.Header.Get("Accept"))
+		// A nil value stops the server from sniffing a content type
+		w.Header()["Content-Type"] = nil
+		if responseType != "" {
+			w.Header().Set("Content-Type", responseType)
+		}
+		w.Write(body)
+	}))
+}
+
+func TestSendUsesJSONByDefault(t *testing.T) {
+	server := echoServer("application/json; charset=utf-8")
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+
+	var out codecPayload
+	response, err := Send(client, http.MethodPost, server.URL, "application/json", codecPayload{Name: "widget"}, &out, http.Header{})
+	require.NoError(t, err)
+
+	assert.Equal(t, codecPayload{Name: "widget"}, out)
+	assert.Equal(t, "application/json", response.Headers().Get("X-Request-Content-Type"))
+	assert.Equal(t, "application/json", response.Headers().Get("X-Request-Accept"))
+}
+
+func TestSendPicksCodecsByContentType(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		assert.Equal(t, "tegdiw", string(body))
+		assert.Equal(t, "application/x-reverse", r.Header.Get("Content-Type"))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"name": "gadget"}`))
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+	client.RegisterCodec(reverseCodec{})
+
+	var out codecPayload
+	_, err := Send(client, http.MethodPut, server.URL, "application/x-reverse", "widget", &out, http.Header{})
+	require.NoError(t, err)
+
+	assert.Equal(t, "gadget", out.Name, "the response should be decoded by its own content type")
+}
+
+func TestSendFallsBackToRequestCodecWithoutResponseContentType(t *testing.T) {
+	server := echoServer("")
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+	client.RegisterCodec(reverseCodec{})
+
+	var out string
+	_, err := Send(client, http.MethodPost, server.URL, "application/x-reverse", "widget", &out, http.Header{})
+	require.NoError(t, err)
+
+	assert.Equal(t, "widget", out)
+}
+
+func TestSendFailsOnUnregisteredContentTypes(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/x-reverse")
+		w.Write([]byte("tegdag"))
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+
+	_, err := Send(client, http.MethodPost, server.URL, "application/msgpack", codecPayload{}, nil, http.Header{})
+	assert.EqualError(t, err, `no codec registered for content type "application/msgpack"`)
+	assert.Equal(t, 0, calls, "a body that cannot be encoded should not be sent")
+
+	var out codecPayload
+	response, err := Send(client, http.MethodGet, server.URL, "application/json", nil, &out, http.Header{})
+	assert.Equal(t, &ErrUnsupportedContentType{ContentType: "application/x-reverse"}, err)
+	assert.Equal(t, "tegdag", string(response.Body()))
+}
+
+func TestDecodeAndDerivedRegistries(t *testing.T) {
+	parent := NewNoopClient(http.StatusOK, []byte("tegdiw"))
+	response, _ := parent.Get("http://example.com", http.Header{})
+	response.headers = http.Header{"Content-Type": []string{"application/x-reverse"}}
+
+	derived := parent.(*noopClient).Derive()
+	derived.(*noopClient).RegisterCodec(reverseCodec{})
+
+	var out string
+	require.NoError(t, Decode(derived, response, &out))
+	assert.Equal(t, "widget", out)
+
+	assert.IsType(t, &ErrUnsupportedContentType{}, Decode(parent, response, &out))
+}
+
+func TestCodecRegistryIgnoresMediaTypeParameters(t *testing.T) {
+	registry := newCodecRegistry()
+
+	for _, contentType := range []string{"application/json", "Application/JSON", "application/json; charset=utf-8"} {
+		codec, err := registry.lookup(contentType)
+		require.NoError(t, err, contentType)
+		assert.Equal(t, NewJSONCodec(), codec)
+	}
+
+	data, err := NewJSONCodec().Marshal(codecPayload{Name: "x"})
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal([]byte(`{"name":"x"}`), data))
+}
@@ -0,0 +1,146 @@
+package heimdall
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// concurrencyBackoffRatio shrinks the limit after an attempt that failed
+	// or took longer than concurrencyLatencyTolerance times the baseline
+	concurrencyBackoffRatio     = 0.9
+	concurrencyLatencyTolerance = 2.0
+	// concurrencyBaselineWindow is the number of successful attempts after
+	// which the baseline is reset to the lowest latency among them
+	concurrencyBaselineWindow = 100
+)
+
+// errConcurrencyLimited rejects an attempt over the limit when there is no
+// queue to wait in
+var errConcurrencyLimited = errors.New("concurrency limit reached")
+
+// concurrencyLimiter bounds the attempts in flight with an additive increase,
+// multiplicative decrease limit, in the manner of Netflix's concurrency-limits
+type concurrencyLimiter struct {
+	mu       sync.Mutex
+	limit    float64
+	min, max float64
+	inFlight int
+	baseline time.Duration
+	// window is the lowest latency of the windowed successful attempts
+	window      time.Duration
+	windowCount int
+	// waiters are the attempts queued for room, oldest first, as
+	// *concurrencyWaiter
+	waiters list.List
+}
+
+// WithAdaptiveConcurrency limits the attempts in flight to a limit that
+// starts at initial and adapts between min and max. The limit grows by one
+// for every attempt that succeeds within twice the baseline latency while the
+// client is using at least half of it, and shrinks by 10% for every
+// attempt that fails or is slower. Attempts over the limit are rejected
+// without being sent, with an *ErrHystrixRejected as when hystrix rejects
+// them for MaxConcurrentRequests, and are not retried unless the retrier
+// implements RejectionRetrier. WithConcurrencyQueue queues them instead. The
+// baseline is the lowest latency observed, reset every 100 successful
+// attempts to the lowest among them so that it follows the upstream as it
+// slows down or speeds up.
+// When expvar is enabled the current limit and the attempts in flight are
+// published as "concurrency_limit" and "concurrency_in_flight". Clients made
+// with Derive share the limit.
+func WithAdaptiveConcurrency(initial, min, max int) Option {
+	return func(options *clientOptions) {
+		options.concurrency = newConcurrencyLimiter(initial, min, max)
+	}
+}
+
+func newConcurrencyLimiter(initial, min, max int) *concurrencyLimiter {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+
+	return &concurrencyLimiter{
+		limit: math.Max(float64(min), math.Min(float64(initial), float64(max))),
+		min:   float64(min),
+		max:   float64(max),
+	}
+}
+
+// acquire reserves room for an attempt with ctx. Over the limit, or with
+// attempts queued before it, the attempt is queued behind them when queue is
+// set and rejected with errConcurrencyLimited otherwise. It returns how long
+// the attempt was queued and whether it was.
+func (l *concurrencyLimiter) acquire(ctx context.Context, queue *concurrencyQueue, clock Clock, metrics *expvarMetrics) (time.Duration, bool, error) {
+	l.mu.Lock()
+	if l.inFlight < int(l.limit) && l.waiters.Len() == 0 {
+		l.inFlight++
+		metrics.concurrency(int(l.limit), l.inFlight)
+		l.mu.Unlock()
+		return 0, false, nil
+	}
+	if queue == nil {
+		l.mu.Unlock()
+		return 0, false, errConcurrencyLimited
+	}
+
+	waited, err := l.queue(ctx, queue, clock, metrics)
+	return waited, true, err
+}
+
+// release frees the room taken by an attempt which took latency, adapting
+// the limit to its outcome
+func (l *concurrencyLimiter) release(latency time.Duration, failed bool, metrics *expvarMetrics) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	utilised := float64(l.inFlight)*2 >= l.limit
+	l.inFlight--
+
+	if !failed {
+		l.observeBaseline(latency)
+	}
+
+	switch {
+	case failed || float64(latency) > float64(l.baseline)*concurrencyLatencyTolerance:
+		l.limit = math.Max(l.min, l.limit*concurrencyBackoffRatio)
+	case utilised:
+		l.limit = math.Min(l.max, l.limit+1)
+	}
+	l.admitWaiters(metrics)
+	metrics.concurrency(int(l.limit), l.inFlight)
+}
+
+// observeBaseline lowers the baseline to the latency of a successful attempt
+// when it is faster, and resets it to the lowest latency of the window once
+// concurrencyBaselineWindow attempts are counted, so that one fast sample
+// does not hold it down for good. l.mu must be held.
+func (l *concurrencyLimiter) observeBaseline(latency time.Duration) {
+	if l.baseline == 0 || latency < l.baseline {
+		l.baseline = latency
+	}
+	if l.windowCount == 0 || latency < l.window {
+		l.window = latency
+	}
+
+	l.windowCount++
+	if l.windowCount == concurrencyBaselineWindow {
+		l.baseline = l.window
+		l.windowCount = 0
+	}
+}
+
+// snapshot returns the current limit and the attempts in flight
+func (l *concurrencyLimiter) snapshot() (limit, inFlight int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return int(l.limit), l.inFlight
+}
@@ -0,0 +1,155 @@
+package heimdall
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/afex/hystrix-go/hystrix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tryAcquire acquires room under limiter without queueing
+func tryAcquire(limiter *concurrencyLimiter) bool {
+	_, _, err := limiter.acquire(context.Background(), nil, realClock{}, nil)
+	return err == nil
+}
+
+func TestConcurrencyLimiterAdditiveIncreaseMultiplicativeDecrease(t *testing.T) {
+	limiter := newConcurrencyLimiter(4, 2, 6)
+
+	for i := 0; i < 4; i++ {
+		require.True(t, tryAcquire(limiter))
+	}
+	assert.False(t, tryAcquire(limiter), "the limit should be enforced")
+
+	limiter.release(10*time.Millisecond, false, nil)
+	limit, inFlight := limiter.snapshot()
+	assert.Equal(t, 5, limit, "a fast attempt while the limit is used should grow it by one")
+	assert.Equal(t, 3, inFlight)
+
+	limiter.release(30*time.Millisecond, false, nil)
+	limit, _ = limiter.snapshot()
+	assert.Equal(t, 4, limit, "a slow attempt should shrink the limit by 10%")
+
+	limiter.release(10*time.Millisecond, true, nil)
+	limit, _ = limiter.snapshot()
+	assert.Equal(t, 4, limit)
+
+	limiter.release(10*time.Millisecond, false, nil)
+	limit, inFlight = limiter.snapshot()
+	assert.Equal(t, 4, limit, "an idle client should not grow its limit")
+	assert.Equal(t, 0, inFlight)
+}
+
+func TestConcurrencyLimiterStaysWithinBounds(t *testing.T) {
+	limiter := newConcurrencyLimiter(100, 0, 3)
+	limit, _ := limiter.snapshot()
+	assert.Equal(t, 3, limit)
+
+	for i := 0; i < 20; i++ {
+		require.True(t, tryAcquire(limiter))
+		limiter.release(time.Millisecond, true, nil)
+	}
+	limit, _ = limiter.snapshot()
+	assert.Equal(t, 1, limit)
+}
+
+func TestAdaptiveConcurrencyRejectsExcessAttempts(t *testing.T) {
+	release := make(chan struct{})
+	entered := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+	}))
+	defer server.Close()
+
+	clients := map[string]testClient{
+		"http":    NewHTTPClient(1000, WithAdaptiveConcurrency(1, 1, 1)),
+		"hystrix": NewHystrixHTTPClient(1000, NewHystrixConfig("adaptive_concurrency_command", HystrixCommandConfig{Timeout: 1000}), WithAdaptiveConcurrency(1, 1, 1)),
+	}
+	for name, client := range clients {
+		t.Run(name, func(t *testing.T) {
+			client.EnableExpvar("heimdall_adaptive_concurrency_test_" + name)
+
+			done := make(chan error)
+			go func() {
+				_, err := client.Get(server.URL, http.Header{})
+				done <- err
+			}()
+			<-entered
+
+			assert.Equal(t, "1", expvar.Get("heimdall_adaptive_concurrency_test_"+name+".concurrency_in_flight").String())
+
+			client.SetRetryCount(3)
+			_, err := client.Get(server.URL, http.Header{})
+			require.Error(t, err)
+
+			var rejected *ErrHystrixRejected
+			require.True(t, errors.As(err, &rejected))
+			assert.True(t, errors.Is(err, hystrix.ErrMaxConcurrency))
+			assert.False(t, rejected.CircuitOpen())
+			assert.Equal(t, 1, rejected.Attempts, "rejected attempts should not be retried")
+
+			release <- struct{}{}
+			assert.NoError(t, <-done)
+			assert.Equal(t, "0", expvar.Get("heimdall_adaptive_concurrency_test_"+name+".concurrency_in_flight").String())
+		})
+	}
+}
+
+// simulateConcurrency runs rounds of demand attempts against limiter, each
+// round sending as many as the limit admits and releasing them with the
+// latency latency gives for that many in flight, and returns the limit after
+// every round
+func simulateConcurrency(limiter *concurrencyLimiter, demand, rounds int, latency func(concurrent int) time.Duration) []int {
+	limits := make([]int, 0, rounds)
+	for round := 0; round < rounds; round++ {
+		concurrent := 0
+		for concurrent < demand && tryAcquire(limiter) {
+			concurrent++
+		}
+		for i := 0; i < concurrent; i++ {
+			limiter.release(latency(concurrent), false, nil)
+		}
+		limit, _ := limiter.snapshot()
+		limits = append(limits, limit)
+	}
+
+	return limits
+}
+
+func TestAdaptiveConcurrencyConverges(t *testing.T) {
+	// The upstream answers in 2ms up to 8 concurrent attempts and slows down
+	// by 2ms for every attempt beyond
+	knee := func(concurrent int) time.Duration {
+		latency := 2 * time.Millisecond
+		if concurrent > 8 {
+			latency += time.Duration(concurrent-8) * 2 * time.Millisecond
+		}
+		return latency
+	}
+
+	limits := simulateConcurrency(newConcurrencyLimiter(4, 2, 100), 32, 20, knee)
+	assert.Equal(t, []int{6, 9, 13, 3, 4, 6, 8, 11, 3, 4, 6, 8, 11, 3, 4, 6, 8, 11, 3, 4}, limits,
+		"the limit should climb past the knee at 8, back off and settle into a steady cycle around it")
+}
+
+func TestConcurrencyLimiterBaselineFollowsTheUpstream(t *testing.T) {
+	limiter := newConcurrencyLimiter(10, 1, 20)
+	require.True(t, tryAcquire(limiter))
+	limiter.release(time.Millisecond, false, nil)
+
+	// One early fast attempt makes every later 10ms attempt slow for the rest
+	// of its window and the whole next one, at the end of which the baseline
+	// is reset to 10ms
+	steady := func(int) time.Duration { return 10 * time.Millisecond }
+	limits := simulateConcurrency(limiter, 1, 2*concurrencyBaselineWindow+2, steady)
+	assert.Equal(t, 1, limits[concurrencyBaselineWindow], "slow attempts shrink the limit to its minimum")
+	assert.Equal(t, []int{1, 2, 3, 3, 3}, limits[2*concurrencyBaselineWindow-3:], "once reset the baseline lets the limit grow again")
+}
@@ -0,0 +1,246 @@
+package heimdall
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// ErrQueueTimeout is returned for an attempt that waited in the queue set
+// with WithConcurrencyQueue for its longest wait without being admitted
+type ErrQueueTimeout struct {
+	// Waited is how long the attempt was queued
+	Waited time.Duration
+}
+
+func (e *ErrQueueTimeout) Error() string {
+	return fmt.Sprintf("concurrency queue wait timed out after %v", e.Waited)
+}
+
+// concurrencyQueue bounds the attempts waiting for room under the adaptive
+// concurrency limit
+type concurrencyQueue struct {
+	maxLength int
+	maxWait   time.Duration
+}
+
+// WithConcurrencyQueue makes attempts over the limit set with
+// WithAdaptiveConcurrency wait for room in a queue instead of being rejected.
+// Queued attempts are admitted first in, first out as attempts in flight
+// finish, and attempts arriving while others are queued queue behind them, so
+// a burst cannot starve anyone. Up to maxLength attempts may wait, any number
+// when 0 or less, each for up to maxWait, until its context is done when 0
+// or less. Attempts finding the queue full fail with an *ErrQueueFull, and
+// those waiting too long with an *ErrQueueTimeout, both retried as
+// rejections are; an attempt whose context is done while queued leaves the
+// queue at once and fails its request with an *ErrContextDone. The wait counts
+// against the deadline of the request, so that the deadline propagated
+// upstream is what is left of it.
+//
+// There is one queue per client rather than one per host, since attempts to
+// every host share the limit they wait for; a queue per host would let a
+// host with a long line be overtaken by the others for the same room. The
+// queue is shared with derived clients along with the limit, while each
+// client counts its own queued attempts in Stats().Queue. When expvar is
+// enabled the attempts queued are published as "concurrency_queue_depth", and
+// the waits of those admitted as the "concurrency_queue_wait_ms" histogram.
+func WithConcurrencyQueue(maxLength int, maxWait time.Duration) Option {
+	return func(options *clientOptions) {
+		options.queue = &concurrencyQueue{maxLength: maxLength, maxWait: maxWait}
+	}
+}
+
+// concurrencyWaiter is an attempt queued for room under the limit
+type concurrencyWaiter struct {
+	// ready is closed once the attempt is admitted
+	ready    chan struct{}
+	admitted bool
+}
+
+// queue waits for room for an attempt with ctx, in line behind the attempts
+// already queued. l.mu must be held, and is released.
+func (l *concurrencyLimiter) queue(ctx context.Context, queue *concurrencyQueue, clock Clock, metrics *expvarMetrics) (time.Duration, error) {
+	if queue.maxLength > 0 && l.waiters.Len() >= queue.maxLength {
+		defer l.mu.Unlock()
+		return 0, &ErrQueueFull{Capacity: l.waiters.Len(), concurrency: true}
+	}
+
+	waiter := &concurrencyWaiter{ready: make(chan struct{})}
+	element := l.waiters.PushBack(waiter)
+	metrics.queueDepth(l.waiters.Len())
+	l.mu.Unlock()
+
+	began := clock.Now()
+	var timeout <-chan time.Time
+	if queue.maxWait > 0 {
+		var stop func() bool
+		timeout, stop = clock.NewTimer(queue.maxWait)
+		defer stop()
+	}
+
+	var err error
+	select {
+	case <-waiter.ready:
+	case <-timeout:
+		err = &ErrQueueTimeout{}
+	case <-ctx.Done():
+		err = &ErrContextDone{err: ctx.Err()}
+	}
+	waited := clock.Now().Sub(began)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if waiter.admitted {
+		if _, cancelled := err.(*ErrContextDone); cancelled {
+			// The room made for an attempt cancelled meanwhile goes to the
+			// next one in line
+			l.inFlight--
+			l.admitWaiters(metrics)
+			metrics.concurrency(int(l.limit), l.inFlight)
+			return waited, err
+		}
+		// An attempt admitted as it timed out takes the room made for it
+		// rather than leave it unused
+		metrics.queueWait(waited)
+		return waited, nil
+	}
+	l.waiters.Remove(element)
+	metrics.queueDepth(l.waiters.Len())
+	if timedOut, ok := err.(*ErrQueueTimeout); ok {
+		timedOut.Waited = waited
+	}
+
+	return waited, err
+}
+
+// admitWaiters admits the queued attempts, oldest first, while there is
+// room for them. l.mu must be held.
+func (l *concurrencyLimiter) admitWaiters(metrics *expvarMetrics) {
+	admitted := false
+	for front := l.waiters.Front(); front != nil && l.inFlight < int(l.limit); front = l.waiters.Front() {
+		waiter := l.waiters.Remove(front).(*concurrencyWaiter)
+		waiter.admitted = true
+		close(waiter.ready)
+		l.inFlight++
+		admitted = true
+	}
+	if admitted {
+		metrics.queueDepth(l.waiters.Len())
+	}
+}
+
+// queueDepth returns the number of attempts queued
+func (l *concurrencyLimiter) queueDepth() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.waiters.Len()
+}
+
+// QueueStats describe the attempts of a client that waited in the queue set
+// with WithConcurrencyQueue
+type QueueStats struct {
+	// Depth is the number of attempts queued now, those of derived clients
+	// sharing the queue included, which a reset keeps
+	Depth int `json:"depth"`
+	// Queued counts the attempts that waited in the queue, and Admitted,
+	// TimedOut and Cancelled how they left it. Full counts the attempts
+	// turned away by a full queue.
+	Queued    int64 `json:"queued"`
+	Admitted  int64 `json:"admitted"`
+	TimedOut  int64 `json:"timed_out"`
+	Cancelled int64 `json:"cancelled"`
+	Full      int64 `json:"full"`
+	// WaitP50, WaitP90 and WaitP99 approximate the percentiles of the waits
+	// of the attempts admitted, bucketed as dial latencies are in
+	// ConnectionStats. They are zero before any was admitted.
+	WaitP50 Duration `json:"wait_p50"`
+	WaitP90 Duration `json:"wait_p90"`
+	WaitP99 Duration `json:"wait_p99"`
+}
+
+// Queue events, indexing the counters of queueCounts
+const (
+	queueQueued = iota
+	queueAdmitted
+	queueTimedOut
+	queueCancelled
+	queueFull
+)
+
+// queueCounts are the counters behind QueueStats, updated atomically
+type queueCounts struct {
+	events  [5]int64
+	waits   []int64
+	slowest int64
+}
+
+func newQueueCounts() *queueCounts {
+	return &queueCounts{waits: make([]int64, len(dialLatencyBuckets)+1)}
+}
+
+// observe counts an attempt that waited for waited under a queue, or was
+// turned away or given up with err
+func (c *queueCounts) observe(waited time.Duration, queued bool, err error) {
+	switch err.(type) {
+	case nil:
+		if !queued {
+			return
+		}
+		atomic.AddInt64(&c.events[queueAdmitted], 1)
+		atomic.AddInt64(&c.waits[dialBucket(waited)], 1)
+		for {
+			slowest := atomic.LoadInt64(&c.slowest)
+			if int64(waited) <= slowest || atomic.CompareAndSwapInt64(&c.slowest, slowest, int64(waited)) {
+				break
+			}
+		}
+	case *ErrQueueFull:
+		atomic.AddInt64(&c.events[queueFull], 1)
+		return
+	case *ErrQueueTimeout:
+		atomic.AddInt64(&c.events[queueTimedOut], 1)
+	case *ErrContextDone:
+		atomic.AddInt64(&c.events[queueCancelled], 1)
+	}
+	atomic.AddInt64(&c.events[queueQueued], 1)
+}
+
+func (c *queueCounts) reset() {
+	for i := range c.events {
+		atomic.StoreInt64(&c.events[i], 0)
+	}
+	for i := range c.waits {
+		atomic.StoreInt64(&c.waits[i], 0)
+	}
+	atomic.StoreInt64(&c.slowest, 0)
+}
+
+func (c *queueCounts) snapshot(depth int) *QueueStats {
+	stats := &QueueStats{
+		Depth:     depth,
+		Queued:    atomic.LoadInt64(&c.events[queueQueued]),
+		Admitted:  atomic.LoadInt64(&c.events[queueAdmitted]),
+		TimedOut:  atomic.LoadInt64(&c.events[queueTimedOut]),
+		Cancelled: atomic.LoadInt64(&c.events[queueCancelled]),
+		Full:      atomic.LoadInt64(&c.events[queueFull]),
+	}
+
+	counts := make([]int64, len(c.waits))
+	total := int64(0)
+	for i := range c.waits {
+		counts[i] = atomic.LoadInt64(&c.waits[i])
+		total += counts[i]
+	}
+	if total == 0 {
+		return stats
+	}
+
+	slowest := Duration(atomic.LoadInt64(&c.slowest))
+	stats.WaitP50 = dialPercentile(counts, total, 0.50, slowest)
+	stats.WaitP90 = dialPercentile(counts, total, 0.90, slowest)
+	stats.WaitP99 = dialPercentile(counts, total, 0.99, slowest)
+
+	return stats
+}
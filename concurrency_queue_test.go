@@ -0,0 +1,305 @@
+package heimdall
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gojektech/heimdall/fakeclock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// queueServer records the n query parameter of every request as it arrives,
+// then holds it until released
+func queueServer() (server *httptest.Server, release chan struct{}, arrived func() []string) {
+	release = make(chan struct{})
+	var mu sync.Mutex
+	var order []string
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		order = append(order, r.URL.Query().Get("n"))
+		mu.Unlock()
+		<-release
+	}))
+
+	return server, release, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), order...)
+	}
+}
+
+// queueClients make clients limited to one attempt in flight, queueing the
+// others with queue
+func queueClients(name string, queue Option) map[string]testClient {
+	return map[string]testClient{
+		"http":    NewHTTPClient(1000, WithAdaptiveConcurrency(1, 1, 1), queue),
+		"hystrix": NewHystrixHTTPClient(1000, NewHystrixConfig(name+"_command", HystrixCommandConfig{Timeout: 5000}), WithAdaptiveConcurrency(1, 1, 1), queue),
+	}
+}
+
+// queueDepth returns the attempts queued by client
+func queueDepth(client testClient) int {
+	return client.Stats().Queue.Depth
+}
+
+// queueWaits counts the waits published in the wait histogram of prefix
+func queueWaits(prefix string) int64 {
+	waits := int64(0)
+	expvar.Get(prefix + ".concurrency_queue_wait_ms").(*expvar.Map).Do(func(kv expvar.KeyValue) {
+		waits += kv.Value.(*expvar.Int).Value()
+	})
+
+	return waits
+}
+
+func TestConcurrencyQueueAdmitsInArrivalOrder(t *testing.T) {
+	for kind, client := range queueClients("concurrency_queue_fifo", WithConcurrencyQueue(0, 0)) {
+		t.Run(kind, func(t *testing.T) {
+			server, release, arrived := queueServer()
+			defer server.Close()
+			prefix := "heimdall_concurrency_queue_test_" + kind
+			client.EnableExpvar(prefix)
+			waitsBefore := queueWaits(prefix)
+
+			done := make(chan error)
+			get := func(n int) {
+				go func() {
+					_, err := client.Get(fmt.Sprintf("%s?n=%d", server.URL, n), http.Header{})
+					done <- err
+				}()
+			}
+			get(0)
+			require.Eventually(t, func() bool { return len(arrived()) == 1 }, time.Second, time.Millisecond)
+			for n := 1; n <= 5; n++ {
+				get(n)
+				n := n
+				require.Eventually(t, func() bool { return queueDepth(client) == n }, time.Second, time.Millisecond)
+			}
+			assert.Equal(t, "5", expvar.Get(prefix+".concurrency_queue_depth").String())
+
+			time.Sleep(5 * time.Millisecond)
+			for n := 0; n <= 5; n++ {
+				release <- struct{}{}
+				require.NoError(t, <-done)
+			}
+
+			assert.Equal(t, []string{"0", "1", "2", "3", "4", "5"}, arrived(), "queued attempts are admitted first in, first out")
+			assert.Equal(t, "0", expvar.Get(prefix+".concurrency_queue_depth").String())
+			assert.Equal(t, "0", expvar.Get(prefix+".concurrency_in_flight").String())
+
+			stats := client.Stats().Queue
+			require.NotNil(t, stats)
+			assert.Equal(t, 0, stats.Depth)
+			assert.Equal(t, int64(5), stats.Queued)
+			assert.Equal(t, int64(5), stats.Admitted)
+			assert.Zero(t, stats.TimedOut+stats.Cancelled+stats.Full)
+			assert.GreaterOrEqual(t, int64(stats.WaitP50), int64(5*time.Millisecond))
+			assert.GreaterOrEqual(t, int64(stats.WaitP99), int64(stats.WaitP50))
+
+			assert.Equal(t, waitsBefore+5, queueWaits(prefix), "the waits of the admitted attempts are published")
+		})
+	}
+}
+
+func TestConcurrencyQueueRejectsWhenFull(t *testing.T) {
+	for kind, client := range queueClients("concurrency_queue_full", WithConcurrencyQueue(1, 0)) {
+		t.Run(kind, func(t *testing.T) {
+			server, release, arrived := queueServer()
+			defer server.Close()
+
+			done := make(chan error, 2)
+			go func() {
+				_, err := client.Get(server.URL, http.Header{})
+				done <- err
+			}()
+			require.Eventually(t, func() bool { return len(arrived()) == 1 }, time.Second, time.Millisecond)
+			go func() {
+				_, err := client.Get(server.URL, http.Header{})
+				done <- err
+			}()
+			require.Eventually(t, func() bool { return queueDepth(client) == 1 }, time.Second, time.Millisecond)
+
+			client.SetRetryCount(3)
+			_, err := client.Get(server.URL, http.Header{})
+			var full *ErrQueueFull
+			require.True(t, errors.As(err, &full), "%v", err)
+			assert.Equal(t, 1, full.Capacity)
+			assert.Zero(t, full.Waited)
+			assert.Equal(t, "concurrency queue full: 1 attempts waiting", full.Error())
+
+			release <- struct{}{}
+			release <- struct{}{}
+			assert.NoError(t, <-done)
+			assert.NoError(t, <-done)
+			assert.Len(t, arrived(), 2, "the attempt turned away is not retried")
+
+			stats := client.Stats().Queue
+			assert.Equal(t, int64(1), stats.Full)
+			assert.Equal(t, int64(1), stats.Queued)
+			assert.Equal(t, int64(1), stats.Admitted)
+		})
+	}
+}
+
+func TestConcurrencyQueueTimesOut(t *testing.T) {
+	server, release, arrived := queueServer()
+	defer server.Close()
+	client := NewHTTPClient(1000, WithAdaptiveConcurrency(1, 1, 1), WithConcurrencyQueue(0, 20*time.Millisecond))
+
+	done := make(chan error)
+	go func() {
+		_, err := client.Get(server.URL, http.Header{})
+		done <- err
+	}()
+	require.Eventually(t, func() bool { return len(arrived()) == 1 }, time.Second, time.Millisecond)
+
+	_, err := client.Get(server.URL, http.Header{})
+	var timedOut *ErrQueueTimeout
+	require.True(t, errors.As(err, &timedOut), "%v", err)
+	assert.GreaterOrEqual(t, int64(timedOut.Waited), int64(20*time.Millisecond))
+	assert.Zero(t, queueDepth(client), "the attempt timed out leaves the queue")
+
+	release <- struct{}{}
+	assert.NoError(t, <-done)
+
+	stats := client.Stats().Queue
+	assert.Equal(t, int64(1), stats.Queued)
+	assert.Equal(t, int64(1), stats.TimedOut)
+	assert.Zero(t, stats.Admitted)
+	assert.Zero(t, stats.WaitP50, "only admitted attempts count toward the wait percentiles")
+}
+
+func TestCancelledWaitersLeaveTheQueue(t *testing.T) {
+	for kind, client := range queueClients("concurrency_queue_cancel", WithConcurrencyQueue(0, 0)) {
+		t.Run(kind, func(t *testing.T) {
+			server, release, arrived := queueServer()
+			defer server.Close()
+
+			done := make(chan error)
+			go func() {
+				_, err := client.Get(server.URL+"?n=0", http.Header{})
+				done <- err
+			}()
+			require.Eventually(t, func() bool { return len(arrived()) == 1 }, time.Second, time.Millisecond)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			request, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"?n=1", nil)
+			require.NoError(t, err)
+			cancelled := make(chan error)
+			go func() {
+				_, err := client.Do(request)
+				cancelled <- err
+			}()
+			require.Eventually(t, func() bool { return queueDepth(client) == 1 }, time.Second, time.Millisecond)
+
+			cancel()
+			select {
+			case err := <-cancelled:
+				var contextDone *ErrContextDone
+				require.True(t, errors.As(err, &contextDone), "%v", err)
+				assert.True(t, errors.Is(err, context.Canceled))
+				assert.Zero(t, contextDone.Attempts)
+			case <-time.After(time.Second):
+				t.Fatal("the cancelled waiter is still queued")
+			}
+			assert.Zero(t, queueDepth(client))
+
+			go func() {
+				_, err := client.Get(server.URL+"?n=2", http.Header{})
+				done <- err
+			}()
+			require.Eventually(t, func() bool { return queueDepth(client) == 1 }, time.Second, time.Millisecond)
+			release <- struct{}{}
+			release <- struct{}{}
+			assert.NoError(t, <-done)
+			assert.NoError(t, <-done)
+			assert.Equal(t, []string{"0", "2"}, arrived(), "the cancelled attempt is never sent")
+
+			stats := client.Stats().Queue
+			assert.Equal(t, int64(2), stats.Queued)
+			assert.Equal(t, int64(1), stats.Cancelled)
+			assert.Equal(t, int64(1), stats.Admitted)
+		})
+	}
+}
+
+func TestConcurrencyQueueCountsResetButDepthDoesNot(t *testing.T) {
+	server, release, arrived := queueServer()
+	defer server.Close()
+	client := NewHTTPClient(1000, WithAdaptiveConcurrency(1, 1, 1), WithConcurrencyQueue(0, 0))
+
+	done := make(chan error, 2)
+	for n := 0; n < 2; n++ {
+		go func() {
+			_, err := client.Get(server.URL, http.Header{})
+			done <- err
+		}()
+		n := n
+		require.Eventually(t, func() bool { return len(arrived())+queueDepth(client) == n+1 }, time.Second, time.Millisecond)
+	}
+
+	client.ResetStats()
+	stats := client.Stats().Queue
+	assert.Equal(t, 1, stats.Depth)
+	assert.Zero(t, stats.Queued)
+
+	release <- struct{}{}
+	release <- struct{}{}
+	assert.NoError(t, <-done)
+	assert.NoError(t, <-done)
+	assert.Equal(t, int64(1), client.Stats().Queue.Admitted)
+
+	assert.Nil(t, NewHTTPClient(1000, WithAdaptiveConcurrency(1, 1, 1)).Stats().Queue, "clients without a queue have no queue stats")
+}
+
+func TestConcurrencyQueueStopsWaitTimers(t *testing.T) {
+	server, release, arrived := queueServer()
+	defer server.Close()
+	clock := fakeclock.New(time.Now())
+	client := NewHTTPClient(1000, WithClock(clock), WithAdaptiveConcurrency(1, 1, 1), WithConcurrencyQueue(0, time.Hour))
+
+	done := make(chan error, 2)
+	for n := 0; n < 2; n++ {
+		go func() {
+			_, err := client.Get(server.URL, http.Header{})
+			done <- err
+		}()
+		n := n
+		require.Eventually(t, func() bool { return len(arrived())+queueDepth(client) == n+1 }, time.Second, time.Millisecond)
+	}
+	assert.Equal(t, 1, clock.Timers())
+
+	release <- struct{}{}
+	release <- struct{}{}
+	assert.NoError(t, <-done)
+	assert.NoError(t, <-done)
+	assert.Zero(t, clock.Timers(), "the timer of an admitted attempt is stopped")
+
+	go func() {
+		_, err := client.Get(server.URL, http.Header{})
+		done <- err
+	}()
+	require.Eventually(t, func() bool { return len(arrived()) == 3 }, time.Second, time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+	go func() {
+		_, err := client.Do(request)
+		done <- err
+	}()
+	require.Eventually(t, func() bool { return queueDepth(client) == 1 }, time.Second, time.Millisecond)
+	cancel()
+	assert.Error(t, <-done)
+	assert.Zero(t, clock.Timers(), "the timer of a cancelled attempt is stopped")
+
+	release <- struct{}{}
+	assert.NoError(t, <-done)
+}
@@ -0,0 +1,73 @@
+package heimdall
+
+import (
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+	"time"
+)
+
+// defaultConnectFailureDelay is the wait before retrying an attempt that
+// failed to connect. Such failures come back at once and usually mean another
+// address or replica is worth trying, so a long backoff only adds latency.
+const defaultConnectFailureDelay = 10 * time.Millisecond
+
+// fixedRetrier waits the same interval before every retry
+type fixedRetrier struct {
+	interval time.Duration
+}
+
+// newConnectFailureRetrier returns the default retrier of connect failures
+func newConnectFailureRetrier() Retriable {
+	return &fixedRetrier{interval: defaultConnectFailureDelay}
+}
+
+// NextInterval returns the interval, whatever the retry
+func (r *fixedRetrier) NextInterval(retry int) time.Duration {
+	return r.interval
+}
+
+// connectionProbe tells whether an attempt got a connection. Redirects and
+// hedged sends get connections of their own, so the latest one counts: an
+// attempt handed a connection, reused or fresh, may have reached the server
+// and fails in the response phase, whereas one whose dial, TLS handshake or
+// proxy tunnel failed never did. Through a proxy the connection is the one to
+// the proxy, which answers for the server it could not reach. Attempts
+// failing before they ask the transport for a connection, as those failed by
+// middlewares or injected faults do, did not fail to connect either.
+type connectionProbe struct {
+	state atomic.Int32
+}
+
+// The states of a connectionProbe
+const (
+	probeIdle int32 = iota
+	probeConnecting
+	probeConnected
+)
+
+// probeConnection returns request with a probe of its connection
+func probeConnection(request *http.Request) (*http.Request, *connectionProbe) {
+	probe := &connectionProbe{}
+	trace := &httptrace.ClientTrace{
+		GetConn: func(string) {
+			probe.state.Store(probeConnecting)
+		},
+		GotConn: func(httptrace.GotConnInfo) {
+			probe.state.Store(probeConnected)
+		},
+	}
+
+	return request.WithContext(httptrace.WithClientTrace(request.Context(), trace)), probe
+}
+
+// failedToConnect reports whether outcome failed an attempt before it got a
+// connection. Attempts rejected by hystrix or answered by the server did not
+// fail to connect.
+func (p *connectionProbe) failedToConnect(outcome attemptOutcome) bool {
+	if p == nil || outcome.err == nil || outcome.rejected || outcome.response.statusCode != 0 {
+		return false
+	}
+
+	return p.state.Load() == probeConnecting
+}
@@ -0,0 +1,159 @@
+package heimdall
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gojektech/heimdall/fakeclock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// refusedURL returns the URL of a port nothing listens on
+func refusedURL(t *testing.T) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Close()
+
+	return server.URL
+}
+
+func TestConnectFailuresAreRetriedWithoutBackoff(t *testing.T) {
+	refused := refusedURL(t)
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+
+	for kind, newClient := range retryClients {
+		clock := fakeclock.New(time.Now())
+		client := newClient("connect_failure_"+kind, clock)
+		client.SetRetryCount(2)
+		client.SetRetrier(&fixedRetrier{interval: time.Second})
+
+		response, err := client.Get(refused, http.Header{})
+		require.Error(t, err, kind)
+		assert.Equal(t, []time.Duration{defaultConnectFailureDelay, defaultConnectFailureDelay}, clock.Sleeps(), "%s: refused connections are retried at once", kind)
+		attempts := response.Trace().Attempts
+		require.Len(t, attempts, 3, kind)
+		assert.True(t, attempts[0].ConnectFailure, kind)
+		assert.True(t, attempts[1].ConnectFailure, kind)
+		assert.False(t, attempts[2].ConnectFailure, "%s: the final attempt is not classified", kind)
+
+		clock = fakeclock.New(time.Now())
+		client = newClient("connect_failure_503_"+kind, clock)
+		client.SetRetryCount(2)
+		client.SetRetrier(&fixedRetrier{interval: time.Second})
+
+		response, err = client.Get(unavailable.URL, http.Header{})
+		require.Error(t, err, kind)
+		assert.Equal(t, []time.Duration{time.Second, time.Second}, clock.Sleeps(), "%s: responses are retried with the retrier", kind)
+		assert.False(t, response.Trace().Attempts[0].ConnectFailure, kind)
+	}
+}
+
+func TestConnectFailureRetrierIsConfigurable(t *testing.T) {
+	refused := refusedURL(t)
+
+	for kind, newClient := range retryClients {
+		clock := fakeclock.New(time.Now())
+		client := newClient("connect_failure_retrier_"+kind, clock)
+		client.SetRetryCount(2)
+		client.SetRetrier(&fixedRetrier{interval: time.Second})
+		client.SetConnectFailureRetrier(NewRetrier(NewConstantBackoff(50)))
+
+		derived := derive(client)
+		derived.SetConnectFailureRetrier(nil)
+
+		_, err := client.Get(refused, http.Header{})
+		require.Error(t, err, kind)
+		assert.Equal(t, []time.Duration{0, 50 * time.Millisecond}, clock.Sleeps(), kind)
+
+		_, err = derived.Get(refused, http.Header{})
+		require.Error(t, err, kind)
+		assert.Equal(t, []time.Duration{0, 50 * time.Millisecond, time.Second, time.Second}, clock.Sleeps(),
+			"%s: without a connect failure retrier the retrier paces every retry", kind)
+	}
+}
+
+func TestConnectFailureDelaysAreMeasurablyShorter(t *testing.T) {
+	refused := refusedURL(t)
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+
+	client := NewHTTPClient(1000)
+	client.SetRetryCount(2)
+	client.SetRetrier(&fixedRetrier{interval: 200 * time.Millisecond})
+
+	start := time.Now()
+	_, err := client.Get(refused, http.Header{})
+	require.Error(t, err)
+	assert.Less(t, int64(time.Since(start)), int64(200*time.Millisecond), "refused connections skip the backoff")
+
+	start = time.Now()
+	_, err = client.Get(unavailable.URL, http.Header{})
+	require.Error(t, err)
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(400*time.Millisecond), "503s wait for the backoff")
+}
+
+func TestDroppedReusedConnectionsFailInTheResponsePhase(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		require.NoError(t, err)
+		conn.Close()
+	}))
+	defer server.Close()
+
+	clock := fakeclock.New(time.Now())
+	client := NewHTTPClient(1000, WithClock(clock))
+	_, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+
+	client.SetRetryCount(1)
+	client.SetRetrier(&fixedRetrier{interval: time.Second})
+	response, err := client.Get(server.URL, http.Header{})
+	require.Error(t, err)
+	assert.False(t, response.Trace().Attempts[0].ConnectFailure, "the request may have reached the server")
+	assert.Equal(t, []time.Duration{time.Second}, clock.Sleeps())
+}
+
+func TestConnectFailuresThroughProxies(t *testing.T) {
+	proxy := newConnectProxyServer(t, "", "")
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	refused := refusedURL(t)
+
+	for name, tc := range map[string]struct {
+		proxy, target  string
+		connectFailure bool
+		sleep          time.Duration
+	}{
+		"proxy_refused":        {proxy: refused, target: unavailable.URL, connectFailure: true, sleep: defaultConnectFailureDelay},
+		"upstream_refused":     {proxy: proxy.URL().String(), target: refused, connectFailure: true, sleep: defaultConnectFailureDelay},
+		"upstream_unavailable": {proxy: proxy.URL().String(), target: unavailable.URL, sleep: time.Second},
+	} {
+		proxyURL, err := url.Parse(tc.proxy)
+		require.NoError(t, err)
+
+		clock := fakeclock.New(time.Now())
+		client := NewHTTPClient(1000, WithClock(clock), WithProxy(proxyURL, nil))
+		client.SetRetryCount(1)
+		client.SetRetrier(&fixedRetrier{interval: time.Second})
+
+		response, err := client.Get(tc.target, http.Header{})
+		require.Error(t, err, name)
+		assert.Equal(t, tc.connectFailure, response.Trace().Attempts[0].ConnectFailure, "%s: a tunnel the proxy cannot open fails to connect", name)
+		assert.Equal(t, []time.Duration{tc.sleep}, clock.Sleeps(), name)
+	}
+}
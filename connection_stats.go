@@ -0,0 +1,301 @@
+package heimdall
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Dial latency buckets in milliseconds, counted as in the expvar histograms
+var dialLatencyBuckets = []int64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500}
+
+// ConnectionStats describe how the attempts of a client got their
+// connections, for tuning keep-alive and the connection pool
+type ConnectionStats struct {
+	// Dialed counts the attempts sent on a new connection, Reused those sent
+	// on a pooled one
+	Dialed int64 `json:"dialed"`
+	Reused int64 `json:"reused"`
+	// Idle is the number of connections waiting in the pool now, which a
+	// reset keeps. Only connections dialed by the transport the client was
+	// built with are counted, and only exactly for HTTP/1.1.
+	Idle int64 `json:"idle"`
+
+	// DialLatency counts the attempts sent on a new connection by how long
+	// getting it took, DNS and TLS handshake included, keyed by bucket in
+	// milliseconds as in expvar
+	DialLatency map[string]int64 `json:"dial_latency_ms,omitempty"`
+	// DialP50, DialP90 and DialP99 approximate the dial latency percentiles
+	// by the upper bound of the bucket they fall in, or the slowest dial for
+	// the last bucket. They are zero before any dial.
+	DialP50 Duration `json:"dial_p50"`
+	DialP90 Duration `json:"dial_p90"`
+	DialP99 Duration `json:"dial_p99"`
+}
+
+// connectionStats are the counters behind ConnectionStats, updated
+// atomically
+type connectionStats struct {
+	dialed      int64
+	reused      int64
+	dialLatency []int64
+	slowestDial int64
+}
+
+func newConnectionStats() *connectionStats {
+	return &connectionStats{dialLatency: make([]int64, len(dialLatencyBuckets)+1)}
+}
+
+// dial counts a new connection got in elapsed
+func (s *connectionStats) dial(elapsed time.Duration) {
+	if s == nil {
+		return
+	}
+
+	atomic.AddInt64(&s.dialLatency[dialBucket(elapsed)], 1)
+	for {
+		slowest := atomic.LoadInt64(&s.slowestDial)
+		if int64(elapsed) <= slowest || atomic.CompareAndSwapInt64(&s.slowestDial, slowest, int64(elapsed)) {
+			return
+		}
+	}
+}
+
+// got counts an attempt getting a connection
+func (s *connectionStats) got(reused bool) {
+	if s == nil {
+		return
+	}
+
+	if reused {
+		atomic.AddInt64(&s.reused, 1)
+		return
+	}
+	atomic.AddInt64(&s.dialed, 1)
+}
+
+func (s *connectionStats) reset() {
+	atomic.StoreInt64(&s.dialed, 0)
+	atomic.StoreInt64(&s.reused, 0)
+	for i := range s.dialLatency {
+		atomic.StoreInt64(&s.dialLatency[i], 0)
+	}
+	atomic.StoreInt64(&s.slowestDial, 0)
+}
+
+func (s *connectionStats) snapshot(pool *connectionPool) ConnectionStats {
+	stats := ConnectionStats{
+		Dialed: atomic.LoadInt64(&s.dialed),
+		Reused: atomic.LoadInt64(&s.reused),
+		Idle:   pool.idleConnections(),
+	}
+
+	counts := make([]int64, len(s.dialLatency))
+	total := int64(0)
+	for i := range s.dialLatency {
+		counts[i] = atomic.LoadInt64(&s.dialLatency[i])
+		total += counts[i]
+	}
+	if total == 0 {
+		return stats
+	}
+
+	stats.DialLatency = map[string]int64{}
+	for i, count := range counts {
+		if count > 0 {
+			stats.DialLatency[dialBucketName(i)] = count
+		}
+	}
+
+	slowest := Duration(atomic.LoadInt64(&s.slowestDial))
+	stats.DialP50 = dialPercentile(counts, total, 0.50, slowest)
+	stats.DialP90 = dialPercentile(counts, total, 0.90, slowest)
+	stats.DialP99 = dialPercentile(counts, total, 0.99, slowest)
+
+	return stats
+}
+
+// dialPercentile returns the upper bound of the bucket holding percentile p
+// of the total dials counted in counts, slowest for the last bucket
+func dialPercentile(counts []int64, total int64, p float64, slowest Duration) Duration {
+	rank := int64(math.Ceil(p * float64(total)))
+	seen := int64(0)
+	for i, count := range counts {
+		seen += count
+		if seen < rank {
+			continue
+		}
+		if i == len(dialLatencyBuckets) {
+			return slowest
+		}
+		return Duration(time.Duration(dialLatencyBuckets[i]) * time.Millisecond)
+	}
+
+	return slowest
+}
+
+func dialBucket(elapsed time.Duration) int {
+	ms := int64(elapsed / time.Millisecond)
+	for i, bound := range dialLatencyBuckets {
+		if ms <= bound {
+			return i
+		}
+	}
+
+	return len(dialLatencyBuckets)
+}
+
+func dialBucketName(bucket int) string {
+	if bucket == len(dialLatencyBuckets) {
+		return "le_inf"
+	}
+
+	return "le_" + strconv.FormatInt(dialLatencyBuckets[bucket], 10)
+}
+
+// connectionPool counts the idle connections of a transport built by
+// newTransport. Its connections move themselves in and out of the count.
+type connectionPool struct {
+	idle int64
+}
+
+func (p *connectionPool) idleConnections() int64 {
+	if p == nil {
+		return 0
+	}
+
+	return atomic.LoadInt64(&p.idle)
+}
+
+func (p *connectionPool) add(delta int64) {
+	if p != nil {
+		atomic.AddInt64(&p.idle, delta)
+	}
+}
+
+// States of a meteredConn as counted by its connectionPool
+const (
+	connNew int32 = iota
+	connBusy
+	connIdle
+	connClosed
+)
+
+// acquire marks c as taken by an attempt
+func (c *meteredConn) acquire() {
+	for {
+		state := atomic.LoadInt32(&c.state)
+		if state == connBusy || state == connClosed {
+			return
+		}
+		if atomic.CompareAndSwapInt32(&c.state, state, connBusy) {
+			if state == connIdle {
+				c.pool.add(-1)
+			}
+			return
+		}
+	}
+}
+
+// release marks c as back in the pool
+func (c *meteredConn) release() {
+	if atomic.CompareAndSwapInt32(&c.state, connBusy, connIdle) {
+		c.pool.add(1)
+	}
+}
+
+func (c *meteredConn) Close() error {
+	if atomic.SwapInt32(&c.state, connClosed) == connIdle {
+		c.pool.add(-1)
+	}
+
+	return c.Conn.Close()
+}
+
+// connectionTrace counts how one attempt got its connection into stats and
+// metrics, timing new connections with clock. It works with any transport
+// honouring httptrace, and moves the connections dialed by newTransport in
+// and out of the idle count of their pool.
+//
+// Dials are timed from asking the pool for a connection to getting it, DNS
+// and TLS handshake included, rather than with ConnectStart and ConnectDone,
+// which would have every attempt trace the dialer too.
+type connectionTrace struct {
+	stats   *connectionStats
+	metrics *expvarMetrics
+	clock   Clock
+
+	mu      sync.Mutex
+	getConn time.Time
+	conn    *meteredConn
+}
+
+func (t *connectionTrace) gettingConn() {
+	now := t.clock.Now()
+
+	t.mu.Lock()
+	t.getConn = now
+	t.mu.Unlock()
+}
+
+func (t *connectionTrace) gotConn(info httptrace.GotConnInfo) {
+	t.stats.got(info.Reused)
+	t.metrics.gotConn(info.Reused)
+
+	if !info.Reused {
+		now := t.clock.Now()
+		t.mu.Lock()
+		started := t.getConn
+		t.mu.Unlock()
+		if !started.IsZero() {
+			t.stats.dial(now.Sub(started))
+			t.metrics.dial(now.Sub(started))
+		}
+	}
+
+	if metered := meteredConnOf(info.Conn); metered != nil {
+		metered.acquire()
+		t.mu.Lock()
+		t.conn = metered
+		t.mu.Unlock()
+	}
+}
+
+// release returns response with its connection marked as back in the pool
+// once its body was read, when the transport returns the connection to its
+// pool. A body closed early has the transport close the connection instead.
+func (t *connectionTrace) release(request *http.Request, response *http.Response, err error) (*http.Response, error) {
+	t.mu.Lock()
+	conn := t.conn
+	t.mu.Unlock()
+	if err != nil || conn == nil || response.Close || request.Close {
+		return response, err
+	}
+
+	if response.Body == nil || response.Body == http.NoBody {
+		conn.release()
+		return response, nil
+	}
+	response.Body = &releasingBody{ReadCloser: response.Body, conn: conn}
+
+	return response, nil
+}
+
+type releasingBody struct {
+	io.ReadCloser
+	conn *meteredConn
+}
+
+func (b *releasingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.conn.release()
+	}
+
+	return n, err
+}
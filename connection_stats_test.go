@@ -0,0 +1,168 @@
+package heimdall
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func okServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok": true}`))
+	}))
+}
+
+func TestClientsCountReusedConnections(t *testing.T) {
+	for kind, newClient := range retryClients {
+		t.Run(kind, func(t *testing.T) {
+			server := okServer()
+			defer server.Close()
+
+			client := derive(newClient("connection_stats_"+kind, realClock{}), WithKeepAlive())
+
+			_, err := client.Get(server.URL, http.Header{})
+			require.NoError(t, err)
+			connections := client.Stats().Connections
+			assert.Equal(t, int64(1), connections.Dialed)
+			assert.Equal(t, int64(0), connections.Reused)
+			assert.Equal(t, int64(1), connections.Idle)
+
+			for i := 0; i < 3; i++ {
+				_, err := client.Get(server.URL, http.Header{})
+				require.NoError(t, err)
+			}
+			connections = client.Stats().Connections
+			assert.Equal(t, int64(1), connections.Dialed)
+			assert.Equal(t, int64(3), connections.Reused)
+			assert.Equal(t, int64(1), connections.Idle)
+
+			dials := int64(0)
+			for _, count := range connections.DialLatency {
+				dials += count
+			}
+			assert.Equal(t, int64(1), dials)
+			assert.True(t, connections.DialP50 > 0)
+			assert.Equal(t, connections.DialP50, connections.DialP99)
+		})
+	}
+}
+
+func TestConnectionStatsWithoutKeepAlive(t *testing.T) {
+	server := okServer()
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+	for i := 0; i < 3; i++ {
+		_, err := client.Get(server.URL, http.Header{})
+		require.NoError(t, err)
+	}
+
+	connections := client.Stats().Connections
+	assert.Equal(t, int64(3), connections.Dialed)
+	assert.Equal(t, int64(0), connections.Reused)
+	assert.Equal(t, int64(0), connections.Idle, "closed connections do not wait in the pool")
+}
+
+func TestIdleConnectionsLeaveThePoolWhenClosed(t *testing.T) {
+	server := okServer()
+	defer server.Close()
+
+	client := NewHTTPClient(1000, WithKeepAlive())
+	_, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), client.Stats().Connections.Idle)
+
+	clientTransport(client).CloseIdleConnections()
+
+	assert.Equal(t, int64(0), client.Stats().Connections.Idle)
+}
+
+func TestConnectionStatsWithCustomTransport(t *testing.T) {
+	server := okServer()
+	defer server.Close()
+
+	client := NewHTTPClient(1000, WithKeepAlive())
+	client.SwapTransport(&http.Transport{})
+	for i := 0; i < 3; i++ {
+		_, err := client.Get(server.URL, http.Header{})
+		require.NoError(t, err)
+	}
+
+	connections := client.Stats().Connections
+	assert.Equal(t, int64(1), connections.Dialed)
+	assert.Equal(t, int64(2), connections.Reused)
+	assert.Equal(t, int64(0), connections.Idle, "connections of custom transports are not tracked")
+}
+
+func TestResetStatsKeepsIdleConnections(t *testing.T) {
+	server := okServer()
+	defer server.Close()
+
+	client := NewHTTPClient(1000, WithKeepAlive())
+	_, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+
+	client.ResetStats()
+
+	assert.Equal(t, ConnectionStats{Idle: 1}, client.Stats().Connections)
+}
+
+func TestPrewarmedConnectionsCountAsIdle(t *testing.T) {
+	server := okServer()
+	defer server.Close()
+
+	client := NewHTTPClient(1000, WithKeepAlive())
+	require.NoError(t, client.Prewarm(context.Background(), server.URL))
+	assert.Equal(t, int64(1), client.Stats().Connections.Idle)
+
+	_, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+
+	connections := client.Stats().Connections
+	assert.Equal(t, int64(1), connections.Reused)
+	assert.Equal(t, int64(1), connections.Idle)
+}
+
+func TestExpvarPublishesConnectionMetrics(t *testing.T) {
+	prefix := uniqueName("heimdall_connections_test")
+	server := okServer()
+	defer server.Close()
+
+	client := NewHTTPClient(1000, WithKeepAlive())
+	client.EnableExpvar(prefix)
+	for i := 0; i < 3; i++ {
+		_, err := client.Get(server.URL, http.Header{})
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, "1", expvar.Get(prefix+".connections_dialed").String())
+	assert.Equal(t, "2", expvar.Get(prefix+".connections_reused").String())
+	assert.NotEqual(t, "{}", expvar.Get(prefix+".dial_latency_ms").String())
+}
+
+func TestDialPercentiles(t *testing.T) {
+	stats := newConnectionStats()
+	for i := 0; i < 90; i++ {
+		stats.dial(3 * time.Millisecond)
+	}
+	for i := 0; i < 9; i++ {
+		stats.dial(40 * time.Millisecond)
+	}
+	stats.dial(4 * time.Second)
+
+	connections := stats.snapshot(nil)
+
+	assert.Equal(t, map[string]int64{"le_5": 90, "le_50": 9, "le_inf": 1}, connections.DialLatency)
+	assert.Equal(t, Duration(5*time.Millisecond), connections.DialP50)
+	assert.Equal(t, Duration(5*time.Millisecond), connections.DialP90)
+	assert.Equal(t, Duration(50*time.Millisecond), connections.DialP99)
+
+	stats.dial(4 * time.Second)
+	assert.Equal(t, Duration(4*time.Second), stats.snapshot(nil).DialP99, "the last bucket reports the slowest dial")
+}
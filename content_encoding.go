@@ -0,0 +1,257 @@
+package heimdall
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// ContentDecoder returns a reader of the decoded content of r, a body sent
+// with the content encoding the decoder is registered for
+type ContentDecoder func(r io.Reader) (io.ReadCloser, error)
+
+// ErrUnsupportedContentEncoding is the cause of the *ErrMalformedResponse
+// returned for a body encoded more than once, such as with
+// `Content-Encoding: gzip, x-custom`, when the outer encodings have decoders
+// but an inner one does not, so that the body cannot be decoded in full.
+type ErrUnsupportedContentEncoding struct {
+	// ContentEncoding is the Content-Encoding of the response
+	ContentEncoding string
+	// Encoding is the encoding no decoder is registered for
+	Encoding string
+}
+
+func (e *ErrUnsupportedContentEncoding) Error() string {
+	return fmt.Sprintf("no decoder is registered for the %s encoding of %q", e.Encoding, e.ContentEncoding)
+}
+
+// ErrContentDecoding is returned when reading a body its decoder fails to
+// start on, such as a gzip body with a corrupt header
+type ErrContentDecoding struct {
+	Encoding string
+
+	err error
+}
+
+func (e *ErrContentDecoding) Error() string {
+	return fmt.Sprintf("decoding %s body: %v", e.Encoding, e.err)
+}
+
+// Unwrap returns the error of the decoder
+func (e *ErrContentDecoding) Unwrap() error {
+	return e.err
+}
+
+var (
+	contentDecodersMu sync.RWMutex
+	contentDecoders   = map[string]ContentDecoder{"gzip": decodeGzip, "deflate": decodeDeflate}
+	// contentEncodings are the encodings of contentDecoders in the order they
+	// were registered, and acceptEncoding the Accept-Encoding listing them
+	contentEncodings = []string{"gzip", "deflate"}
+	acceptEncoding   = "gzip, deflate"
+)
+
+// RegisterContentDecoder registers decoder for the content encoding, such as
+// br or zstd, replacing the decoder already registered for it. A nil decoder
+// unregisters the encoding. The clients advertise the registered encodings,
+// gzip and deflate unless unregistered, in the Accept-Encoding of requests
+// that do not set one, and decode the bodies of the responses to them. The
+// brotlidecoder and zstddecoder packages provide decoders for br and zstd.
+// Encodings are case-insensitive, and registering one applies to every client
+// of the process.
+func RegisterContentDecoder(encoding string, decoder ContentDecoder) error {
+	encoding = strings.ToLower(encoding)
+	if !validMethod(encoding) || encoding == "identity" {
+		return fmt.Errorf("heimdall: invalid content encoding %q", encoding)
+	}
+
+	contentDecodersMu.Lock()
+	defer contentDecodersMu.Unlock()
+
+	_, registered := contentDecoders[encoding]
+	switch {
+	case decoder == nil && registered:
+		delete(contentDecoders, encoding)
+		for i, registered := range contentEncodings {
+			if registered == encoding {
+				contentEncodings = append(contentEncodings[:i:i], contentEncodings[i+1:]...)
+				break
+			}
+		}
+	case decoder != nil:
+		contentDecoders[encoding] = decoder
+		if !registered {
+			contentEncodings = append(contentEncodings[:len(contentEncodings):len(contentEncodings)], encoding)
+		}
+	}
+
+	acceptEncoding = strings.Join(contentEncodings, ", ")
+	if acceptEncoding == "" {
+		acceptEncoding = "identity"
+	}
+
+	return nil
+}
+
+// decodeContent advertises the registered content encodings on the attempts
+// sent through next, and decodes the bodies of the responses to them. The
+// transport then leaves bodies as they were sent, gzip ones included, so
+// heimdall decodes them all. Attempts which set an Accept-Encoding of their
+// own get their bodies as they were sent, as with net/http.
+func decodeContent(next Doer) Doer {
+	return DoerFunc(func(request *http.Request) (*http.Response, error) {
+		if request.Header.Get("Accept-Encoding") != "" {
+			return next.Do(request)
+		}
+
+		contentDecodersMu.RLock()
+		accept := acceptEncoding
+		contentDecodersMu.RUnlock()
+
+		// The request is shared by every attempt, so the header goes on a copy
+		attempt := *request
+		attempt.Header = copyHeader(request.Header)
+		attempt.Header.Set("Accept-Encoding", accept)
+
+		response, err := next.Do(&attempt)
+		if err != nil || response == nil || response.Body == nil {
+			return response, err
+		}
+
+		if err := decodeBody(response); err != nil {
+			closeBody(response)
+			return nil, err
+		}
+
+		return response, nil
+	})
+}
+
+// decodeBody replaces the body of response with its decoded content, when
+// decoders are registered for its encodings. Bodies encoded with one the
+// outermost encoding of which has no decoder are left as they were sent.
+func decodeBody(response *http.Response) error {
+	header := strings.Join(response.Header.Values("Content-Encoding"), ", ")
+	var encodings []string
+	for _, encoding := range strings.Split(header, ",") {
+		switch encoding = strings.ToLower(strings.TrimSpace(encoding)); encoding {
+		case "", "identity":
+		case "x-gzip":
+			encodings = append(encodings, "gzip")
+		default:
+			encodings = append(encodings, encoding)
+		}
+	}
+	if len(encodings) == 0 {
+		return nil
+	}
+
+	// Encodings are listed in the order they were applied, so the last one
+	// is decoded first
+	decoders := make([]ContentDecoder, len(encodings))
+	contentDecodersMu.RLock()
+	for i, encoding := range encodings {
+		decoders[len(encodings)-1-i] = contentDecoders[encoding]
+	}
+	contentDecodersMu.RUnlock()
+
+	if decoders[0] == nil {
+		return nil
+	}
+	for i, decoder := range decoders {
+		if decoder == nil {
+			unsupported := &ErrUnsupportedContentEncoding{ContentEncoding: header, Encoding: encodings[len(encodings)-1-i]}
+			return &ErrMalformedResponse{Detail: unsupported.Error(), err: unsupported}
+		}
+	}
+
+	for i, j := 0, len(encodings)-1; i < j; i, j = i+1, j-1 {
+		encodings[i], encodings[j] = encodings[j], encodings[i]
+	}
+	response.Body = &decodedBody{body: response.Body, decoders: decoders, encodings: encodings}
+	response.Header.Del("Content-Encoding")
+	response.Header.Del("Content-Length")
+	response.ContentLength = -1
+	response.Uncompressed = true
+
+	return nil
+}
+
+// decodedBody reads body through decoders, the outermost encoding first. The
+// decoders start on the first read, as those reading a header of their own
+// would otherwise block until the server sends the body.
+type decodedBody struct {
+	body      io.ReadCloser
+	decoders  []ContentDecoder
+	encodings []string
+
+	reader  io.Reader
+	readers []io.ReadCloser
+	err     error
+}
+
+func (b *decodedBody) Read(p []byte) (int, error) {
+	if b.reader == nil && b.err == nil {
+		b.start()
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+
+	return b.reader.Read(p)
+}
+
+func (b *decodedBody) start() {
+	reader := io.Reader(b.body)
+	for i, decoder := range b.decoders {
+		decoded, err := decoder(reader)
+		if err == io.EOF {
+			// An empty body, as some servers send for errors whatever the
+			// encoding
+			b.err = io.EOF
+			return
+		}
+		if err != nil {
+			b.err = &ErrContentDecoding{Encoding: b.encodings[i], err: err}
+			return
+		}
+
+		b.readers = append(b.readers, decoded)
+		reader = decoded
+	}
+	b.reader = reader
+}
+
+func (b *decodedBody) Close() error {
+	for i := len(b.readers) - 1; i >= 0; i-- {
+		b.readers[i].Close()
+	}
+
+	return b.body.Close()
+}
+
+func decodeGzip(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// decodeDeflate decodes deflate bodies, which RFC 7230 defines as zlib
+// streams but some servers send as raw deflate
+func decodeDeflate(r io.Reader) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(r)
+	header, err := buffered.Peek(2)
+	if len(header) == 0 && err != nil {
+		return nil, err
+	}
+
+	if len(header) == 2 && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(buffered)
+	}
+
+	return flate.NewReader(buffered), nil
+}
@@ -0,0 +1,288 @@
+package heimdall
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const encodedPayload = `{ "response": "compressible compressible compressible" }`
+
+func gzipped(t *testing.T, body []byte) []byte {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	_, err := writer.Write(body)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	return buffer.Bytes()
+}
+
+func zlibbed(t *testing.T, body []byte) []byte {
+	var buffer bytes.Buffer
+	writer := zlib.NewWriter(&buffer)
+	_, err := writer.Write(body)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	return buffer.Bytes()
+}
+
+func deflated(t *testing.T, body []byte) []byte {
+	var buffer bytes.Buffer
+	writer, err := flate.NewWriter(&buffer, flate.DefaultCompression)
+	require.NoError(t, err)
+	_, err = writer.Write(body)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	return buffer.Bytes()
+}
+
+// reversed is a test encoding writing bodies backwards
+func reversed(body []byte) []byte {
+	out := make([]byte, len(body))
+	for i, b := range body {
+		out[len(body)-1-i] = b
+	}
+
+	return out
+}
+
+func decodeReversed(r io.Reader) (io.ReadCloser, error) {
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(reversed(body))), nil
+}
+
+// encodedServer answers every request with body sent with encoding, counting
+// the requests into hits and the Accept-Encoding of the last into accept
+func encodedServer(encoding string, body []byte, hits *int32, accept *atomic.Value) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		accept.Store(r.Header.Get("Accept-Encoding"))
+		if encoding != "" {
+			w.Header().Set("Content-Encoding", encoding)
+		}
+		w.Write(body)
+	}))
+}
+
+func TestClientsDecodeContentEncodings(t *testing.T) {
+	payload := []byte(encodedPayload)
+
+	for kind, newClient := range retryClients {
+		t.Run(kind, func(t *testing.T) {
+			for name, tc := range map[string]struct {
+				encoding string
+				body     []byte
+			}{
+				"gzip":           {encoding: "gzip", body: gzipped(t, payload)},
+				"x-gzip":         {encoding: "x-gzip", body: gzipped(t, payload)},
+				"deflate":        {encoding: "deflate", body: zlibbed(t, payload)},
+				"raw deflate":    {encoding: "deflate", body: deflated(t, payload)},
+				"identity":       {encoding: "identity", body: payload},
+				"layered":        {encoding: "deflate, GZIP", body: gzipped(t, zlibbed(t, payload))},
+				"layered deeper": {encoding: "gzip, identity, gzip", body: gzipped(t, gzipped(t, payload))},
+			} {
+				var hits int32
+				var accept atomic.Value
+				server := encodedServer(tc.encoding, tc.body, &hits, &accept)
+
+				response, err := newClient("content_encoding_"+kind, realClock{}).Get(server.URL, http.Header{})
+				server.Close()
+				require.NoError(t, err, name)
+				assert.Equal(t, encodedPayload, string(response.Body()), name)
+				if tc.encoding != "identity" {
+					assert.Empty(t, response.Headers().Get("Content-Encoding"), name)
+					assert.Empty(t, response.Headers().Get("Content-Length"), name)
+				}
+				assert.Equal(t, "gzip, deflate", accept.Load(), name)
+			}
+		})
+	}
+}
+
+func TestClientsPassUnknownContentEncodingsThrough(t *testing.T) {
+	payload := []byte(encodedPayload)
+	body := gzipped(t, reversed(payload))
+
+	for kind, newClient := range retryClients {
+		t.Run(kind, func(t *testing.T) {
+			var hits int32
+			var accept atomic.Value
+			server := encodedServer("gzip, x-reversed", reversed(body), &hits, &accept)
+			defer server.Close()
+
+			response, err := newClient("content_encoding_unknown_"+kind, realClock{}).Get(server.URL, http.Header{})
+			require.NoError(t, err)
+			assert.Equal(t, reversed(body), response.Body(), "bodies the outermost encoding of which is unknown are left as they were sent")
+			assert.Equal(t, "gzip, x-reversed", response.Headers().Get("Content-Encoding"))
+		})
+	}
+}
+
+func TestClientsRejectPartlyDecodableContentEncodings(t *testing.T) {
+	payload := []byte(encodedPayload)
+
+	for kind, newClient := range retryClients {
+		t.Run(kind, func(t *testing.T) {
+			var hits int32
+			var accept atomic.Value
+			server := encodedServer("x-reversed, gzip", gzipped(t, reversed(payload)), &hits, &accept)
+			defer server.Close()
+
+			client := newClient("content_encoding_partial_"+kind, realClock{})
+			client.SetRetryCount(2)
+			client.SetRetrier(NewRetrier(NewConstantBackoff(1)))
+
+			_, err := client.Get(server.URL, http.Header{})
+			require.Error(t, err)
+			var malformed *ErrMalformedResponse
+			require.True(t, errors.As(err, &malformed), "%v", err)
+			var unsupported *ErrUnsupportedContentEncoding
+			require.True(t, errors.As(err, &unsupported), "%v", err)
+			assert.Equal(t, "x-reversed", unsupported.Encoding)
+			assert.Equal(t, "x-reversed, gzip", unsupported.ContentEncoding)
+			assert.Contains(t, err.Error(), `no decoder is registered for the x-reversed encoding of "x-reversed, gzip"`)
+			assert.Equal(t, int32(1), atomic.LoadInt32(&hits), "such responses are not retried")
+		})
+	}
+}
+
+// keepContentDecoders restores the registered content decoders once t ends
+func keepContentDecoders(t *testing.T) {
+	contentDecodersMu.RLock()
+	decoders := make(map[string]ContentDecoder, len(contentDecoders))
+	for encoding, decoder := range contentDecoders {
+		decoders[encoding] = decoder
+	}
+	encodings, accept := contentEncodings, acceptEncoding
+	contentDecodersMu.RUnlock()
+
+	t.Cleanup(func() {
+		contentDecodersMu.Lock()
+		defer contentDecodersMu.Unlock()
+
+		contentDecoders, contentEncodings, acceptEncoding = decoders, encodings, accept
+	})
+}
+
+func TestRegisterContentDecoder(t *testing.T) {
+	keepContentDecoders(t)
+	require.NoError(t, RegisterContentDecoder("X-Reversed", decodeReversed))
+
+	payload := []byte(encodedPayload)
+	var hits int32
+	var accept atomic.Value
+	server := encodedServer("x-reversed, gzip", gzipped(t, reversed(payload)), &hits, &accept)
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+	response, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, encodedPayload, string(response.Body()))
+	assert.Equal(t, "gzip, deflate, x-reversed", accept.Load())
+
+	require.NoError(t, RegisterContentDecoder("gzip", nil))
+	_, err = client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, "deflate, x-reversed", accept.Load(), "unregistered encodings are no longer advertised")
+
+	require.NoError(t, RegisterContentDecoder("deflate", nil))
+	require.NoError(t, RegisterContentDecoder("x-reversed", nil))
+	response, err = client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, "identity", accept.Load(), "the transport does not decode gzip behind heimdall")
+	assert.Equal(t, gzipped(t, reversed(payload)), response.Body())
+
+	for _, encoding := range []string{"", "identity", "gzip, br", "b r"} {
+		assert.Error(t, RegisterContentDecoder(encoding, decodeReversed), "%q", encoding)
+	}
+}
+
+func TestContentSetByTheRequestIsNotDecoded(t *testing.T) {
+	body := gzipped(t, []byte(encodedPayload))
+	var hits int32
+	var accept atomic.Value
+	server := encodedServer("gzip", body, &hits, &accept)
+	defer server.Close()
+
+	response, err := NewHTTPClient(1000).Get(server.URL, http.Header{"Accept-Encoding": {"gzip"}})
+	require.NoError(t, err)
+	assert.Equal(t, "gzip", accept.Load())
+	assert.Equal(t, body, response.Body(), "requests asking for an encoding themselves get bodies as they were sent")
+	assert.Equal(t, "gzip", response.Headers().Get("Content-Encoding"))
+}
+
+func TestContentDecodingFailures(t *testing.T) {
+	body := gzipped(t, []byte(strings.Repeat(encodedPayload, 100)))
+
+	for name, tc := range map[string]struct {
+		body   []byte
+		status int
+		check  func(t *testing.T, response Response, err error)
+	}{
+		"corrupt": {
+			body: []byte("not gzip at all"),
+			check: func(t *testing.T, response Response, err error) {
+				var decoding *ErrContentDecoding
+				require.True(t, errors.As(err, &decoding), "%v", err)
+				assert.Equal(t, "gzip", decoding.Encoding)
+				assert.True(t, errors.Is(err, gzip.ErrHeader))
+			},
+		},
+		"truncated": {
+			body: body[:len(body)/2],
+			check: func(t *testing.T, response Response, err error) {
+				var truncated *ErrTruncatedBody
+				require.True(t, errors.As(err, &truncated), "%v", err)
+				assert.Equal(t, int64(-1), truncated.Expected)
+			},
+		},
+		"empty": {
+			status: http.StatusNotFound,
+			check: func(t *testing.T, response Response, err error) {
+				require.NoError(t, err)
+				assert.Equal(t, http.StatusNotFound, response.StatusCode())
+				assert.Empty(t, response.Body())
+			},
+		},
+		"no content": {
+			status: http.StatusNoContent,
+			check: func(t *testing.T, response Response, err error) {
+				require.NoError(t, err)
+				assert.Equal(t, http.StatusNoContent, response.StatusCode())
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Encoding", "gzip")
+				if tc.status != 0 {
+					w.WriteHeader(tc.status)
+				}
+				w.Write(tc.body)
+			}))
+			defer server.Close()
+
+			response, err := NewHTTPClient(1000).Get(server.URL, http.Header{})
+			tc.check(t, response, err)
+		})
+	}
+}
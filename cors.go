@@ -0,0 +1,239 @@
+package heimdall
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSResult is the answer of a server to a CORS preflight, and whether a
+// browser would go on to send the request the preflight asked about
+type CORSResult struct {
+	// Allowed reports whether the request may be sent without credentials
+	Allowed bool
+	// AllowedWithCredentials reports whether the request may be sent with
+	// cookies or an Authorization header, which rules out wildcards
+	AllowedWithCredentials bool
+	// Problems explains why the request would be blocked. Problems only
+	// blocking credentialed requests start with "with credentials: ".
+	Problems []string
+
+	// AllowOrigin is the Access-Control-Allow-Origin of the response
+	AllowOrigin string
+	// AllowCredentials reports whether Access-Control-Allow-Credentials is true
+	AllowCredentials bool
+	// AllowMethods are the methods listed by Access-Control-Allow-Methods
+	AllowMethods []string
+	// AllowHeaders are the headers listed by Access-Control-Allow-Headers
+	AllowHeaders []string
+	// MaxAge is how long the preflight may be cached, zero when not given
+	MaxAge time.Duration
+
+	// Response is the preflight response
+	Response Response
+}
+
+// CheckCORS sends through client the CORS preflight a browser on origin
+// would send before making a request with method and requestHeaders to url,
+// so request mutators, middlewares and retries apply as they do to any
+// request. It reports whether the server permits that request, taking the
+// methods and headers browsers send without asking, such as GET or Accept,
+// as permitted. An error is only returned when client returns one for the
+// preflight, as for a 5xx; a refusal is reported in the result.
+func CheckCORS(ctx context.Context, client Client, url, origin, method string, requestHeaders []string) (CORSResult, error) {
+	request, err := newRequest(http.MethodOptions, url, nil)
+	if err != nil {
+		return CORSResult{}, err
+	}
+
+	unsafe := unsafeCORSHeaders(requestHeaders)
+	request.Header.Set("Origin", origin)
+	request.Header.Set("Access-Control-Request-Method", method)
+	if len(unsafe) > 0 {
+		request.Header.Set("Access-Control-Request-Headers", strings.Join(unsafe, ","))
+	}
+
+	response, err := SendRequest(client, request.WithContext(ctx))
+	if err != nil {
+		return CORSResult{Response: response}, err
+	}
+
+	return checkPreflight(response, origin, method, unsafe), nil
+}
+
+// corsCheck collects the problems found in a preflight response
+type corsCheck struct {
+	problems       []string
+	blocked        bool
+	credentialless bool
+}
+
+// block records a problem blocking every request
+func (c *corsCheck) block(problem string) {
+	c.problems = append(c.problems, problem)
+	c.blocked = true
+}
+
+// blockCredentials records a problem blocking credentialed requests only
+func (c *corsCheck) blockCredentials(problem string) {
+	c.problems = append(c.problems, "with credentials: "+problem)
+	c.credentialless = true
+}
+
+// checkPreflight runs the CORS check of the fetch standard on response for
+// a request with method and the unsafe headers from origin
+func checkPreflight(response Response, origin, method string, unsafe []string) CORSResult {
+	headers := response.headers
+	result := CORSResult{
+		AllowOrigin:      headers.Get("Access-Control-Allow-Origin"),
+		AllowCredentials: headers.Get("Access-Control-Allow-Credentials") == "true",
+		Response:         response,
+	}
+	check := &corsCheck{}
+
+	if status := response.StatusCode(); status < 200 || status > 299 {
+		check.block("preflight answered with status " + strconv.Itoa(status))
+	}
+
+	switch origins := headers["Access-Control-Allow-Origin"]; {
+	case len(origins) == 0:
+		check.block("no Access-Control-Allow-Origin")
+	case len(origins) > 1 || strings.Contains(origins[0], ","):
+		check.block("ill-formed Access-Control-Allow-Origin " + strconv.Quote(strings.Join(origins, ", ")))
+	case origins[0] == "*":
+		check.blockCredentials("Access-Control-Allow-Origin is a wildcard")
+	case origins[0] != origin:
+		check.block("Access-Control-Allow-Origin " + strconv.Quote(origins[0]) + " does not match " + strconv.Quote(origin))
+	}
+	if !result.AllowCredentials {
+		check.blockCredentials("Access-Control-Allow-Credentials is not true")
+	}
+
+	methods, ok := corsList(headers, "Access-Control-Allow-Methods")
+	if !ok {
+		check.block("ill-formed Access-Control-Allow-Methods")
+	}
+	result.AllowMethods = methods
+	if ok && !corsSafeMethod(method) && !containsString(methods, method) {
+		if containsString(methods, "*") {
+			check.blockCredentials("method " + method + " is only allowed by a wildcard")
+		} else {
+			check.block("method " + method + " is not allowed")
+		}
+	}
+
+	allowed, ok := corsList(headers, "Access-Control-Allow-Headers")
+	if !ok {
+		check.block("ill-formed Access-Control-Allow-Headers")
+	}
+	result.AllowHeaders = allowed
+	if ok {
+		checkCORSHeaders(check, allowed, unsafe)
+	}
+
+	if seconds, err := strconv.ParseUint(headers.Get("Access-Control-Max-Age"), 10, 32); err == nil {
+		result.MaxAge = time.Duration(seconds) * time.Second
+	}
+
+	result.Problems = check.problems
+	result.Allowed = !check.blocked
+	result.AllowedWithCredentials = !check.blocked && !check.credentialless
+
+	return result
+}
+
+// checkCORSHeaders checks that each of the unsafe request headers is allowed.
+// A wildcard covers every header but Authorization, and only without
+// credentials.
+func checkCORSHeaders(check *corsCheck, allowed, unsafe []string) {
+	listed := make(map[string]bool, len(allowed))
+	for _, name := range allowed {
+		listed[strings.ToLower(name)] = true
+	}
+
+	for _, name := range unsafe {
+		switch {
+		case listed[name]:
+		case listed["*"] && name != "authorization":
+			check.blockCredentials("header " + name + " is only allowed by a wildcard")
+		default:
+			check.block("header " + name + " is not allowed")
+		}
+	}
+}
+
+// corsList parses the comma separated tokens of the named header, reporting
+// false when one of them is not a token
+func corsList(headers http.Header, name string) ([]string, bool) {
+	var list []string
+	for _, value := range headers[name] {
+		for _, item := range strings.Split(value, ",") {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			if !isToken(item) {
+				return nil, false
+			}
+
+			list = append(list, item)
+		}
+	}
+
+	return list, true
+}
+
+// unsafeCORSHeaders returns the lower-cased and sorted names of the headers
+// a browser asks the server about in a preflight
+func unsafeCORSHeaders(names []string) []string {
+	var unsafe []string
+	seen := map[string]bool{}
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || seen[name] || corsSafeHeader(name) {
+			continue
+		}
+
+		seen[name] = true
+		unsafe = append(unsafe, name)
+	}
+	sort.Strings(unsafe)
+
+	return unsafe
+}
+
+// corsSafeMethod reports whether browsers send method without a preflight
+func corsSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodPost
+}
+
+// corsSafeHeader reports whether browsers send the lower-cased header name
+// without a preflight. Content-Type is only safe with the values forms send,
+// so it is always asked about.
+func corsSafeHeader(name string) bool {
+	return name == "accept" || name == "accept-language" || name == "content-language"
+}
+
+// isToken reports whether s is an HTTP token, as header names and methods are
+func isToken(s string) bool {
+	for _, r := range s {
+		if r > 0x7e || r <= ' ' || strings.ContainsRune("\"(),/:;<=>?@[\\]{}", r) {
+			return false
+		}
+	}
+
+	return s != ""
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
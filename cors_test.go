@@ -0,0 +1,249 @@
+package heimdall
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const corsOrigin = "https://app.example.com"
+
+// preflightServer answers OPTIONS requests with headers
+func preflightServer(t *testing.T, status int, headers http.Header) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodOptions, r.Method)
+		for name, values := range headers {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(status)
+	}))
+}
+
+func TestCheckCORSSendsPreflight(t *testing.T) {
+	var seen http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header
+		assert.Equal(t, http.MethodOptions, r.Method)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+	client.AddRequestMutator(RequestMutatorFunc(func(request *http.Request) error {
+		request.Header.Set("Authorization", "Bearer ci")
+		return nil
+	}))
+
+	_, err := CheckCORS(context.Background(), client, server.URL, corsOrigin, http.MethodPut,
+		[]string{"X-Token", "Content-Type", "Accept", "x-token"})
+	require.NoError(t, err)
+
+	assert.Equal(t, corsOrigin, seen.Get("Origin"))
+	assert.Equal(t, http.MethodPut, seen.Get("Access-Control-Request-Method"))
+	assert.Equal(t, "content-type,x-token", seen.Get("Access-Control-Request-Headers"))
+	assert.Equal(t, "Bearer ci", seen.Get("Authorization"))
+}
+
+func TestCheckCORSPermissive(t *testing.T) {
+	server := preflightServer(t, http.StatusNoContent, http.Header{
+		"Access-Control-Allow-Origin":      {corsOrigin},
+		"Access-Control-Allow-Credentials": {"true"},
+		"Access-Control-Allow-Methods":     {"PUT, DELETE"},
+		"Access-Control-Allow-Headers":     {"X-Token", "Content-Type"},
+		"Access-Control-Max-Age":           {"600"},
+	})
+	defer server.Close()
+
+	result, err := CheckCORS(context.Background(), NewHTTPClient(1000), server.URL, corsOrigin, http.MethodPut, []string{"x-token", "content-type"})
+	require.NoError(t, err)
+
+	assert.True(t, result.Allowed)
+	assert.True(t, result.AllowedWithCredentials)
+	assert.Empty(t, result.Problems)
+	assert.Equal(t, []string{"PUT", "DELETE"}, result.AllowMethods)
+	assert.Equal(t, []string{"X-Token", "Content-Type"}, result.AllowHeaders)
+	assert.Equal(t, 10*time.Minute, result.MaxAge)
+	assert.Equal(t, http.StatusNoContent, result.Response.StatusCode())
+}
+
+func TestCheckCORSWildcards(t *testing.T) {
+	server := preflightServer(t, http.StatusOK, http.Header{
+		"Access-Control-Allow-Origin":      {"*"},
+		"Access-Control-Allow-Credentials": {"true"},
+		"Access-Control-Allow-Methods":     {"*"},
+		"Access-Control-Allow-Headers":     {"*"},
+	})
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+
+	result, err := CheckCORS(context.Background(), client, server.URL, corsOrigin, http.MethodPatch, []string{"X-Token"})
+	require.NoError(t, err)
+
+	assert.True(t, result.Allowed)
+	assert.False(t, result.AllowedWithCredentials)
+	assert.Equal(t, []string{
+		"with credentials: Access-Control-Allow-Origin is a wildcard",
+		"with credentials: method PATCH is only allowed by a wildcard",
+		"with credentials: header x-token is only allowed by a wildcard",
+	}, result.Problems)
+
+	result, err = CheckCORS(context.Background(), client, server.URL, corsOrigin, http.MethodGet, []string{"Authorization"})
+	require.NoError(t, err)
+
+	assert.False(t, result.Allowed, "a wildcard does not cover Authorization")
+	assert.Contains(t, result.Problems, "header authorization is not allowed")
+}
+
+func TestCheckCORSRestrictive(t *testing.T) {
+	cases := map[string]struct {
+		status  int
+		headers http.Header
+		method  string
+		request []string
+		problem string
+	}{
+		"other_origin": {
+			status:  http.StatusOK,
+			headers: http.Header{"Access-Control-Allow-Origin": {"https://admin.example.com"}},
+			method:  http.MethodGet,
+			problem: `Access-Control-Allow-Origin "https://admin.example.com" does not match "https://app.example.com"`,
+		},
+		"no_origin": {
+			status:  http.StatusOK,
+			headers: http.Header{"Access-Control-Allow-Methods": {"PUT"}},
+			method:  http.MethodPut,
+			problem: "no Access-Control-Allow-Origin",
+		},
+		"method": {
+			status:  http.StatusOK,
+			headers: http.Header{"Access-Control-Allow-Origin": {corsOrigin}, "Access-Control-Allow-Methods": {"PUT"}},
+			method:  http.MethodDelete,
+			problem: "method DELETE is not allowed",
+		},
+		"method_case": {
+			status:  http.StatusOK,
+			headers: http.Header{"Access-Control-Allow-Origin": {corsOrigin}, "Access-Control-Allow-Methods": {"patch"}},
+			method:  http.MethodPatch,
+			problem: "method PATCH is not allowed",
+		},
+		"header": {
+			status:  http.StatusOK,
+			headers: http.Header{"Access-Control-Allow-Origin": {corsOrigin}, "Access-Control-Allow-Headers": {"X-Token"}},
+			method:  http.MethodPost,
+			request: []string{"X-Token", "X-Tenant"},
+			problem: "header x-tenant is not allowed",
+		},
+		"status": {
+			status:  http.StatusForbidden,
+			headers: http.Header{"Access-Control-Allow-Origin": {corsOrigin}},
+			method:  http.MethodGet,
+			problem: "preflight answered with status 403",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			server := preflightServer(t, tc.status, tc.headers)
+			defer server.Close()
+
+			result, err := CheckCORS(context.Background(), NewHTTPClient(1000), server.URL, corsOrigin, tc.method, tc.request)
+			require.NoError(t, err)
+
+			assert.False(t, result.Allowed)
+			assert.False(t, result.AllowedWithCredentials)
+			assert.Contains(t, result.Problems, tc.problem)
+		})
+	}
+}
+
+func TestCheckCORSMalformed(t *testing.T) {
+	cases := map[string]struct {
+		headers http.Header
+		problem string
+	}{
+		"several_origins": {
+			headers: http.Header{"Access-Control-Allow-Origin": {corsOrigin, "https://admin.example.com"}},
+			problem: `ill-formed Access-Control-Allow-Origin "https://app.example.com, https://admin.example.com"`,
+		},
+		"origin_list": {
+			headers: http.Header{"Access-Control-Allow-Origin": {corsOrigin + ", https://admin.example.com"}},
+			problem: `ill-formed Access-Control-Allow-Origin "https://app.example.com, https://admin.example.com"`,
+		},
+		"methods": {
+			headers: http.Header{"Access-Control-Allow-Origin": {corsOrigin}, "Access-Control-Allow-Methods": {"PUT;DELETE"}},
+			problem: "ill-formed Access-Control-Allow-Methods",
+		},
+		"headers": {
+			headers: http.Header{"Access-Control-Allow-Origin": {corsOrigin}, "Access-Control-Allow-Headers": {"X Token"}},
+			problem: "ill-formed Access-Control-Allow-Headers",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			server := preflightServer(t, http.StatusOK, tc.headers)
+			defer server.Close()
+
+			result, err := CheckCORS(context.Background(), NewHTTPClient(1000), server.URL, corsOrigin, http.MethodPut, nil)
+			require.NoError(t, err)
+
+			assert.False(t, result.Allowed)
+			assert.Contains(t, result.Problems, tc.problem)
+		})
+	}
+}
+
+func TestCheckCORSIgnoresMalformedMaxAge(t *testing.T) {
+	server := preflightServer(t, http.StatusOK, http.Header{
+		"Access-Control-Allow-Origin": {corsOrigin},
+		"Access-Control-Max-Age":      {"ten minutes"},
+	})
+	defer server.Close()
+
+	result, err := CheckCORS(context.Background(), NewHTTPClient(1000), server.URL, corsOrigin, http.MethodGet, nil)
+	require.NoError(t, err)
+
+	assert.True(t, result.Allowed)
+	assert.Equal(t, time.Duration(0), result.MaxAge)
+}
+
+func TestCheckCORSRetriesPreflight(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", corsOrigin)
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+	client.SetRetryCount(1)
+
+	result, err := CheckCORS(context.Background(), client, server.URL, corsOrigin, http.MethodGet, nil)
+	require.NoError(t, err)
+
+	assert.True(t, result.Allowed)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestCheckCORSReturnsClientError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	result, err := CheckCORS(context.Background(), NewHTTPClient(1000), server.URL, corsOrigin, http.MethodGet, nil)
+
+	assert.Error(t, err)
+	assert.False(t, result.Allowed)
+	assert.Equal(t, http.StatusInternalServerError, result.Response.StatusCode())
+}
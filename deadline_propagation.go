@@ -0,0 +1,89 @@
+package heimdall
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DeadlineFormat is how WithDeadlinePropagation encodes the time left
+type DeadlineFormat int
+
+const (
+	// DeadlineMilliseconds encodes the time left as whole milliseconds, as in
+	// X-Request-Timeout: 1500
+	DeadlineMilliseconds DeadlineFormat = iota
+	// DeadlineGRPCTimeout encodes the time left as the grpc-timeout header
+	// does, at most eight digits followed by a unit, as in 1500m
+	DeadlineGRPCTimeout
+)
+
+// WithDeadlinePropagation tells servers how long they have to answer: when
+// the context of a request has a deadline, each attempt carries the time left
+// until it in the header named header, encoded in format. The time left is
+// computed just before the attempt is sent, so retries advertise what remains
+// of the budget. Requests without a deadline are sent without the header, and
+// a value set by the caller, a middleware or the raw request mutator is sent
+// as it is.
+func WithDeadlinePropagation(header string, format DeadlineFormat) Option {
+	return func(options *clientOptions) {
+		options.deadline = &deadlinePropagation{header: http.CanonicalHeaderKey(header), format: format}
+	}
+}
+
+type deadlinePropagation struct {
+	header string
+	format DeadlineFormat
+}
+
+// propagateDeadline sets the header of propagation on the attempts sent
+// through next, unless propagation is nil
+func propagateDeadline(next Doer, propagation *deadlinePropagation, clock Clock) Doer {
+	if propagation == nil {
+		return next
+	}
+
+	return DoerFunc(func(request *http.Request) (*http.Response, error) {
+		deadline, ok := request.Context().Deadline()
+		if !ok || request.Header.Get(propagation.header) != "" {
+			return next.Do(request)
+		}
+
+		// The request is shared by every attempt, so the header goes on a copy
+		attempt := *request
+		attempt.Header = copyHeader(request.Header)
+		attempt.Header.Set(propagation.header, propagation.format.encode(deadline.Sub(clock.Now())))
+
+		return next.Do(&attempt)
+	})
+}
+
+// grpcTimeoutUnits are the units of grpc-timeout, finest first
+var grpcTimeoutUnits = []struct {
+	unit     time.Duration
+	encoding string
+}{
+	{time.Nanosecond, "n"}, {time.Microsecond, "u"}, {time.Millisecond, "m"},
+	{time.Second, "S"}, {time.Minute, "M"}, {time.Hour, "H"},
+}
+
+// encode formats left, rounded down and never below zero
+func (format DeadlineFormat) encode(left time.Duration) string {
+	if left < 0 {
+		left = 0
+	}
+
+	if format != DeadlineGRPCTimeout {
+		return strconv.FormatInt(int64(left/time.Millisecond), 10)
+	}
+
+	// grpc-timeout allows at most eight digits, so the finest unit that fits
+	// is used
+	for _, unit := range grpcTimeoutUnits {
+		if value := int64(left / unit.unit); value <= 99999999 {
+			return strconv.FormatInt(value, 10) + unit.encoding
+		}
+	}
+
+	return "99999999H"
+}
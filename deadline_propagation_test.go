@@ -0,0 +1,104 @@
+package heimdall
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gojektech/heimdall/fakeclock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// deadlineServer records the header of every request, failing the first
+// failures with a 503
+func deadlineServer(header string, failures int) (*httptest.Server, func() []string) {
+	var mu sync.Mutex
+	var received []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		received = append(received, r.Header.Get(header))
+		if len(received) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+
+	return server, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), received...)
+	}
+}
+
+func TestClientsPropagateTheShrinkingDeadline(t *testing.T) {
+	formats := map[DeadlineFormat][]string{
+		DeadlineMilliseconds: {"2000", "2000", "1900", "1700"},
+		DeadlineGRPCTimeout:  {"2000000u", "2000000u", "1900000u", "1700000u"},
+	}
+	for kind, newClient := range retryClients {
+		for format, expected := range formats {
+			t.Run(kind+"/"+expected[0], func(t *testing.T) {
+				server, received := deadlineServer("X-Request-Timeout", 3)
+				defer server.Close()
+
+				clock := fakeclock.New(time.Now())
+				client := derive(newClient("deadline_propagation_"+kind, clock), WithDeadlinePropagation("x-request-timeout", format))
+				client.SetRetryCount(3)
+				client.SetRetrier(NewRetrier(NewLinearBackoff(100*time.Millisecond, time.Second)))
+
+				ctx, cancel := context.WithDeadline(context.Background(), clock.Now().Add(2*time.Second))
+				defer cancel()
+				request, err := http.NewRequest(http.MethodGet, server.URL, nil)
+				require.NoError(t, err)
+
+				_, err = client.Do(request.WithContext(ctx))
+				require.NoError(t, err)
+
+				assert.Equal(t, expected, received())
+				assert.Empty(t, request.Header.Get("X-Request-Timeout"), "the caller's request is left as it was")
+			})
+		}
+	}
+}
+
+func TestDeadlinePropagationLeavesOtherRequestsAlone(t *testing.T) {
+	server, received := deadlineServer("X-Request-Timeout", 0)
+	defer server.Close()
+
+	client := NewHTTPClient(1000, WithDeadlinePropagation("X-Request-Timeout", DeadlineMilliseconds))
+
+	_, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	request, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+	request.Header.Set("X-Request-Timeout", "250")
+
+	_, err = client.Do(request.WithContext(ctx))
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"", "250"}, received(), "no deadline sends no header, and the caller's value wins")
+}
+
+func TestGRPCTimeoutEncoding(t *testing.T) {
+	cases := map[time.Duration]string{
+		-time.Second:            "0n",
+		0:                       "0n",
+		99 * time.Millisecond:   "99000000n",
+		1500 * time.Millisecond: "1500000u",
+		3 * time.Minute:         "180000m",
+		30 * time.Hour:          "108000S",
+		50000 * time.Hour:       "3000000M",
+	}
+	for left, expected := range cases {
+		assert.Equal(t, expected, DeadlineGRPCTimeout.encode(left), "%v", left)
+	}
+	assert.Equal(t, "1499", DeadlineMilliseconds.encode(1499*time.Millisecond+999*time.Microsecond))
+}
@@ -0,0 +1,166 @@
+package heimdall
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Verdicts of DecisionRecord
+const (
+	// DecisionSucceeded ends the request with the response of the attempt
+	DecisionSucceeded = "succeeded"
+	// DecisionRetry sends another attempt after DecisionRecord.Backoff
+	DecisionRetry = "retry"
+	// DecisionExhausted gives up on the request, as the attempt failed and
+	// was the last one the retry count allowed
+	DecisionExhausted = "exhausted"
+	// DecisionBudgetExhausted gives up on the request, as the time left
+	// before its deadline is below the minimum attempt budget
+	DecisionBudgetExhausted = "budget_exhausted"
+	// DecisionRetryBudgetExhausted gives up on the request, as the attempt
+	// failed and the retry budget allows no more retries
+	DecisionRetryBudgetExhausted = "retry_budget_exhausted"
+	// DecisionAborted gives up on the request at once, for an error that is
+	// never retried, such as a forbidden host, a rate limit, a tenant quota
+	// or a panicking retrier
+	DecisionAborted = "aborted"
+	// DecisionCancelled gives up on the request, as its context is done
+	DecisionCancelled = "cancelled"
+	// DecisionShutdown gives up on the request, as Shutdown was called and
+	// the backoff before the next attempt would outlast its deadline
+	DecisionShutdown = "shutdown"
+)
+
+// DecisionRecord is the input and verdict of one retry decision, taken
+// after each attempt and whenever a request is given up before one. Its JSON
+// field names are stable.
+type DecisionRecord struct {
+	// RequestID is the ID of the request, as Response.RequestID
+	RequestID string    `json:"request_id"`
+	Method    string    `json:"method"`
+	Host      string    `json:"host"`
+	Time      time.Time `json:"time"`
+	// Attempt is the number of the attempt decided on, 0 for the first
+	Attempt int `json:"attempt"`
+	// StatusCode is the status the attempt got, 0 without a response
+	StatusCode int `json:"status_code,omitempty"`
+	// Class is the outcome of the attempt, such as OutcomeServerError
+	Class string `json:"class"`
+	// Error is the message of the error failing the attempt, if any
+	Error string `json:"error,omitempty"`
+	// Elapsed is the time since the request started
+	Elapsed Duration `json:"elapsed"`
+	// RetriesLeft is the number of retries the retry count still allows
+	RetriesLeft int `json:"retries_left"`
+	// BudgetLeft is the time left before the deadline of the request context,
+	// nil without a deadline
+	BudgetLeft *Duration `json:"budget_left,omitempty"`
+	// Verdict is the decision, such as DecisionRetry
+	Verdict string `json:"verdict"`
+	// Backoff is the wait before the next attempt, for DecisionRetry
+	Backoff Duration `json:"backoff,omitempty"`
+}
+
+// WithDecisionLog records every retry decision of the client in a ring
+// buffer of the last size records, returned by LastDecisions, and hands each
+// record to hook, if not nil, on the goroutine of the request. Panics of hook
+// are recovered and dropped. Clients made with Derive record into the same
+// log.
+func WithDecisionLog(size int, hook func(DecisionRecord)) Option {
+	return func(options *clientOptions) {
+		options.decisions = newDecisionLog(size, hook)
+	}
+}
+
+// decisionLog is the ring buffer of WithDecisionLog
+type decisionLog struct {
+	hook func(DecisionRecord)
+
+	mu      sync.Mutex
+	records []DecisionRecord
+	next    int
+	full    bool
+}
+
+func newDecisionLog(size int, hook func(DecisionRecord)) *decisionLog {
+	if size < 1 {
+		size = 1
+	}
+
+	return &decisionLog{hook: hook, records: make([]DecisionRecord, size)}
+}
+
+// decide records the verdict on attempt of request, started at start, which
+// ended with response and err, count being the retry count
+func (l *decisionLog) decide(request *http.Request, start, now time.Time, attempt, count int, response Response, err error, verdict string, backoff time.Duration) {
+	if l == nil {
+		return
+	}
+
+	record := DecisionRecord{
+		RequestID:   RequestIDFromContext(request.Context()),
+		Method:      request.Method,
+		Host:        request.URL.Host,
+		Time:        now,
+		Attempt:     attempt,
+		StatusCode:  response.statusCode,
+		Class:       outcomes[requestOutcome(response, err)],
+		Elapsed:     Duration(now.Sub(start)),
+		RetriesLeft: count - attempt,
+		Verdict:     verdict,
+		Backoff:     Duration(backoff),
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	if record.RetriesLeft < 0 {
+		record.RetriesLeft = 0
+	}
+	if deadline, ok := request.Context().Deadline(); ok {
+		left := Duration(deadline.Sub(now))
+		record.BudgetLeft = &left
+	}
+
+	l.mu.Lock()
+	l.records[l.next] = record
+	l.next = (l.next + 1) % len(l.records)
+	l.full = l.full || l.next == 0
+	l.mu.Unlock()
+
+	if l.hook != nil {
+		l.emit(record)
+	}
+}
+
+// emit hands record to the hook, dropping its panics
+func (l *decisionLog) emit(record DecisionRecord) {
+	defer func() { recover() }()
+
+	l.hook(record)
+}
+
+// last returns the last n records, oldest first
+func (l *decisionLog) last(n int) []DecisionRecord {
+	if l == nil || n <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	count := l.next
+	if l.full {
+		count = len(l.records)
+	}
+	if n > count {
+		n = count
+	}
+
+	records := make([]DecisionRecord, n)
+	for i := range records {
+		records[i] = l.records[(l.next-n+i+len(l.records))%len(l.records)]
+	}
+
+	return records
+}
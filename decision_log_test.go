@@ -0,0 +1,128 @@
+package heimdall
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gojektech/heimdall/fakeclock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// decisions returns the attempts, classes, verdicts and backoffs of records,
+// which are the inputs and outputs of the decisions the tests compare
+func decisions(records []DecisionRecord) []DecisionRecord {
+	kept := make([]DecisionRecord, len(records))
+	for i, record := range records {
+		kept[i] = DecisionRecord{
+			Attempt:     record.Attempt,
+			StatusCode:  record.StatusCode,
+			Class:       record.Class,
+			Elapsed:     record.Elapsed,
+			RetriesLeft: record.RetriesLeft,
+			BudgetLeft:  record.BudgetLeft,
+			Verdict:     record.Verdict,
+			Backoff:     record.Backoff,
+		}
+	}
+
+	return kept
+}
+
+func budgetLeft(d time.Duration) *Duration {
+	left := Duration(d)
+	return &left
+}
+
+func TestClientsRecordRetryDecisions(t *testing.T) {
+	for kind, newClient := range retryClients {
+		t.Run(kind, func(t *testing.T) {
+			clock := fakeclock.New(time.Now())
+			var hits int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				clock.Advance(250 * time.Millisecond)
+				if r.URL.Path == "/flaky" && atomic.AddInt32(&hits, 1) > 1 {
+					return
+				}
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}))
+			defer server.Close()
+
+			var emitted []DecisionRecord
+			client := derive(newClient("decision_log_"+kind, clock), WithDecisionLog(16, func(record DecisionRecord) {
+				emitted = append(emitted, record)
+			}))
+			client.SetRetryCount(5)
+			client.SetRetrier(NewRetrier(NewConstantBackoff(1000)))
+			client.SetMinAttemptBudget(1500 * time.Millisecond)
+
+			ctx, cancel := context.WithDeadline(context.Background(), clock.Now().Add(4*time.Second))
+			defer cancel()
+			request, err := http.NewRequest(http.MethodGet, server.URL+"/down", nil)
+			require.NoError(t, err)
+			_, err = client.Do(request.WithContext(ctx))
+			var done *ErrContextDone
+			require.True(t, errors.As(err, &done), "%v", err)
+			require.Equal(t, 4, done.Attempts)
+
+			assert.Equal(t, []DecisionRecord{
+				{Attempt: 0, StatusCode: 503, Class: OutcomeServerError, Elapsed: Duration(250 * time.Millisecond), RetriesLeft: 5, BudgetLeft: budgetLeft(3750 * time.Millisecond), Verdict: DecisionRetry},
+				{Attempt: 1, StatusCode: 503, Class: OutcomeServerError, Elapsed: Duration(500 * time.Millisecond), RetriesLeft: 4, BudgetLeft: budgetLeft(3500 * time.Millisecond), Verdict: DecisionRetry, Backoff: Duration(time.Second)},
+				{Attempt: 2, StatusCode: 503, Class: OutcomeServerError, Elapsed: Duration(1750 * time.Millisecond), RetriesLeft: 3, BudgetLeft: budgetLeft(2250 * time.Millisecond), Verdict: DecisionRetry, Backoff: Duration(750 * time.Millisecond)},
+				{Attempt: 3, StatusCode: 503, Class: OutcomeServerError, Elapsed: Duration(2750 * time.Millisecond), RetriesLeft: 2, BudgetLeft: budgetLeft(1250 * time.Millisecond), Verdict: DecisionBudgetExhausted},
+			}, decisions(client.LastDecisions(10)), "the backoff is cut to keep the minimum attempt budget, until even an immediate attempt would not have it")
+
+			client.SetRetryCount(1)
+			_, err = client.Get(server.URL+"/down", http.Header{})
+			require.Error(t, err)
+			_, err = client.Get(server.URL+"/flaky", http.Header{})
+			require.NoError(t, err)
+
+			assert.Equal(t, []DecisionRecord{
+				{Attempt: 0, StatusCode: 503, Class: OutcomeServerError, Elapsed: Duration(250 * time.Millisecond), RetriesLeft: 1, Verdict: DecisionRetry},
+				{Attempt: 1, StatusCode: 503, Class: OutcomeServerError, Elapsed: Duration(500 * time.Millisecond), Verdict: DecisionExhausted},
+				{Attempt: 0, StatusCode: 503, Class: OutcomeServerError, Elapsed: Duration(250 * time.Millisecond), RetriesLeft: 1, Verdict: DecisionRetry},
+				{Attempt: 1, StatusCode: 200, Class: OutcomeSuccess, Elapsed: Duration(500 * time.Millisecond), Verdict: DecisionSucceeded},
+			}, decisions(client.LastDecisions(4)))
+
+			all := client.LastDecisions(100)
+			require.Len(t, all, 8)
+			assert.Equal(t, emitted, all, "the hook sees every record")
+			assert.Equal(t, http.MethodGet, all[7].Method)
+			assert.Equal(t, request.URL.Host, all[7].Host)
+			assert.NotEmpty(t, all[7].RequestID)
+			assert.Equal(t, all[6].RequestID, all[7].RequestID, "records of a request share its ID")
+			assert.NotEqual(t, all[5].RequestID, all[6].RequestID)
+		})
+	}
+}
+
+func TestDecisionLogIsBounded(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	client := NewHTTPClient(1000, WithDecisionLog(3, func(DecisionRecord) { panic("hook") }))
+	for i := 0; i < 5; i++ {
+		_, err := client.Get(server.URL, http.Header{})
+		require.NoError(t, err, "panics of the hook are dropped")
+	}
+
+	records := client.LastDecisions(10)
+	require.Len(t, records, 3, "only the last records are kept")
+	assert.False(t, records[0].Time.After(records[2].Time), "oldest first")
+	assert.Len(t, client.LastDecisions(2), 2)
+	assert.Equal(t, records[1:], client.LastDecisions(2))
+
+	encoded, err := json.Marshal(records[0])
+	require.NoError(t, err)
+	assert.Contains(t, string(encoded), `"verdict":"succeeded"`)
+	assert.Contains(t, string(encoded), `"class":"success"`)
+
+	assert.Nil(t, NewHTTPClient(1000).LastDecisions(10), "the log is opt-in")
+}
@@ -0,0 +1,175 @@
+package heimdall
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxDeduplicationKeys bounds the keys a client remembers. Past it, the
+// oldest key is forgotten before its window ends.
+const maxDeduplicationKeys = 4096
+
+// ErrDuplicateRequest is returned, without the request being sent, for a
+// request with the key of one sent within the window of WithDuplicateRejection
+type ErrDuplicateRequest struct {
+	Key string
+	// Since is how long before the request the first one was sent
+	Since time.Duration
+}
+
+func (e *ErrDuplicateRequest) Error() string {
+	return fmt.Sprintf("duplicate of a request sent %s before", e.Since)
+}
+
+// WithDeduplication sends only the first of the requests with the same key
+// sent within window of each other, such as a form submitted twice. The
+// others wait for the first and share its response, or its error, without
+// being sent; a duplicate whose own context is done first returns with the
+// error of its context. keyFunc returns the key of a copy of a request, or
+// false for requests not to deduplicate. With a nil keyFunc, POST and PATCH
+// requests are deduplicated by their method, URL and a hash of their body.
+// Keys are forgotten once their window ends, and at most 4096 are
+// remembered, the oldest being forgotten early past that. Clients made with
+// Derive remember keys of their own.
+func WithDeduplication(window time.Duration, keyFunc func(*http.Request) (string, bool)) Option {
+	return func(options *clientOptions) {
+		options.dedup = newDedupGroup(window, keyFunc, false)
+	}
+}
+
+// WithDuplicateRejection is WithDeduplication failing duplicates fast with an
+// *ErrDuplicateRequest instead of sharing the response of the first request
+func WithDuplicateRejection(window time.Duration, keyFunc func(*http.Request) (string, bool)) Option {
+	return func(options *clientOptions) {
+		options.dedup = newDedupGroup(window, keyFunc, true)
+	}
+}
+
+// dedupGroup remembers the requests sent within its window by key
+type dedupGroup struct {
+	window  time.Duration
+	keyFunc func(*http.Request) (string, bool)
+	reject  bool
+
+	mu      sync.Mutex
+	entries map[string]*dedupEntry
+	// order holds the entries oldest first, which is the order their windows
+	// end in
+	order []*dedupEntry
+}
+
+type dedupEntry struct {
+	key     string
+	started time.Time
+
+	done     chan struct{}
+	response Response
+	err      error
+}
+
+func newDedupGroup(window time.Duration, keyFunc func(*http.Request) (string, bool), reject bool) *dedupGroup {
+	return &dedupGroup{window: window, keyFunc: keyFunc, reject: reject, entries: map[string]*dedupEntry{}}
+}
+
+// fresh returns an empty group with the settings of g, for a derived client
+func (g *dedupGroup) fresh() *dedupGroup {
+	return newDedupGroup(g.window, g.keyFunc, g.reject)
+}
+
+// do sends request through flights and send, unless a request with its key
+// was sent within the window, in which case it shares the outcome of that
+// request or fails with an *ErrDuplicateRequest. A nil group sends every
+// request.
+func (g *dedupGroup) do(request *http.Request, clock Clock, flights *flightGroup, send func(*http.Request) (Response, error)) (Response, error) {
+	if g == nil {
+		return flights.do(request, send)
+	}
+	key, ok := g.key(request)
+	if !ok {
+		return flights.do(request, send)
+	}
+
+	now := clock.Now()
+	g.mu.Lock()
+	g.evict(now)
+	if first, ok := g.entries[key]; ok {
+		g.mu.Unlock()
+
+		if g.reject {
+			return Response{}, &ErrDuplicateRequest{Key: key, Since: now.Sub(first.started)}
+		}
+		select {
+		case <-first.done:
+			return first.response.clone(), first.err
+		case <-request.Context().Done():
+			return Response{}, request.Context().Err()
+		}
+	}
+
+	entry := &dedupEntry{key: key, started: now, done: make(chan struct{})}
+	if len(g.order) >= maxDeduplicationKeys {
+		g.forget(g.order[0])
+		g.order = g.order[1:]
+	}
+	g.entries[key] = entry
+	g.order = append(g.order, entry)
+	g.mu.Unlock()
+
+	entry.response, entry.err = flights.do(request, send)
+	close(entry.done)
+
+	return entry.response.clone(), entry.err
+}
+
+// evict forgets the entries whose window ended by now
+func (g *dedupGroup) evict(now time.Time) {
+	expired := 0
+	for _, entry := range g.order {
+		if now.Sub(entry.started) < g.window {
+			break
+		}
+		g.forget(entry)
+		expired++
+	}
+	if expired > 0 {
+		g.order = append(g.order[:0:0], g.order[expired:]...)
+	}
+}
+
+// forget removes entry from the entries of g, unless a later request with its
+// key took its place
+func (g *dedupGroup) forget(entry *dedupEntry) {
+	if g.entries[entry.key] == entry {
+		delete(g.entries, entry.key)
+	}
+}
+
+// key returns the key of request by the keyFunc of g, which is given a copy
+// of request, or by defaultDedupKey without one
+func (g *dedupGroup) key(request *http.Request) (string, bool) {
+	if g.keyFunc == nil {
+		return defaultDedupKey(request)
+	}
+
+	return g.keyFunc(hookCopy(request))
+}
+
+// defaultDedupKey keys POST and PATCH requests by their method, URL and a
+// hash of their body
+func defaultDedupKey(request *http.Request) (string, bool) {
+	if request.Method != http.MethodPost && request.Method != http.MethodPatch {
+		return "", false
+	}
+
+	body, err := requestBody(request)
+	if err != nil {
+		return "", false
+	}
+	sum := sha256.Sum256(body)
+
+	return request.Method + "\n" + request.URL.String() + "\n" + hex.EncodeToString(sum[:]), true
+}
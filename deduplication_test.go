@@ -0,0 +1,172 @@
+package heimdall
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gojektech/heimdall/fakeclock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mutationServer answers requests after delay with the number of requests it
+// handled so far, counting them into hits
+func mutationServer(delay time.Duration, hits *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(hits, 1)
+		ioutil.ReadAll(r.Body)
+		time.Sleep(delay)
+		fmt.Fprintf(w, "order %d", n)
+	}))
+}
+
+func TestDeduplicationSharesTheFirstResponse(t *testing.T) {
+	for name, newClient := range map[string]func(opts ...Option) testClient{
+		"http": func(opts ...Option) testClient { return NewHTTPClient(1000, opts...) },
+		"hystrix": func(opts ...Option) testClient {
+			return NewHystrixHTTPClient(1000, NewHystrixConfig("dedup_command", HystrixCommandConfig{Timeout: 1000, MaxConcurrentRequests: 100}), opts...)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var hits int32
+			server := mutationServer(200*time.Millisecond, &hits)
+			defer server.Close()
+
+			client := newClient(WithDeduplication(time.Second, nil))
+			responses := make([]Response, 2)
+			errs := make([]error, 2)
+			var wg sync.WaitGroup
+			for i := range responses {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					responses[i], errs[i] = client.Post(server.URL, bytes.NewReader([]byte(`{ "order": 1 }`)), http.Header{})
+				}(i)
+				time.Sleep(50 * time.Millisecond)
+			}
+			wg.Wait()
+
+			assert.Equal(t, int32(1), atomic.LoadInt32(&hits), "the handler runs once")
+			for i := range responses {
+				require.NoError(t, errs[i])
+				assert.Equal(t, "order 1", string(responses[i].Body()))
+			}
+		})
+	}
+}
+
+func TestDeduplicationWindow(t *testing.T) {
+	var hits int32
+	server := mutationServer(0, &hits)
+	defer server.Close()
+
+	clock := fakeclock.New(time.Now())
+	client := NewHTTPClient(1000, WithClock(clock), WithDeduplication(500*time.Millisecond, nil))
+	post := func(body string) string {
+		response, err := client.Post(server.URL, bytes.NewReader([]byte(body)), http.Header{})
+		require.NoError(t, err)
+		return string(response.Body())
+	}
+
+	assert.Equal(t, "order 1", post(`{ "a": 1 }`))
+	clock.Advance(300 * time.Millisecond)
+	assert.Equal(t, "order 1", post(`{ "a": 1 }`), "duplicates sent after the first completed share its response")
+	assert.Equal(t, "order 2", post(`{ "a": 2 }`), "requests with other bodies are sent")
+
+	clock.Advance(200 * time.Millisecond)
+	assert.Equal(t, "order 3", post(`{ "a": 1 }`), "requests past the window are sent")
+	assert.Equal(t, "order 2", post(`{ "a": 2 }`))
+
+	response, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, "order 4", string(response.Body()), "GET requests are not deduplicated by default")
+	response, err = client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, "order 5", string(response.Body()))
+}
+
+func TestDuplicateRejection(t *testing.T) {
+	var hits int32
+	server := mutationServer(0, &hits)
+	defer server.Close()
+
+	clock := fakeclock.New(time.Now())
+	byIdempotencyKey := func(request *http.Request) (string, bool) {
+		key := request.Header.Get("Idempotency-Key")
+		return key, key != ""
+	}
+	client := NewHTTPClient(1000, WithClock(clock), WithDuplicateRejection(time.Second, byIdempotencyKey))
+
+	_, err := client.Post(server.URL, bytes.NewReader([]byte("a")), http.Header{"Idempotency-Key": {"k1"}})
+	require.NoError(t, err)
+
+	clock.Advance(100 * time.Millisecond)
+	_, err = client.Post(server.URL, bytes.NewReader([]byte("b")), http.Header{"Idempotency-Key": {"k1"}})
+	var duplicate *ErrDuplicateRequest
+	require.True(t, errors.As(err, &duplicate), "%v", err)
+	assert.Equal(t, "k1", duplicate.Key)
+	assert.Equal(t, 100*time.Millisecond, duplicate.Since)
+	assert.EqualError(t, err, "duplicate of a request sent 100ms before")
+
+	_, err = client.Post(server.URL, bytes.NewReader([]byte("a")), http.Header{})
+	require.NoError(t, err, "requests keyFunc skips are sent")
+	_, err = client.Post(server.URL, bytes.NewReader([]byte("a")), http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&hits))
+
+	_, err = client.Derive().Post(server.URL, bytes.NewReader([]byte("a")), http.Header{"Idempotency-Key": {"k1"}})
+	assert.NoError(t, err, "derived clients remember keys of their own")
+}
+
+func TestDuplicatesStopWaitingWithTheirContext(t *testing.T) {
+	var hits int32
+	server := mutationServer(time.Second, &hits)
+	defer server.Close()
+
+	client := NewHTTPClient(5000, WithDeduplication(time.Minute, nil))
+	go client.Post(server.URL, bytes.NewReader([]byte("a")), http.Header{})
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&hits) == 1 }, time.Second, time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	request, err := http.NewRequest(http.MethodPost, server.URL, bytes.NewReader([]byte("a")))
+	require.NoError(t, err)
+
+	start := time.Now()
+	_, err = client.Do(request.WithContext(ctx))
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "%v", err)
+	assert.Less(t, int64(time.Since(start)), int64(500*time.Millisecond))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits))
+}
+
+func TestDeduplicationKeysAreBounded(t *testing.T) {
+	clock := fakeclock.New(time.Now())
+	group := newDedupGroup(time.Second, func(request *http.Request) (string, bool) {
+		return request.URL.Path, true
+	}, false)
+	send := func(*http.Request) (Response, error) { return Response{}, nil }
+
+	for i := 0; i < maxDeduplicationKeys+10; i++ {
+		request, _ := http.NewRequest(http.MethodPost, fmt.Sprintf("http://localhost/%d", i), nil)
+		_, err := group.do(request, clock, nil, send)
+		require.NoError(t, err)
+	}
+	assert.Len(t, group.entries, maxDeduplicationKeys)
+	assert.Len(t, group.order, maxDeduplicationKeys)
+
+	clock.Advance(time.Second)
+	request, _ := http.NewRequest(http.MethodPost, "http://localhost/last", nil)
+	_, err := group.do(request, clock, nil, send)
+	require.NoError(t, err)
+	assert.Len(t, group.entries, 1, "keys are forgotten once their window ends")
+	assert.Len(t, group.order, 1)
+}
@@ -0,0 +1,121 @@
+package heimdall
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults of the client Do sends through until SetDefaultClient is called
+const (
+	defaultRequestTimeout = 30 * time.Second
+	defaultInitialBackoff = 100 * time.Millisecond
+	defaultMaxBackoff     = 2 * time.Second
+)
+
+// Request is a request sent with Do
+type Request struct {
+	// Method is the method of the request, GET when empty
+	Method string
+	URL    string
+	// Body is sent as the request body when not nil. Retries resend it only
+	// when it is a *bytes.Reader, *bytes.Buffer or *strings.Reader.
+	Body    io.Reader
+	Headers http.Header
+	// Timeout bounds the request, retries and waits between them included,
+	// and is 30 seconds when zero
+	Timeout time.Duration
+	// Retries is the number of times the request is retried, in place of the
+	// retry count of the default client, when above 0
+	Retries int
+}
+
+// sharedClient holds the client Do sends through
+type sharedClient struct {
+	client Client
+}
+
+var (
+	defaultClientMu sync.Mutex
+	defaultClient   atomic.Pointer[sharedClient]
+)
+
+// newDefaultClient returns the client Do sends through unless
+// SetDefaultClient gave another: an HTTP client keeping connections alive
+// over the transport of NewHTTPClient, bounded by the timeout of each
+// request rather than one of its own, and retrying with exponential backoff
+// from 100ms to 2s
+func newDefaultClient() Client {
+	client := NewHTTPClient(0)
+	client.SetRetrier(NewRetrier(NewExponentialBackoff(defaultInitialBackoff, defaultMaxBackoff, defaultExponentFactor)))
+
+	return client
+}
+
+// DefaultClient returns the client Do sends through, building the default
+// one on first use. Concurrent first uses build it once.
+func DefaultClient() Client {
+	if shared := defaultClient.Load(); shared != nil {
+		return shared.client
+	}
+
+	defaultClientMu.Lock()
+	defer defaultClientMu.Unlock()
+
+	if shared := defaultClient.Load(); shared != nil {
+		return shared.client
+	}
+	shared := &sharedClient{client: newDefaultClient()}
+	defaultClient.Store(shared)
+
+	return shared.client
+}
+
+// SetDefaultClient makes Do send through c from now on, such as a client
+// with the settings of a service or a stub in tests. Requests already sent
+// complete through the client they started with. A nil c restores the
+// default client, built again on next use.
+func SetDefaultClient(c Client) {
+	defaultClientMu.Lock()
+	defer defaultClientMu.Unlock()
+
+	if c == nil {
+		defaultClient.Store(nil)
+		return
+	}
+	defaultClient.Store(&sharedClient{client: c})
+}
+
+// Do sends request with ctx through the default client, for callers such as
+// serverless functions that send a few requests and want no client of their
+// own. Its errors are those of the client, such as a *RetriesExhaustedError
+// once every retry failed or an *ErrInvalidMethod before anything is sent.
+func Do(ctx context.Context, request Request) (Response, error) {
+	method := request.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	httpRequest, err := newMethodRequest(method, request.URL, request.Body)
+	if err != nil {
+		return Response{}, err
+	}
+	if request.Headers != nil {
+		httpRequest.Header = request.Headers
+	}
+
+	timeout := request.Timeout
+	if timeout <= 0 {
+		timeout = defaultRequestTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if request.Retries > 0 {
+		ctx = context.WithValue(ctx, retryCountKey{}, request.Retries)
+	}
+
+	return SendRequest(DefaultClient(), httpRequest.WithContext(ctx))
+}
@@ -0,0 +1,165 @@
+package heimdall
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// cleanDefaultClient restores the default client before and after the test
+func cleanDefaultClient(t *testing.T) {
+	SetDefaultClient(nil)
+	t.Cleanup(func() { SetDefaultClient(nil) })
+}
+
+func TestDefaultClientIsBuiltOnceForConcurrentFirstUses(t *testing.T) {
+	cleanDefaultClient(t)
+
+	clients := make([]Client, 50)
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := range clients {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			clients[i] = DefaultClient()
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	for _, c := range clients {
+		assert.Same(t, clients[0], c)
+	}
+	assert.Same(t, clients[0], DefaultClient(), "later uses keep the client")
+
+	SetDefaultClient(nil)
+	assert.NotSame(t, clients[0], DefaultClient(), "restoring the default builds it again")
+}
+
+func TestDoSendsTheRequestOptions(t *testing.T) {
+	cleanDefaultClient(t)
+
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write([]byte(r.Method + " " + r.Header.Get("X-Trace") + " " + string(body)))
+	}))
+	defer server.Close()
+
+	response, err := Do(context.Background(), Request{
+		Method:  http.MethodPut,
+		URL:     server.URL,
+		Body:    strings.NewReader("payload"),
+		Headers: http.Header{"X-Trace": {"abc"}},
+		Retries: 2,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "PUT abc payload", string(response.Body()))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&hits), "the request is retried as asked")
+
+	atomic.StoreInt32(&hits, 0)
+	response, err = Do(context.Background(), Request{URL: server.URL})
+	var exhausted *RetriesExhaustedError
+	require.True(t, errors.As(err, &exhausted), "without retries the first failure is returned: %v", err)
+	assert.Equal(t, 1, exhausted.Attempts)
+	assert.Equal(t, http.StatusServiceUnavailable, response.StatusCode())
+
+	_, err = Do(context.Background(), Request{Method: "GET FILE", URL: server.URL})
+	var invalid *ErrInvalidMethod
+	assert.True(t, errors.As(err, &invalid), "%v", err)
+}
+
+func TestDoTimesOutTheRequest(t *testing.T) {
+	cleanDefaultClient(t)
+
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	start := time.Now()
+	_, err := Do(context.Background(), Request{URL: server.URL, Timeout: 50 * time.Millisecond})
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "%v", err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestSetDefaultClientLeavesRequestsInFlight(t *testing.T) {
+	cleanDefaultClient(t)
+
+	arrived := make(chan struct{})
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Client") == "first" {
+			close(arrived)
+			<-release
+		}
+		w.Write([]byte(r.Header.Get("X-Client")))
+	}))
+	defer server.Close()
+
+	SetDefaultClient(NewHTTPClient(1000).With(Header("X-Client", "first")))
+
+	done := make(chan string)
+	go func() {
+		response, err := Do(context.Background(), Request{URL: server.URL})
+		assert.NoError(t, err)
+		done <- string(response.Body())
+	}()
+	<-arrived
+
+	SetDefaultClient(NewHTTPClient(1000).With(Header("X-Client", "second")))
+	response, err := Do(context.Background(), Request{URL: server.URL})
+	require.NoError(t, err)
+	assert.Equal(t, "second", string(response.Body()), "new requests go through the new client")
+
+	close(release)
+	assert.Equal(t, "first", <-done, "the request in flight completes through its client")
+}
+
+func TestSetDefaultClientRacesWithDo(t *testing.T) {
+	cleanDefaultClient(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	clients := []Client{NewHTTPClient(1000), NewHTTPClient(1000)}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				_, err := Do(context.Background(), Request{URL: server.URL})
+				assert.NoError(t, err)
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				SetDefaultClient(clients[(i+j)%len(clients)])
+			}
+		}(i)
+	}
+	wg.Wait()
+}
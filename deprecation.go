@@ -0,0 +1,189 @@
+package heimdall
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxDeprecatedURLs bounds the URLs a deprecation log remembers reporting.
+// Past it, those reported longer than the interval ago are forgotten.
+const maxDeprecatedURLs = 1024
+
+// DeprecationInfo describes the Deprecation and Sunset headers of a response,
+// as defined by RFC 9745 and RFC 8594
+type DeprecationInfo struct {
+	// Deprecated reports whether the response carried a Deprecation header
+	// other than false
+	Deprecated bool
+	// DeprecatedAt is the date of the Deprecation header, zero for the
+	// boolean form `Deprecation: true`. It may be in the future.
+	DeprecatedAt time.Time
+	// Sunset is the date of the Sunset header, after which the resource is
+	// expected to stop responding. It is zero without one, or when its date
+	// does not parse.
+	Sunset time.Time
+	// Successor is the link of rel successor-version of the Link header, if
+	// any, resolved against the request URL
+	Successor string
+	// StatusCode is the status of the response
+	StatusCode int
+}
+
+// deprecationLog reports deprecated URLs to a hook, each at most once an
+// interval of the clock
+type deprecationLog struct {
+	interval time.Duration
+	hook     func(url string, info DeprecationInfo)
+
+	mu       sync.Mutex
+	reported map[string]time.Time
+}
+
+// newDeprecationLog returns nil, reporting nothing, when hook is nil
+func newDeprecationLog(interval time.Duration, hook func(url string, info DeprecationInfo)) *deprecationLog {
+	if hook == nil {
+		return nil
+	}
+
+	return &deprecationLog{interval: interval, hook: hook, reported: map[string]time.Time{}}
+}
+
+// clone returns a log with the settings of l and reports of its own
+func (l *deprecationLog) clone() *deprecationLog {
+	if l == nil {
+		return nil
+	}
+
+	return newDeprecationLog(l.interval, l.hook)
+}
+
+// observe counts response into metrics when it carries a Deprecation or
+// Sunset header, and reports it unless its URL was reported within the
+// interval, returning an *ErrCallbackPanic in place of err when the hook
+// panics
+func (l *deprecationLog) observe(request *http.Request, response Response, err error, now time.Time, metrics *expvarMetrics) error {
+	if response.statusCode == 0 {
+		return err
+	}
+	info, ok := parseDeprecation(response.headers, request.URL)
+	if !ok {
+		return err
+	}
+	info.StatusCode = response.statusCode
+	metrics.deprecated(request.URL.Host)
+
+	if l == nil {
+		return err
+	}
+	endpoint := deprecatedURL(request.URL)
+	if !l.allow(endpoint, now) {
+		return err
+	}
+	if hookErr := l.report(endpoint, info); hookErr != nil {
+		return hookErr
+	}
+
+	return err
+}
+
+func (l *deprecationLog) report(endpoint string, info DeprecationInfo) (err error) {
+	defer recoverCallback("deprecation hook", &err)
+
+	l.hook(endpoint, info)
+	return nil
+}
+
+// allow records a report of endpoint at now, reporting false when it was
+// reported less than the interval before
+func (l *deprecationLog) allow(endpoint string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if last, ok := l.reported[endpoint]; ok && now.Sub(last) < l.interval {
+		return false
+	}
+	if len(l.reported) >= maxDeprecatedURLs {
+		for reported, last := range l.reported {
+			if now.Sub(last) >= l.interval {
+				delete(l.reported, reported)
+			}
+		}
+	}
+	if len(l.reported) < maxDeprecatedURLs {
+		l.reported[endpoint] = now
+	}
+
+	return true
+}
+
+// deprecatedURL is the URL deprecations of requests to u are reported under:
+// its scheme, host and path, as query strings usually vary between requests
+// to the same endpoint
+func deprecatedURL(u *url.URL) string {
+	endpoint := url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path, RawPath: u.RawPath}
+	return endpoint.String()
+}
+
+// parseDeprecation reads the Deprecation, Sunset and Link headers of a
+// response to a request to u, reporting false when it is neither deprecated
+// nor sunset. Dates that do not parse are left zero.
+func parseDeprecation(header http.Header, u *url.URL) (DeprecationInfo, bool) {
+	var info DeprecationInfo
+	if value := strings.TrimSpace(header.Get("Deprecation")); value != "" && !strings.EqualFold(value, "false") {
+		info.Deprecated = true
+		info.DeprecatedAt = parseDeprecationDate(value)
+	}
+	sunset := strings.TrimSpace(header.Get("Sunset"))
+	if sunset != "" {
+		info.Sunset, _ = http.ParseTime(sunset)
+	}
+	if !info.Deprecated && sunset == "" {
+		return DeprecationInfo{}, false
+	}
+
+	info.Successor = linkWithRel(header.Values("Link"), "successor-version", u)
+	return info, true
+}
+
+// parseDeprecationDate parses the date of a Deprecation header, either the
+// structured `@1688169599` of RFC 9745 or the HTTP date of earlier drafts
+func parseDeprecationDate(value string) time.Time {
+	if strings.HasPrefix(value, "@") {
+		seconds, err := strconv.ParseInt(value[1:], 10, 64)
+		if err != nil {
+			return time.Time{}
+		}
+		return time.Unix(seconds, 0).UTC()
+	}
+
+	date, _ := http.ParseTime(value)
+	return date
+}
+
+// linkWithRel returns the target of the first link of the Link headers
+// links with rel among its relation types, resolved against base
+func linkWithRel(links []string, rel string, base *url.URL) string {
+	for _, header := range links {
+		for _, link := range splitLinks(header) {
+			target, params := parseLink(link)
+			if target == "" {
+				continue
+			}
+
+			for _, relation := range strings.Fields(params["rel"]) {
+				if strings.EqualFold(relation, rel) {
+					if parsed, err := url.Parse(target); err == nil {
+						return base.ResolveReference(parsed).String()
+					}
+					return target
+				}
+			}
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,159 @@
+package heimdall
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gojektech/heimdall/fakeclock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// deprecatedServer answers requests with the headers of the query parameter
+// named after them
+func deprecatedServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, name := range []string{"Deprecation", "Sunset", "Link"} {
+			if value := r.URL.Query().Get(strings.ToLower(name)); value != "" {
+				w.Header().Set(name, value)
+			}
+		}
+	}))
+}
+
+// deprecationReports records the reports of a deprecation hook
+type deprecationReports struct {
+	mu      sync.Mutex
+	urls    []string
+	reports []DeprecationInfo
+}
+
+func (r *deprecationReports) hook(url string, info DeprecationInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.urls = append(r.urls, url)
+	r.reports = append(r.reports, info)
+}
+
+func TestDeprecationHeadersAreParsed(t *testing.T) {
+	server := deprecatedServer()
+	defer server.Close()
+
+	sunset := time.Date(2026, time.December, 31, 23, 59, 59, 0, time.UTC)
+	deprecatedAt := time.Date(2023, time.June, 30, 23, 59, 59, 0, time.UTC)
+
+	for name, tc := range map[string]struct {
+		query    string
+		reported bool
+		info     DeprecationInfo
+	}{
+		"boolean": {query: "deprecation=true", reported: true, info: DeprecationInfo{Deprecated: true}},
+		"structured date": {
+			query:    "deprecation=@1688169599",
+			reported: true,
+			info:     DeprecationInfo{Deprecated: true, DeprecatedAt: deprecatedAt},
+		},
+		"http date": {
+			query:    "deprecation=" + url.QueryEscape(deprecatedAt.Format(http.TimeFormat)),
+			reported: true,
+			info:     DeprecationInfo{Deprecated: true, DeprecatedAt: deprecatedAt},
+		},
+		"unparsed date": {query: "deprecation=soon", reported: true, info: DeprecationInfo{Deprecated: true}},
+		"sunset": {
+			query:    "sunset=" + url.QueryEscape(sunset.Format(http.TimeFormat)),
+			reported: true,
+			info:     DeprecationInfo{Sunset: sunset},
+		},
+		"unparsed sunset": {query: "sunset=never", reported: true},
+		"successor": {
+			query:    "deprecation=true&link=" + url.QueryEscape(`</docs>; rel="deprecation", </v2/items>; rel="successor-version latest-version"`),
+			reported: true,
+			info:     DeprecationInfo{Deprecated: true, Successor: server.URL + "/v2/items"},
+		},
+		"not deprecated": {query: "deprecation=false"},
+		"no headers":     {query: "link=" + url.QueryEscape(`</v2>; rel="successor-version"`)},
+	} {
+		for kind, newClient := range retryClients {
+			reports := &deprecationReports{}
+			client := newClient("deprecation_"+kind, realClock{})
+			client.SetDeprecationHook(0, reports.hook)
+
+			_, err := client.Get(server.URL+"/v1/items?"+tc.query, http.Header{})
+			require.NoError(t, err, name)
+
+			if !tc.reported {
+				assert.Empty(t, reports.reports, "%s through %s", name, kind)
+				continue
+			}
+			require.Len(t, reports.reports, 1, "%s through %s", name, kind)
+			tc.info.StatusCode = http.StatusOK
+			assert.Equal(t, tc.info, reports.reports[0], "%s through %s", name, kind)
+			assert.Equal(t, server.URL+"/v1/items", reports.urls[0], "%s through %s", name, kind)
+		}
+	}
+}
+
+func TestDeprecationHookIsRateLimitedByURL(t *testing.T) {
+	server := deprecatedServer()
+	defer server.Close()
+
+	clock := fakeclock.New(time.Now())
+	client := NewHTTPClient(1000, WithClock(clock))
+	client.EnableExpvar("heimdall_deprecation_test")
+	reports := &deprecationReports{}
+	client.SetDeprecationHook(time.Hour, reports.hook)
+
+	get := func(path string) {
+		_, err := client.Get(server.URL+path, http.Header{})
+		require.NoError(t, err)
+	}
+	for i := 0; i < 5; i++ {
+		get("/v1/items?deprecation=true&page=" + string(rune('a'+i)))
+	}
+	get("/v1/orders?deprecation=true")
+	get("/v1/orders?deprecation=true")
+	assert.Equal(t, []string{server.URL + "/v1/items", server.URL + "/v1/orders"}, reports.urls, "each URL is reported once an interval")
+
+	clock.Advance(59 * time.Minute)
+	get("/v1/items?deprecation=true")
+	assert.Len(t, reports.urls, 2)
+
+	clock.Advance(time.Minute)
+	get("/v1/items?deprecation=true")
+	assert.Equal(t, []string{server.URL + "/v1/items", server.URL + "/v1/orders", server.URL + "/v1/items"}, reports.urls, "URLs are reported again once the interval passed")
+
+	derived := client.Derive()
+	_, err := derived.Get(server.URL+"/v1/orders?sunset=never", http.Header{})
+	require.NoError(t, err)
+	assert.Len(t, reports.urls, 4, "derived clients limit their reports on their own")
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	counted := expvar.Get("heimdall_deprecation_test.deprecated_responses").(*expvar.Map).Get(host)
+	require.NotNil(t, counted)
+	assert.Equal(t, "10", counted.String(), "every deprecated response is counted")
+}
+
+func TestDeprecationHookPanicsFailTheRequest(t *testing.T) {
+	server := deprecatedServer()
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+	client.SetDeprecationHook(0, func(url string, info DeprecationInfo) {
+		panic("hook broke")
+	})
+
+	_, err := client.Get(server.URL+"?deprecation=true", http.Header{})
+	var panicked *ErrCallbackPanic
+	require.ErrorAs(t, err, &panicked)
+
+	client.SetDeprecationHook(0, nil)
+	_, err = client.Get(server.URL+"?deprecation=true", http.Header{})
+	assert.NoError(t, err)
+}
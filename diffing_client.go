@@ -0,0 +1,400 @@
+package heimdall
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultDiffQueueSize int = 64
+	defaultDiffWorkers   int = 4
+)
+
+// OnDiffFunc is called with the stable and shadow responses of a sampled
+// request whose status codes or bodies differ, and a line per difference
+type OnDiffFunc func(url string, stable, shadow Response, diff string)
+
+type diffJob struct {
+	url     string
+	headers http.Header
+	request *http.Request
+	stable  Response
+}
+
+type diffingClient struct {
+	stable Client
+	shadow Client
+
+	onDiff      OnDiffFunc
+	ignorePaths [][]string
+	sampleRate  float64
+	random      func() float64
+
+	jobs    chan diffJob
+	workers int
+	start   sync.Once
+	pending sync.WaitGroup
+}
+
+// DiffOption configures optional behaviour of a diffing client
+type DiffOption func(*diffingClient)
+
+// WithOnDiff sets the callback mismatches are reported to. It is called from
+// the comparison workers, never on the request path.
+func WithOnDiff(onDiff OnDiffFunc) DiffOption {
+	return func(dc *diffingClient) {
+		dc.onDiff = onDiff
+	}
+}
+
+// WithDiffIgnorePaths leaves JSON fields out of the comparison. Paths are dot
+// separated, with "*" matching any key or array index, as in "meta.timestamp"
+// or "items.*.id".
+func WithDiffIgnorePaths(paths ...string) DiffOption {
+	return func(dc *diffingClient) {
+		for _, path := range paths {
+			dc.ignorePaths = append(dc.ignorePaths, strings.Split(path, "."))
+		}
+	}
+}
+
+// WithDiffSampleRate sets the fraction of GET requests that are compared, all
+// of them by default
+func WithDiffSampleRate(sampleRate float64) DiffOption {
+	return func(dc *diffingClient) {
+		dc.sampleRate = sampleRate
+	}
+}
+
+// WithDiffWorkers sets how many comparisons may wait and how many workers run
+// them, 64 and 4 by default. Sampled requests arriving while the queue is full
+// are not compared.
+func WithDiffWorkers(queueSize, workers int) DiffOption {
+	return func(dc *diffingClient) {
+		if queueSize > 0 {
+			dc.jobs = make(chan diffJob, queueSize)
+		}
+		if workers > 0 {
+			dc.workers = workers
+		}
+	}
+}
+
+// NewDiffingClient returns a Client which serves every call from stable and,
+// for sampled GET requests, repeats the request against shadow in the
+// background and compares the two responses. Status codes are compared as they
+// are and JSON bodies after decoding, so key order and formatting do not
+// matter; other bodies must be identical. Mismatches are reported to the
+// WithOnDiff callback. SetRetryCount and SetRetrier are applied to stable
+// only; configure the shadow directly.
+func NewDiffingClient(stable, shadow Client, opts ...DiffOption) Client {
+	dc := &diffingClient{
+		stable:     stable,
+		shadow:     shadow,
+		sampleRate: 1,
+		random:     rand.Float64,
+		jobs:       make(chan diffJob, defaultDiffQueueSize),
+		workers:    defaultDiffWorkers,
+	}
+	for _, opt := range opts {
+		opt(dc)
+	}
+
+	return dc
+}
+
+// Derive returns a diffing client over clients derived from stable and the
+// shadow, with the same options and a worker pool of its own
+func (dc *diffingClient) Derive(opts ...Option) Client {
+	return &diffingClient{
+		stable:      deriveClient(dc.stable, opts),
+		shadow:      deriveClient(dc.shadow, opts),
+		onDiff:      dc.onDiff,
+		ignorePaths: dc.ignorePaths,
+		sampleRate:  dc.sampleRate,
+		random:      dc.random,
+		jobs:        make(chan diffJob, cap(dc.jobs)),
+		workers:     dc.workers,
+	}
+}
+
+// With returns a view of dc setting the defaults of opts on every request
+// sent through it
+func (dc *diffingClient) With(opts ...RequestOption) Client {
+	return newScopedClient(dc, requestDefaults{}, opts)
+}
+
+// SetRetryCount sets the retry count of the stable client
+func (dc *diffingClient) SetRetryCount(count int) {
+	dc.stable.SetRetryCount(count)
+}
+
+// SetRetrier sets the retry strategy of the stable client
+func (dc *diffingClient) SetRetrier(retrier Retriable) {
+	dc.stable.SetRetrier(retrier)
+}
+
+// Stats returns the stats of the stable client
+func (dc *diffingClient) Stats() ClientStats {
+	return statsOf(dc.stable)
+}
+
+// Get makes a HTTP GET request through stable, comparing it when sampled
+func (dc *diffingClient) Get(url string, headers http.Header) (Response, error) {
+	sampled := dc.random() < dc.sampleRate
+
+	response, err := dc.stable.Get(url, headers)
+	if sampled {
+		dc.compare(diffJob{url: url, headers: copyHeader(headers), stable: response.clone()})
+	}
+
+	return response, err
+}
+
+// Post makes a HTTP POST request through stable only
+func (dc *diffingClient) Post(url string, body io.Reader, headers http.Header) (Response, error) {
+	return dc.stable.Post(url, body, headers)
+}
+
+// Put makes a HTTP PUT request through stable only
+func (dc *diffingClient) Put(url string, body io.Reader, headers http.Header) (Response, error) {
+	return dc.stable.Put(url, body, headers)
+}
+
+// Patch makes a HTTP PATCH request through stable only
+func (dc *diffingClient) Patch(url string, body io.Reader, headers http.Header) (Response, error) {
+	return dc.stable.Patch(url, body, headers)
+}
+
+// Delete makes a HTTP DELETE request through stable only
+func (dc *diffingClient) Delete(url string, headers http.Header) (Response, error) {
+	return dc.stable.Delete(url, headers)
+}
+
+// Invoke makes a HTTP request with method through stable only
+func (dc *diffingClient) Invoke(method, url string, body io.Reader, headers http.Header) (Response, error) {
+	return invoke(dc.stable, method, url, body, headers)
+}
+
+// Do sends the request through stable, comparing GET requests when sampled.
+// The copy sent to the shadow is detached from the request context.
+func (dc *diffingClient) Do(request *http.Request) (Response, error) {
+	if request.Method != http.MethodGet || dc.random() >= dc.sampleRate {
+		return SendRequest(dc.stable, request)
+	}
+
+	shadowRequest := withShadowBody(request.WithContext(context.Background()), nil)
+
+	response, err := SendRequest(dc.stable, request)
+	dc.compare(diffJob{url: request.URL.String(), request: shadowRequest, stable: response.clone()})
+
+	return response, err
+}
+
+// NewRequest returns a builder for a request sent through stable and compared when sampled
+func (dc *diffingClient) NewRequest(method, template string) *RequestBuilder {
+	return newRequestBuilder(dc, method, template)
+}
+
+// PostAsync queues the request on stable only
+func (dc *diffingClient) PostAsync(url string, body []byte, headers http.Header) error {
+	return postAsync(dc.stable, url, body, headers)
+}
+
+// Flush waits for the async queue of stable
+func (dc *diffingClient) Flush(ctx context.Context) error {
+	return flushClient(ctx, dc.stable)
+}
+
+// Shutdown shuts the stable client down
+func (dc *diffingClient) Shutdown(ctx context.Context) error {
+	return shutdownClient(ctx, dc.stable)
+}
+
+// GetSSE opens the event stream on stable only
+func (dc *diffingClient) GetSSE(ctx context.Context, url string, headers http.Header) (<-chan Event, func(), error) {
+	return getSSE(ctx, dc.stable, url, headers)
+}
+
+// compare queues job for a worker, dropping it when the queue is full
+func (dc *diffingClient) compare(job diffJob) {
+	dc.start.Do(func() {
+		for i := 0; i < dc.workers; i++ {
+			go dc.work()
+		}
+	})
+
+	dc.pending.Add(1)
+	select {
+	case dc.jobs <- job:
+	default:
+		dc.pending.Done()
+	}
+}
+
+func (dc *diffingClient) work() {
+	for job := range dc.jobs {
+		dc.run(job)
+		dc.pending.Done()
+	}
+}
+
+func (dc *diffingClient) run(job diffJob) {
+	var shadow Response
+	var err error
+	if job.request != nil {
+		shadow, err = SendRequest(dc.shadow, job.request)
+	} else {
+		shadow, err = dc.shadow.Get(job.url, job.headers)
+	}
+
+	var diff string
+	if err != nil && shadow.StatusCode() == 0 {
+		diff = fmt.Sprintf("shadow request failed: %v", err)
+	} else {
+		diff = diffResponses(job.stable, shadow, dc.ignorePaths)
+	}
+
+	if diff != "" && dc.onDiff != nil {
+		dc.onDiff(job.url, job.stable, shadow, diff)
+	}
+}
+
+// wait blocks until all queued comparisons have finished
+func (dc *diffingClient) wait() {
+	dc.pending.Wait()
+}
+
+// diffResponses describes how shadow differs from stable, one line per
+// difference, or returns "" when they match
+func diffResponses(stable, shadow Response, ignorePaths [][]string) string {
+	var lines []string
+	if stable.StatusCode() != shadow.StatusCode() {
+		lines = append(lines, fmt.Sprintf("status: %d != %d", stable.StatusCode(), shadow.StatusCode()))
+	}
+
+	var stableJSON, shadowJSON interface{}
+	stableErr := json.Unmarshal(stable.Body(), &stableJSON)
+	shadowErr := json.Unmarshal(shadow.Body(), &shadowJSON)
+
+	if stableErr != nil || shadowErr != nil {
+		if !bytes.Equal(stable.Body(), shadow.Body()) {
+			lines = append(lines, fmt.Sprintf("body: %d bytes != %d bytes", len(stable.Body()), len(shadow.Body())))
+		}
+		return strings.Join(lines, "\n")
+	}
+
+	for _, path := range ignorePaths {
+		stableJSON = removeJSONPath(stableJSON, path)
+		shadowJSON = removeJSONPath(shadowJSON, path)
+	}
+	lines = diffJSON("", stableJSON, shadowJSON, lines)
+
+	return strings.Join(lines, "\n")
+}
+
+// removeJSONPath drops the value at path from a decoded JSON document
+func removeJSONPath(value interface{}, path []string) interface{} {
+	if len(path) == 0 {
+		return nil
+	}
+
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		for key, child := range typed {
+			if path[0] != "*" && path[0] != key {
+				continue
+			}
+			if len(path) == 1 {
+				delete(typed, key)
+				continue
+			}
+			typed[key] = removeJSONPath(child, path[1:])
+		}
+	case []interface{}:
+		// Array elements are blanked rather than removed to keep indexes stable
+		for i, child := range typed {
+			if path[0] == "*" || path[0] == strconv.Itoa(i) {
+				typed[i] = removeJSONPath(child, path[1:])
+			}
+		}
+	}
+
+	return value
+}
+
+// diffJSON appends a line for every path at which the decoded documents differ
+func diffJSON(path string, stable, shadow interface{}, lines []string) []string {
+	switch stableTyped := stable.(type) {
+	case map[string]interface{}:
+		shadowTyped, ok := shadow.(map[string]interface{})
+		if !ok {
+			break
+		}
+
+		keys := make([]string, 0, len(stableTyped)+len(shadowTyped))
+		for key := range stableTyped {
+			keys = append(keys, key)
+		}
+		for key := range shadowTyped {
+			if _, ok := stableTyped[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			stableChild, inStable := stableTyped[key]
+			shadowChild, inShadow := shadowTyped[key]
+			childPath := joinJSONPath(path, key)
+
+			switch {
+			case !inShadow:
+				lines = append(lines, fmt.Sprintf("%s: missing in shadow", childPath))
+			case !inStable:
+				lines = append(lines, fmt.Sprintf("%s: missing in stable", childPath))
+			default:
+				lines = diffJSON(childPath, stableChild, shadowChild, lines)
+			}
+		}
+		return lines
+	case []interface{}:
+		shadowTyped, ok := shadow.([]interface{})
+		if !ok || len(stableTyped) != len(shadowTyped) {
+			break
+		}
+
+		for i := range stableTyped {
+			lines = diffJSON(joinJSONPath(path, strconv.Itoa(i)), stableTyped[i], shadowTyped[i], lines)
+		}
+		return lines
+	}
+
+	stableValue, _ := json.Marshal(stable)
+	shadowValue, _ := json.Marshal(shadow)
+	if !bytes.Equal(stableValue, shadowValue) {
+		if path == "" {
+			path = "body"
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s != %s", path, stableValue, shadowValue))
+	}
+
+	return lines
+}
+
+func joinJSONPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+
+	return path + "." + key
+}
@@ -0,0 +1,163 @@
+package heimdall
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var _ Client = (*diffingClient)(nil)
+
+type recordedDiff struct {
+	url    string
+	stable Response
+	shadow Response
+	diff   string
+}
+
+type diffRecorder struct {
+	mu    sync.Mutex
+	diffs []recordedDiff
+}
+
+func (r *diffRecorder) onDiff(url string, stable, shadow Response, diff string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.diffs = append(r.diffs, recordedDiff{url: url, stable: stable, shadow: shadow, diff: diff})
+}
+
+func (r *diffRecorder) recorded() []recordedDiff {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]recordedDiff(nil), r.diffs...)
+}
+
+func jsonServer(status int, body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+}
+
+func TestDiffingClientDoesNotReportMatchingResponses(t *testing.T) {
+	stableServer := jsonServer(http.StatusOK, `{"id": 1, "tags": ["a", "b"], "name": "x"}`)
+	defer stableServer.Close()
+	shadowServer := jsonServer(http.StatusOK, `{"name":"x","id":1,"tags":["a","b"]}`)
+	defer shadowServer.Close()
+
+	recorder := &diffRecorder{}
+	client := NewDiffingClient(armClient(stableServer), armClient(shadowServer), WithOnDiff(recorder.onDiff))
+
+	response, err := client.Get("http://upstream.local/items/1", http.Header{})
+	require.NoError(t, err)
+	client.(*diffingClient).wait()
+
+	assert.Equal(t, http.StatusOK, response.StatusCode())
+	assert.Empty(t, recorder.recorded())
+}
+
+func TestDiffingClientReportsMismatchesAndReturnsStable(t *testing.T) {
+	stableServer := jsonServer(http.StatusOK, `{"id": 1, "name": "x", "tags": ["a"]}`)
+	defer stableServer.Close()
+	shadowServer := jsonServer(http.StatusAccepted, `{"id": 2, "tags": ["b"], "extra": true}`)
+	defer shadowServer.Close()
+
+	recorder := &diffRecorder{}
+	client := NewDiffingClient(armClient(stableServer), armClient(shadowServer), WithOnDiff(recorder.onDiff))
+
+	response, err := client.Get("http://upstream.local/items/1", http.Header{})
+	require.NoError(t, err)
+	client.(*diffingClient).wait()
+
+	assert.Equal(t, http.StatusOK, response.StatusCode())
+	assert.JSONEq(t, `{"id": 1, "name": "x", "tags": ["a"]}`, string(response.Body()))
+
+	diffs := recorder.recorded()
+	require.Len(t, diffs, 1)
+	assert.Equal(t, "http://upstream.local/items/1", diffs[0].url)
+	assert.Equal(t, http.StatusOK, diffs[0].stable.StatusCode())
+	assert.Equal(t, http.StatusAccepted, diffs[0].shadow.StatusCode())
+	assert.Equal(t, "status: 200 != 202\n"+
+		"extra: missing in stable\n"+
+		"id: 1 != 2\n"+
+		"name: missing in shadow\n"+
+		"tags.0: \"a\" != \"b\"", diffs[0].diff)
+}
+
+func TestDiffingClientSkipsIgnoredPaths(t *testing.T) {
+	stableServer := jsonServer(http.StatusOK, `{"meta": {"timestamp": 1}, "items": [{"id": "a", "name": "x"}]}`)
+	defer stableServer.Close()
+	shadowServer := jsonServer(http.StatusOK, `{"meta": {"timestamp": 2}, "items": [{"id": "b", "name": "x"}]}`)
+	defer shadowServer.Close()
+
+	recorder := &diffRecorder{}
+	client := NewDiffingClient(armClient(stableServer), armClient(shadowServer),
+		WithOnDiff(recorder.onDiff),
+		WithDiffIgnorePaths("meta.timestamp", "items.*.id"),
+	)
+
+	_, err := client.Get("http://upstream.local/items", http.Header{})
+	require.NoError(t, err)
+	client.(*diffingClient).wait()
+
+	assert.Empty(t, recorder.recorded())
+}
+
+func TestDiffingClientComparesNonJSONBodiesExactly(t *testing.T) {
+	assert.Equal(t, "", diffResponses(Response{statusCode: 200, body: []byte("ok")}, Response{statusCode: 200, body: []byte("ok")}, nil))
+	assert.Equal(t, "body: 2 bytes != 3 bytes", diffResponses(Response{statusCode: 200, body: []byte("ok")}, Response{statusCode: 200, body: []byte("nok")}, nil))
+}
+
+func TestDiffingClientComparesOffTheRequestPath(t *testing.T) {
+	stableServer := jsonServer(http.StatusOK, `{}`)
+	defer stableServer.Close()
+
+	release := make(chan struct{})
+	shadowServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer shadowServer.Close()
+
+	client := NewDiffingClient(armClient(stableServer), armClient(shadowServer), WithDiffWorkers(1, 1))
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		_, err := client.Get("http://upstream.local/items", http.Header{})
+		require.NoError(t, err)
+	}
+	assert.True(t, time.Since(start) < 500*time.Millisecond, "stable requests waited for the shadow")
+
+	close(release)
+	client.(*diffingClient).wait()
+}
+
+func TestDiffingClientOnlyComparesGetRequests(t *testing.T) {
+	stableServer := jsonServer(http.StatusOK, `{"a": 1}`)
+	defer stableServer.Close()
+	shadowServer := jsonServer(http.StatusOK, `{"a": 2}`)
+	defer shadowServer.Close()
+
+	recorder := &diffRecorder{}
+	client := NewDiffingClient(armClient(stableServer), armClient(shadowServer), WithOnDiff(recorder.onDiff))
+
+	_, err := client.Delete("http://upstream.local/items/1", http.Header{})
+	require.NoError(t, err)
+
+	request, err := http.NewRequest(http.MethodGet, "http://upstream.local/items/1", nil)
+	require.NoError(t, err)
+	_, err = SendRequest(client, request)
+	require.NoError(t, err)
+	client.(*diffingClient).wait()
+
+	diffs := recorder.recorded()
+	require.Len(t, diffs, 1)
+	assert.Equal(t, "a: 1 != 2", diffs[0].diff)
+}
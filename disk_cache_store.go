@@ -0,0 +1,313 @@
+package heimdall
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	diskCacheMagic     = "heimdall-cache 1\n"
+	diskCacheSuffix    = ".entry"
+	diskCacheTempGlob  = ".tmp-*"
+	diskCacheTempStart = ".tmp-"
+)
+
+// DiskCacheStore is a CacheStore keeping one file per entry in a directory,
+// so that cached responses survive restarts. Entries are written to a temp
+// file and renamed into place, so a crash never leaves a partial entry under
+// its final name, and entries that fail to parse are deleted and reported as
+// misses. Once the entries take more than maxBytes the least recently used
+// are evicted. Use one store per directory within a process.
+type DiskCacheStore struct {
+	dir      string
+	maxBytes int64
+	now      func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*diskCacheEntry
+	size    int64
+	clock   int64
+}
+
+type diskCacheEntry struct {
+	size     int64
+	lastUsed int64
+}
+
+// diskCacheHeader is the metadata line written before the body of an entry
+type diskCacheHeader struct {
+	KeyHash    string      `json:"key_hash"`
+	StatusCode int         `json:"status_code"`
+	Headers    http.Header `json:"headers"`
+	Expires    time.Time   `json:"expires"`
+	BodySize   int         `json:"body_size"`
+	BodyCRC    uint32      `json:"body_crc"`
+}
+
+// NewDiskCacheStore opens, creating it if needed, a store in dir holding at
+// most maxBytes of entries. Entries left by a previous process are kept,
+// oldest modification first in eviction order, and leftover temp files of
+// interrupted writes are removed.
+func NewDiskCacheStore(dir string, maxBytes int64) (*DiskCacheStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "cache directory creation failed")
+	}
+
+	s := &DiskCacheStore{
+		dir:      dir,
+		maxBytes: maxBytes,
+		now:      time.Now,
+		entries:  map[string]*diskCacheEntry{},
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *DiskCacheStore) load() error {
+	temps, _ := filepath.Glob(filepath.Join(s.dir, diskCacheTempGlob))
+	for _, temp := range temps {
+		os.Remove(temp)
+	}
+
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return errors.Wrap(err, "cache directory read failed")
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), diskCacheSuffix) {
+			continue
+		}
+
+		name := strings.TrimSuffix(file.Name(), diskCacheSuffix)
+		s.track(name, file.Size())
+	}
+	s.evict()
+
+	return nil
+}
+
+// Get returns the entry for key. Expired and unreadable entries are deleted
+// and reported as misses.
+func (s *DiskCacheStore) Get(key string) (CachedResponse, bool, error) {
+	name := diskCacheName(key)
+
+	data, err := ioutil.ReadFile(s.path(name))
+	if os.IsNotExist(err) {
+		s.forget(name)
+		return CachedResponse{}, false, nil
+	}
+	if err != nil {
+		return CachedResponse{}, false, errors.Wrap(err, "cache entry read failed")
+	}
+
+	response, ok := decodeDiskCacheEntry(data, name)
+	if !ok || response.Expired(s.now()) {
+		s.remove(name)
+		return CachedResponse{}, false, nil
+	}
+
+	s.mu.Lock()
+	if entry, ok := s.entries[name]; ok {
+		s.clock++
+		entry.lastUsed = s.clock
+	}
+	s.mu.Unlock()
+
+	// Keep the eviction order across reopening the store
+	now := s.now()
+	os.Chtimes(s.path(name), now, now)
+
+	return response, true, nil
+}
+
+// Set stores response under key, replacing any previous entry, and evicts
+// the least recently used entries until the store is within its size limit
+func (s *DiskCacheStore) Set(key string, response CachedResponse) error {
+	name := diskCacheName(key)
+	data, err := encodeDiskCacheEntry(name, response)
+	if err != nil {
+		return err
+	}
+
+	temp, err := ioutil.TempFile(s.dir, diskCacheTempStart)
+	if err != nil {
+		return errors.Wrap(err, "cache entry creation failed")
+	}
+
+	_, err = temp.Write(data)
+	if err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), s.path(name))
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return errors.Wrap(err, "cache entry write failed")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.untrack(name)
+	s.track(name, int64(len(data)))
+	s.evict()
+
+	return nil
+}
+
+// Delete removes the entry for key, if any
+func (s *DiskCacheStore) Delete(key string) error {
+	name := diskCacheName(key)
+
+	s.forget(name)
+	if err := os.Remove(s.path(name)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "cache entry removal failed")
+	}
+
+	return nil
+}
+
+// Size returns the number of bytes taken by the entries on disk
+func (s *DiskCacheStore) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.size
+}
+
+func (s *DiskCacheStore) path(name string) string {
+	return filepath.Join(s.dir, name+diskCacheSuffix)
+}
+
+func (s *DiskCacheStore) remove(name string) {
+	s.forget(name)
+	os.Remove(s.path(name))
+}
+
+func (s *DiskCacheStore) forget(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.untrack(name)
+}
+
+// track, untrack and evict must be called with mu held
+func (s *DiskCacheStore) track(name string, size int64) {
+	s.clock++
+	s.entries[name] = &diskCacheEntry{size: size, lastUsed: s.clock}
+	s.size += size
+}
+
+func (s *DiskCacheStore) untrack(name string) {
+	if entry, ok := s.entries[name]; ok {
+		s.size -= entry.size
+		delete(s.entries, name)
+	}
+}
+
+func (s *DiskCacheStore) evict() {
+	for s.size > s.maxBytes && len(s.entries) > 0 {
+		oldest, oldestUsed := "", int64(-1)
+		for name, entry := range s.entries {
+			if oldestUsed < 0 || entry.lastUsed < oldestUsed {
+				oldest, oldestUsed = name, entry.lastUsed
+			}
+		}
+
+		s.untrack(oldest)
+		os.Remove(s.path(oldest))
+	}
+}
+
+// diskCacheName is the file name of key, a hash so that any URL is safe
+func diskCacheName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+
+	return hex.EncodeToString(sum[:])
+}
+
+func encodeDiskCacheEntry(name string, response CachedResponse) ([]byte, error) {
+	header, err := json.Marshal(diskCacheHeader{
+		KeyHash:    name,
+		StatusCode: response.StatusCode,
+		Headers:    response.Headers,
+		Expires:    response.Expires,
+		BodySize:   len(response.Body),
+		BodyCRC:    crc32.ChecksumIEEE(response.Body),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "cache entry encoding failed")
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(diskCacheMagic)
+	buf.Write(header)
+	buf.WriteByte('\n')
+	buf.Write(response.Body)
+
+	return buf.Bytes(), nil
+}
+
+// decodeDiskCacheEntry parses an entry file, rejecting any that is truncated,
+// corrupted or stored under the wrong name
+func decodeDiskCacheEntry(data []byte, name string) (CachedResponse, bool) {
+	reader := bufio.NewReader(bytes.NewReader(data))
+
+	magic := make([]byte, len(diskCacheMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil || string(magic) != diskCacheMagic {
+		return CachedResponse{}, false
+	}
+
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return CachedResponse{}, false
+	}
+
+	var header diskCacheHeader
+	if err := json.Unmarshal(line, &header); err != nil || header.KeyHash != name {
+		return CachedResponse{}, false
+	}
+
+	body, err := ioutil.ReadAll(reader)
+	if err != nil || len(body) != header.BodySize || crc32.ChecksumIEEE(body) != header.BodyCRC {
+		return CachedResponse{}, false
+	}
+
+	return CachedResponse{
+		StatusCode: header.StatusCode,
+		Headers:    header.Headers,
+		Body:       body,
+		Expires:    header.Expires,
+	}, true
+}
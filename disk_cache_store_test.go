@@ -0,0 +1,186 @@
+package heimdall
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func tempCacheDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "heimdall-cache")
+	require.NoError(t, err)
+
+	return dir
+}
+
+func cachedBody(body string) CachedResponse {
+	return CachedResponse{
+		StatusCode: http.StatusOK,
+		Headers:    http.Header{"Content-Type": []string{"application/json"}},
+		Body:       []byte(body),
+	}
+}
+
+func TestDiskCacheStoreHitsAcrossReopen(t *testing.T) {
+	dir := tempCacheDir(t)
+	defer os.RemoveAll(dir)
+
+	store, err := NewDiskCacheStore(dir, 1<<20)
+	require.NoError(t, err)
+
+	expires := time.Now().Add(time.Hour).Round(time.Second)
+	entry := cachedBody(`{"id": 1}`)
+	entry.Expires = expires
+	require.NoError(t, store.Set("http://example.com/items/1", entry))
+
+	reopened, err := NewDiskCacheStore(dir, 1<<20)
+	require.NoError(t, err)
+
+	cached, ok, err := reopened.Get("http://example.com/items/1")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, http.StatusOK, cached.StatusCode)
+	assert.Equal(t, "application/json", cached.Headers.Get("Content-Type"))
+	assert.Equal(t, `{"id": 1}`, string(cached.Body))
+	assert.True(t, expires.Equal(cached.Expires))
+	assert.Equal(t, store.Size(), reopened.Size())
+
+	_, ok, err = reopened.Get("http://example.com/items/2")
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestDiskCacheStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	dir := tempCacheDir(t)
+	defer os.RemoveAll(dir)
+
+	probe, err := encodeDiskCacheEntry(diskCacheName("a"), cachedBody("0123456789"))
+	require.NoError(t, err)
+	entrySize := int64(len(probe))
+
+	store, err := NewDiskCacheStore(dir, 3*entrySize)
+	require.NoError(t, err)
+
+	for _, key := range []string{"a", "b", "c"} {
+		require.NoError(t, store.Set(key, cachedBody("0123456789")))
+	}
+
+	_, ok, _ := store.Get("a")
+	require.True(t, ok)
+
+	require.NoError(t, store.Set("d", cachedBody("0123456789")))
+	assert.Equal(t, 3*entrySize, store.Size())
+
+	_, ok, _ = store.Get("b")
+	assert.False(t, ok, "b was the least recently used entry")
+	for _, key := range []string{"a", "c", "d"} {
+		_, ok, _ = store.Get(key)
+		assert.True(t, ok, key)
+	}
+
+	require.NoError(t, store.Set("e", cachedBody("0123456789")))
+	_, ok, _ = store.Get("a")
+	assert.False(t, ok, "a was the least recently used entry")
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+diskCacheSuffix))
+	assert.Len(t, files, 3)
+}
+
+func TestDiskCacheStoreDeletesCorruptedEntries(t *testing.T) {
+	dir := tempCacheDir(t)
+	defer os.RemoveAll(dir)
+
+	store, err := NewDiskCacheStore(dir, 1<<20)
+	require.NoError(t, err)
+
+	require.NoError(t, store.Set("truncated", cachedBody("a body that will be cut short")))
+	require.NoError(t, store.Set("garbage", cachedBody("fine")))
+	require.NoError(t, store.Set("renamed", cachedBody("fine")))
+
+	truncated := store.path(diskCacheName("truncated"))
+	data, err := ioutil.ReadFile(truncated)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(truncated, data[:len(data)-5], 0600))
+	require.NoError(t, ioutil.WriteFile(store.path(diskCacheName("garbage")), []byte("not an entry"), 0600))
+	require.NoError(t, os.Rename(store.path(diskCacheName("renamed")), store.path(diskCacheName("other"))))
+
+	// Simulate a crash in the middle of a write
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, diskCacheTempStart+"123"), []byte("heimdall-"), 0600))
+
+	reopened, err := NewDiskCacheStore(dir, 1<<20)
+	require.NoError(t, err)
+
+	for _, key := range []string{"truncated", "garbage", "other"} {
+		_, ok, err := reopened.Get(key)
+		require.NoError(t, err, key)
+		assert.False(t, ok, key)
+
+		_, statErr := os.Stat(reopened.path(diskCacheName(key)))
+		assert.True(t, os.IsNotExist(statErr), "%s should have been deleted", key)
+	}
+
+	temps, _ := filepath.Glob(filepath.Join(dir, diskCacheTempGlob))
+	assert.Empty(t, temps)
+	assert.Equal(t, int64(0), reopened.Size())
+}
+
+func TestDiskCacheStoreExpiresAndDeletesEntries(t *testing.T) {
+	dir := tempCacheDir(t)
+	defer os.RemoveAll(dir)
+
+	store, err := NewDiskCacheStore(dir, 1<<20)
+	require.NoError(t, err)
+
+	expired := cachedBody("old")
+	expired.Expires = time.Now().Add(-time.Second)
+	require.NoError(t, store.Set("expired", expired))
+	require.NoError(t, store.Set("deleted", cachedBody("gone")))
+	require.NoError(t, store.Delete("deleted"))
+	require.NoError(t, store.Delete("never stored"))
+
+	for _, key := range []string{"expired", "deleted"} {
+		_, ok, err := store.Get(key)
+		require.NoError(t, err)
+		assert.False(t, ok, key)
+	}
+	assert.Equal(t, int64(0), store.Size())
+}
+
+func TestDiskCacheStoreConcurrentUse(t *testing.T) {
+	dir := tempCacheDir(t)
+	defer os.RemoveAll(dir)
+
+	store, err := NewDiskCacheStore(dir, 4<<10)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				key := fmt.Sprintf("key-%d", (worker+j)%10)
+				body := fmt.Sprintf("body of %s", key)
+
+				assert.NoError(t, store.Set(key, cachedBody(body)))
+				if cached, ok, err := store.Get(key); assert.NoError(t, err) && ok {
+					assert.Equal(t, body, string(cached.Body))
+				}
+				if j%7 == 0 {
+					assert.NoError(t, store.Delete(key))
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.True(t, store.Size() <= 4<<10)
+}
@@ -0,0 +1,162 @@
+package heimdall
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/afex/hystrix-go/hystrix"
+)
+
+// RetriesExhaustedError is returned when the final allowed attempt of a
+// request fails. Its message is that of the underlying attempt errors.
+type RetriesExhaustedError struct {
+	// Attempts is the number of attempts made
+	Attempts int
+	// LastResponse is the last response received from the server, which has
+	// a zero StatusCode if no attempt got a response
+	LastResponse Response
+
+	err  error
+	last error
+}
+
+func (e *RetriesExhaustedError) Error() string {
+	return e.err.Error()
+}
+
+// Is reports whether the final attempt failed with target, such as
+// ErrResponseHeaderTimeout, for errors.Is. Attempts answered with a server
+// error status have no attempt error.
+func (e *RetriesExhaustedError) Is(target error) bool {
+	return e.last != nil && errors.Is(e.last, target)
+}
+
+// As finds the first error in the chain of the final attempt error that
+// matches target, such as an *ErrProxyConnect, for errors.As
+func (e *RetriesExhaustedError) As(target interface{}) bool {
+	return e.last != nil && errors.As(e.last, target)
+}
+
+// Cause returns the underlying attempt errors
+func (e *RetriesExhaustedError) Cause() error {
+	return e.err
+}
+
+// Unwrap returns the underlying attempt errors
+func (e *RetriesExhaustedError) Unwrap() error {
+	return e.err
+}
+
+// ErrContextDone is returned instead of sending an attempt when the request
+// context is already cancelled or past its deadline, either before the first
+// attempt, between retries or while an attempt is queued with
+// WithConcurrencyQueue. It is also returned, as a deadline error, when
+// a retry is skipped for having less than the minimum attempt budget left.
+type ErrContextDone struct {
+	// Attempts is the number of attempts sent before the context was done
+	Attempts int
+	// LastResponse is the last response received from the server, which has
+	// a zero StatusCode if no attempt got a response
+	LastResponse Response
+
+	err     error
+	skipped bool
+	left    time.Duration
+}
+
+func (e *ErrContextDone) Error() string {
+	if e.skipped {
+		return fmt.Sprintf("request stopped after %d attempts: %v, skipped final attempt with %v left", e.Attempts, e.err, e.left)
+	}
+
+	return fmt.Sprintf("request stopped after %d attempts: %v", e.Attempts, e.err)
+}
+
+// Timeout reports whether the context deadline was exceeded, rather than the
+// context being cancelled
+func (e *ErrContextDone) Timeout() bool {
+	return e.err == context.DeadlineExceeded
+}
+
+// Cause returns the context error
+func (e *ErrContextDone) Cause() error {
+	return e.err
+}
+
+// Unwrap returns the context error
+func (e *ErrContextDone) Unwrap() error {
+	return e.err
+}
+
+// ErrHystrixRejected is returned when hystrix refuses to run an attempt,
+// because the circuit is open or MaxConcurrentRequests attempts are already
+// running, and when the limit set with WithAdaptiveConcurrency is reached. Rejected attempts are not retried unless the retrier implements
+// RejectionRetrier.
+type ErrHystrixRejected struct {
+	// Attempts is the number of attempts made, including the rejected one
+	Attempts int
+	// LastResponse is the last response received from the server, which has
+	// a zero StatusCode if no attempt got a response
+	LastResponse Response
+
+	err error
+}
+
+func (e *ErrHystrixRejected) Error() string {
+	return fmt.Sprintf("request rejected after %d attempts: %v", e.Attempts, e.err)
+}
+
+// CircuitOpen reports whether the attempt was rejected because the circuit
+// is open, rather than because too many requests were running
+func (e *ErrHystrixRejected) CircuitOpen() bool {
+	return e.err == hystrix.ErrCircuitOpen
+}
+
+// Cause returns the hystrix error
+func (e *ErrHystrixRejected) Cause() error {
+	return e.err
+}
+
+// Unwrap returns the hystrix error
+func (e *ErrHystrixRejected) Unwrap() error {
+	return e.err
+}
+
+// ErrConnect matches, with errors.Is, the error of an attempt that could not
+// connect to the server: the connection was refused, timed out, or no
+// address of the allowed families was reachable
+var ErrConnect = errors.New("connect failed")
+
+// connectError marks a dial error as an ErrConnect, keeping its message and
+// timeout behaviour
+type connectError struct {
+	err error
+}
+
+func (e *connectError) Error() string {
+	return e.err.Error()
+}
+
+// Is reports whether target is ErrConnect
+func (e *connectError) Is(target error) bool {
+	return target == ErrConnect
+}
+
+// Unwrap returns the dial error
+func (e *connectError) Unwrap() error {
+	return e.err
+}
+
+// Timeout reports whether the dial timed out
+func (e *connectError) Timeout() bool {
+	timeout, ok := e.err.(interface{ Timeout() bool })
+	return ok && timeout.Timeout()
+}
+
+// Temporary reports whether the dial error is temporary
+func (e *connectError) Temporary() bool {
+	temporary, ok := e.err.(interface{ Temporary() bool })
+	return ok && temporary.Temporary()
+}
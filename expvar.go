@@ -0,0 +1,260 @@
+package heimdall
+
+import (
+	"expvar"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Latency buckets in milliseconds and response size buckets in bytes used by
+// EnableExpvar. Each observation is counted in the first bucket it fits in,
+// keyed as "le_<bound>", or in "le_inf" when it exceeds every bound.
+var (
+	expvarLatencyBuckets = []int64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+	expvarSizeBuckets    = []int64{1 << 10, 10 << 10, 100 << 10, 1 << 20, 10 << 20}
+)
+
+var (
+	expvarRegistryMu sync.Mutex
+	expvarRegistry   = map[string]*expvarMetrics{}
+)
+
+type expvarMetrics struct {
+	requests  *expvar.Int
+	errors    *expvar.Int
+	retries   *expvar.Int
+	cancelled *expvar.Int
+	dropped   *expvar.Int
+	shed      *expvar.Int
+	audit     *expvar.Int
+	tls       *expvar.Int
+	limit     *expvar.Int
+	inFlight  *expvar.Int
+	depth     *expvar.Int
+	sent      *expvar.Map
+	received  *expvar.Map
+	limited   *expvar.Int
+	dialed    *expvar.Int
+	reused    *expvar.Int
+
+	latency *expvar.Map
+	size    *expvar.Map
+	dials   *expvar.Map
+	waits   *expvar.Map
+
+	outcomes         *expvar.Map
+	outcomeLatencies [len(outcomes)]*expvar.Map
+	apdex            *expvar.Map
+	hedges           *expvar.Map
+	faults           *expvar.Map
+	deprecations     *expvar.Map
+}
+
+// publishExpvar registers the metric vars under prefix. Registering a prefix
+// twice returns the vars published the first time, so clients sharing a
+// prefix report into the same counters.
+func publishExpvar(prefix string) *expvarMetrics {
+	expvarRegistryMu.Lock()
+	defer expvarRegistryMu.Unlock()
+
+	if metrics, ok := expvarRegistry[prefix]; ok {
+		return metrics
+	}
+
+	metrics := &expvarMetrics{
+		requests:  expvar.NewInt(prefix + ".requests"),
+		errors:    expvar.NewInt(prefix + ".errors"),
+		retries:   expvar.NewInt(prefix + ".retries"),
+		cancelled: expvar.NewInt(prefix + ".cancelled_before_send"),
+		dropped:   expvar.NewInt(prefix + ".async_dropped"),
+		shed:      expvar.NewInt(prefix + ".circuit_open_responses"),
+		audit:     expvar.NewInt(prefix + ".audit_dropped"),
+		tls:       expvar.NewInt(prefix + ".tls_warnings"),
+		limit:     expvar.NewInt(prefix + ".concurrency_limit"),
+		inFlight:  expvar.NewInt(prefix + ".concurrency_in_flight"),
+		depth:     expvar.NewInt(prefix + ".concurrency_queue_depth"),
+		sent:      expvar.NewMap(prefix + ".bytes_sent"),
+		received:  expvar.NewMap(prefix + ".bytes_received"),
+		limited:   expvar.NewInt(prefix + ".rate_limited"),
+		dialed:    expvar.NewInt(prefix + ".connections_dialed"),
+		reused:    expvar.NewInt(prefix + ".connections_reused"),
+		latency:   expvar.NewMap(prefix + ".latency_ms"),
+		size:      expvar.NewMap(prefix + ".response_bytes"),
+		dials:     expvar.NewMap(prefix + ".dial_latency_ms"),
+		waits:     expvar.NewMap(prefix + ".concurrency_queue_wait_ms"),
+		outcomes:  expvar.NewMap(prefix + ".outcomes"),
+		apdex:     expvar.NewMap(prefix + ".apdex"),
+		hedges:    expvar.NewMap(prefix + ".hedges"),
+		faults:    expvar.NewMap(prefix + ".faults_injected"),
+
+		deprecations: expvar.NewMap(prefix + ".deprecated_responses"),
+	}
+	latencies := expvar.NewMap(prefix + ".latency_ms_by_outcome")
+	for i, outcome := range outcomes {
+		metrics.outcomeLatencies[i] = new(expvar.Map).Init()
+		latencies.Set(outcome, metrics.outcomeLatencies[i])
+	}
+	expvarRegistry[prefix] = metrics
+
+	return metrics
+}
+
+// observe records the outcome of one logical request. Requests stopped by
+// their context before an attempt could be sent are counted as cancelled, and
+// synthetic open circuit responses and requests held back by a rate limit
+// cooldown separately, rather than as errors. Latencies are also recorded by
+// outcome, and scored against apdex when set. It is a no-op when expvar
+// publishing has not been enabled.
+func (m *expvarMetrics) observe(elapsed time.Duration, attempts int, response Response, err error, apdex time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.requests.Add(1)
+	if _, cancelled := err.(*ErrContextDone); cancelled {
+		m.cancelled.Add(1)
+	} else if err == ErrCircuitOpen {
+		m.shed.Add(1)
+	} else if _, limited := err.(*ErrRateLimited); limited {
+		m.limited.Add(1)
+	} else if err != nil {
+		m.errors.Add(1)
+	}
+	if attempts > 1 {
+		m.retries.Add(int64(attempts - 1))
+	}
+
+	bucket := expvarBucket(expvarLatencyBuckets, int64(elapsed/time.Millisecond))
+	m.latency.Add(bucket, 1)
+	outcome := requestOutcome(response, err)
+	m.outcomes.Add(outcomes[outcome], 1)
+	m.outcomeLatencies[outcome].Add(bucket, 1)
+	if apdex > 0 {
+		m.apdex.Add(apdexZones[apdexZone(apdex, elapsed, err)], 1)
+	}
+	m.size.Add(expvarBucket(expvarSizeBuckets, response.bodySize()), 1)
+}
+
+// dropAsync counts a PostAsync job dropped because the queue was full
+func (m *expvarMetrics) dropAsync() {
+	if m == nil {
+		return
+	}
+
+	m.dropped.Add(1)
+}
+
+// dropAudit counts an audit record dropped because the sink fell behind
+func (m *expvarMetrics) dropAudit() {
+	if m == nil {
+		return
+	}
+
+	m.audit.Add(1)
+}
+
+// warnTLS counts an attempt whose TLS connection raised a warning
+func (m *expvarMetrics) warnTLS() {
+	if m == nil {
+		return
+	}
+
+	m.tls.Add(1)
+}
+
+// concurrency publishes the adaptive concurrency limit and the attempts in
+// flight under it
+func (m *expvarMetrics) concurrency(limit, inFlight int) {
+	if m == nil {
+		return
+	}
+
+	m.limit.Set(int64(limit))
+	m.inFlight.Set(int64(inFlight))
+}
+
+// queueDepth publishes the attempts queued for room under the adaptive
+// concurrency limit
+func (m *expvarMetrics) queueDepth(depth int) {
+	if m == nil {
+		return
+	}
+
+	m.depth.Set(int64(depth))
+}
+
+// queueWait counts an attempt admitted after waiting in the queue for waited,
+// bucketed as dials are
+func (m *expvarMetrics) queueWait(waited time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.waits.Add(dialBucketName(dialBucket(waited)), 1)
+}
+
+// countBytes adds the bytes sent to and received from host
+func (m *expvarMetrics) countBytes(host string, sent, received int64) {
+	if m == nil {
+		return
+	}
+
+	if sent > 0 {
+		m.sent.Add(host, sent)
+	}
+	if received > 0 {
+		m.received.Add(host, received)
+	}
+}
+
+// gotConn counts an attempt getting a new or a pooled connection
+func (m *expvarMetrics) gotConn(reused bool) {
+	if m == nil {
+		return
+	}
+
+	if reused {
+		m.reused.Add(1)
+		return
+	}
+	m.dialed.Add(1)
+}
+
+// dial records how long getting a new connection took
+func (m *expvarMetrics) dial(elapsed time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.dials.Add(dialBucketName(dialBucket(elapsed)), 1)
+}
+
+// hedge counts a hedge event, such as one sent or skipped for the budget
+func (m *expvarMetrics) hedge(event string) {
+	if m == nil {
+		return
+	}
+
+	m.hedges.Add(event, 1)
+}
+
+// deprecated counts a response from host carrying a Deprecation or Sunset
+// header
+func (m *expvarMetrics) deprecated(host string) {
+	if m == nil {
+		return
+	}
+
+	m.deprecations.Add(host, 1)
+}
+
+func expvarBucket(bounds []int64, value int64) string {
+	for _, bound := range bounds {
+		if value <= bound {
+			return "le_" + strconv.FormatInt(bound, 10)
+		}
+	}
+
+	return "le_inf"
+}
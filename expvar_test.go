@@ -0,0 +1,129 @@
+package heimdall
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// names counts the names uniqueName hands out
+var names int64
+
+// uniqueName returns base numbered apart from every other name it returns.
+// Expvar prefixes and hystrix commands are global, so tests name theirs with
+// it to start from zero every time they run.
+func uniqueName(base string) string {
+	return fmt.Sprintf("%s_%d", base, atomic.AddInt64(&names, 1))
+}
+
+func TestHTTPClientPublishesExpvarMetrics(t *testing.T) {
+	prefix := uniqueName("heimdall_http_test")
+	count := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count++
+		if count == 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{ "response": "ok" }`))
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(100)
+	client.EnableExpvar(prefix)
+	client.EnableExpvar(prefix)
+
+	for i := 0; i < 2; i++ {
+		_, err := client.Get(server.URL, http.Header{})
+		require.NoError(t, err)
+	}
+
+	client.SetRetryCount(1)
+	_, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err, "second attempt should succeed")
+
+	assert.Equal(t, "3", expvar.Get(prefix+".requests").String())
+	assert.Equal(t, "0", expvar.Get(prefix+".errors").String())
+	assert.Equal(t, "1", expvar.Get(prefix+".retries").String())
+
+	latency := expvar.Get(prefix + ".latency_ms").(*expvar.Map)
+	total := int64(0)
+	latency.Do(func(kv expvar.KeyValue) {
+		total += kv.Value.(*expvar.Int).Value()
+	})
+	assert.Equal(t, int64(3), total)
+
+	size := expvar.Get(prefix + ".response_bytes").(*expvar.Map)
+	assert.Equal(t, "3", size.Get("le_1024").String())
+}
+
+func TestHystrixHTTPClientPublishesExpvarErrors(t *testing.T) {
+	prefix := uniqueName("heimdall_hystrix_test")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	client := NewHystrixHTTPClient(100, NewHystrixConfig(uniqueName("expvar_command"), HystrixCommandConfig{
+		Timeout:                100,
+		RequestVolumeThreshold: 100,
+	}))
+	client.EnableExpvar(prefix)
+	client.SetRetryCount(2)
+
+	_, err := client.Get(server.URL, http.Header{})
+	require.Error(t, err)
+
+	assert.Equal(t, "1", expvar.Get(prefix+".requests").String())
+	assert.Equal(t, "1", expvar.Get(prefix+".errors").String())
+	assert.Equal(t, "2", expvar.Get(prefix+".retries").String())
+}
+
+func TestExpvarCountsRequestsCancelledBeforeSend(t *testing.T) {
+	prefix := uniqueName("heimdall_cancelled_test")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	request, err := http.NewRequest(http.MethodGet, "http://127.0.0.1:0/", nil)
+	require.NoError(t, err)
+
+	client := NewHTTPClient(100)
+	client.EnableExpvar(prefix)
+
+	_, err = client.Do(request.WithContext(ctx))
+	require.Error(t, err)
+
+	assert.Equal(t, "1", expvar.Get(prefix+".requests").String())
+	assert.Equal(t, "1", expvar.Get(prefix+".cancelled_before_send").String())
+	assert.Equal(t, "0", expvar.Get(prefix+".errors").String())
+}
+
+func TestClientsSharingExpvarPrefixAggregate(t *testing.T) {
+	prefix := uniqueName("heimdall_shared_test")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	first := NewHTTPClient(100)
+	first.EnableExpvar(prefix)
+	second := NewHTTPClient(100)
+	second.EnableExpvar(prefix)
+
+	first.Get(server.URL, http.Header{})
+	second.Get(server.URL, http.Header{})
+
+	assert.Equal(t, "2", expvar.Get(prefix+".requests").String())
+}
+
+func TestExpvarBucket(t *testing.T) {
+	assert.Equal(t, "le_5", expvarBucket(expvarLatencyBuckets, 0))
+	assert.Equal(t, "le_100", expvarBucket(expvarLatencyBuckets, 100))
+	assert.Equal(t, "le_250", expvarBucket(expvarLatencyBuckets, 101))
+	assert.Equal(t, "le_inf", expvarBucket(expvarLatencyBuckets, 10001))
+}
@@ -0,0 +1,34 @@
+package heimdall
+
+import (
+	"fmt"
+	"time"
+)
+
+// ErrClassifiedFailure fails an attempt whose response the failure classifier
+// flagged, although the server did not answer with an error status
+type ErrClassifiedFailure struct {
+	// StatusCode is the status of the flagged response
+	StatusCode int
+	// Duration is how long the attempt took
+	Duration time.Duration
+}
+
+func (e *ErrClassifiedFailure) Error() string {
+	return fmt.Sprintf("response classified as failure: status %d after %v", e.StatusCode, e.Duration)
+}
+
+// classifyAttempt asks classifier whether response, received after duration,
+// fails its attempt, returning an *ErrClassifiedFailure when it does
+func classifyAttempt(classifier func(response *Response, attemptDuration time.Duration) bool, response *Response, duration time.Duration) (err error) {
+	if classifier == nil {
+		return nil
+	}
+	defer recoverCallback("failure classifier", &err)
+
+	if classifier(response, duration) {
+		return &ErrClassifiedFailure{StatusCode: response.statusCode, Duration: duration}
+	}
+
+	return nil
+}
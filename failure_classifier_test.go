@@ -0,0 +1,175 @@
+package heimdall
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/afex/hystrix-go/hystrix"
+	"github.com/gojektech/heimdall/fakeclock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// emptyBodies flags responses with bodies shorter than 10 bytes
+func emptyBodies(response *Response, attemptDuration time.Duration) bool {
+	return len(response.Body()) < 10
+}
+
+// emptyServer answers 200 with an empty body to requests to /empty, and with
+// a body to the others
+func emptyServer(calls *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		if !strings.HasPrefix(r.URL.Path, "/empty") {
+			w.Write([]byte(`{"users": []}`))
+		}
+	}))
+}
+
+func TestHystrixCircuitOpensOnClassifiedFailures(t *testing.T) {
+	var calls int32
+	server := emptyServer(&calls)
+	defer server.Close()
+
+	client := NewHystrixHTTPClient(1000, NewHystrixConfig(uniqueName("failure_classifier_circuit_command"), HystrixCommandConfig{
+		Timeout:                1000,
+		MaxConcurrentRequests:  10,
+		RequestVolumeThreshold: 5,
+		ErrorPercentThreshold:  50,
+		SleepWindow:            60000,
+	}))
+	client.SetFailureClassifier(emptyBodies)
+
+	for i := 0; i < 5; i++ {
+		response, err := client.Get(server.URL+"/empty", http.Header{})
+		require.Error(t, err)
+		assert.Equal(t, http.StatusOK, response.StatusCode())
+	}
+	assert.Equal(t, int32(5), atomic.LoadInt32(&calls))
+
+	_, err := client.Get(server.URL+"/users", http.Header{})
+	assert.True(t, errors.Is(err, hystrix.ErrCircuitOpen), "%v", err)
+	assert.Equal(t, int32(5), atomic.LoadInt32(&calls), "the open circuit sends nothing")
+}
+
+func TestClientsRetryClassifiedFailures(t *testing.T) {
+	for kind, newClient := range retryClients {
+		t.Run(kind, func(t *testing.T) {
+			var calls int32
+			server := emptyServer(&calls)
+			defer server.Close()
+
+			client := newClient("failure_classifier_retry_"+kind, realClock{})
+			client.SetRetryCount(2)
+			client.SetFailureClassifier(emptyBodies)
+
+			response, err := client.Get(server.URL+"/empty", http.Header{})
+
+			var classified *ErrClassifiedFailure
+			require.True(t, errors.As(err, &classified), "%v", err)
+			assert.Equal(t, http.StatusOK, classified.StatusCode)
+			assert.Equal(t, http.StatusOK, response.StatusCode(), "the final response is returned with the error")
+			assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+			response, err = client.Get(server.URL+"/users", http.Header{})
+			require.NoError(t, err)
+			assert.Equal(t, `{"users": []}`, string(response.Body()))
+		})
+	}
+}
+
+func TestClientsClassifySlowAttempts(t *testing.T) {
+	for kind, newClient := range retryClients {
+		t.Run(kind, func(t *testing.T) {
+			clock := fakeclock.New(time.Now())
+			server := slowServer(clock)
+			defer server.Close()
+
+			var durations []time.Duration
+			client := newClient("failure_classifier_latency_"+kind, clock)
+			client.SetFailureClassifier(func(response *Response, attemptDuration time.Duration) bool {
+				durations = append(durations, attemptDuration)
+				return attemptDuration > 500*time.Millisecond
+			})
+
+			_, err := client.Get(server.URL+"/fast", http.Header{})
+			require.NoError(t, err)
+
+			_, err = client.Get(server.URL+"/slow", http.Header{})
+			var classified *ErrClassifiedFailure
+			require.True(t, errors.As(err, &classified), "%v", err)
+			assert.Equal(t, time.Second, classified.Duration)
+			assert.Equal(t, []time.Duration{0, time.Second}, durations)
+		})
+	}
+}
+
+func TestFailureClassifierSkipsServerErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	classified := 0
+	client := NewHTTPClient(1000)
+	client.SetFailureClassifier(func(*Response, time.Duration) bool {
+		classified++
+		return false
+	})
+
+	_, err := client.Get(server.URL, http.Header{})
+
+	assert.Error(t, err)
+	assert.Equal(t, 0, classified, "5xx answers fail without asking the classifier")
+}
+
+func TestFailureDetectorCountsClassifiedFailures(t *testing.T) {
+	var calls int32
+	server := emptyServer(&calls)
+	defer server.Close()
+
+	detector, err := NewFailureDetector(FailureDetectorConfig{}, realClock{})
+	require.NoError(t, err)
+	client := NewHTTPClient(1000, WithFailureDetector(detector))
+	client.SetFailureClassifier(emptyBodies)
+
+	client.Get(server.URL+"/empty", http.Header{})
+	client.Get(server.URL+"/users", http.Header{})
+
+	snapshot := detector.Snapshot()
+	assert.Equal(t, 2, snapshot.Requests)
+	assert.Equal(t, 1, snapshot.Failures)
+}
+
+func TestFailureClassifierPanicFailsAttempt(t *testing.T) {
+	var calls int32
+	server := emptyServer(&calls)
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+	client.SetFailureClassifier(func(*Response, time.Duration) bool {
+		panic("classifier bug")
+	})
+
+	_, err := client.Get(server.URL, http.Header{})
+
+	var panicked *ErrCallbackPanic
+	require.True(t, errors.As(err, &panicked), "%v", err)
+	assert.Equal(t, "failure classifier", panicked.Callback)
+}
+
+func TestDefaultFailureClassificationIsUnchanged(t *testing.T) {
+	var calls int32
+	server := emptyServer(&calls)
+	defer server.Close()
+
+	response, err := NewHTTPClient(1000).Get(server.URL+"/empty", http.Header{})
+
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode())
+}
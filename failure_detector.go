@@ -0,0 +1,184 @@
+package heimdall
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// FailureDetectorConfig tunes the rolling window of a FailureDetector. Zero
+// fields take the defaults of hystrix: a 10 second window of 10 buckets, 20
+// requests and 50 percent of errors.
+type FailureDetectorConfig struct {
+	// Window is how far back attempt outcomes are counted
+	Window time.Duration
+	// Buckets is how many slices the window is split into. Outcomes leave
+	// the window one bucket at a time, so more buckets smooth the rate.
+	Buckets int
+	// MinimumRequests is the number of attempts in the window below which
+	// the detector never trips, however many of them failed
+	MinimumRequests int
+	// ErrorPercentThreshold is the percentage of failed attempts, from 1 to
+	// 100, at which the detector trips
+	ErrorPercentThreshold int
+}
+
+// FailureDetector counts the outcomes of request attempts over a sliding
+// window split into buckets, as hystrix does with a window it does not let
+// callers change. Clients report to it when given WithFailureDetector.
+type FailureDetector struct {
+	mu     sync.Mutex
+	config FailureDetectorConfig
+	clock  Clock
+	width  time.Duration
+
+	buckets []failureBucket
+}
+
+type failureBucket struct {
+	// index is the number of bucket widths since the zero time at which the
+	// bucket starts, telling a current bucket apart from a stale one
+	index     int64
+	successes int
+	failures  int
+}
+
+// FailureSnapshot is the state of a FailureDetector at one point in time
+type FailureSnapshot struct {
+	Window       time.Duration
+	Requests     int
+	Failures     int
+	ErrorPercent float64
+	Tripped      bool
+	// Buckets holds the buckets of the window, oldest first
+	Buckets []FailureBucket
+}
+
+// FailureBucket holds the outcomes counted in one bucket of the window
+type FailureBucket struct {
+	Start     time.Time
+	Successes int
+	Failures  int
+}
+
+// NewFailureDetector returns a detector with config, reading time from clock
+// or the real clock when it is nil. The window must split into buckets of at
+// least a millisecond.
+func NewFailureDetector(config FailureDetectorConfig, clock Clock) (*FailureDetector, error) {
+	if config.Window == 0 {
+		config.Window = 10 * time.Second
+	}
+	if config.Buckets == 0 {
+		config.Buckets = 10
+	}
+	if config.MinimumRequests == 0 {
+		config.MinimumRequests = 20
+	}
+	if config.ErrorPercentThreshold == 0 {
+		config.ErrorPercentThreshold = 50
+	}
+
+	switch {
+	case config.Window < 0:
+		return nil, fmt.Errorf("failure detector - window must be positive, got %s", config.Window)
+	case config.Buckets < 0:
+		return nil, fmt.Errorf("failure detector - bucket count must be positive, got %d", config.Buckets)
+	case config.Window%time.Duration(config.Buckets) != 0 || config.Window/time.Duration(config.Buckets) < time.Millisecond:
+		return nil, fmt.Errorf("failure detector - window of %s does not split into %d buckets of at least 1ms", config.Window, config.Buckets)
+	case config.MinimumRequests < 0:
+		return nil, fmt.Errorf("failure detector - minimum requests must not be negative, got %d", config.MinimumRequests)
+	case config.ErrorPercentThreshold < 0 || config.ErrorPercentThreshold > 100:
+		return nil, fmt.Errorf("failure detector - error percent threshold must be between 1 and 100, got %d", config.ErrorPercentThreshold)
+	}
+
+	if clock == nil {
+		clock = realClock{}
+	}
+
+	return &FailureDetector{
+		config:  config,
+		clock:   clock,
+		width:   config.Window / time.Duration(config.Buckets),
+		buckets: make([]failureBucket, config.Buckets),
+	}, nil
+}
+
+// Record counts the outcome of one attempt. It does nothing on a nil detector.
+func (d *FailureDetector) Record(success bool) {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	bucket := d.bucket(d.clock.Now())
+	if success {
+		bucket.successes++
+	} else {
+		bucket.failures++
+	}
+}
+
+// Tripped reports whether enough attempts failed in the window to reach the
+// threshold
+func (d *FailureDetector) Tripped() bool {
+	return d.Snapshot().Tripped
+}
+
+// Snapshot returns the counts of the current window
+func (d *FailureDetector) Snapshot() FailureSnapshot {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	current := d.index(d.clock.Now())
+	snapshot := FailureSnapshot{
+		Window:  d.config.Window,
+		Buckets: make([]FailureBucket, 0, len(d.buckets)),
+	}
+
+	for index := current - int64(len(d.buckets)) + 1; index <= current; index++ {
+		bucket := FailureBucket{Start: time.Unix(0, index*int64(d.width))}
+		if stored := d.buckets[d.slot(index)]; stored.index == index {
+			bucket.Successes = stored.successes
+			bucket.Failures = stored.failures
+		}
+
+		snapshot.Requests += bucket.Successes + bucket.Failures
+		snapshot.Failures += bucket.Failures
+		snapshot.Buckets = append(snapshot.Buckets, bucket)
+	}
+
+	if snapshot.Requests > 0 {
+		snapshot.ErrorPercent = float64(snapshot.Failures) * 100 / float64(snapshot.Requests)
+	}
+	snapshot.Tripped = snapshot.Requests > 0 && snapshot.Requests >= d.config.MinimumRequests &&
+		snapshot.ErrorPercent >= float64(d.config.ErrorPercentThreshold)
+
+	return snapshot
+}
+
+// bucket returns the bucket counting outcomes at now, resetting the slot
+// when it last held an older bucket
+func (d *FailureDetector) bucket(now time.Time) *failureBucket {
+	index := d.index(now)
+	bucket := &d.buckets[d.slot(index)]
+	if bucket.index != index {
+		*bucket = failureBucket{index: index}
+	}
+
+	return bucket
+}
+
+func (d *FailureDetector) index(now time.Time) int64 {
+	return now.UnixNano() / int64(d.width)
+}
+
+func (d *FailureDetector) slot(index int64) int {
+	slot := int(index % int64(len(d.buckets)))
+	if slot < 0 {
+		slot += len(d.buckets)
+	}
+
+	return slot
+}
@@ -0,0 +1,195 @@
+package heimdall
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gojektech/heimdall/fakeclock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var detectorStart = time.Date(2018, time.January, 19, 22, 0, 0, 0, time.UTC)
+
+func newTestFailureDetector(t *testing.T, config FailureDetectorConfig) (*FailureDetector, *fakeclock.Clock) {
+	clock := fakeclock.New(detectorStart)
+	detector, err := NewFailureDetector(config, clock)
+	require.NoError(t, err)
+
+	return detector, clock
+}
+
+func record(detector *FailureDetector, successes, failures int) {
+	for i := 0; i < successes; i++ {
+		detector.Record(true)
+	}
+	for i := 0; i < failures; i++ {
+		detector.Record(false)
+	}
+}
+
+func TestNewFailureDetectorAppliesDefaults(t *testing.T) {
+	detector, _ := newTestFailureDetector(t, FailureDetectorConfig{})
+
+	assert.Equal(t, FailureDetectorConfig{
+		Window:                10 * time.Second,
+		Buckets:               10,
+		MinimumRequests:       20,
+		ErrorPercentThreshold: 50,
+	}, detector.config)
+	assert.Len(t, detector.Snapshot().Buckets, 10)
+}
+
+func TestNewFailureDetectorValidatesConfig(t *testing.T) {
+	invalid := []FailureDetectorConfig{
+		{Window: -time.Second},
+		{Buckets: -1},
+		{Window: time.Second, Buckets: 3},
+		{Window: time.Millisecond, Buckets: 10},
+		{MinimumRequests: -1},
+		{ErrorPercentThreshold: 101},
+	}
+
+	for _, config := range invalid {
+		_, err := NewFailureDetector(config, nil)
+		assert.Error(t, err, "%+v", config)
+	}
+}
+
+func TestFailureDetectorComputesRateOverWindow(t *testing.T) {
+	detector, clock := newTestFailureDetector(t, FailureDetectorConfig{
+		Window:                time.Second,
+		Buckets:               4,
+		MinimumRequests:       4,
+		ErrorPercentThreshold: 50,
+	})
+
+	record(detector, 3, 1)
+	snapshot := detector.Snapshot()
+	assert.Equal(t, 4, snapshot.Requests)
+	assert.Equal(t, 1, snapshot.Failures)
+	assert.Equal(t, 25.0, snapshot.ErrorPercent)
+	assert.False(t, snapshot.Tripped)
+
+	clock.Advance(250 * time.Millisecond)
+	record(detector, 0, 3)
+	snapshot = detector.Snapshot()
+	assert.Equal(t, 7, snapshot.Requests)
+	assert.Equal(t, 4, snapshot.Failures)
+	assert.True(t, snapshot.Tripped)
+
+	// The first bucket leaves the window one second after it started
+	clock.Advance(750 * time.Millisecond)
+	snapshot = detector.Snapshot()
+	assert.Equal(t, 3, snapshot.Requests)
+	assert.Equal(t, 3, snapshot.Failures)
+	assert.False(t, snapshot.Tripped, "too few requests left in the window")
+
+	clock.Advance(250 * time.Millisecond)
+	snapshot = detector.Snapshot()
+	assert.Equal(t, 0, snapshot.Requests)
+	assert.Equal(t, 0.0, snapshot.ErrorPercent)
+}
+
+func TestFailureDetectorSnapshotListsBucketsOldestFirst(t *testing.T) {
+	detector, clock := newTestFailureDetector(t, FailureDetectorConfig{Window: 3 * time.Second, Buckets: 3})
+
+	record(detector, 1, 0)
+	clock.Advance(time.Second)
+	record(detector, 0, 2)
+	clock.Advance(time.Second)
+	record(detector, 3, 0)
+
+	assert.Equal(t, []FailureBucket{
+		{Start: detectorStart, Successes: 1},
+		{Start: detectorStart.Add(time.Second), Failures: 2},
+		{Start: detectorStart.Add(2 * time.Second), Successes: 3},
+	}, utcBuckets(detector.Snapshot().Buckets))
+
+	// Slots are reused once their bucket falls out of the window
+	clock.Advance(time.Second)
+	record(detector, 0, 1)
+
+	assert.Equal(t, []FailureBucket{
+		{Start: detectorStart.Add(time.Second), Failures: 2},
+		{Start: detectorStart.Add(2 * time.Second), Successes: 3},
+		{Start: detectorStart.Add(3 * time.Second), Failures: 1},
+	}, utcBuckets(detector.Snapshot().Buckets))
+}
+
+func TestFailureDetectorForgetsBucketsAfterLongIdle(t *testing.T) {
+	detector, clock := newTestFailureDetector(t, FailureDetectorConfig{Window: time.Second, Buckets: 2, MinimumRequests: 1})
+
+	record(detector, 0, 5)
+	require.True(t, detector.Tripped())
+
+	// A multiple of the window lands on the same slot, which must not count
+	// the stale bucket
+	clock.Advance(10 * time.Second)
+	record(detector, 1, 0)
+
+	snapshot := detector.Snapshot()
+	assert.Equal(t, 1, snapshot.Requests)
+	assert.Equal(t, 0, snapshot.Failures)
+	assert.False(t, snapshot.Tripped)
+}
+
+func TestNilFailureDetectorIgnoresRecords(t *testing.T) {
+	var detector *FailureDetector
+	assert.NotPanics(t, func() { detector.Record(false) })
+}
+
+func TestClientsReportAttemptsToFailureDetector(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls%3 != 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	clients := map[string]func(detector *FailureDetector) testClient{
+		"http": func(detector *FailureDetector) testClient {
+			return NewHTTPClient(1000, WithFailureDetector(detector))
+		},
+		"hystrix": func(detector *FailureDetector) testClient {
+			return NewHystrixHTTPClient(1000, NewHystrixConfig("failure_detector_command", HystrixCommandConfig{
+				Timeout:                1000,
+				MaxConcurrentRequests:  10,
+				RequestVolumeThreshold: 100,
+				ErrorPercentThreshold:  100,
+			}), WithFailureDetector(detector))
+		},
+	}
+
+	for name, newClient := range clients {
+		t.Run(name, func(t *testing.T) {
+			calls = 0
+			detector, _ := newTestFailureDetector(t, FailureDetectorConfig{MinimumRequests: 3})
+
+			client := newClient(detector)
+			client.SetRetryCount(2)
+
+			_, err := client.Get(server.URL, http.Header{})
+			require.NoError(t, err)
+
+			snapshot := detector.Snapshot()
+			assert.Equal(t, 3, snapshot.Requests)
+			assert.Equal(t, 2, snapshot.Failures)
+			assert.True(t, snapshot.Tripped)
+		})
+	}
+}
+
+func utcBuckets(buckets []FailureBucket) []FailureBucket {
+	for i := range buckets {
+		buckets[i].Start = buckets[i].Start.UTC()
+	}
+
+	return buckets
+}
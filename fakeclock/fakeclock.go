@@ -0,0 +1,130 @@
+// Package fakeclock provides a manually driven heimdall.Clock for tests.
+//
+// Sleep advances the fake time instantly instead of blocking, so retries and
+// backoffs run in microseconds while still observing the intervals they would
+// have waited. Timers created with After or NewTimer fire once the fake time
+// passes their deadline, either through Advance or through a Sleep.
+package fakeclock
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Clock is a fake clock whose time only moves when told to
+type Clock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*waiter
+	sleeps  []time.Duration
+}
+
+type waiter struct {
+	deadline time.Time
+	ch       chan time.Time
+}
+
+// New returns a fake clock set to start
+func New(start time.Time) *Clock {
+	return &Clock{now: start}
+}
+
+// Now returns the fake current time
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+// Sleep records d and advances the clock by it without blocking
+func (c *Clock) Sleep(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.sleeps = append(c.sleeps, d)
+	c.mu.Unlock()
+
+	c.Advance(d)
+
+	return nil
+}
+
+// After returns a channel receiving the fake time once it has advanced by d
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	ch, _ := c.NewTimer(d)
+	return ch
+}
+
+// NewTimer returns a channel receiving the fake time once it has advanced by
+// d, and a function removing the timer from the clock if it has yet to fire
+func (c *Clock) NewTimer(d time.Duration) (<-chan time.Time, func() bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	w := &waiter{ch: make(chan time.Time, 1)}
+	if d <= 0 {
+		w.ch <- c.now
+		return w.ch, func() bool { return false }
+	}
+
+	w.deadline = c.now.Add(d)
+	c.waiters = append(c.waiters, w)
+
+	return w.ch, func() bool { return c.stop(w) }
+}
+
+func (c *Clock) stop(stopped *waiter) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, w := range c.waiters {
+		if w == stopped {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// Advance moves the clock forward by d, firing timers that have expired
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if d > 0 {
+		c.now = c.now.Add(d)
+	}
+
+	pending := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.deadline.After(c.now) {
+			pending = append(pending, w)
+			continue
+		}
+
+		w.ch <- c.now
+	}
+	c.waiters = pending
+}
+
+// Sleeps returns the durations passed to Sleep, in call order
+func (c *Clock) Sleeps() []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]time.Duration(nil), c.sleeps...)
+}
+
+// Timers returns the number of timers which have neither fired nor been
+// stopped yet
+func (c *Clock) Timers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.waiters)
+}
@@ -0,0 +1,93 @@
+package fakeclock
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gojektech/heimdall"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var _ heimdall.Clock = (*Clock)(nil)
+
+var start = time.Date(2018, time.January, 19, 22, 0, 0, 0, time.UTC)
+
+func TestSleepAdvancesTimeWithoutBlocking(t *testing.T) {
+	clock := New(start)
+
+	began := time.Now()
+	require.NoError(t, clock.Sleep(context.Background(), time.Hour))
+	require.NoError(t, clock.Sleep(context.Background(), time.Minute))
+
+	assert.True(t, time.Since(began) < 100*time.Millisecond)
+	assert.Equal(t, start.Add(time.Hour+time.Minute), clock.Now())
+	assert.Equal(t, []time.Duration{time.Hour, time.Minute}, clock.Sleeps())
+}
+
+func TestSleepReturnsContextError(t *testing.T) {
+	clock := New(start)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	assert.Equal(t, context.Canceled, clock.Sleep(ctx, time.Second))
+	assert.Equal(t, start, clock.Now())
+}
+
+func TestAfterFiresOnceDeadlinePasses(t *testing.T) {
+	clock := New(start)
+
+	timer := clock.After(10 * time.Second)
+	assert.Equal(t, 1, clock.Timers())
+
+	clock.Advance(9 * time.Second)
+	select {
+	case <-timer:
+		require.FailNow(t, "timer fired early")
+	default:
+	}
+
+	clock.Advance(time.Second)
+	select {
+	case fired := <-timer:
+		assert.Equal(t, start.Add(10*time.Second), fired)
+	default:
+		require.FailNow(t, "timer did not fire")
+	}
+	assert.Equal(t, 0, clock.Timers())
+}
+
+func TestAfterWithZeroDurationFiresImmediately(t *testing.T) {
+	clock := New(start)
+
+	select {
+	case fired := <-clock.After(0):
+		assert.Equal(t, start, fired)
+	default:
+		assert.Fail(t, "timer did not fire")
+	}
+}
+
+func TestStoppedTimersNeverFire(t *testing.T) {
+	clock := New(start)
+
+	timer, stop := clock.NewTimer(10 * time.Second)
+	assert.Equal(t, 1, clock.Timers())
+	assert.True(t, stop())
+	assert.Equal(t, 0, clock.Timers())
+	assert.False(t, stop(), "a timer is stopped once")
+
+	clock.Advance(time.Minute)
+	select {
+	case <-timer:
+		assert.Fail(t, "a stopped timer fired")
+	default:
+	}
+
+	fired, stop := clock.NewTimer(time.Second)
+	clock.Advance(time.Second)
+	<-fired
+	assert.False(t, stop(), "a fired timer is not pending")
+}
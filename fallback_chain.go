@@ -0,0 +1,225 @@
+package heimdall
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// FallbackStep is one step of a fallback chain, serving requests either
+// through Client or by calling Func, such as to answer from a cache or with
+// a static default
+type FallbackStep struct {
+	// Name identifies the step in Response.ServedBy and *FallbackError,
+	// "step N" counting from 1 when empty
+	Name   string
+	Client Client
+	Func   func(ctx context.Context, request *http.Request) (Response, error)
+	// FallbackOn reports whether the chain moves on to the next step after
+	// the step failed with err. Nil falls back on any error.
+	FallbackOn func(err error) bool
+}
+
+// FallbackError is returned by a fallback chain when every step failed, or
+// when a step failed with an error its FallbackOn does not fall back on. It
+// wraps the error of every step tried, so errors.Is and errors.As find any of
+// them.
+type FallbackError struct {
+	// Steps are the names of the steps tried, in order, and Errors their
+	// errors
+	Steps  []string
+	Errors []error
+}
+
+func (e *FallbackError) Error() string {
+	failures := make([]string, len(e.Steps))
+	for i, step := range e.Steps {
+		failures[i] = step + ": " + e.Errors[i].Error()
+	}
+
+	return "fallback chain failed: " + strings.Join(failures, "; ")
+}
+
+// Unwrap returns the errors of the steps tried
+func (e *FallbackError) Unwrap() []error {
+	return e.Errors
+}
+
+type fallbackChain struct {
+	steps   []FallbackStep
+	primary Client
+}
+
+// NewFallbackChain returns a Client trying each request on steps in order,
+// moving on to the next step when one fails with an error it falls back on,
+// and recording the step that answered in Response.ServedBy. Request bodies
+// are buffered so every step gets the whole body. SetRetryCount, SetRetrier,
+// stats and the calls not made through the chain, such as PostAsync and
+// GetSSE, apply to the first step with a Client only; configure the other
+// steps directly.
+func NewFallbackChain(steps ...FallbackStep) Client {
+	fc := &fallbackChain{steps: make([]FallbackStep, len(steps))}
+	for i, step := range steps {
+		if step.Name == "" {
+			step.Name = fmt.Sprintf("step %d", i+1)
+		}
+		if fc.primary == nil && step.Client != nil {
+			fc.primary = step.Client
+		}
+		fc.steps[i] = step
+	}
+	if fc.primary == nil {
+		fc.primary = NewNoopClient(0, nil)
+	}
+
+	return fc
+}
+
+// Derive returns a fallback chain over clients derived from the Client steps,
+// sharing the Func steps
+func (fc *fallbackChain) Derive(opts ...Option) Client {
+	steps := make([]FallbackStep, len(fc.steps))
+	for i, step := range fc.steps {
+		if step.Client != nil {
+			step.Client = deriveClient(step.Client, opts)
+		}
+		steps[i] = step
+	}
+
+	return NewFallbackChain(steps...)
+}
+
+// With returns a view of fc setting the defaults of opts on every request
+// sent through it
+func (fc *fallbackChain) With(opts ...RequestOption) Client {
+	return newScopedClient(fc, requestDefaults{}, opts)
+}
+
+// serve tries request on each step in turn
+func (fc *fallbackChain) serve(request *http.Request) (Response, error) {
+	data, err := readShadowBody(request.Body)
+	if err != nil {
+		return Response{}, errors.Wrap(err, "request body read failed")
+	}
+
+	failed := &FallbackError{}
+	var response Response
+	for _, step := range fc.steps {
+		response, err = step.serve(withShadowBody(request.WithContext(request.Context()), data))
+		response.servedBy = step.Name
+		if err == nil {
+			return response, nil
+		}
+
+		failed.Steps = append(failed.Steps, step.Name)
+		failed.Errors = append(failed.Errors, err)
+		if step.FallbackOn != nil && !step.FallbackOn(err) {
+			break
+		}
+	}
+
+	return response, failed
+}
+
+// serve sends request through the step, failing it when Func panics
+func (step FallbackStep) serve(request *http.Request) (response Response, err error) {
+	switch {
+	case step.Client != nil:
+		return SendRequest(step.Client, request)
+	case step.Func != nil:
+		defer recoverCallback("fallback step", &err)
+		return step.Func(request.Context(), request)
+	}
+
+	return Response{}, errors.New("fallback step has neither a Client nor a Func")
+}
+
+// call builds the request of a convenience method and serves it
+func (fc *fallbackChain) call(method, url string, body io.Reader, headers http.Header) (Response, error) {
+	request, err := newMethodRequest(method, url, body)
+	if err != nil {
+		return Response{}, err
+	}
+	request.Header = headers
+
+	return fc.serve(request)
+}
+
+// SetRetryCount sets the retry count of the primary client
+func (fc *fallbackChain) SetRetryCount(count int) {
+	fc.primary.SetRetryCount(count)
+}
+
+// SetRetrier sets the retry strategy of the primary client
+func (fc *fallbackChain) SetRetrier(retrier Retriable) {
+	fc.primary.SetRetrier(retrier)
+}
+
+// Stats returns the stats of the primary client
+func (fc *fallbackChain) Stats() ClientStats {
+	return statsOf(fc.primary)
+}
+
+// Get makes a HTTP GET request through the chain
+func (fc *fallbackChain) Get(url string, headers http.Header) (Response, error) {
+	return fc.call(http.MethodGet, url, nil, headers)
+}
+
+// Post makes a HTTP POST request through the chain
+func (fc *fallbackChain) Post(url string, body io.Reader, headers http.Header) (Response, error) {
+	return fc.call(http.MethodPost, url, body, headers)
+}
+
+// Put makes a HTTP PUT request through the chain
+func (fc *fallbackChain) Put(url string, body io.Reader, headers http.Header) (Response, error) {
+	return fc.call(http.MethodPut, url, body, headers)
+}
+
+// Patch makes a HTTP PATCH request through the chain
+func (fc *fallbackChain) Patch(url string, body io.Reader, headers http.Header) (Response, error) {
+	return fc.call(http.MethodPatch, url, body, headers)
+}
+
+// Delete makes a HTTP DELETE request through the chain
+func (fc *fallbackChain) Delete(url string, headers http.Header) (Response, error) {
+	return fc.call(http.MethodDelete, url, nil, headers)
+}
+
+// Invoke makes a HTTP request with method through the chain
+func (fc *fallbackChain) Invoke(method, url string, body io.Reader, headers http.Header) (Response, error) {
+	return fc.call(method, url, body, headers)
+}
+
+// Do sends the request through the chain
+func (fc *fallbackChain) Do(request *http.Request) (Response, error) {
+	return fc.serve(request)
+}
+
+// NewRequest returns a builder for a request sent through the chain
+func (fc *fallbackChain) NewRequest(method, template string) *RequestBuilder {
+	return newRequestBuilder(fc, method, template)
+}
+
+// PostAsync queues the request on the primary only
+func (fc *fallbackChain) PostAsync(url string, body []byte, headers http.Header) error {
+	return postAsync(fc.primary, url, body, headers)
+}
+
+// Flush waits for the async queue of the primary
+func (fc *fallbackChain) Flush(ctx context.Context) error {
+	return flushClient(ctx, fc.primary)
+}
+
+// Shutdown shuts the primary client down
+func (fc *fallbackChain) Shutdown(ctx context.Context) error {
+	return shutdownClient(ctx, fc.primary)
+}
+
+// GetSSE opens the event stream on the primary only
+func (fc *fallbackChain) GetSSE(ctx context.Context, url string, headers http.Header) (<-chan Event, func(), error) {
+	return getSSE(ctx, fc.primary, url, headers)
+}
@@ -0,0 +1,143 @@
+package heimdall
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errCacheMiss = errors.New("cache miss")
+
+// bodyServer answers with status, echoing the request body
+func bodyServer(status int, calls *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		body, _ := ioutil.ReadAll(r.Body)
+		w.WriteHeader(status)
+		w.Write(body)
+	}))
+}
+
+func TestFallbackChainServesFromTheFirstHealthyStep(t *testing.T) {
+	var liveCalls, replicaCalls int32
+	live := bodyServer(http.StatusServiceUnavailable, &liveCalls)
+	defer live.Close()
+	replica := bodyServer(http.StatusOK, &replicaCalls)
+	defer replica.Close()
+
+	liveClient := NewHTTPClient(1000)
+	liveClient.SetBaseURL(live.URL)
+	replicaClient := NewHTTPClient(1000)
+	replicaClient.SetBaseURL(replica.URL)
+
+	chain := NewFallbackChain(
+		FallbackStep{Name: "live", Client: liveClient},
+		FallbackStep{Name: "replica", Client: replicaClient},
+	)
+
+	response, err := chain.Put("/users/1", strings.NewReader(`{"name":"heimdall"}`), http.Header{})
+	require.NoError(t, err)
+
+	assert.Equal(t, "replica", response.ServedBy())
+	assert.Equal(t, `{"name":"heimdall"}`, string(response.Body()), "every step gets the whole body")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&liveCalls))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&replicaCalls))
+}
+
+func TestFallbackChainStepPredicates(t *testing.T) {
+	var liveCalls int32
+	live := bodyServer(http.StatusBadGateway, &liveCalls)
+	defer live.Close()
+
+	liveClient := NewHTTPClient(1000)
+	liveClient.SetBaseURL(live.URL)
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	replica := NewHTTPClient(1000)
+	replica.SetBaseURL(closed.URL)
+
+	var cacheCalls int32
+	cache := func(ctx context.Context, request *http.Request) (Response, error) {
+		atomic.AddInt32(&cacheCalls, 1)
+		return Response{}, errCacheMiss
+	}
+	static := func(ctx context.Context, request *http.Request) (Response, error) {
+		return Response{statusCode: http.StatusOK, body: []byte(`{"users":[]}`)}, nil
+	}
+
+	// The replica step only falls back on server errors, so that the cache
+	// and the static default are skipped when it cannot be reached at all
+	serverErrors := func(err error) bool { return strings.Contains(err.Error(), "server error") }
+	steps := []FallbackStep{
+		{Name: "live", Client: liveClient},
+		{Name: "replica", Client: replica, FallbackOn: serverErrors},
+		{Name: "cache", Func: cache},
+		{Name: "static", Func: static},
+	}
+
+	response, err := NewFallbackChain(steps...).Get("/users", http.Header{})
+
+	var failed *FallbackError
+	require.True(t, errors.As(err, &failed), "%v", err)
+	assert.Equal(t, []string{"live", "replica"}, failed.Steps)
+	assert.Contains(t, failed.Errors[0].Error(), "server error: 502")
+	assert.Contains(t, err.Error(), "live: ")
+	assert.Contains(t, err.Error(), "replica: ")
+	assert.Equal(t, int32(0), atomic.LoadInt32(&cacheCalls))
+	assert.Equal(t, "replica", response.ServedBy())
+
+	steps[1].FallbackOn = nil
+	response, err = NewFallbackChain(steps...).Get("/users", http.Header{})
+	require.NoError(t, err)
+
+	assert.Equal(t, "static", response.ServedBy())
+	assert.Equal(t, `{"users":[]}`, string(response.Body()))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&cacheCalls))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&liveCalls))
+}
+
+func TestFallbackChainWrapsEveryStepError(t *testing.T) {
+	chain := NewFallbackChain(
+		FallbackStep{Func: func(ctx context.Context, request *http.Request) (Response, error) {
+			return Response{}, errCacheMiss
+		}},
+		FallbackStep{Func: func(ctx context.Context, request *http.Request) (Response, error) {
+			panic("no default")
+		}},
+	)
+
+	_, err := chain.Get("http://example.com/users", http.Header{})
+
+	assert.True(t, errors.Is(err, errCacheMiss))
+	var panicked *ErrCallbackPanic
+	require.True(t, errors.As(err, &panicked))
+	assert.Equal(t, "fallback step", panicked.Callback)
+
+	var failed *FallbackError
+	require.True(t, errors.As(err, &failed))
+	assert.Equal(t, []string{"step 1", "step 2"}, failed.Steps)
+}
+
+func TestFallbackChainPassesTheRequestContext(t *testing.T) {
+	type key struct{}
+	chain := NewFallbackChain(FallbackStep{Func: func(ctx context.Context, request *http.Request) (Response, error) {
+		assert.Equal(t, "value", ctx.Value(key{}))
+		return Response{statusCode: http.StatusNoContent}, nil
+	}})
+
+	request, err := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	require.NoError(t, err)
+
+	response, err := SendRequest(chain, request.WithContext(context.WithValue(context.Background(), key{}, "value")))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, response.StatusCode())
+	assert.Equal(t, "step 1", response.ServedBy())
+}
@@ -0,0 +1,266 @@
+package heimdall
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ErrInjectedConnectionReset is the transport error of a FaultRule meant to
+// look like the server resetting the connection
+var ErrInjectedConnectionReset error = &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+
+// FaultInjectedHeader is set on the synthetic responses of fault rules
+const FaultInjectedHeader = "X-Heimdall-Fault-Injected"
+
+// FaultRule injects a fault into a share of the attempts it matches. Match
+// fields left empty match every attempt. A rule delays the attempt by Delay,
+// then either answers it with the synthetic Status and Body, fails it with
+// Err, or, with neither, lets it through to the server.
+type FaultRule struct {
+	// Host is a host pattern, as given to SetAllowedHosts
+	Host       string
+	PathPrefix string
+	Method     string
+
+	// Probability is the share of matching attempts the rule applies to,
+	// from 0 to 1
+	Probability float64
+	// Seed seeds the random source of the rule, so that tests inject faults
+	// into the same attempts every run. Zero seeds it from the time.
+	Seed int64
+
+	Delay  time.Duration
+	Status int
+	Body   []byte
+	Err    error
+}
+
+// ErrInjectedFault is the error of an attempt failed by the Err of a fault
+// rule. It unwraps to that error, so retries, breakers and errors.Is treat it
+// as they would the real one.
+type ErrInjectedFault struct {
+	err error
+}
+
+func (e *ErrInjectedFault) Error() string {
+	return "injected fault: " + e.err.Error()
+}
+
+// Unwrap returns the error of the rule
+func (e *ErrInjectedFault) Unwrap() error {
+	return e.err
+}
+
+// Timeout reports whether the error of the rule is a timeout
+func (e *ErrInjectedFault) Timeout() bool {
+	timeout, ok := e.err.(interface{ Timeout() bool })
+	return ok && timeout.Timeout()
+}
+
+// Temporary reports whether the error of the rule is temporary
+func (e *ErrInjectedFault) Temporary() bool {
+	temporary, ok := e.err.(interface{ Temporary() bool })
+	return ok && temporary.Temporary()
+}
+
+// Fault effects, keying ClientStats.FaultsInjected and the faults_injected
+// expvar map
+const (
+	FaultDelay  = "delay"
+	FaultStatus = "status"
+	FaultError  = "error"
+)
+
+const (
+	faultDelay = iota
+	faultStatus
+	faultError
+)
+
+var faultEffects = [...]string{faultDelay: FaultDelay, faultStatus: FaultStatus, faultError: FaultError}
+
+// FaultInjectingClient is a Client injecting the faults of its rules into
+// the attempts it sends, created with NewFaultInjectingClient
+type FaultInjectingClient struct {
+	Client
+
+	injector *faultInjector
+}
+
+// NewFaultInjectingClient returns a client derived from inner which injects
+// faults into its attempts as rules say, for chaos testing. Faults are
+// injected per attempt under the retry loop and inside the hystrix command,
+// so retries, breakers, stats and hooks see them as they see real failures,
+// and they are counted by effect in ClientStats.FaultsInjected and expvar.
+// inner itself is left as it was.
+func NewFaultInjectingClient(inner Client, rules []FaultRule) *FaultInjectingClient {
+	injector := &faultInjector{}
+	injector.update(rules)
+
+	return &FaultInjectingClient{
+		Client:   deriveClient(inner, []Option{withFaultInjector(injector)}),
+		injector: injector,
+	}
+}
+
+// UpdateRules replaces the rules, taking effect for the attempts sent after
+// the call, including those of clients derived from fc. Nil rules stop
+// injecting faults.
+func (fc *FaultInjectingClient) UpdateRules(rules []FaultRule) {
+	fc.injector.update(rules)
+}
+
+// Stats returns the stats of the client injecting the faults
+func (fc *FaultInjectingClient) Stats() ClientStats {
+	return statsOf(fc.Client)
+}
+
+// Derive returns a client derived with opts from the one injecting the
+// faults, which keeps injecting the faults of the rules of fc
+func (fc *FaultInjectingClient) Derive(opts ...Option) Client {
+	return deriveClient(fc.Client, opts)
+}
+
+func withFaultInjector(injector *faultInjector) Option {
+	return func(options *clientOptions) {
+		options.faults = injector
+	}
+}
+
+// faultInjector holds the rules of a fault injecting client
+type faultInjector struct {
+	rules atomic.Value // []*faultRule
+}
+
+// faultRule is a FaultRule with its own random source
+type faultRule struct {
+	FaultRule
+
+	mu     sync.Mutex
+	random *rand.Rand
+}
+
+func (f *faultInjector) update(rules []FaultRule) {
+	compiled := make([]*faultRule, len(rules))
+	for i, rule := range rules {
+		seed := rule.Seed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		compiled[i] = &faultRule{FaultRule: rule, random: rand.New(rand.NewSource(seed))}
+	}
+
+	f.rules.Store(compiled)
+}
+
+// match returns the first rule matching request that fires for it, nil when
+// none does
+func (f *faultInjector) match(request *http.Request) *faultRule {
+	rules, _ := f.rules.Load().([]*faultRule)
+	for _, rule := range rules {
+		if rule.matches(request) && rule.fires() {
+			return rule
+		}
+	}
+
+	return nil
+}
+
+func (r *faultRule) matches(request *http.Request) bool {
+	method := request.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	switch {
+	case r.Host != "" && !hostMatches(r.Host, request.URL.Hostname()):
+		return false
+	case r.PathPrefix != "" && !strings.HasPrefix(request.URL.Path, r.PathPrefix):
+		return false
+	case r.Method != "" && r.Method != method:
+		return false
+	}
+
+	return true
+}
+
+func (r *faultRule) fires() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.random.Float64() < r.Probability
+}
+
+// injectFaults applies the rules of injector to the attempts sent through
+// next, unless injector is nil
+func injectFaults(next Doer, injector *faultInjector, clock Clock, stats *clientStats, metrics *expvarMetrics) Doer {
+	if injector == nil {
+		return next
+	}
+
+	return DoerFunc(func(request *http.Request) (*http.Response, error) {
+		rule := injector.match(request)
+		if rule == nil {
+			return next.Do(request)
+		}
+
+		if rule.Delay > 0 {
+			stats.fault(faultDelay)
+			metrics.fault(faultDelay)
+			if err := clock.Sleep(request.Context(), rule.Delay); err != nil {
+				return nil, err
+			}
+		}
+
+		switch {
+		case rule.Err != nil:
+			stats.fault(faultError)
+			metrics.fault(faultError)
+			return nil, &ErrInjectedFault{err: rule.Err}
+		case rule.Status > 0:
+			stats.fault(faultStatus)
+			metrics.fault(faultStatus)
+			return injectedResponse(request, rule.Status, rule.Body), nil
+		}
+
+		return next.Do(request)
+	})
+}
+
+// injectedResponse builds the synthetic response of a fault rule
+func injectedResponse(request *http.Request, status int, body []byte) *http.Response {
+	return &http.Response{
+		Status:        strconv.Itoa(status) + " " + http.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{FaultInjectedHeader: {"true"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       request,
+	}
+}
+
+// fault counts a fault injected into an attempt
+func (s *clientStats) fault(effect int) {
+	atomic.AddInt64(&s.faults[effect], 1)
+}
+
+// fault counts a fault injected into an attempt
+func (m *expvarMetrics) fault(effect int) {
+	if m == nil {
+		return
+	}
+
+	m.faults.Add(faultEffects[effect], 1)
+}
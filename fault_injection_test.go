@@ -0,0 +1,158 @@
+package heimdall
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/afex/hystrix-go/hystrix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFaultInjectedStatusesAreRetried(t *testing.T) {
+	for kind, newClient := range retryClients {
+		t.Run(kind, func(t *testing.T) {
+			var calls int32
+			server := countingServer(&calls)
+			defer server.Close()
+
+			inner := newClient("fault_injection_retry_"+kind, realClock{})
+			inner.SetRetryCount(2)
+			client := NewFaultInjectingClient(inner, []FaultRule{
+				{Probability: 1, Status: http.StatusServiceUnavailable, Body: []byte("injected")},
+			})
+
+			response, err := client.Get(server.URL, http.Header{})
+
+			require.Error(t, err)
+			assert.Equal(t, http.StatusServiceUnavailable, response.StatusCode())
+			assert.Equal(t, "injected", string(response.Body()))
+			assert.Len(t, response.Trace().Attempts, 3)
+			assert.Equal(t, int32(0), atomic.LoadInt32(&calls), "injected responses never reach the server")
+			assert.Equal(t, map[string]int64{FaultStatus: 3}, client.Stats().FaultsInjected)
+
+			_, err = inner.Get(server.URL, http.Header{})
+			require.NoError(t, err, "the inner client is left as it was")
+			assert.Empty(t, inner.Stats().FaultsInjected)
+		})
+	}
+}
+
+func TestFaultInjectedErrorsOpenTheCircuit(t *testing.T) {
+	var calls int32
+	server := countingServer(&calls)
+	defer server.Close()
+
+	inner := NewHystrixHTTPClient(1000, NewHystrixConfig(uniqueName("fault_injection_circuit_command"), HystrixCommandConfig{
+		Timeout:                1000,
+		MaxConcurrentRequests:  10,
+		RequestVolumeThreshold: 5,
+		ErrorPercentThreshold:  50,
+		SleepWindow:            60000,
+	}))
+	client := NewFaultInjectingClient(inner, []FaultRule{{Probability: 1, Err: ErrInjectedConnectionReset}})
+
+	for i := 0; i < 5; i++ {
+		_, err := client.Get(server.URL, http.Header{})
+
+		var injected *ErrInjectedFault
+		require.True(t, errors.As(err, &injected), "%v", err)
+		assert.True(t, errors.Is(err, syscall.ECONNRESET))
+	}
+
+	client.UpdateRules(nil)
+	_, err := client.Get(server.URL, http.Header{})
+	assert.True(t, errors.Is(err, hystrix.ErrCircuitOpen), "%v", err)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&calls))
+	assert.Equal(t, map[string]int64{FaultError: 5}, client.Stats().FaultsInjected)
+}
+
+func TestFaultRulesMatchHostPathAndMethod(t *testing.T) {
+	var calls int32
+	server := countingServer(&calls)
+	defer server.Close()
+
+	client := NewFaultInjectingClient(NewHTTPClient(1000), []FaultRule{
+		{Host: "127.0.0.1", PathPrefix: "/orders", Method: http.MethodPost, Probability: 1, Status: http.StatusTeapot},
+		{Host: "*.example.com", Probability: 1, Status: http.StatusBadGateway},
+	})
+
+	response, err := client.Post(server.URL+"/orders/1", nil, http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTeapot, response.StatusCode())
+	assert.Equal(t, "true", response.Headers().Get(FaultInjectedHeader))
+
+	for _, send := range []func() (Response, error){
+		func() (Response, error) { return client.Get(server.URL+"/orders/1", http.Header{}) },
+		func() (Response, error) { return client.Post(server.URL+"/users", nil, http.Header{}) },
+	} {
+		response, err := send()
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, response.StatusCode())
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	u, err := url.Parse("http://api.example.com/users")
+	require.NoError(t, err)
+	assert.True(t, (&faultRule{FaultRule: FaultRule{Host: "*.example.com"}}).matches(&http.Request{URL: u}))
+}
+
+func TestFaultRuleDelaysAttempts(t *testing.T) {
+	var calls int32
+	server := countingServer(&calls)
+	defer server.Close()
+
+	client := NewFaultInjectingClient(NewHTTPClient(1000), []FaultRule{{Probability: 1, Delay: 20 * time.Millisecond}})
+
+	started := time.Now()
+	response, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+
+	assert.True(t, time.Since(started) >= 20*time.Millisecond)
+	assert.Equal(t, http.StatusOK, response.StatusCode())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "a delay alone lets the attempt through")
+	assert.Equal(t, map[string]int64{FaultDelay: 1}, client.Stats().FaultsInjected)
+}
+
+func TestSeededFaultRulesAreDeterministic(t *testing.T) {
+	fired := func() []bool {
+		injector := &faultInjector{}
+		injector.update([]FaultRule{{Probability: 0.5, Seed: 42, Status: http.StatusServiceUnavailable}})
+
+		request, err := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+		require.NoError(t, err)
+
+		var fired []bool
+		for i := 0; i < 20; i++ {
+			fired = append(fired, injector.match(request) != nil)
+		}
+		return fired
+	}
+
+	first := fired()
+	assert.Equal(t, first, fired())
+	assert.Contains(t, first, true)
+	assert.Contains(t, first, false)
+}
+
+func TestFaultRulesUpdateAtRuntime(t *testing.T) {
+	var calls int32
+	server := countingServer(&calls)
+	defer server.Close()
+
+	client := NewFaultInjectingClient(NewHTTPClient(1000), nil)
+	derived := client.Derive()
+
+	_, err := derived.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+
+	client.UpdateRules([]FaultRule{{Probability: 1, Err: ErrInjectedConnectionReset}})
+	_, err = derived.Get(server.URL, http.Header{})
+	assert.True(t, errors.Is(err, ErrInjectedConnectionReset), "%v", err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
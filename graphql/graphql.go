@@ -0,0 +1,141 @@
+// Package graphql sends GraphQL queries through a heimdall.Client, so that
+// they get the same retries, circuit breaking and middlewares as any other
+// request.
+package graphql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gojektech/heimdall"
+	"github.com/pkg/errors"
+)
+
+// Client posts GraphQL queries to a single endpoint, created with
+// NewGraphQLClient
+type Client struct {
+	endpoint string
+	client   heimdall.Client
+	headers  http.Header
+}
+
+// NewGraphQLClient returns a client posting queries to endpoint through c
+func NewGraphQLClient(endpoint string, c heimdall.Client) *Client {
+	return &Client{
+		endpoint: endpoint,
+		client:   c,
+		headers:  http.Header{},
+	}
+}
+
+// SetHeader sets a header sent with every query, such as Authorization
+func (gc *Client) SetHeader(name, value string) {
+	gc.headers.Set(name, value)
+}
+
+// Error is a single entry of the errors array of a GraphQL response
+type Error struct {
+	Message   string     `json:"message"`
+	Locations []Location `json:"locations,omitempty"`
+	// Path is the response field the error belongs to, made of field names
+	// and list indexes
+	Path       []interface{}          `json:"path,omitempty"`
+	Extensions map[string]interface{} `json:"extensions,omitempty"`
+}
+
+// Location is a position in the query document
+type Location struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+// GraphQLErrors is returned by Query when the response carries errors, even
+// if the HTTP status was 200. Any data in the response is still decoded.
+type GraphQLErrors []Error
+
+func (e GraphQLErrors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, err := range e {
+		message := err.Message
+		if len(err.Path) > 0 {
+			path := make([]string, len(err.Path))
+			for i, segment := range err.Path {
+				path[i] = fmt.Sprint(segment)
+			}
+			message = strings.Join(path, ".") + ": " + message
+		}
+		messages = append(messages, message)
+	}
+
+	return "graphql: " + strings.Join(messages, "; ")
+}
+
+type request struct {
+	Query     string                 `json:"query"`
+	Variables map[string]interface{} `json:"variables,omitempty"`
+}
+
+type response struct {
+	Data   json.RawMessage `json:"data"`
+	Errors GraphQLErrors   `json:"errors"`
+}
+
+// Query posts query with variables and decodes the data of the response into
+// out. When the response has errors they are returned as GraphQLErrors, and
+// any partial data is decoded into out all the same.
+func (gc *Client) Query(ctx context.Context, query string, variables map[string]interface{}, out interface{}) error {
+	body, err := json.Marshal(request{Query: query, Variables: variables})
+	if err != nil {
+		return errors.Wrap(err, "graphql - request encoding failed")
+	}
+
+	httpRequest, err := http.NewRequest(http.MethodPost, gc.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "graphql - request creation failed")
+	}
+	httpRequest = httpRequest.WithContext(ctx)
+
+	httpRequest.Header = http.Header{}
+	for name, values := range gc.headers {
+		httpRequest.Header[name] = append([]string(nil), values...)
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	httpRequest.Header.Set("Accept", "application/json")
+
+	httpResponse, err := heimdall.SendRequest(gc.client, httpRequest)
+	if httpResponse.StatusCode() == 0 {
+		return err
+	}
+
+	var decoded response
+	if decodeErr := json.Unmarshal(httpResponse.Body(), &decoded); decodeErr != nil {
+		if err != nil {
+			return err
+		}
+		return errors.Wrapf(decodeErr, "graphql - response with status %d is not a GraphQL response", httpResponse.StatusCode())
+	}
+
+	if out != nil && len(decoded.Data) > 0 && string(decoded.Data) != "null" {
+		if decodeErr := json.Unmarshal(decoded.Data, out); decodeErr != nil {
+			return errors.Wrap(decodeErr, "graphql - data decoding failed")
+		}
+	}
+
+	if len(decoded.Errors) > 0 {
+		return decoded.Errors
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if httpResponse.StatusCode() >= http.StatusBadRequest {
+		return fmt.Errorf("graphql - unexpected status code: %d", httpResponse.StatusCode())
+	}
+
+	return nil
+}
@@ -0,0 +1,126 @@
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/gojektech/heimdall"
+	"github.com/gojektech/heimdall/heimdalltest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type hero struct {
+	Hero struct {
+		Name    string `json:"name"`
+		Friends []struct {
+			Name string `json:"name"`
+		} `json:"friends"`
+	} `json:"hero"`
+}
+
+const heroQuery = "query Hero($episode: Episode) { hero(episode: $episode) { name friends { name } } }"
+
+func fixtureServer(t *testing.T, status int, fixture string) *heimdalltest.ScriptedServer {
+	return heimdalltest.NewScriptedServer(t, heimdalltest.Step{
+		Status:  status,
+		Body:    fixture,
+		Headers: http.Header{"Content-Type": {"application/json"}},
+		Assert:  checkHeroQuery,
+	})
+}
+
+// checkHeroQuery checks that request posts the hero query for JEDI as JSON
+// with the bearer token
+func checkHeroQuery(request *http.Request) error {
+	if request.Method != http.MethodPost || request.Header.Get("Content-Type") != "application/json" {
+		return fmt.Errorf("%s with Content-Type %q", request.Method, request.Header.Get("Content-Type"))
+	}
+	if authorization := request.Header.Get("Authorization"); authorization != "Bearer token" {
+		return fmt.Errorf("Authorization %q", authorization)
+	}
+
+	var envelope struct {
+		Query     string                 `json:"query"`
+		Variables map[string]interface{} `json:"variables"`
+	}
+	if err := json.NewDecoder(request.Body).Decode(&envelope); err != nil {
+		return err
+	}
+	if envelope.Query != heroQuery || !reflect.DeepEqual(envelope.Variables, map[string]interface{}{"episode": "JEDI"}) {
+		return fmt.Errorf("query %q with variables %v", envelope.Query, envelope.Variables)
+	}
+
+	return nil
+}
+
+func query(t *testing.T, server *heimdalltest.ScriptedServer, out interface{}) error {
+	client := NewGraphQLClient(server.URL, heimdall.NewHTTPClient(1000))
+	client.SetHeader("Authorization", "Bearer token")
+
+	return client.Query(context.Background(), heroQuery, map[string]interface{}{"episode": "JEDI"}, out)
+}
+
+func TestQueryDecodesData(t *testing.T) {
+	server := fixtureServer(t, http.StatusOK, `{"data": {"hero": {"name": "R2-D2", "friends": [{"name": "Luke"}]}}}`)
+
+	var out hero
+	require.NoError(t, query(t, server, &out))
+
+	assert.Equal(t, "R2-D2", out.Hero.Name)
+	require.Len(t, out.Hero.Friends, 1)
+	assert.Equal(t, "Luke", out.Hero.Friends[0].Name)
+}
+
+func TestQueryReturnsErrorsWithStatusOK(t *testing.T) {
+	server := fixtureServer(t, http.StatusOK, `{"data": null, "errors": [{
+		"message": "Cannot query field \"hero\"",
+		"locations": [{"line": 1, "column": 34}],
+		"extensions": {"code": "GRAPHQL_VALIDATION_FAILED"}
+	}]}`)
+
+	var out hero
+	err := query(t, server, &out)
+
+	graphQLErrors, ok := err.(GraphQLErrors)
+	require.True(t, ok, "expected GraphQLErrors, got %T", err)
+	require.Len(t, graphQLErrors, 1)
+	assert.Equal(t, []Location{{Line: 1, Column: 34}}, graphQLErrors[0].Locations)
+	assert.Equal(t, "GRAPHQL_VALIDATION_FAILED", graphQLErrors[0].Extensions["code"])
+	assert.Equal(t, `graphql: Cannot query field "hero"`, err.Error())
+	assert.Equal(t, "", out.Hero.Name)
+}
+
+func TestQuerySurfacesPartialDataAndErrors(t *testing.T) {
+	server := fixtureServer(t, http.StatusOK, `{
+		"data": {"hero": {"name": "R2-D2", "friends": [{"name": "Luke"}, null]}},
+		"errors": [{"message": "Name for character with ID 1002 could not be fetched.", "path": ["hero", "friends", 1, "name"]}]
+	}`)
+
+	var out hero
+	err := query(t, server, &out)
+	require.Error(t, err)
+
+	assert.Equal(t, "R2-D2", out.Hero.Name)
+	assert.Equal(t, "graphql: hero.friends.1.name: Name for character with ID 1002 could not be fetched.", err.Error())
+
+	graphQLErrors := err.(GraphQLErrors)
+	assert.Equal(t, []interface{}{"hero", "friends", float64(1), "name"}, graphQLErrors[0].Path)
+}
+
+func TestQueryReportsNonGraphQLErrorResponses(t *testing.T) {
+	server := fixtureServer(t, http.StatusBadGateway, `<html>bad gateway</html>`)
+
+	err := query(t, server, nil)
+	require.Error(t, err)
+	assert.Equal(t, "server error: 502", err.Error())
+
+	unauthorized := fixtureServer(t, http.StatusUnauthorized, `{"errors": [{"message": "not authorized"}]}`)
+
+	err = query(t, unauthorized, nil)
+	assert.IsType(t, GraphQLErrors{}, err)
+}
@@ -0,0 +1,298 @@
+// Package grpcweb makes unary gRPC-Web calls through a heimdall.Client, so
+// that backends exposing gRPC-Web are reached with the same retries, circuit
+// breaking and middlewares as any other request, without grpc-go.
+//
+//	err := grpcweb.Invoke(ctx, client, "https://users.internal", "/users.v1.Users/Get", request, response, nil)
+package grpcweb
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gojektech/heimdall"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+)
+
+// Content types of gRPC-Web requests. Invoke sends ContentType unless the
+// headers given to it set ContentTypeText, which base64 encodes the frames.
+const (
+	ContentType     = "application/grpc-web+proto"
+	ContentTypeText = "application/grpc-web-text+proto"
+)
+
+// Flags of the first byte of a frame
+const (
+	dataFrame    byte = 0x00
+	trailerFrame byte = 0x80
+)
+
+// prefixLength is the length of the flag and message length prefixing every
+// frame
+const prefixLength = 5
+
+// ErrMalformedFrame is wrapped by the error of a call whose response is not
+// made of valid gRPC-Web frames
+var ErrMalformedFrame = errors.New("grpcweb - malformed frame")
+
+// Status codes of gRPC, as named by the spec
+var codeNames = [...]string{
+	"OK", "Canceled", "Unknown", "InvalidArgument", "DeadlineExceeded", "NotFound",
+	"AlreadyExists", "PermissionDenied", "ResourceExhausted", "FailedPrecondition",
+	"Aborted", "OutOfRange", "Unimplemented", "Internal", "Unavailable", "DataLoss",
+	"Unauthenticated",
+}
+
+// GRPCStatusError is returned by Invoke when the call ended with a non-zero
+// grpc-status, or with an HTTP error status and none
+type GRPCStatusError struct {
+	// Code is the grpc-status, such as 5 for NotFound
+	Code int
+	// Message is the grpc-message, percent-decoded
+	Message string
+	// Details is the decoded grpc-status-details-bin, a serialized
+	// google.rpc.Status, when the server sent one
+	Details []byte
+	// Trailer holds the trailers of the call, or its headers for a
+	// trailers-only response
+	Trailer http.Header
+}
+
+func (e *GRPCStatusError) Error() string {
+	name := "Code(" + strconv.Itoa(e.Code) + ")"
+	if e.Code >= 0 && e.Code < len(codeNames) {
+		name = codeNames[e.Code]
+	}
+	if e.Message == "" {
+		return "grpcweb - " + name
+	}
+
+	return fmt.Sprintf("grpcweb - %s: %s", name, e.Message)
+}
+
+// Invoke calls fullMethod, such as "/users.v1.Users/Get", on the gRPC-Web
+// server at baseURL through client, sending req with headers and decoding
+// the reply into resp. A call ending with a non-zero status fails with a
+// *GRPCStatusError, and a response that is not valid gRPC-Web with an error
+// wrapping ErrMalformedFrame.
+func Invoke(ctx context.Context, client heimdall.Client, baseURL, fullMethod string, req, resp proto.Message, headers http.Header) error {
+	message, err := proto.Marshal(req)
+	if err != nil {
+		return errors.Wrap(err, "grpcweb - request encoding failed")
+	}
+
+	contentType := ContentType
+	if mediaType(headers.Get("Content-Type")) == mediaType(ContentTypeText) {
+		contentType = ContentTypeText
+	}
+	body := frame(dataFrame, message)
+	if contentType == ContentTypeText {
+		body = []byte(base64.StdEncoding.EncodeToString(body))
+	}
+
+	request, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(baseURL, "/")+"/"+strings.TrimPrefix(fullMethod, "/"), bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "grpcweb - request creation failed")
+	}
+	request = request.WithContext(ctx)
+
+	request.Header = http.Header{}
+	for name, values := range headers {
+		request.Header[name] = append([]string(nil), values...)
+	}
+	request.Header.Set("Content-Type", contentType)
+	request.Header.Set("Accept", contentType)
+	request.Header.Set("X-Grpc-Web", "1")
+
+	response, err := heimdall.SendRequest(client, request)
+	if response.StatusCode() == 0 {
+		return err
+	}
+
+	return decode(response, resp, err)
+}
+
+// decode reads the reply of a call into resp. err is the error the client
+// returned with response, which the status of the call, when there is one,
+// replaces.
+func decode(response heimdall.Response, resp proto.Message, err error) error {
+	headers := response.Headers()
+	if response.StatusCode() != http.StatusOK && headers.Get("Grpc-Status") == "" {
+		return &GRPCStatusError{Code: httpStatusCode(response.StatusCode()), Message: "HTTP status " + strconv.Itoa(response.StatusCode()), Trailer: headers}
+	}
+
+	body := response.Body()
+	if strings.HasPrefix(mediaType(headers.Get("Content-Type")), "application/grpc-web-text") {
+		decoded, decodeErr := decodeText(body)
+		if decodeErr != nil {
+			return errors.Wrapf(ErrMalformedFrame, "base64 decoding failed: %v", decodeErr)
+		}
+		body = decoded
+	}
+
+	var message []byte
+	var trailer http.Header
+	for len(body) > 0 {
+		if len(body) < prefixLength {
+			return errors.Wrapf(ErrMalformedFrame, "%d bytes left, short of a frame prefix", len(body))
+		}
+		flag, length := body[0], binary.BigEndian.Uint32(body[1:prefixLength])
+		if uint64(len(body)-prefixLength) < uint64(length) {
+			return errors.Wrapf(ErrMalformedFrame, "frame of %d bytes with %d left", length, len(body)-prefixLength)
+		}
+		payload := body[prefixLength : prefixLength+int(length)]
+		body = body[prefixLength+int(length):]
+
+		switch {
+		case flag&trailerFrame != 0:
+			if trailer != nil {
+				return errors.Wrap(ErrMalformedFrame, "more than one trailer frame")
+			}
+			parsed, parseErr := parseTrailer(payload)
+			if parseErr != nil {
+				return parseErr
+			}
+			trailer = parsed
+		case flag != dataFrame:
+			return errors.Wrapf(ErrMalformedFrame, "unsupported frame flags %#x", flag)
+		case trailer != nil, message != nil:
+			return errors.Wrap(ErrMalformedFrame, "unexpected data frame")
+		default:
+			message = payload
+		}
+	}
+
+	if trailer == nil {
+		// A trailers-only response carries the status in its headers
+		trailer = headers
+	}
+	status, statusErr := callStatus(trailer)
+	if statusErr != nil {
+		return statusErr
+	}
+	if status != nil {
+		return status
+	}
+	if err != nil {
+		return err
+	}
+	if message == nil {
+		return errors.Wrap(ErrMalformedFrame, "no message in a successful response")
+	}
+
+	return errors.Wrap(proto.Unmarshal(message, resp), "grpcweb - response decoding failed")
+}
+
+// frame prefixes payload with flag and its length
+func frame(flag byte, payload []byte) []byte {
+	framed := make([]byte, prefixLength+len(payload))
+	framed[0] = flag
+	binary.BigEndian.PutUint32(framed[1:prefixLength], uint32(len(payload)))
+	copy(framed[prefixLength:], payload)
+
+	return framed
+}
+
+// decodeText decodes a base64 body, which servers may send as separately
+// padded chunks
+func decodeText(body []byte) ([]byte, error) {
+	var decoded []byte
+	for len(body) > 0 {
+		end := bytes.IndexByte(body, '=')
+		if end < 0 {
+			end = len(body)
+		} else {
+			for end < len(body) && body[end] == '=' {
+				end++
+			}
+		}
+
+		chunk := make([]byte, base64.StdEncoding.DecodedLen(end))
+		n, err := base64.StdEncoding.Decode(chunk, body[:end])
+		if err != nil {
+			return nil, err
+		}
+		decoded = append(decoded, chunk[:n]...)
+		body = body[end:]
+	}
+
+	return decoded, nil
+}
+
+// parseTrailer parses the HTTP/1 style headers of a trailer frame
+func parseTrailer(payload []byte) (http.Header, error) {
+	trailer := http.Header{}
+	for _, line := range strings.Split(string(payload), "\r\n") {
+		if line == "" {
+			continue
+		}
+		colon := strings.IndexByte(line, ':')
+		if colon <= 0 {
+			return nil, errors.Wrapf(ErrMalformedFrame, "trailer line %q", line)
+		}
+		trailer.Add(textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(line[:colon])), strings.TrimSpace(line[colon+1:]))
+	}
+
+	return trailer, nil
+}
+
+// callStatus returns the status in trailer as a *GRPCStatusError, nil for OK
+func callStatus(trailer http.Header) (*GRPCStatusError, error) {
+	value := trailer.Get("Grpc-Status")
+	if value == "" {
+		return nil, errors.Wrap(ErrMalformedFrame, "no grpc-status")
+	}
+	code, err := strconv.Atoi(value)
+	if err != nil || code < 0 {
+		return nil, errors.Wrapf(ErrMalformedFrame, "grpc-status %q", value)
+	}
+	if code == 0 {
+		return nil, nil
+	}
+
+	status := &GRPCStatusError{Code: code, Trailer: trailer}
+	status.Message, err = url.PathUnescape(trailer.Get("Grpc-Message"))
+	if err != nil {
+		status.Message = trailer.Get("Grpc-Message")
+	}
+	if details := trailer.Get("Grpc-Status-Details-Bin"); details != "" {
+		status.Details, _ = base64.RawStdEncoding.DecodeString(strings.TrimRight(details, "="))
+	}
+
+	return status, nil
+}
+
+// httpStatusCode maps the status of a response without grpc-status to a
+// gRPC code, as the gRPC spec does
+func httpStatusCode(status int) int {
+	switch status {
+	case http.StatusBadRequest:
+		return 13 // Internal
+	case http.StatusUnauthorized:
+		return 16 // Unauthenticated
+	case http.StatusForbidden:
+		return 7 // PermissionDenied
+	case http.StatusNotFound:
+		return 12 // Unimplemented
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return 14 // Unavailable
+	}
+
+	return 2 // Unknown
+}
+
+func mediaType(contentType string) string {
+	if semicolon := strings.IndexByte(contentType, ';'); semicolon >= 0 {
+		contentType = contentType[:semicolon]
+	}
+
+	return strings.ToLower(strings.TrimSpace(contentType))
+}
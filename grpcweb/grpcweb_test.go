@@ -0,0 +1,139 @@
+package grpcweb
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gojektech/heimdall"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type message struct {
+	Name string `protobuf:"bytes,1,opt,name=name,proto3"`
+}
+
+func (m *message) Reset()         { *m = message{} }
+func (m *message) String() string { return m.Name }
+func (m *message) ProtoMessage()  {}
+
+// greeterServer is a small gRPC-Web server of a Greeter service, answering
+// in the mode of the request and recording the headers of the last one
+func greeterServer(t *testing.T, headers *http.Header) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*headers = r.Header.Clone()
+		text := r.Header.Get("Content-Type") == ContentTypeText
+
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		if text {
+			body, err = base64.StdEncoding.DecodeString(string(body))
+			require.NoError(t, err)
+		}
+		require.True(t, len(body) >= prefixLength && body[0] == dataFrame)
+		var request message
+		require.NoError(t, proto.Unmarshal(body[prefixLength:], &request))
+
+		var reply []byte
+		switch r.URL.Path {
+		case "/greeter.v1.Greeter/SayHello":
+			encoded, err := proto.Marshal(&message{Name: "hello " + request.Name})
+			require.NoError(t, err)
+			reply = append(frame(dataFrame, encoded), frame(trailerFrame, []byte("grpc-status: 0\r\ngrpc-message: \r\n"))...)
+		case "/greeter.v1.Greeter/Missing":
+			reply = frame(trailerFrame, []byte("grpc-status: 5\r\ngrpc-message: no%20greeting%20for%20"+request.Name+"\r\ngrpc-status-details-bin: AQID\r\n"))
+		case "/greeter.v1.Greeter/TrailersOnly":
+			w.Header().Set("Grpc-Status", "7")
+			w.Header().Set("Grpc-Message", "denied")
+		case "/greeter.v1.Greeter/Truncated":
+			reply = frame(dataFrame, []byte("partial"))[:8]
+		case "/greeter.v1.Greeter/NoStatus":
+			reply = frame(dataFrame, []byte{0x0a})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		contentType := ContentType
+		if text {
+			contentType = ContentTypeText
+			// Each frame is padded on its own, as streaming servers do
+			reply = []byte(base64.StdEncoding.EncodeToString(reply[:len(reply)-1]) + base64.StdEncoding.EncodeToString(reply[len(reply)-1:]))
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Write(reply)
+	}))
+}
+
+func TestInvokeUnaryCall(t *testing.T) {
+	for mode, contentType := range map[string]string{"binary": "", "text": ContentTypeText} {
+		t.Run(mode, func(t *testing.T) {
+			var received http.Header
+			server := greeterServer(t, &received)
+			defer server.Close()
+
+			headers := http.Header{"Authorization": {"Bearer token"}}
+			if contentType != "" {
+				headers.Set("Content-Type", contentType)
+			}
+
+			var reply message
+			err := Invoke(context.Background(), heimdall.NewHTTPClient(1000), server.URL+"/", "/greeter.v1.Greeter/SayHello", &message{Name: "ada"}, &reply, headers)
+			require.NoError(t, err)
+			assert.Equal(t, "hello ada", reply.Name)
+
+			assert.Equal(t, "Bearer token", received.Get("Authorization"))
+			assert.Equal(t, "1", received.Get("X-Grpc-Web"))
+			assert.NotEmpty(t, received.Get("Content-Type"))
+			assert.Equal(t, received.Get("Content-Type"), received.Get("Accept"))
+		})
+	}
+}
+
+func TestInvokeMapsStatusesToErrors(t *testing.T) {
+	var received http.Header
+	server := greeterServer(t, &received)
+	defer server.Close()
+	client := heimdall.NewHTTPClient(1000)
+
+	err := Invoke(context.Background(), client, server.URL, "greeter.v1.Greeter/Missing", &message{Name: "ada"}, &message{}, nil)
+	var status *GRPCStatusError
+	require.True(t, errors.As(err, &status), "%v", err)
+	assert.Equal(t, 5, status.Code)
+	assert.Equal(t, "no greeting for ada", status.Message)
+	assert.Equal(t, []byte{1, 2, 3}, status.Details)
+	assert.EqualError(t, err, "grpcweb - NotFound: no greeting for ada")
+
+	err = Invoke(context.Background(), client, server.URL, "/greeter.v1.Greeter/TrailersOnly", &message{}, &message{}, nil)
+	require.True(t, errors.As(err, &status), "%v", err)
+	assert.Equal(t, 7, status.Code)
+	assert.EqualError(t, err, "grpcweb - PermissionDenied: denied")
+
+	err = Invoke(context.Background(), client, server.URL, "/greeter.v1.Greeter/Unknown", &message{}, &message{}, nil)
+	require.True(t, errors.As(err, &status), "%v", err)
+	assert.Equal(t, 12, status.Code, "a 404 without grpc-status is Unimplemented")
+}
+
+func TestInvokeRejectsMalformedFraming(t *testing.T) {
+	var received http.Header
+	server := greeterServer(t, &received)
+	defer server.Close()
+
+	for _, method := range []string{"/greeter.v1.Greeter/Truncated", "/greeter.v1.Greeter/NoStatus"} {
+		for _, contentType := range []string{"", ContentTypeText} {
+			err := Invoke(context.Background(), heimdall.NewHTTPClient(1000), server.URL, method, &message{}, &message{}, http.Header{"Content-Type": {contentType}})
+			assert.True(t, errors.Is(err, ErrMalformedFrame), "%s %s: %v", method, contentType, err)
+		}
+	}
+
+	_, err := parseTrailer([]byte("grpc-status 0\r\n"))
+	assert.True(t, errors.Is(err, ErrMalformedFrame))
+	_, err = decodeText([]byte("not base64!"))
+	assert.Error(t, err)
+}
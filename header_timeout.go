@@ -0,0 +1,109 @@
+package heimdall
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrResponseHeaderTimeout is the error of an attempt whose response headers
+// did not arrive within the timeout set with SetResponseHeaderTimeout. It
+// reports Timeout() as true, and attempts failing with it are retried. Match
+// it with errors.Is, which also finds it as the final attempt error of a
+// *RetriesExhaustedError.
+var ErrResponseHeaderTimeout error = &responseHeaderTimeoutError{}
+
+type responseHeaderTimeoutError struct{}
+
+func (e *responseHeaderTimeoutError) Error() string {
+	return "timeout awaiting response headers"
+}
+
+// Timeout returns true
+func (e *responseHeaderTimeoutError) Timeout() bool {
+	return true
+}
+
+// Temporary returns true
+func (e *responseHeaderTimeoutError) Temporary() bool {
+	return true
+}
+
+// headerTimeoutDoer fails attempts whose response headers take longer than
+// timeout to arrive, leaving the time spent reading the body unbounded
+type headerTimeoutDoer struct {
+	next    Doer
+	timeout time.Duration
+	clock   Clock
+}
+
+// withResponseHeaderTimeout wraps next in a first byte timer, unless timeout
+// is not positive. The timer runs per attempt, on clock, rather than on the
+// transport, which derived clients share.
+func withResponseHeaderTimeout(next Doer, timeout time.Duration, clock Clock) Doer {
+	if timeout <= 0 {
+		return next
+	}
+
+	return &headerTimeoutDoer{next: next, timeout: timeout, clock: clock}
+}
+
+// Do sends request, cancelling it if its headers are late
+func (d *headerTimeoutDoer) Do(request *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(request.Context())
+
+	var mu sync.Mutex
+	headersReceived, timedOut := false, false
+	fired, stop := d.clock.NewTimer(d.timeout)
+	received := make(chan struct{})
+	go func() {
+		select {
+		case <-fired:
+		case <-received:
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if !headersReceived {
+			timedOut = true
+			cancel()
+		}
+	}()
+
+	response, err := d.next.Do(request.WithContext(ctx))
+
+	mu.Lock()
+	headersReceived = true
+	late := timedOut
+	mu.Unlock()
+	stop()
+	close(received)
+
+	if err != nil {
+		cancel()
+		if late {
+			return nil, ErrResponseHeaderTimeout
+		}
+		return nil, err
+	}
+
+	response.Body = &cancelOnClose{ReadCloser: response.Body, cancel: cancel}
+
+	return response, nil
+}
+
+// cancelOnClose releases the context of an attempt once its body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+
+	return err
+}
@@ -0,0 +1,142 @@
+package heimdall
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gojektech/heimdall/fakeclock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func slowHeadersServer(delay time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+		w.Write([]byte("late"))
+	}))
+}
+
+func slowBodyServer(chunks int, interval time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+
+		for i := 0; i < chunks; i++ {
+			time.Sleep(interval)
+			w.Write([]byte("chunk;"))
+			w.(http.Flusher).Flush()
+		}
+	}))
+}
+
+func TestHTTPClientResponseHeaderTimeoutFailsLateHeaders(t *testing.T) {
+	server := slowHeadersServer(time.Second)
+	defer server.Close()
+
+	client := NewHTTPClient(5000)
+	client.SetResponseHeaderTimeout(50 * time.Millisecond)
+	client.SetRetryCount(2)
+
+	begin := time.Now()
+	_, err := client.Get(server.URL, http.Header{})
+	require.Error(t, err)
+
+	assert.True(t, time.Since(begin) < 750*time.Millisecond, "attempts should fail once the header timeout passes")
+	assert.True(t, errors.Is(err, ErrResponseHeaderTimeout))
+
+	var exhausted *RetriesExhaustedError
+	require.True(t, errors.As(err, &exhausted))
+	assert.Equal(t, 3, exhausted.Attempts, "header timeouts should be retried")
+	assert.True(t, strings.Contains(err.Error(), "timeout awaiting response headers"))
+
+	var timeout interface{ Timeout() bool }
+	require.True(t, errors.As(ErrResponseHeaderTimeout, &timeout))
+	assert.True(t, timeout.Timeout())
+}
+
+func TestHTTPClientResponseHeaderTimeoutAllowsSlowBodies(t *testing.T) {
+	server := slowBodyServer(4, 50*time.Millisecond)
+	defer server.Close()
+
+	client := NewHTTPClient(5000)
+	client.SetResponseHeaderTimeout(30 * time.Millisecond)
+
+	response, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+
+	assert.Equal(t, "chunk;chunk;chunk;chunk;", string(response.Body()))
+}
+
+func TestHystrixHTTPClientResponseHeaderTimeout(t *testing.T) {
+	slow := slowHeadersServer(time.Second)
+	defer slow.Close()
+	streaming := slowBodyServer(3, 40*time.Millisecond)
+	defer streaming.Close()
+
+	client := NewHystrixHTTPClient(5000, NewHystrixConfig("response_header_timeout_command", HystrixCommandConfig{
+		Timeout:                5000,
+		MaxConcurrentRequests:  10,
+		RequestVolumeThreshold: 1000,
+		ErrorPercentThreshold:  100,
+		SleepWindow:            100,
+	}))
+	client.SetResponseHeaderTimeout(30 * time.Millisecond)
+
+	_, err := client.Get(slow.URL, http.Header{})
+	assert.True(t, errors.Is(err, ErrResponseHeaderTimeout))
+
+	response, err := client.Get(streaming.URL, http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, "chunk;chunk;chunk;", string(response.Body()))
+}
+
+func TestResponseHeaderTimeoutRunsOnTheClock(t *testing.T) {
+	var arrived int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/prompt" {
+			return
+		}
+		atomic.AddInt32(&arrived, 1)
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	clock := fakeclock.New(time.Now())
+	client := NewHTTPClient(60000, WithClock(clock))
+	client.SetResponseHeaderTimeout(time.Minute)
+
+	_, err := client.Get(server.URL+"/prompt", http.Header{})
+	require.NoError(t, err)
+	assert.Zero(t, clock.Timers(), "the timer of headers on time is stopped")
+
+	done := make(chan error)
+	go func() {
+		_, err := client.Get(server.URL, http.Header{})
+		done <- err
+	}()
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&arrived) == 1 && clock.Timers() == 1 }, time.Second, time.Millisecond)
+
+	clock.Advance(59 * time.Second)
+	select {
+	case err := <-done:
+		require.FailNow(t, "the attempt failed before the timeout", "%v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	clock.Advance(time.Second)
+	select {
+	case err := <-done:
+		assert.True(t, errors.Is(err, ErrResponseHeaderTimeout), "%v", err)
+	case <-time.After(time.Second):
+		require.FailNow(t, "the header timeout did not follow the clock")
+	}
+}
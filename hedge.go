@@ -0,0 +1,267 @@
+package heimdall
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LoadBudget caps the extra requests sent on top of those asked for, by
+// hedged attempts and by the retry passes of GetManyWithBudget, at perSecond
+// a second with bursts of as many. Share one budget between the clients and
+// helpers calling the same upstream, so that fanning a batch out does not
+// multiply the hedges it sends.
+type LoadBudget struct {
+	perSecond int
+	clock     Clock
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+
+	granted int64
+	denied  int64
+}
+
+// LoadBudgetStats is the consumption of a LoadBudget since it was created
+type LoadBudgetStats struct {
+	PerSecond int `json:"per_second"`
+	// Granted counts the extra requests the budget allowed, Denied those it
+	// skipped
+	Granted int64 `json:"granted"`
+	Denied  int64 `json:"denied"`
+}
+
+// NewLoadBudget returns a budget of perSecond extra requests a second
+func NewLoadBudget(perSecond int) *LoadBudget {
+	return newLoadBudget(perSecond, realClock{})
+}
+
+func newLoadBudget(perSecond int, clock Clock) *LoadBudget {
+	return &LoadBudget{perSecond: perSecond, clock: clock, tokens: float64(perSecond), last: clock.Now()}
+}
+
+// take consumes one extra request, reporting false once the budget is
+// exhausted. A nil budget allows every extra request.
+func (b *LoadBudget) take() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	now := b.clock.Now()
+	b.tokens += now.Sub(b.last).Seconds() * float64(b.perSecond)
+	if b.tokens > float64(b.perSecond) {
+		b.tokens = float64(b.perSecond)
+	}
+	b.last = now
+	granted := b.tokens >= 1
+	if granted {
+		b.tokens--
+	}
+	b.mu.Unlock()
+
+	if !granted {
+		atomic.AddInt64(&b.denied, 1)
+		return false
+	}
+	atomic.AddInt64(&b.granted, 1)
+
+	return true
+}
+
+// Stats returns the consumption of the budget
+func (b *LoadBudget) Stats() LoadBudgetStats {
+	return LoadBudgetStats{
+		PerSecond: b.perSecond,
+		Granted:   atomic.LoadInt64(&b.granted),
+		Denied:    atomic.LoadInt64(&b.denied),
+	}
+}
+
+// hedging is the setting of WithHedging
+type hedging struct {
+	delay  time.Duration
+	budget *LoadBudget
+}
+
+// WithHedging sends a second, hedged attempt when an attempt has had no
+// response after delay, returning whichever of the two answers first and
+// cancelling the other, so that its connection is released rather than left
+// reading a response nobody waits for. Each hedge is drawn from budget, and
+// is skipped once the budget is exhausted; a nil budget hedges every late
+// attempt. Only attempts of idempotent methods whose body can be sent again
+// are hedged. Hedges are counted in ClientStats.Hedges and expvar.
+func WithHedging(delay time.Duration, budget *LoadBudget) Option {
+	return func(options *clientOptions) {
+		options.hedging = &hedging{delay: delay, budget: budget}
+	}
+}
+
+// HedgeStats count the hedged attempts of a client
+type HedgeStats struct {
+	Delay Duration `json:"delay"`
+	// Sent counts the hedges sent, Won those answering before the attempt
+	// they hedged
+	Sent int64 `json:"sent"`
+	Won  int64 `json:"won"`
+	// Skipped counts the late attempts left unhedged by an exhausted budget
+	Skipped int64 `json:"skipped"`
+}
+
+// Hedge events, indexing the counters of hedgeCounts
+const (
+	hedgeSent = iota
+	hedgeWon
+	hedgeSkipped
+)
+
+var hedgeEvents = [...]string{"sent", "won", "skipped"}
+
+// hedgeCounts are the counters behind HedgeStats, updated atomically
+type hedgeCounts [3]int64
+
+func (c *hedgeCounts) reset() {
+	for i := range c {
+		atomic.StoreInt64(&c[i], 0)
+	}
+}
+
+func (c *hedgeCounts) snapshot(delay time.Duration) *HedgeStats {
+	return &HedgeStats{
+		Delay:   Duration(delay),
+		Sent:    atomic.LoadInt64(&c[hedgeSent]),
+		Won:     atomic.LoadInt64(&c[hedgeWon]),
+		Skipped: atomic.LoadInt64(&c[hedgeSkipped]),
+	}
+}
+
+// hedgeDoer hedges the attempts of next that are late
+type hedgeDoer struct {
+	next    Doer
+	hedging *hedging
+	clock   Clock
+	stats   *clientStats
+	metrics *expvarMetrics
+}
+
+// hedgedAttempt is the result of the first attempt of a hedgeDoer, or of
+// its hedge
+type hedgedAttempt struct {
+	response *http.Response
+	err      error
+	hedge    int
+}
+
+// hedge wraps next in hedging, unless hedging is nil
+func hedge(next Doer, hedging *hedging, clock Clock, stats *clientStats, metrics *expvarMetrics) Doer {
+	if hedging == nil {
+		return next
+	}
+
+	return &hedgeDoer{next: next, hedging: hedging, clock: clock, stats: stats, metrics: metrics}
+}
+
+// Do sends request, and a hedge of it if it is late
+func (d *hedgeDoer) Do(request *http.Request) (*http.Response, error) {
+	if !hedgeable(request) {
+		return d.next.Do(request)
+	}
+
+	results := make(chan hedgedAttempt, 2)
+	var cancels [2]context.CancelFunc
+	cancels[0] = d.send(request, 0, results)
+	sent, pending := 1, 1
+	late, stop := d.clock.NewTimer(d.hedging.delay)
+	defer stop()
+
+	for {
+		select {
+		case <-late:
+			late = nil
+			if !d.hedging.budget.take() {
+				d.count(hedgeSkipped)
+				continue
+			}
+
+			hedged := request.Clone(request.Context())
+			if request.GetBody != nil {
+				body, err := request.GetBody()
+				if err != nil {
+					continue
+				}
+				hedged.Body = body
+			}
+			d.count(hedgeSent)
+			cancels[1] = d.send(hedged, 1, results)
+			sent++
+			pending++
+
+		case result := <-results:
+			pending--
+			if result.err != nil {
+				cancels[result.hedge]()
+				if pending > 0 {
+					continue
+				}
+				return nil, result.err
+			}
+
+			if result.hedge > 0 {
+				d.count(hedgeWon)
+			}
+			for i := 0; i < sent; i++ {
+				if i != result.hedge {
+					cancels[i]()
+				}
+			}
+			go discardHedgedAttempts(results, pending)
+
+			result.response.Body = &cancelOnClose{ReadCloser: result.response.Body, cancel: cancels[result.hedge]}
+			return result.response, nil
+		}
+	}
+}
+
+// send starts attempt hedge of request, the first being 0, returning the
+// function cancelling it
+func (d *hedgeDoer) send(request *http.Request, hedge int, results chan<- hedgedAttempt) context.CancelFunc {
+	ctx, cancel := context.WithCancel(request.Context())
+	go func() {
+		response, err := d.next.Do(request.WithContext(ctx))
+		results <- hedgedAttempt{response: response, err: err, hedge: hedge}
+	}()
+
+	return cancel
+}
+
+func (d *hedgeDoer) count(event int) {
+	atomic.AddInt64(&d.stats.hedges[event], 1)
+	d.metrics.hedge(hedgeEvents[event])
+}
+
+// discardHedgedAttempts closes the responses of the pending attempts that
+// lost, once their cancellation lets them return
+func discardHedgedAttempts(results <-chan hedgedAttempt, pending int) {
+	for i := 0; i < pending; i++ {
+		if result := <-results; result.response != nil {
+			result.response.Body.Close()
+		}
+	}
+}
+
+// hedgeable reports whether request may be sent twice: its method must be
+// idempotent and its body, if any, replayable
+func hedgeable(request *http.Request) bool {
+	switch request.Method {
+	case http.MethodPost, http.MethodPatch, http.MethodConnect:
+		return false
+	}
+	if !retriesMethod(request.Method) {
+		return false
+	}
+
+	return request.Body == nil || request.Body == http.NoBody || request.GetBody != nil
+}
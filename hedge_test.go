@@ -0,0 +1,182 @@
+package heimdall
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gojektech/heimdall/fakeclock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stalledServer holds its first request until the client gives up on it,
+// signalling cancelled, and answers the others at once
+func stalledServer(calls *int32, cancelled chan<- struct{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(calls, 1) == 1 {
+			select {
+			case <-r.Context().Done():
+				cancelled <- struct{}{}
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+
+		w.Write([]byte("hedged"))
+	}))
+}
+
+func TestClientsHedgeLateAttempts(t *testing.T) {
+	clients := map[string]func() testClient{
+		"http": func() testClient {
+			return NewHTTPClient(5000, WithHedging(20*time.Millisecond, nil))
+		},
+		"hystrix": func() testClient {
+			return NewHystrixHTTPClient(5000, NewHystrixConfig(uniqueName("hedge_late_command"), HystrixCommandConfig{Timeout: 5000}), WithHedging(20*time.Millisecond, nil))
+		},
+	}
+	for kind, newClient := range clients {
+		t.Run(kind, func(t *testing.T) {
+			var calls int32
+			cancelled := make(chan struct{}, 1)
+			server := stalledServer(&calls, cancelled)
+			defer server.Close()
+
+			client := newClient()
+			prefix := uniqueName("heimdall_hedge_test_" + kind)
+			client.EnableExpvar(prefix)
+
+			response, err := client.Get(server.URL, http.Header{})
+			require.NoError(t, err)
+			assert.Equal(t, "hedged", string(response.Body()))
+
+			select {
+			case <-cancelled:
+			case <-time.After(time.Second):
+				t.Fatal("the losing attempt was not cancelled")
+			}
+
+			assert.Equal(t, &HedgeStats{Delay: Duration(20 * time.Millisecond), Sent: 1, Won: 1}, client.Stats().Hedges)
+			hedges := expvar.Get(prefix + ".hedges").(*expvar.Map)
+			assert.Equal(t, "1", hedges.Get("sent").String())
+			assert.Equal(t, "1", hedges.Get("won").String())
+		})
+	}
+}
+
+func TestHedgesStayWithinBudgetUnderBatchLoad(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(30 * time.Millisecond)
+		fmt.Fprintf(w, "%s", strings.TrimPrefix(r.URL.Path, "/items/"))
+	}))
+	defer server.Close()
+
+	budget := newLoadBudget(10, fakeclock.New(time.Date(2018, time.January, 19, 22, 0, 0, 0, time.UTC)))
+	client := NewHTTPClient(5000, WithHedging(5*time.Millisecond, budget))
+
+	ids := make([]string, 100)
+	for i := range ids {
+		ids[i] = fmt.Sprint(i)
+	}
+	responses, failures := GetManyWithBudget(context.Background(), client, server.URL+"/items/{id}", ids, 20, 1, budget)
+
+	assert.Empty(t, failures)
+	assert.Len(t, responses, 100)
+	assert.Equal(t, "42", string(responses["42"].Body()))
+
+	assert.Equal(t, int32(110), atomic.LoadInt32(&calls), "one upstream call per ID, and one per hedge")
+	assert.Equal(t, LoadBudgetStats{PerSecond: 10, Granted: 10, Denied: 90}, budget.Stats())
+	hedges := client.Stats().Hedges
+	assert.Equal(t, int64(10), hedges.Sent)
+	assert.Equal(t, int64(90), hedges.Skipped)
+}
+
+func TestGetManyRetryPassesDrawFromBudget(t *testing.T) {
+	server := newItemServer(func(id string, call int) bool { return call == 1 })
+	defer server.Close()
+
+	budget := newLoadBudget(3, fakeclock.New(time.Date(2018, time.January, 19, 22, 0, 0, 0, time.UTC)))
+	ids := []string{"a", "b", "c", "d", "e"}
+	responses, failures := GetManyWithBudget(context.Background(), NewHTTPClient(1000), server.URL+"/items/{id}", ids, 5, 2, budget)
+
+	assert.Len(t, responses, 3)
+	assert.Len(t, failures, 2)
+	for _, err := range failures {
+		assert.Contains(t, err.Error(), "server error: 500")
+	}
+	assert.Equal(t, LoadBudgetStats{PerSecond: 3, Granted: 3, Denied: 2}, budget.Stats())
+}
+
+func TestGetManyCancelsRequestsInFlight(t *testing.T) {
+	released := make(chan struct{}, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			released <- struct{}{}
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, failures := GetMany(ctx, NewHTTPClient(5000), server.URL+"/items/{id}", []string{"a", "b"}, 2, 1)
+
+	assert.True(t, time.Since(start) < time.Second, "requests in flight are cancelled with the context")
+	assert.Len(t, failures, 2)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-released:
+		case <-time.After(time.Second):
+			t.Fatal("the server kept waiting on a cancelled request")
+		}
+	}
+}
+
+func TestHedgingSkipsNonIdempotentRequests(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(30 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(1000, WithHedging(time.Millisecond, nil))
+	_, err := client.Post(server.URL, strings.NewReader("{}"), http.Header{})
+	require.NoError(t, err)
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	assert.Equal(t, int64(0), client.Stats().Hedges.Sent)
+}
+
+func TestLoadBudgetRefills(t *testing.T) {
+	clock := fakeclock.New(time.Date(2018, time.January, 19, 22, 0, 0, 0, time.UTC))
+	budget := newLoadBudget(2, clock)
+
+	assert.True(t, budget.take())
+	assert.True(t, budget.take())
+	assert.False(t, budget.take())
+
+	clock.Advance(500 * time.Millisecond)
+	assert.True(t, budget.take())
+	assert.False(t, budget.take())
+
+	clock.Advance(time.Hour)
+	assert.True(t, budget.take())
+	assert.True(t, budget.take())
+	assert.False(t, budget.take(), "bursts are capped at a second of budget")
+
+	assert.Equal(t, LoadBudgetStats{PerSecond: 2, Granted: 5, Denied: 3}, budget.Stats())
+	assert.True(t, (*LoadBudget)(nil).take())
+}
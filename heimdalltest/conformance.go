@@ -0,0 +1,1266 @@
+// Package heimdalltest checks implementations of heimdall.Client against the
+// contract the built-in clients keep.
+//
+// Custom clients, such as caching clients or tracing wrappers, should pass
+// TestClientConformance before they are handed to code written against
+// heimdall.Client:
+//
+//	func TestConformance(t *testing.T) {
+//		heimdalltest.TestClientConformance(t, func() heimdall.Client {
+//			return NewTracingClient(heimdall.NewHTTPClient(1000))
+//		})
+//	}
+//
+// Both built-in clients are run through it with the tests of this package.
+//
+// Code sending requests with heimdall can be tested against a ScriptedServer,
+// which answers with a script of responses and records what it received:
+//
+//	server := heimdalltest.NewScriptedServer(t, heimdalltest.FailNTimes(2, heimdalltest.Step{Body: "ok"})...)
+//	client.SetRetryCount(2)
+//	response, err := client.Get(server.URL, http.Header{})
+package heimdalltest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gojektech/heimdall"
+)
+
+// promptly bounds how long a request stopped by its context, a timeout or a
+// cancellation may take to return
+const promptly = 2 * time.Second
+
+// TestClientConformance runs the conformance suite against the clients
+// factory makes, a fresh one for every check. The clients must send requests
+// to the URLs they are given, with a timeout of at least a second and, unless
+// set otherwise, no retries. Every method of heimdall.Client is exercised, and
+// so are the methods of the built-in clients a client also has, such as Do or
+// SetBaseURL; the checks of methods a client lacks are skipped:
+//
+//   - requests carry their method, headers and body, and responses their
+//     status, headers and body
+//   - a nil error always comes with a response with a status, and error
+//     statuses still return the status, headers and body of the response,
+//     alongside an error for 5xx
+//   - requests end promptly once their context is done or a timeout passes,
+//     with an error matching the context error
+//   - retries resend the body, and a response reports its request ID and the
+//     trace of every attempt
+//   - the setters take effect, and anything else asked for does what the
+//     documentation of the built-in clients says
+func TestClientConformance(t *testing.T, factory func() heimdall.Client) {
+	server := newConformanceServer()
+	defer server.Close()
+
+	checks := []struct {
+		name  string
+		check func(t *testing.T, server *conformanceServer, client heimdall.Client)
+	}{
+		{"methods", checkMethods},
+		{"error statuses", checkErrorStatuses},
+		{"context", checkContext},
+		{"timeouts", checkTimeouts},
+		{"retries", checkRetries},
+		{"base URL", checkBaseURL},
+		{"request builder", checkRequestBuilder},
+		{"async", checkAsync},
+		{"prewarm", checkPrewarm},
+		{"server-sent events", checkSSE},
+		{"mutators and middlewares", checkMutators},
+		{"response interceptors", checkInterceptors},
+		{"API version", checkAPIVersion},
+		{"baggage", checkBaggage},
+		{"validator", checkValidator},
+		{"host guard", checkHostGuard},
+		{"redirects", checkRedirects},
+		{"redaction", checkRedaction},
+		{"codecs", checkCodecs},
+		{"stats", checkStats},
+		{"hooks", checkHooks},
+		{"maintenance", checkMaintenance},
+		{"limits", checkLimits},
+		{"truncated bodies", checkTruncatedBodies},
+		{"transport", checkTransport},
+		{"in flight", checkInFlight},
+		{"with", checkWith},
+		{"introspection", checkIntrospection},
+	}
+	for _, c := range checks {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			client := factory()
+			if client == nil {
+				t.Fatal("factory returned a nil client")
+			}
+			c.check(t, server, client)
+		})
+	}
+}
+
+// skipUnless skips the check when the client lacks the methods it exercises
+func skipUnless(t *testing.T, ok bool, methods string) {
+	t.Helper()
+
+	if !ok {
+		t.Skipf("the client has no %s", methods)
+	}
+}
+
+// doer is a client sending requests built by the caller
+type doer interface {
+	heimdall.Client
+	Do(request *http.Request) (heimdall.Response, error)
+}
+
+// echo is what the conformance server answers /echo with
+type echo struct {
+	Method  string
+	Path    string
+	Query   string
+	Headers http.Header
+	Body    string
+}
+
+// conformanceServer serves the endpoints the checks send requests to:
+//
+//	/echo            answers 200 with the request as an echo
+//	/status/{code}   answers code with the body "status {code}"
+//	/fail            answers 500, recording the body of every attempt
+//	/hang            answers once the request is cancelled
+//	/redirect        redirects to /echo
+//	/deprecated      answers 200 with a Deprecation and a Sunset header
+//	/events          streams two server-sent events
+type conformanceServer struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	hits   map[string]int
+	bodies map[string][]string
+}
+
+func newConformanceServer() *conformanceServer {
+	s := &conformanceServer{hits: map[string]int{}, bodies: map[string][]string{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+
+	return s
+}
+
+func (s *conformanceServer) serve(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	key := r.Header.Get("X-Conformance-Key")
+
+	s.mu.Lock()
+	s.hits[key]++
+	s.bodies[key] = append(s.bodies[key], string(body))
+	s.mu.Unlock()
+
+	w.Header().Set("X-Served-Path", r.URL.Path)
+	switch path := r.URL.Path; {
+	case strings.HasPrefix(path, "/status/"):
+		code, _ := strconv.Atoi(strings.TrimPrefix(path, "/status/"))
+		w.WriteHeader(code)
+		fmt.Fprintf(w, "status %d", code)
+	case path == "/fail":
+		w.WriteHeader(http.StatusInternalServerError)
+	case path == "/hang":
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Minute):
+		}
+	case path == "/redirect":
+		http.Redirect(w, r, "/echo", http.StatusFound)
+	case path == "/deprecated":
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Sunset", "Thu, 31 Dec 2099 23:59:59 GMT")
+	case path == "/events":
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "id: 1\ndata: first\n\nid: 2\nevent: update\ndata: second\n\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(echo{Method: r.Method, Path: path, Query: r.URL.RawQuery, Headers: r.Header, Body: string(body)})
+	}
+}
+
+// sent returns how many requests carried key in X-Conformance-Key, and their
+// bodies
+func (s *conformanceServer) sent(key string) (int, []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.hits[key], append([]string(nil), s.bodies[key]...)
+}
+
+// keyed returns headers tagging requests with key, for sent to count them
+func keyed(key string) http.Header {
+	return http.Header{"X-Conformance-Key": []string{key}}
+}
+
+// decodeEcho returns the echo of response, failing t if it has none
+func decodeEcho(t *testing.T, response heimdall.Response, err error) echo {
+	t.Helper()
+
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	var e echo
+	if err := json.Unmarshal(response.Body(), &e); err != nil {
+		t.Fatalf("response is not the echo of the request: %v: %q", err, response.Body())
+	}
+
+	return e
+}
+
+func checkMethods(t *testing.T, server *conformanceServer, client heimdall.Client) {
+	url := server.URL + "/echo"
+	headers := http.Header{"X-Custom": []string{"a", "b"}, "Accept": []string{"application/json"}}
+	body := func() *strings.Reader { return strings.NewReader(`{"name":"heimdall"}`) }
+
+	cases := []struct {
+		method string
+		body   bool
+		send   func() (heimdall.Response, error)
+	}{
+		{http.MethodGet, false, func() (heimdall.Response, error) { return client.Get(url, headers) }},
+		{http.MethodPost, true, func() (heimdall.Response, error) { return client.Post(url, body(), headers) }},
+		{http.MethodPut, true, func() (heimdall.Response, error) { return client.Put(url, body(), headers) }},
+		{http.MethodPatch, true, func() (heimdall.Response, error) { return client.Patch(url, body(), headers) }},
+		{http.MethodDelete, false, func() (heimdall.Response, error) { return client.Delete(url, headers) }},
+	}
+	if c, ok := client.(interface {
+		Invoke(method, url string, body io.Reader, headers http.Header) (heimdall.Response, error)
+	}); ok {
+		cases = append(cases, struct {
+			method string
+			body   bool
+			send   func() (heimdall.Response, error)
+		}{http.MethodOptions, true, func() (heimdall.Response, error) {
+			return c.Invoke(http.MethodOptions, url, body(), headers)
+		}})
+	}
+	if c, ok := client.(doer); ok {
+		cases = append(cases, struct {
+			method string
+			body   bool
+			send   func() (heimdall.Response, error)
+		}{http.MethodPost, true, func() (heimdall.Response, error) {
+			request, _ := http.NewRequest(http.MethodPost, url, body())
+			request.Header = headers.Clone()
+			return c.Do(request)
+		}})
+	}
+	for _, c := range cases {
+		response, err := c.send()
+		e := decodeEcho(t, response, err)
+
+		if response.StatusCode() != http.StatusOK {
+			t.Errorf("%s: status %d, want 200", c.method, response.StatusCode())
+		}
+		if e.Method != c.method {
+			t.Errorf("%s: sent as %s", c.method, e.Method)
+		}
+		if got := e.Headers["X-Custom"]; len(got) != 2 || got[0] != "a" || got[1] != "b" {
+			t.Errorf("%s: X-Custom sent as %q, want every value in order", c.method, got)
+		}
+		if e.Headers.Get("Accept") != "application/json" {
+			t.Errorf("%s: Accept sent as %q", c.method, e.Headers.Get("Accept"))
+		}
+		if c.body && e.Body != `{"name":"heimdall"}` {
+			t.Errorf("%s: body sent as %q", c.method, e.Body)
+		}
+		if response.Headers().Get("X-Served-Path") != "/echo" {
+			t.Errorf("%s: response headers missing: %v", c.method, response.Headers())
+		}
+		if response.ContentType() != "application/json" {
+			t.Errorf("%s: content type %q", c.method, response.ContentType())
+		}
+	}
+	if len(headers) != 2 || len(headers["X-Custom"]) != 2 {
+		t.Errorf("the headers given were modified: %v", headers)
+	}
+}
+
+func checkErrorStatuses(t *testing.T, server *conformanceServer, client heimdall.Client) {
+	for _, code := range []int{http.StatusNotFound, http.StatusConflict, http.StatusServiceUnavailable} {
+		response, err := client.Get(server.URL+"/status/"+strconv.Itoa(code), http.Header{})
+		if code >= http.StatusInternalServerError && err == nil {
+			t.Errorf("%d: no error", code)
+		}
+		if response.StatusCode() != code {
+			t.Errorf("%d: response has status %d, with error %v", code, response.StatusCode(), err)
+		}
+		if string(response.Body()) != "status "+strconv.Itoa(code) {
+			t.Errorf("%d: response has body %q", code, response.Body())
+		}
+		if response.Headers().Get("X-Served-Path") == "" {
+			t.Errorf("%d: response has no headers", code)
+		}
+	}
+
+	response, err := client.Get(server.URL+"/status/204", http.Header{})
+	if err != nil || response.StatusCode() != http.StatusNoContent {
+		t.Errorf("204: status %d, error %v", response.StatusCode(), err)
+	}
+	if response.HasBody() {
+		t.Errorf("204: response has a body")
+	}
+
+	response, err = client.Get("http://127.0.0.1:1/unreachable", http.Header{})
+	if err == nil {
+		t.Errorf("a request to a closed port succeeded with status %d", response.StatusCode())
+	}
+}
+
+func checkContext(t *testing.T, server *conformanceServer, base heimdall.Client) {
+	client, ok := base.(interface {
+		doer
+		Use(middlewares ...heimdall.Middleware)
+	})
+	skipUnless(t, ok, "Do or Use")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	request, _ := http.NewRequest(http.MethodGet, server.URL+"/echo", nil)
+	request.Header = keyed("cancelled")
+	if _, err := client.Do(request.WithContext(ctx)); !errors.Is(err, context.Canceled) {
+		t.Errorf("a cancelled request returned %v, want an error matching context.Canceled", err)
+	}
+	if hits, _ := server.sent("cancelled"); hits != 0 {
+		t.Errorf("a cancelled request was sent %d times", hits)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	request, _ = http.NewRequest(http.MethodGet, server.URL+"/hang", nil)
+	start := time.Now()
+	_, err := client.Do(request.WithContext(ctx))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("a request past its deadline returned %v, want an error matching context.DeadlineExceeded", err)
+	}
+	if took := time.Since(start); took > promptly {
+		t.Errorf("a request past its deadline took %v to return", took)
+	}
+
+	ctx = context.WithValue(context.Background(), conformanceKey{}, "value")
+	seen := make(chan interface{}, 1)
+	client.Use(func(next heimdall.Doer) heimdall.Doer {
+		return heimdall.DoerFunc(func(request *http.Request) (*http.Response, error) {
+			seen <- request.Context().Value(conformanceKey{})
+			return next.Do(request)
+		})
+	})
+	request, _ = http.NewRequest(http.MethodGet, server.URL+"/echo", nil)
+	if _, err := client.Do(request.WithContext(ctx)); err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if value := <-seen; value != "value" {
+		t.Errorf("attempts lost the values of the request context, got %v", value)
+	}
+}
+
+type conformanceKey struct{}
+
+func checkTimeouts(t *testing.T, server *conformanceServer, base heimdall.Client) {
+	client, ok := base.(interface {
+		heimdall.Client
+		SetResponseHeaderTimeout(timeout time.Duration)
+	})
+	skipUnless(t, ok, "SetResponseHeaderTimeout")
+
+	client.SetResponseHeaderTimeout(50 * time.Millisecond)
+
+	start := time.Now()
+	if _, err := client.Get(server.URL+"/hang", http.Header{}); err == nil {
+		t.Errorf("a request past the response header timeout succeeded")
+	}
+	if took := time.Since(start); took > promptly {
+		t.Errorf("a request past the response header timeout took %v to return", took)
+	}
+
+	client.SetResponseHeaderTimeout(0)
+	if _, err := client.Get(server.URL+"/echo", http.Header{}); err != nil {
+		t.Errorf("request failed once the response header timeout was disabled: %v", err)
+	}
+}
+
+func checkRetries(t *testing.T, server *conformanceServer, client heimdall.Client) {
+	response, err := client.Post(server.URL+"/fail", strings.NewReader("once"), keyed("unretried"))
+	if err == nil {
+		t.Errorf("a 500 succeeded")
+	}
+	if hits, _ := server.sent("unretried"); hits != 1 {
+		t.Errorf("a request was sent %d times without retries", hits)
+	}
+
+	client.SetRetryCount(2)
+	client.SetRetrier(heimdall.NewRetrier(heimdall.NewConstantBackoff(1)))
+	response, err = client.Post(server.URL+"/fail", strings.NewReader("again"), keyed("retried"))
+	if err == nil {
+		t.Errorf("a request failing every attempt succeeded")
+	}
+	if response.StatusCode() != http.StatusInternalServerError {
+		t.Errorf("a request failing every attempt returned status %d", response.StatusCode())
+	}
+	hits, bodies := server.sent("retried")
+	if hits != 3 {
+		t.Errorf("a request with 2 retries was sent %d times", hits)
+	}
+	for i, body := range bodies {
+		if body != "again" {
+			t.Errorf("attempt %d sent the body %q", i, body)
+		}
+	}
+
+	trace := response.Trace()
+	if response.RequestID() == "" || trace.RequestID != response.RequestID() {
+		t.Errorf("request ID %q, trace for %q", response.RequestID(), trace.RequestID)
+	}
+	if len(trace.Attempts) != hits {
+		t.Errorf("trace of %d attempts for %d sent", len(trace.Attempts), hits)
+	}
+	for i, attempt := range trace.Attempts {
+		if attempt.Attempt != i || attempt.StatusCode != http.StatusInternalServerError {
+			t.Errorf("attempt %d traced as %+v", i, attempt)
+		}
+	}
+
+	response, err = client.Get(server.URL+"/echo", http.Header{})
+	if err != nil || len(response.Trace().Attempts) != 1 || response.RequestID() == "" {
+		t.Errorf("a successful request has request ID %q and a trace of %d attempts, error %v", response.RequestID(), len(response.Trace().Attempts), err)
+	}
+
+	for i, attempt := range trace.Attempts {
+		if attempt.ConnectFailure {
+			t.Errorf("attempt %d answered with a 500 traced as a connect failure", i)
+		}
+	}
+
+	connect, ok := client.(interface {
+		SetConnectFailureRetrier(retrier heimdall.Retriable)
+	})
+	if !ok {
+		return
+	}
+	refused := httptest.NewServer(http.NotFoundHandler())
+	refused.Close()
+	connect.SetConnectFailureRetrier(heimdall.NewRetrier(heimdall.NewConstantBackoff(1)))
+	response, err = client.Get(refused.URL, http.Header{})
+	if attempts := response.Trace().Attempts; err == nil || len(attempts) != 3 || !attempts[0].ConnectFailure || !attempts[1].ConnectFailure {
+		t.Errorf("a refused request was traced as %+v, error %v", attempts, err)
+	}
+}
+
+func checkBaseURL(t *testing.T, server *conformanceServer, base heimdall.Client) {
+	client, ok := base.(interface {
+		heimdall.Client
+		SetBaseURL(base string)
+	})
+	skipUnless(t, ok, "SetBaseURL")
+
+	client.SetBaseURL(server.URL + "/v1/")
+	response, err := client.Get("users/42?full=1", http.Header{})
+	e := decodeEcho(t, response, err)
+	if e.Path != "/v1/users/42" || e.Query != "full=1" {
+		t.Errorf("relative URL sent to %s?%s", e.Path, e.Query)
+	}
+
+	response, err = client.Get(server.URL+"/echo", http.Header{})
+	e = decodeEcho(t, response, err)
+	if e.Path != "/echo" {
+		t.Errorf("absolute URL sent to %s", e.Path)
+	}
+}
+
+func checkRequestBuilder(t *testing.T, server *conformanceServer, base heimdall.Client) {
+	client, ok := base.(interface {
+		NewRequest(method, template string) *heimdall.RequestBuilder
+	})
+	skipUnless(t, ok, "NewRequest")
+
+	response, err := client.NewRequest(http.MethodPut, server.URL+"/items/{id}").
+		PathParam("id", "a b").
+		QueryParam("force", "true").
+		Header("X-Custom", "built").
+		Body(strings.NewReader("payload")).
+		Do(context.Background())
+	e := decodeEcho(t, response, err)
+	if e.Method != http.MethodPut || e.Path != "/items/a b" || e.Query != "force=true" {
+		t.Errorf("built request sent as %s %s?%s", e.Method, e.Path, e.Query)
+	}
+	if e.Headers.Get("X-Custom") != "built" || e.Body != "payload" {
+		t.Errorf("built request sent with X-Custom %q and body %q", e.Headers.Get("X-Custom"), e.Body)
+	}
+}
+
+func checkAsync(t *testing.T, server *conformanceServer, base heimdall.Client) {
+	client, ok := base.(interface {
+		PostAsync(url string, body []byte, headers http.Header) error
+		Flush(ctx context.Context) error
+	})
+	skipUnless(t, ok, "PostAsync or Flush")
+
+	for i := 0; i < 3; i++ {
+		if err := client.PostAsync(server.URL+"/echo", []byte("queued"), keyed("async")); err != nil {
+			t.Fatalf("PostAsync failed: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), promptly)
+	defer cancel()
+	if err := client.Flush(ctx); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	hits, bodies := server.sent("async")
+	if hits != 3 {
+		t.Errorf("%d of 3 queued requests were sent once Flush returned", hits)
+	}
+	for _, body := range bodies {
+		if body != "queued" {
+			t.Errorf("queued request sent with body %q", body)
+		}
+	}
+}
+
+func checkPrewarm(t *testing.T, server *conformanceServer, base heimdall.Client) {
+	client, ok := base.(interface {
+		Prewarm(ctx context.Context, urls ...string) error
+	})
+	skipUnless(t, ok, "Prewarm")
+
+	ctx, cancel := context.WithTimeout(context.Background(), promptly)
+	defer cancel()
+	if err := client.Prewarm(ctx, server.URL); err != nil {
+		t.Errorf("Prewarm failed: %v", err)
+	}
+}
+
+func checkSSE(t *testing.T, server *conformanceServer, base heimdall.Client) {
+	client, ok := base.(interface {
+		GetSSE(ctx context.Context, url string, headers http.Header) (<-chan heimdall.Event, func(), error)
+	})
+	skipUnless(t, ok, "GetSSE")
+
+	ctx, cancel := context.WithTimeout(context.Background(), promptly)
+	defer cancel()
+	events, stop, err := client.GetSSE(ctx, server.URL+"/events", http.Header{})
+	if err != nil {
+		t.Fatalf("GetSSE failed: %v", err)
+	}
+
+	want := []heimdall.Event{{ID: "1", Type: "message", Data: "first"}, {ID: "2", Type: "update", Data: "second"}}
+	for _, w := range want {
+		select {
+		case event := <-events:
+			if event != w {
+				t.Errorf("event %+v, want %+v", event, w)
+			}
+		case <-ctx.Done():
+			t.Fatalf("no event %+v", w)
+		}
+	}
+
+	stop()
+	for {
+		select {
+		case _, open := <-events:
+			if !open {
+				return
+			}
+		case <-ctx.Done():
+			t.Fatal("the events channel is still open once the stream was closed")
+		}
+	}
+}
+
+func checkMutators(t *testing.T, server *conformanceServer, base heimdall.Client) {
+	client, ok := base.(interface {
+		heimdall.Client
+		AddRequestMutator(mutator heimdall.RequestMutator)
+		SetRawRequestMutator(mutator func(*http.Request))
+		Use(middlewares ...heimdall.Middleware)
+	})
+	skipUnless(t, ok, "AddRequestMutator, SetRawRequestMutator or Use")
+
+	var order []string
+	client.AddRequestMutator(heimdall.RequestMutatorFunc(func(request *http.Request) error {
+		request.Header.Set("X-Mutated", "yes")
+		return nil
+	}))
+	client.SetRawRequestMutator(func(request *http.Request) {
+		request.Header.Set("X-Raw", request.Header.Get("X-Mutated"))
+	})
+	client.Use(func(next heimdall.Doer) heimdall.Doer {
+		return heimdall.DoerFunc(func(request *http.Request) (*http.Response, error) {
+			order = append(order, "outer")
+			request.Header.Set("X-Middleware", "outer")
+			return next.Do(request)
+		})
+	}, func(next heimdall.Doer) heimdall.Doer {
+		return heimdall.DoerFunc(func(request *http.Request) (*http.Response, error) {
+			order = append(order, "inner")
+			response, err := next.Do(request)
+			if err == nil {
+				response.Header.Set("X-Seen-By", "inner")
+			}
+			return response, err
+		})
+	})
+
+	response, err := client.Get(server.URL+"/echo", http.Header{})
+	e := decodeEcho(t, response, err)
+	for _, name := range []string{"X-Mutated", "X-Raw", "X-Middleware"} {
+		if e.Headers.Get(name) == "" {
+			t.Errorf("%s was not sent: %v", name, e.Headers)
+		}
+	}
+	if strings.Join(order, ",") != "outer,inner" {
+		t.Errorf("middlewares ran in the order %v, want the first outermost", order)
+	}
+	if response.Headers().Get("X-Seen-By") != "inner" {
+		t.Errorf("the response of the middlewares was not returned")
+	}
+
+	client.AddRequestMutator(heimdall.RequestMutatorFunc(func(request *http.Request) error {
+		return errors.New("refused")
+	}))
+	if _, err := client.Get(server.URL+"/echo", keyed("mutator failed")); err == nil {
+		t.Errorf("a request whose mutator failed succeeded")
+	}
+	if hits, _ := server.sent("mutator failed"); hits != 0 {
+		t.Errorf("a request whose mutator failed was sent")
+	}
+}
+
+func checkInterceptors(t *testing.T, server *conformanceServer, base heimdall.Client) {
+	client, ok := base.(interface {
+		heimdall.Client
+		UseResponseInterceptor(interceptor heimdall.ResponseInterceptor, opts ...heimdall.InterceptorOption)
+	})
+	skipUnless(t, ok, "UseResponseInterceptor")
+
+	mark := func(name string) heimdall.ResponseInterceptor {
+		return func(response *heimdall.Response) error {
+			headers := response.Headers()
+			headers.Add("X-Intercepted", name)
+			response.SetHeaders(headers)
+			return nil
+		}
+	}
+	client.UseResponseInterceptor(mark("first"))
+	client.UseResponseInterceptor(mark("second"))
+	client.UseResponseInterceptor(func(response *heimdall.Response) error {
+		response.SetBody([]byte("status scrubbed"))
+		return nil
+	}, heimdall.InterceptErrorResponses())
+
+	response, err := client.Get(server.URL+"/status/200", http.Header{})
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if got := strings.Join(response.Headers().Values("X-Intercepted"), ","); got != "first,second" {
+		t.Errorf("interceptors ran as %q, want in the order they were registered", got)
+	}
+	if string(response.Body()) != "status scrubbed" {
+		t.Errorf("the body of the interceptors was not returned: %q", response.Body())
+	}
+
+	response, _ = client.Get(server.URL+"/status/503", http.Header{})
+	if response.StatusCode() != http.StatusServiceUnavailable {
+		t.Fatalf("503: response has status %d", response.StatusCode())
+	}
+	if len(response.Headers().Values("X-Intercepted")) != 0 {
+		t.Errorf("interceptors ran on an error response")
+	}
+	if string(response.Body()) != "status scrubbed" {
+		t.Errorf("an interceptor for error responses did not run: %q", response.Body())
+	}
+
+	refused := errors.New("refused by policy")
+	client.UseResponseInterceptor(func(response *heimdall.Response) error {
+		return refused
+	})
+	response, err = client.Get(server.URL+"/status/200", keyed("interceptor refused"))
+	if !errors.Is(err, refused) {
+		t.Errorf("a request refused by an interceptor returned %v", err)
+	}
+	if response.StatusCode() != 0 {
+		t.Errorf("a request refused by an interceptor returned a response with status %d", response.StatusCode())
+	}
+	if hits, _ := server.sent("interceptor refused"); hits != 1 {
+		t.Errorf("a request refused by an interceptor was sent %d times, want once", hits)
+	}
+}
+
+func checkAPIVersion(t *testing.T, server *conformanceServer, base heimdall.Client) {
+	client, ok := base.(interface {
+		heimdall.Client
+		SetAPIVersion(strategy heimdall.VersionStrategy)
+	})
+	skipUnless(t, ok, "SetAPIVersion")
+
+	client.SetAPIVersion(heimdall.HeaderVersion("X-API-Version", "2"))
+
+	headers := http.Header{}
+	response, err := client.Get(server.URL+"/echo", headers)
+	if e := decodeEcho(t, response, err); e.Headers.Get("X-API-Version") != "2" {
+		t.Errorf("the API version was not sent: %v", e.Headers)
+	}
+	if len(headers) != 0 {
+		t.Errorf("the API version was set on the caller's headers: %v", headers)
+	}
+
+	response, err = client.Get(server.URL+"/status/406", http.Header{})
+	var rejected *heimdall.ErrAPIVersionRejected
+	if !errors.As(err, &rejected) || rejected.Version != "2" {
+		t.Errorf("a 406 returned %v, want an *ErrAPIVersionRejected", err)
+	}
+	if response.StatusCode() != http.StatusNotAcceptable {
+		t.Errorf("a rejected version returned a response with status %d", response.StatusCode())
+	}
+}
+
+func checkBaggage(t *testing.T, server *conformanceServer, base heimdall.Client) {
+	client, ok := base.(interface {
+		doer
+		SetBaggagePropagation(allowlist []string, maxTotalBytes int, opts ...heimdall.BaggageOption)
+	})
+	skipUnless(t, ok, "Do or SetBaggagePropagation")
+
+	client.SetBaggagePropagation([]string{"Baggage", "X-Context"}, 64)
+
+	ctx := heimdall.ContextWithBaggage(context.Background(), "baggage", "user=42")
+	ctx = heimdall.ContextWithBaggage(ctx, "X-Context", strings.Repeat("x", 45))
+	ctx = heimdall.ContextWithBaggage(ctx, "X-Not-Allowed", "1")
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/echo", nil)
+	if err != nil {
+		t.Fatalf("building the request failed: %v", err)
+	}
+	response, err := client.Do(request)
+	e := decodeEcho(t, response, err)
+	if e.Headers.Get("Baggage") != "user=42" {
+		t.Errorf("the baggage of the context was not sent: %v", e.Headers)
+	}
+	if e.Headers.Get("X-Context") != "" || e.Headers.Get("X-Not-Allowed") != "" {
+		t.Errorf("baggage over the budget or not allowed was sent: %v", e.Headers)
+	}
+	if len(request.Header) != 0 {
+		t.Errorf("the baggage was set on the caller's headers: %v", request.Header)
+	}
+
+	response, err = client.Get(server.URL+"/echo", http.Header{})
+	e = decodeEcho(t, response, err)
+	if e.Headers.Get("Baggage") != "" {
+		t.Errorf("baggage was sent without a context carrying any: %v", e.Headers)
+	}
+}
+
+func checkValidator(t *testing.T, server *conformanceServer, base heimdall.Client) {
+	client, ok := base.(interface {
+		heimdall.Client
+		SetRequestValidator(validator heimdall.RequestValidator)
+	})
+	skipUnless(t, ok, "SetRequestValidator")
+
+	refused := errors.New("no deletes")
+	client.SetRequestValidator(func(request *http.Request) error {
+		if request.Method == http.MethodDelete {
+			return refused
+		}
+		return nil
+	})
+
+	_, err := client.Delete(server.URL+"/echo", keyed("rejected"))
+	var rejected *heimdall.ErrRequestRejected
+	if !errors.As(err, &rejected) || !errors.Is(err, refused) {
+		t.Errorf("a rejected request returned %v, want an *ErrRequestRejected for the error of the validator", err)
+	}
+	if hits, _ := server.sent("rejected"); hits != 0 {
+		t.Errorf("a rejected request was sent")
+	}
+	if _, err := client.Get(server.URL+"/echo", http.Header{}); err != nil {
+		t.Errorf("an accepted request failed: %v", err)
+	}
+}
+
+func checkHostGuard(t *testing.T, server *conformanceServer, base heimdall.Client) {
+	client, ok := base.(interface {
+		heimdall.Client
+		SetAllowedHosts(patterns []string)
+		SetBlockPrivateNetworks(block bool)
+	})
+	skipUnless(t, ok, "SetAllowedHosts or SetBlockPrivateNetworks")
+
+	var forbidden *heimdall.ErrForbiddenHost
+
+	client.SetAllowedHosts([]string{"*.example.com"})
+	if _, err := client.Get(server.URL+"/echo", keyed("not allowed")); !errors.As(err, &forbidden) {
+		t.Errorf("a request to a host not allowed returned %v, want an *ErrForbiddenHost", err)
+	}
+	client.SetAllowedHosts([]string{"127.0.0.1"})
+	if _, err := client.Get(server.URL+"/echo", http.Header{}); err != nil {
+		t.Errorf("a request to an allowed host failed: %v", err)
+	}
+	client.SetAllowedHosts(nil)
+
+	client.SetBlockPrivateNetworks(true)
+	if _, err := client.Get(server.URL+"/echo", keyed("private")); !errors.As(err, &forbidden) {
+		t.Errorf("a request to a private network returned %v, want an *ErrForbiddenHost", err)
+	}
+	client.SetBlockPrivateNetworks(false)
+	if _, err := client.Get(server.URL+"/echo", http.Header{}); err != nil {
+		t.Errorf("a request failed once private networks were unblocked: %v", err)
+	}
+
+	if hits, _ := server.sent("not allowed"); hits != 0 {
+		t.Errorf("a request to a host not allowed was sent")
+	}
+	if hits, _ := server.sent("private"); hits != 0 {
+		t.Errorf("a request to a private network was sent")
+	}
+}
+
+func checkRedirects(t *testing.T, server *conformanceServer, base heimdall.Client) {
+	client, ok := base.(interface {
+		heimdall.Client
+		SetMaxRedirects(n int)
+		SetReturnRedirects(enabled bool)
+	})
+	skipUnless(t, ok, "SetMaxRedirects or SetReturnRedirects")
+
+	response, err := client.Get(server.URL+"/redirect", http.Header{})
+	if e := decodeEcho(t, response, err); e.Path != "/echo" {
+		t.Errorf("redirect followed to %s", e.Path)
+	}
+	if response.FinalURL() != server.URL+"/echo" {
+		t.Errorf("final URL %q of a redirected request", response.FinalURL())
+	}
+	hop := heimdall.RedirectHop{URL: server.URL + "/redirect", StatusCode: http.StatusFound, Location: "/echo"}
+	if chain := response.RedirectChain(); len(chain) != 1 || chain[0] != hop {
+		t.Errorf("redirect chain %+v of a redirected request", chain)
+	}
+
+	client.SetMaxRedirects(0)
+	_, err = client.Get(server.URL+"/redirect", http.Header{})
+	var tooMany *heimdall.ErrTooManyRedirects
+	if !errors.As(err, &tooMany) || len(tooMany.Chain) != 1 || tooMany.Chain[0] != hop {
+		t.Errorf("a redirect beyond the maximum failed with %v", err)
+	}
+	client.SetMaxRedirects(10)
+
+	client.SetReturnRedirects(true)
+	response, err = client.Get(server.URL+"/redirect", http.Header{})
+	if err != nil || response.StatusCode() != http.StatusFound || response.Headers().Get("Location") != "/echo" {
+		t.Errorf("returned redirect has status %d and Location %q, error %v", response.StatusCode(), response.Headers().Get("Location"), err)
+	}
+}
+
+func checkRedaction(t *testing.T, server *conformanceServer, base heimdall.Client) {
+	client, ok := base.(interface {
+		SetSensitiveHeaders(names ...string)
+		RedactHeaders(headers http.Header) http.Header
+	})
+	skipUnless(t, ok, "SetSensitiveHeaders or RedactHeaders")
+
+	headers := http.Header{"Authorization": []string{"Bearer token"}, "X-Secret": []string{"hush"}}
+
+	redacted := client.RedactHeaders(headers)
+	if redacted.Get("Authorization") == "Bearer token" {
+		t.Errorf("Authorization is not redacted by default")
+	}
+	if redacted.Get("X-Secret") != "hush" {
+		t.Errorf("X-Secret is redacted by default")
+	}
+
+	client.SetSensitiveHeaders("X-Secret")
+	redacted = client.RedactHeaders(headers)
+	if redacted.Get("X-Secret") == "hush" {
+		t.Errorf("X-Secret is not redacted once sensitive")
+	}
+	if headers.Get("X-Secret") != "hush" || headers.Get("Authorization") != "Bearer token" {
+		t.Errorf("RedactHeaders modified the headers given: %v", headers)
+	}
+}
+
+type conformanceCodec struct{}
+
+func (conformanceCodec) ContentType() string { return "application/x-conformance" }
+
+func (conformanceCodec) Marshal(v interface{}) ([]byte, error) { return []byte(fmt.Sprint(v)), nil }
+
+func (conformanceCodec) Unmarshal(data []byte, v interface{}) error { return nil }
+
+func checkCodecs(t *testing.T, server *conformanceServer, base heimdall.Client) {
+	client, ok := base.(interface {
+		RegisterCodec(codec heimdall.Codec)
+		Codec(contentType string) (heimdall.Codec, error)
+	})
+	skipUnless(t, ok, "RegisterCodec or Codec")
+
+	if codec, err := client.Codec("application/json; charset=utf-8"); err != nil || codec == nil {
+		t.Errorf("no JSON codec: %v", err)
+	}
+
+	var unsupported *heimdall.ErrUnsupportedContentType
+	if _, err := client.Codec("application/x-conformance"); !errors.As(err, &unsupported) {
+		t.Errorf("codec for an unregistered content type returned %v, want an *ErrUnsupportedContentType", err)
+	}
+	client.RegisterCodec(conformanceCodec{})
+	if codec, err := client.Codec("application/x-conformance"); err != nil || codec == nil || codec.ContentType() != "application/x-conformance" {
+		t.Errorf("registered codec not returned: %v, %v", codec, err)
+	}
+}
+
+func checkStats(t *testing.T, server *conformanceServer, base heimdall.Client) {
+	client, ok := base.(interface {
+		heimdall.Client
+		Stats() heimdall.ClientStats
+		ResetStats()
+	})
+	skipUnless(t, ok, "Stats or ResetStats")
+
+	client.Get(server.URL+"/echo", http.Header{})
+	client.Get(server.URL+"/echo", http.Header{})
+	client.Get(server.URL+"/fail", http.Header{})
+
+	stats := client.Stats()
+	if stats.Requests != 3 || stats.Successes != 2 || stats.Failures != 1 {
+		t.Errorf("stats count %d requests, %d successes and %d failures, want 3, 2 and 1", stats.Requests, stats.Successes, stats.Failures)
+	}
+
+	client.ResetStats()
+	if stats := client.Stats(); stats.Requests != 0 {
+		t.Errorf("stats count %d requests once reset", stats.Requests)
+	}
+}
+
+func checkHooks(t *testing.T, server *conformanceServer, base heimdall.Client) {
+	client, ok := base.(interface {
+		heimdall.Client
+		SetSlowRequestHook(threshold time.Duration, maxPerMinute int, fn func(heimdall.SlowRequestReport))
+		SetFailureClassifier(classifier func(response *heimdall.Response, attemptDuration time.Duration) bool)
+		SetDeprecationHook(interval time.Duration, fn func(url string, info heimdall.DeprecationInfo))
+		EnableAuditLog(sink func(heimdall.AuditRecord), sampleRate float64, opts ...heimdall.AuditOption)
+		SetBodyRetryPredicate(maxInspectBytes int, fn func(statusCode int, body []byte) bool)
+	})
+	skipUnless(t, ok, "SetSlowRequestHook, SetFailureClassifier, SetDeprecationHook, EnableAuditLog or SetBodyRetryPredicate")
+
+	var reports int32
+	client.SetSlowRequestHook(time.Nanosecond, 0, func(report heimdall.SlowRequestReport) {
+		atomic.AddInt32(&reports, 1)
+	})
+	client.SetFailureClassifier(func(response *heimdall.Response, attemptDuration time.Duration) bool {
+		return response.StatusCode() == http.StatusAccepted
+	})
+	var deprecations []heimdall.DeprecationInfo
+	client.SetDeprecationHook(time.Hour, func(url string, info heimdall.DeprecationInfo) {
+		deprecations = append(deprecations, info)
+	})
+	audited := make(chan heimdall.AuditRecord, 10)
+	client.EnableAuditLog(func(record heimdall.AuditRecord) { audited <- record }, 1)
+
+	if _, err := client.Get(server.URL+"/echo", http.Header{}); err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	response, err := client.Get(server.URL+"/status/202", http.Header{})
+	var classified *heimdall.ErrClassifiedFailure
+	if !errors.As(err, &classified) || response.StatusCode() != http.StatusAccepted {
+		t.Errorf("a response the classifier fails returned status %d and %v, want an *ErrClassifiedFailure", response.StatusCode(), err)
+	}
+
+	if n := atomic.LoadInt32(&reports); n != 2 {
+		t.Errorf("%d slow request reports, want 2", n)
+	}
+
+	client.SetBodyRetryPredicate(64, func(statusCode int, body []byte) bool {
+		return string(body) == "status 203"
+	})
+	response, err = client.Get(server.URL+"/status/203", http.Header{})
+	var retryable *heimdall.ErrRetryableBody
+	if !errors.As(err, &retryable) || string(response.Body()) != "status 203" {
+		t.Errorf("a body the predicate flags returned %q and %v, want the body and an *ErrRetryableBody", response.Body(), err)
+	}
+	client.SetBodyRetryPredicate(0, nil)
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.Get(server.URL+"/deprecated?page="+strconv.Itoa(i), http.Header{}); err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+	}
+	if len(deprecations) != 1 || !deprecations[0].Deprecated || deprecations[0].Sunset.Year() != 2099 {
+		t.Errorf("deprecation reports %+v, want one of a deprecated endpoint sunset in 2099", deprecations)
+	}
+	select {
+	case record := <-audited:
+		if record.Method != http.MethodGet || record.StatusCode != http.StatusOK {
+			t.Errorf("audit record %+v", record)
+		}
+	case <-time.After(promptly):
+		t.Errorf("no audit record")
+	}
+}
+
+func checkMaintenance(t *testing.T, server *conformanceServer, base heimdall.Client) {
+	client, ok := base.(interface {
+		heimdall.Client
+		SetMaintenanceDetector(detector func(*heimdall.Response) (inMaintenance bool, retryAt time.Time))
+		SetMaintenanceHook(fn func(heimdall.MaintenanceEvent))
+	})
+	skipUnless(t, ok, "SetMaintenanceDetector or SetMaintenanceHook")
+
+	retryAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	client.SetMaintenanceDetector(func(response *heimdall.Response) (bool, time.Time) {
+		return response.StatusCode() == http.StatusServiceUnavailable, retryAt
+	})
+	var events []heimdall.MaintenanceEvent
+	client.SetMaintenanceHook(func(event heimdall.MaintenanceEvent) {
+		events = append(events, event)
+	})
+	client.SetRetryCount(2)
+
+	response, err := client.Get(server.URL+"/status/503", keyed("maintenance"))
+	var maintenance *heimdall.ErrUpstreamMaintenance
+	if !errors.As(err, &maintenance) || !maintenance.RetryAt.Equal(retryAt) {
+		t.Fatalf("a response announcing maintenance returned %v, want an *ErrUpstreamMaintenance", err)
+	}
+	if response.StatusCode() != http.StatusServiceUnavailable {
+		t.Errorf("a response announcing maintenance was returned with status %d", response.StatusCode())
+	}
+	if _, err := client.Get(server.URL+"/echo", keyed("maintenance")); !errors.As(err, &maintenance) {
+		t.Errorf("a request to a host in maintenance returned %v", err)
+	}
+	if hits, _ := server.sent("maintenance"); hits != 1 {
+		t.Errorf("%d requests were sent to a host in maintenance, want the one announcing it", hits)
+	}
+	if len(events) != 1 || !events[0].InMaintenance || !events[0].RetryAt.Equal(retryAt) {
+		t.Errorf("maintenance events %+v, want one entry", events)
+	}
+}
+
+func checkLimits(t *testing.T, server *conformanceServer, base heimdall.Client) {
+	client, ok := base.(interface {
+		heimdall.Client
+		SetDrainLimit(limit int64)
+		SetMinAttemptBudget(budget time.Duration)
+		SetTenantLimits(defaults heimdall.TenantLimits, overrides map[string]heimdall.TenantLimits)
+		SetMaxInFlightBodyBytes(n int64)
+	})
+	skipUnless(t, ok, "SetDrainLimit, SetMinAttemptBudget, SetTenantLimits or SetMaxInFlightBodyBytes")
+
+	client.SetDrainLimit(1024)
+	client.SetMinAttemptBudget(time.Millisecond)
+	client.SetTenantLimits(heimdall.TenantLimits{}, nil)
+	if _, err := client.Get(server.URL+"/echo", http.Header{}); err != nil {
+		t.Errorf("request failed with limits that leave it be: %v", err)
+	}
+
+	client.SetMaxInFlightBodyBytes(4)
+	_, err := client.Post(server.URL+"/echo", bytes.NewReader([]byte("too large")), keyed("over budget"))
+	var exceeded *heimdall.ErrBodyBudgetExceeded
+	if !errors.As(err, &exceeded) {
+		t.Errorf("a body over the in-flight budget returned %v, want an *ErrBodyBudgetExceeded", err)
+	}
+	if hits, _ := server.sent("over budget"); hits != 0 {
+		t.Errorf("a body over the in-flight budget was sent")
+	}
+	client.SetMaxInFlightBodyBytes(0)
+	if _, err := client.Post(server.URL+"/echo", bytes.NewReader([]byte("too large")), http.Header{}); err != nil {
+		t.Errorf("request failed once the in-flight budget was removed: %v", err)
+	}
+}
+
+func checkTruncatedBodies(t *testing.T, server *conformanceServer, base heimdall.Client) {
+	client, ok := base.(interface {
+		heimdall.Client
+		Use(middlewares ...heimdall.Middleware)
+		SetStrictContentLength(strict bool)
+	})
+	skipUnless(t, ok, "Use or SetStrictContentLength")
+
+	client.Use(func(next heimdall.Doer) heimdall.Doer {
+		return heimdall.DoerFunc(func(request *http.Request) (*http.Response, error) {
+			response, err := next.Do(request)
+			if err == nil {
+				response.Body.Close()
+				response.ContentLength = 20
+				response.Body = ioutil.NopCloser(strings.NewReader("short"))
+			}
+			return response, err
+		})
+	})
+
+	_, err := client.Get(server.URL+"/echo", http.Header{})
+	var truncated *heimdall.ErrTruncatedBody
+	if !errors.As(err, &truncated) || truncated.Expected != 20 || truncated.Got != 5 {
+		t.Errorf("a body short of its Content-Length returned %v, want an *ErrTruncatedBody", err)
+	}
+
+	client.SetStrictContentLength(false)
+	response, err := client.Get(server.URL+"/echo", http.Header{})
+	if err != nil || string(response.Body()) != "short" {
+		t.Errorf("an unchecked body returned %q and %v", response.Body(), err)
+	}
+}
+
+type countingTransport struct {
+	requests int32
+}
+
+func (c *countingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&c.requests, 1)
+	return http.DefaultTransport.RoundTrip(request)
+}
+
+func checkTransport(t *testing.T, server *conformanceServer, base heimdall.Client) {
+	client, ok := base.(interface {
+		heimdall.Client
+		SetProxyBypass(patterns []string) error
+		SwapTransport(rt http.RoundTripper)
+	})
+	skipUnless(t, ok, "SetProxyBypass or SwapTransport")
+
+	if err := client.SetProxyBypass([]string{"127.0.0.0/8"}); err != nil {
+		t.Errorf("SetProxyBypass failed: %v", err)
+	}
+	if err := client.SetProxyBypass([]string{"10.0.0.0/33"}); err == nil {
+		t.Errorf("SetProxyBypass accepted an invalid CIDR range")
+	}
+
+	transport := &countingTransport{}
+	client.SwapTransport(transport)
+	if _, err := client.Get(server.URL+"/echo", http.Header{}); err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if n := atomic.LoadInt32(&transport.requests); n != 1 {
+		t.Errorf("the swapped in transport sent %d requests, want 1", n)
+	}
+}
+
+func checkInFlight(t *testing.T, server *conformanceServer, base heimdall.Client) {
+	client, ok := base.(interface {
+		heimdall.Client
+		InFlight() []heimdall.InFlightRequest
+		CancelInFlight(hostPattern string) int
+	})
+	skipUnless(t, ok, "InFlight or CancelInFlight")
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.Get(server.URL+"/hang", http.Header{})
+		done <- err
+	}()
+
+	deadline := time.Now().Add(promptly)
+	for len(client.InFlight()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the request sent is not in flight")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if request := client.InFlight()[0]; request.Method != http.MethodGet || request.Path != "/hang" {
+		t.Errorf("in flight request %+v", request)
+	}
+
+	if n := client.CancelInFlight("*.example.com"); n != 0 {
+		t.Errorf("cancelled %d requests to other hosts", n)
+	}
+	if n := client.CancelInFlight("127.0.0.1"); n != 1 {
+		t.Errorf("cancelled %d requests, want 1", n)
+	}
+	select {
+	case err := <-done:
+		if !errors.Is(err, heimdall.ErrOperatorCancelled) || !errors.Is(err, context.Canceled) {
+			t.Errorf("a cancelled request returned %v, want an error matching ErrOperatorCancelled and context.Canceled", err)
+		}
+	case <-time.After(promptly):
+		t.Fatal("the cancelled request did not return")
+	}
+	if requests := client.InFlight(); len(requests) != 0 {
+		t.Errorf("requests still in flight: %+v", requests)
+	}
+}
+
+// scoper is a client handing out views with RequestOptions applied
+type scoper interface {
+	heimdall.Client
+	With(opts ...heimdall.RequestOption) heimdall.Client
+}
+
+func checkWith(t *testing.T, server *conformanceServer, base heimdall.Client) {
+	client, ok := base.(scoper)
+	skipUnless(t, ok, "With")
+
+	view, ok := client.With(heimdall.Header("X-Scope", "outer"), heimdall.Retry(1)).(scoper)
+	if !ok {
+		t.Fatal("With returned a client without With")
+	}
+	nested := view.With(heimdall.Header("X-Scope", "inner"))
+
+	for name, tc := range map[string]struct {
+		client  heimdall.Client
+		headers http.Header
+		want    string
+	}{
+		"the original":  {client: client, headers: http.Header{}, want: ""},
+		"a view":        {client: view, headers: http.Header{}, want: "outer"},
+		"a nested view": {client: nested, headers: http.Header{}, want: "inner"},
+		"a request":     {client: nested, headers: http.Header{"X-Scope": {"request"}}, want: "request"},
+	} {
+		response, err := tc.client.Get(server.URL+"/echo", tc.headers)
+		if e := decodeEcho(t, response, err); e.Headers.Get("X-Scope") != tc.want {
+			t.Errorf("%s sent X-Scope %q, want %q", name, e.Headers.Get("X-Scope"), tc.want)
+		}
+	}
+
+	client.Get(server.URL+"/fail", keyed("with original"))
+	nested.Get(server.URL+"/fail", keyed("with view"))
+	if hits, _ := server.sent("with original"); hits != 1 {
+		t.Errorf("a view with 1 retry changed the original, which sent %d attempts", hits)
+	}
+	if hits, _ := server.sent("with view"); hits != 2 {
+		t.Errorf("a view with 1 retry sent %d attempts", hits)
+	}
+}
+
+func checkIntrospection(t *testing.T, server *conformanceServer, base heimdall.Client) {
+	client, ok := base.(interface {
+		heimdall.Client
+		EnableExpvar(prefix string)
+		ExportBreakerState() heimdall.BreakerState
+		LastDecisions(n int) []heimdall.DecisionRecord
+		ApplyConfig(cfg heimdall.ClientConfig) error
+	})
+	skipUnless(t, ok, "EnableExpvar, ExportBreakerState, LastDecisions or ApplyConfig")
+
+	client.EnableExpvar(fmt.Sprintf("heimdalltest_%d", time.Now().UnixNano()))
+	if _, err := client.Get(server.URL+"/echo", http.Header{}); err != nil {
+		t.Fatalf("request failed with expvar enabled: %v", err)
+	}
+
+	if state := client.ExportBreakerState(); state.State == heimdall.CircuitOpen {
+		t.Errorf("the circuit opened after a successful request: %+v", state)
+	}
+	if decisions := client.LastDecisions(10); len(decisions) != 0 {
+		t.Errorf("%d decisions recorded without a decision log", len(decisions))
+	}
+
+	var invalid *heimdall.ErrInvalidConfig
+	if err := client.ApplyConfig(heimdall.ClientConfig{Timeout: heimdall.Duration(-time.Second)}); !errors.As(err, &invalid) {
+		t.Errorf("an invalid config returned %v, want an *ErrInvalidConfig", err)
+	}
+}
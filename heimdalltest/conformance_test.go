@@ -0,0 +1,23 @@
+package heimdalltest
+
+import (
+	"testing"
+
+	"github.com/gojektech/heimdall"
+)
+
+func TestHTTPClientConformance(t *testing.T) {
+	TestClientConformance(t, func() heimdall.Client {
+		return heimdall.NewHTTPClient(1000)
+	})
+}
+
+func TestHystrixClientConformance(t *testing.T) {
+	TestClientConformance(t, func() heimdall.Client {
+		return heimdall.NewHystrixHTTPClient(1000, heimdall.NewHystrixConfig("conformance_command", heimdall.HystrixCommandConfig{
+			Timeout:               2000,
+			MaxConcurrentRequests: 100,
+			ErrorPercentThreshold: 100,
+		}))
+	})
+}
@@ -0,0 +1,160 @@
+package heimdalltest
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Step is a response of a ScriptedServer. The zero Step answers 200 with an
+// empty body.
+type Step struct {
+	// Status is the status of the response, 200 when 0
+	Status  int
+	Body    string
+	Headers http.Header
+	// Delay holds the response back for as long, or until the request is
+	// cancelled
+	Delay time.Duration
+	// Drop closes the connection after Delay without answering, as a server
+	// crashing mid-request does
+	Drop bool
+	// Assert checks the request the step answers, failing the test with the
+	// error it returns. The request body may be read.
+	Assert func(request *http.Request) error
+}
+
+// FailNTimes returns the steps answering n requests with 503 Service
+// Unavailable and the next with then
+func FailNTimes(n int, then Step) []Step {
+	steps := make([]Step, 0, n+1)
+	for i := 0; i < n; i++ {
+		steps = append(steps, Step{Status: http.StatusServiceUnavailable})
+	}
+
+	return append(steps, then)
+}
+
+// AssertRequest returns a step answering 200 once check accepts the request,
+// failing the test with the error check returns otherwise. Set Step.Assert
+// to check requests answered with other responses.
+func AssertRequest(check func(request *http.Request) error) Step {
+	return Step{Assert: check}
+}
+
+// ReceivedRequest is a request a ScriptedServer received
+type ReceivedRequest struct {
+	Method string
+	// URL is the path and query of the request, as sent
+	URL    string
+	Header http.Header
+	Body   []byte
+}
+
+// ScriptedServer answers the requests it receives with its steps, in order,
+// and the requests beyond them with the last step. It is safe for concurrent
+// requests, which take the steps in the order they arrive.
+type ScriptedServer struct {
+	*httptest.Server
+
+	t     testing.TB
+	steps []Step
+
+	mu       sync.Mutex
+	received []ReceivedRequest
+}
+
+// NewScriptedServer starts a server answering with steps, closed once t and
+// its subtests complete
+func NewScriptedServer(t testing.TB, steps ...Step) *ScriptedServer {
+	s := &ScriptedServer{t: t, steps: steps}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+// Requests returns the requests received so far, in order
+func (s *ScriptedServer) Requests() []ReceivedRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	requests := make([]ReceivedRequest, len(s.received))
+	for i, received := range s.received {
+		requests[i] = received
+		requests[i].Header = received.Header.Clone()
+		requests[i].Body = append([]byte(nil), received.Body...)
+	}
+
+	return requests
+}
+
+// Hits returns the number of requests received so far
+func (s *ScriptedServer) Hits() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.received)
+}
+
+func (s *ScriptedServer) serve(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	s.mu.Lock()
+	n := len(s.received)
+	s.received = append(s.received, ReceivedRequest{Method: r.Method, URL: r.RequestURI, Header: r.Header.Clone(), Body: body})
+	s.mu.Unlock()
+
+	step := s.step(n)
+	if step.Assert != nil {
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if err := step.Assert(r); err != nil {
+			s.t.Errorf("heimdalltest: request %d, %s %s: %v", n+1, r.Method, r.RequestURI, err)
+		}
+	}
+
+	if step.Delay > 0 {
+		timer := time.NewTimer(step.Delay)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	if step.Drop {
+		if hijacker, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hijacker.Hijack(); err == nil {
+				conn.Close()
+				return
+			}
+		}
+		panic(http.ErrAbortHandler)
+	}
+
+	for name, values := range step.Headers {
+		w.Header()[name] = values
+	}
+	if step.Status != 0 {
+		w.WriteHeader(step.Status)
+	}
+	w.Write([]byte(step.Body))
+}
+
+// step returns the step answering request n, counted from 0
+func (s *ScriptedServer) step(n int) Step {
+	switch {
+	case len(s.steps) == 0:
+		return Step{}
+	case n >= len(s.steps):
+		return s.steps[len(s.steps)-1]
+	}
+
+	return s.steps[n]
+}
@@ -0,0 +1,177 @@
+package heimdalltest
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gojektech/heimdall"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingT records the errors reported to it rather than failing the test
+type recordingT struct {
+	testing.TB
+
+	mu     sync.Mutex
+	errors []string
+}
+
+func (t *recordingT) Errorf(format string, args ...interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
+
+func (t *recordingT) reported() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return append([]string(nil), t.errors...)
+}
+
+func TestScriptedServerAnswersWithItsSteps(t *testing.T) {
+	server := NewScriptedServer(t,
+		Step{Status: http.StatusCreated, Body: "created", Headers: http.Header{"Location": {"/orders/1"}}},
+		Step{Status: http.StatusConflict, Body: "exists"},
+		Step{Body: "fine"},
+	)
+	client := heimdall.NewHTTPClient(1000)
+
+	response, err := client.Post(server.URL+"/orders?dry=1", strings.NewReader(`{"id":1}`), http.Header{"X-Trace": {"abc"}})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, response.StatusCode())
+	assert.Equal(t, "created", string(response.Body()))
+	assert.Equal(t, "/orders/1", response.Headers().Get("Location"))
+
+	response, err = client.Get(server.URL+"/orders/1", http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusConflict, response.StatusCode())
+
+	for i := 0; i < 2; i++ {
+		response, err = client.Get(server.URL, http.Header{})
+		require.NoError(t, err)
+		assert.Equal(t, "fine", string(response.Body()), "requests beyond the script get the last step")
+	}
+
+	requests := server.Requests()
+	require.Len(t, requests, 4)
+	assert.Equal(t, 4, server.Hits())
+	assert.Equal(t, http.MethodPost, requests[0].Method)
+	assert.Equal(t, "/orders?dry=1", requests[0].URL)
+	assert.Equal(t, "abc", requests[0].Header.Get("X-Trace"))
+	assert.Equal(t, `{"id":1}`, string(requests[0].Body))
+	assert.Equal(t, "/orders/1", requests[1].URL)
+
+	requests[0].Body[0] = 'x'
+	assert.Equal(t, `{"id":1}`, string(server.Requests()[0].Body), "received requests are returned as copies")
+}
+
+func TestFailNTimesIsRetriedThrough(t *testing.T) {
+	server := NewScriptedServer(t, FailNTimes(2, Step{Body: "recovered"})...)
+	client := heimdall.NewHTTPClient(1000)
+	client.SetRetryCount(2)
+
+	response, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, "recovered", string(response.Body()))
+	assert.Equal(t, 3, server.Hits())
+}
+
+func TestAssertRequestReportsRejectedRequests(t *testing.T) {
+	recorder := &recordingT{TB: t}
+	check := func(request *http.Request) error {
+		if request.Header.Get("Authorization") == "" {
+			return errors.New("no Authorization header")
+		}
+		return nil
+	}
+	server := NewScriptedServer(recorder, AssertRequest(check))
+	client := heimdall.NewHTTPClient(1000)
+
+	response, err := client.Get(server.URL+"/private", http.Header{"Authorization": {"Bearer token"}})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode())
+	assert.Empty(t, recorder.reported())
+
+	_, err = client.Get(server.URL+"/private", http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"heimdalltest: request 2, GET /private: no Authorization header"}, recorder.reported())
+}
+
+func TestAssertedStepsCanReadTheBody(t *testing.T) {
+	var body []byte
+	server := NewScriptedServer(t, Step{Status: http.StatusAccepted, Assert: func(request *http.Request) error {
+		var err error
+		body, err = ioutil.ReadAll(request.Body)
+		return err
+	}})
+
+	response, err := heimdall.NewHTTPClient(1000).Post(server.URL, strings.NewReader("payload"), http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, response.StatusCode())
+	assert.Equal(t, "payload", string(body))
+	assert.Equal(t, "payload", string(server.Requests()[0].Body))
+}
+
+func TestDelayedStepsTimeOutTheClient(t *testing.T) {
+	server := NewScriptedServer(t, Step{Delay: time.Minute}, Step{Body: "prompt"})
+	client := heimdall.NewHTTPClient(50)
+
+	start := time.Now()
+	_, err := client.Get(server.URL, http.Header{})
+	assert.Error(t, err)
+	assert.Less(t, int64(time.Since(start)), int64(promptly), "the delay ends with the request")
+
+	response, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, "prompt", string(response.Body()))
+}
+
+func TestDroppedConnectionsFailTheAttempt(t *testing.T) {
+	server := NewScriptedServer(t, Step{Drop: true}, Step{Drop: true}, Step{Body: "reconnected"})
+	client := heimdall.NewHTTPClient(1000)
+
+	_, err := client.Get(server.URL, http.Header{})
+	assert.Error(t, err)
+
+	client.SetRetryCount(1)
+	response, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, "reconnected", string(response.Body()))
+	assert.Equal(t, 3, server.Hits())
+}
+
+func TestScriptedServerTakesConcurrentRequests(t *testing.T) {
+	server := NewScriptedServer(t, FailNTimes(5, Step{})...)
+	client := heimdall.NewHTTPClient(1000)
+
+	var wg sync.WaitGroup
+	statuses := make(chan int, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			response, _ := client.Get(server.URL, http.Header{})
+			statuses <- response.StatusCode()
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+
+	failed := 0
+	for status := range statuses {
+		if status == http.StatusServiceUnavailable {
+			failed++
+		}
+	}
+	assert.Equal(t, 5, failed, "each step answers one request")
+	assert.Len(t, server.Requests(), 20)
+}
@@ -0,0 +1,118 @@
+package heimdall
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"hash"
+	"net/http"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// HMACTimestampHeader is the header carrying the timestamp included in the signature
+const HMACTimestampHeader = "X-Timestamp"
+
+// Algo is the hash algorithm used for HMAC signatures
+type Algo int
+
+const (
+	// HMACSHA256 signs with HMAC-SHA256
+	HMACSHA256 Algo = iota
+	// HMACSHA512 signs with HMAC-SHA512
+	HMACSHA512
+	// HMACSHA1 signs with HMAC-SHA1, only for legacy partners
+	HMACSHA1
+)
+
+func (a Algo) newHash() func() hash.Hash {
+	switch a {
+	case HMACSHA512:
+		return sha512.New
+	case HMACSHA1:
+		return sha1.New
+	default:
+		return sha256.New
+	}
+}
+
+type hmacSigner struct {
+	secret     []byte
+	headerName string
+	algo       Algo
+}
+
+// NewHMACSigner returns a RequestMutator which signs every attempt with an
+// HMAC over method, path, timestamp and body. The timestamp is read from the
+// Clock of the client, refreshed on each retry and sent in the
+// HMACTimestampHeader header.
+func NewHMACSigner(secret []byte, headerName string, algo Algo) RequestMutator {
+	return &hmacSigner{
+		secret:     secret,
+		headerName: headerName,
+		algo:       algo,
+	}
+}
+
+// Mutate sets the timestamp and signature headers on the request
+func (s *hmacSigner) Mutate(request *http.Request) error {
+	body, err := requestBody(request)
+	if err != nil {
+		return errors.Wrap(err, "failed to read request body for signing")
+	}
+
+	if request.Header == nil {
+		request.Header = http.Header{}
+	}
+
+	timestamp := strconv.FormatInt(requestClock(request.Context()).Now().Unix(), 10)
+	signature := ComputeHMACSignature(s.secret, s.algo, request.Method, request.URL.Path, timestamp, body)
+
+	request.Header.Set(HMACTimestampHeader, timestamp)
+	request.Header.Set(s.headerName, signature)
+
+	return nil
+}
+
+// ComputeHMACSignature returns the hex encoded HMAC of method, path, timestamp
+// and body, each separated by a newline
+func ComputeHMACSignature(secret []byte, algo Algo, method, path, timestamp string, body []byte) string {
+	mac := hmac.New(algo.newHash(), secret)
+	mac.Write([]byte(method + "\n" + path + "\n" + timestamp + "\n"))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyHMACSignature reports whether signature matches the expected HMAC,
+// comparing in constant time
+func VerifyHMACSignature(secret []byte, algo Algo, method, path, timestamp string, body []byte, signature string) bool {
+	expected := ComputeHMACSignature(secret, algo, method, path, timestamp, body)
+
+	return SignaturesEqual(expected, signature)
+}
+
+// VerifyHMACRequest verifies the signature of an inbound webhook request. The
+// request body is left readable for the caller.
+func VerifyHMACRequest(request *http.Request, secret []byte, headerName string, algo Algo) (bool, error) {
+	body, err := requestBody(request)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to read request body for verification")
+	}
+
+	timestamp := request.Header.Get(HMACTimestampHeader)
+	signature := request.Header.Get(headerName)
+	if timestamp == "" || signature == "" {
+		return false, nil
+	}
+
+	return VerifyHMACSignature(secret, algo, request.Method, request.URL.Path, timestamp, body, signature), nil
+}
+
+// SignaturesEqual compares two signatures in constant time
+func SignaturesEqual(a, b string) bool {
+	return hmac.Equal([]byte(a), []byte(b))
+}
@@ -0,0 +1,99 @@
+package heimdall
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gojektech/heimdall/fakeclock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestComputeHMACSignature(t *testing.T) {
+	secret := []byte("top-secret")
+	body := []byte(`{"id":42}`)
+
+	assert.Equal(t, "5ee509b4abedab23f7da1b4c2fffc13f9d20ca105f6e63780f9c02dabba2868f",
+		ComputeHMACSignature(secret, HMACSHA256, http.MethodPost, "/v1/orders", "1516300000", body))
+
+	assert.Equal(t, "27cc2ddc499ba19051a028519dcc3c56b1919f81e1221ee6bdf04420853b8dfdac471a8e2315c648f5942e451cb1086e915baad9a5e57231637ee0c59ba15afe",
+		ComputeHMACSignature(secret, HMACSHA512, http.MethodPost, "/v1/orders", "1516300000", body))
+
+	assert.Equal(t, "5e30c4d99a08dd97a51bde7160d513c55b5d692c",
+		ComputeHMACSignature(secret, HMACSHA1, http.MethodGet, "/v1/orders", "1516300000", nil))
+}
+
+func TestHMACSignerSetsSignatureAndTimestampHeaders(t *testing.T) {
+	signer := NewHMACSigner([]byte("top-secret"), "X-Signature", HMACSHA256)
+
+	request, err := http.NewRequest(http.MethodPost, "http://example.com/v1/orders", bytes.NewReader([]byte(`{"id":42}`)))
+	require.NoError(t, err)
+	request = request.WithContext(withRequestTrace(request.Context(), fakeclock.New(time.Unix(1516300000, 0))))
+
+	require.NoError(t, signer.Mutate(request))
+
+	assert.Equal(t, "1516300000", request.Header.Get(HMACTimestampHeader))
+	assert.Equal(t, "5ee509b4abedab23f7da1b4c2fffc13f9d20ca105f6e63780f9c02dabba2868f", request.Header.Get("X-Signature"))
+
+	body, err := ioutil.ReadAll(request.Body)
+	require.NoError(t, err)
+	assert.Equal(t, `{"id":42}`, string(body), "signing should not consume the body")
+}
+
+func TestHMACSignerRecomputesSignatureOnEveryRetry(t *testing.T) {
+	secret := []byte("top-secret")
+	signer := NewHMACSigner(secret, "X-Signature", HMACSHA256)
+
+	var timestamps []string
+	dummyHandler := func(w http.ResponseWriter, r *http.Request) {
+		valid, err := VerifyHMACRequest(r, secret, "X-Signature", HMACSHA256)
+		require.NoError(t, err)
+		assert.True(t, valid, "signature should be valid on every attempt")
+
+		timestamps = append(timestamps, r.Header.Get(HMACTimestampHeader))
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(dummyHandler))
+	defer server.Close()
+
+	client := NewHTTPClient(10, WithClock(fakeclock.New(time.Unix(1516300001, 0))))
+	client.SetRetryCount(2)
+	client.SetRetrier(&fixedRetrier{interval: time.Second})
+	client.AddRequestMutator(signer)
+
+	_, err := client.Post(server.URL+"/v1/orders", bytes.NewReader([]byte(`{"id":42}`)), http.Header{})
+	require.Error(t, err)
+
+	assert.Equal(t, []string{"1516300001", "1516300002", "1516300003"}, timestamps)
+}
+
+func TestVerifyHMACRequestRejectsTamperedBody(t *testing.T) {
+	secret := []byte("top-secret")
+
+	request := httptest.NewRequest(http.MethodPost, "/v1/orders", bytes.NewReader([]byte(`{"id":43}`)))
+	request.Header.Set(HMACTimestampHeader, "1516300000")
+	request.Header.Set("X-Signature", "5ee509b4abedab23f7da1b4c2fffc13f9d20ca105f6e63780f9c02dabba2868f")
+
+	valid, err := VerifyHMACRequest(request, secret, "X-Signature", HMACSHA256)
+	require.NoError(t, err)
+	assert.False(t, valid)
+}
+
+func TestVerifyHMACRequestWithoutHeaders(t *testing.T) {
+	request := httptest.NewRequest(http.MethodGet, "/v1/orders", nil)
+
+	valid, err := VerifyHMACRequest(request, []byte("top-secret"), "X-Signature", HMACSHA256)
+	require.NoError(t, err)
+	assert.False(t, valid)
+}
+
+func TestSignaturesEqual(t *testing.T) {
+	assert.True(t, SignaturesEqual("abc123", "abc123"))
+	assert.False(t, SignaturesEqual("abc123", "abc124"))
+	assert.False(t, SignaturesEqual("abc123", "abc12"))
+}
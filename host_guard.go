@@ -0,0 +1,213 @@
+package heimdall
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// ErrForbiddenHost is returned when a request targets a host outside the
+// allowlist, or a connection would be made to a blocked private address
+type ErrForbiddenHost struct {
+	Host   string
+	Reason string
+}
+
+func (e *ErrForbiddenHost) Error() string {
+	return fmt.Sprintf("forbidden host %q: %s", e.Host, e.Reason)
+}
+
+// metadataAddresses are cloud metadata services not covered by the
+// loopback, private and link-local ranges
+var metadataAddresses = []net.IP{
+	net.ParseIP("100.100.100.200"),
+	net.ParseIP("fd00:ec2::254"),
+}
+
+type hostGuard struct {
+	mu              sync.RWMutex
+	allowedHosts    []string
+	returnRedirects bool
+	maxRedirects    int
+
+	// network is shared with clones, as it is enforced by the transport
+	// they share when dialing
+	network *networkPolicy
+}
+
+type networkPolicy struct {
+	mu           sync.RWMutex
+	blockPrivate bool
+	proxyBypass  []proxyBypass
+}
+
+func newHostGuard() *hostGuard {
+	return &hostGuard{maxRedirects: defaultMaxRedirects, network: &networkPolicy{}}
+}
+
+// clone returns a guard with a copy of the allowlist and redirect settings,
+// sharing the private network policy of g
+func (g *hostGuard) clone() *hostGuard {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return &hostGuard{
+		allowedHosts:    g.allowedHosts,
+		returnRedirects: g.returnRedirects,
+		maxRedirects:    g.maxRedirects,
+		network:         g.network,
+	}
+}
+
+func (g *hostGuard) setAllowedHosts(patterns []string) {
+	allowed := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		allowed = append(allowed, strings.ToLower(strings.TrimSpace(pattern)))
+	}
+
+	g.mu.Lock()
+	g.allowedHosts = allowed
+	g.mu.Unlock()
+}
+
+func (g *hostGuard) setBlockPrivateNetworks(block bool) {
+	g.network.mu.Lock()
+	g.network.blockPrivate = block
+	g.network.mu.Unlock()
+}
+
+// checkURL validates the host of u against the allowlist. An empty allowlist
+// allows every host.
+func (g *hostGuard) checkURL(u *url.URL) error {
+	g.mu.RLock()
+	allowed := g.allowedHosts
+	g.mu.RUnlock()
+
+	if len(allowed) == 0 {
+		return nil
+	}
+
+	host := strings.ToLower(u.Hostname())
+	for _, pattern := range allowed {
+		if hostMatches(pattern, host) {
+			return nil
+		}
+	}
+
+	return &ErrForbiddenHost{Host: host, Reason: "not in allowed hosts"}
+}
+
+// hostMatches reports whether host matches pattern, which is either a glob
+// such as "*.example.com", a suffix such as ".example.com" matching the
+// domain and its subdomains, or an exact host name
+func hostMatches(pattern, host string) bool {
+	if strings.HasPrefix(pattern, ".") {
+		return host == pattern[1:] || strings.HasSuffix(host, pattern)
+	}
+
+	matched, err := path.Match(pattern, host)
+	return err == nil && matched
+}
+
+// control runs after name resolution for every dial, so the check applies to
+// the address actually connected to and DNS rebinding cannot bypass it
+func (g *hostGuard) control(network, address string, _ syscall.RawConn) error {
+	g.network.mu.RLock()
+	block := g.network.blockPrivate
+	g.network.mu.RUnlock()
+
+	if !block {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return &ErrForbiddenHost{Host: host, Reason: "unresolved address"}
+	}
+
+	if isPrivateIP(ip) {
+		return &ErrForbiddenHost{Host: host, Reason: "private network address"}
+	}
+
+	return nil
+}
+
+func (g *hostGuard) setReturnRedirects(enabled bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.returnRedirects = enabled
+}
+
+func (g *hostGuard) setMaxRedirects(n int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.maxRedirects = n
+}
+
+// checkRedirect records the chain of redirects into the trace of the
+// request, and applies the allowlist and the maximum number of redirects to
+// every hop, unless redirects are returned to the caller instead of being
+// followed
+func (g *hostGuard) checkRedirect(request *http.Request, via []*http.Request) error {
+	g.mu.RLock()
+	returnRedirects := g.returnRedirects
+	max := g.maxRedirects
+	g.mu.RUnlock()
+
+	if returnRedirects {
+		return http.ErrUseLastResponse
+	}
+
+	chain := redirectChain(request, via)
+	if trace, ok := request.Context().Value(requestTraceKey{}).(*requestTrace); ok {
+		trace.setRedirects(chain)
+	}
+
+	if err := g.checkURL(request.URL); err != nil {
+		return err
+	}
+
+	if len(via) > max {
+		return &ErrTooManyRedirects{Max: max, Chain: chain}
+	}
+
+	return nil
+}
+
+func isPrivateIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return true
+	}
+
+	for _, metadata := range metadataAddresses {
+		if ip.Equal(metadata) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// forbiddenHostError extracts an ErrForbiddenHost from a transport error
+func forbiddenHostError(err error) *ErrForbiddenHost {
+	var forbidden *ErrForbiddenHost
+	if errors.As(err, &forbidden) {
+		return forbidden
+	}
+
+	return nil
+}
@@ -0,0 +1,140 @@
+package heimdall
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPClientRejectsHostOutsideAllowlist(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(100)
+	client.SetAllowedHosts([]string{"*.example.com", ".internal.corp"})
+	client.SetRetryCount(2)
+
+	_, err := client.Get(server.URL, http.Header{})
+	require.Error(t, err)
+
+	forbidden, ok := err.(*ErrForbiddenHost)
+	require.True(t, ok, "error should be ErrForbiddenHost, got %T", err)
+	assert.Equal(t, "127.0.0.1", forbidden.Host)
+	assert.Equal(t, 0, calls, "no request should reach the server")
+}
+
+func TestHystrixHTTPClientAllowsHostInAllowlist(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	client := NewHystrixHTTPClient(100, NewHystrixConfig("allowlist_command", HystrixCommandConfig{Timeout: 100}))
+	client.SetAllowedHosts([]string{"127.0.0.*"})
+
+	response, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(response.Body()))
+}
+
+func TestHTTPClientBlocksHostnameResolvingToLoopback(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+	defer server.Close()
+
+	serverURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	_, port, _ := net.SplitHostPort(serverURL.Host)
+
+	client := NewHTTPClient(100)
+	client.SetBlockPrivateNetworks(true)
+	client.SetRetryCount(2)
+
+	_, err = client.Get("http://localhost:"+port, http.Header{})
+	require.Error(t, err)
+
+	forbidden, ok := err.(*ErrForbiddenHost)
+	require.True(t, ok, "error should be ErrForbiddenHost, got %T: %v", err, err)
+	assert.True(t, net.ParseIP(forbidden.Host).IsLoopback())
+	assert.Equal(t, 0, calls)
+}
+
+func TestHystrixHTTPClientBlocksPrivateNetworks(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	client := NewHystrixHTTPClient(100, NewHystrixConfig("private_network_command", HystrixCommandConfig{Timeout: 100}))
+	client.SetBlockPrivateNetworks(true)
+
+	_, err := client.Get(server.URL, http.Header{})
+	require.Error(t, err)
+
+	_, ok := err.(*ErrForbiddenHost)
+	assert.True(t, ok, "error should be ErrForbiddenHost, got %T: %v", err, err)
+}
+
+func TestHTTPClientRejectsRedirectToBlockedHost(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("escaped"))
+	}))
+	defer target.Close()
+
+	redirectURL := strings.Replace(target.URL, "127.0.0.1", "localhost", 1)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, redirectURL, http.StatusFound)
+	}))
+	defer origin.Close()
+
+	client := NewHTTPClient(100)
+	client.SetAllowedHosts([]string{"127.0.0.1"})
+
+	_, err := client.Get(origin.URL, http.Header{})
+	require.Error(t, err)
+
+	forbidden, ok := err.(*ErrForbiddenHost)
+	require.True(t, ok, "error should be ErrForbiddenHost, got %T: %v", err, err)
+	assert.Equal(t, "localhost", forbidden.Host)
+}
+
+func TestHostMatches(t *testing.T) {
+	assert.True(t, hostMatches("*.example.com", "api.example.com"))
+	assert.False(t, hostMatches("*.example.com", "example.com"))
+	assert.True(t, hostMatches(".example.com", "example.com"))
+	assert.True(t, hostMatches(".example.com", "a.b.example.com"))
+	assert.False(t, hostMatches(".example.com", "badexample.com"))
+	assert.True(t, hostMatches("api.example.com", "api.example.com"))
+	assert.False(t, hostMatches("api.example.com", "api.example.com.evil.com"))
+}
+
+func TestIsPrivateIP(t *testing.T) {
+	for _, address := range []string{"127.0.0.1", "::1", "10.1.2.3", "172.16.0.1", "192.168.1.1", "169.254.169.254", "fe80::1", "fd00::1", "0.0.0.0", "100.100.100.200"} {
+		assert.True(t, isPrivateIP(net.ParseIP(address)), address)
+	}
+
+	for _, address := range []string{"8.8.8.8", "172.32.0.1", "2001:4860:4860::8888"} {
+		assert.False(t, isPrivateIP(net.ParseIP(address)), address)
+	}
+}
+
+func TestGetSSERejectsHostOutsideAllowlist(t *testing.T) {
+	client := NewHTTPClient(100)
+	client.SetAllowedHosts([]string{"*.example.com"})
+
+	_, _, err := client.GetSSE(context.Background(), "http://127.0.0.1:1/events", nil)
+	require.Error(t, err)
+
+	_, ok := err.(*ErrForbiddenHost)
+	assert.True(t, ok, "error should be ErrForbiddenHost, got %T", err)
+}
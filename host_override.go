@@ -0,0 +1,63 @@
+package heimdall
+
+import (
+	"crypto/tls"
+	"net/http"
+)
+
+// WithHostOverride sends requests with host as their Host header while they
+// are still dialed at the host of their URL, such as the IP address of an
+// instance found through service discovery behind a virtual host. Requests
+// setting a Host other than the host of their URL keep it. For HTTPS, give
+// WithTLSServerName as well, so that the server is asked for and verified
+// against the certificate of host rather than of the address.
+func WithHostOverride(host string) Option {
+	return func(options *clientOptions) {
+		options.hostOverride = host
+	}
+}
+
+// WithTLSServerName sends name as the TLS server name (SNI) of every
+// connection, and verifies the certificate of the server against name rather
+// than the host of the request URL. It is a setting of the transport: clients
+// made with Derive keep that of the client they derive from, and an
+// *http.Transport given to SwapTransport is cloned to send name too, unless it
+// sets a server name of its own. Other transports given to SwapTransport do
+// not send it.
+func WithTLSServerName(name string) Option {
+	return func(options *clientOptions) {
+		options.tlsServerName = name
+	}
+}
+
+// overrideHost sets the Host of request, the clone of an attempt, to the
+// override of options, unless there is none or the request sets one itself.
+// http.NewRequest sets the Host to that of the URL, which does not count as
+// setting one.
+func overrideHost(request *http.Request, options clientOptions) {
+	if options.hostOverride != "" && (request.Host == "" || request.Host == request.URL.Host) {
+		request.Host = options.hostOverride
+	}
+}
+
+// withTLSServerName returns rt sending name as the TLS server name when rt is
+// an *http.Transport without one, and rt as it is otherwise
+func withTLSServerName(rt http.RoundTripper, name string) http.RoundTripper {
+	transport, ok := rt.(*http.Transport)
+	if name == "" || !ok || transport.TLSClientConfig != nil && transport.TLSClientConfig.ServerName != "" {
+		return rt
+	}
+
+	transport = transport.Clone()
+	setTLSServerName(transport, name)
+
+	return transport
+}
+
+// setTLSServerName makes transport send name as the TLS server name
+func setTLSServerName(transport *http.Transport, name string) {
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+	transport.TLSClientConfig.ServerName = name
+}
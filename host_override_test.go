@@ -0,0 +1,140 @@
+package heimdall
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// issueFor returns a server certificate for name alone signed by the CA
+func (ca *testCA) issueFor(name string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(ca.t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{name},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(ca.t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// virtualHostServer serves TLS with a certificate for name only, answering
+// with the Host and server name of every request
+func virtualHostServer(ca *testCA, name string) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host + " " + r.TLS.ServerName))
+	}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{ca.issueFor(name)}}
+	server.StartTLS()
+
+	return server
+}
+
+// trustCA makes client trust the certificates ca issues
+func trustCA(client testClient, ca *testCA) {
+	transport := clientTransport(client)
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+	transport.TLSClientConfig.RootCAs = ca.pool
+}
+
+func TestHostAndServerNameOverrides(t *testing.T) {
+	ca := newTestCA(t)
+	server := virtualHostServer(ca, "api.internal")
+	defer server.Close()
+
+	for kind, newClient := range map[string]func(opts ...Option) testClient{
+		"http": func(opts ...Option) testClient { return NewHTTPClient(1000, opts...) },
+		"hystrix": func(opts ...Option) testClient {
+			return NewHystrixHTTPClient(1000, NewHystrixConfig("host_override_command", HystrixCommandConfig{Timeout: 1000}), opts...)
+		},
+	} {
+		t.Run(kind, func(t *testing.T) {
+			client := newClient(WithHostOverride("api.internal"), WithTLSServerName("api.internal"))
+			trustCA(client, ca)
+
+			response, err := client.Get(server.URL+"/items", http.Header{})
+			require.NoError(t, err, "the certificate is verified against the server name given")
+			assert.Equal(t, "api.internal api.internal", string(response.Body()))
+
+			request, err := http.NewRequest(http.MethodGet, server.URL, nil)
+			require.NoError(t, err)
+			request.Host = "other.internal"
+			response, err = client.Do(request)
+			require.NoError(t, err)
+			assert.Equal(t, "other.internal api.internal", string(response.Body()), "requests setting their Host keep it")
+
+			request, err = http.NewRequest(http.MethodGet, server.URL, nil)
+			require.NoError(t, err)
+			host := request.Host
+			response, err = client.Do(request)
+			require.NoError(t, err)
+			assert.Equal(t, "api.internal api.internal", string(response.Body()))
+			assert.Equal(t, host, request.Host, "the caller's request keeps its Host")
+
+			response, err = derive(client).Get(server.URL, http.Header{})
+			require.NoError(t, err)
+			assert.Equal(t, "api.internal api.internal", string(response.Body()), "derived clients keep the overrides")
+		})
+	}
+}
+
+func TestServerNameOverrideIsVerified(t *testing.T) {
+	ca := newTestCA(t)
+	server := virtualHostServer(ca, "api.internal")
+	defer server.Close()
+
+	for name, opts := range map[string][]Option{
+		"no override":    {WithHostOverride("api.internal")},
+		"other override": {WithHostOverride("api.internal"), WithTLSServerName("other.internal")},
+	} {
+		client := NewHTTPClient(1000, opts...)
+		trustCA(client, ca)
+
+		_, err := client.Get(server.URL, http.Header{})
+		var invalid x509.HostnameError
+		assert.True(t, errors.As(err, &invalid), "%s: %v", name, err)
+	}
+}
+
+func TestServerNameOverrideComposesWithSwappedTransports(t *testing.T) {
+	ca := newTestCA(t)
+	server := virtualHostServer(ca, "api.internal")
+	defer server.Close()
+
+	client := NewHTTPClient(1000, WithTLSServerName("api.internal"))
+	swapped := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: ca.pool}}
+	client.SwapTransport(swapped)
+
+	response, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+	assert.Contains(t, string(response.Body()), " api.internal")
+	assert.Empty(t, swapped.TLSClientConfig.ServerName, "the transport given is left as it is")
+
+	named := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: ca.pool, ServerName: "other.internal"}}
+	client.SwapTransport(named)
+	_, err = client.Get(server.URL, http.Header{})
+	var invalid x509.HostnameError
+	assert.True(t, errors.As(err, &invalid), "transports naming a server keep it: %v", err)
+}
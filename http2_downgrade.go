@@ -0,0 +1,253 @@
+package heimdall
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const defaultHTTP2DowngradeTTL = 5 * time.Minute
+
+// ErrHTTP2 matches, with errors.Is, the error of an attempt the server failed
+// at the HTTP/2 layer: it reset the stream, as with RST_STREAM INTERNAL_ERROR,
+// or sent GOAWAY
+var ErrHTTP2 = errors.New("http2 stream failed")
+
+// http2ErrorTypes are the types of the stream and GOAWAY errors of net/http
+// and of golang.org/x/net/http2
+var http2ErrorTypes = map[string]bool{
+	"http.http2StreamError": true,
+	"http.http2GoAwayError": true,
+	"http2.StreamError":     true,
+	"http2.GoAwayError":     true,
+}
+
+// isHTTP2Error reports whether err is, or wraps, an HTTP/2 stream or GOAWAY
+// error. Neither type is exported by net/http, so they are matched by name.
+func isHTTP2Error(err error) bool {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if http2ErrorTypes[reflect.TypeOf(err).String()] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// http2Error marks an HTTP/2 stream or GOAWAY error as an ErrHTTP2, keeping
+// its message
+type http2Error struct {
+	err error
+}
+
+func (e *http2Error) Error() string {
+	return e.err.Error()
+}
+
+// Is reports whether target is ErrHTTP2
+func (e *http2Error) Is(target error) bool {
+	return target == ErrHTTP2
+}
+
+// Unwrap returns the HTTP/2 error
+func (e *http2Error) Unwrap() error {
+	return e.err
+}
+
+// markHTTP2Error returns err as an ErrHTTP2 when it is an HTTP/2 error,
+// leaving an *url.Error outermost
+func markHTTP2Error(err error) error {
+	if !isHTTP2Error(err) {
+		return err
+	}
+
+	if urlErr, ok := err.(*url.Error); ok {
+		marked := *urlErr
+		marked.Err = &http2Error{err: urlErr.Err}
+		return &marked
+	}
+
+	return &http2Error{err: err}
+}
+
+// HTTP2Downgrade is reported to the hook of WithHTTP2Downgrade when a host
+// is downgraded to HTTP/1.1, and when its downgrade expires
+type HTTP2Downgrade struct {
+	// Host is the host and port of the downgraded URLs
+	Host string
+	// Downgraded is set when the host was downgraded, and unset when the
+	// downgrade expired
+	Downgraded bool
+	// Until is when the downgrade expires
+	Until time.Time
+	// Err is the HTTP/2 error that downgraded the host, nil on expiry
+	Err error
+}
+
+// WithHTTP2Downgrade sends the requests to a host over HTTP/1.1 for ttl, five
+// minutes when zero, once an attempt to it failed with an ErrHTTP2. An
+// attempt failing so before the response headers arrived is sent again at
+// once over HTTP/1.1, as part of the same attempt, when its body can be
+// rewound; one failing while its body was read is retried, if retries are
+// left, over HTTP/1.1. The HTTP/1.1 transport is a copy of the transport of
+// the client, so downgrading needs the transport to be an *http.Transport.
+// hook, which may be nil, is called on the requesting goroutine when a host is
+// downgraded, and when the first request after its ttl finds the downgrade
+// expired.
+func WithHTTP2Downgrade(ttl time.Duration, hook func(HTTP2Downgrade)) Option {
+	return func(options *clientOptions) {
+		if ttl <= 0 {
+			ttl = defaultHTTP2DowngradeTTL
+		}
+		options.http2Downgrade = &http2Downgrade{
+			ttl:        ttl,
+			hook:       hook,
+			hosts:      map[string]time.Time{},
+			transports: map[*http.Transport]*http.Transport{},
+		}
+	}
+}
+
+type http2Downgrade struct {
+	ttl  time.Duration
+	hook func(HTTP2Downgrade)
+
+	mu    sync.Mutex
+	hosts map[string]time.Time
+	// transports maps the transports of clients to their HTTP/1.1 copies
+	transports map[*http.Transport]*http.Transport
+}
+
+// downgradeHTTP2 sends the requests through client, or through its HTTP/1.1
+// copy while their host is downgraded, unless downgrade is nil
+func downgradeHTTP2(client *http.Client, downgrade *http2Downgrade, clock Clock) Doer {
+	if downgrade == nil {
+		return client
+	}
+
+	return DoerFunc(func(request *http.Request) (*http.Response, error) {
+		host := request.URL.Host
+		if downgrade.downgraded(host, clock.Now()) {
+			return downgrade.fallback(client).Do(request)
+		}
+
+		response, err := client.Do(request)
+		if err == nil || !isHTTP2Error(err) {
+			return response, err
+		}
+		downgrade.downgrade(host, err, clock.Now())
+
+		retry, ok := rewound(request)
+		if !ok {
+			return response, err
+		}
+
+		return downgrade.fallback(client).Do(retry)
+	})
+}
+
+// rewound returns a copy of request with a fresh body, reporting false when
+// its body cannot be read again
+func rewound(request *http.Request) (*http.Request, bool) {
+	if request.Body == nil || request.Body == http.NoBody {
+		return request, true
+	}
+	if request.GetBody == nil {
+		return nil, false
+	}
+
+	body, err := request.GetBody()
+	if err != nil {
+		return nil, false
+	}
+	retry := *request
+	retry.Body = body
+
+	return &retry, true
+}
+
+// observe downgrades the host of request when err, the error an attempt
+// failed with, is an ErrHTTP2
+func (d *http2Downgrade) observe(request *http.Request, err error, now time.Time) {
+	if d != nil && errors.Is(err, ErrHTTP2) {
+		d.downgrade(request.URL.Host, err, now)
+	}
+}
+
+// downgrade sends the requests to host over HTTP/1.1 from now on, for the
+// ttl. A host already downgraded keeps its expiry.
+func (d *http2Downgrade) downgrade(host string, err error, now time.Time) {
+	d.mu.Lock()
+	if until, ok := d.hosts[host]; ok && now.Before(until) {
+		d.mu.Unlock()
+		return
+	}
+	until := now.Add(d.ttl)
+	d.hosts[host] = until
+	d.mu.Unlock()
+
+	if d.hook != nil {
+		d.hook(HTTP2Downgrade{Host: host, Downgraded: true, Until: until, Err: err})
+	}
+}
+
+// downgraded reports whether host is downgraded, expiring its downgrade once
+// the ttl has passed
+func (d *http2Downgrade) downgraded(host string, now time.Time) bool {
+	d.mu.Lock()
+	until, ok := d.hosts[host]
+	if !ok || now.Before(until) {
+		d.mu.Unlock()
+		return ok
+	}
+	delete(d.hosts, host)
+	d.mu.Unlock()
+
+	if d.hook != nil {
+		d.hook(HTTP2Downgrade{Host: host, Until: until})
+	}
+
+	return false
+}
+
+// fallback returns client sending over an HTTP/1.1 copy of its transport,
+// or client itself when its transport cannot be copied
+func (d *http2Downgrade) fallback(client *http.Client) *http.Client {
+	transport, ok := client.Transport.(*http.Transport)
+	if !ok {
+		return client
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	http1, ok := d.transports[transport]
+	if !ok {
+		http1 = http1Transport(transport)
+		d.transports[transport] = http1
+	}
+
+	return withTransport(client, http1)
+}
+
+// http1Transport returns a copy of transport that never negotiates HTTP/2
+func http1Transport(transport *http.Transport) *http.Transport {
+	http1 := transport.Clone()
+	http1.ForceAttemptHTTP2 = false
+	http1.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	if http1.TLSClientConfig != nil {
+		protocols := make([]string, 0, len(http1.TLSClientConfig.NextProtos))
+		for _, protocol := range http1.TLSClientConfig.NextProtos {
+			if protocol != "h2" {
+				protocols = append(protocols, protocol)
+			}
+		}
+		http1.TLSClientConfig.NextProtos = protocols
+	}
+
+	return http1
+}
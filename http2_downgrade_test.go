@@ -0,0 +1,122 @@
+package heimdall
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gojektech/heimdall/fakeclock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// http2ResetServer resets every HTTP/2 stream with INTERNAL_ERROR, as a
+// handler panic does, answering HTTP/1.1 requests with the protocol they
+// came over. It records the protocol of every request.
+func http2ResetServer() (*httptest.Server, func() []string) {
+	var mu sync.Mutex
+	var protocols []string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		protocols = append(protocols, r.Proto)
+		mu.Unlock()
+
+		if r.ProtoMajor == 2 {
+			panic(http.ErrAbortHandler)
+		}
+		w.Write([]byte(r.Proto))
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+
+	return server, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), protocols...)
+	}
+}
+
+// trustServer makes client trust the certificate of server
+func trustServer(client Client, server *httptest.Server) {
+	transport := client.(interface{ settings() attemptSettings }).settings().client.Transport.(*http.Transport)
+	transport.TLSClientConfig = &tls.Config{RootCAs: server.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs}
+}
+
+func TestHTTP2StreamErrorsMatchErrHTTP2(t *testing.T) {
+	server, protocols := http2ResetServer()
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+	trustServer(client, server)
+
+	_, err := client.Get(server.URL, http.Header{})
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrHTTP2), "%v", err)
+	assert.Contains(t, err.Error(), "INTERNAL_ERROR")
+	assert.Equal(t, []string{"HTTP/2.0"}, protocols(), "without downgrading, requests stay on HTTP/2")
+
+	assert.False(t, errors.Is(markHTTP2Error(errors.New("connection reset")), ErrHTTP2))
+}
+
+func TestClientsDowngradeHostsToHTTP1(t *testing.T) {
+	for kind, newClient := range map[string]func(opts ...Option) testClient{
+		"http": func(opts ...Option) testClient {
+			return NewHTTPClient(1000, opts...)
+		},
+		"hystrix": func(opts ...Option) testClient {
+			return NewHystrixHTTPClient(1000, NewHystrixConfig("http2_downgrade_command", HystrixCommandConfig{Timeout: 1000}), opts...)
+		},
+	} {
+		t.Run(kind, func(t *testing.T) {
+			server, protocols := http2ResetServer()
+			defer server.Close()
+
+			var events []HTTP2Downgrade
+			clock := fakeclock.New(time.Now())
+			client := newClient(WithClock(clock), WithHTTP2Downgrade(time.Minute, func(event HTTP2Downgrade) {
+				events = append(events, event)
+			}))
+			trustServer(client, server)
+
+			response, err := client.Post(server.URL, strings.NewReader("payload"), http.Header{})
+			require.NoError(t, err)
+			assert.Equal(t, "HTTP/1.1", string(response.Body()), "the attempt is sent again over HTTP/1.1")
+
+			response, err = client.Get(server.URL, http.Header{})
+			require.NoError(t, err)
+			assert.Equal(t, "HTTP/1.1", string(response.Body()))
+			assert.Equal(t, []string{"HTTP/2.0", "HTTP/1.1", "HTTP/1.1"}, protocols(), "the downgrade is remembered")
+
+			require.Len(t, events, 1)
+			host := strings.TrimPrefix(server.URL, "https://")
+			assert.Equal(t, host, events[0].Host)
+			assert.True(t, events[0].Downgraded)
+			assert.Equal(t, clock.Now().Add(time.Minute), events[0].Until)
+			assert.True(t, isHTTP2Error(events[0].Err), "%v", events[0].Err)
+
+			clock.Advance(time.Minute)
+			_, err = client.Get(server.URL, http.Header{})
+			require.NoError(t, err)
+			assert.Equal(t, []string{"HTTP/2.0", "HTTP/1.1", "HTTP/1.1", "HTTP/2.0", "HTTP/1.1"}, protocols(), "HTTP/2 is tried again once the downgrade expires")
+
+			require.Len(t, events, 3)
+			assert.Equal(t, HTTP2Downgrade{Host: host, Until: events[0].Until}, events[1], "the expiry is reported")
+			assert.True(t, events[2].Downgraded)
+		})
+	}
+}
+
+func TestHTTP1TransportNeverNegotiatesHTTP2(t *testing.T) {
+	transport := &http.Transport{ForceAttemptHTTP2: true, TLSClientConfig: &tls.Config{NextProtos: []string{"h2", "http/1.1"}}}
+
+	http1 := http1Transport(transport)
+	assert.False(t, http1.ForceAttemptHTTP2)
+	assert.NotNil(t, http1.TLSNextProto)
+	assert.Equal(t, []string{"http/1.1"}, http1.TLSClientConfig.NextProtos)
+	assert.Equal(t, []string{"h2", "http/1.1"}, transport.TLSClientConfig.NextProtos, "the transport of the client is left as it was")
+}
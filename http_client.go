@@ -1,55 +1,592 @@
 package heimdall
 
 import (
-	"fmt"
+	"bytes"
+	"context"
 	"io"
-	"io/ioutil"
 	"net/http"
+	"sync"
 	"time"
-
-	"github.com/gojektech/valkyrie"
-	"github.com/pkg/errors"
 )
 
 const defaultRetryCount int = 0
 
-type httpClient struct {
-	client *http.Client
-
-	retryCount int
-	retrier    Retriable
+// HTTPClient is the Client sending requests through net/http, with retries.
+// Its setters and SwapTransport may be called while requests are in flight.
+type HTTPClient struct {
+	// mu guards the settings, which setters, ApplyConfig and SwapTransport
+	// change at runtime; requests read them through settings
+	mu      sync.RWMutex
+	current clientSettings
+
+	options clientOptions
+	guard   *hostGuard
+
+	redactor *headerRedactor
+	async    *asyncQueue
+	base     *baseURL
+	codecs   *codecRegistry
+	stats    *clientStats
+	tenants  *tenantQuotas
+	bodies   *bodyBudget
+	inFlight *inFlightTracker
+	shutdown *shutdownGate
 }
 
 // NewHTTPClient returns a new instance of HTTPClient
-func NewHTTPClient(timeoutInMilliseconds int) Client {
-	httpTimeout := time.Duration(timeoutInMilliseconds) * time.Millisecond
-	return &httpClient{
-		client: &http.Client{
-			Timeout: httpTimeout,
+func NewHTTPClient(timeoutInMilliseconds int, opts ...Option) *HTTPClient {
+	options := newClientOptions(opts)
+	httpTimeout := options.httpTimeout(time.Duration(timeoutInMilliseconds) * time.Millisecond)
+	guard := newHostGuard()
+
+	c := &HTTPClient{
+		current: clientSettings{
+			client: &http.Client{
+				Timeout:       httpTimeout,
+				Transport:     newTransport(guard, options),
+				CheckRedirect: guard.checkRedirect,
+			},
+
+			retryCount:          defaultRetryCount,
+			retrier:             NewNoRetrier(),
+			connectRetrier:      newConnectFailureRetrier(),
+			drainLimit:          defaultDrainLimit,
+			strictContentLength: true,
 		},
 
-		retryCount: defaultRetryCount,
-		retrier:    NewNoRetrier(),
+		options: options,
+		guard:   guard,
+
+		redactor: newHeaderRedactor(),
+		base:     &baseURL{},
+		codecs:   newCodecRegistry(),
+		stats:    newClientStats(options.clock.Now()),
+		tenants:  newTenantQuotas(),
+		bodies:   newBodyBudget(),
+		inFlight: newInFlightTracker(),
+		shutdown: newShutdownGate(),
+	}
+	c.async = newAsyncQueue(c.options.asyncQueueSize, c.options.asyncWorkers, c.postAsyncJob, c.dropAsyncJob)
+	autoRegister(c, c.options)
+
+	return c
+}
+
+// Derive returns a client sharing the underlying http.Client, and so the
+// transport and its connection pool, with c. Retry settings, mutators,
+// middlewares, the validator, host allowlist, redirect and redaction settings,
+// the base URL and codecs are copied, so setting them on either client never affects
+// the other. Private network blocking is enforced by the shared transport and
+// stays shared. The derived client has its own async queue and singleflight
+// group, and publishes into the same expvar counters and audit log until
+// EnableExpvar or EnableAuditLog is called on it. opts are applied on top of the options of c.
+func (c *HTTPClient) Derive(opts ...Option) *HTTPClient {
+	guard := c.guard.clone()
+	options := c.options.derive(opts)
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	derived := &HTTPClient{
+		current: c.current.derive(options, guard),
+
+		options: options,
+		guard:   guard,
+
+		redactor: c.redactor.clone(),
+		base:     c.base.clone(),
+		codecs:   c.codecs.clone(),
+		stats:    newClientStats(options.clock.Now()),
+		tenants:  c.tenants.clone(),
+		bodies:   c.bodies.clone(),
+		inFlight: newInFlightTracker(),
+		shutdown: newShutdownGate(),
+	}
+	derived.async = newAsyncQueue(derived.options.asyncQueueSize, derived.options.asyncWorkers, derived.postAsyncJob, derived.dropAsyncJob)
+
+	return derived
+}
+
+// With returns a view of c setting the defaults of opts, such as a header
+// with Header or a retry count with Retry, on every request sent through it.
+// Everything else is that of c, settings included, so setting them on the
+// view sets them on c. Headers a request sets itself win over the defaults,
+// and the defaults of a view made from another view win over those of the
+// other. Views are cheap to make and safe for concurrent use.
+func (c *HTTPClient) With(opts ...RequestOption) Client {
+	return newScopedClient(c, requestDefaults{}, opts)
+}
+
+// ApplyConfig swaps the timeout, retry settings, base URL, default headers
+// and response size limit of c for those of cfg, keeping the transport and
+// its connection pool. Requests in flight keep the settings they started
+// with. An invalid cfg, or one with hystrix settings, which need a hystrix
+// client, fails with an *ErrInvalidConfig and changes nothing.
+func (c *HTTPClient) ApplyConfig(cfg ClientConfig) error {
+	if err := cfg.validate(); err != nil {
+		return err
 	}
+	if cfg.Hystrix != nil {
+		return invalidConfig("hystrix", "cannot be added to a running client without a circuit breaker")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.current.client = withTimeout(c.current.client, time.Duration(cfg.Timeout))
+	c.current.retryCount = cfg.RetryCount
+	c.current.retrier = cfg.retrier()
+	c.current.configured = cfg.middlewares()
+	c.base.set(cfg.BaseURL)
+
+	return nil
+}
+
+// settings returns the settings of a request starting now
+func (c *HTTPClient) settings() attemptSettings {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return newAttemptSettings(c.current, c.redactor, c.stats)
+}
+
+// Stats returns a snapshot of the requests made by c since it was created or
+// ResetStats was last called. Clients made with Derive count on their own.
+func (c *HTTPClient) Stats() ClientStats {
+	stats := c.stats.snapshot(c.settings(), c.options)
+	stats.Tenants = c.tenants.snapshot()
+	stats.BodyBytesInFlight = c.bodies.snapshot()
+	stats.ShutdownDrained, stats.ShutdownAborted = c.shutdown.counts()
+
+	return stats
+}
+
+// ResetStats zeroes the counters returned by Stats
+func (c *HTTPClient) ResetStats() {
+	c.stats.reset(c.options.clock.Now())
+	c.tenants.reset()
+}
+
+// ExportBreakerState returns the zero BreakerState, as c has no circuit
+func (c *HTTPClient) ExportBreakerState() BreakerState {
+	return BreakerState{}
+}
+
+// LastDecisions returns the last n retry decisions recorded by the decision
+// log of c, oldest first, or nil when c was made without WithDecisionLog
+func (c *HTTPClient) LastDecisions(n int) []DecisionRecord {
+	return c.options.decisions.last(n)
+}
+
+// InFlight returns the requests of c in flight, oldest first. Clients made
+// with Derive track their requests on their own.
+func (c *HTTPClient) InFlight() []InFlightRequest {
+	return c.inFlight.snapshot()
+}
+
+// CancelInFlight cancels the requests of c in flight to hosts matching
+// hostPattern, a host, with or without its port, a glob such as
+// "*.example.com" or a suffix such as ".example.com", returning how many it
+// cancelled. Cancelled requests return an *ErrContextDone whose error is
+// ErrOperatorCancelled.
+func (c *HTTPClient) CancelInFlight(hostPattern string) int {
+	return c.inFlight.cancel(hostPattern)
 }
 
-// SetRetryCount sets the retry count for the httpClient
-func (c *httpClient) SetRetryCount(count int) {
-	c.retryCount = count
+// SetBaseURL sets the URL that relative request URLs such as "/v1/users/42"
+// are resolved against. Absolute URLs are used as they are.
+func (c *HTTPClient) SetBaseURL(base string) {
+	c.base.set(base)
+}
+
+// SetRetryCount sets the retry count for the HTTPClient
+func (c *HTTPClient) SetRetryCount(count int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.current.retryCount = count
 }
 
 // SetRetrier sets the strategy for retrying
-func (c *httpClient) SetRetrier(retrier Retriable) {
-	c.retrier = retrier
+func (c *HTTPClient) SetRetrier(retrier Retriable) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.current.retrier = retrier
+}
+
+// SetConnectFailureRetrier sets the strategy for retrying attempts that failed
+// before getting a connection, as refused dials and failed TLS handshakes do.
+// The retrier set with SetRetrier paces the retries of other failures. It
+// waits 10ms by default, and nil makes SetRetrier pace every retry.
+func (c *HTTPClient) SetConnectFailureRetrier(retrier Retriable) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.current.connectRetrier = retrier
+}
+
+// SetDrainLimit caps how much of the error body of an attempt that will be
+// retried is read. Bodies within the limit leave the connection reusable,
+// longer ones are truncated and close the connection instead.
+func (c *HTTPClient) SetDrainLimit(limit int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.current.drainLimit = limit
+}
+
+// SetStrictContentLength sets whether a response body read in full must be as
+// long as the Content-Length of the response. When strict, the default, a body cut
+// short fails the attempt with an *ErrTruncatedBody, which is retried. When
+// not, the body is not checked, and a body the transport reports cut short
+// fails with the error of the transport.
+func (c *HTTPClient) SetStrictContentLength(strict bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.current.strictContentLength = strict
+}
+
+// SetResponseHeaderTimeout fails an attempt with ErrResponseHeaderTimeout when
+// its response headers take longer than timeout to arrive. Unlike the overall
+// client timeout it does not limit how long reading the body takes, so large
+// downloads can still fail fast on an unresponsive server. Zero disables it.
+func (c *HTTPClient) SetResponseHeaderTimeout(timeout time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.current.responseHeaderTimeout = timeout
+}
+
+// SetMinAttemptBudget sets the least time before the request context deadline
+// a retry needs to be worth sending. Backoff waits are cut short so that a
+// retry still gets that much time, and a retry that could not get it is
+// skipped, failing the request with an *ErrContextDone at once instead of
+// after the wait. Zero, the default, only cuts waits short.
+func (c *HTTPClient) SetMinAttemptBudget(budget time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.current.minAttemptBudget = budget
+}
+
+// SetSlowRequestHook calls fn with a report of every request taking longer
+// than threshold, retries and backoffs included, but for at most
+// maxPerMinute requests each minute, so that a slowdown of every request
+// cannot flood logs; zero or less reports them all. Reports over the cap are
+// counted in the Suppressed field of the next report made. fn is called on
+// the goroutine making the request once it completes, and a panic fails the
+// request with an *ErrCallbackPanic. A nil fn removes the hook. Clients made
+// with Derive keep the hook with a cap of their own.
+func (c *HTTPClient) SetSlowRequestHook(threshold time.Duration, maxPerMinute int, fn func(SlowRequestReport)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.current.slow = newSlowRequestLog(threshold, maxPerMinute, fn)
+}
+
+// SetDeprecationHook calls fn with the URL of every request whose response
+// carries a Deprecation or Sunset header, as upstreams retiring an endpoint
+// send, and what the headers say. Each URL, its scheme, host and path, is
+// reported at most once an interval, so that a busy deprecated endpoint does
+// not flood logs; zero or less reports every response. fn is called on the
+// goroutine making the request once it completes, and a panic fails the
+// request with an *ErrCallbackPanic. A nil fn removes the hook. Such
+// responses are counted by host in the deprecated_responses expvar map
+// whether or not a hook is set. Clients made with Derive keep the hook with
+// an interval of their own.
+func (c *HTTPClient) SetDeprecationHook(interval time.Duration, fn func(url string, info DeprecationInfo)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.current.deprecations = newDeprecationLog(interval, fn)
+}
+
+// SetMaintenanceDetector makes detector judge every response received,
+// reporting whether it announces planned maintenance of its host and when
+// to retry. Such a response fails its request at once with an
+// *ErrUpstreamMaintenance, and so do requests to the host until retryAt, or
+// a minute when retryAt is zero or past, without being sent. They consume
+// no retries and count as failures neither to the circuit breaker nor to
+// the failure detector. A panic of detector fails the attempt, and a nil
+// detector, the default, detects nothing. Clients made with Derive share
+// the paused hosts.
+func (c *HTTPClient) SetMaintenanceDetector(detector func(*Response) (inMaintenance bool, retryAt time.Time)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.current.maintenance = c.current.maintenance.withDetector(detector)
+}
+
+// SetMaintenanceHook makes fn announce each host entering maintenance, as
+// found by the maintenance detector, and leaving it, once a response after
+// its pause is not found to announce it. fn runs on the goroutine of the
+// request, and a panic fails that request with an *ErrCallbackPanic. A nil fn
+// removes the hook.
+func (c *HTTPClient) SetMaintenanceHook(fn func(MaintenanceEvent)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.current.maintenance = c.current.maintenance.withHook(fn)
+}
+
+// SetFailureClassifier makes classifier judge every attempt the server
+// answered without an error status, given its response and how long the
+// attempt took. An attempt it returns true for fails with an
+// *ErrClassifiedFailure as an attempt answered with a 5xx does: it is
+// retried while attempts remain, counted as a failure by adaptive concurrency and the
+// failure detector, and its response is returned with the error when it is
+// the final attempt. classifier must not modify the response, and a panic
+// fails the attempt. A nil classifier, the default, only fails 5xx answers.
+func (c *HTTPClient) SetFailureClassifier(classifier func(response *Response, attemptDuration time.Duration) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.current.classifier = classifier
+}
+
+// SetBodyRetryPredicate makes fn judge every attempt the server answered
+// without an error status, given its status and up to maxInspectBytes of its
+// body, the whole body when 0 or less, for upstreams answering 200 with an
+// error in the body. An attempt it returns true for fails with an
+// *ErrRetryableBody as an attempt answered with a 5xx does: it is retried
+// with backoff while attempts remain, counted as a failure by adaptive concurrency and the
+// failure detector, and its response, whole body included, is returned with
+// the error when it is the final attempt. fn must not modify the body, and a
+// panic fails the attempt. A nil fn, the default, removes the predicate.
+func (c *HTTPClient) SetBodyRetryPredicate(maxInspectBytes int, fn func(statusCode int, body []byte) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.current.bodyRetry = newBodyRetryPredicate(maxInspectBytes, fn)
+}
+
+// SetAPIVersion pins the API version of every request with strategy, such
+// as HeaderVersion or MediaTypeVersion, and fails requests whose response
+// strategy finds to refuse the version with an *ErrAPIVersionRejected,
+// returned alongside the response. A nil strategy, the default, pins none.
+func (c *HTTPClient) SetAPIVersion(strategy VersionStrategy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.current.apiVersion = strategy
+}
+
+// SetBaggagePropagation sets the headers of allowlist, such as baggage, that
+// the context of a request carries, as ContextWithBaggage sets them, on every
+// attempt of the request. Their names and values may take maxTotalBytes at
+// most, none when 0 or less: the headers listed last are dropped first until
+// the rest fit. Values too long to fit on their own, or than the limit of
+// WithBaggageValueLimit, are dropped, or truncated with WithBaggageTruncation.
+// Headers the request sets keep their value. An empty allowlist, the default,
+// propagates none.
+func (c *HTTPClient) SetBaggagePropagation(allowlist []string, maxTotalBytes int, opts ...BaggageOption) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.current.baggage = newBaggagePropagation(allowlist, maxTotalBytes, opts)
+}
+
+// AddRequestMutator registers a mutator run on the request before every attempt
+func (c *HTTPClient) AddRequestMutator(mutator RequestMutator) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.current.requestMutators = append(c.current.requestMutators, mutator)
+}
+
+// SetRawRequestMutator runs mutator on every attempt right before it is
+// written, after the request mutators, middlewares and all other header
+// processing, as an escape hatch for upstreams with quirks Go normalizes
+// away. mutator may assign header names as they must be sent, such as
+// req.Header["X-API-KEY"], remove headers the transport would add or change
+// req.Host. Its sharp edges:
+//   - it is given a copy of the attempt, so its changes are not seen by
+//     middlewares, the audit log or hooks, and it runs again on every retry
+//   - names assigned directly are invisible to Header.Get and Header.Del,
+//     and are sent twice when the canonical name is set too, so delete that
+//   - Content-Length and Transfer-Encoding follow req.ContentLength and
+//     req.Body rather than the header map; a GET sends no Content-Length
+//     with a nil or http.NoBody body and no ContentLength
+//   - an empty User-Agent value stops the default one from being sent
+//   - HTTP/2 lower-cases every header name, so casing only survives on
+//     HTTP/1.1
+//
+// A panic fails the attempt with an *ErrCallbackPanic. A nil mutator removes
+// it.
+func (c *HTTPClient) SetRawRequestMutator(mutator func(*http.Request)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.current.rawMutator = mutator
+}
+
+// SetRequestValidator sets a validator run once per request before the first
+// attempt; a request it rejects fails with an *ErrRequestRejected and is
+// never sent. Use ChainValidators to combine several.
+func (c *HTTPClient) SetRequestValidator(validator RequestValidator) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.current.requestValidator = validator
+}
+
+// AddPlugin adds plugin, which observes every request after the plugins
+// added before it. A panic in a plugin fails the request with an
+// *ErrCallbackPanic, which is reported to OnError of every plugin.
+func (c *HTTPClient) AddPlugin(plugin Plugin) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.current.plugins = append(c.current.plugins, plugin)
+}
+
+// Use wraps every attempt in the middlewares, the first registered outermost
+func (c *HTTPClient) Use(middlewares ...Middleware) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.current.middlewares = append(c.current.middlewares, middlewares...)
+}
+
+// UseResponseInterceptor runs interceptor on the response of every
+// successful attempt, after the interceptors registered before it, so that
+// it may scrub headers or rewrite the body before hooks, callers caching the
+// response and the caller see it, or fail the request with a policy error.
+// It skips failed attempts unless given InterceptErrorResponses.
+func (c *HTTPClient) UseResponseInterceptor(interceptor ResponseInterceptor, opts ...InterceptorOption) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.current.interceptors = append(c.current.interceptors, newResponseInterceptor(interceptor, opts))
+}
+
+// EnableExpvar publishes request metrics through expvar under prefix
+func (c *HTTPClient) EnableExpvar(prefix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.current.expvar = publishExpvar(prefix)
+}
+
+// EnableAuditLog hands a record of sampleRate, from 0 to 1, of the attempts
+// sent over the network to sink. The sink runs on a goroutine of its own, and
+// records arriving while it is behind by more than the buffer are dropped and
+// counted as audit_dropped in expvar.
+func (c *HTTPClient) EnableAuditLog(sink func(AuditRecord), sampleRate float64, opts ...AuditOption) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.current.audit = newAuditLog(sink, sampleRate, c.options.clock, func() { c.settings().expvar.dropAudit() }, opts)
+}
+
+// SetAllowedHosts restricts requests, including redirects, to hosts matching
+// one of the glob ("*.example.com") or suffix (".example.com") patterns
+func (c *HTTPClient) SetAllowedHosts(patterns []string) {
+	c.guard.setAllowedHosts(patterns)
+}
+
+// SetBlockPrivateNetworks rejects connections to loopback, private, link-local
+// and cloud metadata addresses
+func (c *HTTPClient) SetBlockPrivateNetworks(block bool) {
+	c.guard.setBlockPrivateNetworks(block)
+}
+
+// SetProxyBypass connects to the hosts matching patterns directly instead of
+// through the proxy given with WithProxy, WithSOCKS5Proxy or set in the
+// environment. Patterns are exact hosts, suffixes (".internal.corp") matching
+// a domain and its subdomains, globs, IP addresses, CIDR ranges
+// ("10.0.0.0/8") or "*" for every host. The list replaces the previous one, which is kept when a
+// pattern is invalid. The proxy is a setting of the transport, so clients
+// made with Derive share the list.
+func (c *HTTPClient) SetProxyBypass(patterns []string) error {
+	return c.guard.setProxyBypass(patterns)
+}
+
+// SetTenantLimits limits the attempts sent on behalf of each tenant, set
+// on requests with ContextWithTenant, to those of overrides, or to defaults
+// for tenants without overrides. An attempt over the limits of its tenant fails
+// the request with an *ErrTenantQuotaExceeded before it is sent. Requests on
+// behalf of no tenant are not limited. Clients made with Derive start with the
+// same limits and count the usage of tenants on their own.
+func (c *HTTPClient) SetTenantLimits(defaults TenantLimits, overrides map[string]TenantLimits) {
+	c.tenants.set(defaults, overrides)
+}
+
+// SetMaxInFlightBodyBytes bounds the bytes of the bodies of the requests of
+// c in flight to n, counting each body by its Content-Length from before the
+// first attempt until the last one is done. Requests whose bodies do not fit
+// fail with an *ErrBodyBudgetExceeded, at once or after the wait set with
+// WithBodyBudgetWait. Streamed bodies of unknown length are not counted. Zero
+// or less removes the bound. Clients made with Derive start with the same
+// bound and count their bodies on their own.
+func (c *HTTPClient) SetMaxInFlightBodyBytes(n int64) {
+	c.bodies.set(n)
+}
+
+// SetReturnRedirects stops the client from following redirects, returning
+// the 3xx status, Location header and body to the caller instead
+func (c *HTTPClient) SetReturnRedirects(enabled bool) {
+	c.guard.setReturnRedirects(enabled)
+}
+
+// SetMaxRedirects makes each attempt follow at most n redirects, 10 by
+// default, failing with an *ErrTooManyRedirects on the next one
+func (c *HTTPClient) SetMaxRedirects(n int) {
+	c.guard.setMaxRedirects(n)
+}
+
+// SwapTransport makes requests started from now on send through rt, for
+// instance one presenting a rotated client certificate, while requests in
+// flight finish on the old transport. The idle connections of the old
+// transport are closed once the client timeout, or 30 seconds when there is none,
+// has passed. rt replaces the transport of the client and with it the dialer
+// blocking private networks, byte counting and WithProxy, which a transport
+// from the caller does not provide, while an *http.Transport is cloned to send
+// the server name of WithTLSServerName. Clients made with Derive keep the
+// transport they share until it is swapped on them too.
+func (c *HTTPClient) SwapTransport(rt http.RoundTripper) {
+	c.mu.Lock()
+	old := c.current.client
+	c.current.client = withTransport(old, withTLSServerName(rt, c.options.tlsServerName))
+	c.mu.Unlock()
+
+	retireTransport(old, c.options.clock)
+}
+
+// SetSensitiveHeaders replaces the set of headers whose values are redacted in
+// errors, debug output and hook payloads. It defaults to Authorization, Cookie,
+// Set-Cookie and X-Api-Key.
+func (c *HTTPClient) SetSensitiveHeaders(names ...string) {
+	c.redactor.setSensitiveHeaders(names...)
+}
+
+// RedactHeaders returns a copy of headers with sensitive values replaced by a
+// marker and a short hash of the value
+func (c *HTTPClient) RedactHeaders(headers http.Header) http.Header {
+	return c.redactor.redact(headers)
+}
+
+// RegisterCodec registers codec for its content type, replacing any codec
+// registered for it before, for use by Send and Decode
+func (c *HTTPClient) RegisterCodec(codec Codec) {
+	c.codecs.register(codec)
+}
+
+// Codec returns the codec registered for contentType, or an
+// *ErrUnsupportedContentType when there is none
+func (c *HTTPClient) Codec(contentType string) (Codec, error) {
+	return c.codecs.lookup(contentType)
 }
 
 // Get makes a HTTP GET request to provided URL
-func (c *httpClient) Get(url string, headers http.Header) (Response, error) {
+func (c *HTTPClient) Get(url string, headers http.Header) (Response, error) {
 	response := Response{}
 
-	request, err := http.NewRequest(http.MethodGet, url, nil)
+	request, err := newRequest(http.MethodGet, url, nil)
 	if err != nil {
-		return response, errors.Wrap(err, "GET - request creation failed")
+		return response, err
 	}
 
 	request.Header = headers
@@ -57,13 +594,20 @@ func (c *httpClient) Get(url string, headers http.Header) (Response, error) {
 	return c.do(request)
 }
 
+// GetNegotiated makes a HTTP GET request to provided URL accepting the media
+// types in acceptable, most preferred first, and returns the media type the
+// server chose, as the package function GetNegotiated does
+func (c *HTTPClient) GetNegotiated(url string, acceptable []string, headers http.Header) (Response, string, error) {
+	return GetNegotiated(c, url, acceptable, headers)
+}
+
 // Post makes a HTTP POST request to provided URL and requestBody
-func (c *httpClient) Post(url string, body io.Reader, headers http.Header) (Response, error) {
+func (c *HTTPClient) Post(url string, body io.Reader, headers http.Header) (Response, error) {
 	response := Response{}
 
-	request, err := http.NewRequest(http.MethodPost, url, body)
+	request, err := newRequest(http.MethodPost, url, body)
 	if err != nil {
-		return response, errors.Wrap(err, "POST - request creation failed")
+		return response, err
 	}
 
 	request.Header = headers
@@ -72,12 +616,12 @@ func (c *httpClient) Post(url string, body io.Reader, headers http.Header) (Resp
 }
 
 // Put makes a HTTP PUT request to provided URL and requestBody
-func (c *httpClient) Put(url string, body io.Reader, headers http.Header) (Response, error) {
+func (c *HTTPClient) Put(url string, body io.Reader, headers http.Header) (Response, error) {
 	response := Response{}
 
-	request, err := http.NewRequest(http.MethodPut, url, body)
+	request, err := newRequest(http.MethodPut, url, body)
 	if err != nil {
-		return response, errors.Wrap(err, "PUT - request creation failed")
+		return response, err
 	}
 
 	request.Header = headers
@@ -86,12 +630,12 @@ func (c *httpClient) Put(url string, body io.Reader, headers http.Header) (Respo
 }
 
 // Patch makes a HTTP PATCH request to provided URL and requestBody
-func (c *httpClient) Patch(url string, body io.Reader, headers http.Header) (Response, error) {
+func (c *HTTPClient) Patch(url string, body io.Reader, headers http.Header) (Response, error) {
 	response := Response{}
 
-	request, err := http.NewRequest(http.MethodPatch, url, body)
+	request, err := newRequest(http.MethodPatch, url, body)
 	if err != nil {
-		return response, errors.Wrap(err, "PATCH - request creation failed")
+		return response, err
 	}
 
 	request.Header = headers
@@ -100,12 +644,12 @@ func (c *httpClient) Patch(url string, body io.Reader, headers http.Header) (Res
 }
 
 // Delete makes a HTTP DELETE request with provided URL
-func (c *httpClient) Delete(url string, headers http.Header) (Response, error) {
+func (c *HTTPClient) Delete(url string, headers http.Header) (Response, error) {
 	response := Response{}
 
-	request, err := http.NewRequest(http.MethodDelete, url, nil)
+	request, err := newRequest(http.MethodDelete, url, nil)
 	if err != nil {
-		return response, errors.Wrap(err, "DELETE - request creation failed")
+		return response, err
 	}
 
 	request.Header = headers
@@ -113,47 +657,246 @@ func (c *httpClient) Delete(url string, headers http.Header) (Response, error) {
 	return c.do(request)
 }
 
-func (c *httpClient) do(request *http.Request) (Response, error) {
-	hr := Response{}
+// Invoke makes a HTTP request with any method, such as the PROPFIND of
+// WebDAV or a PURGE, to provided URL and requestBody. Failed attempts are
+// only retried for the standard methods and those registered with
+// RegisterIdempotentMethod.
+func (c *HTTPClient) Invoke(method, url string, body io.Reader, headers http.Header) (Response, error) {
+	response := Response{}
+
+	request, err := newMethodRequest(method, url, body)
+	if err != nil {
+		return response, err
+	}
+
+	request.Header = headers
+
+	return c.do(request)
+}
+
+// Do sends a request built by the caller. No attempt is sent, and no backoff
+// is waited for, once the request context is cancelled or past its deadline.
+func (c *HTTPClient) Do(request *http.Request) (Response, error) {
+	return c.do(request)
+}
+
+// NewRequest returns a builder for a request with method to the URL the
+// RFC 6570 template expands to, sent through the client by its Do
+func (c *HTTPClient) NewRequest(method, template string) *RequestBuilder {
+	return newRequestBuilder(c, method, template)
+}
+
+// PostAsync queues a HTTP POST request to be sent in the background through
+// the usual retries, returning an *ErrQueueFull without blocking when the
+// queue is full. Jobs are not guaranteed to be sent in order.
+func (c *HTTPClient) PostAsync(url string, body []byte, headers http.Header) error {
+	if _, err := normalizeURL(url); err != nil {
+		return err
+	}
+
+	if c.shutdown.closed() {
+		return ErrClientClosed
+	}
+
+	return c.async.enqueue(url, body, headers)
+}
+
+// Flush waits until every job queued by PostAsync has been sent, returning
+// early with the context error once ctx is done
+func (c *HTTPClient) Flush(ctx context.Context) error {
+	return c.async.flush(ctx)
+}
+
+// Shutdown stops the client accepting requests, which then fail with
+// ErrClientClosed, and waits until the requests in flight and the jobs queued
+// by PostAsync are done. Their retries go on while the backoff before them
+// ends before the deadline of ctx, and are given up with the error of the last
+// attempt otherwise. Once ctx is done, the requests still in flight are
+// cancelled as by CancelInFlight and the queued jobs dropped. The PostAsync
+// workers are then stopped and the idle connections of the transport closed,
+// including those of the clients made with Derive, which share them but have
+// to be shut down on their own. It returns an *ErrShutdownIncomplete when
+// requests were cut short, and Stats counts the requests drained and aborted.
+func (c *HTTPClient) Shutdown(ctx context.Context) error {
+	c.shutdown.close(ctx)
+	c.async.flush(ctx)
+	err := c.shutdown.wait(ctx, func() int { return c.inFlight.cancel("*") })
+	c.async.close()
+	closeIdleConnections(c.settings().client)
+
+	return c.shutdown.result(err)
+}
+
+// Prewarm connects to the host of each of urls, resolved against the base
+// URL, and leaves the connection in the pool, so that the first requests to
+// them skip DNS, dialing and the TLS handshake. Each host is warmed by a HEAD
+// request sent straight through the transport, and so through the proxy,
+// TLS and dialer settings of the client, within ctx and the client timeout.
+// A host with an idle pooled connection reuses it and dials nothing. Retries
+// and middlewares are skipped. Without WithKeepAlive a warm connection
+// serves one request. Hosts that could not be warmed are listed in an
+// *ErrPrewarmFailed.
+func (c *HTTPClient) Prewarm(ctx context.Context, urls ...string) error {
+	return prewarm(ctx, c.settings().client, c.guard, c.base, urls)
+}
+
+func (c *HTTPClient) postAsyncJob(job asyncJob) {
+	if c.shutdown.drop() {
+		c.settings().expvar.dropAsync()
+		return
+	}
+	request, err := newRequest(http.MethodPost, job.url, bytes.NewReader(job.body))
+	if err != nil {
+		return
+	}
+	request.Header = job.headers
+
+	c.shutdown.admit()
+	defer c.shutdown.leave()
+	c.run(request)
+}
+
+func (c *HTTPClient) dropAsyncJob() {
+	c.settings().expvar.dropAsync()
+}
+
+// GetSSE opens a server-sent event stream at the provided URL. Events are
+// delivered on the returned channel, which is closed once the stream ends. On
+// disconnect the stream is resumed with the Last-Event-ID header, waiting as
+// advised by the retrier, unless it carried a line over the limit set with
+// WithMaxSSELineSize: the last event then has Err set. Calling the returned func or cancelling ctx closes
+// the stream.
+// Every connect goes through the middlewares of the client and is reported
+// to its plugins, stats and slow request log as a request ending once the
+// response headers are in.
+func (c *HTTPClient) GetSSE(ctx context.Context, url string, headers http.Header) (<-chan Event, func(), error) {
+	return openSSE(ctx, newSSEStream(url, headers, c.settings(), c.options, c.guard, c.base))
+}
+
+func (c *HTTPClient) do(request *http.Request) (Response, error) {
+	if !c.shutdown.enter() {
+		return Response{}, ErrClientClosed
+	}
+	defer c.shutdown.leave()
+
+	return c.run(request)
+}
+
+// run sends a request admitted by the shutdown gate
+func (c *HTTPClient) run(request *http.Request) (Response, error) {
+	c.stats.begin()
+	settings := c.settings()
+
+	began := c.options.clock.Now()
+	var response Response
+	err := settings.plugins.start(request)
+	if err == nil {
+		response, err = c.dispatch(request, settings)
+	}
+	now := c.options.clock.Now()
+	err = settings.slow.observe(request, response, err, now.Sub(began), now, c.options.slowRedactQuery)
+	err = settings.deprecations.observe(request, response, err, now, settings.expvar)
+	err = settings.plugins.end(request, response, err)
+	c.stats.end(response, err, now.Sub(began), c.options.apdex, now)
+
+	return response, err
+}
+
+// dispatch checks request and sends it, sharing the response with identical
+// requests in flight when singleflight is enabled
+func (c *HTTPClient) dispatch(request *http.Request, settings attemptSettings) (Response, error) {
+	resolved, err := c.base.resolve(request.URL)
+	if err != nil {
+		return Response{}, err
+	}
+	// The caller's request keeps its URL
+	copied := *request
+	copied.URL = resolved
+	request = &copied
+	reserved, err := c.bodies.reserve(request, c.options.bodyBudgetWait, c.options.clock)
+	if err != nil {
+		return Response{}, err
+	}
+	defer c.bodies.release(reserved)
+	if request, err = c.options.balancer.route(request, c.options.clock.Now()); err != nil {
+		return Response{}, err
+	}
 
-	request.Close = true
-	multiErr := valkyrie.NewMultiError()
+	if err := checkRequestURL(request.URL); err != nil {
+		return Response{}, err
+	}
 
-	for i := 0; i <= c.retryCount; i++ {
-		var err error
-		response, err := c.client.Do(request)
-		if err != nil {
-			multiErr.Push(err.Error())
-			backoffTime := c.retrier.NextInterval(i)
-			time.Sleep(backoffTime)
-			continue
-		}
+	if err := c.options.openAPI.validate(request, c.options.openAPIStrict); err != nil {
+		return Response{}, err
+	}
 
-		if response.Body != nil {
-			hr.body, err = ioutil.ReadAll(response.Body)
-			if err != nil {
-				multiErr.Push(err.Error())
-				backoffTime := c.retrier.NextInterval(i)
-				time.Sleep(backoffTime)
-				continue
-			}
-		}
+	if err := validateRequest(settings.requestValidator, request); err != nil {
+		return Response{}, err
+	}
 
-		response.Body.Close()
+	tracked := c.inFlight.track(withRequestTrace(request.Context(), c.options.clock), request, c.options.clock.Now())
+	response, err := c.options.dedup.do(tracked.request, c.options.clock, c.options.flights, func(request *http.Request) (Response, error) {
+		return c.send(request, settings)
+	})
+	if err = c.inFlight.done(tracked, response, err); err != nil {
+		return response, err
+	}
+	if err := apiVersionRejected(settings.apiVersion, response); err != nil {
+		return response, err
+	}
 
-		hr.statusCode = response.StatusCode
+	return response, c.options.responseSchemas.validate(request, response)
+}
 
-		if response.StatusCode >= http.StatusInternalServerError {
-			multiErr.Push(fmt.Sprintf("server error: %d", response.StatusCode))
+func (c *HTTPClient) send(request *http.Request, settings attemptSettings) (Response, error) {
+	request.Close = !c.options.keepAlive
+	expectContinue(request, c.options)
+	pinAPIVersion(request, settings.apiVersion)
+	settings.baggage.apply(request)
 
-			backoffTime := c.retrier.NextInterval(i)
-			time.Sleep(backoffTime)
-			continue
-		}
+	if err := c.guard.checkURL(request.URL); err != nil {
+		return Response{}, err
+	}
 
-		multiErr = valkyrie.NewMultiError() // Clear errors if any iteration succeeds
-		break
+	settings.retryCount = methodRetryCount(request.Method, requestRetryCount(request, settings.retryCount))
+	doer := buildDoer(c.options, settings)
+	attempt := func(request *http.Request, attempt int, lastResponse Response) attemptOutcome {
+		return settings.interceptors.apply(c.attempt(doer, request, attempt, settings))
 	}
 
-	return hr, multiErr.HasError()
+	hooks := c.retryHooks(settings)
+	hooks.connectRetrier = requestRetrier(settings.connectRetrier)
+
+	return executeWithRetries(request, attempt, requestRetrier(settings.retrier), settings.retryCount, hooks)
+}
+
+// attempt sends the request once
+func (c *HTTPClient) attempt(doer Doer, request *http.Request, attempt int, settings attemptSettings) attemptOutcome {
+	response, abort, err := sendAttempt(doer, request, attempt, settings, c.options, "server error: %d")
+	if abort != nil {
+		return attemptOutcome{response: response, abort: abort}
+	}
+
+	return attemptOutcomeOf(response, err, err, c.options)
+}
+
+func (c *HTTPClient) retryHooks(settings attemptSettings) retryHooks {
+	return retryHooks{
+		clock:       c.options.clock,
+		mutators:    settings.requestMutators,
+		failures:    c.options.failures,
+		retryBudget: c.options.retryBudget,
+		concurrency: c.options.concurrency,
+		rateLimits:  c.options.rateLimits,
+		expvar:      settings.expvar,
+
+		minAttemptBudget: settings.minAttemptBudget,
+		stats:            c.stats,
+		tenants:          c.tenants,
+		decisions:        c.options.decisions,
+		apdex:            c.options.apdex,
+		maintenance:      settings.maintenance,
+		shutdown:         c.shutdown,
+		queue:            c.options.queue,
+	}
 }
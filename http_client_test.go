@@ -2,11 +2,19 @@ package heimdall
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/gojektech/heimdall/fakeclock"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -169,7 +177,8 @@ func TestHTTPClientPatchSuccess(t *testing.T) {
 }
 
 func TestHTTPClientGetRetriesOnFailure(t *testing.T) {
-	client := NewHTTPClient(10)
+	clock := fakeclock.New(time.Now())
+	client := NewHTTPClient(10, WithClock(clock))
 
 	count := 0
 
@@ -195,6 +204,7 @@ func TestHTTPClientGetRetriesOnFailure(t *testing.T) {
 	require.Equal(t, "{ \"response\": \"something went wrong\" }", string(response.Body()))
 
 	assert.Equal(t, noOfCalls, count)
+	assert.Equal(t, []time.Duration{0, time.Millisecond, time.Millisecond}, clock.Sleeps(), "no backoff follows the final attempt")
 }
 
 func TestHTTPClientGetReturnsAllErrorsIfRetriesFail(t *testing.T) {
@@ -263,7 +273,7 @@ func TestHTTPClientGetReturnsErrorOnClientCallFailure(t *testing.T) {
 	}
 
 	server := httptest.NewServer(http.HandlerFunc(dummyHandler))
-	server.URL = "" // Invalid URL to simulate client.Do error
+	server.URL = "" // Invalid URL, rejected before any attempt
 	defer server.Close()
 
 	response, err := client.Get(server.URL, http.Header{})
@@ -271,7 +281,7 @@ func TestHTTPClientGetReturnsErrorOnClientCallFailure(t *testing.T) {
 
 	require.NotEqual(t, http.StatusOK, response.StatusCode())
 
-	assert.Equal(t, "Get : unsupported protocol scheme \"\"", err.Error())
+	assert.Equal(t, "invalid URL \"\": empty URL", err.Error())
 }
 
 func TestHTTPClientGetReturnsErrorOnParseResponseFailure(t *testing.T) {
@@ -291,7 +301,8 @@ func TestHTTPClientGetReturnsErrorOnParseResponseFailure(t *testing.T) {
 
 	require.NotEqual(t, http.StatusOK, response.StatusCode())
 
-	assert.Equal(t, "unexpected EOF", err.Error())
+	assert.True(t, errors.Is(err, io.ErrUnexpectedEOF))
+	assert.Equal(t, "truncated body: read 0 of the 3 bytes of Content-Length", err.Error())
 }
 
 func TestHTTPClientGetReturnsErrorOn5xxFailure(t *testing.T) {
@@ -312,3 +323,386 @@ func TestHTTPClientGetReturnsErrorOn5xxFailure(t *testing.T) {
 
 	assert.Equal(t, "server error: 500", err.Error())
 }
+
+func TestHTTPClientReturnsErrorResponseBodyOn5xx(t *testing.T) {
+	client := NewHTTPClient(10)
+
+	dummyHandler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Trace-Id", "trace-42")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{ "error": "maintenance", "trace_id": "trace-42" }`))
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(dummyHandler))
+	defer server.Close()
+
+	client.SetRetryCount(1)
+
+	response, err := client.Get(server.URL, http.Header{})
+	require.Error(t, err)
+
+	assert.Equal(t, http.StatusServiceUnavailable, response.StatusCode())
+	assert.Equal(t, "trace-42", response.Headers().Get("X-Trace-Id"))
+	assert.Equal(t, `{ "error": "maintenance", "trace_id": "trace-42" }`, string(response.Body()))
+
+	exhausted, ok := err.(*RetriesExhaustedError)
+	require.True(t, ok, "error should be a RetriesExhaustedError")
+	assert.Equal(t, 2, exhausted.Attempts)
+	assert.Equal(t, response, exhausted.LastResponse)
+}
+
+func TestHTTPClientResetsResponseBetweenAttempts(t *testing.T) {
+	client := NewHTTPClient(10)
+
+	count := 0
+	dummyHandler := func(w http.ResponseWriter, r *http.Request) {
+		count++
+		if count == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`first attempt failed`))
+			return
+		}
+
+		conn, _, err := w.(http.Hijacker).Hijack()
+		require.NoError(t, err)
+		conn.Close()
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(dummyHandler))
+	defer server.Close()
+
+	client.SetRetryCount(1)
+
+	response, err := client.Get(server.URL, http.Header{})
+	require.Error(t, err)
+
+	assert.Equal(t, 0, response.StatusCode(), "final attempt got no response")
+	assert.Nil(t, response.Body())
+
+	exhausted, ok := err.(*RetriesExhaustedError)
+	require.True(t, ok, "error should be a RetriesExhaustedError")
+	assert.Equal(t, http.StatusServiceUnavailable, exhausted.LastResponse.StatusCode())
+	assert.Equal(t, "first attempt failed", string(exhausted.LastResponse.Body()))
+}
+
+func TestHTTPClientStartsBackoffStateAfreshForEachRequest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	backoff := NewDecorrelatedJitterBackoff(time.Millisecond, time.Second)
+	backoff.(*decorrelatedJitterBackoff).random = func(n int64) int64 { return n - 1 }
+
+	clock := fakeclock.New(time.Now())
+	client := NewHTTPClient(10, WithClock(clock))
+	client.SetRetryCount(2)
+	client.SetRetrier(NewRetrier(backoff))
+
+	for i := 0; i < 2; i++ {
+		_, err := client.Get(server.URL, http.Header{})
+		require.Error(t, err)
+	}
+
+	ms := time.Millisecond
+	assert.Equal(t, []time.Duration{0, 3 * ms, 0, 3 * ms}, clock.Sleeps())
+}
+
+func redirectServer() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/moved", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/target", http.StatusMovedPermanently)
+	})
+	mux.HandleFunc("/found", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/target", http.StatusFound)
+	})
+	mux.HandleFunc("/submit", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/target", http.StatusSeeOther)
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	mux.HandleFunc("/target", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Method + " target"))
+	})
+
+	return httptest.NewServer(mux)
+}
+
+func TestHTTPClientFollowsRedirectsByDefault(t *testing.T) {
+	server := redirectServer()
+	defer server.Close()
+
+	client := NewHTTPClient(100)
+
+	for _, path := range []string{"/moved", "/found"} {
+		response, err := client.Get(server.URL+path, http.Header{})
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusOK, response.StatusCode())
+		assert.Equal(t, "GET target", string(response.Body()))
+		assert.Equal(t, server.URL+"/target", response.FinalURL())
+	}
+}
+
+func TestHTTPClientFollowsSeeOtherAfterPostWithGet(t *testing.T) {
+	server := redirectServer()
+	defer server.Close()
+
+	response, err := NewHTTPClient(100).Post(server.URL+"/submit", bytes.NewBufferString("{}"), http.Header{})
+	require.NoError(t, err)
+
+	assert.Equal(t, "GET target", string(response.Body()))
+	assert.Equal(t, server.URL+"/target", response.FinalURL())
+}
+
+func TestHTTPClientReturnsRedirectsWhenEnabled(t *testing.T) {
+	server := redirectServer()
+	defer server.Close()
+
+	client := NewHTTPClient(100)
+	client.SetReturnRedirects(true)
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/moved", http.StatusMovedPermanently},
+		{"/found", http.StatusFound},
+	}
+
+	for _, test := range tests {
+		response, err := client.Get(server.URL+test.path, http.Header{})
+		require.NoError(t, err, test.path)
+
+		assert.Equal(t, test.status, response.StatusCode())
+		assert.Equal(t, "/target", response.Headers().Get("Location"))
+		assert.Contains(t, string(response.Body()), "/target")
+		assert.Equal(t, server.URL+test.path, response.FinalURL())
+	}
+
+	response, err := client.Post(server.URL+"/submit", bytes.NewBufferString("{}"), http.Header{})
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusSeeOther, response.StatusCode())
+	assert.Equal(t, "/target", response.Headers().Get("Location"))
+}
+
+func TestHTTPClientRedirectLoop(t *testing.T) {
+	server := redirectServer()
+	defer server.Close()
+
+	client := NewHTTPClient(100)
+
+	_, err := client.Get(server.URL+"/loop", http.Header{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "stopped after 10 redirects")
+
+	client.SetReturnRedirects(true)
+
+	response, err := client.Get(server.URL+"/loop", http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusFound, response.StatusCode())
+	assert.Equal(t, "/loop", response.Headers().Get("Location"))
+}
+
+// cancellingClock cancels the request context as soon as a backoff starts
+type cancellingClock struct {
+	realClock
+	cancel context.CancelFunc
+}
+
+func (c cancellingClock) Sleep(ctx context.Context, d time.Duration) error {
+	c.cancel()
+	return c.realClock.Sleep(ctx, d)
+}
+
+func TestHTTPClientDoFailsFastWithCancelledContext(t *testing.T) {
+	count := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count++
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	request, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+
+	client := NewHTTPClient(100)
+	client.SetRetryCount(3)
+
+	response, err := client.Do(request.WithContext(ctx))
+	require.Error(t, err)
+
+	contextDone, ok := err.(*ErrContextDone)
+	require.True(t, ok, "expected *ErrContextDone, got %T", err)
+	assert.Equal(t, 0, contextDone.Attempts)
+	assert.Equal(t, context.Canceled, contextDone.Unwrap())
+	assert.False(t, contextDone.Timeout())
+	assert.Equal(t, 0, response.StatusCode())
+	assert.Equal(t, 0, count)
+}
+
+func TestHTTPClientDoFailsFastPastDeadline(t *testing.T) {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	request, err := http.NewRequest(http.MethodGet, "http://127.0.0.1:0/", nil)
+	require.NoError(t, err)
+
+	_, err = NewHTTPClient(100).Do(request.WithContext(ctx))
+
+	contextDone, ok := err.(*ErrContextDone)
+	require.True(t, ok, "expected *ErrContextDone, got %T", err)
+	assert.True(t, contextDone.Timeout())
+}
+
+func TestHTTPClientDoStopsRetryingWhenCancelledDuringBackoff(t *testing.T) {
+	count := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := NewHTTPClient(100, WithClock(cancellingClock{cancel: cancel}))
+	client.SetRetryCount(3)
+	client.SetRetrier(NewRetrier(NewConstantBackoff(10000)))
+
+	request, err := http.NewRequest(http.MethodPost, server.URL, bytes.NewBufferString("{}"))
+	require.NoError(t, err)
+
+	began := time.Now()
+	response, err := client.Do(request.WithContext(ctx))
+	require.Error(t, err)
+
+	contextDone, ok := err.(*ErrContextDone)
+	require.True(t, ok, "expected *ErrContextDone, got %T", err)
+	assert.Equal(t, 1, contextDone.Attempts)
+	assert.Equal(t, http.StatusInternalServerError, contextDone.LastResponse.StatusCode())
+	assert.Equal(t, http.StatusInternalServerError, response.StatusCode())
+	assert.Equal(t, 1, count)
+	assert.True(t, time.Since(began) < time.Second, "backoff should stop once the context is cancelled")
+}
+
+func TestHTTPClientDeriveSharesConnectionPool(t *testing.T) {
+	var connections int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&connections, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	parent := NewHTTPClient(1000, WithKeepAlive())
+	derived := parent.Derive()
+
+	assert.Equal(t, parent.current.client.Transport, derived.current.client.Transport)
+
+	_, err := parent.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+	_, err = derived.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&connections))
+}
+
+func TestHTTPClientDeriveCopiesConfiguration(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if r.URL.Query().Get("fail") != "" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		w.Write([]byte(r.Header.Get("X-Tenant") + r.URL.Path))
+	}))
+	defer server.Close()
+
+	parent := NewHTTPClient(1000)
+	parent.SetBaseURL(server.URL + "/parent")
+	parent.Use(NewHeaderMiddleware(http.Header{"X-Tenant": []string{"base"}}))
+
+	derived := parent.Derive()
+	derived.SetBaseURL(server.URL + "/derived")
+	derived.Use(NewHeaderMiddleware(http.Header{"X-Tenant": []string{"acme"}}))
+	derived.SetRetryCount(2)
+	derived.SetAllowedHosts([]string{"nowhere.example.com"})
+
+	response, err := parent.Get("/users", http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, "base/parent/users", string(response.Body()))
+
+	_, err = derived.Get("/users", http.Header{})
+	assert.IsType(t, &ErrForbiddenHost{}, err)
+
+	derived.SetAllowedHosts(nil)
+	response, err = derived.Get("/users", http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, "acme/derived/users", string(response.Body()))
+
+	atomic.StoreInt32(&calls, 0)
+	parent.Get("/users?fail=1", http.Header{})
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "the retry count of the derived client leaked into the parent")
+}
+
+func TestHTTPClientDeriveWhileParentServesTraffic(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	parent := NewHTTPClient(1000, WithKeepAlive())
+	parent.AddRequestMutator(RequestMutatorFunc(func(request *http.Request) error {
+		request.Header.Set("X-Parent", "true")
+		return nil
+	}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				_, err := parent.Get(server.URL, http.Header{})
+				assert.NoError(t, err)
+			}
+		}()
+	}
+
+	for i := 0; i < 25; i++ {
+		derived := parent.Derive()
+		derived.SetRetryCount(i)
+		derived.SetBaseURL(server.URL)
+		derived.SetSensitiveHeaders("X-Tenant")
+		derived.SetAllowedHosts([]string{"127.0.0.1"})
+		derived.AddRequestMutator(RequestMutatorFunc(func(request *http.Request) error {
+			request.Header.Set("X-Tenant", "acme")
+			return nil
+		}))
+		_, err := derived.Get("/", http.Header{})
+		assert.NoError(t, err)
+	}
+
+	wg.Wait()
+	assert.Len(t, parent.current.requestMutators, 1)
+}
+
+func TestHTTPClientWithTimeoutOverridesConstructorTimeout(t *testing.T) {
+	client := NewHTTPClient(10, WithTimeout(time.Second))
+	assert.Equal(t, time.Second, client.current.client.Timeout)
+
+	derived := client.Derive()
+	assert.Equal(t, time.Second, derived.current.client.Timeout)
+
+	derived = NewHTTPClient(10).Derive(WithTimeout(2 * time.Second))
+	assert.Equal(t, 2*time.Second, derived.current.client.Timeout)
+}
@@ -1,63 +1,638 @@
 package heimdall
 
 import (
-	"fmt"
+	"bytes"
+	"context"
 	"io"
-	"io/ioutil"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/afex/hystrix-go/hystrix"
-
-	"github.com/pkg/errors"
 )
 
 const defaultHystrixRetryCount int = 0
 
-type hystrixHTTPClient struct {
-	client *http.Client
+// HystrixHTTPClient is the Client sending every attempt of its requests as a
+// hystrix command, so that a failing server opens its circuit. Its setters and
+// SwapTransport may be called while requests are in flight.
+type HystrixHTTPClient struct {
+	// mu guards the settings, which setters, ApplyConfig and SwapTransport
+	// change at runtime; requests read them through settings
+	mu      sync.RWMutex
+	current clientSettings
 
 	hystrixCommandName string
-
-	retryCount int
-	retrier    Retriable
+	hystrixConfig      HystrixConfig
+
+	options clientOptions
+	guard   *hostGuard
+
+	redactor *headerRedactor
+	async    *asyncQueue
+	base     *baseURL
+	codecs   *codecRegistry
+	stats    *clientStats
+	tenants  *tenantQuotas
+	bodies   *bodyBudget
+	inFlight *inFlightTracker
+	shutdown *shutdownGate
+
+	breaker *breakerTracker
 }
 
 // NewHystrixHTTPClient returns a new instance of HystrixHTTPClient
-func NewHystrixHTTPClient(timeoutInMillis int, hystrixConfig HystrixConfig) Client {
-	httpTimeout := time.Duration(timeoutInMillis) * time.Millisecond
+func NewHystrixHTTPClient(timeoutInMillis int, hystrixConfig HystrixConfig, opts ...Option) *HystrixHTTPClient {
+	options := newClientOptions(opts)
+	httpTimeout := options.httpTimeout(time.Duration(timeoutInMillis) * time.Millisecond)
+	guard := newHostGuard()
 	httpClient := &http.Client{
-		Timeout: httpTimeout,
+		Timeout:       httpTimeout,
+		Transport:     newTransport(guard, options),
+		CheckRedirect: guard.checkRedirect,
+	}
+
+	if options.hystrixConfig != nil {
+		hystrixConfig = *options.hystrixConfig
 	}
 
 	hystrix.ConfigureCommand(hystrixConfig.commandName, hystrixConfig.commandConfig)
 
-	return &hystrixHTTPClient{
-		client: httpClient,
+	hhc := &HystrixHTTPClient{
+		current: clientSettings{
+			client: httpClient,
+
+			retryCount:          defaultHystrixRetryCount,
+			retrier:             NewNoRetrier(),
+			connectRetrier:      newConnectFailureRetrier(),
+			drainLimit:          defaultDrainLimit,
+			strictContentLength: true,
+		},
 
-		retryCount:         defaultHystrixRetryCount,
-		retrier:            NewNoRetrier(),
 		hystrixCommandName: hystrixConfig.commandName,
+		hystrixConfig:      hystrixConfig,
+
+		options: options,
+		guard:   guard,
+
+		redactor: newHeaderRedactor(),
+		base:     &baseURL{},
+		codecs:   newCodecRegistry(),
+		stats:    newClientStats(options.clock.Now()),
+		tenants:  newTenantQuotas(),
+		bodies:   newBodyBudget(),
+		inFlight: newInFlightTracker(),
+		shutdown: newShutdownGate(),
+
+		breaker: newBreakerTracker(hystrixConfig, options.clock),
+	}
+	hhc.async = newAsyncQueue(hhc.options.asyncQueueSize, hhc.options.asyncWorkers, hhc.postAsyncJob, hhc.dropAsyncJob)
+	autoRegister(hhc, hhc.options)
+
+	return hhc
+}
+
+// Derive returns a client sharing the underlying http.Client, and so the
+// transport and its connection pool, with hhc. Retry settings, mutators,
+// middlewares, the validator, host allowlist, redirect and redaction settings,
+// the base URL and codecs are copied, so setting them on either client never affects
+// the other. Private network blocking is enforced by the shared transport and
+// stays shared. The derived client has its own async queue and singleflight
+// group, and publishes into the same expvar counters and audit log until
+// EnableExpvar or EnableAuditLog is called on it. It runs under the same hystrix command, sharing its circuit,
+// unless opts include WithHystrixConfig.
+func (hhc *HystrixHTTPClient) Derive(opts ...Option) *HystrixHTTPClient {
+	guard := hhc.guard.clone()
+	options := hhc.options.derive(opts)
+
+	hhc.mu.RLock()
+	defer hhc.mu.RUnlock()
+
+	commandName, hystrixConfig, breaker := hhc.hystrixCommandName, hhc.hystrixConfig, hhc.breaker
+	if options.hystrixConfig != nil && options.hystrixConfig.commandName != commandName {
+		commandName, hystrixConfig = options.hystrixConfig.commandName, *options.hystrixConfig
+		hystrix.ConfigureCommand(commandName, hystrixConfig.commandConfig)
+		breaker = newBreakerTracker(hystrixConfig, options.clock)
+	}
+
+	derived := &HystrixHTTPClient{
+		current: hhc.current.derive(options, guard),
+
+		hystrixCommandName: commandName,
+		hystrixConfig:      hystrixConfig,
+
+		options: options,
+		guard:   guard,
+
+		redactor: hhc.redactor.clone(),
+		base:     hhc.base.clone(),
+		codecs:   hhc.codecs.clone(),
+		stats:    newClientStats(options.clock.Now()),
+		tenants:  hhc.tenants.clone(),
+		bodies:   hhc.bodies.clone(),
+		inFlight: newInFlightTracker(),
+		shutdown: newShutdownGate(),
+
+		breaker: breaker,
+	}
+	derived.async = newAsyncQueue(derived.options.asyncQueueSize, derived.options.asyncWorkers, derived.postAsyncJob, derived.dropAsyncJob)
+
+	return derived
+}
+
+// With returns a view of hhc setting the defaults of opts, such as a header
+// with Header or a retry count with Retry, on every request sent through it.
+// Everything else is that of hhc, the hystrix command and its circuit as
+// well as settings, so setting them on the view sets them on hhc. Headers a
+// request sets itself win over the defaults, and the defaults of a view made
+// from another view win over those of the other. Views are cheap to make and
+// safe for concurrent use.
+func (hhc *HystrixHTTPClient) With(opts ...RequestOption) Client {
+	return newScopedClient(hhc, requestDefaults{}, opts)
+}
+
+// ApplyConfig swaps the timeout, retry settings, base URL, default headers
+// and response size limit of hhc for those of cfg, keeping the transport and
+// its connection pool. Requests in flight keep the settings they started
+// with. The hystrix command cannot change in place, so cfg must describe the
+// current one; Derive with WithHystrixConfig to move to another. An invalid
+// cfg fails with an *ErrInvalidConfig and changes nothing.
+func (hhc *HystrixHTTPClient) ApplyConfig(cfg ClientConfig) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	if cfg.Hystrix == nil {
+		return invalidConfig("hystrix", "cannot be removed from a running hystrix client")
+	}
+	if cfg.Hystrix.hystrixConfig() != hhc.hystrixConfig {
+		return invalidConfig("hystrix", "the command of a running client cannot change, derive a client with WithHystrixConfig instead")
+	}
+
+	hhc.mu.Lock()
+	defer hhc.mu.Unlock()
+
+	hhc.current.client = withTimeout(hhc.current.client, time.Duration(cfg.Timeout))
+	hhc.current.retryCount = cfg.RetryCount
+	hhc.current.retrier = cfg.retrier()
+	hhc.current.configured = cfg.middlewares()
+	hhc.base.set(cfg.BaseURL)
+
+	return nil
+}
+
+// settings returns the settings of a request starting now
+func (hhc *HystrixHTTPClient) settings() attemptSettings {
+	hhc.mu.RLock()
+	defer hhc.mu.RUnlock()
+
+	return newAttemptSettings(hhc.current, hhc.redactor, hhc.stats)
+}
+
+// Stats returns a snapshot of the requests made by hhc since it was created
+// or ResetStats was last called, with the state of its hystrix circuit.
+// Clients made with Derive count on their own.
+func (hhc *HystrixHTTPClient) Stats() ClientStats {
+	stats := hhc.stats.snapshot(hhc.settings(), hhc.options)
+	stats.Tenants = hhc.tenants.snapshot()
+	stats.BodyBytesInFlight = hhc.bodies.snapshot()
+	stats.ShutdownDrained, stats.ShutdownAborted = hhc.shutdown.counts()
+	if stats.ConcurrencyLimit == 0 {
+		stats.ConcurrencyLimit = hhc.hystrixConfig.commandConfig.MaxConcurrentRequests
+		if stats.ConcurrencyLimit == 0 {
+			stats.ConcurrencyLimit = hystrix.DefaultMaxConcurrent
+		}
+	}
+
+	stats.Circuit = CircuitClosed
+	if circuit, _, err := hystrix.GetCircuit(hhc.hystrixCommandName); err == nil && circuit.IsOpen() || hhc.breaker.gating() {
+		stats.Circuit = CircuitOpen
 	}
+
+	return stats
+}
+
+// ResetStats zeroes the counters returned by Stats, leaving the hystrix
+// circuit as it is
+func (hhc *HystrixHTTPClient) ResetStats() {
+	hhc.stats.reset(hhc.options.clock.Now())
+	hhc.tenants.reset()
 }
 
-// SetRetryCount sets the retry count for the hystrixHTTPClient
-func (hhc *hystrixHTTPClient) SetRetryCount(count int) {
-	hhc.retryCount = count
+// LastDecisions returns the last n retry decisions recorded by the decision
+// log of hhc, oldest first, or nil when hhc was made without WithDecisionLog
+func (hhc *HystrixHTTPClient) LastDecisions(n int) []DecisionRecord {
+	return hhc.options.decisions.last(n)
+}
+
+// InFlight returns the requests of hhc in flight, oldest first. Clients made
+// with Derive track their requests on their own.
+func (hhc *HystrixHTTPClient) InFlight() []InFlightRequest {
+	return hhc.inFlight.snapshot()
+}
+
+// CancelInFlight cancels the requests of hhc in flight to hosts matching
+// hostPattern, a host, with or without its port, a glob such as
+// "*.example.com" or a suffix such as ".example.com", returning how many it
+// cancelled. Cancelled requests return an *ErrContextDone whose error is
+// ErrOperatorCancelled.
+func (hhc *HystrixHTTPClient) CancelInFlight(hostPattern string) int {
+	return hhc.inFlight.cancel(hostPattern)
+}
+
+// SetBaseURL sets the URL that relative request URLs such as "/v1/users/42"
+// are resolved against. Absolute URLs are used as they are.
+func (hhc *HystrixHTTPClient) SetBaseURL(base string) {
+	hhc.base.set(base)
+}
+
+// SetRetryCount sets the retry count for the HystrixHTTPClient
+func (hhc *HystrixHTTPClient) SetRetryCount(count int) {
+	hhc.mu.Lock()
+	defer hhc.mu.Unlock()
+
+	hhc.current.retryCount = count
 }
 
 // SetRetrier sets the strategy for retrying
-func (hhc *hystrixHTTPClient) SetRetrier(retrier Retriable) {
-	hhc.retrier = retrier
+func (hhc *HystrixHTTPClient) SetRetrier(retrier Retriable) {
+	hhc.mu.Lock()
+	defer hhc.mu.Unlock()
+
+	hhc.current.retrier = retrier
+}
+
+// SetConnectFailureRetrier sets the strategy for retrying attempts that failed
+// before getting a connection, as refused dials and failed TLS handshakes do.
+// The retrier set with SetRetrier paces the retries of other failures. It
+// waits 10ms by default, and nil makes SetRetrier pace every retry.
+func (hhc *HystrixHTTPClient) SetConnectFailureRetrier(retrier Retriable) {
+	hhc.mu.Lock()
+	defer hhc.mu.Unlock()
+
+	hhc.current.connectRetrier = retrier
+}
+
+// SetDrainLimit caps how much of the error body of an attempt that will be
+// retried is read. Bodies within the limit leave the connection reusable,
+// longer ones are truncated and close the connection instead.
+func (hhc *HystrixHTTPClient) SetDrainLimit(limit int64) {
+	hhc.mu.Lock()
+	defer hhc.mu.Unlock()
+
+	hhc.current.drainLimit = limit
+}
+
+// SetStrictContentLength sets whether a response body read in full must be as
+// long as the Content-Length of the response. When strict, the default, a body cut
+// short fails the attempt with an *ErrTruncatedBody, which is retried. When
+// not, the body is not checked, and a body the transport reports cut short
+// fails with the error of the transport.
+func (hhc *HystrixHTTPClient) SetStrictContentLength(strict bool) {
+	hhc.mu.Lock()
+	defer hhc.mu.Unlock()
+
+	hhc.current.strictContentLength = strict
+}
+
+// SetResponseHeaderTimeout fails an attempt with ErrResponseHeaderTimeout when
+// its response headers take longer than timeout to arrive. Unlike the overall
+// client timeout it does not limit how long reading the body takes, so large
+// downloads can still fail fast on an unresponsive server. Zero disables it.
+func (hhc *HystrixHTTPClient) SetResponseHeaderTimeout(timeout time.Duration) {
+	hhc.mu.Lock()
+	defer hhc.mu.Unlock()
+
+	hhc.current.responseHeaderTimeout = timeout
+}
+
+// SetMinAttemptBudget sets the least time before the request context deadline
+// a retry needs to be worth sending. Backoff waits are cut short so that a
+// retry still gets that much time, and a retry that could not get it is
+// skipped, failing the request with an *ErrContextDone at once instead of
+// after the wait. Zero, the default, only cuts waits short.
+func (hhc *HystrixHTTPClient) SetMinAttemptBudget(budget time.Duration) {
+	hhc.mu.Lock()
+	defer hhc.mu.Unlock()
+
+	hhc.current.minAttemptBudget = budget
+}
+
+// SetSlowRequestHook calls fn with a report of every request taking longer
+// than threshold, retries and backoffs included, but for at most
+// maxPerMinute requests each minute, so that a slowdown of every request
+// cannot flood logs; zero or less reports them all. Reports over the cap are
+// counted in the Suppressed field of the next report made. fn is called on
+// the goroutine making the request once it completes, and a panic fails the
+// request with an *ErrCallbackPanic. A nil fn removes the hook. Clients made
+// with Derive keep the hook with a cap of their own.
+func (hhc *HystrixHTTPClient) SetSlowRequestHook(threshold time.Duration, maxPerMinute int, fn func(SlowRequestReport)) {
+	hhc.mu.Lock()
+	defer hhc.mu.Unlock()
+
+	hhc.current.slow = newSlowRequestLog(threshold, maxPerMinute, fn)
+}
+
+// SetDeprecationHook calls fn with the URL of every request whose response
+// carries a Deprecation or Sunset header, as upstreams retiring an endpoint
+// send, and what the headers say. Each URL, its scheme, host and path, is
+// reported at most once an interval, so that a busy deprecated endpoint does
+// not flood logs; zero or less reports every response. fn is called on the
+// goroutine making the request once it completes, and a panic fails the
+// request with an *ErrCallbackPanic. A nil fn removes the hook. Such
+// responses are counted by host in the deprecated_responses expvar map
+// whether or not a hook is set. Clients made with Derive keep the hook with
+// an interval of their own.
+func (hhc *HystrixHTTPClient) SetDeprecationHook(interval time.Duration, fn func(url string, info DeprecationInfo)) {
+	hhc.mu.Lock()
+	defer hhc.mu.Unlock()
+
+	hhc.current.deprecations = newDeprecationLog(interval, fn)
+}
+
+// SetMaintenanceDetector makes detector judge every response received,
+// reporting whether it announces planned maintenance of its host and when
+// to retry. Such a response fails its request at once with an
+// *ErrUpstreamMaintenance, and so do requests to the host until retryAt, or
+// a minute when retryAt is zero or past, without being sent. They consume
+// no retries and count as failures neither to the circuit breaker nor to
+// the failure detector. A panic of detector fails the attempt, and a nil
+// detector, the default, detects nothing. Clients made with Derive share
+// the paused hosts.
+func (hhc *HystrixHTTPClient) SetMaintenanceDetector(detector func(*Response) (inMaintenance bool, retryAt time.Time)) {
+	hhc.mu.Lock()
+	defer hhc.mu.Unlock()
+
+	hhc.current.maintenance = hhc.current.maintenance.withDetector(detector)
+}
+
+// SetMaintenanceHook makes fn announce each host entering maintenance, as
+// found by the maintenance detector, and leaving it, once a response after
+// its pause is not found to announce it. fn runs on the goroutine of the
+// request, and a panic fails that request with an *ErrCallbackPanic. A nil fn
+// removes the hook.
+func (hhc *HystrixHTTPClient) SetMaintenanceHook(fn func(MaintenanceEvent)) {
+	hhc.mu.Lock()
+	defer hhc.mu.Unlock()
+
+	hhc.current.maintenance = hhc.current.maintenance.withHook(fn)
+}
+
+// SetFailureClassifier makes classifier judge every attempt the server
+// answered without an error status, given its response and how long the
+// attempt took. An attempt it returns true for fails with an
+// *ErrClassifiedFailure as an attempt answered with a 5xx does: it is
+// retried while attempts remain, counted as a failure by the circuit breaker and the
+// failure detector, and its response is returned with the error when it is
+// the final attempt. classifier must not modify the response, and a panic
+// fails the attempt. A nil classifier, the default, only fails 5xx answers.
+func (hhc *HystrixHTTPClient) SetFailureClassifier(classifier func(response *Response, attemptDuration time.Duration) bool) {
+	hhc.mu.Lock()
+	defer hhc.mu.Unlock()
+
+	hhc.current.classifier = classifier
+}
+
+// SetBodyRetryPredicate makes fn judge every attempt the server answered
+// without an error status, given its status and up to maxInspectBytes of its
+// body, the whole body when 0 or less, for upstreams answering 200 with an
+// error in the body. An attempt it returns true for fails with an
+// *ErrRetryableBody as an attempt answered with a 5xx does: it is retried
+// with backoff while attempts remain, counted as a failure by the circuit breaker and the
+// failure detector, and its response, whole body included, is returned with
+// the error when it is the final attempt. fn must not modify the body, and a
+// panic fails the attempt. A nil fn, the default, removes the predicate.
+func (hhc *HystrixHTTPClient) SetBodyRetryPredicate(maxInspectBytes int, fn func(statusCode int, body []byte) bool) {
+	hhc.mu.Lock()
+	defer hhc.mu.Unlock()
+
+	hhc.current.bodyRetry = newBodyRetryPredicate(maxInspectBytes, fn)
+}
+
+// SetAPIVersion pins the API version of every request with strategy, such
+// as HeaderVersion or MediaTypeVersion, and fails requests whose response
+// strategy finds to refuse the version with an *ErrAPIVersionRejected,
+// returned alongside the response. A nil strategy, the default, pins none.
+func (hhc *HystrixHTTPClient) SetAPIVersion(strategy VersionStrategy) {
+	hhc.mu.Lock()
+	defer hhc.mu.Unlock()
+
+	hhc.current.apiVersion = strategy
+}
+
+// SetBaggagePropagation sets the headers of allowlist, such as baggage, that
+// the context of a request carries, as ContextWithBaggage sets them, on every
+// attempt of the request. Their names and values may take maxTotalBytes at
+// most, none when 0 or less: the headers listed last are dropped first until
+// the rest fit. Values too long to fit on their own, or than the limit of
+// WithBaggageValueLimit, are dropped, or truncated with WithBaggageTruncation.
+// Headers the request sets keep their value. An empty allowlist, the default,
+// propagates none.
+func (hhc *HystrixHTTPClient) SetBaggagePropagation(allowlist []string, maxTotalBytes int, opts ...BaggageOption) {
+	hhc.mu.Lock()
+	defer hhc.mu.Unlock()
+
+	hhc.current.baggage = newBaggagePropagation(allowlist, maxTotalBytes, opts)
+}
+
+// AddRequestMutator registers a mutator run on the request before every attempt
+func (hhc *HystrixHTTPClient) AddRequestMutator(mutator RequestMutator) {
+	hhc.mu.Lock()
+	defer hhc.mu.Unlock()
+
+	hhc.current.requestMutators = append(hhc.current.requestMutators, mutator)
+}
+
+// SetRawRequestMutator runs mutator on every attempt right before it is
+// written, after the request mutators, middlewares and all other header
+// processing, as an escape hatch for upstreams with quirks Go normalizes
+// away. mutator may assign header names as they must be sent, such as
+// req.Header["X-API-KEY"], remove headers the transport would add or change
+// req.Host. Its sharp edges:
+//   - it is given a copy of the attempt, so its changes are not seen by
+//     middlewares, the audit log or hooks, and it runs again on every retry
+//   - names assigned directly are invisible to Header.Get and Header.Del,
+//     and are sent twice when the canonical name is set too, so delete that
+//   - Content-Length and Transfer-Encoding follow req.ContentLength and
+//     req.Body rather than the header map; a GET sends no Content-Length
+//     with a nil or http.NoBody body and no ContentLength
+//   - an empty User-Agent value stops the default one from being sent
+//   - HTTP/2 lower-cases every header name, so casing only survives on
+//     HTTP/1.1
+//
+// A panic fails the attempt with an *ErrCallbackPanic. A nil mutator removes
+// it.
+func (hhc *HystrixHTTPClient) SetRawRequestMutator(mutator func(*http.Request)) {
+	hhc.mu.Lock()
+	defer hhc.mu.Unlock()
+
+	hhc.current.rawMutator = mutator
+}
+
+// SetRequestValidator sets a validator run once per request before the first
+// attempt; a request it rejects fails with an *ErrRequestRejected and is
+// never sent. Use ChainValidators to combine several.
+func (hhc *HystrixHTTPClient) SetRequestValidator(validator RequestValidator) {
+	hhc.mu.Lock()
+	defer hhc.mu.Unlock()
+
+	hhc.current.requestValidator = validator
+}
+
+// AddPlugin adds plugin, which observes every request after the plugins
+// added before it. A panic in a plugin fails the request with an
+// *ErrCallbackPanic, which is reported to OnError of every plugin.
+func (hhc *HystrixHTTPClient) AddPlugin(plugin Plugin) {
+	hhc.mu.Lock()
+	defer hhc.mu.Unlock()
+
+	hhc.current.plugins = append(hhc.current.plugins, plugin)
+}
+
+// Use wraps every attempt in the middlewares, the first registered outermost
+func (hhc *HystrixHTTPClient) Use(middlewares ...Middleware) {
+	hhc.mu.Lock()
+	defer hhc.mu.Unlock()
+
+	hhc.current.middlewares = append(hhc.current.middlewares, middlewares...)
+}
+
+// UseResponseInterceptor runs interceptor on the response of every
+// successful attempt, after the interceptors registered before it, so that
+// it may scrub headers or rewrite the body before hooks, callers caching the
+// response and the caller see it, or fail the request with a policy error.
+// It skips failed attempts unless given InterceptErrorResponses.
+func (hhc *HystrixHTTPClient) UseResponseInterceptor(interceptor ResponseInterceptor, opts ...InterceptorOption) {
+	hhc.mu.Lock()
+	defer hhc.mu.Unlock()
+
+	hhc.current.interceptors = append(hhc.current.interceptors, newResponseInterceptor(interceptor, opts))
+}
+
+// EnableExpvar publishes request metrics through expvar under prefix
+func (hhc *HystrixHTTPClient) EnableExpvar(prefix string) {
+	hhc.mu.Lock()
+	defer hhc.mu.Unlock()
+
+	hhc.current.expvar = publishExpvar(prefix)
+}
+
+// EnableAuditLog hands a record of sampleRate, from 0 to 1, of the attempts
+// sent over the network to sink. The sink runs on a goroutine of its own, and
+// records arriving while it is behind by more than the buffer are dropped and
+// counted as audit_dropped in expvar.
+func (hhc *HystrixHTTPClient) EnableAuditLog(sink func(AuditRecord), sampleRate float64, opts ...AuditOption) {
+	hhc.mu.Lock()
+	defer hhc.mu.Unlock()
+
+	hhc.current.audit = newAuditLog(sink, sampleRate, hhc.options.clock, func() { hhc.settings().expvar.dropAudit() }, opts)
+}
+
+// SetAllowedHosts restricts requests, including redirects, to hosts matching
+// one of the glob ("*.example.com") or suffix (".example.com") patterns
+func (hhc *HystrixHTTPClient) SetAllowedHosts(patterns []string) {
+	hhc.guard.setAllowedHosts(patterns)
+}
+
+// SetBlockPrivateNetworks rejects connections to loopback, private, link-local
+// and cloud metadata addresses
+func (hhc *HystrixHTTPClient) SetBlockPrivateNetworks(block bool) {
+	hhc.guard.setBlockPrivateNetworks(block)
+}
+
+// SetProxyBypass connects to the hosts matching patterns directly instead of
+// through the proxy given with WithProxy, WithSOCKS5Proxy or set in the
+// environment. Patterns are exact hosts, suffixes (".internal.corp") matching
+// a domain and its subdomains, globs, IP addresses, CIDR ranges
+// ("10.0.0.0/8") or "*" for every host. The list replaces the previous one, which is kept when a
+// pattern is invalid. The proxy is a setting of the transport, so clients
+// made with Derive share the list.
+func (hhc *HystrixHTTPClient) SetProxyBypass(patterns []string) error {
+	return hhc.guard.setProxyBypass(patterns)
+}
+
+// SetTenantLimits limits the attempts sent on behalf of each tenant, set
+// on requests with ContextWithTenant, to those of overrides, or to defaults
+// for tenants without overrides. An attempt over the limits of its tenant fails
+// the request with an *ErrTenantQuotaExceeded before it is sent. Requests on
+// behalf of no tenant are not limited. Clients made with Derive start with the
+// same limits and count the usage of tenants on their own.
+func (hhc *HystrixHTTPClient) SetTenantLimits(defaults TenantLimits, overrides map[string]TenantLimits) {
+	hhc.tenants.set(defaults, overrides)
+}
+
+// SetMaxInFlightBodyBytes bounds the bytes of the bodies of the requests of
+// hhc in flight to n, counting each body by its Content-Length from before the
+// first attempt until the last one is done. Requests whose bodies do not fit
+// fail with an *ErrBodyBudgetExceeded, at once or after the wait set with
+// WithBodyBudgetWait. Streamed bodies of unknown length are not counted. Zero
+// or less removes the bound. Clients made with Derive start with the same
+// bound and count their bodies on their own.
+func (hhc *HystrixHTTPClient) SetMaxInFlightBodyBytes(n int64) {
+	hhc.bodies.set(n)
+}
+
+// SetReturnRedirects stops the client from following redirects, returning
+// the 3xx status, Location header and body to the caller instead
+func (hhc *HystrixHTTPClient) SetReturnRedirects(enabled bool) {
+	hhc.guard.setReturnRedirects(enabled)
+}
+
+// SetMaxRedirects makes each attempt follow at most n redirects, 10 by
+// default, failing with an *ErrTooManyRedirects on the next one
+func (hhc *HystrixHTTPClient) SetMaxRedirects(n int) {
+	hhc.guard.setMaxRedirects(n)
+}
+
+// SwapTransport makes requests started from now on send through rt, for
+// instance one presenting a rotated client certificate, while requests in
+// flight finish on the old transport. The idle connections of the old
+// transport are closed once the client timeout, or 30 seconds when there is none,
+// has passed. rt replaces the transport of the client and with it the dialer
+// blocking private networks, byte counting and WithProxy, which a transport
+// from the caller does not provide, while an *http.Transport is cloned to send
+// the server name of WithTLSServerName. Clients made with Derive keep the
+// transport they share until it is swapped on them too.
+func (hhc *HystrixHTTPClient) SwapTransport(rt http.RoundTripper) {
+	hhc.mu.Lock()
+	old := hhc.current.client
+	hhc.current.client = withTransport(old, withTLSServerName(rt, hhc.options.tlsServerName))
+	hhc.mu.Unlock()
+
+	retireTransport(old, hhc.options.clock)
+}
+
+// SetSensitiveHeaders replaces the set of headers whose values are redacted in
+// errors, debug output and hook payloads. It defaults to Authorization, Cookie,
+// Set-Cookie and X-Api-Key.
+func (hhc *HystrixHTTPClient) SetSensitiveHeaders(names ...string) {
+	hhc.redactor.setSensitiveHeaders(names...)
+}
+
+// RedactHeaders returns a copy of headers with sensitive values replaced by a
+// marker and a short hash of the value
+func (hhc *HystrixHTTPClient) RedactHeaders(headers http.Header) http.Header {
+	return hhc.redactor.redact(headers)
+}
+
+// RegisterCodec registers codec for its content type, replacing any codec
+// registered for it before, for use by Send and Decode
+func (hhc *HystrixHTTPClient) RegisterCodec(codec Codec) {
+	hhc.codecs.register(codec)
+}
+
+// Codec returns the codec registered for contentType, or an
+// *ErrUnsupportedContentType when there is none
+func (hhc *HystrixHTTPClient) Codec(contentType string) (Codec, error) {
+	return hhc.codecs.lookup(contentType)
 }
 
 // Get makes a HTTP GET request to provided URL
-func (hhc *hystrixHTTPClient) Get(url string, headers http.Header) (Response, error) {
+func (hhc *HystrixHTTPClient) Get(url string, headers http.Header) (Response, error) {
 	response := Response{}
 
-	request, err := http.NewRequest(http.MethodGet, url, nil)
+	request, err := newRequest(http.MethodGet, url, nil)
 	if err != nil {
-		return response, errors.Wrap(err, "GET - request creation failed")
+		return response, err
 	}
 
 	request.Header = headers
@@ -65,13 +640,20 @@ func (hhc *hystrixHTTPClient) Get(url string, headers http.Header) (Response, er
 	return hhc.do(request)
 }
 
+// GetNegotiated makes a HTTP GET request to provided URL accepting the media
+// types in acceptable, most preferred first, and returns the media type the
+// server chose, as the package function GetNegotiated does
+func (hhc *HystrixHTTPClient) GetNegotiated(url string, acceptable []string, headers http.Header) (Response, string, error) {
+	return GetNegotiated(hhc, url, acceptable, headers)
+}
+
 // Post makes a HTTP POST request to provided URL and requestBody
-func (hhc *hystrixHTTPClient) Post(url string, body io.Reader, headers http.Header) (Response, error) {
+func (hhc *HystrixHTTPClient) Post(url string, body io.Reader, headers http.Header) (Response, error) {
 	response := Response{}
 
-	request, err := http.NewRequest(http.MethodPost, url, body)
+	request, err := newRequest(http.MethodPost, url, body)
 	if err != nil {
-		return response, errors.Wrap(err, "POST - request creation failed")
+		return response, err
 	}
 
 	request.Header = headers
@@ -80,12 +662,12 @@ func (hhc *hystrixHTTPClient) Post(url string, body io.Reader, headers http.Head
 }
 
 // Put makes a HTTP PUT request to provided URL and requestBody
-func (hhc *hystrixHTTPClient) Put(url string, body io.Reader, headers http.Header) (Response, error) {
+func (hhc *HystrixHTTPClient) Put(url string, body io.Reader, headers http.Header) (Response, error) {
 	response := Response{}
 
-	request, err := http.NewRequest(http.MethodPut, url, body)
+	request, err := newRequest(http.MethodPut, url, body)
 	if err != nil {
-		return response, errors.Wrap(err, "PUT - request creation failed")
+		return response, err
 	}
 
 	request.Header = headers
@@ -94,12 +676,12 @@ func (hhc *hystrixHTTPClient) Put(url string, body io.Reader, headers http.Heade
 }
 
 // Patch makes a HTTP PATCH request to provided URL and requestBody
-func (hhc *hystrixHTTPClient) Patch(url string, body io.Reader, headers http.Header) (Response, error) {
+func (hhc *HystrixHTTPClient) Patch(url string, body io.Reader, headers http.Header) (Response, error) {
 	response := Response{}
 
-	request, err := http.NewRequest(http.MethodPatch, url, body)
+	request, err := newRequest(http.MethodPatch, url, body)
 	if err != nil {
-		return response, errors.Wrap(err, "PATCH - request creation failed")
+		return response, err
 	}
 
 	request.Header = headers
@@ -108,12 +690,29 @@ func (hhc *hystrixHTTPClient) Patch(url string, body io.Reader, headers http.Hea
 }
 
 // Delete makes a HTTP DELETE request with provided URL
-func (hhc *hystrixHTTPClient) Delete(url string, headers http.Header) (Response, error) {
+func (hhc *HystrixHTTPClient) Delete(url string, headers http.Header) (Response, error) {
+	response := Response{}
+
+	request, err := newRequest(http.MethodDelete, url, nil)
+	if err != nil {
+		return response, err
+	}
+
+	request.Header = headers
+
+	return hhc.do(request)
+}
+
+// Invoke makes a HTTP request with any method, such as the PROPFIND of
+// WebDAV or a PURGE, to provided URL and requestBody. Failed attempts are
+// only retried for the standard methods and those registered with
+// RegisterIdempotentMethod.
+func (hhc *HystrixHTTPClient) Invoke(method, url string, body io.Reader, headers http.Header) (Response, error) {
 	response := Response{}
 
-	request, err := http.NewRequest(http.MethodDelete, url, nil)
+	request, err := newMethodRequest(method, url, body)
 	if err != nil {
-		return response, errors.Wrap(err, "DELETE - request creation failed")
+		return response, err
 	}
 
 	request.Header = headers
@@ -121,48 +720,303 @@ func (hhc *hystrixHTTPClient) Delete(url string, headers http.Header) (Response,
 	return hhc.do(request)
 }
 
-func (hhc *hystrixHTTPClient) do(request *http.Request) (Response, error) {
-	hr := Response{}
+// Do sends a request built by the caller. No attempt is sent, and no backoff
+// is waited for, once the request context is cancelled or past its deadline.
+func (hhc *HystrixHTTPClient) Do(request *http.Request) (Response, error) {
+	return hhc.do(request)
+}
 
-	request.Close = true
+// NewRequest returns a builder for a request with method to the URL the
+// RFC 6570 template expands to, sent through the client by its Do
+func (hhc *HystrixHTTPClient) NewRequest(method, template string) *RequestBuilder {
+	return newRequestBuilder(hhc, method, template)
+}
 
-	var err error
-	for i := 0; i <= hhc.retryCount; i++ {
+// PostAsync queues a HTTP POST request to be sent in the background through
+// the usual retries, returning an *ErrQueueFull without blocking when the
+// queue is full. Jobs are not guaranteed to be sent in order.
+func (hhc *HystrixHTTPClient) PostAsync(url string, body []byte, headers http.Header) error {
+	if _, err := normalizeURL(url); err != nil {
+		return err
+	}
 
-		err = hystrix.Do(hhc.hystrixCommandName, func() error {
-			response, err := hhc.client.Do(request)
-			if err != nil {
-				return err
-			}
+	if hhc.shutdown.closed() {
+		return ErrClientClosed
+	}
 
-			if response.Body != nil {
-				hr.body, err = ioutil.ReadAll(response.Body)
-				if err != nil {
-					return err
-				}
-			}
+	return hhc.async.enqueue(url, body, headers)
+}
 
-			response.Body.Close()
+// Flush waits until every job queued by PostAsync has been sent, returning
+// early with the context error once ctx is done
+func (hhc *HystrixHTTPClient) Flush(ctx context.Context) error {
+	return hhc.async.flush(ctx)
+}
 
-			hr.statusCode = response.StatusCode
+// Shutdown stops the client accepting requests, which then fail with
+// ErrClientClosed, and waits until the requests in flight and the jobs queued
+// by PostAsync are done. Their retries go on while the backoff before them
+// ends before the deadline of ctx, and are given up with the error of the last
+// attempt otherwise. Once ctx is done, the requests still in flight are
+// cancelled as by CancelInFlight and the queued jobs dropped. The PostAsync
+// workers are then stopped and the idle connections of the transport closed,
+// including those of the clients made with Derive, which share them but have
+// to be shut down on their own. It returns an *ErrShutdownIncomplete when
+// requests were cut short, and Stats counts the requests drained and aborted.
+func (hhc *HystrixHTTPClient) Shutdown(ctx context.Context) error {
+	hhc.shutdown.close(ctx)
+	hhc.async.flush(ctx)
+	err := hhc.shutdown.wait(ctx, func() int { return hhc.inFlight.cancel("*") })
+	hhc.async.close()
+	closeIdleConnections(hhc.settings().client)
+
+	return hhc.shutdown.result(err)
+}
 
-			if response.StatusCode >= http.StatusInternalServerError {
-				return fmt.Errorf("Server is down: returned status code: %d", response.StatusCode)
-			}
+// Prewarm connects to the host of each of urls, resolved against the base
+// URL, and leaves the connection in the pool, so that the first requests to
+// them skip DNS, dialing and the TLS handshake. Each host is warmed by a HEAD
+// request sent straight through the transport, and so through the proxy,
+// TLS and dialer settings of the client, within ctx and the client timeout.
+// A host with an idle pooled connection reuses it and dials nothing. Retries,
+// middlewares and the circuit breaker are skipped. Without WithKeepAlive a
+// warm connection serves one request. Hosts that could not be warmed are
+// listed in an *ErrPrewarmFailed.
+func (hhc *HystrixHTTPClient) Prewarm(ctx context.Context, urls ...string) error {
+	return prewarm(ctx, hhc.settings().client, hhc.guard, hhc.base, urls)
+}
+
+func (hhc *HystrixHTTPClient) postAsyncJob(job asyncJob) {
+	if hhc.shutdown.drop() {
+		hhc.settings().expvar.dropAsync()
+		return
+	}
+	request, err := newRequest(http.MethodPost, job.url, bytes.NewReader(job.body))
+	if err != nil {
+		return
+	}
+	request.Header = job.headers
+
+	hhc.shutdown.admit()
+	defer hhc.shutdown.leave()
+	hhc.run(request)
+}
 
-			return nil
+func (hhc *HystrixHTTPClient) dropAsyncJob() {
+	hhc.settings().expvar.dropAsync()
+}
+
+// GetSSE opens a server-sent event stream at the provided URL. Events are
+// delivered on the returned channel, which is closed once the stream ends. On
+// disconnect the stream is resumed with the Last-Event-ID header, waiting as
+// advised by the retrier, unless it carried a line over the limit set with
+// WithMaxSSELineSize: the last event then has Err set. Calling the returned func or cancelling ctx closes
+// the stream.
+// Every connect goes through the middlewares of the client and is reported
+// to its plugins, stats and slow request log as a request ending once the
+// response headers are in.
+// The stream is not wrapped in a hystrix command, since a command timeout would
+// cut the long-lived connection; reconnects still use the retrier.
+func (hhc *HystrixHTTPClient) GetSSE(ctx context.Context, url string, headers http.Header) (<-chan Event, func(), error) {
+	return openSSE(ctx, newSSEStream(url, headers, hhc.settings(), hhc.options, hhc.guard, hhc.base))
+}
+
+func (hhc *HystrixHTTPClient) do(request *http.Request) (Response, error) {
+	if !hhc.shutdown.enter() {
+		return Response{}, ErrClientClosed
+	}
+	defer hhc.shutdown.leave()
+
+	return hhc.run(request)
+}
+
+// run sends a request admitted by the shutdown gate
+func (hhc *HystrixHTTPClient) run(request *http.Request) (Response, error) {
+	hhc.stats.begin()
+	settings := hhc.settings()
+
+	began := hhc.options.clock.Now()
+	var response Response
+	err := settings.plugins.start(request)
+	if err == nil {
+		response, err = hhc.dispatch(request, settings)
+	}
+	now := hhc.options.clock.Now()
+	err = settings.slow.observe(request, response, err, now.Sub(began), now, hhc.options.slowRedactQuery)
+	err = settings.deprecations.observe(request, response, err, now, settings.expvar)
+	err = settings.plugins.end(request, response, err)
+	hhc.stats.end(response, err, now.Sub(began), hhc.options.apdex, now)
+
+	return response, err
+}
+
+// dispatch checks request and sends it, sharing the response with identical
+// requests in flight when singleflight is enabled
+func (hhc *HystrixHTTPClient) dispatch(request *http.Request, settings attemptSettings) (Response, error) {
+	resolved, err := hhc.base.resolve(request.URL)
+	if err != nil {
+		return Response{}, err
+	}
+	// The caller's request keeps its URL
+	copied := *request
+	copied.URL = resolved
+	request = &copied
+	reserved, err := hhc.bodies.reserve(request, hhc.options.bodyBudgetWait, hhc.options.clock)
+	if err != nil {
+		return Response{}, err
+	}
+	defer hhc.bodies.release(reserved)
+	if request, err = hhc.options.balancer.route(request, hhc.options.clock.Now()); err != nil {
+		return Response{}, err
+	}
+
+	if err := checkRequestURL(request.URL); err != nil {
+		return Response{}, err
+	}
+
+	if err := hhc.options.openAPI.validate(request, hhc.options.openAPIStrict); err != nil {
+		return Response{}, err
+	}
+
+	if err := validateRequest(settings.requestValidator, request); err != nil {
+		return Response{}, err
+	}
+
+	tracked := hhc.inFlight.track(withRequestTrace(request.Context(), hhc.options.clock), request, hhc.options.clock.Now())
+	response, err := hhc.options.dedup.do(tracked.request, hhc.options.clock, hhc.options.flights, func(request *http.Request) (Response, error) {
+		return hhc.send(request, settings)
+	})
+	if err = hhc.inFlight.done(tracked, response, err); err != nil {
+		return response, err
+	}
+	if err := apiVersionRejected(settings.apiVersion, response); err != nil {
+		return response, err
+	}
+
+	return response, hhc.options.responseSchemas.validate(request, response)
+}
+
+func (hhc *HystrixHTTPClient) send(request *http.Request, settings attemptSettings) (Response, error) {
+	request.Close = !hhc.options.keepAlive
+	expectContinue(request, hhc.options)
+	pinAPIVersion(request, settings.apiVersion)
+	settings.baggage.apply(request)
+
+	if err := hhc.guard.checkURL(request.URL); err != nil {
+		return Response{}, err
+	}
+
+	settings.retryCount = methodRetryCount(request.Method, requestRetryCount(request, settings.retryCount))
+	retrier := requestRetrier(settings.retrier)
+	doer := buildDoer(hhc.options, settings)
+	attempt := func(request *http.Request, attempt int, lastResponse Response) attemptOutcome {
+		return settings.interceptors.apply(hhc.command(doer, request, attempt, settings, retrier, lastResponse))
+	}
+
+	hooks := hhc.retryHooks(settings)
+	hooks.connectRetrier = requestRetrier(settings.connectRetrier)
+
+	return executeWithRetries(request, attempt, retrier, settings.retryCount, hooks)
+}
+
+// command sends the request once inside the hystrix command
+func (hhc *HystrixHTTPClient) command(doer Doer, request *http.Request, attempt int, settings attemptSettings, retrier Retriable, lastResponse Response) attemptOutcome {
+	// The run func may outlive hystrix.Do on timeouts, so it hands its
+	// result back over a channel instead of writing to the outcome directly,
+	// and sends the attempt with a context cancelled once hystrix.Do returns,
+	// which aborts the send or the body read it is still blocked on
+	ctx, cancel := context.WithCancel(request.Context())
+	defer cancel()
+	request = request.WithContext(ctx)
+
+	results := make(chan hystrixAttempt, 1)
+	var rejection error
+	fallback := false
+	var err error
+	if hhc.breaker.allow() {
+		err = hystrix.Do(hhc.hystrixCommandName, func() (err error) {
+			// hystrix runs this on its own goroutine, where a panic would end the
+			// process, so it is recovered here and counted as a failed run
+			var response Response
+			var maintenance error
+			defer func() {
+				results <- hystrixAttempt{response: response, err: err, maintenance: maintenance}
+			}()
+			defer recoverCallback("attempt", &err)
+
+			response, maintenance, err = sendAttempt(doer, request, attempt, settings, hhc.options, "Server is down: returned status code: %d")
+			if _, ok := maintenance.(*ErrUpstreamMaintenance); !ok && maintenance != nil {
+				// Maintenance is announced by a healthy upstream, so it is no
+				// error of the command, unlike a panic of the detector or hook
+				err = maintenance
+			}
+			return err
 		}, func(err error) error {
+			fallback = true
+			if err == hystrix.ErrCircuitOpen || err == hystrix.ErrMaxConcurrency {
+				rejection = err
+			}
 			return err
 		})
+		hhc.breaker.observe(hhc.hystrixCommandName, err, rejection)
+	} else {
+		// The circuit handed over by NewHystrixHTTPClientWithState is still
+		// open, so the request is rejected as hystrix would have
+		err, rejection = hystrix.ErrCircuitOpen, hystrix.ErrCircuitOpen
+	}
 
-		if err != nil {
-			backoffTime := hhc.retrier.NextInterval(i)
-			time.Sleep(backoffTime)
-			continue
+	if rejection == hystrix.ErrCircuitOpen && hhc.options.openCircuit != nil {
+		return attemptOutcome{response: hhc.options.openCircuit.response(), abort: ErrCircuitOpen, fallback: fallback}
+	}
+
+	if rejection != nil {
+		if !retriesRejections(retrier) {
+			return attemptOutcome{abort: &ErrHystrixRejected{Attempts: attempt + 1, LastResponse: lastResponse, err: rejection}, fallback: fallback}
 		}
 
-		break
+		return attemptOutcome{err: err, cause: err, rejected: true, fallback: fallback}
 	}
 
-	return hr, err
+	select {
+	case result := <-results:
+		if result.maintenance != nil {
+			return attemptOutcome{response: result.response, abort: result.maintenance, fallback: fallback}
+		}
+		outcome := attemptOutcomeOf(result.response, result.err, err, hhc.options)
+		outcome.fallback = fallback
+
+		return outcome
+	default:
+		return attemptOutcome{err: err, cause: err, fallback: fallback}
+	}
+}
+
+func (hhc *HystrixHTTPClient) retryHooks(settings attemptSettings) retryHooks {
+	return retryHooks{
+		clock:       hhc.options.clock,
+		mutators:    settings.requestMutators,
+		failures:    hhc.options.failures,
+		retryBudget: hhc.options.retryBudget,
+		concurrency: hhc.options.concurrency,
+		rateLimits:  hhc.options.rateLimits,
+		expvar:      settings.expvar,
+
+		minAttemptBudget: settings.minAttemptBudget,
+		stats:            hhc.stats,
+		tenants:          hhc.tenants,
+		decisions:        hhc.options.decisions,
+		apdex:            hhc.options.apdex,
+		maintenance:      settings.maintenance,
+		shutdown:         hhc.shutdown,
+		queue:            hhc.options.queue,
+	}
+}
+
+type hystrixAttempt struct {
+	response Response
+	err      error
+	// maintenance is the error of the maintenance monitor, which ends the
+	// request; an *ErrUpstreamMaintenance is reported to the command as a
+	// success
+	maintenance error
 }
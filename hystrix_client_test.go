@@ -2,14 +2,19 @@ package heimdall
 
 import (
 	"bytes"
+	"context"
 	"github.com/afex/hystrix-go/hystrix"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"runtime"
+	"sync"
 	"testing"
+	"time"
 
 	"strings"
 
+	"github.com/gojektech/heimdall/fakeclock"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -236,10 +241,11 @@ func TestHystrixHTTPClientRetriesOnFailure(t *testing.T) {
 		RequestVolumeThreshold: 10,
 	}
 
+	clock := fakeclock.New(time.Now())
 	client := NewHystrixHTTPClient(10, HystrixConfig{
 		commandName:   "some_command_name",
 		commandConfig: hystrixCommandConfig,
-	})
+	}, WithClock(clock))
 
 	count := 0
 
@@ -259,6 +265,7 @@ func TestHystrixHTTPClientRetriesOnFailure(t *testing.T) {
 	require.Error(t, err)
 
 	assert.Equal(t, 4, count)
+	assert.Equal(t, []time.Duration{0, time.Millisecond, time.Millisecond}, clock.Sleeps(), "no backoff follows the final attempt")
 
 	assert.Equal(t, http.StatusInternalServerError, response.StatusCode())
 	assert.Equal(t, "{ \"response\": \"something went wrong\" }", string(response.Body()))
@@ -283,3 +290,234 @@ func TestHystrixHTTPClientReturnsFallbackFailure(t *testing.T) {
 
 	assert.True(t, strings.Contains(err.Error(), "fallback failed"))
 }
+
+func TestHystrixHTTPClientReturnsErrorResponseBodyOn5xx(t *testing.T) {
+	client := NewHystrixHTTPClient(10, NewHystrixConfig("error_body_command", HystrixCommandConfig{
+		Timeout:                50,
+		RequestVolumeThreshold: 100,
+	}))
+
+	dummyHandler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Trace-Id", "trace-42")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{ "error": "maintenance", "trace_id": "trace-42" }`))
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(dummyHandler))
+	defer server.Close()
+
+	client.SetRetryCount(2)
+
+	response, err := client.Get(server.URL, http.Header{})
+	require.Error(t, err)
+
+	assert.Equal(t, http.StatusServiceUnavailable, response.StatusCode())
+	assert.Equal(t, "trace-42", response.Headers().Get("X-Trace-Id"))
+	assert.Equal(t, `{ "error": "maintenance", "trace_id": "trace-42" }`, string(response.Body()))
+
+	exhausted, ok := err.(*RetriesExhaustedError)
+	require.True(t, ok, "error should be a RetriesExhaustedError")
+	assert.Equal(t, 3, exhausted.Attempts)
+	assert.Equal(t, response, exhausted.LastResponse)
+}
+
+func TestHystrixHTTPClientReturnsRedirectsWhenEnabled(t *testing.T) {
+	server := redirectServer()
+	defer server.Close()
+
+	client := NewHystrixHTTPClient(100, NewHystrixConfig("redirect_command", HystrixCommandConfig{}))
+
+	response, err := client.Get(server.URL+"/moved", http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, server.URL+"/target", response.FinalURL())
+
+	client.SetReturnRedirects(true)
+
+	response, err = client.Get(server.URL+"/moved", http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusMovedPermanently, response.StatusCode())
+	assert.Equal(t, "/target", response.Headers().Get("Location"))
+}
+
+func TestHystrixHTTPClientDoFailsFastWithCancelledContext(t *testing.T) {
+	count := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count++
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	request, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+
+	client := NewHystrixHTTPClient(100, NewHystrixConfig("cancelled_command", HystrixCommandConfig{}))
+
+	_, err = client.Do(request.WithContext(ctx))
+
+	contextDone, ok := err.(*ErrContextDone)
+	require.True(t, ok, "expected *ErrContextDone, got %T", err)
+	assert.Equal(t, 0, contextDone.Attempts)
+	assert.Equal(t, 0, count)
+}
+
+// saturatedHystrixClient returns a client whose only hystrix slot is held by a
+// request blocked in the server until release is closed
+func saturatedHystrixClient(t *testing.T, commandName string) (Client, *httptest.Server, chan struct{}) {
+	holding := make(chan struct{})
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(holding)
+			<-release
+		}
+	}))
+
+	client := NewHystrixHTTPClient(5000, NewHystrixConfig(commandName, HystrixCommandConfig{
+		Timeout:                5000,
+		MaxConcurrentRequests:  1,
+		RequestVolumeThreshold: 1000,
+		ErrorPercentThreshold:  100,
+		SleepWindow:            60000,
+	}))
+
+	go client.Get(server.URL+"/slow", http.Header{})
+	<-holding
+
+	return client, server, release
+}
+
+func TestHystrixHTTPClientDoesNotRetryMaxConcurrencyRejections(t *testing.T) {
+	client, server, release := saturatedHystrixClient(t, "max_concurrency_fail_fast_command")
+	defer server.Close()
+	defer close(release)
+
+	client.SetRetryCount(3)
+	client.SetRetrier(NewRetrier(NewConstantBackoff(1000)))
+
+	begin := time.Now()
+	response, err := client.Get(server.URL, http.Header{})
+	require.Error(t, err)
+
+	assert.True(t, time.Since(begin) < 500*time.Millisecond, "a rejected request should not wait for backoff")
+	assert.Equal(t, 0, response.StatusCode())
+
+	rejected, ok := err.(*ErrHystrixRejected)
+	require.True(t, ok, "expected *ErrHystrixRejected, got %T", err)
+	assert.Equal(t, 1, rejected.Attempts)
+	assert.False(t, rejected.CircuitOpen())
+	assert.Equal(t, hystrix.ErrMaxConcurrency, rejected.Cause())
+}
+
+func TestHystrixHTTPClientRetriesRejectionsWithRejectionRetrier(t *testing.T) {
+	client, server, release := saturatedHystrixClient(t, "max_concurrency_retry_command")
+	defer server.Close()
+	defer close(release)
+
+	client.SetRetryCount(2)
+	client.SetRetrier(NewRejectionRetrier(NewRetrier(NewConstantBackoff(1))))
+
+	_, err := client.Get(server.URL, http.Header{})
+	require.Error(t, err)
+
+	exhausted, ok := err.(*RetriesExhaustedError)
+	require.True(t, ok, "expected *RetriesExhaustedError, got %T", err)
+	assert.Equal(t, 3, exhausted.Attempts)
+}
+
+func TestHystrixHTTPClientDoesNotRetryWhenCircuitIsOpen(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	client := NewHystrixHTTPClient(1000, openOnFirstFailure(uniqueName("circuit_open_fail_fast_command")))
+	tripCircuit(t, client, server.URL)
+
+	client.SetRetryCount(3)
+	client.SetRetrier(NewRetrier(NewConstantBackoff(1000)))
+
+	begin := time.Now()
+	_, err := client.Get(server.URL, http.Header{})
+	require.Error(t, err)
+
+	assert.True(t, time.Since(begin) < 500*time.Millisecond)
+	assert.Equal(t, 1, calls)
+
+	rejected, ok := err.(*ErrHystrixRejected)
+	require.True(t, ok, "expected *ErrHystrixRejected, got %T", err)
+	assert.True(t, rejected.CircuitOpen())
+}
+
+func TestHystrixHTTPClientDeriveRunsUnderItsOwnCommand(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	parent := NewHystrixHTTPClient(1000, openOnFirstFailure("derive_parent_command"))
+	derived := parent.Derive(WithHystrixConfig(openOnFirstFailure("derive_tenant_command")))
+
+	assert.Equal(t, parent.current.client.Transport, derived.current.client.Transport)
+	assert.Equal(t, "derive_tenant_command", derived.hystrixCommandName)
+
+	tripCircuit(t, derived, server.URL+"/fail")
+
+	_, err := derived.Get(server.URL, http.Header{})
+	assert.IsType(t, &ErrHystrixRejected{}, err)
+
+	_, err = parent.Get(server.URL, http.Header{})
+	assert.NoError(t, err, "tripping the derived circuit should leave the parent closed")
+
+	sameCommand := parent.Derive()
+	assert.Equal(t, "derive_parent_command", sameCommand.hystrixCommandName)
+}
+
+func TestHystrixHTTPClientTimeoutsCancelTheirAttempts(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client := NewHystrixHTTPClient(5000, NewHystrixConfig("hystrix_timeout_cancel_command", HystrixCommandConfig{
+		Timeout:                20,
+		MaxConcurrentRequests:  100,
+		RequestVolumeThreshold: 1000,
+	}))
+	client.SetRetryCount(1)
+
+	// Goroutines settling after the last test, such as closing connections,
+	// are given a moment before the baseline is taken
+	time.Sleep(50 * time.Millisecond)
+	baseline := runtime.NumGoroutine()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := client.Get(server.URL, http.Header{})
+			assert.Error(t, err)
+		}()
+	}
+	wg.Wait()
+
+	settled := false
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if runtime.NumGoroutine() <= baseline+2 {
+			settled = true
+			break
+		}
+	}
+	assert.True(t, settled, "%d goroutines left running, %d before the burst", runtime.NumGoroutine(), baseline)
+}
@@ -0,0 +1,159 @@
+package heimdall
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrOperatorCancelled is the error of the *ErrContextDone returned by
+// requests cancelled with CancelInFlight. It matches context.Canceled with
+// errors.Is, so callers handling cancellation need no change.
+var ErrOperatorCancelled error = operatorCancelled{}
+
+type operatorCancelled struct{}
+
+func (operatorCancelled) Error() string {
+	return "cancelled by operator"
+}
+
+// Is reports whether target is context.Canceled
+func (operatorCancelled) Is(target error) bool {
+	return target == context.Canceled
+}
+
+// InFlightRequest is a request of a client in flight, in InFlight
+type InFlightRequest struct {
+	RequestID string    `json:"request_id"`
+	Method    string    `json:"method"`
+	Host      string    `json:"host"`
+	Path      string    `json:"path"`
+	Started   time.Time `json:"started"`
+	// Attempt is the number of the attempt being sent, starting at 1, or 0
+	// before the first one
+	Attempt int `json:"attempt"`
+}
+
+// inFlightShards spreads the requests in flight over locks, so that
+// concurrent requests seldom wait for each other to be tracked
+const inFlightShards = 16
+
+// inFlightTracker tracks the requests of a client in flight
+type inFlightTracker struct {
+	next   uint64
+	shards [inFlightShards]inFlightShard
+}
+
+type inFlightShard struct {
+	mu       sync.Mutex
+	requests map[uint64]inFlightEntry
+}
+
+type inFlightEntry struct {
+	id        uint64
+	request   *http.Request
+	started   time.Time
+	cancel    context.CancelFunc
+	cancelled bool
+}
+
+func newInFlightTracker() *inFlightTracker {
+	tracker := &inFlightTracker{}
+	for i := range tracker.shards {
+		tracker.shards[i].requests = map[uint64]inFlightEntry{}
+	}
+
+	return tracker
+}
+
+// track tracks a copy of request with context ctx, started at now, that
+// CancelInFlight can cancel. The request to send is that of the entry
+// returned, to be handed to done once the request is done.
+func (t *inFlightTracker) track(ctx context.Context, request *http.Request, now time.Time) inFlightEntry {
+	id := atomic.AddUint64(&t.next, 1)
+	ctx, cancel := context.WithCancel(ctx)
+	entry := inFlightEntry{id: id, request: request.WithContext(ctx), started: now, cancel: cancel}
+
+	shard := &t.shards[id%inFlightShards]
+	shard.mu.Lock()
+	shard.requests[id] = entry
+	shard.mu.Unlock()
+
+	return entry
+}
+
+// done stops tracking entry, returning the error to return for a request that
+// returned response and err: ErrOperatorCancelled when CancelInFlight
+// cancelled it
+func (t *inFlightTracker) done(entry inFlightEntry, response Response, err error) error {
+	shard := &t.shards[entry.id%inFlightShards]
+	shard.mu.Lock()
+	byOperator := shard.requests[entry.id].cancelled
+	delete(shard.requests, entry.id)
+	shard.mu.Unlock()
+	entry.cancel()
+
+	if err == nil || !byOperator {
+		return err
+	}
+	cancelled := &ErrContextDone{Attempts: len(response.attempts), err: ErrOperatorCancelled}
+	if response.statusCode != 0 {
+		cancelled.LastResponse = response
+	}
+
+	return cancelled
+}
+
+// snapshot returns the requests in flight, oldest first
+func (t *inFlightTracker) snapshot() []InFlightRequest {
+	var requests []InFlightRequest
+	for i := range t.shards {
+		shard := &t.shards[i]
+		shard.mu.Lock()
+		for _, entry := range shard.requests {
+			requests = append(requests, InFlightRequest{
+				RequestID: RequestIDFromContext(entry.request.Context()),
+				Method:    entry.request.Method,
+				Host:      entry.request.URL.Host,
+				Path:      entry.request.URL.Path,
+				Started:   entry.started,
+				Attempt:   RequestAttemptFromContext(entry.request.Context()),
+			})
+		}
+		shard.mu.Unlock()
+	}
+	sort.Slice(requests, func(i, j int) bool { return requests[i].Started.Before(requests[j].Started) })
+
+	return requests
+}
+
+// cancel cancels the requests in flight to hosts matching pattern, returning
+// how many it cancelled
+func (t *inFlightTracker) cancel(pattern string) int {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+
+	cancelled := 0
+	for i := range t.shards {
+		shard := &t.shards[i]
+		shard.mu.Lock()
+		for id, entry := range shard.requests {
+			url := entry.request.URL
+			if !hostMatches(pattern, strings.ToLower(url.Hostname())) && !hostMatches(pattern, strings.ToLower(url.Host)) {
+				continue
+			}
+			if !entry.cancelled {
+				entry.cancelled = true
+				shard.requests[id] = entry
+				entry.cancel()
+				cancelled++
+			}
+		}
+		shard.mu.Unlock()
+	}
+
+	return cancelled
+}
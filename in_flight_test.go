@@ -0,0 +1,133 @@
+package heimdall
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// hangingServer answers requests once their connection closes, or after
+// delay, whichever comes first
+func hangingServer(delay time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(delay):
+		}
+	}))
+}
+
+func TestCancelInFlightByHost(t *testing.T) {
+	hanging := hangingServer(time.Minute)
+	defer hanging.Close()
+	slow := hangingServer(200 * time.Millisecond)
+	defer slow.Close()
+
+	for name, newClient := range map[string]func() testClient{
+		"http": func() testClient { return NewHTTPClient(5000) },
+		"hystrix": func() testClient {
+			return NewHystrixHTTPClient(5000, NewHystrixConfig("cancel_in_flight_command", HystrixCommandConfig{Timeout: 5000, MaxConcurrentRequests: 100}))
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			client := newClient()
+			client.SetRetryCount(3)
+			client.SetRetrier(NewRetrier(NewConstantBackoff(1)))
+
+			type result struct {
+				url  string
+				err  error
+				took time.Duration
+			}
+			results := make(chan result, 4)
+			urls := []string{localhostURL(hanging) + "/a", localhostURL(hanging) + "/b", slow.URL + "/c", slow.URL + "/d"}
+			for _, url := range urls {
+				go func(url string) {
+					start := time.Now()
+					_, err := client.Get(url, http.Header{})
+					results <- result{url: url, err: err, took: time.Since(start)}
+				}(url)
+			}
+
+			require.Eventually(t, func() bool { return len(client.InFlight()) == 4 }, time.Second, time.Millisecond)
+			inFlight := client.InFlight()
+			for _, request := range inFlight {
+				assert.Equal(t, http.MethodGet, request.Method)
+				assert.NotEmpty(t, request.RequestID)
+				assert.Equal(t, 1, request.Attempt)
+				assert.False(t, request.Started.IsZero())
+			}
+
+			assert.Equal(t, 0, client.CancelInFlight("*.example.com"))
+			assert.Equal(t, 2, client.CancelInFlight("LOCALHOST"))
+
+			for range urls {
+				result := <-results
+				if strings.Contains(result.url, "localhost") {
+					require.Error(t, result.err)
+					assert.True(t, errors.Is(result.err, ErrOperatorCancelled), "%v", result.err)
+					assert.True(t, errors.Is(result.err, context.Canceled), "cancellations match context.Canceled")
+					var done *ErrContextDone
+					require.True(t, errors.As(result.err, &done), "%v", result.err)
+					assert.Less(t, int64(result.took), int64(time.Second), "cancelled requests return promptly")
+				} else {
+					assert.NoError(t, result.err, "requests to other hosts finish")
+				}
+			}
+			assert.Empty(t, client.InFlight())
+			assert.Equal(t, 0, client.CancelInFlight("localhost"))
+		})
+	}
+}
+
+func TestCancelInFlightWithPort(t *testing.T) {
+	hanging := hangingServer(time.Minute)
+	defer hanging.Close()
+	other := hangingServer(100 * time.Millisecond)
+	defer other.Close()
+
+	client := NewHTTPClient(5000)
+	derived := client.Derive()
+	var wg sync.WaitGroup
+	errs := make([]error, 3)
+	for i, send := range []func() error{
+		func() error { _, err := client.Get(hanging.URL, http.Header{}); return err },
+		func() error { _, err := client.Get(other.URL, http.Header{}); return err },
+		func() error { _, err := derived.Get(hanging.URL, http.Header{}); return err },
+	} {
+		wg.Add(1)
+		go func(i int, send func() error) {
+			defer wg.Done()
+			errs[i] = send()
+		}(i, send)
+	}
+
+	require.Eventually(t, func() bool { return len(client.InFlight()) == 2 && len(derived.InFlight()) == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, 1, client.CancelInFlight(strings.TrimPrefix(hanging.URL, "http://")))
+	assert.Equal(t, 1, derived.CancelInFlight("127.0.0.1"), "derived clients track their requests on their own")
+	wg.Wait()
+
+	assert.True(t, errors.Is(errs[0], ErrOperatorCancelled), "%v", errs[0])
+	assert.NoError(t, errs[1])
+	assert.True(t, errors.Is(errs[2], ErrOperatorCancelled), "%v", errs[2])
+}
+
+func TestCallerCancellationIsNotOperatorCancellation(t *testing.T) {
+	hanging := hangingServer(time.Minute)
+	defer hanging.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	request, _ := http.NewRequest(http.MethodGet, hanging.URL, nil)
+	_, err := NewHTTPClient(5000).Do(request.WithContext(ctx))
+	require.Error(t, err)
+	assert.False(t, errors.Is(err, ErrOperatorCancelled))
+}
@@ -0,0 +1,41 @@
+package heimdall
+
+import (
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+)
+
+// OnInformationalResponse calls hook with the status and headers of every 1xx
+// informational response an attempt receives before its final response, such
+// as the Link headers of a 103 Early Hints. Each attempt reports its own, so
+// hook may be called again for the same request when it is retried. hook is
+// called on the goroutine reading the response and must not block; a panic
+// fails the attempt with an *ErrCallbackPanic. The final response is returned
+// as usual.
+func OnInformationalResponse(hook func(status int, headers http.Header)) Option {
+	return func(options *clientOptions) {
+		options.informational = hook
+	}
+}
+
+// reportInformational calls hook for the 1xx responses received by each
+// attempt sent through next
+func reportInformational(next Doer, hook func(status int, headers http.Header)) Doer {
+	if hook == nil {
+		return next
+	}
+
+	return DoerFunc(func(request *http.Request) (*http.Response, error) {
+		ctx := httptrace.WithClientTrace(request.Context(), &httptrace.ClientTrace{
+			Got1xxResponse: func(status int, headers textproto.MIMEHeader) (err error) {
+				defer recoverCallback("informational response hook", &err)
+
+				hook(status, copyHeader(http.Header(headers)))
+				return nil
+			},
+		})
+
+		return next.Do(request.WithContext(ctx))
+	})
+}
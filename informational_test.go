@@ -0,0 +1,122 @@
+package heimdall
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type informationalResponse struct {
+	status  int
+	headers http.Header
+}
+
+// informationalRecorder collects the 1xx responses reported to its hook
+type informationalRecorder struct {
+	mu        sync.Mutex
+	responses []informationalResponse
+}
+
+func (r *informationalRecorder) hook(status int, headers http.Header) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.responses = append(r.responses, informationalResponse{status: status, headers: headers})
+}
+
+func (r *informationalRecorder) recorded() []informationalResponse {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]informationalResponse(nil), r.responses...)
+}
+
+// earlyHintsServer sends a 103 Early Hints before each response, failing the
+// first failures of them
+func earlyHintsServer(failures int32) *httptest.Server {
+	var calls int32
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := atomic.AddInt32(&calls, 1)
+
+		w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		w.Header().Add("Link", "</app.js>; rel=preload; as=script")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Del("Link")
+
+		if call <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("final"))
+	}))
+}
+
+func TestClientsReportEarlyHints(t *testing.T) {
+	for kind, newClient := range retryClients {
+		t.Run(kind, func(t *testing.T) {
+			server := earlyHintsServer(0)
+			defer server.Close()
+
+			recorder := &informationalRecorder{}
+			client := derive(newClient("early_hints_"+kind, realClock{}), OnInformationalResponse(recorder.hook))
+
+			response, err := client.Get(server.URL, http.Header{})
+			require.NoError(t, err)
+
+			assert.Equal(t, http.StatusOK, response.StatusCode())
+			assert.Equal(t, "final", string(response.Body()))
+			assert.Empty(t, response.Headers().Values("Link"), "hints should not leak into the final response")
+
+			hints := recorder.recorded()
+			require.Len(t, hints, 1)
+			assert.Equal(t, http.StatusEarlyHints, hints[0].status)
+			assert.Equal(t, []string{"</style.css>; rel=preload; as=style", "</app.js>; rel=preload; as=script"}, hints[0].headers.Values("Link"))
+		})
+	}
+}
+
+func TestInformationalResponsesAreReportedPerAttempt(t *testing.T) {
+	server := earlyHintsServer(2)
+	defer server.Close()
+
+	recorder := &informationalRecorder{}
+	client := NewHTTPClient(1000, OnInformationalResponse(recorder.hook))
+	client.SetRetryCount(2)
+
+	response, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, response.StatusCode())
+	assert.Len(t, recorder.recorded(), 3)
+}
+
+func TestInformationalResponseHookIsOptIn(t *testing.T) {
+	server := earlyHintsServer(0)
+	defer server.Close()
+
+	response, err := NewHTTPClient(1000).Get(server.URL, http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, "final", string(response.Body()))
+}
+
+func TestInformationalResponseHookPanicFailsAttempt(t *testing.T) {
+	server := earlyHintsServer(0)
+	defer server.Close()
+
+	client := NewHTTPClient(1000, OnInformationalResponse(func(status int, headers http.Header) {
+		panic("hint exploded")
+	}))
+
+	_, err := client.Get(server.URL, http.Header{})
+
+	var panicked *ErrCallbackPanic
+	require.True(t, errors.As(err, &panicked), "%v", err)
+	assert.Equal(t, "informational response hook", panicked.Callback)
+}
@@ -0,0 +1,239 @@
+package heimdall
+
+import (
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultLoadBalancerExploration  = 0.05
+	defaultLoadBalancerErrorPenalty = time.Second
+	defaultLoadBalancerHalfLife     = 30 * time.Second
+
+	// latencyWeight is the weight of the latest attempt in the moving
+	// average of the latency of a target
+	latencyWeight = 0.3
+)
+
+// LoadBalanceStrategy decides which target of WithLoadBalancing a request
+// goes to
+type LoadBalanceStrategy int
+
+const (
+	// RoundRobin sends requests to the targets in turn
+	RoundRobin LoadBalanceStrategy = iota
+	// LeastLatency sends requests to the target with the lowest score: the
+	// exponentially weighted moving average of the latency of its attempts,
+	// failed ones counting the error penalty on top, decaying while the target
+	// is not measured and multiplied by one plus its attempts in flight
+	LeastLatency
+)
+
+// LoadBalancerConfig configures WithLoadBalancing
+type LoadBalancerConfig struct {
+	Strategy LoadBalanceStrategy
+
+	// Exploration is the probability that a LeastLatency request goes to a
+	// target picked at random, so that targets which recovered are measured
+	// again, 0.05 when zero and none when negative
+	Exploration float64
+	// ErrorPenalty is added to the latency of attempts that failed or got a
+	// 5xx, one second when zero
+	ErrorPenalty time.Duration
+	// HalfLife is the time it takes the score of a target no attempt measured
+	// to halve, 30 seconds when zero, so stale scores do not keep traffic away
+	// from a target forever
+	HalfLife time.Duration
+	// Seed seeds exploration, so that tests route the same requests every run.
+	// Zero seeds it from the time.
+	Seed int64
+}
+
+// WithLoadBalancing spreads the requests of the client over targets, the
+// scheme and host of replicas of the same service such as
+// "http://10.0.0.7:8080". The scheme and host of the URL of each request,
+// resolved against the base URL, are replaced by those of the target config
+// picks, and the Host header goes with them unless the caller set another one.
+// All attempts of a request go to the same target. Requests fail when a
+// target is not an absolute URL.
+func WithLoadBalancing(targets []string, config LoadBalancerConfig) Option {
+	return func(options *clientOptions) {
+		options.balancer = newLoadBalancer(targets, config)
+	}
+}
+
+type loadBalancer struct {
+	config  LoadBalancerConfig
+	targets []*balancedTarget
+	err     error
+
+	next uint64
+
+	mu     sync.Mutex
+	random *rand.Rand
+}
+
+// balancedTarget is a target with the measurements of its attempts
+type balancedTarget struct {
+	scheme, host string
+
+	inFlight int
+	// latency is the moving average of the latency of the attempts of the
+	// target, in seconds, as measured at measured
+	latency  float64
+	measured time.Time
+}
+
+func newLoadBalancer(targets []string, config LoadBalancerConfig) *loadBalancer {
+	if config.Exploration == 0 {
+		config.Exploration = defaultLoadBalancerExploration
+	}
+	if config.ErrorPenalty == 0 {
+		config.ErrorPenalty = defaultLoadBalancerErrorPenalty
+	}
+	if config.HalfLife == 0 {
+		config.HalfLife = defaultLoadBalancerHalfLife
+	}
+	seed := config.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	balancer := &loadBalancer{config: config, random: rand.New(rand.NewSource(seed))}
+	for _, raw := range targets {
+		target, err := url.Parse(raw)
+		if err == nil && (target.Scheme == "" || target.Host == "") {
+			err = errors.Errorf("%q is not absolute", raw)
+		}
+		if err != nil {
+			balancer.err = errors.Wrap(err, "invalid load balancer target")
+			return balancer
+		}
+		balancer.targets = append(balancer.targets, &balancedTarget{scheme: target.Scheme, host: target.Host})
+	}
+	if len(balancer.targets) == 0 {
+		balancer.err = errors.New("invalid load balancer targets: none given")
+	}
+
+	return balancer
+}
+
+// route returns a copy of request pointed at the target picked for it at
+// now, or request itself without load balancing
+func (b *loadBalancer) route(request *http.Request, now time.Time) (*http.Request, error) {
+	if b == nil {
+		return request, nil
+	}
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	target := b.pick(now)
+	routed := request.WithContext(request.Context())
+	routed.URL = &url.URL{}
+	*routed.URL = *request.URL
+	routed.URL.Scheme, routed.URL.Host = target.scheme, target.host
+	if request.Host == request.URL.Host {
+		routed.Host = ""
+	}
+
+	return routed, nil
+}
+
+func (b *loadBalancer) pick(now time.Time) *balancedTarget {
+	if b.config.Strategy != LeastLatency {
+		return b.targets[(atomic.AddUint64(&b.next, 1)-1)%uint64(len(b.targets))]
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.targets) > 1 && b.random.Float64() < b.config.Exploration {
+		return b.targets[b.random.Intn(len(b.targets))]
+	}
+
+	best, bestScore := b.targets[0], math.Inf(1)
+	for _, target := range b.targets {
+		if score := b.score(target, now); score < bestScore {
+			best, bestScore = target, score
+		}
+	}
+
+	return best
+}
+
+// score returns the score of target at now, lowest for the best target
+func (b *loadBalancer) score(target *balancedTarget, now time.Time) float64 {
+	decay := math.Exp2(-float64(now.Sub(target.measured)) / float64(b.config.HalfLife))
+	return target.latency * decay * float64(target.inFlight+1)
+}
+
+// target returns the target of host, nil for hosts that are no target
+func (b *loadBalancer) target(host string) *balancedTarget {
+	for _, target := range b.targets {
+		if target.host == host {
+			return target
+		}
+	}
+
+	return nil
+}
+
+// begin counts an attempt to target in flight
+func (b *loadBalancer) begin(target *balancedTarget) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	target.inFlight++
+}
+
+// end measures an attempt to target counted by begin, which took elapsed
+// and failed unless ok
+func (b *loadBalancer) end(target *balancedTarget, elapsed time.Duration, ok bool, now time.Time) {
+	if !ok {
+		elapsed += b.config.ErrorPenalty
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	target.inFlight--
+	sample := elapsed.Seconds()
+	if target.measured.IsZero() {
+		target.latency = sample
+	} else {
+		decayed := target.latency * math.Exp2(-float64(now.Sub(target.measured))/float64(b.config.HalfLife))
+		target.latency = latencyWeight*sample + (1-latencyWeight)*decayed
+	}
+	target.measured = now
+}
+
+// weighTargets measures the attempts sent through next for balancer, unless
+// it is nil or does not weigh its targets
+func weighTargets(next Doer, balancer *loadBalancer, clock Clock) Doer {
+	if balancer == nil || balancer.config.Strategy != LeastLatency {
+		return next
+	}
+
+	return DoerFunc(func(request *http.Request) (*http.Response, error) {
+		target := balancer.target(request.URL.Host)
+		if target == nil {
+			return next.Do(request)
+		}
+
+		balancer.begin(target)
+		began := clock.Now()
+		response, err := next.Do(request)
+		now := clock.Now()
+		balancer.end(target, now.Sub(began), err == nil && response.StatusCode < http.StatusInternalServerError, now)
+
+		return response, err
+	})
+}
@@ -0,0 +1,128 @@
+package heimdall
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gojektech/heimdall/fakeclock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// replica is a target answering after latency on clock, failing its first
+// failures requests with a 500
+type replica struct {
+	*httptest.Server
+	hits int32
+}
+
+func newReplica(clock *fakeclock.Clock, latency time.Duration, failures int32) *replica {
+	r := &replica{}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		clock.Advance(latency)
+		if atomic.AddInt32(&r.hits, 1) <= failures {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+
+	return r
+}
+
+func (r *replica) requests() int {
+	return int(atomic.LoadInt32(&r.hits))
+}
+
+func TestClientsSkewTrafficTowardsTheFastestTarget(t *testing.T) {
+	for kind, newClient := range map[string]func(opts ...Option) testClient{
+		"http": func(opts ...Option) testClient {
+			return NewHTTPClient(1000, opts...)
+		},
+		"hystrix": func(opts ...Option) testClient {
+			return NewHystrixHTTPClient(1000, NewHystrixConfig("least_latency_command", HystrixCommandConfig{Timeout: 1000}), opts...)
+		},
+	} {
+		t.Run(kind, func(t *testing.T) {
+			clock := fakeclock.New(time.Now())
+			fast, medium, slow := newReplica(clock, 10*time.Millisecond, 0), newReplica(clock, 50*time.Millisecond, 0), newReplica(clock, 100*time.Millisecond, 0)
+			defer fast.Close()
+			defer medium.Close()
+			defer slow.Close()
+
+			client := newClient(WithClock(clock), WithLoadBalancing([]string{slow.URL, medium.URL, fast.URL}, LoadBalancerConfig{Strategy: LeastLatency, Seed: 7}))
+			client.SetBaseURL("http://users.internal")
+			for i := 0; i < 400; i++ {
+				_, err := client.Get("/users/42", http.Header{})
+				require.NoError(t, err)
+			}
+
+			assert.Greater(t, fast.requests(), 340, "most traffic goes to the fastest target")
+			assert.Greater(t, medium.requests(), 1, "the others are still probed")
+			assert.Greater(t, slow.requests(), 1, "the others are still probed")
+		})
+	}
+}
+
+func TestLeastLatencyScoresDecay(t *testing.T) {
+	clock := fakeclock.New(time.Now())
+	steady, recovering := newReplica(clock, 100*time.Millisecond, 0), newReplica(clock, 10*time.Millisecond, 1)
+	defer steady.Close()
+	defer recovering.Close()
+
+	client := NewHTTPClient(1000, WithClock(clock), WithLoadBalancing([]string{steady.URL, recovering.URL}, LoadBalancerConfig{
+		Strategy:    LeastLatency,
+		Exploration: -1,
+		HalfLife:    time.Second,
+	}))
+
+	for i := 0; i < 2; i++ {
+		client.Get("http://users.internal/", http.Header{})
+	}
+	require.Equal(t, 1, recovering.requests(), "the failure penalizes the target")
+
+	for i := 0; i < 20; i++ {
+		client.Get("http://users.internal/", http.Header{})
+	}
+	assert.Equal(t, 1, recovering.requests(), "without exploration, only decay brings traffic back")
+
+	for i := 0; i < 40; i++ {
+		client.Get("http://users.internal/", http.Header{})
+	}
+	assert.Greater(t, recovering.requests(), 20, "once its penalty has decayed, the recovered target is measured again and wins")
+}
+
+func TestRoundRobinLoadBalancing(t *testing.T) {
+	var hosts []string
+	servers := make([]*httptest.Server, 3)
+	targets := make([]string, 3)
+	for i := range servers {
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hosts = append(hosts, r.Host)
+			w.Write([]byte(r.URL.Path))
+		}))
+		defer servers[i].Close()
+		targets[i] = servers[i].URL
+	}
+
+	client := NewHTTPClient(1000, WithLoadBalancing(targets, LoadBalancerConfig{}))
+	for i := 0; i < 6; i++ {
+		response, err := client.Get("http://users.internal/users/42", http.Header{})
+		require.NoError(t, err)
+		assert.Equal(t, "/users/42", string(response.Body()))
+	}
+	strip := func(url string) string { return url[len("http://"):] }
+	assert.Equal(t, []string{strip(targets[0]), strip(targets[1]), strip(targets[2]), strip(targets[0]), strip(targets[1]), strip(targets[2])}, hosts)
+
+	request, err := http.NewRequest(http.MethodGet, "http://users.internal/", nil)
+	require.NoError(t, err)
+	request.Host = "users.example.com"
+	_, err = client.Do(request)
+	require.NoError(t, err)
+	assert.Equal(t, "users.example.com", hosts[6], "a Host set by the caller is kept")
+	assert.Equal(t, "http://users.internal/", request.URL.String(), "the caller's request is left as it was")
+
+	_, err = NewHTTPClient(1000, WithLoadBalancing([]string{"//10.0.0.7:8080"}, LoadBalancerConfig{})).Get("http://users.internal/", http.Header{})
+	assert.EqualError(t, err, `invalid load balancer target: "//10.0.0.7:8080" is not absolute`)
+}
@@ -0,0 +1,135 @@
+package heimdall
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const defaultLongPollTimeout = 35 * time.Second
+
+// LongPollOption configures optional behaviour of LongPoll
+type LongPollOption func(*longPoll)
+
+// WithLongPollTimeout sets the timeout of each poll, 35 seconds by default.
+// It should be slightly above the time the server holds a poll open, so that
+// an idle poll ends with the server response rather than the timeout. On a
+// hystrix client the command timeout must be above it too.
+func WithLongPollTimeout(timeout time.Duration) LongPollOption {
+	return func(lp *longPoll) {
+		lp.timeout = timeout
+	}
+}
+
+// WithLongPollRetrier sets the backoff between failed polls, exponential from
+// 100 milliseconds up to 10 seconds by default. The retry count is reset by
+// every successful poll.
+func WithLongPollRetrier(retrier Retriable) LongPollOption {
+	return func(lp *longPoll) {
+		lp.retrier = retrier
+	}
+}
+
+// WithLongPollHeaders sends headers with every poll
+func WithLongPollHeaders(headers http.Header) LongPollOption {
+	return func(lp *longPoll) {
+		lp.headers = headers
+	}
+}
+
+// WithLongPollClock waits between failed polls on clock, which should be the
+// clock the client was made with, instead of the real clock
+func WithLongPollClock(clock Clock) LongPollOption {
+	return func(lp *longPoll) {
+		lp.clock = clock
+	}
+}
+
+type longPoll struct {
+	timeout time.Duration
+	retrier Retriable
+	headers http.Header
+	clock   Clock
+}
+
+// LongPoll polls a long-poll API until extract reports it is done, ctx is
+// done or handler fails. Each poll is a GET of urlBuilder(token), where token
+// is the one extract returned for the previous response, starting empty; an
+// empty token keeps the previous one. Every successful response is passed to
+// handler before extract.
+//
+// Polls run on a client derived from client with the poll timeout and no
+// retries of its own: failed polls, including 5xx responses, are retried
+// with the LongPoll retrier instead, indefinitely. Other error statuses and
+// forbidden hosts stop polling. LongPoll returns nil once done, and ctx.Err() once ctx is done.
+func LongPoll(ctx context.Context, client Client, urlBuilder func(lastToken string) string, extract func(Response) (token string, done bool, err error), handler func(Response) error, opts ...LongPollOption) error {
+	lp := &longPoll{
+		timeout: defaultLongPollTimeout,
+		retrier: NewRetrier(NewExponentialBackoff(100*time.Millisecond, 10*time.Second, defaultExponentFactor)),
+		clock:   realClock{},
+	}
+	for _, opt := range opts {
+		opt(lp)
+	}
+
+	poller := deriveClient(client, []Option{WithTimeout(lp.timeout)})
+	poller.SetRetryCount(0)
+
+	retrier := requestRetrier(lp.retrier)
+	token := ""
+	failures := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		request, err := http.NewRequest(http.MethodGet, urlBuilder(token), nil)
+		if err != nil {
+			return errors.Wrap(err, "long poll - request creation failed")
+		}
+		request = request.WithContext(ctx)
+		request.Header = copyHeader(lp.headers)
+
+		response, err := SendRequest(poller, request)
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			if forbidden := forbiddenHostError(err); forbidden != nil {
+				return forbidden
+			}
+
+			if err := lp.clock.Sleep(ctx, retrier.NextInterval(failures)); err != nil {
+				return err
+			}
+			failures++
+			continue
+		}
+		if failures > 0 {
+			retrier = requestRetrier(lp.retrier)
+			failures = 0
+		}
+
+		if response.StatusCode() >= http.StatusBadRequest {
+			return fmt.Errorf("long poll - unexpected status code: %d", response.StatusCode())
+		}
+
+		if err := handler(response); err != nil {
+			return err
+		}
+
+		next, done, err := extract(response)
+		if err != nil {
+			return errors.Wrap(err, "long poll - token extraction failed")
+		}
+		if done {
+			return nil
+		}
+		if next != "" {
+			token = next
+		}
+	}
+}
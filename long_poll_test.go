@@ -0,0 +1,197 @@
+package heimdall
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type pollBatch struct {
+	Events []int  `json:"events"`
+	Next   string `json:"next"`
+}
+
+// longPollServer answers GET /events?since=<token> with the batch for the
+// token, and holds polls past the last batch open for hold before answering
+// 204 No Content. Other paths are not found.
+func longPollServer(t *testing.T, hold time.Duration, batches map[string]pollBatch) (*httptest.Server, func() []string) {
+	var mu sync.Mutex
+	var polls []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/events" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		since := r.URL.Query().Get("since")
+
+		mu.Lock()
+		polls = append(polls, since)
+		mu.Unlock()
+
+		batch, ok := batches[since]
+		if !ok {
+			select {
+			case <-time.After(hold):
+			case <-r.Context().Done():
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(batch)
+	}))
+
+	return server, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), polls...)
+	}
+}
+
+func eventsURL(server *httptest.Server) func(string) string {
+	return func(token string) string {
+		return server.URL + "/events?since=" + token
+	}
+}
+
+func extractNext(response Response) (string, bool, error) {
+	if response.StatusCode() == http.StatusNoContent {
+		return "", false, nil
+	}
+
+	var batch pollBatch
+	if err := json.Unmarshal(response.Body(), &batch); err != nil {
+		return "", false, err
+	}
+
+	return batch.Next, batch.Next == "end", nil
+}
+
+func TestLongPollFollowsTokensUntilContextIsDone(t *testing.T) {
+	server, polls := longPollServer(t, 100*time.Millisecond, map[string]pollBatch{
+		"":  {Events: []int{1, 2}, Next: "a"},
+		"a": {Events: []int{3}, Next: "b"},
+	})
+	defer server.Close()
+
+	// The client timeout is below the hold time, the poll timeout above it
+	client := NewHTTPClient(50)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var events []int
+	idle := 0
+	err := LongPoll(ctx, client, eventsURL(server), extractNext, func(response Response) error {
+		if response.StatusCode() == http.StatusNoContent {
+			idle++
+			if idle == 2 {
+				cancel()
+			}
+			return nil
+		}
+
+		var batch pollBatch
+		require.NoError(t, json.Unmarshal(response.Body(), &batch))
+		events = append(events, batch.Events...)
+		return nil
+	}, WithLongPollTimeout(time.Second))
+
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, []int{1, 2, 3}, events)
+	assert.Equal(t, []string{"", "a", "b", "b"}, polls())
+}
+
+func TestLongPollStopsWhenDone(t *testing.T) {
+	server, polls := longPollServer(t, time.Second, map[string]pollBatch{
+		"":  {Events: []int{1}, Next: "a"},
+		"a": {Events: []int{2}, Next: "end"},
+	})
+	defer server.Close()
+
+	handled := 0
+	err := LongPoll(context.Background(), NewHTTPClient(1000), eventsURL(server), extractNext, func(Response) error {
+		handled++
+		return nil
+	})
+
+	require.NoError(t, err)
+	assert.Equal(t, 2, handled)
+	assert.Equal(t, []string{"", "a"}, polls())
+}
+
+func TestLongPollBacksOffOnErrors(t *testing.T) {
+	failures := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failures < 3 {
+			failures++
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"events": [1], "next": "end"}`))
+	}))
+	defer server.Close()
+
+	retrier := &recordingRetrier{}
+	began := time.Now()
+	err := LongPoll(context.Background(), NewHTTPClient(1000), eventsURL(server), extractNext, func(Response) error {
+		return nil
+	}, WithLongPollRetrier(retrier))
+
+	require.NoError(t, err)
+	assert.Equal(t, []int{0, 1, 2}, retrier.retries)
+	assert.True(t, time.Since(began) >= 30*time.Millisecond)
+}
+
+func TestLongPollReturnsHandlerAndStatusErrors(t *testing.T) {
+	server, _ := longPollServer(t, time.Second, map[string]pollBatch{"": {Next: "a"}})
+	defer server.Close()
+
+	boom := errors.New("boom")
+	err := LongPoll(context.Background(), NewHTTPClient(1000), eventsURL(server), extractNext, func(Response) error {
+		return boom
+	})
+	assert.Equal(t, boom, err)
+
+	err = LongPoll(context.Background(), NewHTTPClient(1000), func(string) string {
+		return server.URL + "/missing"
+	}, extractNext, func(Response) error {
+		t.Fatal("error responses should not reach the handler")
+		return nil
+	})
+	assert.EqualError(t, err, "long poll - unexpected status code: 404")
+}
+
+func TestLongPollReturnsWhenContextEndsDuringBackoff(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err := LongPoll(ctx, NewHTTPClient(1000), eventsURL(server), extractNext, func(Response) error {
+		return nil
+	}, WithLongPollRetrier(NewRetrier(NewConstantBackoff(10000))))
+
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+// recordingRetrier waits 10ms between attempts and records the retries asked
+type recordingRetrier struct {
+	retries []int
+}
+
+func (r *recordingRetrier) NextInterval(retry int) time.Duration {
+	r.retries = append(r.retries, retry)
+	return 10 * time.Millisecond
+}
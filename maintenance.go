@@ -0,0 +1,175 @@
+package heimdall
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// defaultMaintenancePause is how long a host is paused when its maintenance
+// detector gives no time to retry at
+const defaultMaintenancePause = time.Minute
+
+// ErrUpstreamMaintenance is returned when a response of the host was found
+// to announce maintenance, and by requests to it until RetryAt, which are
+// failed without being sent
+type ErrUpstreamMaintenance struct {
+	// Host is the host in maintenance
+	Host string
+	// RetryAt is when requests to Host are sent again
+	RetryAt time.Time
+}
+
+func (e *ErrUpstreamMaintenance) Error() string {
+	return fmt.Sprintf("%s is in maintenance until %s", e.Host, e.RetryAt.Format(time.RFC3339))
+}
+
+// MaintenanceEvent announces that a host entered or left maintenance
+type MaintenanceEvent struct {
+	Host string
+	// InMaintenance is true when Host entered maintenance, and false when it
+	// answered the first request after its pause without announcing it
+	InMaintenance bool
+	// RetryAt is when requests to Host are sent again, zero once it left
+	RetryAt time.Time
+}
+
+// maintenanceMonitor pauses hosts whose responses its detector finds to
+// announce maintenance. It is replaced rather than changed by the setters,
+// so that clients made with Derive share the pauses and not later settings.
+type maintenanceMonitor struct {
+	detector func(*Response) (bool, time.Time)
+	hook     func(MaintenanceEvent)
+	pauses   *maintenancePauses
+}
+
+// maintenancePauses are the hosts in maintenance, until the time each may be
+// sent requests again
+type maintenancePauses struct {
+	mu      sync.Mutex
+	retryAt map[string]time.Time
+}
+
+// withDetector returns a monitor with the hook and pauses of m running
+// detector, and nil when there is neither a detector nor a hook
+func (m *maintenanceMonitor) withDetector(detector func(*Response) (bool, time.Time)) *maintenanceMonitor {
+	var hook func(MaintenanceEvent)
+	if m != nil {
+		hook = m.hook
+	}
+
+	return m.with(detector, hook)
+}
+
+// withHook returns a monitor with the detector and pauses of m announcing
+// to hook
+func (m *maintenanceMonitor) withHook(hook func(MaintenanceEvent)) *maintenanceMonitor {
+	var detector func(*Response) (bool, time.Time)
+	if m != nil {
+		detector = m.detector
+	}
+
+	return m.with(detector, hook)
+}
+
+func (m *maintenanceMonitor) with(detector func(*Response) (bool, time.Time), hook func(MaintenanceEvent)) *maintenanceMonitor {
+	if detector == nil && hook == nil {
+		return nil
+	}
+	if m != nil {
+		return &maintenanceMonitor{detector: detector, hook: hook, pauses: m.pauses}
+	}
+
+	return &maintenanceMonitor{detector: detector, hook: hook, pauses: &maintenancePauses{retryAt: map[string]time.Time{}}}
+}
+
+// check returns an *ErrUpstreamMaintenance while host is paused at now
+func (m *maintenanceMonitor) check(host string, now time.Time) error {
+	if m == nil || m.detector == nil {
+		return nil
+	}
+
+	m.pauses.mu.Lock()
+	defer m.pauses.mu.Unlock()
+
+	if retryAt, ok := m.pauses.retryAt[host]; ok && now.Before(retryAt) {
+		return &ErrUpstreamMaintenance{Host: host, RetryAt: retryAt}
+	}
+
+	return nil
+}
+
+// observe asks the detector whether response of host announces maintenance,
+// pausing host and returning an *ErrUpstreamMaintenance when it does. Entry
+// into maintenance is announced to the hook, and so is the first response
+// found not to announce it once the pause is over. Panics of the detector or
+// hook fail the attempt with an *ErrCallbackPanic.
+func (m *maintenanceMonitor) observe(host string, response *Response, now time.Time) error {
+	if m == nil || m.detector == nil || response.statusCode == 0 {
+		return nil
+	}
+
+	inMaintenance, retryAt, err := m.detect(response)
+	if err != nil {
+		return err
+	}
+	if !inMaintenance {
+		if m.pauses.leave(host) {
+			return m.announce(MaintenanceEvent{Host: host})
+		}
+		return nil
+	}
+
+	if !retryAt.After(now) {
+		retryAt = now.Add(defaultMaintenancePause)
+	}
+	if m.pauses.enter(host, retryAt) {
+		if err := m.announce(MaintenanceEvent{Host: host, InMaintenance: true, RetryAt: retryAt}); err != nil {
+			return err
+		}
+	}
+
+	return &ErrUpstreamMaintenance{Host: host, RetryAt: retryAt}
+}
+
+func (m *maintenanceMonitor) detect(response *Response) (inMaintenance bool, retryAt time.Time, err error) {
+	defer recoverCallback("maintenance detector", &err)
+
+	inMaintenance, retryAt = m.detector(response)
+	return inMaintenance, retryAt, nil
+}
+
+func (m *maintenanceMonitor) announce(event MaintenanceEvent) (err error) {
+	if m.hook == nil {
+		return nil
+	}
+	defer recoverCallback("maintenance hook", &err)
+
+	m.hook(event)
+	return nil
+}
+
+// enter pauses host until retryAt, reporting whether it was not in
+// maintenance before
+func (p *maintenancePauses) enter(host string, retryAt time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, paused := p.retryAt[host]
+	if !paused || retryAt.After(p.retryAt[host]) {
+		p.retryAt[host] = retryAt
+	}
+
+	return !paused
+}
+
+// leave ends the maintenance of host, reporting whether it was in one
+func (p *maintenancePauses) leave(host string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, paused := p.retryAt[host]
+	delete(p.retryAt, host)
+
+	return paused
+}
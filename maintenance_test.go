@@ -0,0 +1,151 @@
+package heimdall
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gojektech/heimdall/fakeclock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// maintenanceServer answers 503 with an X-Maintenance-Until header of until
+// while in maintenance, and 200 otherwise, counting requests into hits
+type maintenanceServer struct {
+	*httptest.Server
+	hits          int32
+	inMaintenance int32
+	until         time.Time
+}
+
+func newMaintenanceServer(until time.Time) *maintenanceServer {
+	s := &maintenanceServer{until: until, inMaintenance: 1}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&s.hits, 1)
+		if atomic.LoadInt32(&s.inMaintenance) == 1 {
+			w.Header().Set("X-Maintenance-Until", s.until.Format(time.RFC3339))
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+
+	return s
+}
+
+func (s *maintenanceServer) recover() {
+	atomic.StoreInt32(&s.inMaintenance, 0)
+}
+
+// detectMaintenanceHeader finds maintenance in 503s with an
+// X-Maintenance-Until header
+func detectMaintenanceHeader(response *Response) (bool, time.Time) {
+	until := response.Headers().Get("X-Maintenance-Until")
+	if response.StatusCode() != http.StatusServiceUnavailable || until == "" {
+		return false, time.Time{}
+	}
+	retryAt, _ := time.Parse(time.RFC3339, until)
+	return true, retryAt
+}
+
+func TestMaintenancePausesTheHostUntilRetryAt(t *testing.T) {
+	for name, newClient := range map[string]func(clock Clock) testClient{
+		"http": func(clock Clock) testClient { return NewHTTPClient(1000, WithClock(clock)) },
+		"hystrix": func(clock Clock) testClient {
+			return NewHystrixHTTPClient(1000, openOnFirstFailure("maintenance_command"), WithClock(clock))
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			start := time.Date(2018, time.January, 19, 22, 0, 0, 0, time.UTC)
+			server := newMaintenanceServer(start.Add(5 * time.Minute))
+			defer server.Close()
+
+			clock := fakeclock.New(start)
+			client := newClient(clock)
+			client.SetRetryCount(3)
+			client.SetMaintenanceDetector(detectMaintenanceHeader)
+			var events []MaintenanceEvent
+			client.SetMaintenanceHook(func(event MaintenanceEvent) {
+				events = append(events, event)
+			})
+
+			response, err := client.Get(server.URL, http.Header{})
+			var maintenance *ErrUpstreamMaintenance
+			require.True(t, errors.As(err, &maintenance), "%v", err)
+			assert.Equal(t, start.Add(5*time.Minute), maintenance.RetryAt)
+			assert.Equal(t, server.Listener.Addr().String(), maintenance.Host)
+			assert.Equal(t, http.StatusServiceUnavailable, response.StatusCode())
+			assert.Equal(t, int32(1), atomic.LoadInt32(&server.hits), "maintenance consumes no retries")
+
+			for i := 0; i < 3; i++ {
+				clock.Advance(time.Minute)
+				_, err = client.Get(server.URL, http.Header{})
+				require.True(t, errors.As(err, &maintenance), "%v", err)
+			}
+			assert.Equal(t, int32(1), atomic.LoadInt32(&server.hits), "requests to a host in maintenance are not sent")
+
+			server.recover()
+			clock.Advance(2 * time.Minute)
+			response, err = client.Get(server.URL, http.Header{})
+			require.NoError(t, err, "maintenance does not open the circuit")
+			assert.Equal(t, http.StatusOK, response.StatusCode())
+
+			require.Len(t, events, 2)
+			assert.Equal(t, MaintenanceEvent{Host: maintenance.Host, InMaintenance: true, RetryAt: start.Add(5 * time.Minute)}, events[0])
+			assert.Equal(t, MaintenanceEvent{Host: maintenance.Host}, events[1])
+		})
+	}
+}
+
+func TestMaintenanceWithoutRetryAtPausesForTheDefault(t *testing.T) {
+	server := newMaintenanceServer(time.Time{})
+	defer server.Close()
+
+	start := time.Now()
+	clock := fakeclock.New(start)
+	client := NewHTTPClient(1000, WithClock(clock))
+	var events []MaintenanceEvent
+	client.SetMaintenanceHook(func(event MaintenanceEvent) {
+		events = append(events, event)
+	})
+	client.SetMaintenanceDetector(func(response *Response) (bool, time.Time) {
+		return response.StatusCode() == http.StatusServiceUnavailable, time.Time{}
+	})
+
+	_, err := client.Get(server.URL, http.Header{})
+	var maintenance *ErrUpstreamMaintenance
+	require.True(t, errors.As(err, &maintenance), "%v", err)
+	assert.Equal(t, start.Add(defaultMaintenancePause), maintenance.RetryAt)
+
+	clock.Advance(defaultMaintenancePause)
+	_, err = client.Get(server.URL, http.Header{})
+	require.True(t, errors.As(err, &maintenance), "hosts still in maintenance are paused again: %v", err)
+	assert.Equal(t, clock.Now().Add(defaultMaintenancePause), maintenance.RetryAt)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&server.hits))
+	assert.Len(t, events, 1, "entry into maintenance is announced once")
+
+	_, err = client.Derive().Get(server.URL, http.Header{})
+	assert.True(t, errors.As(err, &maintenance), "derived clients share the paused hosts")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&server.hits))
+}
+
+func TestMaintenanceDetectorPanicsFailTheRequest(t *testing.T) {
+	server := newMaintenanceServer(time.Now().Add(time.Hour))
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+	client.SetMaintenanceDetector(func(response *Response) (bool, time.Time) {
+		panic("detector broke")
+	})
+
+	_, err := client.Get(server.URL, http.Header{})
+	var panicked *ErrCallbackPanic
+	require.True(t, errors.As(err, &panicked), "%v", err)
+
+	client.SetMaintenanceDetector(nil)
+	response, err := client.Get(server.URL, http.Header{})
+	assert.Error(t, err, "without a detector a 503 is a server error")
+	assert.Equal(t, http.StatusServiceUnavailable, response.StatusCode())
+}
@@ -0,0 +1,92 @@
+package heimdall
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"strings"
+)
+
+// ErrMalformedResponse is returned when a server answers with a response
+// net/http cannot parse, such as a malformed status line or header, or with
+// headers past the limit set with WithMaxResponseHeaderBytes. A server doing
+// so rarely answers differently the next time, so such attempts are not
+// retried unless WithMalformedResponseRetries is given.
+type ErrMalformedResponse struct {
+	// HeaderTooLarge reports whether the headers exceeded the limit, rather
+	// than failing to parse
+	HeaderTooLarge bool
+	// Detail is the error net/http reported, such as
+	// `malformed HTTP status code "abc"`
+	Detail string
+
+	err error
+}
+
+func (e *ErrMalformedResponse) Error() string {
+	return fmt.Sprintf("malformed response: %s", e.Detail)
+}
+
+// Unwrap returns the error of the transport
+func (e *ErrMalformedResponse) Unwrap() error {
+	return e.err
+}
+
+// WithMaxResponseHeaderBytes limits the size of the response headers the
+// transport reads to n bytes instead of the 10MB net/http allows by default.
+// Larger headers fail the attempt with an *ErrMalformedResponse. The limit is
+// a setting of the transport, so clients made with Derive keep that of the
+// client they derive from.
+func WithMaxResponseHeaderBytes(n int64) Option {
+	return func(options *clientOptions) {
+		options.maxResponseHeaderBytes = n
+	}
+}
+
+// WithMalformedResponseRetries retries attempts failing with an
+// *ErrMalformedResponse like other failed attempts
+func WithMalformedResponseRetries() Option {
+	return func(options *clientOptions) {
+		options.retryMalformed = true
+	}
+}
+
+// malformedResponseError returns err as an *ErrMalformedResponse when the
+// transport failed to parse the response, nil otherwise. net/http does not
+// export these errors, so they are told apart by their messages.
+func malformedResponseError(err error) *ErrMalformedResponse {
+	if err == nil {
+		return nil
+	}
+
+	var malformed *ErrMalformedResponse
+	if errors.As(err, &malformed) {
+		return malformed
+	}
+
+	detail := err
+	for unwrapped := errors.Unwrap(detail); unwrapped != nil; unwrapped = errors.Unwrap(detail) {
+		detail = unwrapped
+	}
+	message := detail.Error()
+
+	var protocol textproto.ProtocolError
+	switch {
+	case strings.HasPrefix(message, "net/http: server response headers exceeded"):
+		return &ErrMalformedResponse{HeaderTooLarge: true, Detail: message, err: err}
+	case strings.HasPrefix(message, "malformed HTTP"), errors.As(err, &protocol):
+		return &ErrMalformedResponse{Detail: message, err: err}
+	}
+
+	return nil
+}
+
+// malformedOutcome returns the outcome of an attempt failing with malformed,
+// which ends the request unless options retry malformed responses
+func malformedOutcome(malformed *ErrMalformedResponse, options clientOptions) attemptOutcome {
+	if options.retryMalformed {
+		return attemptOutcome{err: malformed, cause: malformed}
+	}
+
+	return attemptOutcome{abort: malformed}
+}
@@ -0,0 +1,144 @@
+package heimdall
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// cannedServer answers every request over a plain TCP listener with the raw
+// bytes of response, counting the requests into requests
+func cannedServer(t *testing.T, response string, requests *int32) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == "\r\n" {
+						break
+					}
+				}
+				atomic.AddInt32(requests, 1)
+				conn.Write([]byte(response))
+			}()
+		}
+	}()
+
+	return "http://" + listener.Addr().String()
+}
+
+func oversizedCookieResponse() string {
+	return "HTTP/1.1 200 OK\r\nSet-Cookie: session=" + strings.Repeat("a", 2<<20) + "\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok"
+}
+
+func TestClientsDoNotRetryOversizedHeaders(t *testing.T) {
+	clients := map[string]Client{
+		"http":    NewHTTPClient(5000, WithMaxResponseHeaderBytes(1<<20)),
+		"hystrix": NewHystrixHTTPClient(5000, NewHystrixConfig("malformed_oversized_command", HystrixCommandConfig{Timeout: 5000}), WithMaxResponseHeaderBytes(1<<20)),
+	}
+	for kind, client := range clients {
+		t.Run(kind, func(t *testing.T) {
+			var requests int32
+			url := cannedServer(t, oversizedCookieResponse(), &requests)
+
+			client.SetRetryCount(2)
+
+			_, err := client.Get(url, http.Header{})
+
+			var malformed *ErrMalformedResponse
+			require.True(t, errors.As(err, &malformed), "%v", err)
+			assert.True(t, malformed.HeaderTooLarge)
+			assert.Contains(t, malformed.Detail, "server response headers exceeded")
+			assert.Equal(t, int32(1), atomic.LoadInt32(&requests), "malformed responses are not retried")
+		})
+	}
+}
+
+func TestMaxResponseHeaderBytes(t *testing.T) {
+	var requests int32
+	url := cannedServer(t, oversizedCookieResponse(), &requests)
+
+	response, err := NewHTTPClient(5000).Get(url, http.Header{})
+	require.NoError(t, err)
+
+	assert.Equal(t, "ok", string(response.Body()))
+	assert.Len(t, response.Headers().Get("Set-Cookie"), len("session=")+2<<20, "net/http allows 10MB by default")
+
+	_, err = NewHTTPClient(5000, WithMaxResponseHeaderBytes(1<<10)).Get(cannedServer(t, "HTTP/1.1 200 OK\r\nX-Padding: "+strings.Repeat("a", 2<<10)+"\r\nContent-Length: 0\r\n\r\n", &requests), http.Header{})
+	var malformed *ErrMalformedResponse
+	require.True(t, errors.As(err, &malformed), "%v", err)
+	assert.True(t, malformed.HeaderTooLarge)
+}
+
+func TestClientsDoNotRetryMalformedStatusLines(t *testing.T) {
+	for kind, newClient := range retryClients {
+		t.Run(kind, func(t *testing.T) {
+			var requests int32
+			url := cannedServer(t, "HTTP/1.1 abc OK\r\nContent-Length: 0\r\n\r\n", &requests)
+
+			client := newClient("malformed_status_"+kind, realClock{})
+			client.SetRetryCount(2)
+
+			_, err := client.Get(url, http.Header{})
+
+			var malformed *ErrMalformedResponse
+			require.True(t, errors.As(err, &malformed), "%v", err)
+			assert.False(t, malformed.HeaderTooLarge)
+			assert.Equal(t, `malformed HTTP status code "abc"`, malformed.Detail)
+			assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+		})
+	}
+}
+
+func TestMalformedHeaderLine(t *testing.T) {
+	var requests int32
+	url := cannedServer(t, "HTTP/1.1 200 OK\r\nnot a header\r\nContent-Length: 0\r\n\r\n", &requests)
+
+	_, err := NewHTTPClient(1000).Get(url, http.Header{})
+
+	var malformed *ErrMalformedResponse
+	require.True(t, errors.As(err, &malformed), "%v", err)
+	assert.Contains(t, malformed.Detail, "malformed MIME header")
+}
+
+func TestMalformedResponseRetries(t *testing.T) {
+	var requests int32
+	url := cannedServer(t, "HTTP/1.1 abc OK\r\nContent-Length: 0\r\n\r\n", &requests)
+
+	client := NewHTTPClient(1000, WithMalformedResponseRetries())
+	client.SetRetryCount(2)
+
+	_, err := client.Get(url, http.Header{})
+
+	var malformed *ErrMalformedResponse
+	require.True(t, errors.As(err, &malformed), "%v", err)
+	var exhausted *RetriesExhaustedError
+	assert.True(t, errors.As(err, &exhausted))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+}
+
+func TestOtherTransportErrorsAreNotMalformed(t *testing.T) {
+	assert.Nil(t, malformedResponseError(errors.New("connection reset by peer")))
+	assert.Nil(t, malformedResponseError(nil))
+}
@@ -0,0 +1,101 @@
+package heimdall
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+)
+
+// byteMeter counts the bytes of one attempt into the totals of its request
+// and the per host metrics
+type byteMeter struct {
+	trace   *requestTrace
+	metrics *expvarMetrics
+	host    string
+}
+
+func (m *byteMeter) count(sent, received int) {
+	if m.trace != nil {
+		atomic.AddInt64(&m.trace.bytesSent, int64(sent))
+		atomic.AddInt64(&m.trace.bytesReceived, int64(received))
+	}
+	m.metrics.countBytes(m.host, int64(sent), int64(received))
+}
+
+// meter counts the bytes each attempt sent through next writes to and reads
+// from its connection, so compressed bodies count with their size on the
+// wire. The connections dialed by the transports of the clients count their
+// traffic into the meter of the attempt which last got them from the pool.
+// That is exact for HTTP/1.1, where an attempt has the connection to itself,
+// and approximate for HTTP/2 streams sharing one. How each attempt got its
+// connection is counted into connections, with new ones timed by clock.
+func meter(next Doer, metrics *expvarMetrics, connections *connectionStats, clock Clock) Doer {
+	return DoerFunc(func(request *http.Request) (*http.Response, error) {
+		trace, _ := request.Context().Value(requestTraceKey{}).(*requestTrace)
+		if trace == nil && metrics == nil && connections == nil {
+			return next.Do(request)
+		}
+
+		m := &byteMeter{trace: trace, metrics: metrics, host: request.URL.Host}
+		counted := &connectionTrace{stats: connections, metrics: metrics, clock: clock}
+		ctx := httptrace.WithClientTrace(request.Context(), &httptrace.ClientTrace{
+			GetConn: func(hostPort string) {
+				counted.gettingConn()
+			},
+			GotConn: func(info httptrace.GotConnInfo) {
+				bindMeter(info.Conn, m)
+				counted.gotConn(info)
+			},
+		})
+
+		response, err := next.Do(request.WithContext(ctx))
+		return counted.release(request, response, err)
+	})
+}
+
+// bindMeter makes conn count its traffic into m from now on
+func bindMeter(conn net.Conn, m *byteMeter) {
+	if metered := meteredConnOf(conn); metered != nil {
+		metered.meter.Store(m)
+	}
+}
+
+// meteredConnOf returns the meteredConn under conn, or nil for connections
+// not dialed by newTransport
+func meteredConnOf(conn net.Conn) *meteredConn {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	metered, _ := conn.(*meteredConn)
+
+	return metered
+}
+
+// meteredConn is a connection counting its traffic into a byteMeter, and
+// itself into the idle count of pool while it waits in the pool
+type meteredConn struct {
+	net.Conn
+	meter atomic.Value
+	pool  *connectionPool
+	state int32
+}
+
+func (c *meteredConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if m, ok := c.meter.Load().(*byteMeter); ok && n > 0 {
+		m.count(0, n)
+	}
+
+	return n, err
+}
+
+func (c *meteredConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if m, ok := c.meter.Load().(*byteMeter); ok && n > 0 {
+		m.count(n, 0)
+	}
+
+	return n, err
+}
@@ -0,0 +1,127 @@
+package heimdall
+
+import (
+	"bytes"
+	"compress/gzip"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// headerOverhead bounds the bytes of request and status lines and headers
+const headerOverhead = 300
+
+func assertWithinOverhead(t *testing.T, payload int, counted int64, what string) {
+	assert.True(t, counted >= int64(payload) && counted <= int64(payload+headerOverhead),
+		"%s: counted %d bytes for a payload of %d", what, counted, payload)
+}
+
+func TestResponseCountsBytesOnTheWire(t *testing.T) {
+	payload := strings.Repeat("x", 8<<10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header()["Content-Type"] = nil
+		w.Write([]byte(payload))
+	}))
+	defer server.Close()
+
+	for name, newClient := range retryClients {
+		t.Run(name, func(t *testing.T) {
+			client := newClient("metering_"+name, realClock{})
+
+			body := strings.Repeat("y", 3<<10)
+			response, err := client.Post(server.URL, strings.NewReader(body), http.Header{})
+			require.NoError(t, err)
+
+			assertWithinOverhead(t, len(body), response.BytesSent(), "sent")
+			assertWithinOverhead(t, len(payload), response.BytesReceived(), "received")
+		})
+	}
+}
+
+func TestResponseCountsBytesOfEveryAttempt(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header()["Content-Type"] = nil
+		if calls < 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		w.Write(bytes.Repeat([]byte("z"), 1000))
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(1000, WithKeepAlive())
+	client.SetRetryCount(2)
+
+	response, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+
+	assertWithinOverhead(t, 3000, response.BytesReceived(), "received")
+	assert.True(t, response.BytesSent() > 0 && response.BytesSent() < 3*headerOverhead)
+}
+
+func TestResponseCountsCompressedBytes(t *testing.T) {
+	payload := bytes.Repeat([]byte("compressible "), 10000)
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(payload)
+	writer.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Contains(t, r.Header.Get("Accept-Encoding"), "gzip")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Length", strconv.Itoa(compressed.Len()))
+		w.Write(compressed.Bytes())
+	}))
+	defer server.Close()
+
+	response, err := NewHTTPClient(1000).Get(server.URL, http.Header{})
+	require.NoError(t, err)
+
+	assert.Equal(t, payload, response.Body())
+	assertWithinOverhead(t, compressed.Len(), response.BytesReceived(), "received")
+}
+
+func TestByteCountersArePublishedPerHost(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("a"), 500))
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+	client.EnableExpvar("heimdall_metering_test")
+
+	response, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	sent := expvar.Get("heimdall_metering_test.bytes_sent").(*expvar.Map).Get(host)
+	received := expvar.Get("heimdall_metering_test.bytes_received").(*expvar.Map).Get(host)
+	require.NotNil(t, sent)
+	require.NotNil(t, received)
+	assert.Equal(t, strconv.FormatInt(response.BytesSent(), 10), sent.String())
+	assert.Equal(t, strconv.FormatInt(response.BytesReceived(), 10), received.String())
+}
+
+func TestResponseCountsBytesThroughTLSAndProxy(t *testing.T) {
+	payload := strings.Repeat("s", 4<<10)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(payload))
+	}))
+	defer server.Close()
+
+	proxy := newConnectProxyServer(t, "Basic", "")
+	client := proxiedClient(server, &url.URL{Scheme: "http", Host: proxy.listener.Addr().String()}, nil)
+
+	response, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+
+	assertWithinOverhead(t, len(payload), response.BytesReceived(), "received")
+}
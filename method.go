@@ -0,0 +1,103 @@
+package heimdall
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// ErrInvalidMethod is returned, before any attempt is sent, for a request
+// method that is not an RFC 7230 token
+type ErrInvalidMethod struct {
+	Method string
+}
+
+func (e *ErrInvalidMethod) Error() string {
+	return fmt.Sprintf("invalid method %q: not an RFC 7230 token", e.Method)
+}
+
+// standardMethods are the methods of RFC 7231 and RFC 5789, which clients
+// retry as they always have
+var standardMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodConnect: true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+}
+
+var (
+	idempotentMethodsMu sync.RWMutex
+	idempotentMethods   = map[string]bool{}
+)
+
+// RegisterIdempotentMethod marks the custom method, such as PROPFIND or
+// PURGE, as safe to send more than once, so that failed attempts of requests
+// using it are retried like those of the standard methods. Requests with
+// custom methods that were not registered are sent once, whatever the retry
+// count. Methods are case-sensitive, and registering one applies to every
+// client of the process.
+func RegisterIdempotentMethod(method string) error {
+	if !validMethod(method) {
+		return &ErrInvalidMethod{Method: method}
+	}
+
+	idempotentMethodsMu.Lock()
+	defer idempotentMethodsMu.Unlock()
+
+	idempotentMethods[method] = true
+	return nil
+}
+
+// methodRetryCount returns the retries allowed to a request with method by a
+// client retrying retryCount times
+func methodRetryCount(method string, retryCount int) int {
+	if retriesMethod(method) {
+		return retryCount
+	}
+
+	return 0
+}
+
+// retriesMethod reports whether failed attempts of requests with method may
+// be retried
+func retriesMethod(method string) bool {
+	if method == "" || standardMethods[method] {
+		return true
+	}
+
+	idempotentMethodsMu.RLock()
+	defer idempotentMethodsMu.RUnlock()
+
+	return idempotentMethods[method]
+}
+
+// validMethod reports whether method is a token as RFC 7230 defines it
+func validMethod(method string) bool {
+	if method == "" {
+		return false
+	}
+
+	for _, c := range method {
+		if c > 0x7e || c <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// newMethodRequest builds the request of Invoke, checking method first
+func newMethodRequest(method, rawURL string, body io.Reader) (*http.Request, error) {
+	if !validMethod(method) {
+		return nil, &ErrInvalidMethod{Method: method}
+	}
+
+	return newRequest(method, rawURL, body)
+}
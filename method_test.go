@@ -0,0 +1,140 @@
+package heimdall
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?><propfind xmlns="DAV:"><prop><getetag/></prop></propfind>`
+
+// webDAVServer answers PROPFIND requests for propfindBody with a 207, after
+// failing the first failures requests with a 503
+func webDAVServer(t *testing.T, failures int32, calls *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		assert.Equal(t, propfindBody, string(body), "every attempt sends the whole body")
+
+		if atomic.AddInt32(calls, 1) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Method != "PROPFIND" || r.Header.Get("Depth") != "1" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusMultiStatus)
+		w.Write([]byte(`<multistatus xmlns="DAV:"/>`))
+	}))
+}
+
+func propfindHeaders() http.Header {
+	return http.Header{"Depth": {"1"}, "Content-Type": {"application/xml"}}
+}
+
+func TestClientsInvokeCustomMethods(t *testing.T) {
+	for kind, newClient := range retryClients {
+		t.Run(kind, func(t *testing.T) {
+			var calls int32
+			server := webDAVServer(t, 0, &calls)
+			defer server.Close()
+
+			client := newClient("method_invoke_"+kind, realClock{})
+			response, err := client.Invoke("PROPFIND", server.URL+"/files/", strings.NewReader(propfindBody), propfindHeaders())
+			require.NoError(t, err)
+
+			assert.Equal(t, http.StatusMultiStatus, response.StatusCode())
+			assert.Equal(t, `<multistatus xmlns="DAV:"/>`, string(response.Body()))
+		})
+	}
+}
+
+func TestUnregisteredCustomMethodsAreNotRetried(t *testing.T) {
+	for kind, newClient := range retryClients {
+		t.Run(kind, func(t *testing.T) {
+			var calls int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&calls, 1)
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}))
+			defer server.Close()
+
+			client := newClient("method_unregistered_"+kind, realClock{})
+			client.SetRetryCount(2)
+
+			response, err := client.Invoke("MKCOL", server.URL+"/files/new/", nil, http.Header{})
+
+			assert.Error(t, err)
+			assert.Equal(t, http.StatusServiceUnavailable, response.StatusCode())
+			assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+		})
+	}
+}
+
+func TestRegisteredIdempotentMethodsAreRetried(t *testing.T) {
+	require.NoError(t, RegisterIdempotentMethod("PROPFIND"))
+
+	for kind, newClient := range retryClients {
+		t.Run(kind, func(t *testing.T) {
+			var calls int32
+			server := webDAVServer(t, 2, &calls)
+			defer server.Close()
+
+			client := newClient("method_registered_"+kind, realClock{})
+			client.SetRetryCount(2)
+
+			response, err := client.Invoke("PROPFIND", server.URL+"/files/", strings.NewReader(propfindBody), propfindHeaders())
+			require.NoError(t, err)
+
+			assert.Equal(t, http.StatusMultiStatus, response.StatusCode())
+			assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+			assert.Len(t, response.Trace().Attempts, 3)
+		})
+	}
+}
+
+func TestInvokeRetriesStandardMethods(t *testing.T) {
+	server := failingServer(2)
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+	client.SetRetryCount(2)
+
+	response, err := client.Invoke(http.MethodPost, server.URL, strings.NewReader("{}"), http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode())
+	assert.Len(t, response.Trace().Attempts, 3)
+}
+
+func TestInvokeRejectsInvalidMethods(t *testing.T) {
+	var calls int32
+	server := countingServer(&calls)
+	defer server.Close()
+
+	for _, method := range []string{"", "GET /", "PRO(FIND)", "PURGE\n", "ÜBER"} {
+		_, err := NewHTTPClient(1000).Invoke(method, server.URL, nil, http.Header{})
+
+		var invalid *ErrInvalidMethod
+		require.True(t, errors.As(err, &invalid), "%q: %v", method, err)
+		assert.Equal(t, method, invalid.Method)
+	}
+	assert.Equal(t, int32(0), atomic.LoadInt32(&calls))
+
+	var invalid *ErrInvalidMethod
+	assert.True(t, errors.As(RegisterIdempotentMethod("BAD METHOD"), &invalid))
+}
+
+func TestValidMethod(t *testing.T) {
+	for _, method := range []string{"GET", "PURGE", "VERSION-CONTROL", "M-SEARCH", "x.custom~1"} {
+		assert.True(t, validMethod(method), method)
+	}
+}
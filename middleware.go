@@ -0,0 +1,165 @@
+package heimdall
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// Doer sends a single HTTP request, as *http.Client does
+type Doer interface {
+	Do(request *http.Request) (*http.Response, error)
+}
+
+// DoerFunc adapts a plain function to the Doer interface
+type DoerFunc func(request *http.Request) (*http.Response, error)
+
+// Do calls f(request)
+func (f DoerFunc) Do(request *http.Request) (*http.Response, error) {
+	return f(request)
+}
+
+// Middleware wraps the Doer that sends each attempt. A middleware may change
+// the request before passing it on, inspect the response, or return a
+// response of its own without calling next at all. The request is that of
+// the attempt, cloned from the caller's for each one, so its changes are
+// seen by the middlewares inside it but not by later attempts, which start
+// from the caller's request again.
+type Middleware func(next Doer) Doer
+
+// chainMiddlewares wraps doer so that the first middleware is the outermost
+func chainMiddlewares(doer Doer, middlewares []Middleware) Doer {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		doer = middlewares[i](doer)
+	}
+
+	return doer
+}
+
+// buildDoer returns the doer sending each attempt of a request with settings,
+// its steps listed innermost first
+func buildDoer(options clientOptions, settings attemptSettings) Doer {
+	doer := downgradeHTTP2(settings.client, options.http2Downgrade, options.clock)
+	doer = decodeContent(doer)
+	doer = captureSent(doer, settings.redactor, options.sentRequests)
+	doer = propagateDeadline(doer, options.deadline, options.clock)
+	doer = mutateRaw(doer, settings.rawMutator)
+	doer = reportInformational(doer, options.informational)
+	doer = tracePhases(doer, options.clock, options.phaseTimings)
+	doer = meter(doer, settings.expvar, settings.stats.connections, options.clock)
+	doer = injectFaults(doer, options.faults, options.clock, settings.stats, settings.expvar)
+	doer = weighTargets(doer, options.balancer, options.clock)
+	doer = hedge(doer, options.hedging, options.clock, settings.stats, settings.expvar)
+	doer = withResponseHeaderTimeout(doer, settings.responseHeaderTimeout, options.clock)
+	doer = settings.audit.wrap(doer)
+
+	return chainMiddlewares(doer, settings.middlewares)
+}
+
+// NewHeaderMiddleware sets headers on every request, replacing any values
+// already present under the same names
+func NewHeaderMiddleware(headers http.Header) Middleware {
+	return func(next Doer) Doer {
+		return DoerFunc(func(request *http.Request) (*http.Response, error) {
+			withHeaders := new(http.Request)
+			*withHeaders = *request
+			withHeaders.Header = copyHeader(request.Header)
+			for name, values := range headers {
+				withHeaders.Header[http.CanonicalHeaderKey(name)] = append([]string(nil), values...)
+			}
+
+			return next.Do(withHeaders)
+		})
+	}
+}
+
+// NewLatencyLoggingMiddleware reports the method, URL, outcome and duration of
+// every attempt through logf, which may be log.Printf. Durations are measured
+// on clock, the real clock when nil.
+func NewLatencyLoggingMiddleware(logf func(format string, args ...interface{}), clock Clock) Middleware {
+	clock = clockOrReal(clock)
+	return func(next Doer) Doer {
+		return DoerFunc(func(request *http.Request) (*http.Response, error) {
+			start := clock.Now()
+			response, err := next.Do(request)
+			elapsed := clock.Now().Sub(start)
+
+			if err != nil {
+				logf("%s %s failed after %s: %v", request.Method, request.URL, elapsed, err)
+				return response, err
+			}
+
+			logf("%s %s returned %d in %s", request.Method, request.URL, response.StatusCode, elapsed)
+
+			return response, nil
+		})
+	}
+}
+
+// ErrResponseTooLarge is the body read error of an attempt whose response
+// body exceeds the limit of NewMaxResponseSizeMiddleware
+type ErrResponseTooLarge struct {
+	Limit int64
+}
+
+func (e *ErrResponseTooLarge) Error() string {
+	return fmt.Sprintf("response body larger than %d bytes", e.Limit)
+}
+
+// NewMaxResponseSizeMiddleware fails the body read of responses larger than
+// limit bytes with an *ErrResponseTooLarge, rather than buffering them whole
+func NewMaxResponseSizeMiddleware(limit int64) Middleware {
+	return func(next Doer) Doer {
+		return DoerFunc(func(request *http.Request) (*http.Response, error) {
+			response, err := next.Do(request)
+			if err != nil || response.Body == nil {
+				return response, err
+			}
+
+			if response.ContentLength > limit {
+				response.Body.Close()
+				response.Body = ioutil.NopCloser(errReader{&ErrResponseTooLarge{Limit: limit}})
+				return response, nil
+			}
+
+			response.Body = &limitedBody{ReadCloser: response.Body, remaining: limit, limit: limit}
+			return response, nil
+		})
+	}
+}
+
+// limitedBody fails once more than limit bytes have been read
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	limit     int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, &ErrResponseTooLarge{Limit: b.limit}
+	}
+
+	// Reading one byte past the limit tells a body of exactly limit bytes
+	// apart from a larger one
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n + int(b.remaining), &ErrResponseTooLarge{Limit: b.limit}
+	}
+
+	return n, err
+}
+
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
@@ -0,0 +1,193 @@
+package heimdall
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func recordingMiddleware(name string, calls *[]string) Middleware {
+	return func(next Doer) Doer {
+		return DoerFunc(func(request *http.Request) (*http.Response, error) {
+			*calls = append(*calls, name+" before")
+			response, err := next.Do(request)
+			*calls = append(*calls, name+" after")
+
+			return response, err
+		})
+	}
+}
+
+func shortCircuitMiddleware(status int, body string) Middleware {
+	return func(next Doer) Doer {
+		return DoerFunc(func(request *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: status,
+				Header:     http.Header{"X-Cached": []string{"true"}},
+				Body:       ioutil.NopCloser(strings.NewReader(body)),
+			}, nil
+		})
+	}
+}
+
+func TestHTTPClientRunsMiddlewaresOutermostFirst(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	var calls []string
+	client := NewHTTPClient(100)
+	client.Use(recordingMiddleware("first", &calls), recordingMiddleware("second", &calls))
+	client.Use(recordingMiddleware("third", &calls))
+
+	_, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"first before", "second before", "third before",
+		"third after", "second after", "first after",
+	}, calls)
+}
+
+func TestHTTPClientMiddlewaresWrapEveryAttempt(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	var calls []string
+	client := NewHTTPClient(100)
+	client.SetRetryCount(2)
+	client.Use(recordingMiddleware("mw", &calls))
+
+	_, err := client.Get(server.URL, http.Header{})
+	require.Error(t, err)
+
+	assert.Len(t, calls, 6)
+}
+
+func TestHTTPClientMiddlewareSeesMutatedRequest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	client := NewHTTPClient(100)
+	client.AddRequestMutator(RequestMutatorFunc(func(request *http.Request) error {
+		request.Header.Set("X-Signature", "signed")
+		return nil
+	}))
+
+	var seen string
+	client.Use(func(next Doer) Doer {
+		return DoerFunc(func(request *http.Request) (*http.Response, error) {
+			seen = request.Header.Get("X-Signature")
+			return next.Do(request)
+		})
+	})
+
+	_, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+
+	assert.Equal(t, "signed", seen)
+}
+
+func testMiddlewareShortCircuit(t *testing.T, client testClient) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	defer server.Close()
+
+	client.Use(shortCircuitMiddleware(http.StatusAccepted, "synthetic"))
+
+	response, err := client.Get(server.URL+"/cached", http.Header{})
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusAccepted, response.StatusCode())
+	assert.Equal(t, "synthetic", string(response.Body()))
+	assert.Equal(t, "true", response.Headers().Get("X-Cached"))
+	assert.Equal(t, server.URL+"/cached", response.FinalURL())
+	assert.Equal(t, int32(0), atomic.LoadInt32(&hits))
+}
+
+func TestHTTPClientMiddlewareCanShortCircuit(t *testing.T) {
+	testMiddlewareShortCircuit(t, NewHTTPClient(100))
+}
+
+func TestHystrixHTTPClientMiddlewareCanShortCircuit(t *testing.T) {
+	testMiddlewareShortCircuit(t, NewHystrixHTTPClient(100, NewHystrixConfig("middleware_command", HystrixCommandConfig{})))
+}
+
+func TestHeaderMiddlewareSetsHeadersWithoutTouchingCallerHeaders(t *testing.T) {
+	var received http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(100)
+	client.Use(NewHeaderMiddleware(http.Header{"authorization": []string{"Bearer token"}}))
+
+	headers := http.Header{}
+	headers.Set("Authorization", "Bearer stale")
+	headers.Set("Accept", "application/json")
+
+	_, err := client.Get(server.URL, headers)
+	require.NoError(t, err)
+
+	assert.Equal(t, "Bearer token", received.Get("Authorization"))
+	assert.Equal(t, "application/json", received.Get("Accept"))
+	assert.Equal(t, "Bearer stale", headers.Get("Authorization"))
+}
+
+func TestLatencyLoggingMiddlewareLogsEachAttempt(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer server.Close()
+
+	var lines []string
+	logf := func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+
+	client := NewHTTPClient(100)
+	client.Use(NewLatencyLoggingMiddleware(logf, nil))
+
+	_, err := client.Get(server.URL+"/pot", http.Header{})
+	require.NoError(t, err)
+
+	require.Len(t, lines, 1)
+	assert.True(t, strings.HasPrefix(lines[0], "GET "+server.URL+"/pot returned 418 in "), lines[0])
+
+	_, err = client.Get("http://127.0.0.1:0/", http.Header{})
+	require.Error(t, err)
+
+	require.Len(t, lines, 2)
+	assert.Contains(t, lines[1], "GET http://127.0.0.1:0/ failed after ")
+}
+
+func TestMaxResponseSizeMiddlewareAllowsBodiesUpToLimit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Streamed without a Content-Length, so the limit applies while reading
+		w.(http.Flusher).Flush()
+		w.Write([]byte(r.URL.Query().Get("body")))
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+	client.Use(NewMaxResponseSizeMiddleware(4))
+
+	response, err := client.Get(server.URL+"?body=abcd", http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, "abcd", string(response.Body()))
+
+	_, err = client.Get(server.URL+"?body=abcde", http.Header{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "response body larger than 4 bytes")
+}
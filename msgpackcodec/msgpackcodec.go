@@ -0,0 +1,34 @@
+// Package msgpackcodec provides a heimdall.Codec for MessagePack bodies.
+//
+// It lives outside the heimdall package so that clients which never speak
+// MessagePack do not depend on the encoder:
+//
+//	client.RegisterCodec(msgpackcodec.New())
+package msgpackcodec
+
+import (
+	"github.com/gojektech/heimdall"
+	"github.com/vmihailenco/msgpack"
+)
+
+// ContentType is the content type the codec is registered for
+const ContentType = "application/msgpack"
+
+type codec struct{}
+
+// New returns a codec encoding values with MessagePack
+func New() heimdall.Codec {
+	return codec{}
+}
+
+func (codec) ContentType() string {
+	return ContentType
+}
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
@@ -0,0 +1,43 @@
+package msgpackcodec
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gojektech/heimdall"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type item struct {
+	Name  string `msgpack:"name"`
+	Count int    `msgpack:"count"`
+}
+
+func TestCodecRoundTripsThroughClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, ContentType, r.Header.Get("Content-Type"))
+		assert.Equal(t, ContentType, r.Header.Get("Accept"))
+
+		var received item
+		body, _ := ioutil.ReadAll(r.Body)
+		require.NoError(t, New().Unmarshal(body, &received))
+		received.Count++
+
+		response, _ := New().Marshal(received)
+		w.Header().Set("Content-Type", ContentType)
+		w.Write(response)
+	}))
+	defer server.Close()
+
+	client := heimdall.NewHTTPClient(1000)
+	client.RegisterCodec(New())
+
+	var out item
+	_, err := heimdall.Send(client, http.MethodPost, server.URL, ContentType, item{Name: "widget", Count: 1}, &out, http.Header{})
+	require.NoError(t, err)
+
+	assert.Equal(t, item{Name: "widget", Count: 2}, out)
+}
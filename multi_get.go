@@ -0,0 +1,148 @@
+package heimdall
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// GetManyIDPlaceholder is replaced with each resource ID in the URL template
+// given to GetMany
+const GetManyIDPlaceholder = "{id}"
+
+// GetMany fetches urlTemplate for every ID, substituting the path escaped ID
+// for "{id}", with at most concurrency requests in flight. Each pass after the
+// first only re-attempts the IDs whose previous attempt returned an error, up
+// to passes in total. Successful responses and the last error of every ID
+// that never succeeded are returned keyed by ID. Requests are sent with ctx,
+// so once it is done the requests in flight are cancelled, no further
+// requests or passes are started, and IDs that were never attempted fail with
+// the context's error.
+func GetMany(ctx context.Context, client Client, urlTemplate string, ids []string, concurrency int, passes int) (map[string]Response, map[string]error) {
+	return GetManyWithBudget(ctx, client, urlTemplate, ids, concurrency, passes, nil)
+}
+
+// GetManyWithBudget is GetMany drawing every request of the passes after the
+// first from budget, which it may share with clients hedging through
+// WithHedging. IDs the budget has no room for are not attempted again in that
+// pass, and keep their last error unless a later pass gets them through.
+func GetManyWithBudget(ctx context.Context, client Client, urlTemplate string, ids []string, concurrency int, passes int, budget *LoadBudget) (map[string]Response, map[string]error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if passes < 1 {
+		passes = 1
+	}
+
+	responses := map[string]Response{}
+	failures := map[string]error{}
+
+	pending := uniqueIDs(ids)
+	for pass := 0; pass < passes && len(pending) > 0; pass++ {
+		if ctx.Err() != nil {
+			break
+		}
+
+		var skipped []string
+		if pass > 0 {
+			pending, skipped = budgetedIDs(pending, budget)
+		}
+		pending = append(getManyPass(ctx, client, urlTemplate, pending, concurrency, responses, failures), skipped...)
+	}
+
+	for _, id := range pending {
+		if _, failed := failures[id]; !failed {
+			failures[id] = ctx.Err()
+		}
+	}
+
+	return responses, failures
+}
+
+// getManyPass fetches ids once and returns those that failed
+func getManyPass(ctx context.Context, client Client, urlTemplate string, ids []string, concurrency int, responses map[string]Response, failures map[string]error) []string {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, concurrency)
+	failed := []string{}
+
+	for _, id := range ids {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+
+		if ctx.Err() != nil {
+			mu.Lock()
+			if _, seen := failures[id]; !seen {
+				failures[id] = ctx.Err()
+			}
+			failed = append(failed, id)
+			mu.Unlock()
+			continue
+		}
+
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			response, err := getManyRequest(ctx, client, strings.Replace(urlTemplate, GetManyIDPlaceholder, url.PathEscape(id), -1))
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err != nil {
+				failures[id] = err
+				failed = append(failed, id)
+				return
+			}
+
+			delete(failures, id)
+			responses[id] = response
+		}(id)
+	}
+
+	wg.Wait()
+
+	return failed
+}
+
+// getManyRequest gets rawURL with ctx
+func getManyRequest(ctx context.Context, client Client, rawURL string) (Response, error) {
+	request, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return Response{}, err
+	}
+
+	return SendRequest(client, request.WithContext(ctx))
+}
+
+// budgetedIDs splits ids into those budget lets through and those it skips
+func budgetedIDs(ids []string, budget *LoadBudget) ([]string, []string) {
+	var allowed, skipped []string
+	for _, id := range ids {
+		if budget.take() {
+			allowed = append(allowed, id)
+		} else {
+			skipped = append(skipped, id)
+		}
+	}
+
+	return allowed, skipped
+}
+
+func uniqueIDs(ids []string) []string {
+	seen := make(map[string]bool, len(ids))
+	unique := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+
+	return unique
+}
@@ -0,0 +1,138 @@
+package heimdall
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type itemServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	calls    map[string]int
+	inFlight int
+	peak     int
+}
+
+// newItemServer serves /items/{id}, failing the first request for every ID
+// for which fail returns true
+func newItemServer(fail func(id string, call int) bool) *itemServer {
+	s := &itemServer{calls: map[string]int{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/items/")
+
+		s.mu.Lock()
+		s.calls[id]++
+		call := s.calls[id]
+		s.inFlight++
+		if s.inFlight > s.peak {
+			s.peak = s.inFlight
+		}
+		s.mu.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+
+		s.mu.Lock()
+		s.inFlight--
+		s.mu.Unlock()
+
+		if fail(id, call) {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		fmt.Fprintf(w, `{ "id": %q }`, id)
+	}))
+
+	return s
+}
+
+func TestGetManyRetriesOnlyFailedIDs(t *testing.T) {
+	server := newItemServer(func(id string, call int) bool {
+		return call == 1 && (id == "2" || id == "4")
+	})
+	defer server.Close()
+
+	ids := []string{"1", "2", "3", "4", "5", "6"}
+	responses, failures := GetMany(context.Background(), NewHTTPClient(100), server.URL+"/items/{id}", ids, 2, 2)
+
+	assert.Empty(t, failures)
+	require.Len(t, responses, len(ids))
+	for _, id := range ids {
+		assert.Equal(t, fmt.Sprintf(`{ "id": %q }`, id), string(responses[id].Body()))
+	}
+
+	assert.Equal(t, map[string]int{"1": 1, "2": 2, "3": 1, "4": 2, "5": 1, "6": 1}, server.calls)
+	assert.True(t, server.peak <= 2, "expected at most 2 requests in flight, got %d", server.peak)
+}
+
+func TestGetManyReportsIDsThatFailEveryPass(t *testing.T) {
+	server := newItemServer(func(id string, call int) bool {
+		return id == "bad"
+	})
+	defer server.Close()
+
+	responses, failures := GetMany(context.Background(), NewHTTPClient(100), server.URL+"/items/{id}", []string{"good", "bad", "good"}, 4, 3)
+
+	assert.Len(t, responses, 1)
+	assert.Contains(t, responses, "good")
+
+	require.Len(t, failures, 1)
+	assert.Contains(t, failures["bad"].Error(), "server error: 500")
+
+	assert.Equal(t, map[string]int{"good": 1, "bad": 3}, server.calls)
+}
+
+func TestGetManyStopsPassesOnceContextIsCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := newItemServer(func(id string, call int) bool {
+		cancel()
+		return true
+	})
+	defer server.Close()
+
+	_, failures := GetMany(ctx, NewHTTPClient(100), server.URL+"/items/{id}", []string{"a"}, 1, 5)
+
+	require.Len(t, failures, 1)
+	assert.True(t, errors.Is(failures["a"], context.Canceled), "the request in flight is cancelled with the context: %v", failures["a"])
+	assert.Equal(t, map[string]int{"a": 1}, server.calls)
+}
+
+func TestGetManyWithCancelledContextMakesNoRequests(t *testing.T) {
+	server := newItemServer(func(id string, call int) bool { return false })
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	responses, failures := GetMany(ctx, NewHTTPClient(100), server.URL+"/items/{id}", []string{"a", "b"}, 2, 2)
+
+	assert.Empty(t, responses)
+	assert.Equal(t, map[string]error{"a": context.Canceled, "b": context.Canceled}, failures)
+	assert.Empty(t, server.calls)
+}
+
+func TestGetManyEscapesIDs(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.EscapedPath())
+	}))
+	defer server.Close()
+
+	_, failures := GetMany(context.Background(), NewHTTPClient(100), server.URL+"/items/{id}/details", []string{"a/b c"}, 1, 1)
+
+	assert.Empty(t, failures)
+	assert.Equal(t, []string{"/items/a%2Fb%20c/details"}, paths)
+}
@@ -0,0 +1,73 @@
+package heimdall
+
+import (
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNotAcceptable is returned by GetNegotiated when the server answers 406
+// Not Acceptable, as it can serve none of the offered media types
+type ErrNotAcceptable struct {
+	// Offered are the media types the request accepted, in order of preference
+	Offered []string
+	// Response is the 406 response
+	Response Response
+}
+
+func (e *ErrNotAcceptable) Error() string {
+	return fmt.Sprintf("not acceptable: server serves none of %s", strings.Join(e.Offered, ", "))
+}
+
+// GetNegotiated makes a HTTP GET request through client accepting the media
+// types in acceptable, most preferred first, and returns the media type the
+// server chose as declared by the response Content-Type. Wildcards such as
+// "text/*" and "*/*" may be offered.
+func GetNegotiated(client Client, url string, acceptable []string, headers http.Header) (Response, string, error) {
+	accept, err := acceptHeader(acceptable)
+	if err != nil {
+		return Response{}, "", err
+	}
+
+	headers = copyHeader(headers)
+	headers.Set("Accept", accept)
+
+	response, err := client.Get(url, headers)
+	if err != nil {
+		return response, "", err
+	}
+
+	if response.StatusCode() == http.StatusNotAcceptable {
+		return response, "", &ErrNotAcceptable{Offered: append([]string(nil), acceptable...), Response: response}
+	}
+
+	return response, response.ContentType(), nil
+}
+
+// acceptHeader builds an Accept header weighting acceptable in the order given
+func acceptHeader(acceptable []string) (string, error) {
+	if len(acceptable) == 0 {
+		return "", errors.New("no acceptable media types")
+	}
+
+	ranges := make([]string, len(acceptable))
+	for i, media := range acceptable {
+		parsed, _, err := mime.ParseMediaType(media)
+		if err != nil || !strings.Contains(parsed, "/") {
+			return "", errors.Errorf("invalid media type %q", media)
+		}
+
+		ranges[i] = strings.TrimSpace(media)
+		if i > 0 {
+			q := math.Max(1-float64(i)/float64(len(acceptable)), 0.001)
+			ranges[i] += ";q=" + strings.TrimRight(strconv.FormatFloat(q, 'f', 3, 64), "0")
+		}
+	}
+
+	return strings.Join(ranges, ", "), nil
+}
@@ -0,0 +1,136 @@
+package heimdall
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// negotiatingServer serves JSON or CSV, whichever the Accept header prefers
+func negotiatingServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+			switch strings.TrimSpace(strings.Split(accepted, ";")[0]) {
+			case "application/json", "application/*":
+				w.Header().Set("Content-Type", "application/json; charset=utf-8")
+				w.Write([]byte(`{ "id": 1 }`))
+				return
+			case "text/csv", "text/*", "*/*":
+				w.Header().Set("Content-Type", "text/csv")
+				w.Write([]byte("id\n1\n"))
+				return
+			}
+		}
+
+		w.WriteHeader(http.StatusNotAcceptable)
+	}))
+}
+
+func TestGetNegotiatedPicksJSON(t *testing.T) {
+	server := negotiatingServer()
+	defer server.Close()
+
+	response, contentType, err := GetNegotiated(NewHTTPClient(1000), server.URL, []string{"application/json", "text/csv"}, http.Header{})
+	require.NoError(t, err)
+
+	assert.Equal(t, "application/json", contentType)
+	assert.Equal(t, `{ "id": 1 }`, string(response.Body()))
+}
+
+func TestGetNegotiatedPicksCSV(t *testing.T) {
+	server := negotiatingServer()
+	defer server.Close()
+
+	response, contentType, err := GetNegotiated(NewHTTPClient(1000), server.URL, []string{"text/csv", "application/json"}, http.Header{})
+	require.NoError(t, err)
+
+	assert.Equal(t, "text/csv", contentType)
+	assert.Equal(t, "id\n1\n", string(response.Body()))
+}
+
+func TestClientsGetNegotiated(t *testing.T) {
+	server := negotiatingServer()
+	defer server.Close()
+
+	clients := map[string]interface {
+		GetNegotiated(url string, acceptable []string, headers http.Header) (Response, string, error)
+	}{
+		"http":    NewHTTPClient(1000),
+		"hystrix": NewHystrixHTTPClient(1000, NewHystrixConfig("get_negotiated_command", HystrixCommandConfig{Timeout: 1000})),
+	}
+	for kind, client := range clients {
+		response, contentType, err := client.GetNegotiated(server.URL, []string{"text/csv", "application/json"}, http.Header{})
+		require.NoError(t, err, kind)
+
+		assert.Equal(t, "text/csv", contentType, kind)
+		assert.Equal(t, "id\n1\n", string(response.Body()), kind)
+	}
+}
+
+func TestGetNegotiatedAcceptsWildcards(t *testing.T) {
+	server := negotiatingServer()
+	defer server.Close()
+
+	_, contentType, err := GetNegotiated(NewHTTPClient(1000), server.URL, []string{"image/png", "*/*"}, http.Header{})
+	require.NoError(t, err)
+
+	assert.Equal(t, "text/csv", contentType)
+}
+
+func TestGetNegotiatedMapsNotAcceptable(t *testing.T) {
+	server := negotiatingServer()
+	defer server.Close()
+
+	offered := []string{"image/png", "image/webp"}
+	response, contentType, err := GetNegotiated(NewHTTPClient(1000), server.URL, offered, http.Header{})
+	require.Error(t, err)
+
+	var notAcceptable *ErrNotAcceptable
+	require.True(t, errors.As(err, &notAcceptable))
+	assert.Equal(t, offered, notAcceptable.Offered)
+	assert.Equal(t, http.StatusNotAcceptable, notAcceptable.Response.StatusCode())
+	assert.Equal(t, http.StatusNotAcceptable, response.StatusCode())
+	assert.Equal(t, "", contentType)
+	assert.Equal(t, "not acceptable: server serves none of image/png, image/webp", err.Error())
+}
+
+func TestGetNegotiatedSendsWeightedAccept(t *testing.T) {
+	var accept string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accept = r.Header.Get("Accept")
+	}))
+	defer server.Close()
+
+	headers := http.Header{"Accept": {"text/html"}}
+	_, _, err := GetNegotiated(NewHTTPClient(1000), server.URL, []string{"application/json", "text/csv", "text/*", "*/*"}, headers)
+	require.NoError(t, err)
+
+	assert.Equal(t, "application/json, text/csv;q=0.75, text/*;q=0.5, */*;q=0.25", accept)
+	assert.Equal(t, "text/html", headers.Get("Accept"), "the caller headers should not be modified")
+}
+
+func TestGetNegotiatedRejectsInvalidMediaTypes(t *testing.T) {
+	_, _, err := GetNegotiated(NewHTTPClient(1000), "http://example.com", nil, http.Header{})
+	assert.EqualError(t, err, "no acceptable media types")
+
+	_, _, err = GetNegotiated(NewHTTPClient(1000), "http://example.com", []string{"json"}, http.Header{})
+	assert.EqualError(t, err, `invalid media type "json"`)
+}
+
+func TestResponseContentType(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "Text/HTML; charset=ISO-8859-1")
+	}))
+	defer server.Close()
+
+	response, err := NewHTTPClient(1000).Get(server.URL, http.Header{})
+	require.NoError(t, err)
+
+	assert.Equal(t, "text/html", response.ContentType())
+	assert.Equal(t, "", Response{}.ContentType())
+}
@@ -0,0 +1,120 @@
+package heimdall
+
+import (
+	"context"
+	"io"
+	"net/http"
+)
+
+type noopClient struct {
+	response Response
+	codecs   *codecRegistry
+}
+
+// NewNoopClient returns a Client which never sends requests and instead
+// responds to every call with the canned status and body
+func NewNoopClient(cannedStatus int, cannedBody []byte) Client {
+	return &noopClient{
+		response: Response{
+			statusCode: cannedStatus,
+			body:       cannedBody,
+			hasBody:    expectsBody("", cannedStatus),
+		},
+		codecs: newCodecRegistry(),
+	}
+}
+
+// Derive returns a client answering with the same canned response
+func (nc *noopClient) Derive(opts ...Option) Client {
+	return &noopClient{response: nc.response.clone(), codecs: nc.codecs.clone()}
+}
+
+// With returns a view of nc setting the defaults of opts on every request
+// sent through it
+func (nc *noopClient) With(opts ...RequestOption) Client {
+	return newScopedClient(nc, requestDefaults{}, opts)
+}
+
+// SetRetryCount is a no-op, as no requests are sent
+func (nc *noopClient) SetRetryCount(count int) {}
+
+// SetRetrier is a no-op, as no requests are sent
+func (nc *noopClient) SetRetrier(retrier Retriable) {}
+
+// Stats returns empty stats, as no requests are sent
+func (nc *noopClient) Stats() ClientStats {
+	return ClientStats{SuccessRate: 1}
+}
+
+// RegisterCodec registers codec, so that canned bodies can be decoded
+func (nc *noopClient) RegisterCodec(codec Codec) {
+	nc.codecs.register(codec)
+}
+
+// Codec returns the codec registered for contentType
+func (nc *noopClient) Codec(contentType string) (Codec, error) {
+	return nc.codecs.lookup(contentType)
+}
+
+// Do returns the canned response
+func (nc *noopClient) Do(request *http.Request) (Response, error) {
+	return nc.response, nil
+}
+
+// NewRequest returns a builder for a request answered with the canned response
+func (nc *noopClient) NewRequest(method, template string) *RequestBuilder {
+	return newRequestBuilder(nc, method, template)
+}
+
+// PostAsync discards the request
+func (nc *noopClient) PostAsync(url string, body []byte, headers http.Header) error {
+	return nil
+}
+
+// Flush returns immediately, as nothing is ever queued
+func (nc *noopClient) Flush(ctx context.Context) error {
+	return nil
+}
+
+// Shutdown returns immediately, as no requests are in flight
+func (nc *noopClient) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+// Get returns the canned response
+func (nc *noopClient) Get(url string, headers http.Header) (Response, error) {
+	return nc.response, nil
+}
+
+// Post returns the canned response
+func (nc *noopClient) Post(url string, body io.Reader, headers http.Header) (Response, error) {
+	return nc.response, nil
+}
+
+// Put returns the canned response
+func (nc *noopClient) Put(url string, body io.Reader, headers http.Header) (Response, error) {
+	return nc.response, nil
+}
+
+// Patch returns the canned response
+func (nc *noopClient) Patch(url string, body io.Reader, headers http.Header) (Response, error) {
+	return nc.response, nil
+}
+
+// Delete returns the canned response
+func (nc *noopClient) Delete(url string, headers http.Header) (Response, error) {
+	return nc.response, nil
+}
+
+// Invoke returns the canned response
+func (nc *noopClient) Invoke(method, url string, body io.Reader, headers http.Header) (Response, error) {
+	return nc.response, nil
+}
+
+// GetSSE returns a stream which ends immediately without any events
+func (nc *noopClient) GetSSE(ctx context.Context, url string, headers http.Header) (<-chan Event, func(), error) {
+	events := make(chan Event)
+	close(events)
+
+	return events, func() {}, nil
+}
@@ -0,0 +1,42 @@
+package heimdall
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNoopClientReturnsCannedResponse(t *testing.T) {
+	client := NewNoopClient(http.StatusAccepted, []byte(`{ "response": "canned" }`))
+
+	responses := []func() (Response, error){
+		func() (Response, error) { return client.Get("http://foobar.example", http.Header{}) },
+		func() (Response, error) {
+			return client.Post("http://foobar.example", bytes.NewReader([]byte("x")), http.Header{})
+		},
+		func() (Response, error) { return client.Put("http://foobar.example", nil, http.Header{}) },
+		func() (Response, error) { return client.Patch("http://foobar.example", nil, http.Header{}) },
+		func() (Response, error) { return client.Delete("http://foobar.example", http.Header{}) },
+	}
+
+	for _, call := range responses {
+		response, err := call()
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusAccepted, response.StatusCode())
+		assert.Equal(t, `{ "response": "canned" }`, string(response.Body()))
+	}
+}
+
+func TestNoopClientSSEStreamEndsImmediately(t *testing.T) {
+	events, cancel, err := getSSE(context.Background(), NewNoopClient(http.StatusOK, nil), "http://foobar.example", nil)
+	require.NoError(t, err)
+	defer cancel()
+
+	_, ok := <-events
+	assert.False(t, ok)
+}
@@ -0,0 +1,35 @@
+package heimdall
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ErrCircuitOpen is returned alongside the synthetic response configured with
+// WithOpenCircuitResponse when the hystrix circuit is open
+var ErrCircuitOpen = errors.New("circuit open: request shed")
+
+type openCircuitResponse struct {
+	statusCode int
+	body       []byte
+	retryAfter time.Duration
+}
+
+// response builds the synthetic response returned instead of calling upstream
+func (o *openCircuitResponse) response() Response {
+	headers := http.Header{}
+	if o.retryAfter > 0 {
+		seconds := (o.retryAfter + time.Second - 1) / time.Second
+		headers.Set("Retry-After", strconv.FormatInt(int64(seconds), 10))
+	}
+
+	return Response{
+		statusCode: o.statusCode,
+		body:       append([]byte(nil), o.body...),
+		headers:    headers,
+		hasBody:    true,
+		synthetic:  true,
+	}
+}
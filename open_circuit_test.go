@@ -0,0 +1,101 @@
+package heimdall
+
+import (
+	"errors"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tripCircuit fails a request through client so that its circuit, configured
+// to open on the first failure, is left open
+func tripCircuit(t *testing.T, client Client, url string) {
+	response, err := client.Get(url, http.Header{})
+	require.Error(t, err)
+	require.False(t, response.Synthetic())
+}
+
+func openOnFirstFailure(name string) HystrixConfig {
+	return NewHystrixConfig(name, HystrixCommandConfig{
+		Timeout:                1000,
+		MaxConcurrentRequests:  10,
+		RequestVolumeThreshold: 1,
+		ErrorPercentThreshold:  1,
+		SleepWindow:            60000,
+	})
+}
+
+func TestHystrixHTTPClientReturnsSyntheticResponseWhenCircuitIsOpen(t *testing.T) {
+	prefix := uniqueName("heimdall_open_circuit_test")
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("upstream down"))
+	}))
+	defer server.Close()
+
+	client := NewHystrixHTTPClient(1000, openOnFirstFailure(uniqueName("open_circuit_response_command")),
+		WithOpenCircuitResponse(http.StatusServiceUnavailable, []byte(`{ "error": "shed" }`), 1500*time.Millisecond))
+	client.EnableExpvar(prefix)
+
+	tripCircuit(t, client, server.URL)
+
+	response, err := client.Get(server.URL, http.Header{})
+	require.Error(t, err)
+
+	assert.True(t, errors.Is(err, ErrCircuitOpen))
+	assert.True(t, response.Synthetic())
+	assert.Equal(t, http.StatusServiceUnavailable, response.StatusCode())
+	assert.Equal(t, `{ "error": "shed" }`, string(response.Body()))
+	assert.Equal(t, "2", response.Headers().Get("Retry-After"))
+	assert.Equal(t, 1, calls, "an open circuit should not reach the server")
+
+	assert.Equal(t, "1", expvar.Get(prefix+".errors").String())
+	assert.Equal(t, "1", expvar.Get(prefix+".circuit_open_responses").String())
+}
+
+func TestHystrixHTTPClientOpenCircuitResponseSkipsRetries(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	client := NewHystrixHTTPClient(1000, openOnFirstFailure(uniqueName("open_circuit_retry_command")),
+		WithOpenCircuitResponse(http.StatusServiceUnavailable, nil, 0))
+
+	tripCircuit(t, client, server.URL)
+	client.SetRetryCount(5)
+	client.SetRetrier(NewRetrier(NewConstantBackoff(1000)))
+
+	begin := time.Now()
+	response, err := client.Get(server.URL, http.Header{})
+
+	assert.Equal(t, ErrCircuitOpen, err)
+	assert.True(t, time.Since(begin) < 500*time.Millisecond)
+	assert.Equal(t, "", response.Headers().Get("Retry-After"))
+}
+
+func TestHystrixHTTPClientOpenCircuitIsAnErrorByDefault(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	client := NewHystrixHTTPClient(1000, openOnFirstFailure("open_circuit_default_command"))
+
+	tripCircuit(t, client, server.URL)
+
+	response, err := client.Get(server.URL, http.Header{})
+	require.Error(t, err)
+
+	assert.False(t, errors.Is(err, ErrCircuitOpen))
+	assert.Contains(t, err.Error(), "circuit open")
+	assert.False(t, response.Synthetic())
+	assert.Equal(t, 0, response.StatusCode())
+}
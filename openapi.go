@@ -0,0 +1,350 @@
+package heimdall
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Kinds of ErrOpenAPIViolation
+const (
+	// OpenAPIUnsubstitutedParameter is a path still carrying a template
+	// parameter such as {id}
+	OpenAPIUnsubstitutedParameter = "unsubstituted-parameter"
+	// OpenAPIUnknownOperation is a method and path the spec does not
+	// describe, only reported with WithStrictOpenAPIPaths
+	OpenAPIUnknownOperation = "unknown-operation"
+	// OpenAPIMissingQueryParameter is a required query parameter left out
+	OpenAPIMissingQueryParameter = "missing-query-parameter"
+	// OpenAPIMissingHeader is a required header left out
+	OpenAPIMissingHeader = "missing-header"
+	// OpenAPIMissingBody is a required request body left out
+	OpenAPIMissingBody = "missing-body"
+	// OpenAPIUnsupportedContentType is a body of a content type the
+	// operation does not accept
+	OpenAPIUnsupportedContentType = "unsupported-content-type"
+)
+
+// ErrOpenAPIViolation is returned, before any attempt is sent, for a request
+// that does not match the OpenAPI spec given with WithOpenAPISpec
+type ErrOpenAPIViolation struct {
+	// Kind is what is wrong, such as OpenAPIMissingHeader
+	Kind   string
+	Method string
+	// Path is the path of the request, and Template the templated path of
+	// the spec it matched, empty when it matched none
+	Path     string
+	Template string
+	// Name is the parameter, header or content type at fault
+	Name string
+}
+
+func (e *ErrOpenAPIViolation) Error() string {
+	operation := e.Method + " " + e.Path
+	switch e.Kind {
+	case OpenAPIUnsubstitutedParameter:
+		return fmt.Sprintf("openapi: %s: path parameter %s was not substituted", operation, e.Name)
+	case OpenAPIUnknownOperation:
+		return fmt.Sprintf("openapi: %s: operation is not in the spec", operation)
+	case OpenAPIMissingQueryParameter:
+		return fmt.Sprintf("openapi: %s: missing required query parameter %q of %s", operation, e.Name, e.Template)
+	case OpenAPIMissingHeader:
+		return fmt.Sprintf("openapi: %s: missing required header %q of %s", operation, e.Name, e.Template)
+	case OpenAPIMissingBody:
+		return fmt.Sprintf("openapi: %s: missing required body of %s", operation, e.Template)
+	}
+
+	return fmt.Sprintf("openapi: %s: content type %q is not accepted by %s", operation, e.Name, e.Template)
+}
+
+// WithOpenAPISpec validates requests against doc, an OpenAPI 3 document in
+// its JSON form, before sending them: the method and path must match an
+// operation of the spec, with every path parameter substituted, the required
+// query parameters and headers present, and a body, when the operation takes
+// one, of a content type it accepts. Violations fail the request with an
+// *ErrOpenAPIViolation without touching the network. Requests to paths the
+// spec does not describe are let through unless WithStrictOpenAPIPaths is
+// given. Validation runs before request mutators and middlewares, so the
+// headers they add do not count. A doc that does not parse fails every
+// request with the parse error.
+func WithOpenAPISpec(doc []byte) Option {
+	return func(options *clientOptions) {
+		options.openAPI = parseOpenAPISpec(doc)
+	}
+}
+
+// WithStrictOpenAPIPaths rejects the requests to operations the spec given
+// with WithOpenAPISpec does not describe
+func WithStrictOpenAPIPaths() Option {
+	return func(options *clientOptions) {
+		options.openAPIStrict = true
+	}
+}
+
+// openAPISpec is the part of an OpenAPI document requests are checked
+// against
+type openAPISpec struct {
+	err        error
+	prefixes   []string
+	operations []openAPIPath
+}
+
+// openAPIPath is a templated path of the spec with its operations by method
+type openAPIPath struct {
+	template   string
+	pattern    *regexp.Regexp
+	literals   int
+	operations map[string]openAPIOperation
+}
+
+type openAPIOperation struct {
+	parameters  []openAPIParameter
+	body        bool
+	contentType []string
+}
+
+type openAPIParameter struct {
+	Ref      string `json:"$ref"`
+	Name     string `json:"name"`
+	In       string `json:"in"`
+	Required bool   `json:"required"`
+}
+
+type openAPIRequestBody struct {
+	Ref      string                     `json:"$ref"`
+	Required bool                       `json:"required"`
+	Content  map[string]json.RawMessage `json:"content"`
+}
+
+type openAPIDocument struct {
+	Servers []struct {
+		URL string `json:"url"`
+	} `json:"servers"`
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Parameters    map[string]openAPIParameter   `json:"parameters"`
+		RequestBodies map[string]openAPIRequestBody `json:"requestBodies"`
+	} `json:"components"`
+}
+
+var openAPIMethods = map[string]string{
+	"get": http.MethodGet, "put": http.MethodPut, "post": http.MethodPost, "delete": http.MethodDelete,
+	"options": http.MethodOptions, "head": http.MethodHead, "patch": http.MethodPatch, "trace": http.MethodTrace,
+}
+
+var templateParameter = regexp.MustCompile(`\{[^{}/]+\}`)
+
+// parseOpenAPISpec reads doc, recording the error when it does not parse
+func parseOpenAPISpec(doc []byte) *openAPISpec {
+	var document openAPIDocument
+	if err := json.Unmarshal(doc, &document); err != nil {
+		return &openAPISpec{err: errors.Wrap(err, "invalid OpenAPI spec")}
+	}
+
+	spec := &openAPISpec{}
+	for _, server := range document.Servers {
+		if u, err := url.Parse(server.URL); err == nil && strings.TrimSuffix(u.Path, "/") != "" {
+			spec.prefixes = append(spec.prefixes, strings.TrimSuffix(u.Path, "/"))
+		}
+	}
+
+	for template, item := range document.Paths {
+		path := openAPIPath{template: template, operations: map[string]openAPIOperation{}}
+		path.pattern = regexp.MustCompile("^" + templatePattern(template) + "$")
+		path.literals = len(templateParameter.ReplaceAllString(template, ""))
+
+		var shared []openAPIParameter
+		if raw, ok := item["parameters"]; ok {
+			if err := json.Unmarshal(raw, &shared); err != nil {
+				return &openAPISpec{err: errors.Wrapf(err, "invalid OpenAPI spec: parameters of %s", template)}
+			}
+		}
+
+		for key, raw := range item {
+			method, ok := openAPIMethods[key]
+			if !ok {
+				continue
+			}
+
+			var operation struct {
+				Parameters  []openAPIParameter  `json:"parameters"`
+				RequestBody *openAPIRequestBody `json:"requestBody"`
+			}
+			if err := json.Unmarshal(raw, &operation); err != nil {
+				return &openAPISpec{err: errors.Wrapf(err, "invalid OpenAPI spec: %s %s", method, template)}
+			}
+			path.operations[method] = document.operation(append(append([]openAPIParameter(nil), shared...), operation.Parameters...), operation.RequestBody)
+		}
+		spec.operations = append(spec.operations, path)
+	}
+
+	// Concrete paths match before templated ones, as the spec requires
+	sort.Slice(spec.operations, func(i, j int) bool {
+		if spec.operations[i].literals != spec.operations[j].literals {
+			return spec.operations[i].literals > spec.operations[j].literals
+		}
+		return spec.operations[i].template < spec.operations[j].template
+	})
+
+	return spec
+}
+
+// operation resolves the references of an operation taking parameters and
+// body
+func (document openAPIDocument) operation(parameters []openAPIParameter, body *openAPIRequestBody) openAPIOperation {
+	var operation openAPIOperation
+	for _, parameter := range parameters {
+		if parameter.Ref != "" {
+			parameter = document.Components.Parameters[strings.TrimPrefix(parameter.Ref, "#/components/parameters/")]
+		}
+		operation.parameters = append(operation.parameters, parameter)
+	}
+
+	if body != nil && body.Ref != "" {
+		resolved := document.Components.RequestBodies[strings.TrimPrefix(body.Ref, "#/components/requestBodies/")]
+		body = &resolved
+	}
+	if body != nil {
+		operation.body = body.Required
+		for contentType := range body.Content {
+			operation.contentType = append(operation.contentType, strings.ToLower(contentType))
+		}
+	}
+
+	return operation
+}
+
+// templatePattern turns a templated path into a regular expression matching
+// each parameter to a non-empty path segment or part of one
+func templatePattern(template string) string {
+	var pattern strings.Builder
+	last := 0
+	for _, match := range templateParameter.FindAllStringIndex(template, -1) {
+		pattern.WriteString(regexp.QuoteMeta(template[last:match[0]]))
+		pattern.WriteString("[^/]+")
+		last = match[1]
+	}
+	pattern.WriteString(regexp.QuoteMeta(template[last:]))
+
+	return pattern.String()
+}
+
+// validate checks request against the spec, nil when there is none
+func (spec *openAPISpec) validate(request *http.Request, strict bool) error {
+	if spec == nil {
+		return nil
+	}
+	if spec.err != nil {
+		return spec.err
+	}
+
+	violation := &ErrOpenAPIViolation{Method: request.Method, Path: request.URL.Path}
+	if violation.Method == "" {
+		violation.Method = http.MethodGet
+	}
+	if name := templateParameter.FindString(request.URL.Path); name != "" {
+		violation.Kind, violation.Name = OpenAPIUnsubstitutedParameter, name
+		return violation
+	}
+
+	path, operation, found := spec.match(violation.Method, request.URL.Path)
+	if !found {
+		if strict {
+			violation.Kind = OpenAPIUnknownOperation
+			return violation
+		}
+		return nil
+	}
+	violation.Template = path
+
+	query := request.URL.Query()
+	for _, parameter := range operation.parameters {
+		if !parameter.Required {
+			continue
+		}
+
+		switch {
+		case parameter.In == "query" && len(query[parameter.Name]) == 0:
+			violation.Kind, violation.Name = OpenAPIMissingQueryParameter, parameter.Name
+			return violation
+		case parameter.In == "header" && !openAPIIgnoredHeader(parameter.Name) && request.Header.Get(parameter.Name) == "":
+			violation.Kind, violation.Name = OpenAPIMissingHeader, parameter.Name
+			return violation
+		}
+	}
+
+	hasBody := request.ContentLength > 0 || request.Body != nil && request.Body != http.NoBody
+	if !hasBody {
+		if operation.body {
+			violation.Kind = OpenAPIMissingBody
+			return violation
+		}
+		return nil
+	}
+
+	if len(operation.contentType) > 0 {
+		contentType := mediaType(request.Header.Get("Content-Type"))
+		if !acceptsContentType(operation.contentType, contentType) {
+			violation.Kind, violation.Name = OpenAPIUnsupportedContentType, contentType
+			return violation
+		}
+	}
+
+	return nil
+}
+
+// match returns the operation of the spec for method and path, trying path
+// with and without the path of each server
+func (spec *openAPISpec) match(method, requestPath string) (string, openAPIOperation, bool) {
+	paths := []string{requestPath}
+	for _, prefix := range spec.prefixes {
+		if strings.HasPrefix(requestPath, prefix+"/") {
+			paths = append(paths, strings.TrimPrefix(requestPath, prefix))
+		}
+	}
+
+	for _, path := range spec.operations {
+		for _, candidate := range paths {
+			if !path.pattern.MatchString(candidate) {
+				continue
+			}
+			if operation, ok := path.operations[method]; ok {
+				return path.template, operation, true
+			}
+		}
+	}
+
+	return "", openAPIOperation{}, false
+}
+
+// openAPIIgnoredHeader reports whether OpenAPI ignores header parameters
+// named name, which are described elsewhere in the spec
+func openAPIIgnoredHeader(name string) bool {
+	switch http.CanonicalHeaderKey(name) {
+	case "Accept", "Content-Type", "Authorization":
+		return true
+	}
+
+	return false
+}
+
+// acceptsContentType matches contentType against the media type ranges of an
+// operation, such as "application/json" or "image/*"
+func acceptsContentType(accepted []string, contentType string) bool {
+	for _, candidate := range accepted {
+		switch {
+		case candidate == "*/*", candidate == contentType:
+			return true
+		case strings.HasSuffix(candidate, "/*") && strings.HasPrefix(contentType, strings.TrimSuffix(candidate, "*")):
+			return true
+		}
+	}
+
+	return false
+}
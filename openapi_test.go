@@ -0,0 +1,161 @@
+package heimdall
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func shopSpec(t *testing.T) []byte {
+	doc, err := ioutil.ReadFile("testdata/openapi/shop.json")
+	require.NoError(t, err)
+
+	return doc
+}
+
+func TestClientsRejectRequestsViolatingTheOpenAPISpec(t *testing.T) {
+	clients := map[string]func(opts ...Option) testClient{
+		"http": func(opts ...Option) testClient {
+			return NewHTTPClient(1000, opts...)
+		},
+		"hystrix": func(opts ...Option) testClient {
+			return NewHystrixHTTPClient(1000, NewHystrixConfig("openapi_command", HystrixCommandConfig{Timeout: 1000}), opts...)
+		},
+	}
+	for kind, newClient := range clients {
+		t.Run(kind, func(t *testing.T) {
+			var calls int32
+			server := countingServer(&calls)
+			defer server.Close()
+
+			client := newClient(WithOpenAPISpec(shopSpec(t)))
+			client.SetBaseURL(server.URL + "/v1")
+
+			_, err := client.Get("/users/{id}", http.Header{"X-Tenant": {"acme"}})
+
+			var violation *ErrOpenAPIViolation
+			require.True(t, errors.As(err, &violation), "%v", err)
+			assert.Equal(t, OpenAPIUnsubstitutedParameter, violation.Kind)
+			assert.Equal(t, "{id}", violation.Name)
+			assert.Equal(t, int32(0), atomic.LoadInt32(&calls), "violations never reach the network")
+
+			_, err = client.Get("/users/42", http.Header{"X-Tenant": {"acme"}})
+			require.NoError(t, err)
+			assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+		})
+	}
+}
+
+func TestOpenAPIViolations(t *testing.T) {
+	var calls int32
+	server := countingServer(&calls)
+	defer server.Close()
+
+	client := NewHTTPClient(1000, WithOpenAPISpec(shopSpec(t)))
+	client.SetBaseURL(server.URL + "/v1")
+
+	json := http.Header{"Content-Type": {"application/json"}}
+	cases := []struct {
+		name     string
+		send     func() (Response, error)
+		kind     string
+		template string
+		field    string
+	}{
+		{"leftover segment", func() (Response, error) {
+			return client.Put("/orders/{orderId}/attachments", strings.NewReader("%PDF"), http.Header{"Content-Type": {"application/pdf"}})
+		}, OpenAPIUnsubstitutedParameter, "", "{orderId}"},
+		{"missing header", func() (Response, error) {
+			return client.Get("/users/42", http.Header{})
+		}, OpenAPIMissingHeader, "/users/{id}", "X-Tenant"},
+		{"missing query", func() (Response, error) {
+			return client.Get("/orders?page=2", http.Header{})
+		}, OpenAPIMissingQueryParameter, "/orders", "status"},
+		{"missing body", func() (Response, error) {
+			return client.Post("/orders", nil, json)
+		}, OpenAPIMissingBody, "/orders", ""},
+		{"wrong content type", func() (Response, error) {
+			return client.Post("/orders", strings.NewReader("id=1"), http.Header{"Content-Type": {"application/x-www-form-urlencoded"}})
+		}, OpenAPIUnsupportedContentType, "/orders", "application/x-www-form-urlencoded"},
+		{"content type outside a range", func() (Response, error) {
+			return client.Put("/orders/7/attachments", strings.NewReader("plain"), http.Header{"Content-Type": {"text/plain"}})
+		}, OpenAPIUnsupportedContentType, "/orders/{id}/attachments", "text/plain"},
+	}
+	for _, c := range cases {
+		_, err := c.send()
+
+		var violation *ErrOpenAPIViolation
+		require.True(t, errors.As(err, &violation), "%s: %v", c.name, err)
+		assert.Equal(t, c.kind, violation.Kind, c.name)
+		assert.Equal(t, c.template, violation.Template, c.name)
+		assert.Equal(t, c.field, violation.Name, c.name)
+		assert.Contains(t, err.Error(), "openapi: ", c.name)
+	}
+	assert.Equal(t, int32(0), atomic.LoadInt32(&calls))
+
+	valid := []func() (Response, error){
+		func() (Response, error) { return client.Get("/users/me", http.Header{}) },
+		func() (Response, error) { return client.Get("/orders?status=open", http.Header{}) },
+		func() (Response, error) { return client.Post("/orders", strings.NewReader(`{"id":1}`), json) },
+		func() (Response, error) {
+			return client.Put("/orders/7/attachments", strings.NewReader("png"), http.Header{"Content-Type": {"image/png"}})
+		},
+		func() (Response, error) { return client.Delete("/carts/1", http.Header{}) },
+	}
+	for i, send := range valid {
+		_, err := send()
+		assert.NoError(t, err, "valid request %d", i)
+	}
+	assert.Equal(t, int32(len(valid)), atomic.LoadInt32(&calls))
+}
+
+func TestStrictOpenAPIPathsRejectUnknownOperations(t *testing.T) {
+	var calls int32
+	server := countingServer(&calls)
+	defer server.Close()
+
+	client := NewHTTPClient(1000, WithStrictOpenAPIPaths(), WithOpenAPISpec(shopSpec(t)))
+	client.SetBaseURL(server.URL + "/v1")
+
+	for _, send := range []func() (Response, error){
+		func() (Response, error) { return client.Get("/carts/1", http.Header{}) },
+		func() (Response, error) { return client.Delete("/users/me", http.Header{}) },
+	} {
+		_, err := send()
+
+		var violation *ErrOpenAPIViolation
+		require.True(t, errors.As(err, &violation), "%v", err)
+		assert.Equal(t, OpenAPIUnknownOperation, violation.Kind)
+	}
+	assert.Equal(t, int32(0), atomic.LoadInt32(&calls))
+}
+
+func TestInvalidOpenAPISpecFailsRequests(t *testing.T) {
+	var calls int32
+	server := countingServer(&calls)
+	defer server.Close()
+
+	_, err := NewHTTPClient(1000, WithOpenAPISpec([]byte("openapi: 3.0.3"))).Get(server.URL, http.Header{})
+
+	assert.Contains(t, err.Error(), "invalid OpenAPI spec")
+	assert.Equal(t, int32(0), atomic.LoadInt32(&calls))
+}
+
+func TestOpenAPIConcretePathsMatchFirst(t *testing.T) {
+	spec := parseOpenAPISpec(shopSpec(t))
+	require.NoError(t, spec.err)
+
+	template, _, found := spec.match(http.MethodGet, "/v1/users/me")
+	assert.True(t, found)
+	assert.Equal(t, "/users/me", template)
+
+	template, _, found = spec.match(http.MethodGet, "/users/7")
+	assert.True(t, found)
+	assert.Equal(t, "/users/{id}", template)
+}
@@ -0,0 +1,242 @@
+package heimdall
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// Option configures optional behaviour of a client when it is constructed
+type Option func(*clientOptions)
+
+type clientOptions struct {
+	charsetDecoding bool
+	spooling        *bodySpooling
+	keepAlive       bool
+	flights         *flightGroup
+	asyncQueueSize  int
+	asyncWorkers    int
+	openCircuit     *openCircuitResponse
+	clock           Clock
+	hystrixConfig   *HystrixConfig
+	failures        *FailureDetector
+	retryBudget     *RetryBudget
+	timeout         time.Duration
+	expectContinue  time.Duration
+	fallbackDelay   time.Duration
+	network         string
+	resolver        *net.Resolver
+	connectTimeout  time.Duration
+	tls             *tlsInspector
+	concurrency     *concurrencyLimiter
+	queue           *concurrencyQueue
+	proxy           tunnelProxy
+	rateLimits      *rateLimitCooldown
+	informational   func(status int, headers http.Header)
+	phaseTimings    bool
+	slowRedactQuery bool
+	name            string
+	autoRegister    bool
+	pool            *connectionPool
+
+	maxResponseHeaderBytes int64
+	retryMalformed         bool
+	apdex                  time.Duration
+	hedging                *hedging
+	sentRequests           bool
+	openAPI                *openAPISpec
+	openAPIStrict          bool
+	faults                 *faultInjector
+	responseSchemas        responseSchemas
+	deadline               *deadlinePropagation
+	breakerStateMaxAge     time.Duration
+	http2Downgrade         *http2Downgrade
+	balancer               *loadBalancer
+	bodyBudgetWait         time.Duration
+	decisions              *decisionLog
+	dedup                  *dedupGroup
+	hostOverride           string
+	tlsServerName          string
+	sseMaxLineSize         int
+}
+
+func newClientOptions(opts []Option) clientOptions {
+	options := clientOptions{
+		clock: realClock{},
+		pool:  &connectionPool{},
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	return options
+}
+
+// derive returns a copy of options for a derived client, with opts applied.
+// The derived client gets a singleflight group and deduplication keys of its
+// own.
+func (options clientOptions) derive(opts []Option) clientOptions {
+	if options.flights != nil {
+		options.flights = newFlightGroup(options.flights.varyHeaders)
+	}
+	if options.dedup != nil {
+		options.dedup = options.dedup.fresh()
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	return options
+}
+
+// httpTimeout returns the timeout set with WithTimeout, or fallback
+func (options clientOptions) httpTimeout(fallback time.Duration) time.Duration {
+	if options.timeout > 0 {
+		return options.timeout
+	}
+
+	return fallback
+}
+
+// WithCharsetDecoding transcodes response bodies declaring a non UTF-8
+// charset in their Content-Type to UTF-8
+func WithCharsetDecoding() Option {
+	return func(options *clientOptions) {
+		options.charsetDecoding = true
+	}
+}
+
+// WithKeepAlive lets requests reuse pooled connections. By default every
+// request asks for its connection to be closed once it completes.
+func WithKeepAlive() Option {
+	return func(options *clientOptions) {
+		options.keepAlive = true
+	}
+}
+
+// WithSingleflight coalesces concurrent GET and HEAD requests for the same URL
+// into one network call whose response is shared by every caller. Requests
+// are only coalesced when the given headers, Authorization and Accept by
+// default, match as well. Waiting callers share the outcome of the first
+// request, including its error, whatever their own request context.
+func WithSingleflight(varyHeaders ...string) Option {
+	return func(options *clientOptions) {
+		options.flights = newFlightGroup(varyHeaders)
+	}
+}
+
+// WithAsyncQueue sets how many PostAsync jobs may wait to be sent and how
+// many workers send them, 1024 and 4 by default
+func WithAsyncQueue(size, workers int) Option {
+	return func(options *clientOptions) {
+		options.asyncQueueSize = size
+		options.asyncWorkers = workers
+	}
+}
+
+// WithOpenCircuitResponse makes the hystrix client answer with a synthetic
+// response, such as a 503 with a Retry-After header, and ErrCircuitOpen
+// instead of a plain error while its circuit is open. The response is flagged
+// as Synthetic. It has no effect on clients without a circuit breaker.
+func WithOpenCircuitResponse(statusCode int, body []byte, retryAfter time.Duration) Option {
+	return func(options *clientOptions) {
+		options.openCircuit = &openCircuitResponse{
+			statusCode: statusCode,
+			body:       body,
+			retryAfter: retryAfter,
+		}
+	}
+}
+
+// WithClock replaces the time source used for backoff sleeps, latency
+// measurement and reconnect timers. Hystrix command timeouts always use
+// the real clock.
+func WithClock(clock Clock) Option {
+	return func(options *clientOptions) {
+		options.clock = clock
+	}
+}
+
+// WithHystrixConfig runs the requests of a hystrix client under another
+// command, typically one per tenant for clients made with Derive. It has no
+// effect on clients without a circuit breaker.
+func WithHystrixConfig(config HystrixConfig) Option {
+	return func(options *clientOptions) {
+		options.hystrixConfig = &config
+	}
+}
+
+// WithFailureDetector reports the outcome of every attempt to detector: a
+// transport error, a body read failure or a 5xx counts as a failure. Attempts
+// rejected by hystrix never reached the server and are not counted. Clients
+// made with Derive report to the same detector unless given another one.
+func WithFailureDetector(detector *FailureDetector) Option {
+	return func(options *clientOptions) {
+		options.failures = detector
+	}
+}
+
+// WithTimeout replaces the timeout of each attempt given to the constructor,
+// typically to derive a client for slow endpoints from one with a short
+// timeout. The hystrix command timeout is configured separately.
+func WithTimeout(timeout time.Duration) Option {
+	return func(options *clientOptions) {
+		options.timeout = timeout
+	}
+}
+
+// WithExpectContinue sends requests with a body with an Expect: 100-continue
+// header, so that the body is only sent once the server agrees to it. A
+// server rejecting the request early, say with a 401, answers with its final
+// status without the body being sent, and the response is returned as usual.
+// Without an answer within timeout, the body is sent anyway. The timeout is
+// a setting of the transport, so clients made with Derive keep that of the
+// client they derive from.
+func WithExpectContinue(timeout time.Duration) Option {
+	return func(options *clientOptions) {
+		options.expectContinue = timeout
+	}
+}
+
+// WithFallbackDelay sets how long a connection attempt to the first address
+// family of a dual-stack host, usually IPv6, may take before the other family
+// is tried in parallel, as described by RFC 6555. It is 300ms by default and
+// a negative delay disables the fallback. Dialer settings belong to the
+// transport, so clients made with Derive keep those of the client they derive
+// from, as for all the dialer options below.
+func WithFallbackDelay(delay time.Duration) Option {
+	return func(options *clientOptions) {
+		options.fallbackDelay = delay
+	}
+}
+
+// WithIPv4Only only connects to the IPv4 addresses of hosts
+func WithIPv4Only() Option {
+	return func(options *clientOptions) {
+		options.network = "tcp4"
+	}
+}
+
+// WithIPv6Only only connects to the IPv6 addresses of hosts
+func WithIPv6Only() Option {
+	return func(options *clientOptions) {
+		options.network = "tcp6"
+	}
+}
+
+// WithResolver resolves host names with resolver instead of the default one,
+// for instance to use a caching resolver or a particular DNS server
+func WithResolver(resolver *net.Resolver) Option {
+	return func(options *clientOptions) {
+		options.resolver = resolver
+	}
+}
+
+// WithConnectTimeout limits how long establishing a connection may take, 30
+// seconds by default. Attempts that fail to connect in time fail with an
+// error matching ErrConnect.
+func WithConnectTimeout(timeout time.Duration) Option {
+	return func(options *clientOptions) {
+		options.connectTimeout = timeout
+	}
+}
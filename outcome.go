@@ -0,0 +1,154 @@
+package heimdall
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/afex/hystrix-go/hystrix"
+)
+
+// Outcomes of requests, as Stats and expvar split request counts and
+// latencies by them
+const (
+	// OutcomeSuccess is a request the client returned without an error,
+	// whatever its status below 400
+	OutcomeSuccess = "success"
+	// OutcomeClientError is a request answered with a 4xx status, or held
+	// back by a rate limit cooldown or a tenant quota
+	OutcomeClientError = "client-error"
+	// OutcomeServerError is a request failed by a 5xx status, or by the
+	// failure classifier on a response that looked healthy
+	OutcomeServerError = "server-error"
+	// OutcomeTransportError is a request that got no response
+	OutcomeTransportError = "transport-error"
+	// OutcomeCircuitOpen is a request shed by an open circuit, or rejected by
+	// hystrix or the adaptive concurrency limit, without being sent
+	OutcomeCircuitOpen = "circuit-open"
+	// OutcomeCancelled is a request whose context was done before it could
+	// complete
+	OutcomeCancelled = "cancelled"
+)
+
+// Indexes of the outcomes in outcomes and the counters of clientStats
+const (
+	outcomeSuccess = iota
+	outcomeClientError
+	outcomeServerError
+	outcomeTransportError
+	outcomeCircuitOpen
+	outcomeCancelled
+)
+
+var outcomes = [...]string{OutcomeSuccess, OutcomeClientError, OutcomeServerError, OutcomeTransportError, OutcomeCircuitOpen, OutcomeCancelled}
+
+// requestOutcome classifies the result of a request. Errors decide over the
+// status, so that a 200 failed by the failure classifier is no success.
+func requestOutcome(response Response, err error) int {
+	if err != nil {
+		return failedOutcome(response, err)
+	}
+	switch {
+	case response.statusCode >= http.StatusInternalServerError:
+		return outcomeServerError
+	case response.statusCode >= http.StatusBadRequest:
+		return outcomeClientError
+	}
+
+	return outcomeSuccess
+}
+
+// failedOutcome classifies a request that failed with err, kept apart from
+// requestOutcome so that successful requests do not pay for errors.As
+func failedOutcome(response Response, err error) int {
+	var done *ErrContextDone
+	var rejected *ErrHystrixRejected
+	var limited *ErrRateLimited
+	var quota *ErrTenantQuotaExceeded
+	var budget *ErrBodyBudgetExceeded
+	switch {
+	case errors.As(err, &done), errors.Is(err, context.Canceled):
+		return outcomeCancelled
+	case errors.Is(err, ErrCircuitOpen), errors.As(err, &rejected), errors.Is(err, hystrix.ErrCircuitOpen), errors.Is(err, hystrix.ErrMaxConcurrency):
+		return outcomeCircuitOpen
+	case errors.As(err, &limited), errors.As(err, &quota), errors.As(err, &budget), response.statusCode >= http.StatusBadRequest && response.statusCode < http.StatusInternalServerError:
+		return outcomeClientError
+	case response.statusCode != 0:
+		return outcomeServerError
+	}
+
+	return outcomeTransportError
+}
+
+// WithApdex scores requests against target as Apdex does: requests taking at
+// most target are satisfied, those taking at most four times target are
+// tolerating, and slower or failed ones are frustrated. The counts and score
+// are reported in ClientStats.Apdex and published through expvar.
+func WithApdex(target time.Duration) Option {
+	return func(options *clientOptions) {
+		options.apdex = target
+	}
+}
+
+// ApdexStats are the Apdex counts of the requests a client made
+type ApdexStats struct {
+	Target     Duration `json:"target"`
+	Satisfied  int64    `json:"satisfied"`
+	Tolerating int64    `json:"tolerating"`
+	Frustrated int64    `json:"frustrated"`
+	// Score is satisfied plus half the tolerating requests, over all of them,
+	// 1 before any request completed
+	Score float64 `json:"score"`
+}
+
+// Apdex zones, indexing the counters of apdexCounts
+const (
+	apdexSatisfied = iota
+	apdexTolerating
+	apdexFrustrated
+)
+
+var apdexZones = [...]string{"satisfied", "tolerating", "frustrated"}
+
+// apdexZone returns the zone of a request that took elapsed and failed with
+// err, scored against target
+func apdexZone(target, elapsed time.Duration, err error) int {
+	switch {
+	case err != nil || elapsed > 4*target:
+		return apdexFrustrated
+	case elapsed > target:
+		return apdexTolerating
+	}
+
+	return apdexSatisfied
+}
+
+// apdexCounts are the counters behind ApdexStats, updated atomically
+type apdexCounts [3]int64
+
+func (c *apdexCounts) observe(target, elapsed time.Duration, err error) {
+	atomic.AddInt64(&c[apdexZone(target, elapsed, err)], 1)
+}
+
+func (c *apdexCounts) reset() {
+	for i := range c {
+		atomic.StoreInt64(&c[i], 0)
+	}
+}
+
+func (c *apdexCounts) snapshot(target time.Duration) *ApdexStats {
+	stats := &ApdexStats{
+		Target:     Duration(target),
+		Satisfied:  atomic.LoadInt64(&c[apdexSatisfied]),
+		Tolerating: atomic.LoadInt64(&c[apdexTolerating]),
+		Frustrated: atomic.LoadInt64(&c[apdexFrustrated]),
+		Score:      1,
+	}
+	if total := stats.Satisfied + stats.Tolerating + stats.Frustrated; total > 0 {
+		stats.Score = (float64(stats.Satisfied) + float64(stats.Tolerating)/2) / float64(total)
+	}
+
+	return stats
+}
@@ -0,0 +1,160 @@
+package heimdall
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/afex/hystrix-go/hystrix"
+	"github.com/gojektech/heimdall/fakeclock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// outcomeServer answers /missing with a 404 and /down with a 503, taking a
+// second of clock for /slow and three for /slower
+func outcomeServer(clock *fakeclock.Clock) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			clock.Advance(time.Second)
+		case "/slower":
+			clock.Advance(3 * time.Second)
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case "/down":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+}
+
+func TestClientsSplitRequestsByOutcome(t *testing.T) {
+	clients := map[string]func(clock Clock) testClient{
+		"http": func(clock Clock) testClient {
+			return NewHTTPClient(1000, WithClock(clock), WithApdex(500*time.Millisecond))
+		},
+		"hystrix": func(clock Clock) testClient {
+			return NewHystrixHTTPClient(1000, NewHystrixConfig(uniqueName("outcome_split_command"), HystrixCommandConfig{
+				Timeout:                1000,
+				MaxConcurrentRequests:  10,
+				RequestVolumeThreshold: 1000,
+			}), WithClock(clock), WithApdex(500*time.Millisecond))
+		},
+	}
+	for kind, newClient := range clients {
+		t.Run(kind, func(t *testing.T) {
+			clock := fakeclock.New(time.Date(2018, time.January, 19, 22, 0, 0, 0, time.UTC))
+			server := outcomeServer(clock)
+			defer server.Close()
+			closed := httptest.NewServer(http.NotFoundHandler())
+			closed.Close()
+
+			client := newClient(clock)
+			prefix := uniqueName("heimdall_outcome_test_" + kind)
+			client.EnableExpvar(prefix)
+
+			for _, path := range []string{"/ok", "/slow", "/slower", "/missing", "/down"} {
+				client.Get(server.URL+path, http.Header{})
+			}
+			client.Get(closed.URL, http.Header{})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			request, err := http.NewRequest(http.MethodGet, server.URL+"/ok", nil)
+			require.NoError(t, err)
+			client.Do(request.WithContext(ctx))
+
+			stats := client.Stats()
+			assert.Equal(t, map[string]int64{
+				OutcomeSuccess:        3,
+				OutcomeClientError:    1,
+				OutcomeServerError:    1,
+				OutcomeTransportError: 1,
+				OutcomeCancelled:      1,
+			}, stats.Outcomes)
+			assert.Equal(t, &ApdexStats{
+				Target:     Duration(500 * time.Millisecond),
+				Satisfied:  2,
+				Tolerating: 1,
+				Frustrated: 4,
+				Score:      2.5 / 7,
+			}, stats.Apdex)
+
+			assert.Equal(t, "3", expvar.Get(prefix+".outcomes").(*expvar.Map).Get(OutcomeSuccess).String())
+			assert.Equal(t, "1", expvar.Get(prefix+".outcomes").(*expvar.Map).Get(OutcomeTransportError).String())
+
+			latencies := expvar.Get(prefix + ".latency_ms_by_outcome").(*expvar.Map)
+			success := latencies.Get(OutcomeSuccess).(*expvar.Map)
+			assert.Equal(t, "1", success.Get("le_1000").String())
+			assert.Equal(t, "1", success.Get("le_5000").String())
+			assert.Equal(t, "{}", latencies.Get(OutcomeCircuitOpen).String())
+
+			apdex := expvar.Get(prefix + ".apdex").(*expvar.Map)
+			assert.Equal(t, "2", apdex.Get("satisfied").String())
+			assert.Equal(t, "1", apdex.Get("tolerating").String())
+			assert.Equal(t, "4", apdex.Get("frustrated").String())
+
+			client.ResetStats()
+			assert.Nil(t, client.Stats().Outcomes)
+			assert.Equal(t, 1.0, client.Stats().Apdex.Score)
+		})
+	}
+}
+
+func TestHystrixClientCountsOpenCircuitOutcomes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	client := NewHystrixHTTPClient(1000, NewHystrixConfig(uniqueName("outcome_circuit_command"), HystrixCommandConfig{
+		Timeout:                1000,
+		MaxConcurrentRequests:  10,
+		RequestVolumeThreshold: 3,
+		ErrorPercentThreshold:  50,
+		SleepWindow:            60000,
+	}))
+	for i := 0; i < 4; i++ {
+		client.Get(server.URL, http.Header{})
+	}
+
+	assert.Equal(t, map[string]int64{OutcomeServerError: 3, OutcomeCircuitOpen: 1}, client.Stats().Outcomes)
+	assert.Nil(t, client.Stats().Apdex, "apdex is only scored with WithApdex")
+}
+
+func TestRequestOutcome(t *testing.T) {
+	cases := []struct {
+		name     string
+		response Response
+		err      error
+		outcome  string
+	}{
+		{"ok", Response{statusCode: http.StatusOK}, nil, OutcomeSuccess},
+		{"redirect", Response{statusCode: http.StatusNotModified}, nil, OutcomeSuccess},
+		{"not found", Response{statusCode: http.StatusNotFound}, nil, OutcomeClientError},
+		{"rate limited", Response{}, &ErrRateLimited{}, OutcomeClientError},
+		{"server error", Response{statusCode: http.StatusBadGateway}, errors.New("server error"), OutcomeServerError},
+		{"classified failure", Response{statusCode: http.StatusOK}, errors.New("empty body"), OutcomeServerError},
+		{"transport", Response{}, errors.New("connection refused"), OutcomeTransportError},
+		{"shed", Response{statusCode: http.StatusServiceUnavailable}, ErrCircuitOpen, OutcomeCircuitOpen},
+		{"hystrix", Response{}, hystrix.ErrCircuitOpen, OutcomeCircuitOpen},
+		{"cancelled", Response{}, context.Canceled, OutcomeCancelled},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.outcome, outcomes[requestOutcome(c.response, c.err)], c.name)
+	}
+}
+
+func TestApdexZone(t *testing.T) {
+	target := 100 * time.Millisecond
+
+	assert.Equal(t, apdexSatisfied, apdexZone(target, target, nil))
+	assert.Equal(t, apdexTolerating, apdexZone(target, target+1, nil))
+	assert.Equal(t, apdexTolerating, apdexZone(target, 4*target, nil))
+	assert.Equal(t, apdexFrustrated, apdexZone(target, 4*target+1, nil))
+	assert.Equal(t, apdexFrustrated, apdexZone(target, 0, errors.New("failed")))
+}
@@ -0,0 +1,297 @@
+package heimdall
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// PageOption configures how Paginate finds the next page
+type PageOption func(*PageIterator)
+
+// WithCursorField follows a cursor found in the JSON body of each page at
+// path, dot separated as in "meta.next_cursor", by requesting the first URL
+// again with the cursor as the param query parameter. Iteration ends on a
+// page whose cursor is missing, null or empty. Without it, pages are
+// followed through their Link rel="next" header.
+func WithCursorField(path, param string) PageOption {
+	return func(it *PageIterator) {
+		it.next = cursorNext(strings.Split(path, "."), param)
+	}
+}
+
+// WithMaxPages stops iteration after max pages, with Err returning an
+// *ErrMaxPagesReached if another page was advertised
+func WithMaxPages(max int) PageOption {
+	return func(it *PageIterator) {
+		it.maxPages = max
+	}
+}
+
+// WithPageHeaders sends headers with every page request
+func WithPageHeaders(headers http.Header) PageOption {
+	return func(it *PageIterator) {
+		it.headers = headers
+	}
+}
+
+// ErrMaxPagesReached is returned by PageIterator.Err when iteration stopped
+// at the WithMaxPages cap although more pages were advertised
+type ErrMaxPagesReached struct {
+	MaxPages int
+	// NextURL is the page that would have been fetched next
+	NextURL string
+}
+
+func (e *ErrMaxPagesReached) Error() string {
+	return fmt.Sprintf("pagination - stopped after %d pages with more remaining", e.MaxPages)
+}
+
+// PageIterator walks the pages of a paginated API, created with Paginate
+type PageIterator struct {
+	ctx      context.Context
+	client   Client
+	firstURL string
+	headers  http.Header
+	maxPages int
+	next     func(first, current string, page Response) (string, error)
+
+	nextURL string
+	pages   int
+	page    Response
+	err     error
+	done    bool
+}
+
+// Paginate returns an iterator over the pages starting at firstURL. Each page
+// is fetched with client.Do, so retries, mutators and middlewares apply.
+// Iteration stops once a page has no next page, a page fails or returns an
+// error status, or ctx is done.
+//
+//	pages := heimdall.Paginate(ctx, client, "https://api.example.com/items")
+//	for pages.Next() {
+//		handle(pages.Page())
+//	}
+//	if err := pages.Err(); err != nil {
+//		...
+//	}
+func Paginate(ctx context.Context, client Client, firstURL string, opts ...PageOption) *PageIterator {
+	it := &PageIterator{
+		ctx:      ctx,
+		client:   client,
+		firstURL: firstURL,
+		nextURL:  firstURL,
+		next:     linkNext,
+	}
+	for _, opt := range opts {
+		opt(it)
+	}
+
+	return it
+}
+
+// Next fetches the next page, returning false when there are no more pages
+// or iteration failed
+func (it *PageIterator) Next() bool {
+	if it.done {
+		return false
+	}
+
+	if it.nextURL == "" {
+		it.done = true
+		return false
+	}
+
+	if it.maxPages > 0 && it.pages >= it.maxPages {
+		it.err = &ErrMaxPagesReached{MaxPages: it.maxPages, NextURL: it.nextURL}
+		it.done = true
+		return false
+	}
+
+	if err := it.ctx.Err(); err != nil {
+		return it.fail(err)
+	}
+
+	request, err := http.NewRequest(http.MethodGet, it.nextURL, nil)
+	if err != nil {
+		return it.fail(errors.Wrap(err, "pagination - request creation failed"))
+	}
+	request = request.WithContext(it.ctx)
+	request.Header = copyHeader(it.headers)
+
+	page, err := SendRequest(it.client, request)
+	if err != nil {
+		return it.fail(err)
+	}
+	if page.StatusCode() >= http.StatusBadRequest {
+		return it.fail(fmt.Errorf("pagination - unexpected status code: %d", page.StatusCode()))
+	}
+
+	current := page.FinalURL()
+	if current == "" {
+		current = it.nextURL
+	}
+
+	it.nextURL, err = it.next(it.firstURL, current, page)
+	if err != nil {
+		return it.fail(err)
+	}
+
+	it.page = page
+	it.pages++
+
+	return true
+}
+
+// Page returns the page fetched by the last call to Next
+func (it *PageIterator) Page() Response {
+	return it.page
+}
+
+// Err returns the error that ended iteration, or nil if it ran out of pages
+func (it *PageIterator) Err() error {
+	return it.err
+}
+
+func (it *PageIterator) fail(err error) bool {
+	it.err = err
+	it.done = true
+	it.page = Response{}
+
+	return false
+}
+
+// linkNext returns the rel="next" target of the RFC 5988 Link headers of
+// page, resolved against the URL of the page
+func linkNext(first, current string, page Response) (string, error) {
+	for _, header := range page.headers["Link"] {
+		for _, link := range splitLinks(header) {
+			target, params := parseLink(link)
+			if target == "" {
+				continue
+			}
+
+			for _, rel := range strings.Fields(params["rel"]) {
+				if strings.EqualFold(rel, "next") {
+					return resolveReference(current, target)
+				}
+			}
+		}
+	}
+
+	return "", nil
+}
+
+// splitLinks splits a Link header on the commas between links, ignoring
+// commas inside the <> of a target or a quoted parameter
+func splitLinks(header string) []string {
+	var links []string
+	inTarget, inQuotes, start := false, false, 0
+
+	for i, r := range header {
+		switch {
+		case r == '<' && !inQuotes:
+			inTarget = true
+		case r == '>' && !inQuotes:
+			inTarget = false
+		case r == '"' && !inTarget:
+			inQuotes = !inQuotes
+		case r == ',' && !inTarget && !inQuotes:
+			links = append(links, header[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(links, header[start:])
+}
+
+// parseLink returns the target of a single link and its parameters
+func parseLink(link string) (string, map[string]string) {
+	link = strings.TrimSpace(link)
+	if !strings.HasPrefix(link, "<") {
+		return "", nil
+	}
+
+	end := strings.IndexByte(link, '>')
+	if end < 0 {
+		return "", nil
+	}
+
+	params := map[string]string{}
+	for _, param := range strings.Split(link[end+1:], ";") {
+		name, value := strings.TrimSpace(param), ""
+		if i := strings.IndexByte(name, '='); i >= 0 {
+			name, value = strings.TrimSpace(name[:i]), strings.Trim(strings.TrimSpace(name[i+1:]), `"`)
+		}
+		if name != "" {
+			params[strings.ToLower(name)] = value
+		}
+	}
+
+	return link[1:end], params
+}
+
+func resolveReference(base, target string) (string, error) {
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return "", errors.Wrap(err, "pagination - invalid page URL")
+	}
+
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		return "", errors.Wrap(err, "pagination - invalid next link")
+	}
+
+	return baseURL.ResolveReference(targetURL).String(), nil
+}
+
+// cursorNext returns a next page func reading the cursor at path from the
+// JSON body of each page
+func cursorNext(path []string, param string) func(first, current string, page Response) (string, error) {
+	return func(first, current string, page Response) (string, error) {
+		decoder := json.NewDecoder(bytes.NewReader(page.Body()))
+		decoder.UseNumber()
+
+		var body interface{}
+		if err := decoder.Decode(&body); err != nil {
+			return "", errors.Wrap(err, "pagination - page body is not JSON")
+		}
+
+		value := body
+		for _, key := range path {
+			object, ok := value.(map[string]interface{})
+			if !ok {
+				return "", nil
+			}
+			value = object[key]
+		}
+
+		var cursor string
+		switch typed := value.(type) {
+		case string:
+			cursor = typed
+		case json.Number:
+			cursor = typed.String()
+		}
+		if cursor == "" {
+			return "", nil
+		}
+
+		next, err := url.Parse(first)
+		if err != nil {
+			return "", errors.Wrap(err, "pagination - invalid first URL")
+		}
+
+		query := next.Query()
+		query.Set(param, cursor)
+		next.RawQuery = query.Encode()
+
+		return next.String(), nil
+	}
+}
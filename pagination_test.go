@@ -0,0 +1,136 @@
+package heimdall
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// linkPagesServer serves pages 1 to last of /items, linking each to the next
+// with a Link header
+func linkPagesServer(last int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if page == 0 {
+			page = 1
+		}
+
+		links := fmt.Sprintf(`</items?page=1>; rel="first", </items?page=%d>; rel="last"`, last)
+		if page < last {
+			links = fmt.Sprintf(`</items?page=%d>; rel="next", %s`, page+1, links)
+		}
+		w.Header().Set("Link", links)
+		fmt.Fprintf(w, "page %d", page)
+	}))
+}
+
+func collectPages(it *PageIterator) []string {
+	var pages []string
+	for it.Next() {
+		pages = append(pages, string(it.Page().Body()))
+	}
+
+	return pages
+}
+
+func TestPaginateFollowsLinkHeaders(t *testing.T) {
+	server := linkPagesServer(3)
+	defer server.Close()
+
+	pages := Paginate(context.Background(), NewHTTPClient(1000), server.URL+"/items")
+
+	assert.Equal(t, []string{"page 1", "page 2", "page 3"}, collectPages(pages))
+	assert.NoError(t, pages.Err())
+	assert.False(t, pages.Next())
+}
+
+func TestPaginateFollowsJSONCursor(t *testing.T) {
+	cursors := map[string]string{"": `"abc"`, "abc": `42`, "42": `null`}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "10", r.URL.Query().Get("limit"))
+		assert.Equal(t, "secret", r.Header.Get("Authorization"))
+
+		cursor := r.URL.Query().Get("cursor")
+		fmt.Fprintf(w, `{"items": [%q], "meta": {"next_cursor": %s}}`, cursor, cursors[cursor])
+	}))
+	defer server.Close()
+
+	pages := Paginate(context.Background(), NewHTTPClient(1000), server.URL+"/items?limit=10",
+		WithCursorField("meta.next_cursor", "cursor"),
+		WithPageHeaders(http.Header{"Authorization": []string{"secret"}}))
+
+	got := collectPages(pages)
+	require.NoError(t, pages.Err())
+	assert.Equal(t, []string{
+		`{"items": [""], "meta": {"next_cursor": "abc"}}`,
+		`{"items": ["abc"], "meta": {"next_cursor": 42}}`,
+		`{"items": ["42"], "meta": {"next_cursor": null}}`,
+	}, got)
+}
+
+func TestPaginateStopsAtMaxPages(t *testing.T) {
+	server := linkPagesServer(10)
+	defer server.Close()
+
+	pages := Paginate(context.Background(), NewHTTPClient(1000), server.URL+"/items", WithMaxPages(2))
+
+	assert.Equal(t, []string{"page 1", "page 2"}, collectPages(pages))
+
+	reached, ok := pages.Err().(*ErrMaxPagesReached)
+	require.True(t, ok, "expected *ErrMaxPagesReached, got %v", pages.Err())
+	assert.Equal(t, server.URL+"/items?page=3", reached.NextURL)
+
+	exact := Paginate(context.Background(), NewHTTPClient(1000), server.URL+"/items?page=9", WithMaxPages(2))
+	assert.Equal(t, []string{"page 9", "page 10"}, collectPages(exact))
+	assert.NoError(t, exact.Err(), "the cap was not hit when no page was left")
+}
+
+func TestPaginateStopsOnPageErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page") == "2" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Link", `<?page=2>; rel="next"`)
+		w.Write([]byte("page 1"))
+	}))
+	defer server.Close()
+
+	pages := Paginate(context.Background(), NewHTTPClient(1000), server.URL+"/items")
+
+	assert.Equal(t, []string{"page 1"}, collectPages(pages))
+	assert.EqualError(t, pages.Err(), "pagination - unexpected status code: 404")
+	assert.Equal(t, 0, pages.Page().StatusCode())
+}
+
+func TestPaginateStopsWhenContextIsDone(t *testing.T) {
+	server := linkPagesServer(10)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pages := Paginate(ctx, NewHTTPClient(1000), server.URL+"/items")
+
+	require.True(t, pages.Next())
+	cancel()
+
+	assert.False(t, pages.Next())
+	assert.Equal(t, context.Canceled, pages.Err())
+}
+
+func TestLinkNextParsesQuotedAndMultipleHeaders(t *testing.T) {
+	page := Response{headers: http.Header{"Link": []string{
+		`<https://api.example.com/a,b>; title="one, two"; rel="prev"`,
+		`<https://api.example.com/items?page=2>; rel="last next"`,
+	}}}
+
+	next, err := linkNext("", "https://api.example.com/items", page)
+	require.NoError(t, err)
+	assert.Equal(t, "https://api.example.com/items?page=2", next)
+}
@@ -0,0 +1,125 @@
+package heimdall
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// PhaseTimings break the time of an attempt down by the phases of sending it
+// over the network. Phases an attempt skipped, such as dialing on a reused
+// connection, are zero.
+type PhaseTimings struct {
+	DNS          Duration `json:"dns,omitempty"`
+	Connect      Duration `json:"connect,omitempty"`
+	TLSHandshake Duration `json:"tls_handshake,omitempty"`
+	// Wait is from the request being written until the first byte of the
+	// response, the time the server took to answer
+	Wait Duration `json:"wait"`
+	// ReusedConnection reports whether the attempt got a pooled connection
+	ReusedConnection bool `json:"reused_connection,omitempty"`
+}
+
+// WithPhaseTimings records the PhaseTimings of every attempt into its
+// AttemptTrace, as returned by Response.Trace and handed to the slow request
+// hook. Tracing the phases costs each attempt a few clock readings.
+func WithPhaseTimings() Option {
+	return func(options *clientOptions) {
+		options.phaseTimings = true
+	}
+}
+
+// tracePhases records the phases of each attempt sent through next into the
+// trace of its request, when enabled
+func tracePhases(next Doer, clock Clock, enabled bool) Doer {
+	if !enabled {
+		return next
+	}
+
+	return DoerFunc(func(request *http.Request) (*http.Response, error) {
+		trace, _ := request.Context().Value(requestTraceKey{}).(*requestTrace)
+		if trace == nil {
+			return next.Do(request)
+		}
+
+		recorder := &phaseRecorder{clock: clock}
+		response, err := next.Do(request.WithContext(httptrace.WithClientTrace(request.Context(), recorder.clientTrace())))
+		trace.setPhases(recorder.timings())
+
+		return response, err
+	})
+}
+
+// phaseRecorder collects the phase timings of one attempt. The transport may
+// report dialing from goroutines of its own, so it is locked.
+type phaseRecorder struct {
+	mu    sync.Mutex
+	clock Clock
+
+	phases                                  PhaseTimings
+	dnsStart, connectStart, tlsStart, wrote time.Time
+}
+
+func (r *phaseRecorder) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			r.start(&r.dnsStart)
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			r.done(&r.phases.DNS, &r.dnsStart)
+		},
+		ConnectStart: func(network, addr string) {
+			r.start(&r.connectStart)
+		},
+		ConnectDone: func(network, addr string, err error) {
+			r.done(&r.phases.Connect, &r.connectStart)
+		},
+		TLSHandshakeStart: func() {
+			r.start(&r.tlsStart)
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			r.done(&r.phases.TLSHandshake, &r.tlsStart)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			r.mu.Lock()
+			r.phases.ReusedConnection = info.Reused
+			r.mu.Unlock()
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			r.start(&r.wrote)
+		},
+		GotFirstResponseByte: func() {
+			r.done(&r.phases.Wait, &r.wrote)
+		},
+	}
+}
+
+// start records the start of a phase in at
+func (r *phaseRecorder) start(at *time.Time) {
+	now := r.clock.Now()
+
+	r.mu.Lock()
+	*at = now
+	r.mu.Unlock()
+}
+
+// done records into phase the time since the phase started at
+func (r *phaseRecorder) done(phase *Duration, at *time.Time) {
+	now := r.clock.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !at.IsZero() {
+		*phase = Duration(now.Sub(*at))
+	}
+}
+
+func (r *phaseRecorder) timings() *PhaseTimings {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	phases := r.phases
+	return &phases
+}
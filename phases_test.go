@@ -0,0 +1,80 @@
+package heimdall
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPhaseTimingsOfAttempts(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(1000, WithPhaseTimings(), WithKeepAlive())
+	client.current.client.Transport.(*http.Transport).TLSClientConfig = &tls.Config{RootCAs: server.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs}
+
+	response, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+
+	phases := response.Trace().Attempts[0].Phases
+	require.NotNil(t, phases)
+	assert.False(t, phases.ReusedConnection)
+	assert.True(t, phases.Connect > 0)
+	assert.True(t, phases.TLSHandshake > 0)
+	assert.True(t, phases.Wait >= Duration(20*time.Millisecond))
+
+	response, err = client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+
+	phases = response.Trace().Attempts[0].Phases
+	require.NotNil(t, phases)
+	assert.True(t, phases.ReusedConnection)
+	assert.Equal(t, Duration(0), phases.Connect)
+	assert.Equal(t, Duration(0), phases.TLSHandshake)
+}
+
+func TestPhaseTimingsOfEachRetry(t *testing.T) {
+	clients := map[string]Client{
+		"http":    NewHTTPClient(1000, WithPhaseTimings()),
+		"hystrix": NewHystrixHTTPClient(1000, NewHystrixConfig("phase_timings_command", HystrixCommandConfig{Timeout: 1000}), WithPhaseTimings()),
+	}
+
+	for kind, client := range clients {
+		t.Run(kind, func(t *testing.T) {
+			server := failingServer(1)
+			defer server.Close()
+
+			client.SetRetryCount(1)
+
+			response, err := client.Get(server.URL, http.Header{})
+			require.NoError(t, err)
+
+			attempts := response.Trace().Attempts
+			require.Len(t, attempts, 2)
+			assert.NotNil(t, attempts[0].Phases)
+			assert.NotNil(t, attempts[1].Phases)
+			assert.NotSame(t, attempts[0].Phases, attempts[1].Phases)
+		})
+	}
+}
+
+func TestPhaseTimingsOfAttemptsNotSent(t *testing.T) {
+	client := NewHTTPClient(1000, WithPhaseTimings())
+	client.Use(func(next Doer) Doer {
+		return DoerFunc(func(request *http.Request) (*http.Response, error) {
+			return nil, assert.AnError
+		})
+	})
+
+	response, err := client.Get("http://example.com", http.Header{})
+	require.Error(t, err)
+
+	assert.Nil(t, response.Trace().Attempts[0].Phases, "the middleware kept the attempt from the network")
+}
@@ -0,0 +1,78 @@
+package heimdall
+
+import (
+	"net/http"
+)
+
+// Plugin observes every request made by a client it is added to with
+// AddPlugin, once per request rather than per attempt
+type Plugin interface {
+	// OnRequestStart is called before the request is checked and sent
+	OnRequestStart(request *http.Request)
+	// OnRequestEnd is called with the response of a request that succeeded
+	OnRequestEnd(request *http.Request, response Response)
+	// OnError is called with the error of a request that failed, which is an
+	// *ErrCallbackPanic when code supplied to the client panicked
+	OnError(request *http.Request, err error)
+}
+
+// plugins are the plugins of a client, in the order they were added
+type plugins []Plugin
+
+// start calls OnRequestStart of every plugin, stopping with an
+// *ErrCallbackPanic at the first that panics
+func (p plugins) start(request *http.Request) error {
+	for _, plugin := range p {
+		if err := startPlugin(plugin, request); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// end reports the outcome of request to every plugin and returns err. A
+// panic in OnRequestEnd fails the request with an *ErrCallbackPanic, which is
+// then reported to OnError of every plugin, and a panic in OnError replaces
+// err for the plugins after it.
+func (p plugins) end(request *http.Request, response Response, err error) error {
+	if err == nil {
+		for _, plugin := range p {
+			if err = endPlugin(plugin, request, response); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		return nil
+	}
+
+	for _, plugin := range p {
+		if panicked := failPlugin(plugin, request, err); panicked != nil {
+			err = panicked
+		}
+	}
+
+	return err
+}
+
+func startPlugin(plugin Plugin, request *http.Request) (err error) {
+	defer recoverCallback("plugin", &err)
+
+	plugin.OnRequestStart(request)
+	return nil
+}
+
+func endPlugin(plugin Plugin, request *http.Request, response Response) (err error) {
+	defer recoverCallback("plugin", &err)
+
+	plugin.OnRequestEnd(request, response)
+	return nil
+}
+
+func failPlugin(plugin Plugin, request *http.Request, cause error) (err error) {
+	defer recoverCallback("plugin", &err)
+
+	plugin.OnError(request, cause)
+	return nil
+}
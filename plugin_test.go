@@ -0,0 +1,187 @@
+package heimdall
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingPlugin records the hooks called on it, panicking in those named
+// by explode
+type recordingPlugin struct {
+	explode string
+
+	mu     sync.Mutex
+	calls  []string
+	errors []error
+}
+
+func (p *recordingPlugin) record(hook string) {
+	p.mu.Lock()
+	p.calls = append(p.calls, hook)
+	p.mu.Unlock()
+	if hook == p.explode {
+		panic(hook + " exploded")
+	}
+}
+
+func (p *recordingPlugin) OnRequestStart(request *http.Request) {
+	p.record("start")
+}
+
+func (p *recordingPlugin) OnRequestEnd(request *http.Request, response Response) {
+	p.record("end")
+}
+
+func (p *recordingPlugin) OnError(request *http.Request, err error) {
+	p.mu.Lock()
+	p.errors = append(p.errors, err)
+	p.mu.Unlock()
+	p.record("error")
+}
+
+func (p *recordingPlugin) recorded() ([]string, []error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]string(nil), p.calls...), append([]error(nil), p.errors...)
+}
+
+func addPlugin(client Client, plugin Plugin) {
+	client.(interface{ AddPlugin(Plugin) }).AddPlugin(plugin)
+}
+
+func TestPluginsObserveEveryRequest(t *testing.T) {
+	for kind, newClient := range retryClients {
+		t.Run(kind, func(t *testing.T) {
+			var calls int32
+			server := countingServer(&calls)
+			defer server.Close()
+
+			client := newClient(t.Name(), realClock{})
+			client.SetRetryCount(2)
+			plugin := &recordingPlugin{}
+			addPlugin(client, plugin)
+
+			_, err := client.Get(server.URL, http.Header{})
+			require.NoError(t, err)
+			hooks, _ := plugin.recorded()
+			assert.Equal(t, []string{"start", "end"}, hooks)
+
+			server.Close()
+			_, err = client.Get(server.URL, http.Header{})
+			require.Error(t, err)
+			hooks, errs := plugin.recorded()
+			assert.Equal(t, []string{"start", "end", "start", "error"}, hooks, "a plugin sees each request once, however many attempts it takes")
+			require.Len(t, errs, 1)
+			assert.Equal(t, err, errs[0])
+		})
+	}
+}
+
+func TestPluginsAreToldOfCallbackPanics(t *testing.T) {
+	cases := map[string]struct {
+		setup    func(client testClient, plugin *recordingPlugin)
+		callback string
+		hooks    []string
+		calls    int32
+	}{
+		"validator": {
+			setup: func(client testClient, plugin *recordingPlugin) {
+				client.SetRequestValidator(func(request *http.Request) error { panic("validator exploded") })
+			},
+			callback: "request validator",
+			hooks:    []string{"start", "error"},
+		},
+		"plugin start": {
+			setup: func(client testClient, plugin *recordingPlugin) {
+				plugin.explode = "start"
+			},
+			callback: "plugin",
+			hooks:    []string{"start", "error"},
+		},
+		"plugin end": {
+			setup: func(client testClient, plugin *recordingPlugin) {
+				plugin.explode = "end"
+			},
+			callback: "plugin",
+			hooks:    []string{"start", "end", "error"},
+			calls:    1,
+		},
+	}
+
+	for name, tc := range cases {
+		for kind, newClient := range retryClients {
+			t.Run(name+"/"+kind, func(t *testing.T) {
+				var calls int32
+				server := countingServer(&calls)
+				defer server.Close()
+
+				client := newClient(t.Name(), realClock{})
+				plugin, observer := &recordingPlugin{}, &recordingPlugin{}
+				addPlugin(client, plugin)
+				addPlugin(client, observer)
+				tc.setup(client, plugin)
+
+				_, err := client.Get(server.URL, http.Header{})
+
+				var panicked *ErrCallbackPanic
+				require.True(t, errors.As(err, &panicked), "%v", err)
+				assert.Equal(t, tc.callback, panicked.Callback)
+				assert.Contains(t, err.Error(), "exploded")
+				assert.Equal(t, tc.calls, atomic.LoadInt32(&calls))
+
+				hooks, errs := plugin.recorded()
+				assert.Equal(t, tc.hooks, hooks)
+				assert.Equal(t, []error{err}, errs)
+				_, errs = observer.recorded()
+				assert.Equal(t, []error{err}, errs, "every plugin is told of the panic")
+			})
+		}
+	}
+}
+
+func TestPanickingOnErrorReplacesTheError(t *testing.T) {
+	var calls int32
+	server := countingServer(&calls)
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+	first, second := &recordingPlugin{explode: "error"}, &recordingPlugin{}
+	addPlugin(client, first)
+	addPlugin(client, second)
+	server.Close()
+
+	_, err := client.Get(server.URL, http.Header{})
+
+	var panicked *ErrCallbackPanic
+	require.True(t, errors.As(err, &panicked), "%v", err)
+	assert.Equal(t, "panic in plugin: error exploded", err.Error())
+	_, errs := second.recorded()
+	assert.Equal(t, []error{err}, errs, "the plugins after the panicking one see its panic")
+}
+
+func TestDerivedClientsCopyPlugins(t *testing.T) {
+	var calls int32
+	server := countingServer(&calls)
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+	plugin := &recordingPlugin{}
+	addPlugin(client, plugin)
+	derived := client.Derive()
+	addPlugin(derived, &recordingPlugin{explode: "start"})
+
+	_, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err, "plugins added to a derived client are its own")
+	_, err = derived.Get(server.URL, http.Header{})
+	require.Error(t, err)
+
+	hooks, _ := plugin.recorded()
+	assert.Equal(t, []string{"start", "end", "start", "error"}, hooks)
+}
@@ -0,0 +1,117 @@
+package heimdall
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrPollUnsatisfied is returned by PollUntil when maxWait passed without the
+// predicate being satisfied
+type ErrPollUnsatisfied struct {
+	// Polls is the number of responses the predicate was given
+	Polls int
+	// Waited is how long polling went on
+	Waited time.Duration
+	// LastResponse is the last response the predicate rejected
+	LastResponse Response
+}
+
+func (e *ErrPollUnsatisfied) Error() string {
+	return fmt.Sprintf("poll - condition not met after %d polls in %v", e.Polls, e.Waited)
+}
+
+// ErrPollFailed is returned by PollUntil when a poll failed, after the retries
+// of the client, before the predicate was satisfied
+type ErrPollFailed struct {
+	// Polls is the number of responses the predicate was given before
+	Polls int
+
+	err error
+}
+
+func (e *ErrPollFailed) Error() string {
+	return fmt.Sprintf("poll - request failed after %d polls: %v", e.Polls, e.err)
+}
+
+// Unwrap returns the error of the failed poll
+func (e *ErrPollFailed) Unwrap() error {
+	return e.err
+}
+
+// PollUntil GETs url through client, with its retries, mutators and
+// middlewares, until predicate reports the response done, for reading a
+// write back from an eventually consistent store. Polls are spaced by
+// backoff, given the number of polls made so far less one. Any response the
+// client does not fail, 404 included, goes to predicate, and an error from
+// predicate stops polling and is returned as it is.
+//
+// Polling gives up with an *ErrPollUnsatisfied once maxWait has passed, a
+// poll in flight included, or an *ErrPollFailed when a poll fails, and
+// returns ctx.Err() once ctx is done. A maxWait of zero polls until ctx is
+// done. The last response received is returned along with any error. The
+// waits and maxWait are measured on clock, the real clock when nil, which
+// should be the clock the client was made with.
+func PollUntil(ctx context.Context, client Client, url string, headers http.Header, predicate func(Response) (done bool, err error), backoff Backoff, maxWait time.Duration, clock Clock) (Response, error) {
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return Response{}, errors.Wrap(err, "poll - request creation failed")
+	}
+
+	clock = clockOrReal(clock)
+	pollCtx := ctx
+	if maxWait > 0 {
+		var cancel context.CancelFunc
+		pollCtx, cancel = withClockTimeout(ctx, clock, maxWait)
+		defer cancel()
+	}
+
+	start := clock.Now()
+	unsatisfied := func(polls int, last Response) (Response, error) {
+		return last, &ErrPollUnsatisfied{Polls: polls, Waited: clock.Now().Sub(start), LastResponse: last}
+	}
+
+	last := Response{}
+	for polls := 0; ; polls++ {
+		if polls > 0 {
+			wait := backoff.Next(polls - 1)
+			if left := start.Add(maxWait).Sub(clock.Now()); maxWait > 0 && wait > left {
+				wait = left
+			}
+			if err := clock.Sleep(pollCtx, wait); err != nil {
+				if ctxErr := ctx.Err(); ctxErr != nil {
+					return last, ctxErr
+				}
+				return unsatisfied(polls, last)
+			}
+			if maxWait > 0 && !clock.Now().Before(start.Add(maxWait)) {
+				return unsatisfied(polls, last)
+			}
+		}
+
+		poll := request.Clone(pollCtx)
+		poll.Header = copyHeader(headers)
+		response, err := SendRequest(client, poll)
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return last, ctxErr
+			}
+			if pollCtx.Err() != nil {
+				return unsatisfied(polls, last)
+			}
+			return response, &ErrPollFailed{Polls: polls, err: err}
+		}
+
+		last = response
+		done, err := predicate(response)
+		if err != nil {
+			return response, err
+		}
+		if done {
+			return response, nil
+		}
+	}
+}
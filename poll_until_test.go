@@ -0,0 +1,161 @@
+package heimdall
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gojektech/heimdall/fakeclock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// visibleAfter answers 404 until polls requests were made, then the order
+func visibleAfter(polls int32, calls *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(calls, 1) <= polls {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"id": 42, "status": "created"}`))
+	}))
+}
+
+func orderVisible(response Response) (bool, error) {
+	return response.StatusCode() == http.StatusOK, nil
+}
+
+func TestPollUntilPredicateMatches(t *testing.T) {
+	var calls int32
+	server := visibleAfter(3, &calls)
+	defer server.Close()
+
+	var seen []string
+	client := NewHTTPClient(1000)
+	client.AddRequestMutator(RequestMutatorFunc(func(request *http.Request) error {
+		seen = append(seen, request.Header.Get("X-Tenant"))
+		return nil
+	}))
+
+	response, err := PollUntil(context.Background(), client, server.URL+"/orders/42", http.Header{"X-Tenant": {"acme"}},
+		orderVisible, NewConstantBackoff(5), time.Second, nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, `{"id": 42, "status": "created"}`, string(response.Body()))
+	assert.Equal(t, int32(4), atomic.LoadInt32(&calls))
+	assert.Equal(t, []string{"acme", "acme", "acme", "acme"}, seen, "polls go through the client")
+}
+
+func TestPollUntilGivesUpAfterMaxWait(t *testing.T) {
+	var calls int32
+	server := visibleAfter(1000, &calls)
+	defer server.Close()
+
+	start := time.Now()
+	response, err := PollUntil(context.Background(), NewHTTPClient(1000), server.URL, nil,
+		orderVisible, NewConstantBackoff(20), 100*time.Millisecond, nil)
+
+	var unsatisfied *ErrPollUnsatisfied
+	require.True(t, errors.As(err, &unsatisfied), "%v", err)
+	assert.True(t, unsatisfied.Polls > 1)
+	assert.Equal(t, int(atomic.LoadInt32(&calls)), unsatisfied.Polls)
+	assert.True(t, unsatisfied.Waited >= 100*time.Millisecond)
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, http.StatusNotFound, unsatisfied.LastResponse.StatusCode())
+	assert.Equal(t, http.StatusNotFound, response.StatusCode())
+}
+
+func TestPollUntilMaxWaitCutsPollInFlight(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer server.Close()
+
+	start := time.Now()
+	_, err := PollUntil(context.Background(), NewHTTPClient(5000), server.URL, nil,
+		orderVisible, NewConstantBackoff(0), 50*time.Millisecond, nil)
+
+	var unsatisfied *ErrPollUnsatisfied
+	require.True(t, errors.As(err, &unsatisfied), "%v", err)
+	assert.Equal(t, 0, unsatisfied.Polls)
+	assert.True(t, time.Since(start) < 500*time.Millisecond)
+}
+
+func TestPollUntilStopsOnFailedPoll(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) > 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+	client.SetRetryCount(1)
+
+	response, err := PollUntil(context.Background(), client, server.URL, nil, orderVisible, NewConstantBackoff(0), time.Second, nil)
+
+	var failed *ErrPollFailed
+	require.True(t, errors.As(err, &failed), "%v", err)
+	assert.Equal(t, 1, failed.Polls)
+	var exhausted *RetriesExhaustedError
+	assert.True(t, errors.As(err, &exhausted), "the client error is wrapped")
+	assert.Equal(t, http.StatusServiceUnavailable, response.StatusCode())
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls), "one poll and its retry after the 404")
+}
+
+func TestPollUntilReturnsPredicateError(t *testing.T) {
+	var calls int32
+	server := visibleAfter(0, &calls)
+	defer server.Close()
+
+	broken := errors.New("unexpected status field")
+	_, err := PollUntil(context.Background(), NewHTTPClient(1000), server.URL, nil, func(Response) (bool, error) {
+		return false, broken
+	}, NewConstantBackoff(0), time.Second, nil)
+
+	assert.Equal(t, broken, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestPollUntilRespectsContext(t *testing.T) {
+	var calls int32
+	server := visibleAfter(1000, &calls)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := PollUntil(ctx, NewHTTPClient(1000), server.URL, nil, orderVisible, NewConstantBackoff(10), 0, nil)
+
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestPollUntilWaitsOnTheClock(t *testing.T) {
+	var calls int32
+	server := visibleAfter(100, &calls)
+	defer server.Close()
+
+	clock := fakeclock.New(time.Now())
+	began := time.Now()
+	_, err := PollUntil(context.Background(), NewHTTPClient(1000, WithClock(clock)), server.URL, nil,
+		orderVisible, NewConstantBackoff(2000), 5*time.Second, clock)
+
+	var unsatisfied *ErrPollUnsatisfied
+	require.True(t, errors.As(err, &unsatisfied), "%v", err)
+	assert.Equal(t, 4, unsatisfied.Polls)
+	assert.Equal(t, 5*time.Second, unsatisfied.Waited)
+	assert.Equal(t, []time.Duration{0, 2 * time.Second, 2 * time.Second, time.Second}, clock.Sleeps(), "the last wait is cut to maxWait")
+	assert.Equal(t, int32(4), atomic.LoadInt32(&calls))
+	assert.True(t, time.Since(began) < time.Second, "no real time is waited")
+	assert.Zero(t, clock.Timers(), "the maxWait timer is stopped")
+}
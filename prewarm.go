@@ -0,0 +1,152 @@
+package heimdall
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrPrewarmFailed is returned by Prewarm when some of the hosts could not be
+// connected to. The others were warmed.
+type ErrPrewarmFailed struct {
+	// Hosts maps the scheme and host of each URL that failed, such as
+	// "https://api.example.com", or the URL itself when it is invalid, to
+	// the error connecting to it
+	Hosts map[string]error
+}
+
+func (e *ErrPrewarmFailed) Error() string {
+	hosts := make([]string, 0, len(e.Hosts))
+	for host := range e.Hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	failures := make([]string, len(hosts))
+	for i, host := range hosts {
+		failures[i] = fmt.Sprintf("%s: %v", host, e.Hosts[host])
+	}
+
+	return fmt.Sprintf("prewarm failed for %d hosts: %s", len(hosts), strings.Join(failures, "; "))
+}
+
+// Unwrap returns the error of each host, for errors.Is and errors.As
+func (e *ErrPrewarmFailed) Unwrap() []error {
+	errs := make([]error, 0, len(e.Hosts))
+	for _, err := range e.Hosts {
+		errs = append(errs, err)
+	}
+
+	return errs
+}
+
+// prewarm sends a HEAD request for each distinct scheme and host of urls
+// straight through the transport of client, concurrently, leaving the
+// connection in its pool. Requests are subject to the host allowlist and the
+// client timeout but skip retries, middlewares and redirects, and any
+// response counts as warm.
+func prewarm(ctx context.Context, client *http.Client, guard *hostGuard, base *baseURL, urls []string) error {
+	var mu sync.Mutex
+	failed := map[string]error{}
+	fail := func(host string, err error) {
+		mu.Lock()
+		failed[host] = err
+		mu.Unlock()
+	}
+
+	if client.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, client.Timeout)
+		defer cancel()
+	}
+
+	var wg sync.WaitGroup
+	warming := map[string]bool{}
+	for _, raw := range urls {
+		request, err := prewarmRequest(ctx, raw, guard, base)
+		if err != nil {
+			fail(redactUserinfo(raw), err)
+			continue
+		}
+
+		host := request.URL.Scheme + "://" + request.URL.Host
+		if warming[host] {
+			continue
+		}
+		warming[host] = true
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := warmConnection(client.Transport, request); err != nil {
+				fail(host, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(failed) > 0 {
+		return &ErrPrewarmFailed{Hosts: failed}
+	}
+
+	return nil
+}
+
+// prewarmRequest builds the HEAD request warming the host of raw
+func prewarmRequest(ctx context.Context, raw string, guard *hostGuard, base *baseURL) (*http.Request, error) {
+	request, err := newRequest(http.MethodHead, raw, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resolved, err := base.resolve(request.URL)
+	if err != nil {
+		return nil, err
+	}
+	request.URL = resolved
+	request.Host = ""
+
+	if err := checkRequestURL(request.URL); err != nil {
+		return nil, err
+	}
+	if err := guard.checkURL(request.URL); err != nil {
+		return nil, err
+	}
+
+	return request.WithContext(ctx), nil
+}
+
+// warmConnection sends request through transport, reading the response so
+// that the connection returns to the pool, and counted as idle there
+func warmConnection(transport http.RoundTripper, request *http.Request) error {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	var conn *meteredConn
+	request = request.WithContext(httptrace.WithClientTrace(request.Context(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if conn = meteredConnOf(info.Conn); conn != nil {
+				conn.acquire()
+			}
+		},
+	}))
+
+	response, err := transport.RoundTrip(request)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, response.Body)
+	err = response.Body.Close()
+	if conn != nil && !response.Close {
+		conn.release()
+	}
+
+	return err
+}
@@ -0,0 +1,138 @@
+package heimdall
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// warmableServer is a TLS server counting the connections and HEAD requests
+// it gets
+func warmableServer(connections, heads *int32) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			atomic.AddInt32(heads, 1)
+		}
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(connections, 1)
+		}
+	}
+	server.StartTLS()
+
+	return server
+}
+
+// reusedConnection sends a GET to url through client, reporting whether it
+// went over a pooled connection
+func reusedConnection(t *testing.T, client testClient, url string) bool {
+	var reused bool
+	ctx := httptrace.WithClientTrace(context.Background(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			reused = info.Reused
+		},
+	})
+
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+	_, err = client.Do(request.WithContext(ctx))
+	require.NoError(t, err)
+
+	return reused
+}
+
+func TestClientsPrewarmConnections(t *testing.T) {
+	for kind, newClient := range retryClients {
+		t.Run(kind, func(t *testing.T) {
+			var connections, heads int32
+			server := warmableServer(&connections, &heads)
+			defer server.Close()
+
+			client := newClient("prewarm_"+kind, realClock{})
+			clientTransport(client).TLSClientConfig = server.Client().Transport.(*http.Transport).TLSClientConfig
+
+			require.NoError(t, client.Prewarm(context.Background(), server.URL+"/users", server.URL+"/orders?limit=1"))
+			assert.Equal(t, int32(1), atomic.LoadInt32(&connections), "one connection per host")
+			assert.Equal(t, int32(1), atomic.LoadInt32(&heads))
+
+			require.NoError(t, client.Prewarm(context.Background(), server.URL))
+			assert.Equal(t, int32(1), atomic.LoadInt32(&connections), "warm hosts dial nothing")
+
+			assert.True(t, reusedConnection(t, client, server.URL+"/users"))
+			assert.Equal(t, int32(1), atomic.LoadInt32(&connections))
+		})
+	}
+}
+
+func TestPrewarmReportsFailedHosts(t *testing.T) {
+	var connections, heads int32
+	server := warmableServer(&connections, &heads)
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+	clientTransport(client).TLSClientConfig = server.Client().Transport.(*http.Transport).TLSClientConfig
+
+	err := client.Prewarm(context.Background(), server.URL, "http://127.0.0.1:1/health", "ftp://example.com", "http://127.0.0.1:1")
+
+	var failed *ErrPrewarmFailed
+	require.True(t, errors.As(err, &failed), "%v", err)
+	assert.Len(t, failed.Hosts, 2)
+	assert.Contains(t, failed.Hosts, "http://127.0.0.1:1")
+	assert.Contains(t, failed.Hosts, "ftp://example.com")
+
+	var invalid *ErrInvalidURL
+	assert.True(t, errors.As(err, &invalid), "%v", err)
+	assert.Contains(t, err.Error(), "prewarm failed for 2 hosts: ftp://example.com: ")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&connections), "the hosts that could be reached are still warmed")
+}
+
+func TestPrewarmRespectsAllowedHosts(t *testing.T) {
+	var connections, heads int32
+	server := warmableServer(&connections, &heads)
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+	client.SetAllowedHosts([]string{"*.example.com"})
+
+	err := client.Prewarm(context.Background(), server.URL)
+
+	var failed *ErrPrewarmFailed
+	require.True(t, errors.As(err, &failed), "%v", err)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&connections))
+}
+
+func TestPrewarmThroughProxy(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	proxy := newConnectProxyServer(t, "", "")
+	client := proxiedClient(server, proxy.URL(), nil)
+
+	require.NoError(t, client.Prewarm(context.Background(), server.URL))
+	assert.Len(t, proxy.connects(), 1)
+
+	assert.True(t, reusedConnection(t, client, server.URL))
+	assert.Len(t, proxy.connects(), 1, "the request goes through the warmed tunnel")
+}
+
+func TestPrewarmRespectsContext(t *testing.T) {
+	var connections, heads int32
+	server := warmableServer(&connections, &heads)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := NewHTTPClient(1000).Prewarm(ctx, server.URL)
+
+	assert.True(t, errors.Is(err, context.Canceled), "%v", err)
+}
@@ -0,0 +1,47 @@
+// Package protocodec provides a heimdall.Codec for protocol buffer bodies.
+//
+// It lives outside the heimdall package so that clients which never speak
+// protobuf do not depend on it:
+//
+//	client.RegisterCodec(protocodec.New())
+package protocodec
+
+import (
+	"fmt"
+
+	"github.com/gojektech/heimdall"
+	"github.com/golang/protobuf/proto"
+)
+
+// ContentType is the content type the codec is registered for
+const ContentType = "application/x-protobuf"
+
+type codec struct{}
+
+// New returns a codec encoding proto.Message values in the protobuf wire
+// format. Marshalling or unmarshalling any other type fails.
+func New() heimdall.Codec {
+	return codec{}
+}
+
+func (codec) ContentType() string {
+	return ContentType
+}
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	message, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("protocodec: %T is not a proto.Message", v)
+	}
+
+	return proto.Marshal(message)
+}
+
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	message, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("protocodec: %T is not a proto.Message", v)
+	}
+
+	return proto.Unmarshal(data, message)
+}
@@ -0,0 +1,35 @@
+package protocodec
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type message struct {
+	Name string `protobuf:"bytes,1,opt,name=name,proto3"`
+}
+
+func (m *message) Reset()         { *m = message{} }
+func (m *message) String() string { return m.Name }
+func (m *message) ProtoMessage()  {}
+
+func TestCodecRoundTripsProtoMessages(t *testing.T) {
+	codec := New()
+
+	data, err := codec.Marshal(&message{Name: "widget"})
+	require.NoError(t, err)
+
+	var decoded message
+	require.NoError(t, codec.Unmarshal(data, &decoded))
+	assert.Equal(t, "widget", decoded.Name)
+}
+
+func TestCodecRejectsOtherTypes(t *testing.T) {
+	_, err := New().Marshal(struct{}{})
+	assert.EqualError(t, err, "protocodec: struct {} is not a proto.Message")
+
+	var decoded map[string]string
+	assert.Error(t, New().Unmarshal([]byte{}, &decoded))
+}
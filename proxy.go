@@ -0,0 +1,298 @@
+package heimdall
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ProxyAuthorizer answers the authentication challenge of a proxy refusing a
+// CONNECT request with 407 Proxy Authentication Required
+type ProxyAuthorizer interface {
+	// ProxyAuthorization returns the Proxy-Authorization header answering
+	// challenges, the Proxy-Authenticate headers of the 407 response
+	ProxyAuthorization(challenges []string) (string, error)
+}
+
+// ProxyAuthorizerFunc adapts a plain function to the ProxyAuthorizer interface
+type ProxyAuthorizerFunc func(challenges []string) (string, error)
+
+// ProxyAuthorization calls f(challenges)
+func (f ProxyAuthorizerFunc) ProxyAuthorization(challenges []string) (string, error) {
+	return f(challenges)
+}
+
+type basicProxyAuthorizer struct {
+	username, password string
+}
+
+// NewBasicProxyAuthorizer returns a ProxyAuthorizer answering Basic
+// challenges with username and password
+func NewBasicProxyAuthorizer(username, password string) ProxyAuthorizer {
+	return &basicProxyAuthorizer{username: username, password: password}
+}
+
+// ProxyAuthorization returns Basic credentials, failing when the proxy
+// offers another scheme only
+func (b *basicProxyAuthorizer) ProxyAuthorization(challenges []string) (string, error) {
+	for _, challenge := range challenges {
+		if scheme := strings.Fields(challenge); len(scheme) > 0 && strings.EqualFold(scheme[0], "Basic") {
+			return "Basic " + base64.StdEncoding.EncodeToString([]byte(b.username+":"+b.password)), nil
+		}
+	}
+
+	return "", errors.Errorf("unsupported proxy authentication challenge %q", strings.Join(challenges, ", "))
+}
+
+// ErrProxyConnect is returned when a tunnel to the target could not be set
+// up through the proxy given with WithProxy or WithSOCKS5Proxy, as opposed to
+// the target itself failing. Retriers can tell the two apart with errors.As.
+type ErrProxyConnect struct {
+	// Proxy is the address of the proxy
+	Proxy string
+	// Target is the address the tunnel was asked for
+	Target string
+	// StatusCode is the status the proxy refused the CONNECT with, or zero
+	// when it gave no answer or is a SOCKS5 proxy
+	StatusCode int
+
+	err error
+}
+
+func (e *ErrProxyConnect) Error() string {
+	if e.err == nil {
+		return fmt.Sprintf("proxy %s refused CONNECT to %s: %d %s", e.Proxy, e.Target, e.StatusCode, http.StatusText(e.StatusCode))
+	}
+
+	return fmt.Sprintf("proxy %s CONNECT to %s failed: %v", e.Proxy, e.Target, e.err)
+}
+
+// Cause returns the underlying error, if any
+func (e *ErrProxyConnect) Cause() error {
+	return e.err
+}
+
+// Unwrap returns the underlying error, if any
+func (e *ErrProxyConnect) Unwrap() error {
+	return e.err
+}
+
+// tunnelProxy opens connections to targets through a proxy, dialing the
+// proxy with dial
+type tunnelProxy interface {
+	dial(ctx context.Context, dial func(ctx context.Context, network, address string) (net.Conn, error), network, target string) (net.Conn, error)
+}
+
+type connectProxy struct {
+	address    string
+	authorizer ProxyAuthorizer
+}
+
+// WithProxy sends every request through a tunnel opened with CONNECT on the
+// http proxy at proxyURL, for https and http targets alike, replacing the
+// proxy settings of the environment; SetProxyBypass exempts hosts from it. A
+// proxy answering 407 gets one more CONNECT, with the credentials authorizer
+// returns for its challenge; Basic credentials in proxyURL are used when
+// authorizer is nil. Without a port in proxyURL, the proxy is dialed at 443
+// for https and at 80 otherwise. Failures to set up the tunnel are returned as
+// *ErrProxyConnect. Private network blocking cannot check the addresses the
+// proxy resolves, and the proxy is a setting of the transport, so clients
+// made with Derive keep that of the client they derive from.
+func WithProxy(proxyURL *url.URL, authorizer ProxyAuthorizer) Option {
+	return func(options *clientOptions) {
+		if authorizer == nil && proxyURL.User != nil {
+			password, _ := proxyURL.User.Password()
+			authorizer = NewBasicProxyAuthorizer(proxyURL.User.Username(), password)
+		}
+
+		address := proxyURL.Host
+		if proxyURL.Port() == "" {
+			port := "80"
+			if strings.EqualFold(proxyURL.Scheme, "https") {
+				port = "443"
+			}
+			address = net.JoinHostPort(proxyURL.Hostname(), port)
+		}
+		options.proxy = &connectProxy{address: address, authorizer: authorizer}
+	}
+}
+
+// dial opens a tunnel to target through the proxy, dialing the proxy with
+// dial. The CONNECT is sent again once with credentials when the proxy asks
+// for authentication.
+func (p *connectProxy) dial(ctx context.Context, dial func(ctx context.Context, network, address string) (net.Conn, error), network, target string) (net.Conn, error) {
+	authorization := ""
+	for try := 0; ; try++ {
+		conn, err := dial(ctx, network, p.address)
+		if err != nil {
+			return nil, &ErrProxyConnect{Proxy: p.address, Target: target, err: err}
+		}
+
+		tunnel, response, err := p.connect(ctx, conn, target, authorization)
+		if err != nil {
+			conn.Close()
+			return nil, &ErrProxyConnect{Proxy: p.address, Target: target, err: err}
+		}
+		if response.StatusCode == http.StatusOK {
+			return tunnel, nil
+		}
+		conn.Close()
+
+		if response.StatusCode != http.StatusProxyAuthRequired || p.authorizer == nil || try > 0 {
+			return nil, &ErrProxyConnect{Proxy: p.address, Target: target, StatusCode: response.StatusCode}
+		}
+
+		authorization, err = p.authorizer.ProxyAuthorization(response.Header.Values("Proxy-Authenticate"))
+		if err != nil {
+			return nil, &ErrProxyConnect{Proxy: p.address, Target: target, StatusCode: response.StatusCode, err: err}
+		}
+	}
+}
+
+// connect sends a CONNECT for target over conn and reads the answer of the
+// proxy, returning the connection to use for the tunnel
+func (p *connectProxy) connect(ctx context.Context, conn net.Conn, target, authorization string) (net.Conn, *http.Response, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: http.Header{},
+	}
+	if authorization != "" {
+		request.Header.Set("Proxy-Authorization", authorization)
+	}
+	if err := request.Write(conn); err != nil {
+		return nil, nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		return nil, nil, err
+	}
+	response.Body.Close()
+
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, response, nil
+	}
+
+	return conn, response, nil
+}
+
+// bufferedConn is a connection whose first bytes were read ahead into reader
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// proxyBypass is a pattern of SetProxyBypass, parsed
+type proxyBypass struct {
+	host    string
+	network *net.IPNet
+}
+
+// parseProxyBypass parses the patterns of SetProxyBypass, failing on the
+// first invalid one
+func parseProxyBypass(patterns []string) ([]proxyBypass, error) {
+	bypass := make([]proxyBypass, 0, len(patterns))
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if strings.Contains(pattern, "/") {
+			_, network, err := net.ParseCIDR(pattern)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid proxy bypass pattern %q", pattern)
+			}
+			bypass = append(bypass, proxyBypass{network: network})
+			continue
+		}
+
+		if !validBypassHost(pattern) {
+			return nil, errors.Errorf("invalid proxy bypass pattern %q", pattern)
+		}
+		bypass = append(bypass, proxyBypass{host: pattern})
+	}
+
+	return bypass, nil
+}
+
+// validBypassHost reports whether pattern is an IP address or a host pattern
+// hostMatches understands, rather than a URL or an address with a port
+func validBypassHost(pattern string) bool {
+	if net.ParseIP(pattern) != nil {
+		return true
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return false
+	}
+
+	return strings.Trim(pattern, ".") != "" && !strings.ContainsAny(pattern, " :@")
+}
+
+// setProxyBypass replaces the proxy bypass list, shared with clones as the
+// proxy is a setting of the transport
+func (g *hostGuard) setProxyBypass(patterns []string) error {
+	bypass, err := parseProxyBypass(patterns)
+	if err != nil {
+		return err
+	}
+
+	g.network.mu.Lock()
+	g.network.proxyBypass = bypass
+	g.network.mu.Unlock()
+
+	return nil
+}
+
+// bypassesProxy reports whether connections to address, a host with an
+// optional port, skip the proxy
+func (g *hostGuard) bypassesProxy(address string) bool {
+	g.network.mu.RLock()
+	bypass := g.network.proxyBypass
+	g.network.mu.RUnlock()
+
+	if len(bypass) == 0 {
+		return false
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	ip := net.ParseIP(host)
+
+	for _, pattern := range bypass {
+		switch {
+		case pattern.network != nil:
+			if ip != nil && pattern.network.Contains(ip) {
+				return true
+			}
+		case ip != nil && net.ParseIP(pattern.host) != nil:
+			if ip.Equal(net.ParseIP(pattern.host)) {
+				return true
+			}
+		case hostMatches(pattern.host, host):
+			return true
+		}
+	}
+
+	return false
+}
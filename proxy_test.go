@@ -0,0 +1,272 @@
+package heimdall
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// connectProxyServer is a CONNECT only proxy asking for authorization with
+// challenge until a CONNECT carries the expected Proxy-Authorization
+type connectProxyServer struct {
+	listener      net.Listener
+	challenge     string
+	authorization string
+
+	mu       sync.Mutex
+	received []string
+}
+
+func newConnectProxyServer(t *testing.T, challenge, authorization string) *connectProxyServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	proxy := &connectProxyServer{listener: listener, challenge: challenge, authorization: authorization}
+	go proxy.serve()
+	t.Cleanup(func() { listener.Close() })
+
+	return proxy
+}
+
+func (p *connectProxyServer) URL() *url.URL {
+	return &url.URL{Scheme: "http", Host: p.listener.Addr().String()}
+}
+
+func (p *connectProxyServer) serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		go p.handle(conn)
+	}
+}
+
+func (p *connectProxyServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	request, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		return
+	}
+	p.mu.Lock()
+	p.received = append(p.received, request.Method+" "+request.Host+" "+request.Header.Get("Proxy-Authorization"))
+	p.mu.Unlock()
+
+	if request.Method != http.MethodConnect {
+		io.WriteString(conn, "HTTP/1.1 405 Method Not Allowed\r\nContent-Length: 0\r\n\r\n")
+		return
+	}
+	if request.Header.Get("Proxy-Authorization") != p.authorization {
+		io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: "+p.challenge+"\r\nContent-Length: 0\r\n\r\n")
+		return
+	}
+
+	upstream, err := net.Dial("tcp", request.Host)
+	if err != nil {
+		io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+		return
+	}
+	defer upstream.Close()
+
+	io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+	go io.Copy(upstream, conn)
+	io.Copy(conn, upstream)
+}
+
+func (p *connectProxyServer) connects() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]string(nil), p.received...)
+}
+
+// proxiedClient returns a client trusting server and tunnelling through the
+// proxy at proxyURL
+func proxiedClient(server *httptest.Server, proxyURL *url.URL, authorizer ProxyAuthorizer) *HTTPClient {
+	client := NewHTTPClient(1000, WithProxy(proxyURL, authorizer))
+	client.current.client.Transport.(*http.Transport).TLSClientConfig = server.Client().Transport.(*http.Transport).TLSClientConfig
+
+	return client
+}
+
+func TestProxyTunnelsAfterBasicChallenge(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("through the tunnel"))
+	}))
+	defer server.Close()
+
+	proxy := newConnectProxyServer(t, `Basic realm="egress"`, "Basic YWxpY2U6c2VjcmV0")
+	proxyURL := proxy.URL()
+	proxyURL.User = url.UserPassword("alice", "secret")
+
+	response, err := proxiedClient(server, proxyURL, nil).Get(server.URL, http.Header{})
+	require.NoError(t, err)
+
+	assert.Equal(t, "through the tunnel", string(response.Body()))
+	target := server.Listener.Addr().String()
+	assert.Equal(t, []string{"CONNECT " + target + " ", "CONNECT " + target + " Basic YWxpY2U6c2VjcmV0"}, proxy.connects())
+}
+
+func TestProxyUsesCustomAuthorizer(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	proxy := newConnectProxyServer(t, `Token realm="egress"`, "Token abc")
+	var challenges []string
+	authorizer := ProxyAuthorizerFunc(func(offered []string) (string, error) {
+		challenges = offered
+		return "Token abc", nil
+	})
+
+	response, err := proxiedClient(server, proxy.URL(), authorizer).Get(server.URL, http.Header{})
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, response.StatusCode())
+	assert.Equal(t, []string{`Token realm="egress"`}, challenges)
+}
+
+func TestProxyRejectingCredentialsIsErrProxyConnect(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	proxy := newConnectProxyServer(t, `Basic realm="egress"`, "Basic c29tZW9uZTplbHNl")
+	proxyURL := proxy.URL()
+	proxyURL.User = url.UserPassword("alice", "wrong")
+
+	_, err := proxiedClient(server, proxyURL, nil).Get(server.URL, http.Header{})
+	require.Error(t, err)
+
+	var proxyErr *ErrProxyConnect
+	require.True(t, errors.As(err, &proxyErr), "%v", err)
+	assert.Equal(t, http.StatusProxyAuthRequired, proxyErr.StatusCode)
+	assert.Equal(t, server.Listener.Addr().String(), proxyErr.Target)
+	assert.Len(t, proxy.connects(), 2, "the CONNECT should only be retried once")
+}
+
+func TestProxyUnsupportedChallenge(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	proxy := newConnectProxyServer(t, `Negotiate`, "Negotiate abc")
+
+	_, err := proxiedClient(server, proxy.URL(), NewBasicProxyAuthorizer("alice", "secret")).Get(server.URL, http.Header{})
+	require.Error(t, err)
+
+	var proxyErr *ErrProxyConnect
+	require.True(t, errors.As(err, &proxyErr))
+	assert.Contains(t, err.Error(), `unsupported proxy authentication challenge "Negotiate"`)
+}
+
+func TestProxyDownIsNotAnUpstreamConnectError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := listener.Addr().String()
+	listener.Close()
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	_, err = proxiedClient(server, &url.URL{Scheme: "http", Host: address}, nil).Get(server.URL, http.Header{})
+	require.Error(t, err)
+
+	var proxyErr *ErrProxyConnect
+	require.True(t, errors.As(err, &proxyErr))
+	assert.Equal(t, address, proxyErr.Proxy)
+	assert.Equal(t, 0, proxyErr.StatusCode)
+	assert.False(t, errors.Is(err, ErrConnect))
+}
+
+func TestProxyAddressDefaultsToThePortOfItsScheme(t *testing.T) {
+	cases := map[string]string{
+		"http://proxy.internal":       "proxy.internal:80",
+		"https://proxy.internal":      "proxy.internal:443",
+		"HTTPS://proxy.internal":      "proxy.internal:443",
+		"https://proxy.internal:3128": "proxy.internal:3128",
+		"http://[fd00::1]":            "[fd00::1]:80",
+	}
+	for raw, address := range cases {
+		proxyURL, err := url.Parse(raw)
+		require.NoError(t, err)
+
+		options := newClientOptions([]Option{WithProxy(proxyURL, nil)})
+		assert.Equal(t, address, options.proxy.(*connectProxy).address, raw)
+	}
+}
+
+func TestProxyBypassConnectsDirectly(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	require.NoError(t, err)
+
+	cases := []struct {
+		bypass    []string
+		host      string
+		tunnelled bool
+	}{
+		{nil, "127.0.0.1", true},
+		{[]string{"localhost"}, "127.0.0.1", true},
+		{[]string{"localhost"}, "localhost", false},
+		{[]string{"metadata.internal", ".localhost"}, "localhost", false},
+		{[]string{"127.0.0.0/8"}, "127.0.0.1", false},
+		{[]string{"10.0.0.0/8", "::1"}, "127.0.0.1", true},
+		{[]string{"127.0.0.1"}, "127.0.0.1", false},
+		{[]string{"*"}, "127.0.0.1", false},
+	}
+	for _, c := range cases {
+		proxy := newConnectProxyServer(t, "", "")
+		client := NewHTTPClient(1000, WithProxy(proxy.URL(), nil))
+		require.NoError(t, client.SetProxyBypass(c.bypass))
+
+		response, err := client.Get("http://"+net.JoinHostPort(c.host, port), http.Header{})
+		require.NoError(t, err, "%v %s", c.bypass, c.host)
+		assert.Equal(t, "ok", string(response.Body()))
+
+		if c.tunnelled {
+			assert.Equal(t, []string{"CONNECT " + net.JoinHostPort(c.host, port) + " "}, proxy.connects(), "%v %s", c.bypass, c.host)
+		} else {
+			assert.Empty(t, proxy.connects(), "%v %s", c.bypass, c.host)
+		}
+	}
+}
+
+func TestProxyBypassRejectsInvalidPatterns(t *testing.T) {
+	proxy := newConnectProxyServer(t, "", "")
+	client := NewHTTPClient(1000, WithProxy(proxy.URL(), nil))
+	require.NoError(t, client.SetProxyBypass([]string{"*"}))
+
+	for _, pattern := range []string{"10.0.0.0/33", "", "http://sidecar", "sidecar:8080", "side[car", "."} {
+		err := client.SetProxyBypass([]string{"localhost", pattern})
+		assert.Error(t, err, "%q", pattern)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	_, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+	assert.Empty(t, proxy.connects(), "the previous list is kept")
+}
+
+func TestProxyBypassIsSharedWithDerivedClients(t *testing.T) {
+	guard := newHostGuard()
+	derived := guard.clone()
+	require.NoError(t, guard.setProxyBypass([]string{".internal.corp", "fd00::/8"}))
+
+	assert.True(t, derived.bypassesProxy("api.internal.corp:443"))
+	assert.True(t, derived.bypassesProxy("internal.corp"))
+	assert.True(t, derived.bypassesProxy("[fd00::1]:80"))
+	assert.False(t, derived.bypassesProxy("internal.corp.example.com:443"))
+	assert.False(t, derived.bypassesProxy("[fe80::1]:80"))
+}
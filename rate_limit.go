@@ -0,0 +1,119 @@
+package heimdall
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultRateLimitCooldown is the cooldown after a 429 advertising no reset
+const defaultRateLimitCooldown = time.Second
+
+// RateLimitMode decides what becomes of requests to a host cooling down
+// after a 429 Too Many Requests
+type RateLimitMode int
+
+const (
+	// RateLimitFail fails requests with an *ErrRateLimited until the
+	// cooldown has passed
+	RateLimitFail RateLimitMode = iota
+	// RateLimitQueue holds requests until the cooldown has passed, or their
+	// context is done
+	RateLimitQueue
+)
+
+// ErrRateLimited is returned without sending the request when its host
+// answered an earlier request with 429 Too Many Requests and the advertised
+// window has not passed yet
+type ErrRateLimited struct {
+	// Host is the host cooling down
+	Host string
+	// ResetAt is when requests to Host are sent again
+	ResetAt time.Time
+}
+
+func (e *ErrRateLimited) Error() string {
+	return fmt.Sprintf("rate limited by %s until %s", e.Host, e.ResetAt.Format(time.RFC3339))
+}
+
+type rateLimitCooldown struct {
+	mode RateLimitMode
+
+	mu      sync.Mutex
+	resetAt map[string]time.Time
+}
+
+// WithRateLimitCooldown stops sending requests to a host once it answers 429
+// Too Many Requests, for the window advertised by the Retry-After or the
+// X-RateLimit-Reset header, or a second when it gives none. What becomes of
+// requests in the meantime is decided by mode. The server is healthy, so
+// requests held back are not hystrix or failure detector errors, and the 429
+// itself is returned as the response of its request as before. Clients made
+// with Derive share the cooldowns.
+func WithRateLimitCooldown(mode RateLimitMode) Option {
+	return func(options *clientOptions) {
+		options.rateLimits = &rateLimitCooldown{mode: mode, resetAt: map[string]time.Time{}}
+	}
+}
+
+// until returns when host may be sent requests again, reporting false when
+// it is not cooling down at now
+func (c *rateLimitCooldown) until(host string, now time.Time) (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	resetAt, ok := c.resetAt[host]
+	if !ok {
+		return time.Time{}, false
+	}
+	if !now.Before(resetAt) {
+		delete(c.resetAt, host)
+		return time.Time{}, false
+	}
+
+	return resetAt, true
+}
+
+// observe starts a cooldown of host when response is a 429
+func (c *rateLimitCooldown) observe(host string, response Response, now time.Time) {
+	if response.StatusCode() != http.StatusTooManyRequests {
+		return
+	}
+
+	resetAt := rateLimitReset(response.headers, now)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if resetAt.After(c.resetAt[host]) {
+		c.resetAt[host] = resetAt
+	}
+}
+
+// rateLimitReset returns when the window advertised by headers resets.
+// Retry-After is given in seconds or as a HTTP date, X-RateLimit-Reset in
+// seconds or as a Unix time.
+func rateLimitReset(headers http.Header, now time.Time) time.Time {
+	if value := strings.TrimSpace(headers.Get("Retry-After")); value != "" {
+		if seconds, err := strconv.ParseInt(value, 10, 64); err == nil && seconds >= 0 {
+			return now.Add(time.Duration(seconds) * time.Second)
+		}
+		if date, err := http.ParseTime(value); err == nil {
+			return date
+		}
+	}
+
+	if value := strings.TrimSpace(headers.Get("X-RateLimit-Reset")); value != "" {
+		if seconds, err := strconv.ParseInt(value, 10, 64); err == nil && seconds >= 0 {
+			if seconds > unixTimeThreshold {
+				return time.Unix(seconds, 0)
+			}
+			return now.Add(time.Duration(seconds) * time.Second)
+		}
+	}
+
+	return now.Add(defaultRateLimitCooldown)
+}
@@ -0,0 +1,170 @@
+package heimdall
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// unixTimeThreshold tells Unix times from windows in seconds, which are far
+// smaller than any Unix time
+const unixTimeThreshold = 1e9
+
+// RateLimitResetFormat is how a rate limit scheme gives the reset of its
+// window
+type RateLimitResetFormat int
+
+const (
+	// RateLimitResetAuto reads seconds until the reset or a Unix time, told
+	// apart by their size, or a HTTP date
+	RateLimitResetAuto RateLimitResetFormat = iota
+	// RateLimitResetDelta reads seconds until the reset
+	RateLimitResetDelta
+	// RateLimitResetUnix reads the Unix time of the reset, in seconds
+	RateLimitResetUnix
+)
+
+// RateLimitScheme names the response headers a family of APIs advertise
+// their rate limits in
+type RateLimitScheme struct {
+	Limit     string
+	Remaining string
+	Reset     string
+	// ResetFormat is how Reset is given
+	ResetFormat RateLimitResetFormat
+}
+
+// RateLimitInfo is the rate limit a response advertised
+type RateLimitInfo struct {
+	// Scheme is the name of the scheme the headers were read with
+	Scheme string
+	// Limit is the number of requests allowed in the window, 0 when not
+	// advertised
+	Limit int
+	// Remaining is the number of requests left in the window
+	Remaining int
+	// Reset is when the window resets, zero when not advertised
+	Reset time.Time
+}
+
+// namedRateLimitScheme is a scheme registered under its name
+type namedRateLimitScheme struct {
+	name string
+	RateLimitScheme
+}
+
+var (
+	rateLimitSchemesMu sync.RWMutex
+	// rateLimitSchemes are tried in order, the built-in ones first: the IETF
+	// RateLimit headers, the X-RateLimit ones of GitHub and many others, and
+	// the X-Rate-Limit ones of Twitter
+	rateLimitSchemes = []namedRateLimitScheme{
+		{name: "ratelimit", RateLimitScheme: RateLimitScheme{Limit: "RateLimit-Limit", Remaining: "RateLimit-Remaining", Reset: "RateLimit-Reset", ResetFormat: RateLimitResetDelta}},
+		{name: "x-ratelimit", RateLimitScheme: RateLimitScheme{Limit: "X-RateLimit-Limit", Remaining: "X-RateLimit-Remaining", Reset: "X-RateLimit-Reset"}},
+		{name: "x-rate-limit", RateLimitScheme: RateLimitScheme{Limit: "X-Rate-Limit-Limit", Remaining: "X-Rate-Limit-Remaining", Reset: "X-Rate-Limit-Reset", ResetFormat: RateLimitResetUnix}},
+	}
+)
+
+// RegisterRateLimitScheme registers scheme under name, for Response.RateLimit
+// to read rate limits from its headers, replacing the scheme already
+// registered under name, built-in ones included. Schemes are tried in the
+// order they were first registered, after the built-in ratelimit,
+// x-ratelimit and x-rate-limit ones, and registering one applies to every
+// client of the process.
+func RegisterRateLimitScheme(name string, scheme RateLimitScheme) error {
+	if name == "" || scheme.Remaining == "" {
+		return fmt.Errorf("heimdall: a rate limit scheme needs a name and a Remaining header")
+	}
+
+	rateLimitSchemesMu.Lock()
+	defer rateLimitSchemesMu.Unlock()
+
+	for i, registered := range rateLimitSchemes {
+		if registered.name == name {
+			rateLimitSchemes[i].RateLimitScheme = scheme
+			return nil
+		}
+	}
+	rateLimitSchemes = append(rateLimitSchemes, namedRateLimitScheme{name: name, RateLimitScheme: scheme})
+
+	return nil
+}
+
+// RateLimit reads the rate limit the response advertised with the first
+// registered scheme whose Remaining header it carries and can be read. The
+// headers are only parsed when it is called. Limits and resets that are
+// missing or malformed are left zero, and seconds until the reset count from
+// the Date of the response, or from when it was received on the clock of the
+// client, and are left zero too for a response no client received.
+func (hr Response) RateLimit() (*RateLimitInfo, bool) {
+	if len(hr.headers) == 0 {
+		return nil, false
+	}
+
+	rateLimitSchemesMu.RLock()
+	defer rateLimitSchemesMu.RUnlock()
+
+	for _, scheme := range rateLimitSchemes {
+		remaining, ok := headerCount(hr.headers, scheme.Remaining)
+		if !ok {
+			continue
+		}
+
+		info := &RateLimitInfo{Scheme: scheme.name, Remaining: remaining}
+		info.Limit, _ = headerCount(hr.headers, scheme.Limit)
+		if scheme.Reset != "" {
+			info.Reset = rateLimitResetTime(hr.headers.Get(scheme.Reset), scheme.ResetFormat, hr.receivedAt())
+		}
+		return info, true
+	}
+
+	return nil, false
+}
+
+// receivedAt returns the Date of the response, or when the attempt that
+// returned it ended on the clock of the client, or the zero time for a
+// response no client received
+func (hr Response) receivedAt() time.Time {
+	if date, err := http.ParseTime(hr.headers.Get("Date")); err == nil {
+		return date
+	}
+
+	return hr.received
+}
+
+// headerCount returns the non-negative integer header name starts with,
+// ignoring quota policies such as `100, 100;w=60` after it
+func headerCount(headers http.Header, name string) (int, bool) {
+	value := headers.Get(name)
+	if end := strings.IndexAny(value, ",;"); end >= 0 {
+		value = value[:end]
+	}
+
+	count, err := strconv.Atoi(strings.TrimSpace(value))
+	return count, err == nil && count >= 0
+}
+
+// rateLimitResetTime returns the reset value gives in format, counting
+// seconds from received, or the zero time when value cannot be read
+func rateLimitResetTime(value string, format RateLimitResetFormat, received time.Time) time.Time {
+	value = strings.TrimSpace(value)
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		if date, err := http.ParseTime(value); err == nil && format == RateLimitResetAuto {
+			return date
+		}
+		return time.Time{}
+	}
+
+	if format == RateLimitResetUnix || format == RateLimitResetAuto && seconds > unixTimeThreshold {
+		return time.Unix(seconds, 0)
+	}
+	if received.IsZero() {
+		return time.Time{}
+	}
+
+	return received.Add(time.Duration(seconds) * time.Second)
+}
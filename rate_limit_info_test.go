@@ -0,0 +1,113 @@
+package heimdall
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var rateLimitDate = time.Date(2018, time.January, 19, 22, 0, 0, 0, time.UTC)
+
+func TestRateLimitReadsTheStandardHeaders(t *testing.T) {
+	response := Response{headers: http.Header{
+		"Date":                {rateLimitDate.Format(http.TimeFormat)},
+		"Ratelimit-Limit":     {"100, 100;w=60"},
+		"Ratelimit-Remaining": {"42"},
+		"Ratelimit-Reset":     {"30"},
+	}}
+
+	info, ok := response.RateLimit()
+	require.True(t, ok)
+	assert.Equal(t, &RateLimitInfo{Scheme: "ratelimit", Limit: 100, Remaining: 42, Reset: rateLimitDate.Add(30 * time.Second)}, info)
+}
+
+func TestRateLimitReadsGitHubHeaders(t *testing.T) {
+	reset := rateLimitDate.Add(time.Hour)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Limit", "5000")
+		w.Header().Set("X-RateLimit-Remaining", "4999")
+		w.Header().Set("X-RateLimit-Reset", "1516402800")
+		w.Header().Set("X-RateLimit-Used", "1")
+	}))
+	defer server.Close()
+
+	response, err := NewHTTPClient(1000).Get(server.URL, http.Header{})
+	require.NoError(t, err)
+
+	info, ok := response.RateLimit()
+	require.True(t, ok)
+	assert.Equal(t, "x-ratelimit", info.Scheme)
+	assert.Equal(t, 5000, info.Limit)
+	assert.Equal(t, 4999, info.Remaining)
+	assert.True(t, reset.Equal(info.Reset), "epoch resets are read as Unix times: %v", info.Reset)
+}
+
+func TestRateLimitResetInSecondsCountsFromReceipt(t *testing.T) {
+	response := Response{
+		headers:  http.Header{"X-Ratelimit-Remaining": {"0"}, "X-Ratelimit-Reset": {"60"}},
+		received: rateLimitDate,
+	}
+
+	info, ok := response.RateLimit()
+	require.True(t, ok)
+	assert.Equal(t, 0, info.Remaining)
+	assert.Equal(t, 0, info.Limit, "a missing limit is left zero")
+	assert.Equal(t, rateLimitDate.Add(time.Minute), info.Reset, "without a Date the reset counts from when the response was received")
+
+	response.headers.Set("X-Ratelimit-Reset", rateLimitDate.Format(http.TimeFormat))
+	info, _ = response.RateLimit()
+	assert.Equal(t, rateLimitDate, info.Reset, "HTTP dates are read as they are")
+}
+
+func TestRateLimitReadsRegisteredSchemes(t *testing.T) {
+	require.NoError(t, RegisterRateLimitScheme("test-quota", RateLimitScheme{
+		Limit:       "X-Quota-Total",
+		Remaining:   "X-Quota-Left",
+		Reset:       "X-Quota-Renews",
+		ResetFormat: RateLimitResetUnix,
+	}))
+	assert.Error(t, RegisterRateLimitScheme("", RateLimitScheme{Remaining: "X-Left"}))
+	assert.Error(t, RegisterRateLimitScheme("no-remaining", RateLimitScheme{Limit: "X-Limit"}))
+
+	response := Response{headers: http.Header{"X-Quota-Total": {"10"}, "X-Quota-Left": {"3"}, "X-Quota-Renews": {"600"}}}
+	info, ok := response.RateLimit()
+	require.True(t, ok)
+	assert.Equal(t, &RateLimitInfo{Scheme: "test-quota", Limit: 10, Remaining: 3, Reset: time.Unix(600, 0)}, info,
+		"resets of Unix time schemes are never read as seconds")
+
+	require.NoError(t, RegisterRateLimitScheme("test-quota", RateLimitScheme{Remaining: "X-Quota-Left"}))
+	info, ok = response.RateLimit()
+	require.True(t, ok)
+	assert.Equal(t, &RateLimitInfo{Scheme: "test-quota", Remaining: 3}, info, "registering a name again replaces its scheme")
+}
+
+func TestRateLimitToleratesGarbage(t *testing.T) {
+	for _, headers := range []http.Header{
+		nil,
+		{},
+		{"X-Ratelimit-Limit": {"100"}},
+		{"X-Ratelimit-Remaining": {"lots"}},
+		{"X-Ratelimit-Remaining": {"-1"}},
+		{"X-Ratelimit-Remaining": {""}},
+	} {
+		_, ok := Response{headers: headers}.RateLimit()
+		assert.False(t, ok, "%v", headers)
+	}
+
+	info, ok := Response{headers: http.Header{
+		"Date":                  {"yesterday"},
+		"X-Ratelimit-Limit":     {"a hundred"},
+		"X-Ratelimit-Remaining": {" 7 "},
+		"X-Ratelimit-Reset":     {"soon"},
+	}}.RateLimit()
+	require.True(t, ok)
+	assert.Equal(t, &RateLimitInfo{Scheme: "x-ratelimit", Remaining: 7}, info, "malformed limits and resets are left zero")
+
+	info, ok = Response{headers: http.Header{"Ratelimit-Remaining": {"5"}, "Ratelimit-Reset": {"-30"}}}.RateLimit()
+	require.True(t, ok)
+	assert.True(t, info.Reset.IsZero())
+}
@@ -0,0 +1,167 @@
+package heimdall
+
+import (
+	"errors"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gojektech/heimdall/fakeclock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// quotaServer allows quota requests per window, answering the rest with 429
+// and a Retry-After of the window
+type quotaServer struct {
+	*httptest.Server
+	quota    int32
+	served   int32
+	received int32
+}
+
+func newQuotaServer(quota int32, window time.Duration) *quotaServer {
+	s := &quotaServer{quota: quota}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&s.received, 1)
+		if atomic.AddInt32(&s.served, 1) > s.quota {
+			w.Header().Set("Retry-After", strconv.Itoa(int(window/time.Second)))
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+	}))
+
+	return s
+}
+
+// resetWindow starts a new quota window
+func (s *quotaServer) resetWindow() {
+	atomic.StoreInt32(&s.served, 0)
+}
+
+func TestRateLimitCooldownFailsFastUntilReset(t *testing.T) {
+	for name, newClient := range retryClients {
+		t.Run(name, func(t *testing.T) {
+			server := newQuotaServer(2, time.Minute)
+			defer server.Close()
+
+			start := time.Date(2018, time.January, 19, 22, 0, 0, 0, time.UTC)
+			clock := fakeclock.New(start)
+			client := derive(newClient(uniqueName("rate_limit_"+name), clock), WithRateLimitCooldown(RateLimitFail))
+			prefix := uniqueName("heimdall_rate_limit_test_" + name)
+			client.EnableExpvar(prefix)
+
+			for i := 0; i < 2; i++ {
+				response, err := client.Get(server.URL, http.Header{})
+				require.NoError(t, err)
+				require.Equal(t, http.StatusOK, response.StatusCode())
+			}
+
+			response, err := client.Get(server.URL, http.Header{})
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusTooManyRequests, response.StatusCode())
+
+			for i := 0; i < 5; i++ {
+				_, err = client.Get(server.URL, http.Header{})
+
+				var limited *ErrRateLimited
+				require.True(t, errors.As(err, &limited), "%v", err)
+				assert.Equal(t, start.Add(time.Minute), limited.ResetAt)
+				assert.Equal(t, server.Listener.Addr().String(), limited.Host)
+			}
+			assert.Equal(t, int32(3), atomic.LoadInt32(&server.received), "cooling requests should not reach the server")
+			assert.Equal(t, "5", expvar.Get(prefix+".rate_limited").String())
+
+			clock.Advance(time.Minute)
+			server.resetWindow()
+
+			response, err = client.Get(server.URL, http.Header{})
+			require.NoError(t, err, "rate limited requests should not open the circuit")
+			assert.Equal(t, http.StatusOK, response.StatusCode())
+		})
+	}
+}
+
+func TestRateLimitCooldownDoesNotTripCircuit(t *testing.T) {
+	server := newQuotaServer(1, time.Minute)
+	defer server.Close()
+
+	clock := fakeclock.New(time.Now())
+	client := NewHystrixHTTPClient(1000, openOnFirstFailure("rate_limit_circuit_command"),
+		WithClock(clock), WithRateLimitCooldown(RateLimitFail))
+
+	client.Get(server.URL, http.Header{})
+	client.Get(server.URL, http.Header{})
+	for i := 0; i < 3; i++ {
+		_, err := client.Get(server.URL, http.Header{})
+		require.IsType(t, &ErrRateLimited{}, err)
+	}
+
+	clock.Advance(time.Minute)
+	server.resetWindow()
+
+	response, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode())
+}
+
+func TestRateLimitCooldownQueuesUntilReset(t *testing.T) {
+	server := newQuotaServer(1, 30*time.Second)
+	defer server.Close()
+
+	clock := fakeclock.New(time.Now())
+	client := NewHTTPClient(1000, WithClock(clock), WithRateLimitCooldown(RateLimitQueue))
+
+	client.Get(server.URL, http.Header{})
+	response, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusTooManyRequests, response.StatusCode())
+
+	server.resetWindow()
+	response, err = client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, response.StatusCode())
+	assert.Equal(t, []time.Duration{30 * time.Second}, clock.Sleeps())
+}
+
+func TestRateLimitCooldownIsPerHost(t *testing.T) {
+	limited := newQuotaServer(0, time.Minute)
+	defer limited.Close()
+	other := newQuotaServer(10, time.Minute)
+	defer other.Close()
+
+	client := NewHTTPClient(1000, WithRateLimitCooldown(RateLimitFail))
+
+	client.Get(limited.URL, http.Header{})
+	_, err := client.Get(limited.URL, http.Header{})
+	assert.IsType(t, &ErrRateLimited{}, err)
+
+	_, err = client.Get(other.URL, http.Header{})
+	assert.NoError(t, err)
+}
+
+func TestRateLimitReset(t *testing.T) {
+	now := time.Date(2018, time.January, 19, 22, 0, 0, 0, time.UTC)
+
+	cases := map[string]struct {
+		headers http.Header
+		reset   time.Time
+	}{
+		"retry_after_seconds": {http.Header{"Retry-After": {"120"}}, now.Add(2 * time.Minute)},
+		"retry_after_date":    {http.Header{"Retry-After": {"Fri, 19 Jan 2018 22:05:00 GMT"}}, now.Add(5 * time.Minute)},
+		"reset_seconds":       {http.Header{"X-Ratelimit-Reset": {"45"}}, now.Add(45 * time.Second)},
+		"reset_unix_time":     {http.Header{"X-Ratelimit-Reset": {strconv.FormatInt(now.Add(time.Hour).Unix(), 10)}}, now.Add(time.Hour)},
+		"none":                {http.Header{}, now.Add(time.Second)},
+		"malformed":           {http.Header{"Retry-After": {"soon"}}, now.Add(time.Second)},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			assert.True(t, tc.reset.Equal(rateLimitReset(tc.headers, now)), "got %v", rateLimitReset(tc.headers, now))
+		})
+	}
+}
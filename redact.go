@@ -0,0 +1,78 @@
+package heimdall
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+)
+
+const redactedMarker = "[REDACTED]"
+
+var defaultSensitiveHeaders = []string{"Authorization", "Cookie", "Set-Cookie", "X-Api-Key"}
+
+// headerRedactor replaces the values of sensitive headers wherever request
+// or response details leave the client: errors, debug output and hooks
+type headerRedactor struct {
+	mu        sync.RWMutex
+	sensitive map[string]bool
+}
+
+func newHeaderRedactor() *headerRedactor {
+	r := &headerRedactor{}
+	r.setSensitiveHeaders(defaultSensitiveHeaders...)
+
+	return r
+}
+
+func (r *headerRedactor) setSensitiveHeaders(names ...string) {
+	sensitive := make(map[string]bool, len(names))
+	for _, name := range names {
+		sensitive[http.CanonicalHeaderKey(name)] = true
+	}
+
+	r.mu.Lock()
+	r.sensitive = sensitive
+	r.mu.Unlock()
+}
+
+// clone returns a redactor with its own copy of the sensitive headers
+func (r *headerRedactor) clone() *headerRedactor {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return &headerRedactor{sensitive: r.sensitive}
+}
+
+func (r *headerRedactor) isSensitive(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.sensitive[http.CanonicalHeaderKey(name)]
+}
+
+// redact returns a copy of headers with sensitive values replaced
+func (r *headerRedactor) redact(headers http.Header) http.Header {
+	redacted := make(http.Header, len(headers))
+	for name, values := range headers {
+		if !r.isSensitive(name) {
+			redacted[name] = append([]string(nil), values...)
+			continue
+		}
+
+		redacted[name] = make([]string, len(values))
+		for i, value := range values {
+			redacted[name][i] = redactValue(value)
+		}
+	}
+
+	return redacted
+}
+
+// redactValue replaces value with a fixed marker followed by a short hash, so
+// distinct credentials remain distinguishable in logs without being exposed
+func redactValue(value string) string {
+	sum := sha256.Sum256([]byte(value))
+
+	return redactedMarker + ":" + hex.EncodeToString(sum[:4])
+}
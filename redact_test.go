@@ -0,0 +1,63 @@
+package heimdall
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactHeadersRedactsDefaultSensitiveHeaders(t *testing.T) {
+	client := NewHTTPClient(10)
+
+	headers := http.Header{}
+	headers.Set("Authorization", "Bearer secret-token")
+	headers.Set("X-Api-Key", "key-1")
+	headers.Add("Cookie", "session=abc")
+	headers.Set("Content-Type", "application/json")
+
+	redacted := client.RedactHeaders(headers)
+
+	for _, name := range []string{"Authorization", "X-Api-Key", "Cookie"} {
+		assert.True(t, strings.HasPrefix(redacted.Get(name), "[REDACTED]:"), name)
+		assert.NotContains(t, redacted.Get(name), headers.Get(name))
+	}
+	assert.Equal(t, "application/json", redacted.Get("Content-Type"))
+
+	assert.Equal(t, "Bearer secret-token", headers.Get("Authorization"), "original headers should be untouched")
+}
+
+func TestRedactedValuesOfDistinctCredentialsDiffer(t *testing.T) {
+	client := NewHystrixHTTPClient(10, NewHystrixConfig("redact_command", HystrixCommandConfig{}))
+
+	first := http.Header{"Authorization": []string{"Bearer one"}}
+	second := http.Header{"Authorization": []string{"Bearer two"}}
+
+	assert.NotEqual(t, client.RedactHeaders(first).Get("Authorization"), client.RedactHeaders(second).Get("Authorization"))
+	assert.Equal(t, client.RedactHeaders(first).Get("Authorization"), client.RedactHeaders(first).Get("Authorization"))
+}
+
+func TestSetSensitiveHeadersReplacesDefaults(t *testing.T) {
+	client := NewHTTPClient(10)
+	client.SetSensitiveHeaders("x-partner-token")
+
+	headers := http.Header{}
+	headers.Set("Authorization", "Bearer secret-token")
+	headers.Set("X-Partner-Token", "partner")
+
+	redacted := client.RedactHeaders(headers)
+
+	assert.Equal(t, "Bearer secret-token", redacted.Get("Authorization"))
+	assert.Equal(t, redactValue("partner"), redacted.Get("X-Partner-Token"))
+}
+
+func TestRedactHeadersRedactsEveryValue(t *testing.T) {
+	headers := http.Header{}
+	headers.Add("Set-Cookie", "a=1")
+	headers.Add("Set-Cookie", "b=2")
+
+	redacted := newHeaderRedactor().redact(headers)
+
+	assert.Equal(t, []string{redactValue("a=1"), redactValue("b=2")}, redacted["Set-Cookie"])
+}
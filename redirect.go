@@ -0,0 +1,86 @@
+package heimdall
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// defaultMaxRedirects is the number of redirects an attempt follows unless
+// SetMaxRedirects sets another
+const defaultMaxRedirects = 10
+
+// RedirectHop is a redirect an attempt followed
+type RedirectHop struct {
+	// URL is the URL that answered with the redirect, its password masked
+	URL        string `json:"url"`
+	StatusCode int    `json:"status_code"`
+	// Location is the Location header of the redirect, as the server sent it
+	Location string `json:"location"`
+	// AuthForwarded reports whether the request sent to Location carried an
+	// Authorization header, which is stripped for redirects to other domains
+	AuthForwarded bool `json:"auth_forwarded,omitempty"`
+	// CookiesForwarded reports whether the request sent to Location carried
+	// the Cookie header of the request, which is stripped alike. Cookies of a
+	// cookie jar are added after and not reported.
+	CookiesForwarded bool `json:"cookies_forwarded,omitempty"`
+}
+
+// ErrTooManyRedirects is returned when an attempt is redirected more times
+// than SetMaxRedirects allows. It is not retried.
+type ErrTooManyRedirects struct {
+	// Max is the number of redirects allowed
+	Max int
+	// Chain are the redirects followed, the refused one last
+	Chain []RedirectHop
+}
+
+func (e *ErrTooManyRedirects) Error() string {
+	return fmt.Sprintf("stopped after %d redirects", e.Max)
+}
+
+// RedirectChain returns the redirects the last attempt followed, in order,
+// which it records whether it ended with a response or an error
+func (hr Response) RedirectChain() []RedirectHop {
+	if len(hr.attempts) == 0 {
+		return nil
+	}
+
+	return append([]RedirectHop(nil), hr.attempts[len(hr.attempts)-1].Redirects...)
+}
+
+// redirectChain returns the hops of the redirects via led to, request being
+// the one about to be sent to the Location of the last
+func redirectChain(request *http.Request, via []*http.Request) []RedirectHop {
+	chain := make([]RedirectHop, 0, len(via))
+	for i, from := range via {
+		next := request
+		if i+1 < len(via) {
+			next = via[i+1]
+		}
+
+		hop := RedirectHop{
+			URL:              redactUserinfo(from.URL.String()),
+			AuthForwarded:    next.Header.Get("Authorization") != "",
+			CookiesForwarded: next.Header.Get("Cookie") != "",
+		}
+		if next.Response != nil {
+			hop.StatusCode = next.Response.StatusCode
+			hop.Location = next.Response.Header.Get("Location")
+		}
+		chain = append(chain, hop)
+	}
+
+	return chain
+}
+
+// tooManyRedirectsError extracts an ErrTooManyRedirects from a transport
+// error
+func tooManyRedirectsError(err error) *ErrTooManyRedirects {
+	var tooMany *ErrTooManyRedirects
+	if errors.As(err, &tooMany) {
+		return tooMany
+	}
+
+	return nil
+}
@@ -0,0 +1,136 @@
+package heimdall
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// hopServer redirects /hop/{n} to /hop/{n-1} with a 302, and answers /hop/0
+// with 200, counting requests into hits
+func hopServer(hits *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/hop/"))
+		if n > 0 {
+			http.Redirect(w, r, "/hop/"+strconv.Itoa(n-1), http.StatusFound)
+			return
+		}
+		w.Write([]byte("arrived"))
+	}))
+}
+
+// hops returns the chain of redirects from /hop/{from} down to /hop/{to+1}
+func hops(server *httptest.Server, from, to int) []RedirectHop {
+	var chain []RedirectHop
+	for n := from; n > to; n-- {
+		chain = append(chain, RedirectHop{
+			URL:        server.URL + "/hop/" + strconv.Itoa(n),
+			StatusCode: http.StatusFound,
+			Location:   "/hop/" + strconv.Itoa(n-1),
+		})
+	}
+
+	return chain
+}
+
+func TestRedirectChainRecordsEveryHop(t *testing.T) {
+	var hits int32
+	server := hopServer(&hits)
+	defer server.Close()
+
+	for kind, newClient := range retryClients {
+		client := newClient("redirect_chain_"+kind, realClock{})
+		client.SetMaxRedirects(5)
+
+		response, err := client.Get(server.URL+"/hop/5", http.Header{})
+		require.NoError(t, err, kind)
+		assert.Equal(t, "arrived", string(response.Body()), kind)
+		assert.Equal(t, hops(server, 5, 0), response.RedirectChain(), kind)
+		assert.Equal(t, hops(server, 5, 0), response.Trace().Attempts[0].Redirects, kind)
+
+		response, err = client.Get(server.URL+"/hop/0", http.Header{})
+		require.NoError(t, err, kind)
+		assert.Empty(t, response.RedirectChain(), "%s: requests without redirects have no chain", kind)
+	}
+}
+
+func TestRedirectsBeyondTheMaximumFailTheRequest(t *testing.T) {
+	var hits int32
+	server := hopServer(&hits)
+	defer server.Close()
+
+	for kind, newClient := range retryClients {
+		atomic.StoreInt32(&hits, 0)
+		client := newClient("redirect_max_"+kind, realClock{})
+		client.SetRetryCount(2)
+		client.SetMaxRedirects(3)
+
+		response, err := client.Get(server.URL+"/hop/5", http.Header{})
+		var tooMany *ErrTooManyRedirects
+		require.True(t, errors.As(err, &tooMany), "%s: %v", kind, err)
+		assert.Equal(t, 3, tooMany.Max, kind)
+		assert.Equal(t, hops(server, 5, 1), tooMany.Chain, "%s: the refused redirect ends the chain", kind)
+		assert.EqualError(t, err, "stopped after 3 redirects", kind)
+		assert.Equal(t, tooMany.Chain, response.RedirectChain(), "%s: the chain is kept on the failed response", kind)
+		assert.Equal(t, int32(4), atomic.LoadInt32(&hits), "%s: too many redirects are not retried", kind)
+
+		derive(client).SetMaxRedirects(10)
+		_, err = client.Get(server.URL+"/hop/5", http.Header{})
+		assert.True(t, errors.As(err, &tooMany), "%s: derived clients have a maximum of their own", kind)
+	}
+}
+
+func TestRedirectChainAcrossHostsStripsCredentials(t *testing.T) {
+	var forwarded http.Header
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Clone()
+	}))
+	defer other.Close()
+	otherURL := strings.Replace(other.URL, "127.0.0.1", "localhost", 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			http.Redirect(w, r, "/account", http.StatusMovedPermanently)
+			return
+		}
+		http.Redirect(w, r, otherURL+"/landing", http.StatusTemporaryRedirect)
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+	response, err := client.Get(server.URL+"/login", http.Header{
+		"Authorization": {"Bearer token"},
+		"Cookie":        {"session=abc"},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, []RedirectHop{
+		{URL: server.URL + "/login", StatusCode: http.StatusMovedPermanently, Location: "/account", AuthForwarded: true, CookiesForwarded: true},
+		{URL: server.URL + "/account", StatusCode: http.StatusTemporaryRedirect, Location: otherURL + "/landing"},
+	}, response.RedirectChain())
+	assert.Empty(t, forwarded.Get("Authorization"), "credentials are not sent to another host")
+	assert.Empty(t, forwarded.Get("Cookie"))
+}
+
+func TestRedirectChainIsKeptWhenTheLastHopFails(t *testing.T) {
+	closed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closedURL := closed.URL
+	closed.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, closedURL+"/gone", http.StatusFound)
+	}))
+	defer server.Close()
+
+	response, err := NewHTTPClient(1000).Get(server.URL+"/start", http.Header{})
+	require.Error(t, err)
+	assert.Equal(t, []RedirectHop{{URL: server.URL + "/start", StatusCode: http.StatusFound, Location: closedURL + "/gone"}}, response.RedirectChain())
+}
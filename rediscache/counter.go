@@ -0,0 +1,62 @@
+package rediscache
+
+import (
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// CounterRedis is the subset of the go-redis client used by Counter,
+// satisfied by *redis.Client, *redis.ClusterClient and *redis.Ring
+type CounterRedis interface {
+	TxPipeline() redis.Pipeliner
+	Get(key string) *redis.StringCmd
+}
+
+// Counter is a heimdall.RetryBudgetCounter keeping counts in Redis, so that
+// replicas given a heimdall.RetryBudget on the same Redis share one budget.
+// Create it with NewCounter.
+type Counter struct {
+	redis   CounterRedis
+	onError func(error)
+}
+
+// NewCounter returns a counter keeping counts in client, reporting failures
+// talking to Redis to onError when it is not nil. The budget counts in memory
+// while Redis fails, so failures never fail a request.
+func NewCounter(client CounterRedis, onError func(error)) *Counter {
+	if onError == nil {
+		onError = func(error) {}
+	}
+
+	return &Counter{redis: client, onError: onError}
+}
+
+// Incr adds one to the counter named key and sets it to expire ttl later, in
+// one MULTI transaction so that no counter is left without an expiry
+func (c *Counter) Incr(key string, ttl time.Duration) (int64, error) {
+	pipe := c.redis.TxPipeline()
+	incr := pipe.Incr(key)
+	pipe.Expire(key, ttl)
+	if _, err := pipe.Exec(); err != nil {
+		c.onError(err)
+		return 0, err
+	}
+
+	return incr.Val(), nil
+}
+
+// Get returns the value of the counter named key, zero when it does not
+// exist
+func (c *Counter) Get(key string) (int64, error) {
+	value, err := c.redis.Get(key).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	if err != nil {
+		c.onError(err)
+		return 0, err
+	}
+
+	return value, nil
+}
@@ -0,0 +1,101 @@
+package rediscache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/go-redis/redis"
+	"github.com/gojektech/heimdall"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newMiniredis(t *testing.T) (*miniredis.Miniredis, *redis.Client) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	t.Cleanup(server.Close)
+
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	return server, client
+}
+
+func TestCounterIncrementsWithExpiry(t *testing.T) {
+	server, client := newMiniredis(t)
+	counter := NewCounter(client, nil)
+
+	value, err := counter.Get("budget:1:retries")
+	require.NoError(t, err)
+	assert.Zero(t, value, "a missing counter is zero")
+
+	for want := int64(1); want <= 3; want++ {
+		value, err := counter.Incr("budget:1:retries", 20*time.Second)
+		require.NoError(t, err)
+		assert.Equal(t, want, value)
+	}
+	assert.Equal(t, 20*time.Second, server.TTL("budget:1:retries"))
+
+	value, err = counter.Get("budget:1:retries")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), value)
+
+	server.FastForward(20 * time.Second)
+	value, _ = counter.Get("budget:1:retries")
+	assert.Zero(t, value, "counters expire")
+}
+
+func TestCounterReportsRedisFailures(t *testing.T) {
+	server, client := newMiniredis(t)
+	var reported int32
+	counter := NewCounter(client, func(error) { atomic.AddInt32(&reported, 1) })
+	server.Close()
+
+	_, err := counter.Incr("budget:1:requests", time.Second)
+	assert.Error(t, err)
+	_, err = counter.Get("budget:1:requests")
+	assert.Error(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&reported))
+}
+
+func TestReplicasShareTheRetryBudget(t *testing.T) {
+	var calls int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer upstream.Close()
+
+	server, client := newMiniredis(t)
+	replica := func() heimdall.Client {
+		budget, err := heimdall.NewRetryBudget(heimdall.RetryBudgetConfig{
+			Window:     time.Minute,
+			Ratio:      0.5,
+			MinRetries: 1,
+			Counter:    NewCounter(client, nil),
+			Key:        "payments",
+		}, nil)
+		require.NoError(t, err)
+		replica := heimdall.NewHTTPClient(1000, heimdall.WithRetryBudget(budget))
+		replica.SetRetryCount(3)
+		return replica
+	}
+	first, second := replica(), replica()
+
+	first.Get(upstream.URL, http.Header{})
+	second.Get(upstream.URL, http.Header{})
+	assert.Equal(t, int32(4), atomic.LoadInt32(&calls), "the second replica finds the retries of the first spent")
+	assert.Len(t, server.Keys(), 2, "requests and retries are counted in Redis")
+
+	server.Close()
+	atomic.StoreInt32(&calls, 0)
+	_, err := second.Get(upstream.URL, http.Header{})
+	require.Error(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls), "without Redis the replica retries within its own budget")
+}
+
+var _ heimdall.RetryBudgetCounter = (*Counter)(nil)
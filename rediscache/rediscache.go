@@ -0,0 +1,194 @@
+// Package rediscache provides a heimdall.CacheStore and a
+// heimdall.RetryBudgetCounter backed by Redis, so that replicas of a service
+// share cached responses and their retry budget.
+//
+// It lives outside the heimdall package so that clients which never use
+// Redis do not depend on a Redis client. Failures talking to Redis never
+// fail a request: for the store a failed read is a miss and a failed write is
+// skipped, so callers fall back to the network as if nothing were cached,
+// and a retry budget counts in memory while its counter fails.
+package rediscache
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/gojektech/heimdall"
+)
+
+const defaultPrefix = "heimdall:cache:"
+
+// Redis is the subset of the go-redis client used by the store, satisfied by
+// *redis.Client, *redis.ClusterClient and *redis.Ring
+type Redis interface {
+	Get(key string) *redis.StringCmd
+	Set(key string, value interface{}, expiration time.Duration) *redis.StatusCmd
+	Del(keys ...string) *redis.IntCmd
+}
+
+// Store is a heimdall.CacheStore keeping entries in Redis, created with New
+type Store struct {
+	redis      Redis
+	prefix     string
+	defaultTTL time.Duration
+	onError    func(error)
+	now        func() time.Time
+}
+
+// Option configures optional behaviour of a Store
+type Option func(*Store)
+
+// WithPrefix sets the prefix of every key, "heimdall:cache:" by default
+func WithPrefix(prefix string) Option {
+	return func(s *Store) {
+		s.prefix = prefix
+	}
+}
+
+// WithDefaultTTL sets how long entries without an expiry or a Cache-Control
+// max-age are kept. By default they are kept until Redis evicts them.
+func WithDefaultTTL(ttl time.Duration) Option {
+	return func(s *Store) {
+		s.defaultTTL = ttl
+	}
+}
+
+// WithErrorHandler reports failures talking to Redis, which the store
+// otherwise treats as misses and skipped writes
+func WithErrorHandler(onError func(error)) Option {
+	return func(s *Store) {
+		s.onError = onError
+	}
+}
+
+// New returns a store keeping entries in client
+func New(client Redis, opts ...Option) *Store {
+	s := &Store{
+		redis:   client,
+		prefix:  defaultPrefix,
+		onError: func(error) {},
+		now:     time.Now,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// Get returns the entry for key. Entries Redis cannot return, or that fail
+// to decode, are misses.
+func (s *Store) Get(key string) (heimdall.CachedResponse, bool, error) {
+	data, err := s.redis.Get(s.prefix + key).Bytes()
+	if err == redis.Nil {
+		return heimdall.CachedResponse{}, false, nil
+	}
+	if err != nil {
+		s.onError(err)
+		return heimdall.CachedResponse{}, false, nil
+	}
+
+	var response heimdall.CachedResponse
+	if err := json.Unmarshal(data, &response); err != nil {
+		s.onError(err)
+		s.Delete(key)
+		return heimdall.CachedResponse{}, false, nil
+	}
+
+	if response.Expired(s.now()) {
+		return heimdall.CachedResponse{}, false, nil
+	}
+
+	return response, true, nil
+}
+
+// Set stores response under key. It expires at the entry's Expires time,
+// or else after the max-age of its Cache-Control header, or else after the
+// default TTL. Responses marked no-store or private, as the store is shared,
+// and those already expired are not stored.
+func (s *Store) Set(key string, response heimdall.CachedResponse) error {
+	ttl, ok := s.ttl(response)
+	if !ok {
+		return nil
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+
+	if err := s.redis.Set(s.prefix+key, data, ttl).Err(); err != nil {
+		s.onError(err)
+	}
+
+	return nil
+}
+
+// Delete removes the entry for key
+func (s *Store) Delete(key string) error {
+	if err := s.redis.Del(s.prefix + key).Err(); err != nil {
+		s.onError(err)
+	}
+
+	return nil
+}
+
+// ttl returns how long response should be kept, zero meaning without
+// expiry, and false if it should not be stored at all
+func (s *Store) ttl(response heimdall.CachedResponse) (time.Duration, bool) {
+	if !response.Expires.IsZero() {
+		ttl := response.Expires.Sub(s.now())
+		return ttl, ttl > 0
+	}
+
+	maxAge, noStore := cacheControl(response.Headers)
+	switch {
+	case noStore:
+		return 0, false
+	case maxAge >= 0:
+		return maxAge, maxAge > 0
+	default:
+		return s.defaultTTL, true
+	}
+}
+
+// cacheControl returns the max-age of headers, s-maxage taking precedence as
+// the store is shared, or -1 if there is none, and whether they forbid
+// storing the response in a shared cache
+func cacheControl(headers http.Header) (time.Duration, bool) {
+	maxAge, sharedMaxAge := time.Duration(-1), time.Duration(-1)
+	noStore := false
+
+	for _, value := range headers["Cache-Control"] {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg := strings.TrimSpace(directive), ""
+			if i := strings.IndexByte(name, '='); i >= 0 {
+				name, arg = strings.TrimSpace(name[:i]), strings.Trim(strings.TrimSpace(name[i+1:]), `"`)
+			}
+
+			seconds, err := strconv.ParseInt(arg, 10, 64)
+			switch strings.ToLower(name) {
+			case "no-store", "private":
+				noStore = true
+			case "max-age":
+				if err == nil {
+					maxAge = time.Duration(seconds) * time.Second
+				}
+			case "s-maxage":
+				if err == nil {
+					sharedMaxAge = time.Duration(seconds) * time.Second
+				}
+			}
+		}
+	}
+
+	if sharedMaxAge >= 0 {
+		return sharedMaxAge, noStore
+	}
+
+	return maxAge, noStore
+}
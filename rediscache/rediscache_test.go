@@ -0,0 +1,163 @@
+package rediscache
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/gojektech/heimdall"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRedis is an in-memory Redis recording the TTL of every key, which can
+// be switched to failing every command
+type fakeRedis struct {
+	mu     sync.Mutex
+	values map[string]string
+	ttls   map[string]time.Duration
+	down   bool
+}
+
+func newFakeRedis() *fakeRedis {
+	return &fakeRedis{values: map[string]string{}, ttls: map[string]time.Duration{}}
+}
+
+var errConnectionRefused = errors.New("dial tcp 127.0.0.1:6379: connect: connection refused")
+
+func (f *fakeRedis) Get(key string) *redis.StringCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.down {
+		return redis.NewStringResult("", errConnectionRefused)
+	}
+	value, ok := f.values[key]
+	if !ok {
+		return redis.NewStringResult("", redis.Nil)
+	}
+
+	return redis.NewStringResult(value, nil)
+}
+
+func (f *fakeRedis) Set(key string, value interface{}, expiration time.Duration) *redis.StatusCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.down {
+		return redis.NewStatusResult("", errConnectionRefused)
+	}
+	f.values[key] = string(value.([]byte))
+	f.ttls[key] = expiration
+
+	return redis.NewStatusResult("OK", nil)
+}
+
+func (f *fakeRedis) Del(keys ...string) *redis.IntCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.down {
+		return redis.NewIntResult(0, errConnectionRefused)
+	}
+	for _, key := range keys {
+		delete(f.values, key)
+	}
+
+	return redis.NewIntResult(int64(len(keys)), nil)
+}
+
+func response(cacheControl string) heimdall.CachedResponse {
+	headers := http.Header{}
+	if cacheControl != "" {
+		headers.Set("Cache-Control", cacheControl)
+	}
+
+	return heimdall.CachedResponse{StatusCode: http.StatusOK, Headers: headers, Body: []byte(`{"id": 1}`)}
+}
+
+func TestStoreRoundTripsUnderPrefix(t *testing.T) {
+	fake := newFakeRedis()
+	store := New(fake, WithPrefix("tenant:"))
+
+	require.NoError(t, store.Set("http://example.com/items/1", response("max-age=60")))
+	assert.Contains(t, fake.values, "tenant:http://example.com/items/1")
+
+	cached, ok, err := store.Get("http://example.com/items/1")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, `{"id": 1}`, string(cached.Body))
+	assert.Equal(t, "max-age=60", cached.Headers.Get("Cache-Control"))
+
+	require.NoError(t, store.Delete("http://example.com/items/1"))
+	_, ok, _ = store.Get("http://example.com/items/1")
+	assert.False(t, ok)
+}
+
+func TestStoreTakesTTLFromCacheControl(t *testing.T) {
+	fake := newFakeRedis()
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := New(fake, WithDefaultTTL(time.Minute))
+	store.now = func() time.Time { return now }
+
+	expiring := response("max-age=60")
+	expiring.Expires = now.Add(10 * time.Second)
+
+	cases := map[string]heimdall.CachedResponse{
+		"max-age":  response("public, max-age=300"),
+		"s-maxage": response("max-age=300, s-maxage=30"),
+		"default":  response(""),
+		"expires":  expiring,
+		"no-store": response("no-store"),
+		"private":  response("private, max-age=300"),
+		"zero":     response("max-age=0"),
+	}
+	for key, entry := range cases {
+		require.NoError(t, store.Set(key, entry))
+	}
+
+	assert.Equal(t, 300*time.Second, fake.ttls["heimdall:cache:max-age"])
+	assert.Equal(t, 30*time.Second, fake.ttls["heimdall:cache:s-maxage"])
+	assert.Equal(t, time.Minute, fake.ttls["heimdall:cache:default"])
+	assert.Equal(t, 10*time.Second, fake.ttls["heimdall:cache:expires"])
+	assert.NotContains(t, fake.values, "heimdall:cache:no-store")
+	assert.NotContains(t, fake.values, "heimdall:cache:private")
+	assert.NotContains(t, fake.values, "heimdall:cache:zero")
+}
+
+func TestStoreDegradesToMissesWhenRedisIsDown(t *testing.T) {
+	fake := newFakeRedis()
+	var reported []error
+	store := New(fake, WithErrorHandler(func(err error) { reported = append(reported, err) }))
+
+	require.NoError(t, store.Set("cached", response("max-age=60")))
+	fake.down = true
+
+	_, ok, err := store.Get("cached")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.NoError(t, store.Set("other", response("max-age=60")))
+	assert.NoError(t, store.Delete("cached"))
+
+	assert.Equal(t, []error{errConnectionRefused, errConnectionRefused, errConnectionRefused}, reported)
+
+	fake.down = false
+	_, ok, _ = store.Get("cached")
+	assert.True(t, ok, "entries should be served again once Redis is back")
+}
+
+func TestStoreDropsUndecodableEntries(t *testing.T) {
+	fake := newFakeRedis()
+	fake.values["heimdall:cache:corrupt"] = "{not json"
+	store := New(fake)
+
+	_, ok, err := store.Get("corrupt")
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.NotContains(t, fake.values, "heimdall:cache:corrupt")
+}
+
+var _ heimdall.CacheStore = (*Store)(nil)
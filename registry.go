@@ -0,0 +1,119 @@
+package heimdall
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Client{}
+)
+
+// ErrDuplicateClient is returned by Register when a client is already
+// registered under the name
+type ErrDuplicateClient struct {
+	Name string
+}
+
+func (e *ErrDuplicateClient) Error() string {
+	return fmt.Sprintf("heimdall: a client is already registered as %q", e.Name)
+}
+
+// WithName names the client, as reported in ClientStats.Name and used to
+// register it when WithAutoRegister is given as well
+func WithName(name string) Option {
+	return func(options *clientOptions) {
+		options.name = name
+	}
+}
+
+// WithAutoRegister registers the client under the name given with WithName
+// once it is constructed. Constructors cannot return an error, so a missing
+// or duplicate name panics, as registering an http handler twice does. Clients
+// made with Derive are not registered.
+func WithAutoRegister() Option {
+	return func(options *clientOptions) {
+		options.autoRegister = true
+	}
+}
+
+// Register adds c to the registry of the process under name, so that code
+// which did not build it, such as an admin endpoint, can find it with Get or
+// Range. A name may only be registered once.
+func Register(name string, c Client) error {
+	if name == "" {
+		return fmt.Errorf("heimdall: cannot register a client without a name")
+	}
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, ok := registry[name]; ok {
+		return &ErrDuplicateClient{Name: name}
+	}
+	registry[name] = c
+
+	return nil
+}
+
+// Get returns the client registered under name
+func Get(name string) (Client, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	c, ok := registry[name]
+	return c, ok
+}
+
+// Range calls fn for each registered client in the order of their names,
+// stopping when fn returns false. It ranges over the clients registered when
+// it was called, and fn may register clients itself.
+func Range(fn func(name string, c Client) bool) {
+	registryMu.RLock()
+	names := make([]string, 0, len(registry))
+	clients := make(map[string]Client, len(registry))
+	for name, c := range registry {
+		names = append(names, name)
+		clients[name] = c
+	}
+	registryMu.RUnlock()
+
+	sort.Strings(names)
+	for _, name := range names {
+		if !fn(name, clients[name]) {
+			return
+		}
+	}
+}
+
+// RegisteredStats returns the stats of every registered client by name
+func RegisteredStats() map[string]ClientStats {
+	stats := map[string]ClientStats{}
+	Range(func(name string, c Client) bool {
+		stats[name] = statsOf(c)
+		return true
+	})
+
+	return stats
+}
+
+// DeregisterAll empties the registry, for tests
+func DeregisterAll() {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	registry = map[string]Client{}
+}
+
+// autoRegister registers c when its options ask for it
+func autoRegister(c Client, options clientOptions) {
+	if !options.autoRegister {
+		return
+	}
+
+	if err := Register(options.name, c); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,175 @@
+package heimdall
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// cleanRegistry empties the registry before and after the test
+func cleanRegistry(t *testing.T) {
+	DeregisterAll()
+	t.Cleanup(DeregisterAll)
+}
+
+func TestRegisterAndGet(t *testing.T) {
+	cleanRegistry(t)
+
+	users := NewHTTPClient(1000)
+	require.NoError(t, Register("users", users))
+
+	c, ok := Get("users")
+	require.True(t, ok)
+	assert.Same(t, users, c)
+
+	_, ok = Get("orders")
+	assert.False(t, ok)
+}
+
+func TestRegisterRejectsDuplicates(t *testing.T) {
+	cleanRegistry(t)
+
+	first := NewHTTPClient(1000)
+	require.NoError(t, Register("users", first))
+
+	err := Register("users", NewHTTPClient(1000))
+
+	var duplicate *ErrDuplicateClient
+	require.True(t, errors.As(err, &duplicate), "%v", err)
+	assert.Equal(t, "users", duplicate.Name)
+
+	c, _ := Get("users")
+	assert.Same(t, first, c, "the first registration is kept")
+
+	assert.Error(t, Register("", NewHTTPClient(1000)))
+}
+
+func TestRangeInNameOrder(t *testing.T) {
+	cleanRegistry(t)
+
+	for _, name := range []string{"payments", "users", "orders"} {
+		require.NoError(t, Register(name, NewHTTPClient(1000)))
+	}
+
+	var names []string
+	Range(func(name string, c Client) bool {
+		names = append(names, name)
+		return true
+	})
+	assert.Equal(t, []string{"orders", "payments", "users"}, names)
+
+	names = nil
+	Range(func(name string, c Client) bool {
+		names = append(names, name)
+		return false
+	})
+	assert.Equal(t, []string{"orders"}, names, "returning false stops the range")
+}
+
+func TestRangeWhileRegistering(t *testing.T) {
+	cleanRegistry(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				assert.NoError(t, Register(fmt.Sprintf("client_%d_%d", i, j), NewNoopClient(http.StatusOK, nil)))
+			}
+		}(i)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	for ranging := true; ranging; {
+		select {
+		case <-done:
+			ranging = false
+		default:
+			Range(func(name string, c Client) bool {
+				assert.NotNil(t, c)
+				return true
+			})
+		}
+	}
+
+	count := 0
+	Range(func(name string, c Client) bool {
+		count++
+		return true
+	})
+	assert.Equal(t, 100, count)
+}
+
+func TestRangeMayRegister(t *testing.T) {
+	cleanRegistry(t)
+	require.NoError(t, Register("users", NewHTTPClient(1000)))
+
+	Range(func(name string, c Client) bool {
+		assert.NoError(t, Register(name+"_derived", deriveClient(c, nil)))
+		return true
+	})
+
+	_, ok := Get("users_derived")
+	assert.True(t, ok)
+}
+
+func TestAutoRegister(t *testing.T) {
+	cleanRegistry(t)
+
+	users := NewHTTPClient(1000, WithName("users"), WithAutoRegister())
+	orders := NewHystrixHTTPClient(1000, NewHystrixConfig("registry_orders_command", HystrixCommandConfig{Timeout: 1000}), WithName("orders"), WithAutoRegister())
+	NewHTTPClient(1000, WithName("unregistered"))
+	users.Derive()
+
+	var registered []Client
+	Range(func(name string, c Client) bool {
+		registered = append(registered, c)
+		return true
+	})
+	assert.Equal(t, []Client{orders, users}, registered)
+
+	assert.Panics(t, func() { NewHTTPClient(1000, WithName("users"), WithAutoRegister()) })
+	assert.Panics(t, func() { NewHTTPClient(1000, WithAutoRegister()) }, "a name is required")
+}
+
+func TestRegisteredStats(t *testing.T) {
+	cleanRegistry(t)
+
+	server := statsServer()
+	defer server.Close()
+
+	users := NewHTTPClient(1000, WithName("users"), WithAutoRegister())
+	orders := NewHTTPClient(1000, WithName("orders"), WithAutoRegister())
+	users.Get(server.URL+"/ok", http.Header{})
+	orders.Get(server.URL+"/fail", http.Header{})
+	orders.Get(server.URL+"/ok", http.Header{})
+
+	stats := RegisteredStats()
+	require.Len(t, stats, 2)
+	assert.Equal(t, "users", stats["users"].Name)
+	assert.Equal(t, int64(1), stats["users"].Successes)
+	assert.Equal(t, int64(2), stats["orders"].Requests)
+	assert.Equal(t, int64(1), stats["orders"].Failures)
+}
+
+func TestDeregisterAll(t *testing.T) {
+	cleanRegistry(t)
+	require.NoError(t, Register("users", NewHTTPClient(1000)))
+
+	DeregisterAll()
+
+	_, ok := Get("users")
+	assert.False(t, ok)
+	assert.NoError(t, Register("users", NewHTTPClient(1000)))
+}
@@ -0,0 +1,139 @@
+package heimdall
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// RequestBuilder builds a request from an RFC 6570 URL template, such as
+// "/repos/{owner}/{repo}/issues{?state,labels}", made with Client.NewRequest.
+// Its methods return the builder, so calls chain; it is not safe for
+// concurrent use.
+type RequestBuilder struct {
+	client   Client
+	method   string
+	template string
+
+	vars    map[string][]string
+	query   url.Values
+	headers http.Header
+	body    io.Reader
+	tenant  string
+}
+
+func newRequestBuilder(client Client, method, template string) *RequestBuilder {
+	return &RequestBuilder{
+		client:   client,
+		method:   method,
+		template: template,
+		vars:     map[string][]string{},
+		query:    url.Values{},
+		headers:  http.Header{},
+	}
+}
+
+// PathParam sets the template variable name to value, replacing any value
+// set before. Values are percent-encoded as the expression they appear in
+// requires, so a slash in value stays part of a {name} segment.
+func (b *RequestBuilder) PathParam(name, value string) *RequestBuilder {
+	b.vars[name] = []string{value}
+	return b
+}
+
+// PathParamList sets the template variable name to the list values, which a
+// {name} expression expands to comma separated and a {/name*} one to a path
+// segment each
+func (b *RequestBuilder) PathParamList(name string, values ...string) *RequestBuilder {
+	b.vars[name] = append([]string(nil), values...)
+	return b
+}
+
+// QueryParam adds value to the query parameter name. Parameters named in a
+// query expression of the template, such as {?state}, are expanded there, the
+// values of a parameter given more than once as a list; the others are added
+// to the query of the expanded URL.
+func (b *RequestBuilder) QueryParam(name, value string) *RequestBuilder {
+	b.query.Add(name, value)
+	return b
+}
+
+// Header adds value to the header name of the request
+func (b *RequestBuilder) Header(name, value string) *RequestBuilder {
+	b.headers.Add(name, value)
+	return b
+}
+
+// Body sets the body of the request
+func (b *RequestBuilder) Body(body io.Reader) *RequestBuilder {
+	b.body = body
+	return b
+}
+
+// Tenant sends the request on behalf of tenant, as ContextWithTenant does
+func (b *RequestBuilder) Tenant(tenant string) *RequestBuilder {
+	b.tenant = tenant
+	return b
+}
+
+// URL returns the expanded URL, failing with an *ErrMissingPathParam when a
+// path parameter of the template was not set, or an *ErrURLTemplate when the
+// template does not parse
+func (b *RequestBuilder) URL() (string, error) {
+	vars := make(map[string][]string, len(b.vars)+len(b.query))
+	for name, values := range b.query {
+		vars[name] = values
+	}
+	for name, values := range b.vars {
+		vars[name] = values
+	}
+
+	used := map[string]bool{}
+	expanded, err := expandURLTemplate(b.template, vars, used)
+	if err != nil {
+		return "", err
+	}
+
+	extra := url.Values{}
+	for name, values := range b.query {
+		if !used[name] {
+			extra[name] = values
+		}
+	}
+	if len(extra) == 0 {
+		return expanded, nil
+	}
+
+	fragment := ""
+	if i := strings.IndexByte(expanded, '#'); i >= 0 {
+		expanded, fragment = expanded[:i], expanded[i:]
+	}
+	separator := "?"
+	if strings.Contains(expanded, "?") {
+		separator = "&"
+	}
+
+	return expanded + separator + extra.Encode() + fragment, nil
+}
+
+// Do expands the URL and sends the request with ctx through the client,
+// failing before any network call when the URL does not expand
+func (b *RequestBuilder) Do(ctx context.Context) (Response, error) {
+	expanded, err := b.URL()
+	if err != nil {
+		return Response{}, err
+	}
+
+	request, err := newMethodRequest(b.method, expanded, b.body)
+	if err != nil {
+		return Response{}, err
+	}
+	request.Header = b.headers
+	if b.tenant != "" {
+		ctx = ContextWithTenant(ctx, b.tenant)
+	}
+
+	return SendRequest(b.client, request.WithContext(ctx))
+}
@@ -0,0 +1,109 @@
+package heimdall
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// echoURLServer answers with the request URI it received, along with the
+// method and body
+func echoURLServer(calls *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Tenant", r.Header.Get("X-Tenant"))
+		w.Write([]byte(r.Method + " " + r.RequestURI + " " + string(body)))
+	}))
+}
+
+func TestClientsBuildRequestsFromURLTemplates(t *testing.T) {
+	clients := map[string]func() testClient{
+		"http": func() testClient {
+			return NewHTTPClient(1000)
+		},
+		"hystrix": func() testClient {
+			return NewHystrixHTTPClient(1000, NewHystrixConfig("request_builder_command", HystrixCommandConfig{Timeout: 1000}))
+		},
+	}
+	for kind, newClient := range clients {
+		t.Run(kind, func(t *testing.T) {
+			var calls int32
+			server := echoURLServer(&calls)
+			defer server.Close()
+
+			client := newClient()
+			client.SetBaseURL(server.URL)
+
+			response, err := client.NewRequest(http.MethodPost, "/repos/{owner}/{repo}/issues{?state,labels}").
+				PathParam("owner", "gojek").
+				PathParam("repo", "heim/dall").
+				QueryParam("state", "open").
+				QueryParam("labels", "bug").
+				QueryParam("labels", "help wanted").
+				QueryParam("page", "2").
+				Header("X-Tenant", "acme").
+				Body(strings.NewReader("title=crash")).
+				Do(context.Background())
+			require.NoError(t, err)
+
+			assert.Equal(t, "POST /repos/gojek/heim%2Fdall/issues?state=open&labels=bug,help%20wanted&page=2 title=crash", string(response.Body()))
+			assert.Equal(t, "acme", response.Headers().Get("X-Tenant"))
+		})
+	}
+}
+
+func TestRequestBuilderFailsBeforeSending(t *testing.T) {
+	var calls int32
+	server := echoURLServer(&calls)
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+	client.SetBaseURL(server.URL)
+
+	_, err := client.NewRequest(http.MethodGet, "/repos/{owner}/{repo}").PathParam("owner", "gojek").Do(context.Background())
+
+	var missing *ErrMissingPathParam
+	require.True(t, errors.As(err, &missing), "%v", err)
+	assert.Equal(t, "repo", missing.Name)
+
+	_, err = client.NewRequest("GET /", "/repos").Do(context.Background())
+	var invalid *ErrInvalidMethod
+	assert.True(t, errors.As(err, &invalid), "%v", err)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&calls))
+}
+
+func TestRequestBuilderURL(t *testing.T) {
+	builder := newRequestBuilder(NewNoopClient(0, nil), http.MethodGet, "/files{/segments*}{?v}#top").
+		PathParamList("segments", "a b", "c").
+		QueryParam("extra", "1")
+
+	expanded, err := builder.URL()
+	require.NoError(t, err)
+	assert.Equal(t, "/files/a%20b/c?extra=1#top", expanded)
+
+	expanded, err = builder.QueryParam("v", "2").URL()
+	require.NoError(t, err)
+	assert.Equal(t, "/files/a%20b/c?v=2&extra=1#top", expanded)
+}
+
+func TestRequestBuilderPassesTheContext(t *testing.T) {
+	var calls int32
+	server := echoURLServer(&calls)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := NewHTTPClient(1000).NewRequest(http.MethodGet, server.URL+"/{id}").PathParam("id", "1").Do(ctx)
+	assert.True(t, errors.Is(err, context.Canceled), "%v", err)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&calls))
+}
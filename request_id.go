@@ -0,0 +1,150 @@
+package heimdall
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync/atomic"
+)
+
+type requestTraceKey struct{}
+
+// requestTrace identifies one logical request and its current attempt
+type requestTrace struct {
+	id      string
+	attempt int32
+	// clock is the Clock of the client sending the request
+	clock Clock
+
+	bytesSent     int64
+	bytesReceived int64
+
+	// phases are the phase timings of the latest attempt, when recorded
+	phases atomic.Pointer[PhaseTimings]
+	// sent is the snapshot of the latest attempt, when recorded
+	sent atomic.Pointer[SentRequestInfo]
+	// redirects are the redirects the latest attempt followed, if any
+	redirects atomic.Pointer[[]RedirectHop]
+}
+
+// ContextWithRequestID returns a copy of ctx making requests sent with it use
+// id as their request ID instead of a generated one, for instance to make it
+// equal to the X-Request-ID header sent on the wire
+func ContextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestTraceKey{}, &requestTrace{id: id})
+}
+
+// RequestIDFromContext returns the ID of the logical request ctx belongs to.
+// The clients give every request an ID, shared by all its attempts, which
+// middlewares, request mutators and other hooks can read from the context of
+// the request they are handed. It is returned by Response.RequestID as well.
+func RequestIDFromContext(ctx context.Context) string {
+	if trace, ok := ctx.Value(requestTraceKey{}).(*requestTrace); ok {
+		return trace.id
+	}
+
+	return ""
+}
+
+// RequestAttemptFromContext returns the number of the attempt being sent with
+// ctx, starting at 1, or 0 outside of an attempt
+func RequestAttemptFromContext(ctx context.Context) int {
+	if trace, ok := ctx.Value(requestTraceKey{}).(*requestTrace); ok {
+		return int(atomic.LoadInt32(&trace.attempt))
+	}
+
+	return 0
+}
+
+// withRequestTrace returns ctx with a trace of its own for a request sent by
+// a client with clock, keeping the ID given with ContextWithRequestID, if any,
+// and generating one otherwise
+func withRequestTrace(ctx context.Context, clock Clock) context.Context {
+	id := RequestIDFromContext(ctx)
+	if id == "" {
+		id = newRequestID()
+	}
+
+	return context.WithValue(ctx, requestTraceKey{}, &requestTrace{id: id, clock: clock})
+}
+
+// requestClock returns the Clock of the client sending the request ctx belongs
+// to, or the real clock for requests sent by no client
+func requestClock(ctx context.Context) Clock {
+	if trace, ok := ctx.Value(requestTraceKey{}).(*requestTrace); ok {
+		return clockOrReal(trace.clock)
+	}
+
+	return realClock{}
+}
+
+// setAttempt records that attempt, counted from 0, is about to be sent
+func (trace *requestTrace) setAttempt(attempt int) {
+	if trace != nil {
+		atomic.StoreInt32(&trace.attempt, int32(attempt+1))
+	}
+}
+
+// setPhases records the phase timings of the attempt being sent
+func (trace *requestTrace) setPhases(phases *PhaseTimings) {
+	trace.phases.Store(phases)
+}
+
+// takePhases returns the phase timings recorded for the attempt just sent,
+// nil when none were, and clears them for the next attempt
+func (trace *requestTrace) takePhases() *PhaseTimings {
+	if trace == nil {
+		return nil
+	}
+
+	return trace.phases.Swap(nil)
+}
+
+// setSent records the snapshot of the request the attempt sent
+func (trace *requestTrace) setSent(sent *SentRequestInfo) {
+	trace.sent.Store(sent)
+}
+
+// takeSent returns the snapshot recorded for the attempt just sent, nil when
+// none was, and clears it for the next attempt
+func (trace *requestTrace) takeSent() *SentRequestInfo {
+	if trace == nil {
+		return nil
+	}
+
+	return trace.sent.Swap(nil)
+}
+
+// setRedirects records the redirects the attempt being sent followed so far
+func (trace *requestTrace) setRedirects(chain []RedirectHop) {
+	trace.redirects.Store(&chain)
+}
+
+// takeRedirects returns the redirects recorded for the attempt just sent, nil
+// when it followed none, and clears them for the next attempt
+func (trace *requestTrace) takeRedirects() []RedirectHop {
+	if trace == nil {
+		return nil
+	}
+	if chain := trace.redirects.Swap(nil); chain != nil {
+		return *chain
+	}
+
+	return nil
+}
+
+// stamp sets the request ID and byte totals of the request on response
+func (trace *requestTrace) stamp(response *Response) {
+	if trace != nil {
+		response.requestID = trace.id
+		response.bytesSent = atomic.LoadInt64(&trace.bytesSent)
+		response.bytesReceived = atomic.LoadInt64(&trace.bytesReceived)
+	}
+}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,153 @@
+package heimdall
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type requestEvent struct {
+	hook    string
+	id      string
+	attempt int
+}
+
+// tracingClient returns a client recording the request ID and attempt seen by
+// its request mutator, middleware and audit log
+func tracingClient(newClient func() testClient) (Client, func() []requestEvent) {
+	var mu sync.Mutex
+	var events []requestEvent
+	record := func(hook string, ctx context.Context) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, requestEvent{hook: hook, id: RequestIDFromContext(ctx), attempt: RequestAttemptFromContext(ctx)})
+	}
+
+	client := newClient()
+	client.AddRequestMutator(RequestMutatorFunc(func(request *http.Request) error {
+		record("mutator", request.Context())
+		return nil
+	}))
+	client.Use(func(next Doer) Doer {
+		return DoerFunc(func(request *http.Request) (*http.Response, error) {
+			record("middleware", request.Context())
+			return next.Do(request)
+		})
+	})
+
+	audited := make(chan AuditRecord, 16)
+	client.EnableAuditLog(func(record AuditRecord) { audited <- record }, 1)
+
+	return client, func() []requestEvent {
+		client.Flush(context.Background())
+		for {
+			select {
+			case audit := <-audited:
+				mu.Lock()
+				events = append(events, requestEvent{hook: "audit", id: audit.RequestID, attempt: audit.Attempt})
+				mu.Unlock()
+			default:
+				mu.Lock()
+				defer mu.Unlock()
+				return append([]requestEvent(nil), events...)
+			}
+		}
+	}
+}
+
+func TestHooksShareTheRequestIDOfEveryAttempt(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	for name, newClient := range retryClients {
+		t.Run(name, func(t *testing.T) {
+			calls = 0
+			client, events := tracingClient(func() testClient { return newClient("request_id_"+name, realClock{}) })
+			client.SetRetryCount(1)
+
+			response, err := client.Get(server.URL, http.Header{})
+			require.NoError(t, err)
+			require.Len(t, response.RequestID(), 32)
+
+			recorded := map[string][]int{}
+			require.Eventually(t, func() bool {
+				recorded = map[string][]int{}
+				for _, event := range events() {
+					assert.Equal(t, response.RequestID(), event.id, event.hook)
+					recorded[event.hook] = append(recorded[event.hook], event.attempt)
+				}
+				return len(recorded["audit"]) == 2
+			}, time.Second, 5*time.Millisecond)
+
+			assert.Equal(t, []int{1, 2}, recorded["mutator"])
+			assert.Equal(t, []int{1, 2}, recorded["middleware"])
+			assert.ElementsMatch(t, []int{1, 2}, recorded["audit"])
+		})
+	}
+}
+
+func TestConcurrentRequestsGetDistinctIDs(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	client, events := tracingClient(func() testClient { return NewHTTPClient(1000) })
+
+	ids := make([]string, 2)
+	var wg sync.WaitGroup
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			response, err := client.Get(server.URL, http.Header{})
+			require.NoError(t, err)
+			ids[i] = response.RequestID()
+		}(i)
+	}
+	wg.Wait()
+
+	assert.NotEqual(t, ids[0], ids[1])
+	for _, event := range events() {
+		if event.hook != "audit" {
+			assert.Contains(t, ids, event.id)
+		}
+	}
+}
+
+func TestContextWithRequestIDIsKept(t *testing.T) {
+	var headerID, hookID string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headerID = r.Header.Get("X-Request-ID")
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+	client.AddRequestMutator(RequestMutatorFunc(func(request *http.Request) error {
+		hookID = RequestIDFromContext(request.Context())
+		request.Header.Set("X-Request-ID", hookID)
+		return nil
+	}))
+
+	request, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+	request = request.WithContext(ContextWithRequestID(context.Background(), "req-42"))
+
+	response, err := client.Do(request)
+	require.NoError(t, err)
+
+	assert.Equal(t, "req-42", response.RequestID())
+	assert.Equal(t, "req-42", hookID)
+	assert.Equal(t, "req-42", headerID)
+	assert.Equal(t, 0, RequestAttemptFromContext(request.Context()), "the caller context should not see attempts")
+}
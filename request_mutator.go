@@ -0,0 +1,142 @@
+package heimdall
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// RequestMutator modifies an outgoing request before each attempt is sent.
+// It is given the request of the attempt, cloned from the caller's, so what
+// it changes is sent with that attempt only and it runs again on the next.
+type RequestMutator interface {
+	Mutate(request *http.Request) error
+}
+
+// RequestMutatorFunc adapts a plain function to the RequestMutator interface
+type RequestMutatorFunc func(request *http.Request) error
+
+// Mutate calls f(request)
+func (f RequestMutatorFunc) Mutate(request *http.Request) error {
+	return f(request)
+}
+
+// prepareAttempt returns the request of attempt number attempt: a clone of
+// request with a rewound body for retries, on which all mutators have run.
+// Every attempt is sent, shown to middlewares and hooks as a request of its
+// own, so that changes made to one are scoped to that attempt and never
+// reach the caller's request, later attempts or requests sharing its headers.
+func prepareAttempt(request *http.Request, attempt int, mutators []RequestMutator) (*http.Request, error) {
+	attemptRequest := request.Clone(request.Context())
+	// Announced trailers are set on the caller's map while the body is read
+	attemptRequest.Trailer = request.Trailer
+
+	if attempt > 0 && request.GetBody != nil {
+		body, err := request.GetBody()
+		if err != nil {
+			return nil, errors.Wrap(err, "request body rewind failed")
+		}
+
+		attemptRequest.Body = body
+	}
+
+	for _, mutator := range mutators {
+		if err := mutate(mutator, attemptRequest); err != nil {
+			return nil, errors.Wrap(err, "request mutation failed")
+		}
+	}
+
+	return attemptRequest, nil
+}
+
+// hookCopy returns a copy of request for hooks that only read it, such as
+// validators, so that their changes reach neither the request sent nor other
+// hooks. The copy has a body of its own when the body can be rewound, and
+// shares it otherwise.
+func hookCopy(request *http.Request) *http.Request {
+	copied := request.Clone(request.Context())
+	if request.GetBody != nil && request.Body != nil && request.Body != http.NoBody {
+		if body, err := request.GetBody(); err == nil {
+			copied.Body = body
+		}
+	}
+
+	return copied
+}
+
+// mutate runs mutator on request, failing the request when it panics
+func mutate(mutator RequestMutator, request *http.Request) (err error) {
+	defer recoverCallback("request mutator", &err)
+
+	return mutator.Mutate(request)
+}
+
+// mutateRaw hands mutator a copy of every attempt sent through next, so that
+// its changes reach the wire but not the request seen by middlewares, hooks
+// and later attempts
+func mutateRaw(next Doer, mutator func(*http.Request)) Doer {
+	if mutator == nil {
+		return next
+	}
+
+	return DoerFunc(func(request *http.Request) (*http.Response, error) {
+		raw := request.Clone(request.Context())
+		if err := mutateRawRequest(mutator, raw); err != nil {
+			return nil, err
+		}
+
+		return next.Do(raw)
+	})
+}
+
+// mutateRawRequest runs mutator on request, failing the attempt when it
+// panics
+func mutateRawRequest(mutator func(*http.Request), request *http.Request) (err error) {
+	defer recoverCallback("raw request mutator", &err)
+
+	mutator(request)
+	return nil
+}
+
+// requestBody returns the request body bytes, leaving the request readable
+// and rewindable afterwards
+func requestBody(request *http.Request) ([]byte, error) {
+	if request.Body == nil || request.Body == http.NoBody {
+		return nil, nil
+	}
+
+	if request.GetBody != nil {
+		body, err := request.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		defer body.Close()
+
+		return ioutil.ReadAll(body)
+	}
+
+	data, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		return nil, err
+	}
+	request.Body.Close()
+
+	request.Body = ioutil.NopCloser(bytes.NewReader(data))
+	request.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+
+	return data, nil
+}
+
+func copyHeader(header http.Header) http.Header {
+	copied := make(http.Header, len(header))
+	for key, values := range header {
+		copied[key] = append([]string(nil), values...)
+	}
+
+	return copied
+}
@@ -0,0 +1,291 @@
+package heimdall
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rawServer answers every request with status over a plain TCP listener and
+// sends the bytes of each request head it read on the returned channel
+func rawServer(t *testing.T, status string) (string, <-chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	heads := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			var head strings.Builder
+			reader := bufio.NewReader(conn)
+			for {
+				line, err := reader.ReadString('\n')
+				head.WriteString(line)
+				if err != nil || line == "\r\n" {
+					break
+				}
+			}
+			heads <- head.String()
+
+			conn.Write([]byte("HTTP/1.1 " + status + "\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+			conn.Close()
+		}
+	}()
+
+	return "http://" + listener.Addr().String(), heads
+}
+
+func headerLines(head string) []string {
+	lines := strings.Split(strings.TrimSuffix(head, "\r\n\r\n"), "\r\n")
+	return lines[1:]
+}
+
+func TestClientsSendRawRequestMutatorHeaders(t *testing.T) {
+	for kind, newClient := range retryClients {
+		t.Run(kind, func(t *testing.T) {
+			url, heads := rawServer(t, "200 OK")
+
+			client := newClient("raw_request_mutator_"+kind, realClock{})
+			client.SetRawRequestMutator(func(request *http.Request) {
+				request.Header["X-API-KEY"] = request.Header["X-Api-Key"]
+				delete(request.Header, "X-Api-Key")
+				request.Header["User-Agent"] = []string{""}
+				request.Host = "legacy.internal"
+			})
+
+			headers := http.Header{}
+			headers.Set("X-Api-Key", "secret")
+			_, err := client.Get(url+"/users", headers)
+			require.NoError(t, err)
+
+			head := <-heads
+			assert.True(t, strings.HasPrefix(head, "GET /users HTTP/1.1\r\n"), head)
+			lines := headerLines(head)
+			assert.Contains(t, lines, "X-API-KEY: secret")
+			assert.Contains(t, lines, "Host: legacy.internal")
+			for _, line := range lines {
+				assert.False(t, strings.HasPrefix(line, "X-Api-Key:"), "the canonical name was deleted")
+				assert.False(t, strings.HasPrefix(line, "User-Agent:"), "the default user agent is suppressed")
+				assert.False(t, strings.HasPrefix(line, "Content-Length:"), "a GET sends no length")
+			}
+
+			assert.Equal(t, http.Header{"X-Api-Key": {"secret"}}, headers, "the caller's headers are left alone")
+		})
+	}
+}
+
+func TestRawRequestMutatorRunsOnEveryAttempt(t *testing.T) {
+	url, heads := rawServer(t, "503 Service Unavailable")
+
+	var seen []string
+	client := NewHTTPClient(1000)
+	client.SetRetryCount(2)
+	client.AddRequestMutator(RequestMutatorFunc(func(request *http.Request) error {
+		request.Header.Set("X-Request-Tag", "tag")
+		return nil
+	}))
+	client.SetRawRequestMutator(func(request *http.Request) {
+		seen = append(seen, request.Header.Get("X-Request-Tag"))
+		request.Header["x-request-tag"] = append(request.Header["X-Request-Tag"], "raw")
+		delete(request.Header, "X-Request-Tag")
+	})
+
+	_, err := client.Get(url, http.Header{})
+	require.Error(t, err)
+
+	for i := 0; i < 3; i++ {
+		lines := headerLines(<-heads)
+		assert.Contains(t, lines, "x-request-tag: tag")
+		assert.Contains(t, lines, "x-request-tag: raw", "attempt %d starts from the unmutated request", i)
+	}
+	assert.Equal(t, []string{"tag", "tag", "tag"}, seen, "the mutator runs after the request mutators")
+}
+
+func TestRawRequestMutatorPanicFailsAttempt(t *testing.T) {
+	url, heads := rawServer(t, "200 OK")
+
+	client := NewHTTPClient(1000)
+	client.SetRawRequestMutator(func(*http.Request) {
+		panic("mutator bug")
+	})
+
+	_, err := client.Get(url, http.Header{})
+
+	var panicked *ErrCallbackPanic
+	require.True(t, errors.As(err, &panicked), "%v", err)
+	assert.Equal(t, "raw request mutator", panicked.Callback)
+	assert.Len(t, heads, 0, "nothing is sent")
+
+	client.SetRawRequestMutator(nil)
+	_, err = client.Get(url, http.Header{})
+	assert.NoError(t, err)
+}
+
+// pluginServer fails the first failures requests with 503, recording the
+// X-Plugin values and path of every request it receives
+type pluginServer struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	calls  int
+	values [][]string
+	paths  []string
+}
+
+func newPluginServer(failures int) *pluginServer {
+	s := &pluginServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.calls++
+		s.values = append(s.values, r.Header.Values("X-Plugin"))
+		s.paths = append(s.paths, r.URL.Path)
+		failed := s.calls <= failures
+		s.mu.Unlock()
+
+		if failed {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+
+	return s
+}
+
+func (s *pluginServer) received() [][]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([][]string(nil), s.values...)
+}
+
+func (s *pluginServer) receivedPaths() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.paths...)
+}
+
+// misbehavingPlugin appends to the headers of every request it sees rather
+// than setting them, and points later attempts elsewhere
+func misbehavingPlugin(name string) Middleware {
+	return func(next Doer) Doer {
+		return DoerFunc(func(request *http.Request) (*http.Response, error) {
+			request.Header.Add("X-Plugin", name)
+			response, err := next.Do(request)
+			request.URL.Path = "/elsewhere"
+			return response, err
+		})
+	}
+}
+
+func TestAttemptChangesDoNotReachLaterAttempts(t *testing.T) {
+	for kind, newClient := range retryClients {
+		t.Run(kind, func(t *testing.T) {
+			server := newPluginServer(2)
+			defer server.Close()
+
+			client := newClient("attempt_isolation_"+kind, realClock{})
+			client.SetRetryCount(2)
+			client.SetRetrier(NewNoRetrier())
+			client.Use(misbehavingPlugin("middleware"))
+			client.AddRequestMutator(RequestMutatorFunc(func(request *http.Request) error {
+				request.Header.Add("X-Plugin", "mutator")
+				return nil
+			}))
+
+			headers := http.Header{"X-Plugin": {"caller"}}
+			_, err := client.Get(server.URL+"/items", headers)
+			require.NoError(t, err)
+			assert.Equal(t, []string{"/items", "/items", "/items"}, server.receivedPaths(), "later attempts go to the URL requested")
+
+			for attempt, values := range server.received() {
+				assert.Equal(t, []string{"caller", "mutator", "middleware"}, values, "attempt %d", attempt)
+			}
+			assert.Len(t, server.received(), 3)
+			assert.Equal(t, http.Header{"X-Plugin": {"caller"}}, headers, "the caller's headers are left as they are")
+		})
+	}
+}
+
+func TestAttemptChangesDoNotReachParallelRequests(t *testing.T) {
+	server := newPluginServer(0)
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+	client.Use(misbehavingPlugin("middleware"))
+
+	shared := http.Header{"X-Plugin": {"caller"}}
+	request, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+	request.Header = shared
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := client.Get(server.URL, shared)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	_, err = client.Do(request)
+	require.NoError(t, err)
+	_, err = client.Do(request)
+	require.NoError(t, err)
+	assert.Equal(t, "", request.URL.Path, "the request given to Do is left as it is")
+
+	for _, values := range server.received() {
+		assert.Equal(t, []string{"caller", "middleware"}, values)
+	}
+	assert.Equal(t, http.Header{"X-Plugin": {"caller"}}, shared)
+}
+
+func TestReadOnlyHooksAreGivenCopies(t *testing.T) {
+	server := newPluginServer(0)
+	defer server.Close()
+
+	tamper := func(request *http.Request) {
+		request.Header.Set("X-Plugin", "tampered")
+		request.URL.Path = "/elsewhere"
+		ioutil.ReadAll(request.Body)
+	}
+	client := NewHTTPClient(1000, WithDeduplication(time.Second, func(request *http.Request) (string, bool) {
+		tamper(request)
+		return "", false
+	}))
+	client.SetRequestValidator(func(request *http.Request) error {
+		tamper(request)
+		return nil
+	})
+
+	var received string
+	client.Use(func(next Doer) Doer {
+		return DoerFunc(func(request *http.Request) (*http.Response, error) {
+			body, _ := ioutil.ReadAll(request.Body)
+			received = request.URL.Path + " " + string(body)
+			request.Body = ioutil.NopCloser(strings.NewReader(string(body)))
+			return next.Do(request)
+		})
+	})
+
+	_, err := client.Post(server.URL+"/items", strings.NewReader("payload"), http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, "/items payload", received)
+	assert.Equal(t, [][]string{nil}, server.received())
+}
@@ -1,9 +1,40 @@
 package heimdall
 
-// Response encapsulates details of a http response
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Response encapsulates details of a http response. A Response is never
+// changed once returned, so it may be shared by goroutines reading it at the
+// same time: Body is shared and must be treated as read-only, BodyReader
+// gives each reader a position of its own, and the headers, trailers and
+// trace are returned as copies that the caller may change.
 type Response struct {
-	body       []byte
+	body []byte
+	// spool holds the body instead when it was spooled to a file
+	spool      *spooledBody
 	statusCode int
+	headers    http.Header
+	trailers   http.Header
+	finalURL   string
+	requestID  string
+	attempts   []AttemptTrace
+
+	bytesSent     int64
+	bytesReceived int64
+	hasBody       bool
+
+	charset            string
+	charsetUnsupported bool
+
+	synthetic bool
+	servedBy  string
+	// received is when the attempt that returned the response ended, on the
+	// clock of the client
+	received time.Time
 }
 
 // StatusCode returns status code of a http request
@@ -11,7 +42,184 @@ func (hr Response) StatusCode() int {
 	return hr.statusCode
 }
 
-// Body returns body in bytes of a http request
+// Body returns body in bytes of a http request. The slice is shared by every
+// copy of the response and must not be modified; copy it first to change it.
 func (hr Response) Body() []byte {
+	if hr.spool != nil {
+		return hr.spool.bytes()
+	}
+
 	return hr.body
 }
+
+// BodyReader returns a new reader over the body on each call, so that
+// goroutines reading the same response each read it from the start. Readers
+// of bodies spooled by WithBodySpooling read the file of the body, with a
+// handle of their own, which is released once they are read to the end or
+// closed.
+func (hr Response) BodyReader() io.Reader {
+	if hr.spool != nil {
+		reader, err := hr.spool.open()
+		if err != nil {
+			return errReader{err: err}
+		}
+		return reader
+	}
+
+	return bytes.NewReader(hr.body)
+}
+
+// Close removes the file a body spooled by WithBodySpooling was written to,
+// for every copy of the response, once the readers open on it are done. It is
+// a no-op for bodies held in memory, and safe to call more than once.
+func (hr Response) Close() error {
+	if hr.spool == nil {
+		return nil
+	}
+
+	return hr.spool.close()
+}
+
+// bodySize returns the length of the body, wherever it is held
+func (hr Response) bodySize() int64 {
+	if hr.spool != nil {
+		return hr.spool.size
+	}
+
+	return int64(len(hr.body))
+}
+
+// Spooled reports whether the body was spooled to a file by WithBodySpooling
+func (hr Response) Spooled() bool {
+	return hr.spool != nil
+}
+
+// HasBody reports whether the response could carry a body, which tells an
+// empty body apart from one that was never expected. Responses to HEAD,
+// informational responses, 204 and 304 have none, and neither does the zero
+// Response returned when no response was received.
+func (hr Response) HasBody() bool {
+	return hr.hasBody
+}
+
+// Headers returns a copy of the headers of a http response. Headers sent
+// more than once, such as Set-Cookie or Vary, keep every value in order.
+func (hr Response) Headers() http.Header {
+	if hr.headers == nil {
+		return nil
+	}
+
+	return copyHeader(hr.headers)
+}
+
+// Cookies parses the Set-Cookie headers of the response as net/http does,
+// skipping malformed ones
+func (hr Response) Cookies() []*http.Cookie {
+	return (&http.Response{Header: hr.headers}).Cookies()
+}
+
+// ContentType returns the media type declared by the response Content-Type,
+// lower-cased and without parameters such as the charset
+func (hr Response) ContentType() string {
+	return mediaType(hr.headers.Get("Content-Type"))
+}
+
+// Trailers returns the trailers sent after a chunked response body. They are
+// only known when the body was read in full, so the truncated error bodies of
+// attempts that were retried carry none. It returns a copy, as Headers does.
+func (hr Response) Trailers() http.Header {
+	if hr.trailers == nil {
+		return nil
+	}
+
+	return copyHeader(hr.trailers)
+}
+
+// RequestID returns the ID shared by the attempts of the request, the one
+// RequestIDFromContext returns to hooks. Unlike an X-Request-ID header it is
+// never sent to the server.
+func (hr Response) RequestID() string {
+	return hr.requestID
+}
+
+// Trace returns the attempts made for the request, whether or not it
+// succeeded, with the status or error and the backoff after each. Responses
+// that were not sent through the retry loop, such as those of a noop client,
+// have none.
+func (hr Response) Trace() RequestTrace {
+	return RequestTrace{RequestID: hr.requestID, Attempts: append([]AttemptTrace(nil), hr.attempts...)}
+}
+
+// BytesSent returns the bytes the attempts of the request wrote on the wire:
+// request lines, headers and bodies, including TLS framing but not the setup
+// of new connections such as TLS handshakes.
+func (hr Response) BytesSent() int64 {
+	return hr.bytesSent
+}
+
+// BytesReceived returns the bytes the attempts of the request read from the
+// wire, counted as BytesSent is. Compressed bodies count with their size
+// before decompression.
+func (hr Response) BytesReceived() int64 {
+	return hr.bytesReceived
+}
+
+// FinalURL returns the URL of the request that produced the response, which
+// differs from the requested URL when redirects were followed
+func (hr Response) FinalURL() string {
+	return hr.finalURL
+}
+
+// Charset returns the charset declared by the response Content-Type, if any
+func (hr Response) Charset() string {
+	return hr.charset
+}
+
+// CharsetUnsupported reports whether charset decoding was requested but the
+// declared charset could not be decoded, leaving the body as received
+func (hr Response) CharsetUnsupported() bool {
+	return hr.charsetUnsupported
+}
+
+// Synthetic reports whether the response was made up by the client, as for
+// an open circuit, rather than received from the server
+func (hr Response) Synthetic() bool {
+	return hr.synthetic
+}
+
+// ServedBy returns the name of the fallback chain step that produced the
+// response, empty for responses not returned by a fallback chain
+func (hr Response) ServedBy() string {
+	return hr.servedBy
+}
+
+// clone returns a copy of the response that shares no memory with it
+func (hr Response) clone() Response {
+	cloned := hr
+	if hr.spool != nil {
+		cloned.body, cloned.spool = hr.spool.bytes(), nil
+	} else if hr.body != nil {
+		cloned.body = append([]byte(nil), hr.body...)
+	}
+	if hr.headers != nil {
+		cloned.headers = copyHeader(hr.headers)
+	}
+	if hr.trailers != nil {
+		cloned.trailers = copyHeader(hr.trailers)
+	}
+	if hr.attempts != nil {
+		cloned.attempts = append([]AttemptTrace(nil), hr.attempts...)
+	}
+
+	return cloned
+}
+
+// responseURL returns the URL that produced response, falling back to the
+// request URL for responses that were not sent over the network
+func responseURL(response *http.Response, request *http.Request) string {
+	if response.Request != nil {
+		return response.Request.URL.String()
+	}
+
+	return request.URL.String()
+}
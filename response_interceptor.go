@@ -0,0 +1,158 @@
+package heimdall
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ResponseInterceptor rewrites or rejects a response before the client
+// returns it. It may change the response through SetBody and SetHeaders;
+// returning an error fails the request with that error, without retries and
+// without a response.
+type ResponseInterceptor func(response *Response) error
+
+// InterceptorOption configures when a response interceptor runs
+type InterceptorOption func(*responseInterceptor)
+
+// InterceptErrorResponses runs the interceptor on the responses of failed
+// attempts as well, such as those with a 5xx status or classified as
+// failures, so that error bodies returned alongside an error are rewritten
+// too
+func InterceptErrorResponses() InterceptorOption {
+	return func(i *responseInterceptor) {
+		i.onErrors = true
+	}
+}
+
+type responseInterceptor struct {
+	intercept ResponseInterceptor
+	onErrors  bool
+}
+
+// responseInterceptors run in the order they were registered
+type responseInterceptors []responseInterceptor
+
+func newResponseInterceptor(interceptor ResponseInterceptor, opts []InterceptorOption) responseInterceptor {
+	i := responseInterceptor{intercept: interceptor}
+	for _, opt := range opts {
+		opt(&i)
+	}
+
+	return i
+}
+
+// apply runs the interceptors on the response of outcome, skipping attempts
+// that received none and, for interceptors not given InterceptErrorResponses,
+// failed ones. An interceptor error or panic aborts the request.
+func (interceptors responseInterceptors) apply(outcome attemptOutcome) attemptOutcome {
+	if len(interceptors) == 0 || outcome.abort != nil || outcome.response.statusCode == 0 {
+		return outcome
+	}
+
+	for _, i := range interceptors {
+		if outcome.err != nil && !i.onErrors {
+			continue
+		}
+		if err := i.run(&outcome.response); err != nil {
+			return attemptOutcome{abort: err, fallback: outcome.fallback}
+		}
+	}
+
+	return outcome
+}
+
+func (i responseInterceptor) run(response *Response) (err error) {
+	defer recoverCallback("response interceptor", &err)
+
+	return i.intercept(response)
+}
+
+// SetBody replaces the body of the response, updating its Content-Length
+// header if it has one. A spooled body is replaced as well, its file left to
+// be removed once the response is garbage collected. It is meant for response
+// interceptors: a Response returned by a client must not be changed.
+func (hr *Response) SetBody(body []byte) {
+	hr.body, hr.spool = body, nil
+	if hr.headers.Get("Content-Length") != "" {
+		hr.headers.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+}
+
+// SetHeaders replaces the headers of the response with a copy of headers.
+// It is meant for response interceptors, as SetBody is.
+func (hr *Response) SetHeaders(headers http.Header) {
+	hr.headers = copyHeader(headers)
+}
+
+// RedactJSONFields returns an interceptor replacing the values of the JSON
+// object members named after one of fields, in any case and at any depth,
+// with a redaction marker. Bodies of responses other than JSON, by their
+// Content-Type application/json or a +json suffix, are left as they are;
+// JSON bodies that do not parse fail the request, rather than reaching the
+// caller unredacted. Redacted bodies are encoded anew, with the members of
+// objects sorted by name.
+func RedactJSONFields(fields ...string) ResponseInterceptor {
+	redacted := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		redacted[strings.ToLower(field)] = true
+	}
+
+	return func(response *Response) error {
+		if !isJSONMediaType(response.ContentType()) {
+			return nil
+		}
+		original := response.Body()
+		if len(bytes.TrimSpace(original)) == 0 {
+			return nil
+		}
+
+		decoder := json.NewDecoder(bytes.NewReader(original))
+		decoder.UseNumber()
+		var document interface{}
+		if err := decoder.Decode(&document); err != nil {
+			return fmt.Errorf("redacting JSON fields: %v", err)
+		}
+		if !redactJSON(document, redacted) {
+			return nil
+		}
+
+		body, err := json.Marshal(document)
+		if err != nil {
+			return fmt.Errorf("redacting JSON fields: %v", err)
+		}
+		response.SetBody(body)
+
+		return nil
+	}
+}
+
+// redactJSON replaces the values of the members of value named in fields,
+// reporting whether any was
+func redactJSON(value interface{}, fields map[string]bool) bool {
+	changed := false
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for name, member := range value {
+			if fields[strings.ToLower(name)] {
+				value[name] = redactedMarker
+				changed = true
+				continue
+			}
+			changed = redactJSON(member, fields) || changed
+		}
+	case []interface{}:
+		for _, element := range value {
+			changed = redactJSON(element, fields) || changed
+		}
+	}
+
+	return changed
+}
+
+func isJSONMediaType(mediaType string) bool {
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
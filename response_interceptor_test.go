@@ -0,0 +1,165 @@
+package heimdall
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const customerJSON = `{"name":"Ada","ssn":"078-05-1120","accounts":[{"id":1,"Token":"tok_live"},{"id":2}],"balance":12.50}`
+
+// customerServer answers with a customer record holding sensitive fields
+func customerServer(contentType string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("X-Internal-Token", "secret")
+		w.Header().Set("Content-Length", strconv.Itoa(len(customerJSON)))
+		w.Write([]byte(customerJSON))
+	}))
+}
+
+// scrubToken removes the X-Internal-Token header of responses
+func scrubToken(response *Response) error {
+	headers := response.Headers()
+	headers.Del("X-Internal-Token")
+	response.SetHeaders(headers)
+	return nil
+}
+
+func TestJSONFieldRedactionReachesCallerAndCache(t *testing.T) {
+	server := customerServer("application/json; charset=utf-8")
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "heimdall-interceptor")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for kind, newClient := range retryClients {
+		t.Run(kind, func(t *testing.T) {
+			store, err := NewDiskCacheStore(dir+"/"+kind, 1<<20)
+			require.NoError(t, err)
+
+			client := newClient("interceptor_"+kind, realClock{})
+			client.UseResponseInterceptor(RedactJSONFields("ssn", "token"))
+			client.UseResponseInterceptor(scrubToken)
+
+			response, err := client.Get(server.URL, http.Header{})
+			require.NoError(t, err)
+			require.NoError(t, store.Set(server.URL, NewCachedResponse(response, time.Time{})))
+
+			cached, ok, err := store.Get(server.URL)
+			require.NoError(t, err)
+			require.True(t, ok)
+			for name, seen := range map[string]Response{"caller": response, "cache": cached.Response()} {
+				var customer map[string]interface{}
+				require.NoError(t, json.Unmarshal(seen.Body(), &customer), name)
+				assert.Equal(t, "Ada", customer["name"], name)
+				assert.Equal(t, redactedMarker, customer["ssn"], name)
+				assert.Equal(t, redactedMarker, customer["accounts"].([]interface{})[0].(map[string]interface{})["Token"], "%s: fields are matched in any case and at any depth", name)
+				assert.Equal(t, 12.5, customer["balance"], name)
+				assert.NotContains(t, string(seen.Body()), "078-05-1120", name)
+				assert.Empty(t, seen.Headers().Get("X-Internal-Token"), name)
+				assert.Equal(t, strconv.Itoa(len(seen.Body())), seen.Headers().Get("Content-Length"), name)
+			}
+
+			response, err = derive(client).Get(server.URL, http.Header{})
+			require.NoError(t, err)
+			assert.NotContains(t, string(response.Body()), "078-05-1120", "derived clients keep the interceptors")
+		})
+	}
+}
+
+func TestJSONFieldRedactionSkipsOtherBodies(t *testing.T) {
+	server := customerServer("text/plain")
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+	client.UseResponseInterceptor(RedactJSONFields("ssn"))
+	response, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, customerJSON, string(response.Body()))
+
+	invalid := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.Write([]byte(`{"ssn": "078-05-1120"`))
+	}))
+	defer invalid.Close()
+	response, err = client.Get(invalid.URL, http.Header{})
+	assert.Error(t, err, "JSON bodies that cannot be redacted fail the request")
+	assert.Nil(t, response.Body())
+}
+
+func TestResponseInterceptorsRunOnSuccessfulAttempts(t *testing.T) {
+	for kind, newClient := range retryClients {
+		t.Run(kind, func(t *testing.T) {
+			server := failingServer(2)
+			defer server.Close()
+
+			var order []string
+			client := newClient("interceptor_attempts_"+kind, realClock{})
+			client.SetRetryCount(3)
+			client.UseResponseInterceptor(func(response *Response) error {
+				order = append(order, "first "+strconv.Itoa(response.StatusCode()))
+				return nil
+			})
+			client.UseResponseInterceptor(func(response *Response) error {
+				order = append(order, "second "+strconv.Itoa(response.StatusCode()))
+				return nil
+			})
+			client.UseResponseInterceptor(func(response *Response) error {
+				order = append(order, "errors "+strconv.Itoa(response.StatusCode()))
+				return nil
+			}, InterceptErrorResponses())
+
+			_, err := client.Get(server.URL, http.Header{})
+			require.NoError(t, err)
+			assert.Equal(t, []string{"errors 503", "errors 503", "first 200", "second 200", "errors 200"}, order)
+		})
+	}
+}
+
+func TestResponseInterceptorErrorsFailTheRequest(t *testing.T) {
+	for kind, newClient := range retryClients {
+		t.Run(kind, func(t *testing.T) {
+			var hits int32
+			server := countingServer(&hits)
+			defer server.Close()
+
+			refused := errors.New("response refused by policy")
+			client := newClient("interceptor_errors_"+kind, realClock{})
+			client.SetRetryCount(3)
+			client.UseResponseInterceptor(func(response *Response) error {
+				return refused
+			})
+
+			response, err := client.Get(server.URL, http.Header{})
+			assert.True(t, errors.Is(err, refused), "%v", err)
+			assert.Equal(t, 0, response.StatusCode(), "the response refused is not returned")
+			assert.Equal(t, int32(1), atomic.LoadInt32(&hits), "refused responses are not retried")
+		})
+	}
+}
+
+func TestResponseInterceptorPanicsFailTheRequest(t *testing.T) {
+	server := customerServer("application/json")
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+	client.UseResponseInterceptor(func(response *Response) error {
+		panic("interceptor broke")
+	})
+
+	_, err := client.Get(server.URL, http.Header{})
+	var panicked *ErrCallbackPanic
+	assert.True(t, errors.As(err, &panicked), "%v", err)
+}
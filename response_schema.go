@@ -0,0 +1,552 @@
+package heimdall
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// SchemaViolation is one way a response body does not match its schema
+type SchemaViolation struct {
+	// Pointer is the JSON pointer of the offending value, such as
+	// "/items/0/id", empty for the whole body
+	Pointer string `json:"pointer"`
+	Message string `json:"message"`
+}
+
+// SchemaValidationError is returned, along with the response, for a
+// successful response whose body does not match the schema given for its
+// content type with WithResponseSchema
+type SchemaValidationError struct {
+	MediaType  string
+	Violations []SchemaViolation
+}
+
+func (e *SchemaValidationError) Error() string {
+	violations := make([]string, len(e.Violations))
+	for i, violation := range e.Violations {
+		pointer := violation.Pointer
+		if pointer == "" {
+			pointer = "/"
+		}
+		violations[i] = pointer + ": " + violation.Message
+	}
+
+	return fmt.Sprintf("response does not match the %s schema: %s", e.MediaType, strings.Join(violations, "; "))
+}
+
+// WithResponseSchema validates the bodies of successful responses of content
+// type mediaType against schema, a JSON Schema of draft 7 or later, failing
+// requests whose body does not match with a *SchemaValidationError returned
+// along with the response. Responses with error statuses or other content
+// types are not validated. Schemas are checked when the client is built; one
+// that does not parse fails every request with the parse error. Requests can
+// use their own schema with ContextWithResponseSchema, or skip validation
+// with ContextWithoutResponseSchema.
+//
+// Validation covers the type, enum, const, numeric, string, array and object
+// keywords, the allOf, anyOf, oneOf, not and if/then/else combinators, and
+// $ref to pointers into the same schema. Formats are not checked.
+func WithResponseSchema(mediaType string, schema []byte) Option {
+	return func(options *clientOptions) {
+		schemas := responseSchemas{}
+		for key, parsed := range options.responseSchemas {
+			schemas[key] = parsed
+		}
+		schemas[strings.ToLower(mediaType)] = parseJSONSchema(schema)
+		options.responseSchemas = schemas
+	}
+}
+
+type responseSchemaKey struct{}
+
+// responseSchemaOverride is the schema of a request set through its context
+type responseSchemaOverride struct {
+	skip      bool
+	mediaType string
+	schema    *jsonSchema
+}
+
+// ContextWithResponseSchema validates the responses of content type
+// mediaType of the requests sent with the returned context against schema,
+// instead of the schema given to the client with WithResponseSchema
+func ContextWithResponseSchema(ctx context.Context, mediaType string, schema []byte) context.Context {
+	return context.WithValue(ctx, responseSchemaKey{}, responseSchemaOverride{mediaType: strings.ToLower(mediaType), schema: parseJSONSchema(schema)})
+}
+
+// ContextWithoutResponseSchema skips validating the responses of the requests
+// sent with the returned context
+func ContextWithoutResponseSchema(ctx context.Context) context.Context {
+	return context.WithValue(ctx, responseSchemaKey{}, responseSchemaOverride{skip: true})
+}
+
+// responseSchemas are the schemas of a client by media type
+type responseSchemas map[string]*jsonSchema
+
+// validate checks the body of response to request against the schema of its
+// content type, if any
+func (schemas responseSchemas) validate(request *http.Request, response Response) error {
+	override, overridden := request.Context().Value(responseSchemaKey{}).(responseSchemaOverride)
+	if override.skip || len(schemas) == 0 && !overridden {
+		return nil
+	}
+	if response.statusCode < http.StatusOK || response.statusCode >= http.StatusMultipleChoices {
+		return nil
+	}
+
+	contentType := mediaType(response.headers.Get("Content-Type"))
+	schema := schemas[contentType]
+	if overridden && override.mediaType == contentType {
+		schema = override.schema
+	}
+	if schema == nil {
+		return nil
+	}
+	if schema.err != nil {
+		return schema.err
+	}
+
+	var body interface{}
+	if err := json.Unmarshal(response.Body(), &body); err != nil {
+		return &SchemaValidationError{MediaType: contentType, Violations: []SchemaViolation{{Message: "body is not valid JSON: " + err.Error()}}}
+	}
+	if violations := schema.validate(schema.root, body, ""); len(violations) > 0 {
+		return &SchemaValidationError{MediaType: contentType, Violations: violations}
+	}
+
+	return nil
+}
+
+// jsonSchema is a parsed JSON Schema with the patterns it uses compiled
+type jsonSchema struct {
+	err      error
+	root     interface{}
+	patterns map[string]*regexp.Regexp
+}
+
+// parseJSONSchema reads doc, recording the error when it does not parse
+func parseJSONSchema(doc []byte) *jsonSchema {
+	schema := &jsonSchema{patterns: map[string]*regexp.Regexp{}}
+	if err := json.Unmarshal(doc, &schema.root); err != nil {
+		return &jsonSchema{err: errors.Wrap(err, "invalid response schema")}
+	}
+	if err := schema.compile(schema.root); err != nil {
+		return &jsonSchema{err: errors.Wrap(err, "invalid response schema")}
+	}
+
+	return schema
+}
+
+// compile checks the subschemas of node and compiles their patterns
+func (schema *jsonSchema) compile(node interface{}) error {
+	switch node := node.(type) {
+	case bool:
+		return nil
+	case map[string]interface{}:
+		if pattern, ok := node["pattern"].(string); ok {
+			if err := schema.compilePattern(pattern); err != nil {
+				return err
+			}
+		}
+		if patterns, ok := node["patternProperties"].(map[string]interface{}); ok {
+			for pattern := range patterns {
+				if err := schema.compilePattern(pattern); err != nil {
+					return err
+				}
+			}
+		}
+		if ref, ok := node["$ref"].(string); ok {
+			if _, err := schema.resolve(ref); err != nil {
+				return err
+			}
+		}
+
+		for key, value := range node {
+			switch key {
+			case "enum", "const", "required", "type", "examples", "default":
+				continue
+			}
+			switch value := value.(type) {
+			case map[string]interface{}:
+				if isSchemaMap(key) {
+					for _, subschema := range value {
+						if err := schema.compile(subschema); err != nil {
+							return err
+						}
+					}
+				} else if err := schema.compile(value); err != nil {
+					return err
+				}
+			case []interface{}:
+				if key != "allOf" && key != "anyOf" && key != "oneOf" && key != "items" {
+					continue
+				}
+				for _, subschema := range value {
+					if err := schema.compile(subschema); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	}
+
+	return fmt.Errorf("schema must be an object or a boolean, not %s", jsonType(node))
+}
+
+// isSchemaMap reports whether the keyword key holds schemas by name
+func isSchemaMap(key string) bool {
+	switch key {
+	case "properties", "patternProperties", "definitions", "$defs":
+		return true
+	}
+
+	return false
+}
+
+func (schema *jsonSchema) compilePattern(pattern string) error {
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	schema.patterns[pattern] = compiled
+
+	return nil
+}
+
+// resolve returns the subschema ref points to within the schema
+func (schema *jsonSchema) resolve(ref string) (interface{}, error) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, fmt.Errorf("$ref %q: only references within the schema are supported", ref)
+	}
+
+	node := schema.root
+	for _, token := range strings.Split(strings.TrimPrefix(ref, "#"), "/")[1:] {
+		token = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+		switch parent := node.(type) {
+		case map[string]interface{}:
+			node = parent[token]
+		case []interface{}:
+			index, err := strconv.Atoi(token)
+			if err != nil || index < 0 || index >= len(parent) {
+				return nil, fmt.Errorf("$ref %q does not resolve", ref)
+			}
+			node = parent[index]
+		default:
+			node = nil
+		}
+		if node == nil {
+			return nil, fmt.Errorf("$ref %q does not resolve", ref)
+		}
+	}
+
+	return node, nil
+}
+
+// validate returns the violations of value, found at pointer, against node
+func (schema *jsonSchema) validate(node, value interface{}, pointer string) []SchemaViolation {
+	keywords, ok := node.(map[string]interface{})
+	if !ok {
+		if node == false {
+			return []SchemaViolation{{Pointer: pointer, Message: "no value is allowed"}}
+		}
+		return nil
+	}
+
+	if ref, ok := keywords["$ref"].(string); ok {
+		resolved, _ := schema.resolve(ref)
+		return schema.validate(resolved, value, pointer)
+	}
+
+	var violations []SchemaViolation
+	violate := func(format string, args ...interface{}) {
+		violations = append(violations, SchemaViolation{Pointer: pointer, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if types, ok := keywords["type"]; ok && !matchesType(types, value) {
+		violate("expected %s, got %s", describeTypes(types), jsonType(value))
+		return violations
+	}
+	if enum, ok := keywords["enum"].([]interface{}); ok && !containsValue(enum, value) {
+		violate("value is not one of the enum values")
+	}
+	if constant, ok := keywords["const"]; ok && !reflect.DeepEqual(constant, value) {
+		violate("value does not equal the const value")
+	}
+
+	switch value := value.(type) {
+	case float64:
+		violations = append(violations, validateNumber(keywords, value, pointer)...)
+	case string:
+		violations = append(violations, schema.validateString(keywords, value, pointer)...)
+	case []interface{}:
+		violations = append(violations, schema.validateArray(keywords, value, pointer)...)
+	case map[string]interface{}:
+		violations = append(violations, schema.validateObject(keywords, value, pointer)...)
+	}
+
+	if all, ok := keywords["allOf"].([]interface{}); ok {
+		for _, subschema := range all {
+			violations = append(violations, schema.validate(subschema, value, pointer)...)
+		}
+	}
+	if any, ok := keywords["anyOf"].([]interface{}); ok && schema.matching(any, value, pointer) == 0 {
+		violate("value matches none of the anyOf schemas")
+	}
+	if one, ok := keywords["oneOf"].([]interface{}); ok {
+		if matching := schema.matching(one, value, pointer); matching != 1 {
+			violate("value matches %d of the oneOf schemas instead of exactly one", matching)
+		}
+	}
+	if not, ok := keywords["not"]; ok && len(schema.validate(not, value, pointer)) == 0 {
+		violate("value matches the not schema")
+	}
+	if condition, ok := keywords["if"]; ok {
+		branch, ok := keywords["else"]
+		if len(schema.validate(condition, value, pointer)) == 0 {
+			branch, ok = keywords["then"]
+		}
+		if ok {
+			violations = append(violations, schema.validate(branch, value, pointer)...)
+		}
+	}
+
+	return violations
+}
+
+// matching counts the schemas value matches
+func (schema *jsonSchema) matching(schemas []interface{}, value interface{}, pointer string) int {
+	matching := 0
+	for _, subschema := range schemas {
+		if len(schema.validate(subschema, value, pointer)) == 0 {
+			matching++
+		}
+	}
+
+	return matching
+}
+
+func validateNumber(keywords map[string]interface{}, value float64, pointer string) []SchemaViolation {
+	var violations []SchemaViolation
+	check := func(keyword string, fails func(bound float64) bool, format string) {
+		if bound, ok := keywords[keyword].(float64); ok && fails(bound) {
+			violations = append(violations, SchemaViolation{Pointer: pointer, Message: fmt.Sprintf(format, formatNumber(value), formatNumber(bound))})
+		}
+	}
+
+	check("minimum", func(bound float64) bool { return value < bound }, "%s is less than the minimum of %s")
+	check("maximum", func(bound float64) bool { return value > bound }, "%s is greater than the maximum of %s")
+	check("exclusiveMinimum", func(bound float64) bool { return value <= bound }, "%s is not greater than the exclusive minimum of %s")
+	check("exclusiveMaximum", func(bound float64) bool { return value >= bound }, "%s is not less than the exclusive maximum of %s")
+	check("multipleOf", func(bound float64) bool {
+		quotient := value / bound
+		return bound > 0 && math.Abs(quotient-math.Round(quotient)) > 1e-9
+	}, "%s is not a multiple of %s")
+
+	return violations
+}
+
+func (schema *jsonSchema) validateString(keywords map[string]interface{}, value, pointer string) []SchemaViolation {
+	var violations []SchemaViolation
+	length := utf8.RuneCountInString(value)
+	if min, ok := keywords["minLength"].(float64); ok && float64(length) < min {
+		violations = append(violations, SchemaViolation{Pointer: pointer, Message: fmt.Sprintf("length %d is less than the minimum of %s", length, formatNumber(min))})
+	}
+	if max, ok := keywords["maxLength"].(float64); ok && float64(length) > max {
+		violations = append(violations, SchemaViolation{Pointer: pointer, Message: fmt.Sprintf("length %d is greater than the maximum of %s", length, formatNumber(max))})
+	}
+	if pattern, ok := keywords["pattern"].(string); ok && !schema.patterns[pattern].MatchString(value) {
+		violations = append(violations, SchemaViolation{Pointer: pointer, Message: fmt.Sprintf("%q does not match the pattern %q", value, pattern)})
+	}
+
+	return violations
+}
+
+func (schema *jsonSchema) validateArray(keywords map[string]interface{}, value []interface{}, pointer string) []SchemaViolation {
+	var violations []SchemaViolation
+	if min, ok := keywords["minItems"].(float64); ok && float64(len(value)) < min {
+		violations = append(violations, SchemaViolation{Pointer: pointer, Message: fmt.Sprintf("%d items are fewer than the minimum of %s", len(value), formatNumber(min))})
+	}
+	if max, ok := keywords["maxItems"].(float64); ok && float64(len(value)) > max {
+		violations = append(violations, SchemaViolation{Pointer: pointer, Message: fmt.Sprintf("%d items are more than the maximum of %s", len(value), formatNumber(max))})
+	}
+	if unique, _ := keywords["uniqueItems"].(bool); unique {
+		for i := range value {
+			if containsValue(value[:i], value[i]) {
+				violations = append(violations, SchemaViolation{Pointer: pointer + "/" + strconv.Itoa(i), Message: "item is not unique"})
+			}
+		}
+	}
+	if contains, ok := keywords["contains"]; ok {
+		found := false
+		for i, item := range value {
+			if len(schema.validate(contains, item, pointer+"/"+strconv.Itoa(i))) == 0 {
+				found = true
+				break
+			}
+		}
+		if !found {
+			violations = append(violations, SchemaViolation{Pointer: pointer, Message: "no item matches the contains schema"})
+		}
+	}
+
+	switch items := keywords["items"].(type) {
+	case []interface{}:
+		for i, item := range value {
+			itemSchema, ok := keywords["additionalItems"]
+			if i < len(items) {
+				itemSchema, ok = items[i], true
+			}
+			if ok {
+				violations = append(violations, schema.validate(itemSchema, item, pointer+"/"+strconv.Itoa(i))...)
+			}
+		}
+	case nil:
+	default:
+		for i, item := range value {
+			violations = append(violations, schema.validate(items, item, pointer+"/"+strconv.Itoa(i))...)
+		}
+	}
+
+	return violations
+}
+
+func (schema *jsonSchema) validateObject(keywords map[string]interface{}, value map[string]interface{}, pointer string) []SchemaViolation {
+	var violations []SchemaViolation
+	if required, ok := keywords["required"].([]interface{}); ok {
+		for _, name := range required {
+			if name, ok := name.(string); ok {
+				if _, present := value[name]; !present {
+					violations = append(violations, SchemaViolation{Pointer: pointer, Message: fmt.Sprintf("missing required property %q", name)})
+				}
+			}
+		}
+	}
+	if min, ok := keywords["minProperties"].(float64); ok && float64(len(value)) < min {
+		violations = append(violations, SchemaViolation{Pointer: pointer, Message: fmt.Sprintf("%d properties are fewer than the minimum of %s", len(value), formatNumber(min))})
+	}
+	if max, ok := keywords["maxProperties"].(float64); ok && float64(len(value)) > max {
+		violations = append(violations, SchemaViolation{Pointer: pointer, Message: fmt.Sprintf("%d properties are more than the maximum of %s", len(value), formatNumber(max))})
+	}
+
+	properties, _ := keywords["properties"].(map[string]interface{})
+	patterns, _ := keywords["patternProperties"].(map[string]interface{})
+	additional, hasAdditional := keywords["additionalProperties"]
+
+	// Properties are checked in order so violations come out the same every
+	// time
+	names := make([]string, 0, len(value))
+	for name := range value {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		property := pointer + "/" + strings.NewReplacer("~", "~0", "/", "~1").Replace(name)
+		matched := false
+		if subschema, ok := properties[name]; ok {
+			matched = true
+			violations = append(violations, schema.validate(subschema, value[name], property)...)
+		}
+		for pattern, subschema := range patterns {
+			if schema.patterns[pattern].MatchString(name) {
+				matched = true
+				violations = append(violations, schema.validate(subschema, value[name], property)...)
+			}
+		}
+		if !matched && hasAdditional {
+			if additional == false {
+				violations = append(violations, SchemaViolation{Pointer: property, Message: "additional property is not allowed"})
+			} else {
+				violations = append(violations, schema.validate(additional, value[name], property)...)
+			}
+		}
+	}
+
+	return violations
+}
+
+// matchesType reports whether value is of the type, or one of the types, of
+// the type keyword
+func matchesType(types, value interface{}) bool {
+	if names, ok := types.([]interface{}); ok {
+		for _, name := range names {
+			if matchesType(name, value) {
+				return true
+			}
+		}
+		return false
+	}
+
+	name, _ := types.(string)
+	actual := jsonType(value)
+	switch {
+	case name == actual:
+		return true
+	case name == "number" && actual == "integer":
+		return true
+	}
+
+	return false
+}
+
+func describeTypes(types interface{}) string {
+	names, ok := types.([]interface{})
+	if !ok {
+		return fmt.Sprint(types)
+	}
+
+	described := make([]string, len(names))
+	for i, name := range names {
+		described[i] = fmt.Sprint(name)
+	}
+
+	return strings.Join(described, " or ")
+}
+
+// jsonType names the JSON Schema type of a decoded value
+func jsonType(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if value == math.Trunc(value) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+
+	return fmt.Sprintf("%T", value)
+}
+
+func containsValue(values []interface{}, value interface{}) bool {
+	for _, candidate := range values {
+		if reflect.DeepEqual(candidate, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func formatNumber(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
@@ -0,0 +1,191 @@
+package heimdall
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// schemaServer answers each path with a fixed content type, status and body
+func schemaServer() *httptest.Server {
+	bodies := map[string]struct {
+		status      int
+		contentType string
+		body        string
+	}{
+		"/valid":   {http.StatusOK, "application/json; charset=utf-8", `{"users":[{"id":1,"name":"ada","role":"admin"}],"next":null}`},
+		"/drifted": {http.StatusOK, "application/json", `{"users":[{"id":"1","name":"ada"},{"id":0,"name":"","email":"nope","nickname":"b"}],"next":2}`},
+		"/broken":  {http.StatusOK, "application/json", `{"users":[`},
+		"/text":    {http.StatusOK, "text/plain", `not json`},
+		"/failure": {http.StatusInternalServerError, "application/json", `{"error":"boom"}`},
+		"/missing": {http.StatusNotFound, "application/json", `{"error":"no such user"}`},
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		canned := bodies[r.URL.Path]
+		w.Header().Set("Content-Type", canned.contentType)
+		w.WriteHeader(canned.status)
+		w.Write([]byte(canned.body))
+	}))
+}
+
+func usersSchema(t *testing.T) []byte {
+	schema, err := ioutil.ReadFile("testdata/schema/users.json")
+	require.NoError(t, err)
+
+	return schema
+}
+
+func TestClientsValidateResponsesAgainstTheirSchema(t *testing.T) {
+	for kind, newClient := range map[string]func(opts ...Option) testClient{
+		"http": func(opts ...Option) testClient {
+			return NewHTTPClient(1000, opts...)
+		},
+		"hystrix": func(opts ...Option) testClient {
+			return NewHystrixHTTPClient(1000, NewHystrixConfig("response_schema_command", HystrixCommandConfig{Timeout: 1000}), opts...)
+		},
+	} {
+		t.Run(kind, func(t *testing.T) {
+			server := schemaServer()
+			defer server.Close()
+
+			client := newClient(WithResponseSchema("application/json", usersSchema(t)))
+			client.SetBaseURL(server.URL)
+
+			_, err := client.Get("/valid", http.Header{})
+			require.NoError(t, err)
+
+			response, err := client.Get("/drifted", http.Header{})
+
+			var invalid *SchemaValidationError
+			require.True(t, errors.As(err, &invalid), "%v", err)
+			assert.Equal(t, "application/json", invalid.MediaType)
+			assert.Equal(t, []SchemaViolation{
+				{Pointer: "/next", Message: "expected string or null, got integer"},
+				{Pointer: "/users/0/id", Message: "expected integer, got string"},
+				{Pointer: "/users/1/email", Message: `"nope" does not match the pattern "^[^@]+@[^@]+$"`},
+				{Pointer: "/users/1/id", Message: "0 is less than the minimum of 1"},
+				{Pointer: "/users/1/name", Message: "length 0 is less than the minimum of 1"},
+				{Pointer: "/users/1/nickname", Message: "additional property is not allowed"},
+			}, invalid.Violations)
+			assert.Contains(t, err.Error(), "/users/0/id: expected integer, got string")
+			assert.Equal(t, http.StatusOK, response.StatusCode(), "the response is returned with the error")
+			assert.Contains(t, string(response.Body()), `"nickname":"b"`)
+		})
+	}
+}
+
+func TestResponseSchemaSkipsOtherResponses(t *testing.T) {
+	server := schemaServer()
+	defer server.Close()
+
+	client := NewHTTPClient(1000, WithResponseSchema("application/json", usersSchema(t)))
+	client.SetBaseURL(server.URL)
+
+	response, err := client.Get("/text", http.Header{})
+	require.NoError(t, err, "other content types are not validated")
+	assert.Equal(t, "not json", string(response.Body()))
+
+	_, err = client.Get("/failure", http.Header{})
+	assert.Contains(t, err.Error(), "server error: 500")
+
+	response, err = client.Get("/missing", http.Header{})
+	require.NoError(t, err, "error statuses are not validated")
+	assert.Equal(t, http.StatusNotFound, response.StatusCode())
+
+	_, err = client.Get("/broken", http.Header{})
+	var invalid *SchemaValidationError
+	require.True(t, errors.As(err, &invalid), "%v", err)
+	require.Len(t, invalid.Violations, 1)
+	assert.Equal(t, "", invalid.Violations[0].Pointer)
+	assert.Contains(t, invalid.Violations[0].Message, "body is not valid JSON")
+}
+
+func TestResponseSchemaPerRequest(t *testing.T) {
+	server := schemaServer()
+	defer server.Close()
+
+	client := NewHTTPClient(1000, WithResponseSchema("application/json", usersSchema(t)))
+
+	request, err := http.NewRequest(http.MethodGet, server.URL+"/drifted", nil)
+	require.NoError(t, err)
+
+	_, err = client.Do(request.WithContext(ContextWithoutResponseSchema(context.Background())))
+	require.NoError(t, err)
+
+	loose := ContextWithResponseSchema(context.Background(), "application/json", []byte(`{"required":["users"]}`))
+	_, err = client.Do(request.WithContext(loose))
+	require.NoError(t, err)
+
+	strict := ContextWithResponseSchema(context.Background(), "APPLICATION/JSON", []byte(`{"properties":{"users":{"maxItems":1}}}`))
+	_, err = NewHTTPClient(1000).Do(request.WithContext(strict))
+
+	var invalid *SchemaValidationError
+	require.True(t, errors.As(err, &invalid), "clients without schemas use those of requests: %v", err)
+	assert.Equal(t, []SchemaViolation{{Pointer: "/users", Message: "2 items are more than the maximum of 1"}}, invalid.Violations)
+}
+
+func TestInvalidResponseSchemaFailsRequests(t *testing.T) {
+	server := schemaServer()
+	defer server.Close()
+
+	for _, schema := range []string{`{"type":`, `[]`, `{"pattern":"("}`, `{"$ref":"#/definitions/missing"}`} {
+		_, err := NewHTTPClient(1000, WithResponseSchema("application/json", []byte(schema))).Get(server.URL+"/valid", http.Header{})
+		require.Error(t, err, schema)
+		assert.True(t, strings.HasPrefix(err.Error(), "invalid response schema"), "%s: %v", schema, err)
+	}
+}
+
+func TestJSONSchemaKeywords(t *testing.T) {
+	cases := []struct {
+		schema string
+		valid  []string
+		failed []string
+	}{
+		{`{"type":"number","exclusiveMaximum":10,"multipleOf":0.5}`, []string{`9.5`, `2`}, []string{`10`, `1.2`, `"1"`}},
+		{`{"const":{"a":[1]}}`, []string{`{"a":[1]}`}, []string{`{"a":[2]}`}},
+		{`{"type":"array","items":[{"type":"string"}],"additionalItems":false,"uniqueItems":true}`, []string{`["a"]`}, []string{`[1]`, `["a","b"]`}},
+		{`{"contains":{"type":"integer"},"minItems":1}`, []string{`["a",1]`}, []string{`["a"]`, `[]`}},
+		{`{"anyOf":[{"type":"string"},{"type":"integer"}]}`, []string{`"a"`, `1`}, []string{`true`}},
+		{`{"oneOf":[{"type":"number"},{"type":"integer"}]}`, []string{`1.5`}, []string{`1`}},
+		{`{"not":{"type":"null"}}`, []string{`0`}, []string{`null`}},
+		{`{"if":{"required":["card"]},"then":{"required":["cvv"]},"else":{"maxProperties":1}}`, []string{`{"card":1,"cvv":2}`, `{"a":1}`}, []string{`{"card":1}`, `{"a":1,"b":2}`}},
+		{`{"patternProperties":{"^x-":{"type":"string"}},"additionalProperties":{"type":"integer"}}`, []string{`{"x-a":"b","c":1}`}, []string{`{"x-a":1}`, `{"c":"d"}`}},
+		{`{"definitions":{"node":{"type":"object","properties":{"next":{"$ref":"#/definitions/node"}}}},"$ref":"#/definitions/node"}`, []string{`{"next":{"next":{}}}`}, []string{`{"next":{"next":1}}`}},
+		{`{"allOf":[{"minLength":2},{"maxLength":3}]}`, []string{`"ab"`}, []string{`"a"`, `"abcd"`}},
+		{`false`, nil, []string{`{}`}},
+	}
+	for _, c := range cases {
+		schema := parseJSONSchema([]byte(c.schema))
+		require.NoError(t, schema.err, c.schema)
+
+		for _, doc := range c.valid {
+			assert.Empty(t, validateJSON(t, schema, doc), "%s should accept %s", c.schema, doc)
+		}
+		for _, doc := range c.failed {
+			assert.NotEmpty(t, validateJSON(t, schema, doc), "%s should reject %s", c.schema, doc)
+		}
+	}
+}
+
+func validateJSON(t *testing.T, schema *jsonSchema, doc string) []SchemaViolation {
+	response := Response{statusCode: http.StatusOK, body: []byte(doc), headers: http.Header{"Content-Type": {"application/json"}}}
+	request, err := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	require.NoError(t, err)
+
+	err = responseSchemas{"application/json": schema}.validate(request, response)
+	if err == nil {
+		return nil
+	}
+
+	var invalid *SchemaValidationError
+	require.True(t, errors.As(err, &invalid), "%v", err)
+	return invalid.Violations
+}
@@ -1,10 +1,18 @@
 package heimdall
 
 import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestStatusCodeOfResponse(t *testing.T) {
@@ -24,3 +32,196 @@ func TestBodyOfResponse(t *testing.T) {
 
 	assert.Equal(t, []byte(`hello`), response.Body())
 }
+
+func TestHeadersOfResponse(t *testing.T) {
+	headers := http.Header{}
+	headers.Set("Content-Type", "application/json")
+
+	response := Response{
+		statusCode: http.StatusOK,
+		headers:    headers,
+	}
+
+	assert.Equal(t, "application/json", response.Headers().Get("Content-Type"))
+}
+
+func TestZeroResponseHasNoBody(t *testing.T) {
+	assert.False(t, Response{}.HasBody())
+	assert.True(t, Response{statusCode: 200, hasBody: true}.HasBody())
+}
+
+// multiValueHandler answers with three cookies and two Vary lines, failing
+// the first failures requests
+func multiValueHandler(failures int) http.HandlerFunc {
+	calls := 0
+	return func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		header := w.Header()
+		header.Add("Set-Cookie", "session=abc; Path=/; HttpOnly")
+		header.Add("Set-Cookie", "theme=dark")
+		header.Add("Set-Cookie", "lang=en; Max-Age=3600")
+		header.Add("Vary", "Accept")
+		header.Add("Vary", "Accept-Encoding")
+		if calls <= failures {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}
+}
+
+func assertMultiValueHeaders(t *testing.T, response Response) {
+	cookies := response.Cookies()
+	require.Len(t, cookies, 3)
+	assert.Equal(t, "session", cookies[0].Name)
+	assert.True(t, cookies[0].HttpOnly)
+	assert.Equal(t, "dark", cookies[1].Value)
+	assert.Equal(t, 3600, cookies[2].MaxAge)
+
+	assert.Equal(t, []string{"Accept", "Accept-Encoding"}, response.Headers()["Vary"])
+}
+
+func TestMultiValueHeadersSurviveRetries(t *testing.T) {
+	server := httptest.NewServer(multiValueHandler(1))
+	defer server.Close()
+
+	client := NewHTTPClient(1000, WithSingleflight())
+	client.SetRetryCount(1)
+
+	var hooked http.Header
+	client.Use(func(next Doer) Doer {
+		return DoerFunc(func(request *http.Request) (*http.Response, error) {
+			response, err := next.Do(request)
+			if err == nil {
+				hooked = response.Header
+			}
+			return response, err
+		})
+	})
+
+	response, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+
+	assertMultiValueHeaders(t, response)
+	assert.Len(t, hooked["Set-Cookie"], 3)
+}
+
+func TestMultiValueHeadersSurviveExhaustedRetries(t *testing.T) {
+	server := httptest.NewServer(multiValueHandler(2))
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+	client.SetRetryCount(1)
+
+	_, err := client.Get(server.URL, http.Header{})
+
+	var exhausted *RetriesExhaustedError
+	require.True(t, errors.As(err, &exhausted))
+	assertMultiValueHeaders(t, exhausted.LastResponse)
+}
+
+func TestMultiValueHeadersSurviveCaching(t *testing.T) {
+	server := httptest.NewServer(multiValueHandler(0))
+	defer server.Close()
+
+	response, err := NewHTTPClient(1000).Get(server.URL, http.Header{})
+	require.NoError(t, err)
+
+	store, err := NewDiskCacheStore(t.TempDir(), 1<<20)
+	require.NoError(t, err)
+
+	entry := NewCachedResponse(response, time.Time{})
+	response.Headers().Add("Set-Cookie", "late=1")
+	require.NoError(t, store.Set("multi", entry))
+
+	cached, ok, err := store.Get("multi")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	restored := cached.Response()
+	assertMultiValueHeaders(t, restored)
+	assert.Equal(t, http.StatusOK, restored.StatusCode())
+	assert.True(t, restored.HasBody())
+}
+
+func TestBodyReadersAreIndependent(t *testing.T) {
+	response := Response{body: []byte(`hello`)}
+
+	first, second := response.BodyReader(), response.BodyReader()
+	prefix := make([]byte, 3)
+	_, err := io.ReadFull(first, prefix)
+	require.NoError(t, err)
+
+	rest, err := ioutil.ReadAll(second)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(rest))
+
+	rest, err = ioutil.ReadAll(first)
+	require.NoError(t, err)
+	assert.Equal(t, "lo", string(rest))
+}
+
+func TestResponseHeadersAreCopies(t *testing.T) {
+	response := Response{
+		headers:  http.Header{"Content-Type": {"application/json"}},
+		trailers: http.Header{"Checksum": {"abc"}},
+		attempts: []AttemptTrace{{Attempt: 0, StatusCode: http.StatusOK}},
+	}
+
+	response.Headers().Set("Content-Type", "text/plain")
+	response.Trailers().Del("Checksum")
+	response.Trace().Attempts[0].StatusCode = http.StatusTeapot
+
+	assert.Equal(t, "application/json", response.Headers().Get("Content-Type"))
+	assert.Equal(t, "abc", response.Trailers().Get("Checksum"))
+	assert.Equal(t, http.StatusOK, response.Trace().Attempts[0].StatusCode)
+	assert.Nil(t, Response{}.Headers())
+	assert.Nil(t, Response{}.Trailers())
+}
+
+func TestResponseSharedAcrossGoroutines(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "Checksum")
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Add("Set-Cookie", "session=abc")
+		w.Write([]byte(`{"users": ["ana", "bo"]}`))
+		w.Header().Set("Checksum", "abc")
+	}))
+	defer server.Close()
+
+	response, err := NewHTTPClient(1000).Get(server.URL, http.Header{})
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			var parsed struct{ Users []string }
+			assert.NoError(t, json.Unmarshal(response.Body(), &parsed))
+			assert.Equal(t, []string{"ana", "bo"}, parsed.Users)
+
+			archived, err := ioutil.ReadAll(response.BodyReader())
+			assert.NoError(t, err)
+			assert.Equal(t, response.Body(), archived)
+
+			headers := response.Headers()
+			headers.Set("Content-Type", "text/plain")
+			headers.Add("Set-Cookie", "other=1")
+			trailers := response.Trailers()
+			trailers.Set("Checksum", "changed")
+			trace := response.Trace()
+			trace.Attempts[0].Error = "changed"
+
+			assert.Equal(t, "application/json", response.ContentType())
+			assert.Len(t, response.Cookies(), 1)
+			assert.Equal(t, "abc", response.Trailers().Get("Checksum"))
+			assert.Empty(t, response.Trace().Attempts[0].Error)
+			assert.Equal(t, http.StatusOK, response.StatusCode())
+			assert.True(t, response.HasBody())
+			assert.NotEmpty(t, response.RequestID())
+			assert.NotEmpty(t, response.FinalURL())
+			assert.True(t, response.BytesReceived() > 0)
+		}()
+	}
+	wg.Wait()
+}
@@ -1,6 +1,9 @@
 package heimdall
 
-import "time"
+import (
+	"net/http"
+	"time"
+)
 
 const defaultExponentFactor float64 = 2.0
 
@@ -9,6 +12,75 @@ type Retriable interface {
 	NextInterval(retry int) time.Duration
 }
 
+// RetrierFactory is implemented by retriers that keep state between the
+// attempts of a single request. Clients ask it for a fresh retrier per request
+// so that concurrent requests never share that state.
+type RetrierFactory interface {
+	NewRequestRetrier() Retriable
+}
+
+// requestRetrier returns the retrier to use for one request
+func requestRetrier(r Retriable) Retriable {
+	if factory, ok := r.(RetrierFactory); ok {
+		return factory.NewRequestRetrier()
+	}
+
+	return r
+}
+
+// RejectionRetrier is implemented by retriers that also want attempts
+// rejected by hystrix, for an open circuit or a saturated pool, retried with
+// backoff. Such attempts fail immediately by default, as retrying into a
+// rejecting command rarely succeeds.
+type RejectionRetrier interface {
+	RetryRejections() bool
+}
+
+// AttemptObserver is implemented by retriers and backoffs that adapt their
+// waits to the responses of a request. Before the wait following a failed
+// attempt is asked for, they are shown its number, from 0, with the status
+// and a copy of the headers of its response, or 0 and nil headers when no
+// response was received.
+type AttemptObserver interface {
+	ObserveAttempt(attempt, statusCode int, headers http.Header)
+}
+
+// retriesRejections reports whether attempts rejected by hystrix should be
+// retried with r
+func retriesRejections(r Retriable) bool {
+	rejection, ok := r.(RejectionRetrier)
+	return ok && rejection.RetryRejections()
+}
+
+type rejectionRetrier struct {
+	Retriable
+}
+
+// NewRejectionRetrier returns a retrier which waits as retrier does and also
+// retries attempts rejected by hystrix
+func NewRejectionRetrier(retrier Retriable) Retriable {
+	return &rejectionRetrier{Retriable: retrier}
+}
+
+// RetryRejections returns true
+func (r *rejectionRetrier) RetryRejections() bool {
+	return true
+}
+
+// ObserveAttempt shows the attempt to the wrapped retrier when it is an
+// AttemptObserver
+func (r *rejectionRetrier) ObserveAttempt(attempt, statusCode int, headers http.Header) {
+	if observer, ok := r.Retriable.(AttemptObserver); ok {
+		observer.ObserveAttempt(attempt, statusCode, headers)
+	}
+}
+
+// NewRequestRetrier returns a rejection retrier over a fresh retrier per
+// request when the wrapped retrier keeps state
+func (r *rejectionRetrier) NewRequestRetrier() Retriable {
+	return &rejectionRetrier{Retriable: requestRetrier(r.Retriable)}
+}
+
 type retrier struct {
 	backoff Backoff
 }
@@ -25,6 +97,24 @@ func (r *retrier) NextInterval(retry int) time.Duration {
 	return r.backoff.Next(retry)
 }
 
+// ObserveAttempt shows the attempt to the backoff when it is an
+// AttemptObserver
+func (r *retrier) ObserveAttempt(attempt, statusCode int, headers http.Header) {
+	if observer, ok := r.backoff.(AttemptObserver); ok {
+		observer.ObserveAttempt(attempt, statusCode, headers)
+	}
+}
+
+// NewRequestRetrier returns a retrier with fresh backoff state when the backoff
+// keeps any, and the retrier itself otherwise
+func (r *retrier) NewRequestRetrier() Retriable {
+	if factory, ok := r.backoff.(BackoffFactory); ok {
+		return &retrier{backoff: factory.NewRequestBackoff()}
+	}
+
+	return r
+}
+
 type noRetrier struct {
 }
 
@@ -0,0 +1,216 @@
+package heimdall
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const defaultRetryBudgetKey = "heimdall:retry_budget"
+
+// RetryBudgetCounter keeps the counts of a RetryBudget, so that replicas
+// given counters on one backend, such as the Redis counter of the rediscache
+// package, retry within one budget
+type RetryBudgetCounter interface {
+	// Incr adds one to the counter named key, which starts at zero when it
+	// does not exist and is dropped no sooner than ttl after it was first
+	// incremented, and returns its new value
+	Incr(key string, ttl time.Duration) (int64, error)
+	// Get returns the value of the counter named key, zero when it does not
+	// exist
+	Get(key string) (int64, error)
+}
+
+// RetryBudgetConfig tunes a RetryBudget. Zero fields take the defaults: a 10
+// second window, 0.2 retries per request and 10 retries per window.
+type RetryBudgetConfig struct {
+	// Window is how long requests and retries are counted before counting
+	// starts over
+	Window time.Duration
+	// Ratio is the number of retries allowed per request counted in the
+	// window
+	Ratio float64
+	// MinRetries is the number of retries allowed in every window on top of
+	// Ratio, so that clients sending few requests still retry
+	MinRetries int
+	// Counter keeps the counts, which are kept in memory when it is nil.
+	// The counts are always kept in memory too, and the budget falls back
+	// to them while Counter fails.
+	Counter RetryBudgetCounter
+	// Key prefixes the names of the counters, telling apart the budgets of
+	// different upstreams sharing Counter. It is "heimdall:retry_budget" by
+	// default.
+	Key string
+}
+
+// RetryBudget caps the retries of the clients it is given to with
+// WithRetryBudget to a share of their requests, so that an unhealthy upstream
+// is not sent several times its usual load. Requests and retries are counted
+// in fixed windows, and a retry the budget does not allow ends its request as
+// if its retries had run out. Replicas sharing the counts through the same
+// Counter and Key count each other's requests and retries, and may then
+// overshoot the budget by the retries they decide on at the same time.
+type RetryBudget struct {
+	config RetryBudgetConfig
+	clock  Clock
+	local  *memoryBudgetCounter
+}
+
+// NewRetryBudget returns a budget with config, reading time from clock or the
+// real clock when it is nil
+func NewRetryBudget(config RetryBudgetConfig, clock Clock) (*RetryBudget, error) {
+	if config.Window == 0 {
+		config.Window = 10 * time.Second
+	}
+	if config.Ratio == 0 {
+		config.Ratio = 0.2
+	}
+	if config.MinRetries == 0 {
+		config.MinRetries = 10
+	}
+	if config.Key == "" {
+		config.Key = defaultRetryBudgetKey
+	}
+
+	switch {
+	case config.Window < time.Millisecond:
+		return nil, fmt.Errorf("retry budget - window must be at least 1ms, got %s", config.Window)
+	case config.Ratio < 0:
+		return nil, fmt.Errorf("retry budget - ratio must not be negative, got %g", config.Ratio)
+	case config.MinRetries < 0:
+		return nil, fmt.Errorf("retry budget - minimum retries must not be negative, got %d", config.MinRetries)
+	}
+
+	clock = clockOrReal(clock)
+
+	return &RetryBudget{
+		config: config,
+		clock:  clock,
+		local:  &memoryBudgetCounter{clock: clock, counts: map[string]memoryBudgetCount{}},
+	}, nil
+}
+
+// request counts a request. It does nothing on a nil budget.
+func (b *RetryBudget) request() {
+	if b == nil {
+		return
+	}
+
+	requestsKey, _, ttl := b.keys()
+	b.local.Incr(requestsKey, ttl)
+	if b.config.Counter != nil {
+		b.config.Counter.Incr(requestsKey, ttl)
+	}
+}
+
+// allowRetry reports whether the budget allows another retry, counting it
+// when it does. A nil budget allows every retry.
+func (b *RetryBudget) allowRetry() bool {
+	if b == nil {
+		return true
+	}
+
+	requestsKey, retriesKey, ttl := b.keys()
+	allowed, _ := b.allows(b.local, requestsKey, retriesKey)
+	if b.config.Counter != nil {
+		if shared, err := b.allows(b.config.Counter, requestsKey, retriesKey); err == nil {
+			allowed = shared
+		}
+	}
+	if !allowed {
+		return false
+	}
+
+	b.local.Incr(retriesKey, ttl)
+	if b.config.Counter != nil {
+		b.config.Counter.Incr(retriesKey, ttl)
+	}
+
+	return true
+}
+
+// allows reports whether the counts of counter leave room for another retry
+func (b *RetryBudget) allows(counter RetryBudgetCounter, requestsKey, retriesKey string) (bool, error) {
+	requests, err := counter.Get(requestsKey)
+	if err != nil {
+		return false, err
+	}
+	retries, err := counter.Get(retriesKey)
+	if err != nil {
+		return false, err
+	}
+
+	return b.within(requests, retries), nil
+}
+
+// within reports whether one more retry stays within the budget of requests
+func (b *RetryBudget) within(requests, retries int64) bool {
+	return float64(retries) < float64(b.config.MinRetries)+b.config.Ratio*float64(requests)
+}
+
+// keys return the names of the request and retry counters of the current
+// window, and how long they must be kept: two windows, so that they outlive
+// the window on replicas whose clocks are slightly behind
+func (b *RetryBudget) keys() (requests, retries string, ttl time.Duration) {
+	window := b.config.Key + ":" + strconv.FormatInt(b.clock.Now().UnixNano()/int64(b.config.Window), 10)
+
+	return window + ":requests", window + ":retries", 2 * b.config.Window
+}
+
+// WithRetryBudget caps the retries of the client with budget, which may be
+// shared by several clients and is shared by clients made with Derive unless
+// they are given another one
+func WithRetryBudget(budget *RetryBudget) Option {
+	return func(options *clientOptions) {
+		options.retryBudget = budget
+	}
+}
+
+// memoryBudgetCounter is a RetryBudgetCounter in memory, dropping counters
+// on its clock
+type memoryBudgetCounter struct {
+	mu     sync.Mutex
+	clock  Clock
+	counts map[string]memoryBudgetCount
+}
+
+type memoryBudgetCount struct {
+	value   int64
+	expires time.Time
+}
+
+// Incr adds one to the counter named key, dropping the expired counters
+func (m *memoryBudgetCounter) Incr(key string, ttl time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.clock.Now()
+	for name, count := range m.counts {
+		if !now.Before(count.expires) {
+			delete(m.counts, name)
+		}
+	}
+
+	count, ok := m.counts[key]
+	if !ok {
+		count.expires = now.Add(ttl)
+	}
+	count.value++
+	m.counts[key] = count
+
+	return count.value, nil
+}
+
+// Get returns the value of the counter named key
+func (m *memoryBudgetCounter) Get(key string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	count, ok := m.counts[key]
+	if !ok || !m.clock.Now().Before(count.expires) {
+		return 0, nil
+	}
+
+	return count.value, nil
+}
@@ -0,0 +1,149 @@
+package heimdall
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gojektech/heimdall/fakeclock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// downServer counts its requests in calls and fails every one of them
+func downServer(calls *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+}
+
+// failingCounter is a RetryBudgetCounter whose backend is unreachable
+type failingCounter struct{}
+
+var errCounterDown = errors.New("counter down")
+
+func (failingCounter) Incr(key string, ttl time.Duration) (int64, error) {
+	return 0, errCounterDown
+}
+
+func (failingCounter) Get(key string) (int64, error) {
+	return 0, errCounterDown
+}
+
+func newMemoryBudgetCounter(clock Clock) *memoryBudgetCounter {
+	return &memoryBudgetCounter{clock: clock, counts: map[string]memoryBudgetCount{}}
+}
+
+func TestRetryBudgetCapsRetries(t *testing.T) {
+	counters := map[string]func(clock Clock) RetryBudgetCounter{
+		"memory": func(clock Clock) RetryBudgetCounter { return nil },
+		"shared": func(clock Clock) RetryBudgetCounter { return newMemoryBudgetCounter(clock) },
+		"failing": func(clock Clock) RetryBudgetCounter {
+			return failingCounter{}
+		},
+	}
+
+	for counterKind, newCounter := range counters {
+		for kind, newClient := range retryClients {
+			t.Run(counterKind+"/"+kind, func(t *testing.T) {
+				var calls int32
+				server := downServer(&calls)
+				defer server.Close()
+
+				clock := fakeclock.New(time.Now())
+				budget, err := NewRetryBudget(RetryBudgetConfig{Window: time.Minute, Ratio: 0.5, MinRetries: 1, Counter: newCounter(clock)}, clock)
+				require.NoError(t, err)
+				client := derive(newClient(t.Name(), clock), WithRetryBudget(budget))
+				client.SetRetryCount(3)
+
+				_, err = client.Get(server.URL, http.Header{})
+				var exhausted *RetriesExhaustedError
+				require.True(t, errors.As(err, &exhausted), "%v", err)
+				assert.Equal(t, 3, exhausted.Attempts, "one request allows 1.5 retries")
+				assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+				_, err = client.Get(server.URL, http.Header{})
+				require.True(t, errors.As(err, &exhausted), "%v", err)
+				assert.Equal(t, 1, exhausted.Attempts, "two requests allow two retries, both spent")
+
+				clock.Advance(time.Minute)
+				_, err = client.Get(server.URL, http.Header{})
+				require.True(t, errors.As(err, &exhausted), "%v", err)
+				assert.Equal(t, 3, exhausted.Attempts, "the budget starts over every window")
+				assert.Equal(t, int32(7), atomic.LoadInt32(&calls))
+			})
+		}
+	}
+}
+
+func TestSharedRetryBudgetCountsEveryReplica(t *testing.T) {
+	var calls int32
+	server := downServer(&calls)
+	defer server.Close()
+
+	clock := fakeclock.New(time.Now())
+	counter := newMemoryBudgetCounter(clock)
+	replicas := make([]Client, 2)
+	for i := range replicas {
+		budget, err := NewRetryBudget(RetryBudgetConfig{Window: time.Minute, Ratio: 0.5, MinRetries: 1, Counter: counter}, clock)
+		require.NoError(t, err)
+		replicas[i] = NewHTTPClient(1000, WithClock(clock), WithRetryBudget(budget))
+		replicas[i].SetRetryCount(3)
+	}
+
+	replicas[0].Get(server.URL, http.Header{})
+	replicas[1].Get(server.URL, http.Header{})
+	assert.Equal(t, int32(4), atomic.LoadInt32(&calls), "the second replica finds the retries of the first spent")
+}
+
+func TestRetryBudgetRecordsItsDecision(t *testing.T) {
+	var calls int32
+	server := downServer(&calls)
+	defer server.Close()
+
+	budget, err := NewRetryBudget(RetryBudgetConfig{Ratio: 0.1, MinRetries: 1}, nil)
+	require.NoError(t, err)
+	client := NewHTTPClient(1000, WithRetryBudget(budget), WithDecisionLog(10, nil))
+	client.SetRetryCount(3)
+
+	client.Get(server.URL, http.Header{})
+
+	decisions := client.LastDecisions(10)
+	require.Len(t, decisions, 3)
+	assert.Equal(t, DecisionRetry, decisions[1].Verdict)
+	assert.Equal(t, DecisionRetryBudgetExhausted, decisions[2].Verdict, "one request allows 1.1 retries")
+}
+
+func TestNewRetryBudgetValidatesConfig(t *testing.T) {
+	budget, err := NewRetryBudget(RetryBudgetConfig{}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, RetryBudgetConfig{Window: 10 * time.Second, Ratio: 0.2, MinRetries: 10, Key: "heimdall:retry_budget"}, budget.config)
+
+	for config, message := range map[RetryBudgetConfig]string{
+		{Window: time.Microsecond}: "retry budget - window must be at least 1ms, got 1µs",
+		{Ratio: -1}:                "retry budget - ratio must not be negative, got -1",
+		{MinRetries: -1}:           "retry budget - minimum retries must not be negative, got -1",
+	} {
+		_, err := NewRetryBudget(config, nil)
+		assert.EqualError(t, err, message)
+	}
+}
+
+func TestMemoryBudgetCounterDropsExpiredCounters(t *testing.T) {
+	clock := fakeclock.New(time.Now())
+	counter := newMemoryBudgetCounter(clock)
+
+	counter.Incr("old", time.Second)
+	value, _ := counter.Incr("old", time.Second)
+	assert.Equal(t, int64(2), value)
+
+	clock.Advance(time.Second)
+	value, _ = counter.Get("old")
+	assert.Zero(t, value)
+	counter.Incr("new", time.Second)
+	assert.Len(t, counter.counts, 1)
+}
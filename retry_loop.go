@@ -0,0 +1,314 @@
+package heimdall
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/afex/hystrix-go/hystrix"
+	"github.com/gojektech/valkyrie"
+)
+
+// attemptOutcome is the result of sending one attempt of a request
+type attemptOutcome struct {
+	response Response
+	// err fails the attempt, which is retried while attempts remain
+	err error
+	// cause is the error matched by errors.Is on RetriesExhaustedError, which
+	// is nil when the server answered with an error status
+	cause error
+	// rejected marks attempts refused by hystrix without being sent, which
+	// the failure detector does not count
+	rejected bool
+	// abort ends the request at once, returning response with abort as error
+	abort error
+	// fallback marks attempts for which the hystrix fallback ran
+	fallback bool
+}
+
+// attemptFunc sends request, the clone of a request for its attempt number
+// attempt. lastResponse is the last response received by an earlier attempt.
+type attemptFunc func(request *http.Request, attempt int, lastResponse Response) attemptOutcome
+
+// retryHooks are the parts of a client taking part in executeWithRetries
+type retryHooks struct {
+	clock       Clock
+	mutators    []RequestMutator
+	failures    *FailureDetector
+	retryBudget *RetryBudget
+	concurrency *concurrencyLimiter
+	rateLimits  *rateLimitCooldown
+	expvar      *expvarMetrics
+
+	minAttemptBudget time.Duration
+	stats            *clientStats
+	tenants          *tenantQuotas
+	decisions        *decisionLog
+	apdex            time.Duration
+	maintenance      *maintenanceMonitor
+	shutdown         *shutdownGate
+	queue            *concurrencyQueue
+	// connectRetrier paces the retries of attempts that failed to connect in
+	// place of the retrier, when set
+	connectRetrier Retriable
+}
+
+// executeWithRetries sends request through attemptFn, retrying failed
+// attempts up to count times and waiting as retrier advises between them. The
+// request body is rewound and the mutators run before each attempt, no
+// attempt is sent once the request context is done, waits are cut short to
+// fit the context deadline, and no wait follows the final attempt. The
+// response carries the ID of the request, which hooks read with
+// RequestIDFromContext, the bytes its attempts sent and received, and the
+// trace of its attempts. Both clients share it so that their retries cannot
+// drift.
+func executeWithRetries(request *http.Request, attemptFn attemptFunc, retrier Retriable, count int, hooks retryHooks) (Response, error) {
+	attempts := make([]AttemptTrace, 0, count+1)
+	response, err := runAttempts(request, attemptFn, retrier, count, hooks, &attempts)
+	trace, _ := request.Context().Value(requestTraceKey{}).(*requestTrace)
+	trace.stamp(&response)
+	response.attempts = attempts
+
+	return response, err
+}
+
+// runAttempts runs the attempts of executeWithRetries, appending the trace of
+// each to traces
+func runAttempts(request *http.Request, attemptFn attemptFunc, retrier Retriable, count int, hooks retryHooks, traces *[]AttemptTrace) (Response, error) {
+	trace, _ := request.Context().Value(requestTraceKey{}).(*requestTrace)
+
+	hr := Response{}
+	lastResponse := Response{}
+	multiErr := valkyrie.NewMultiError()
+
+	start := hooks.clock.Now()
+	attempts := 0
+	var attemptErr error
+	hooks.retryBudget.request()
+	for i := 0; i <= count; i++ {
+		if ctxErr := request.Context().Err(); ctxErr != nil {
+			err := &ErrContextDone{Attempts: attempts, LastResponse: lastResponse, err: ctxErr}
+			hooks.decide(request, start, i, count, Response{}, err, DecisionCancelled, 0)
+			hooks.observe(start, attempts, hr, err)
+			return hr, err
+		}
+
+		if err := hooks.maintenance.check(request.URL.Host, hooks.clock.Now()); err != nil {
+			hooks.decide(request, start, i, count, Response{}, err, DecisionAborted, 0)
+			hooks.observe(start, attempts, hr, err)
+			return hr, err
+		}
+
+		if err := hooks.awaitRateLimit(request, attempts, lastResponse); err != nil {
+			hooks.decide(request, start, i, count, Response{}, err, abortVerdict(err), 0)
+			hooks.observe(start, attempts, hr, err)
+			return hr, err
+		}
+
+		trace.setAttempt(i)
+		attemptRequest, err := prepareAttempt(request, i, hooks.mutators)
+		if err != nil {
+			hooks.decide(request, start, i, count, Response{}, err, DecisionAborted, 0)
+			hooks.observe(start, attempts, hr, err)
+			return hr, err
+		}
+
+		tenant := TenantFromContext(request.Context())
+		if err := hooks.tenants.acquire(tenant, hooks.clock.Now()); err != nil {
+			hooks.decide(request, start, i, count, Response{}, err, DecisionAborted, 0)
+			hooks.observe(start, attempts, hr, err)
+			return hr, err
+		}
+
+		var probe *connectionProbe
+		if i < count && hooks.connectRetrier != nil {
+			attemptRequest, probe = probeConnection(attemptRequest)
+		}
+
+		attempts++
+		hooks.stats.attempt(i)
+		began := hooks.clock.Now()
+		outcome := hooks.limitedAttempt(attemptFn, attemptRequest, i, lastResponse, retrier)
+		hooks.tenants.release(tenant)
+		ended := hooks.clock.Now()
+		attemptTrace := newAttemptTrace(i, began, ended, outcome)
+		attemptTrace.Phases = trace.takePhases()
+		attemptTrace.Sent = trace.takeSent()
+		attemptTrace.Redirects = trace.takeRedirects()
+		attemptTrace.ConnectFailure = probe.failedToConnect(outcome)
+		*traces = append(*traces, attemptTrace)
+		hr = outcome.response
+		hr.attempts = *traces
+		hr.received = ended
+		trace.stamp(&hr)
+		if hooks.rateLimits != nil {
+			hooks.rateLimits.observe(request.URL.Host, hr, hooks.clock.Now())
+		}
+		if outcome.abort != nil {
+			hooks.decide(request, start, i, count, hr, outcome.abort, abortVerdict(outcome.abort), 0)
+			hooks.observe(start, attempts, hr, outcome.abort)
+			return hr, outcome.abort
+		}
+
+		if hr.statusCode != 0 {
+			if lastResponse.spool != hr.spool {
+				lastResponse.Close()
+			}
+			lastResponse = hr
+		}
+		if !outcome.rejected {
+			hooks.failures.Record(outcome.err == nil)
+		}
+
+		if outcome.err == nil {
+			hooks.decide(request, start, i, count, hr, nil, DecisionSucceeded, 0)
+			multiErr = valkyrie.NewMultiError() // Clear errors if any iteration succeeds
+			break
+		}
+
+		multiErr.Push(outcome.err.Error())
+		attemptErr = outcome.cause
+
+		if i < count {
+			next := retrier
+			if attemptTrace.ConnectFailure {
+				next = hooks.connectRetrier
+			}
+			interval, err := nextInterval(next, i, hr)
+			if err != nil {
+				hooks.decide(request, start, i, count, hr, err, DecisionAborted, 0)
+				hooks.observe(start, attempts, hr, err)
+				return hr, err
+			}
+			interval, left, fits := hooks.fitBackoff(request, interval)
+			if !fits {
+				err := &ErrContextDone{Attempts: attempts, LastResponse: lastResponse, err: context.DeadlineExceeded, skipped: true, left: left}
+				hooks.decide(request, start, i, count, hr, outcome.err, DecisionBudgetExhausted, 0)
+				hooks.observe(start, attempts, hr, err)
+				return hr, err
+			}
+			if !hooks.retryBudget.allowRetry() {
+				hooks.decide(request, start, i, count, hr, outcome.err, DecisionRetryBudgetExhausted, 0)
+				break
+			}
+			(*traces)[len(*traces)-1].Backoff = Duration(interval)
+			hooks.decide(request, start, i, count, hr, outcome.err, DecisionRetry, interval)
+			if !hooks.shutdown.backoff(hooks.clock, request.Context(), interval) {
+				hooks.decide(request, start, i, count, hr, outcome.err, DecisionShutdown, 0)
+				break
+			}
+		} else {
+			hooks.decide(request, start, i, count, hr, outcome.err, DecisionExhausted, 0)
+		}
+	}
+
+	err := multiErr.HasError()
+	if err != nil {
+		err = &RetriesExhaustedError{Attempts: attempts, LastResponse: lastResponse, err: err, last: attemptErr}
+	}
+	hooks.observe(start, attempts, hr, err)
+
+	return hr, err
+}
+
+// observe publishes the outcome of a request started at start
+func (hooks retryHooks) observe(start time.Time, attempts int, response Response, err error) {
+	hooks.expvar.observe(hooks.clock.Now().Sub(start), attempts, response, err, hooks.apdex)
+}
+
+// decide records a retry decision in the decision log, if any
+func (hooks retryHooks) decide(request *http.Request, start time.Time, attempt, count int, response Response, err error, verdict string, backoff time.Duration) {
+	hooks.decisions.decide(request, start, hooks.clock.Now(), attempt, count, response, err, verdict, backoff)
+}
+
+// abortVerdict returns the verdict on a request given up with err before its
+// retries ran out
+func abortVerdict(err error) string {
+	if _, ok := err.(*ErrContextDone); ok {
+		return DecisionCancelled
+	}
+
+	return DecisionAborted
+}
+
+// limitedAttempt runs attemptFn under the adaptive concurrency limit, if any.
+// Attempts over the limit wait in the queue, when there is one, and are
+// otherwise rejected as hystrix rejects them when MaxConcurrentRequests are
+// running.
+func (hooks retryHooks) limitedAttempt(attemptFn attemptFunc, request *http.Request, attempt int, lastResponse Response, retrier Retriable) attemptOutcome {
+	if hooks.concurrency == nil {
+		return recoveredAttempt(attemptFn, request, attempt, lastResponse)
+	}
+
+	waited, queued, err := hooks.concurrency.acquire(request.Context(), hooks.queue, hooks.clock, hooks.expvar)
+	if hooks.queue != nil {
+		hooks.stats.queue.observe(waited, queued, err)
+	}
+	if err != nil {
+		if done, ok := err.(*ErrContextDone); ok {
+			done.Attempts, done.LastResponse = attempt, lastResponse
+			return attemptOutcome{abort: done}
+		}
+		if err == errConcurrencyLimited {
+			if !retriesRejections(retrier) {
+				return attemptOutcome{abort: &ErrHystrixRejected{Attempts: attempt + 1, LastResponse: lastResponse, err: hystrix.ErrMaxConcurrency}}
+			}
+			err = hystrix.ErrMaxConcurrency
+		} else if !retriesRejections(retrier) {
+			return attemptOutcome{abort: err}
+		}
+
+		return attemptOutcome{err: err, cause: err, rejected: true}
+	}
+
+	began := hooks.clock.Now()
+	outcome := recoveredAttempt(attemptFn, request, attempt, lastResponse)
+	hooks.concurrency.release(hooks.clock.Now().Sub(began), outcome.err != nil && !outcome.rejected, hooks.expvar)
+
+	return outcome
+}
+
+// fitBackoff cuts interval short so that the next attempt still has the
+// minimum attempt budget before the request deadline, reporting the time left
+// and false when even an immediate attempt would not have it
+func (hooks retryHooks) fitBackoff(request *http.Request, interval time.Duration) (time.Duration, time.Duration, bool) {
+	deadline, ok := request.Context().Deadline()
+	if !ok {
+		return interval, 0, true
+	}
+
+	left := deadline.Sub(hooks.clock.Now())
+	if hooks.minAttemptBudget > 0 && left < hooks.minAttemptBudget {
+		return 0, left, false
+	}
+	if wait := left - hooks.minAttemptBudget; interval > wait {
+		interval = wait
+	}
+	if interval < 0 {
+		interval = 0
+	}
+
+	return interval, left, true
+}
+
+// awaitRateLimit holds back an attempt to a host cooling down after a 429,
+// failing it or waiting for the cooldown as configured
+func (hooks retryHooks) awaitRateLimit(request *http.Request, attempts int, lastResponse Response) error {
+	if hooks.rateLimits == nil {
+		return nil
+	}
+
+	resetAt, cooling := hooks.rateLimits.until(request.URL.Host, hooks.clock.Now())
+	if !cooling {
+		return nil
+	}
+	if hooks.rateLimits.mode != RateLimitQueue {
+		return &ErrRateLimited{Host: request.URL.Host, ResetAt: resetAt}
+	}
+
+	if err := hooks.clock.Sleep(request.Context(), resetAt.Sub(hooks.clock.Now())); err != nil {
+		return &ErrContextDone{Attempts: attempts, LastResponse: lastResponse, err: err}
+	}
+
+	return nil
+}
@@ -0,0 +1,209 @@
+package heimdall
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gojektech/heimdall/fakeclock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testClient is what the tests exercise on both built-in clients, which each
+// return their own type from Derive, so tests derive them with derive
+type testClient interface {
+	Get(url string, headers http.Header) (Response, error)
+	Post(url string, body io.Reader, headers http.Header) (Response, error)
+	Put(url string, body io.Reader, headers http.Header) (Response, error)
+	Patch(url string, body io.Reader, headers http.Header) (Response, error)
+	Delete(url string, headers http.Header) (Response, error)
+	Invoke(method, url string, body io.Reader, headers http.Header) (Response, error)
+	Do(request *http.Request) (Response, error)
+	NewRequest(method, template string) *RequestBuilder
+	PostAsync(url string, body []byte, headers http.Header) error
+	Flush(ctx context.Context) error
+	Shutdown(ctx context.Context) error
+	Prewarm(ctx context.Context, urls ...string) error
+	GetSSE(ctx context.Context, url string, headers http.Header) (<-chan Event, func(), error)
+
+	SetBaseURL(base string)
+	SetRetryCount(count int)
+	SetRetrier(retrier Retriable)
+	SetConnectFailureRetrier(retrier Retriable)
+	SetDrainLimit(limit int64)
+	SetStrictContentLength(strict bool)
+	SetResponseHeaderTimeout(timeout time.Duration)
+	SetMinAttemptBudget(budget time.Duration)
+	SetSlowRequestHook(threshold time.Duration, maxPerMinute int, fn func(SlowRequestReport))
+	SetDeprecationHook(interval time.Duration, fn func(url string, info DeprecationInfo))
+	SetMaintenanceDetector(detector func(*Response) (inMaintenance bool, retryAt time.Time))
+	SetMaintenanceHook(fn func(MaintenanceEvent))
+	SetFailureClassifier(classifier func(response *Response, attemptDuration time.Duration) bool)
+	SetBodyRetryPredicate(maxInspectBytes int, fn func(statusCode int, body []byte) bool)
+	SetAPIVersion(strategy VersionStrategy)
+	SetBaggagePropagation(allowlist []string, maxTotalBytes int, opts ...BaggageOption)
+	AddRequestMutator(mutator RequestMutator)
+	SetRawRequestMutator(mutator func(*http.Request))
+	SetRequestValidator(validator RequestValidator)
+	Use(middlewares ...Middleware)
+	UseResponseInterceptor(interceptor ResponseInterceptor, opts ...InterceptorOption)
+	EnableExpvar(prefix string)
+	EnableAuditLog(sink func(AuditRecord), sampleRate float64, opts ...AuditOption)
+	SetAllowedHosts(patterns []string)
+	SetBlockPrivateNetworks(block bool)
+	SetProxyBypass(patterns []string) error
+	SetTenantLimits(defaults TenantLimits, overrides map[string]TenantLimits)
+	SetMaxInFlightBodyBytes(n int64)
+	SetReturnRedirects(enabled bool)
+	SetMaxRedirects(n int)
+	SetSensitiveHeaders(names ...string)
+	SwapTransport(rt http.RoundTripper)
+	RedactHeaders(headers http.Header) http.Header
+	RegisterCodec(codec Codec)
+	Codec(contentType string) (Codec, error)
+	Stats() ClientStats
+	ResetStats()
+	ExportBreakerState() BreakerState
+	LastDecisions(n int) []DecisionRecord
+	InFlight() []InFlightRequest
+	CancelInFlight(hostPattern string) int
+
+	AddPlugin(plugin Plugin)
+	With(opts ...RequestOption) Client
+	ApplyConfig(cfg ClientConfig) error
+}
+
+// derive derives client with opts, keeping the type of the tests
+func derive(client testClient, opts ...Option) testClient {
+	return deriveClient(client, opts).(testClient)
+}
+
+// retryClients builds one client of each implementation
+var retryClients = map[string]func(name string, clock Clock) testClient{
+	"http": func(name string, clock Clock) testClient {
+		return NewHTTPClient(1000, WithClock(clock))
+	},
+	"hystrix": func(name string, clock Clock) testClient {
+		return NewHystrixHTTPClient(1000, NewHystrixConfig(name, HystrixCommandConfig{
+			Timeout:                1000,
+			MaxConcurrentRequests:  10,
+			RequestVolumeThreshold: 1000,
+		}), WithClock(clock))
+	},
+}
+
+func TestClientsShareRetrySemantics(t *testing.T) {
+	cases := []struct {
+		name     string
+		statuses []int
+		retries  int
+
+		status   int
+		attempts int
+		sleeps   int
+		err      bool
+	}{
+		{name: "success", statuses: []int{200}, retries: 3, status: 200, attempts: 1},
+		{name: "retryable_then_success", statuses: []int{500, 503, 200}, retries: 3, status: 200, attempts: 3, sleeps: 2},
+		{name: "exhaustion", statuses: []int{500, 500, 500}, retries: 2, status: 500, attempts: 3, sleeps: 2, err: true},
+		{name: "non_retryable", statuses: []int{404, 200}, retries: 3, status: 404, attempts: 1},
+	}
+
+	for _, tc := range cases {
+		for kind, newClient := range retryClients {
+			t.Run(tc.name+"/"+kind, func(t *testing.T) {
+				var calls int32
+				var bodies []string
+				server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					body, _ := ioutil.ReadAll(r.Body)
+					bodies = append(bodies, string(body))
+
+					call := int(atomic.AddInt32(&calls, 1)) - 1
+					if call >= len(tc.statuses) {
+						call = len(tc.statuses) - 1
+					}
+					w.WriteHeader(tc.statuses[call])
+					w.Write([]byte("attempt"))
+				}))
+				defer server.Close()
+
+				clock := fakeclock.New(time.Now())
+				client := newClient("retry_semantics_"+tc.name, clock)
+				client.SetRetryCount(tc.retries)
+				client.SetRetrier(NewRetrier(NewConstantBackoff(5)))
+
+				response, err := client.Post(server.URL, strings.NewReader("payload"), http.Header{})
+
+				assert.Equal(t, tc.status, response.StatusCode())
+				assert.Equal(t, "attempt", string(response.Body()))
+				assert.Equal(t, tc.attempts, int(atomic.LoadInt32(&calls)))
+				assert.Len(t, clock.Sleeps(), tc.sleeps)
+				for _, body := range bodies {
+					assert.Equal(t, "payload", body, "the body should be rewound for every attempt")
+				}
+
+				if !tc.err {
+					assert.NoError(t, err)
+					return
+				}
+
+				var exhausted *RetriesExhaustedError
+				require.True(t, errors.As(err, &exhausted), "%v", err)
+				assert.Equal(t, tc.attempts, exhausted.Attempts)
+				assert.Equal(t, tc.status, exhausted.LastResponse.StatusCode())
+			})
+		}
+	}
+}
+
+func TestExecuteWithRetriesStopsOnAbort(t *testing.T) {
+	request, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	require.NoError(t, err)
+
+	clock := fakeclock.New(time.Now())
+	boom := errors.New("boom")
+	forbidden := &ErrForbiddenHost{Host: "example.com", Reason: "not allowed"}
+	outcomes := []attemptOutcome{{err: boom, cause: boom}, {abort: forbidden}}
+
+	attempts := 0
+	response, err := executeWithRetries(request, func(request *http.Request, attempt int, lastResponse Response) attemptOutcome {
+		attempts++
+		return outcomes[attempt]
+	}, NewRetrier(NewConstantBackoff(5)), 5, retryHooks{clock: clock})
+
+	assert.Equal(t, forbidden, err)
+	assert.Equal(t, 0, response.StatusCode())
+	assert.Len(t, response.Trace().Attempts, 2, "the aborted attempt is traced")
+	assert.Equal(t, 2, attempts)
+	assert.Len(t, clock.Sleeps(), 1, "only the failed attempt is followed by a backoff")
+}
+
+func TestExecuteWithRetriesReportsCauseOfFinalAttempt(t *testing.T) {
+	request, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	require.NoError(t, err)
+
+	serverError := attemptOutcome{response: Response{statusCode: 502}, err: errors.New("server error: 502")}
+	timeout := attemptOutcome{err: ErrResponseHeaderTimeout, cause: ErrResponseHeaderTimeout}
+	outcomes := []attemptOutcome{serverError, timeout}
+
+	_, err = executeWithRetries(request, func(request *http.Request, attempt int, lastResponse Response) attemptOutcome {
+		if attempt == 1 {
+			assert.Equal(t, 502, lastResponse.StatusCode())
+		}
+		return outcomes[attempt]
+	}, NewNoRetrier(), 1, retryHooks{clock: realClock{}})
+
+	var exhausted *RetriesExhaustedError
+	require.True(t, errors.As(err, &exhausted))
+	assert.True(t, errors.Is(err, ErrResponseHeaderTimeout))
+	assert.Equal(t, 502, exhausted.LastResponse.StatusCode())
+	assert.Equal(t, "server error: 502, "+ErrResponseHeaderTimeout.Error(), err.Error())
+}
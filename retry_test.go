@@ -22,3 +22,40 @@ func TestRetrierWithConstantBackoff(t *testing.T) {
 
 	assert.Equal(t, 2*time.Millisecond, constantRetrier.NextInterval(1))
 }
+
+func TestRetrierGivesEachRequestFreshBackoffState(t *testing.T) {
+	backoff := NewDecorrelatedJitterBackoff(2*time.Millisecond, time.Second)
+	backoff.(*decorrelatedJitterBackoff).random = func(n int64) int64 { return n - 1 }
+	shared := NewRetrier(backoff)
+
+	first := requestRetrier(shared)
+	assert.Equal(t, 6*time.Millisecond, first.NextInterval(1))
+	assert.Equal(t, 18*time.Millisecond, first.NextInterval(2))
+
+	second := requestRetrier(shared)
+	assert.Equal(t, 6*time.Millisecond, second.NextInterval(1))
+	assert.Equal(t, 54*time.Millisecond, first.NextInterval(3))
+}
+
+func TestRequestRetrierReusesStatelessRetriers(t *testing.T) {
+	constantRetrier := NewRetrier(NewConstantBackoff(2))
+
+	assert.Equal(t, constantRetrier, requestRetrier(constantRetrier))
+	assert.Equal(t, NewNoRetrier(), requestRetrier(NewNoRetrier()))
+}
+
+func TestRejectionRetrierKeepsPerRequestBackoffState(t *testing.T) {
+	backoff := NewDecorrelatedJitterBackoff(2*time.Millisecond, time.Second)
+	backoff.(*decorrelatedJitterBackoff).random = func(n int64) int64 { return n - 1 }
+	shared := NewRejectionRetrier(NewRetrier(backoff))
+
+	first := requestRetrier(shared)
+	assert.True(t, retriesRejections(first))
+	assert.Equal(t, 6*time.Millisecond, first.NextInterval(1))
+
+	second := requestRetrier(shared)
+	assert.True(t, retriesRejections(second))
+	assert.Equal(t, 6*time.Millisecond, second.NextInterval(1))
+
+	assert.False(t, retriesRejections(NewRetrier(backoff)))
+}
@@ -0,0 +1,175 @@
+package heimdall
+
+import (
+	"context"
+	"io"
+	"net/http"
+)
+
+// RequestOption sets a default of the requests sent through a client made
+// with With
+type RequestOption func(*requestDefaults)
+
+// Header sends name with value on every request that does not set name
+// itself
+func Header(name, value string) RequestOption {
+	return func(d *requestDefaults) {
+		d.headers[http.CanonicalHeaderKey(name)] = []string{value}
+	}
+}
+
+// Retry retries every request up to count times, in place of the retry count
+// of the client. Requests of methods the client does not retry, such as
+// custom methods not registered with RegisterIdempotentMethod, are still not
+// retried.
+func Retry(count int) RequestOption {
+	return func(d *requestDefaults) {
+		d.retryCount, d.retries = count, true
+	}
+}
+
+// requestDefaults are the defaults a scopedClient sets on its requests
+type requestDefaults struct {
+	headers    http.Header
+	retryCount int
+	retries    bool
+}
+
+// retryCountKey is the context key of the retry count set with Retry
+type retryCountKey struct{}
+
+// requestRetryCount returns the retry count set on request with Retry, or
+// count when none is
+func requestRetryCount(request *http.Request, count int) int {
+	if scoped, ok := request.Context().Value(retryCountKey{}).(int); ok {
+		return scoped
+	}
+
+	return count
+}
+
+// scopedClient is the client With returns. Its defaults are flattened when
+// it is made, so that a scopedClient made from another wraps the same client
+// and costs no more per request.
+type scopedClient struct {
+	Client
+	defaults requestDefaults
+}
+
+// newScopedClient returns client setting the defaults of opts, applied in
+// order over base, on every request
+func newScopedClient(client Client, base requestDefaults, opts []RequestOption) *scopedClient {
+	defaults := requestDefaults{headers: make(http.Header, len(base.headers)), retryCount: base.retryCount, retries: base.retries}
+	for name, values := range base.headers {
+		defaults.headers[name] = values
+	}
+	for _, opt := range opts {
+		opt(&defaults)
+	}
+
+	return &scopedClient{Client: client, defaults: defaults}
+}
+
+// apply returns a copy of request with the defaults of sc it does not set
+// itself
+func (sc *scopedClient) apply(request *http.Request) *http.Request {
+	ctx := request.Context()
+	if _, set := ctx.Value(retryCountKey{}).(int); sc.defaults.retries && !set {
+		ctx = context.WithValue(ctx, retryCountKey{}, sc.defaults.retryCount)
+	}
+	scoped := request.WithContext(ctx)
+
+	if len(sc.defaults.headers) > 0 {
+		scoped.Header = sc.headers(request.Header)
+	}
+
+	return scoped
+}
+
+// headers returns a copy of headers with the default headers of sc it does
+// not set
+func (sc *scopedClient) headers(headers http.Header) http.Header {
+	merged := make(http.Header, len(headers)+len(sc.defaults.headers))
+	for name, values := range sc.defaults.headers {
+		merged[name] = values
+	}
+	for name, values := range headers {
+		merged[name] = values
+	}
+
+	return merged
+}
+
+func (sc *scopedClient) send(method, url string, body io.Reader, headers http.Header) (Response, error) {
+	request, err := newMethodRequest(method, url, body)
+	if err != nil {
+		return Response{}, err
+	}
+	request.Header = headers
+
+	return sc.Do(request)
+}
+
+// Get makes a HTTP GET request to url with the defaults of sc
+func (sc *scopedClient) Get(url string, headers http.Header) (Response, error) {
+	return sc.send(http.MethodGet, url, nil, headers)
+}
+
+// Post makes a HTTP POST request to url with the defaults of sc
+func (sc *scopedClient) Post(url string, body io.Reader, headers http.Header) (Response, error) {
+	return sc.send(http.MethodPost, url, body, headers)
+}
+
+// Put makes a HTTP PUT request to url with the defaults of sc
+func (sc *scopedClient) Put(url string, body io.Reader, headers http.Header) (Response, error) {
+	return sc.send(http.MethodPut, url, body, headers)
+}
+
+// Patch makes a HTTP PATCH request to url with the defaults of sc
+func (sc *scopedClient) Patch(url string, body io.Reader, headers http.Header) (Response, error) {
+	return sc.send(http.MethodPatch, url, body, headers)
+}
+
+// Delete makes a HTTP DELETE request to url with the defaults of sc
+func (sc *scopedClient) Delete(url string, headers http.Header) (Response, error) {
+	return sc.send(http.MethodDelete, url, nil, headers)
+}
+
+// Invoke makes a HTTP request with any method to url with the defaults of sc
+func (sc *scopedClient) Invoke(method, url string, body io.Reader, headers http.Header) (Response, error) {
+	return sc.send(method, url, body, headers)
+}
+
+// Do sends request through the client sc wraps with the defaults of sc
+func (sc *scopedClient) Do(request *http.Request) (Response, error) {
+	return SendRequest(sc.Client, sc.apply(request))
+}
+
+// NewRequest returns a builder for a request sent with the defaults of sc
+func (sc *scopedClient) NewRequest(method, template string) *RequestBuilder {
+	return newRequestBuilder(sc, method, template)
+}
+
+// PostAsync queues a HTTP POST request on the client sc wraps with the
+// default headers of sc. The queue runs jobs with the retry count of that
+// client, whatever Retry says.
+func (sc *scopedClient) PostAsync(url string, body []byte, headers http.Header) error {
+	return postAsync(sc.Client, url, body, sc.headers(headers))
+}
+
+// GetSSE opens a server-sent event stream with the default headers of sc
+func (sc *scopedClient) GetSSE(ctx context.Context, url string, headers http.Header) (<-chan Event, func(), error) {
+	return getSSE(ctx, sc.Client, url, sc.headers(headers))
+}
+
+// With returns a client setting the defaults of opts on top of those of sc,
+// which they override
+func (sc *scopedClient) With(opts ...RequestOption) Client {
+	return newScopedClient(sc.Client, sc.defaults, opts)
+}
+
+// Derive returns a client derived from the client sc wraps, with the
+// defaults of sc
+func (sc *scopedClient) Derive(opts ...Option) Client {
+	return &scopedClient{Client: deriveClient(sc.Client, opts), defaults: sc.defaults}
+}
@@ -0,0 +1,184 @@
+package heimdall
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// headerEchoServer answers every request with the values of its X-Tenant and
+// X-Trace headers
+func headerEchoServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s/%s", r.Header.Get("X-Tenant"), r.Header.Get("X-Trace"))
+	}))
+}
+
+func TestWithSetsDefaultHeaders(t *testing.T) {
+	server := headerEchoServer()
+	defer server.Close()
+
+	for kind, newClient := range retryClients {
+		t.Run(kind, func(t *testing.T) {
+			client := newClient("scoped_headers_"+kind, realClock{})
+			tenant := client.With(Header("x-tenant", "acme"), Header("X-Trace", "outer"))
+			traced := tenant.(*scopedClient).With(Header("X-Trace", "inner"))
+
+			for name, tc := range map[string]struct {
+				client  Client
+				headers http.Header
+				want    string
+			}{
+				"parent":           {client: client, want: "/"},
+				"view":             {client: tenant, want: "acme/outer"},
+				"nested":           {client: traced, want: "acme/inner"},
+				"request wins":     {client: traced, headers: http.Header{"X-Trace": {"request"}}, want: "acme/request"},
+				"parent unchanged": {client: client, want: "/"},
+			} {
+				headers := tc.headers
+				if headers == nil {
+					headers = http.Header{}
+				}
+				response, err := tc.client.Get(server.URL, headers)
+				require.NoError(t, err, name)
+				assert.Equal(t, tc.want, string(response.Body()), name)
+				assert.Empty(t, headers.Get("X-Tenant"), "the headers of the caller are left as they are")
+			}
+
+			request, err := http.NewRequest(http.MethodPost, server.URL, bytes.NewReader([]byte("{}")))
+			require.NoError(t, err)
+			request.Header.Set("X-Tenant", "request")
+			response, err := SendRequest(traced, request)
+			require.NoError(t, err)
+			assert.Equal(t, "request/inner", string(response.Body()))
+			assert.Empty(t, request.Header.Get("X-Trace"))
+
+			response, err = newRequestBuilder(traced, http.MethodGet, server.URL).Do(context.Background())
+			require.NoError(t, err)
+			assert.Equal(t, "acme/inner", string(response.Body()), "built requests get the defaults")
+		})
+	}
+}
+
+func TestWithOverridesTheRetryCount(t *testing.T) {
+	for kind, newClient := range retryClients {
+		t.Run(kind, func(t *testing.T) {
+			client := newClient("scoped_retries_"+kind, realClock{})
+			client.SetRetryCount(5)
+			client.SetRetrier(NewRetrier(NewConstantBackoff(1)))
+
+			for name, tc := range map[string]struct {
+				client Client
+				hits   int32
+			}{
+				"parent": {client: client, hits: 6},
+				"view":   {client: client.With(Retry(2)), hits: 3},
+				"nested": {client: client.With(Retry(2)).(*scopedClient).With(Retry(0)), hits: 1},
+				"kept":   {client: client.With(Retry(1)).(*scopedClient).With(Header("X-Tenant", "acme")), hits: 2},
+			} {
+				var hits int32
+				server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					atomic.AddInt32(&hits, 1)
+					w.WriteHeader(http.StatusServiceUnavailable)
+				}))
+
+				_, err := tc.client.Get(server.URL, http.Header{})
+				server.Close()
+				assert.Error(t, err, name)
+				assert.Equal(t, tc.hits, atomic.LoadInt32(&hits), name)
+			}
+		})
+	}
+}
+
+func TestWithIsSafeForConcurrentUse(t *testing.T) {
+	server := headerEchoServer()
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+	base := client.With(Header("X-Trace", "shared")).(*scopedClient)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			tenant := fmt.Sprintf("tenant-%d", i)
+			view := base.With(Header("X-Tenant", tenant))
+			for j := 0; j < 5; j++ {
+				response, err := view.Get(server.URL, http.Header{})
+				if assert.NoError(t, err) {
+					assert.Equal(t, tenant+"/shared", string(response.Body()))
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestWithSharesTheSettingsOfTheParent(t *testing.T) {
+	server := headerEchoServer()
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+	view := client.With(Header("X-Tenant", "acme"))
+	client.AddRequestMutator(RequestMutatorFunc(func(request *http.Request) error {
+		request.Header.Set("X-Trace", "mutated")
+		return nil
+	}))
+
+	response, err := view.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, "acme/mutated", string(response.Body()), "settings set on the parent are used by its views")
+
+	response, err = deriveClient(view, nil).Get(server.URL, http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, "acme/mutated", string(response.Body()), "derived views keep their defaults")
+}
+
+func TestWithSharesTheHystrixCircuit(t *testing.T) {
+	server := failingServer(100)
+	defer server.Close()
+
+	client := NewHystrixHTTPClient(1000, breakerStateConfig("scoped_circuit"))
+	first, second := client.With(Header("X-Tenant", "a")), client.With(Header("X-Tenant", "b"))
+	for _, view := range []Client{first, second, first} {
+		_, err := view.Get(server.URL, http.Header{})
+		require.Error(t, err)
+	}
+
+	assert.Equal(t, CircuitOpen, client.Stats().Circuit, "views fail into the circuit of the parent")
+	_, err := client.Get(server.URL, http.Header{})
+	var rejected *ErrHystrixRejected
+	require.True(t, errors.As(err, &rejected), "%v", err)
+	assert.True(t, rejected.CircuitOpen())
+}
+
+func TestWithSetsHeadersOfQueuedRequests(t *testing.T) {
+	received := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get("X-Tenant")
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+	require.NoError(t, postAsync(client.With(Header("X-Tenant", "acme")), server.URL, []byte("{}"), http.Header{}))
+
+	select {
+	case tenant := <-received:
+		assert.Equal(t, "acme", tenant)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the queued request was not sent")
+	}
+}
@@ -0,0 +1,145 @@
+package heimdall
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// sentRequestBodyLimit is the size up to which SentRequestInfo keeps the body
+// itself; larger bodies are only hashed and measured
+const sentRequestBodyLimit = 4 << 10
+
+// SentRequestInfo is a snapshot of the request an attempt actually sent,
+// after the request mutators, middlewares and raw request mutator ran, so
+// with the headers they added and the signatures they computed. Sensitive
+// headers are redacted as they are in errors and hooks, and the password of
+// the URL is masked. Headers the transport adds on the wire, such as Host,
+// Content-Length and Accept-Encoding, are not included.
+type SentRequestInfo struct {
+	Method  string      `json:"method"`
+	URL     string      `json:"url"`
+	Headers http.Header `json:"headers,omitempty"`
+	// BodyLength is the number of body bytes the transport had sent when the
+	// response headers arrived
+	BodyLength int64 `json:"body_length"`
+	// BodyHash is the hex SHA-256 of those bytes, empty without a body
+	BodyHash string `json:"body_hash,omitempty"`
+	// Body holds those bytes when there were at most 4KB of them
+	Body []byte `json:"body,omitempty"`
+}
+
+// WithSentRequests records a SentRequestInfo for every attempt into its
+// AttemptTrace, the last of which Response.SentRequest returns. Recording
+// costs each attempt a copy of its headers and a hash of its body.
+func WithSentRequests() Option {
+	return func(options *clientOptions) {
+		options.sentRequests = true
+	}
+}
+
+// SentRequest returns the snapshot of the request the last attempt sent, or
+// the zero SentRequestInfo when the client was not made with
+// WithSentRequests or no attempt was sent
+func (hr Response) SentRequest() SentRequestInfo {
+	for i := len(hr.attempts) - 1; i >= 0; i-- {
+		if sent := hr.attempts[i].Sent; sent != nil {
+			info := *sent
+			info.Headers = copyHeader(sent.Headers)
+			info.Body = append([]byte(nil), sent.Body...)
+			return info
+		}
+	}
+
+	return SentRequestInfo{}
+}
+
+// captureSent records what each attempt sent through next into the trace of
+// its request, when enabled
+func captureSent(next Doer, redactor *headerRedactor, enabled bool) Doer {
+	if !enabled {
+		return next
+	}
+
+	return DoerFunc(func(request *http.Request) (*http.Response, error) {
+		trace, _ := request.Context().Value(requestTraceKey{}).(*requestTrace)
+		if trace == nil {
+			return next.Do(request)
+		}
+
+		var body *sentBody
+		if request.Body != nil && request.Body != http.NoBody {
+			body = &sentBody{ReadCloser: request.Body, hash: sha256.New()}
+			request = request.WithContext(request.Context())
+			request.Body = body
+		}
+
+		response, err := next.Do(request)
+
+		info := &SentRequestInfo{
+			Method:  request.Method,
+			URL:     redactUserinfo(request.URL.String()),
+			Headers: redactor.redact(request.Header),
+		}
+		if info.Method == "" {
+			info.Method = http.MethodGet
+		}
+		body.summarise(info)
+		trace.setSent(info)
+
+		return response, err
+	})
+}
+
+// sentBody hashes and measures a request body as the transport reads it,
+// keeping only its first sentRequestBodyLimit bytes. The transport may still
+// be reading it when the response arrives, from a goroutine of its own, so it
+// is locked.
+type sentBody struct {
+	io.ReadCloser
+
+	mu     sync.Mutex
+	hash   hash.Hash
+	length int64
+	head   []byte
+}
+
+func (b *sentBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.mu.Lock()
+		b.hash.Write(p[:n])
+		b.length += int64(n)
+		if keep := sentRequestBodyLimit - len(b.head); keep > 0 {
+			if keep > n {
+				keep = n
+			}
+			b.head = append(b.head, p[:keep]...)
+		}
+		b.mu.Unlock()
+	}
+
+	return n, err
+}
+
+// summarise sets the body fields of info from what was read so far
+func (b *sentBody) summarise(info *SentRequestInfo) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	info.BodyLength = b.length
+	if b.length == 0 {
+		return
+	}
+	info.BodyHash = hex.EncodeToString(b.hash.Sum(nil))
+	if b.length <= sentRequestBodyLimit {
+		info.Body = append([]byte(nil), b.head...)
+	}
+}
@@ -0,0 +1,110 @@
+package heimdall
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// authMiddleware sets the headers a client would add to every request
+func authMiddleware(next Doer) Doer {
+	return DoerFunc(func(request *http.Request) (*http.Response, error) {
+		request.Header.Set("Authorization", "Bearer secret-token")
+		request.Header.Set("X-Client", "heimdall")
+
+		return next.Do(request)
+	})
+}
+
+func TestClientsCaptureSentRequests(t *testing.T) {
+	clients := map[string]func() testClient{
+		"http": func() testClient {
+			return NewHTTPClient(1000, WithSentRequests())
+		},
+		"hystrix": func() testClient {
+			return NewHystrixHTTPClient(1000, NewHystrixConfig("sent_request_command", HystrixCommandConfig{Timeout: 1000}), WithSentRequests())
+		},
+	}
+	for kind, newClient := range clients {
+		t.Run(kind, func(t *testing.T) {
+			server := failingServer(1)
+			defer server.Close()
+
+			client := newClient()
+			client.SetRetryCount(1)
+			client.Use(authMiddleware)
+			client.AddRequestMutator(NewHMACSigner([]byte("key"), "X-Signature", HMACSHA256))
+
+			response, err := client.Post(server.URL+"/orders?page=2", strings.NewReader(`{"id":1}`), http.Header{"X-Api-Key": {"api-key"}})
+			require.NoError(t, err)
+
+			sent := response.SentRequest()
+			assert.Equal(t, http.MethodPost, sent.Method)
+			assert.Equal(t, server.URL+"/orders?page=2", sent.URL)
+			assert.Equal(t, "heimdall", sent.Headers.Get("X-Client"))
+			assert.NotEmpty(t, sent.Headers.Get("X-Signature"))
+			assert.NotEmpty(t, sent.Headers.Get(HMACTimestampHeader))
+			assert.Equal(t, redactValue("Bearer secret-token"), sent.Headers.Get("Authorization"))
+			assert.Equal(t, redactValue("api-key"), sent.Headers.Get("X-Api-Key"))
+
+			sum := sha256.Sum256([]byte(`{"id":1}`))
+			assert.Equal(t, int64(8), sent.BodyLength)
+			assert.Equal(t, hex.EncodeToString(sum[:]), sent.BodyHash)
+			assert.Equal(t, `{"id":1}`, string(sent.Body))
+
+			attempts := response.Trace().Attempts
+			require.Len(t, attempts, 2)
+			require.NotNil(t, attempts[0].Sent)
+			assert.Equal(t, int64(8), attempts[0].Sent.BodyLength, "every attempt sends the whole body")
+			assert.NotEqual(t, attempts[0].Sent.Headers.Get("X-Signature"), "", "each attempt is signed")
+
+			sent.Headers.Set("X-Client", "changed")
+			assert.Equal(t, "heimdall", response.SentRequest().Headers.Get("X-Client"), "snapshots are returned as copies")
+		})
+	}
+}
+
+func TestSentRequestsOnlyHashLargeBodies(t *testing.T) {
+	server := statsServer()
+	defer server.Close()
+
+	body := bytes.Repeat([]byte("a"), 1<<20)
+	response, err := NewHTTPClient(5000, WithSentRequests()).Put(server.URL, bytes.NewReader(body), http.Header{})
+	require.NoError(t, err)
+
+	sum := sha256.Sum256(body)
+	sent := response.SentRequest()
+	assert.Equal(t, int64(1<<20), sent.BodyLength)
+	assert.Equal(t, hex.EncodeToString(sum[:]), sent.BodyHash)
+	assert.Nil(t, sent.Body, "bodies above 4KB are not kept")
+}
+
+func TestSentRequestsAreOnlyCapturedWhenEnabled(t *testing.T) {
+	server := statsServer()
+	defer server.Close()
+
+	response, err := NewHTTPClient(1000).Get(server.URL, http.Header{})
+	require.NoError(t, err)
+
+	assert.Equal(t, SentRequestInfo{}, response.SentRequest())
+	assert.Nil(t, response.Trace().Attempts[0].Sent)
+}
+
+func TestSentRequestMasksURLPassword(t *testing.T) {
+	server := statsServer()
+	defer server.Close()
+
+	response, err := NewHTTPClient(1000, WithSentRequests()).Get(strings.Replace(server.URL, "http://", "http://user:pass@", 1), http.Header{})
+	require.NoError(t, err)
+
+	sent := response.SentRequest()
+	assert.NotContains(t, sent.URL, "pass")
+	assert.Equal(t, int64(0), sent.BodyLength)
+	assert.Empty(t, sent.BodyHash)
+}
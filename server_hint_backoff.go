@@ -0,0 +1,222 @@
+package heimdall
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultMaxHintInterval caps the waits of a server hint backoff unless
+// WithHintBounds sets other bounds
+const defaultMaxHintInterval = time.Minute
+
+// healthyQuotaFraction is the fraction of the rate limit quota left above
+// which an upstream is taken as healthy by the rate limit hint parser
+const healthyQuotaFraction = 0.5
+
+// HintParser reads the load hints of the response of an attempt, numbered
+// from 0. The status is 0 and the headers nil when no response was received.
+type HintParser interface {
+	// Parse returns the factor to scale the next wait by: 1 for a healthy
+	// upstream and more the more loaded it is. It returns false for responses
+	// without hints, which are waited for as the base backoff does.
+	Parse(statusCode int, headers http.Header, attempt int) (scale float64, ok bool)
+}
+
+// HintParserFunc adapts a plain function to the HintParser interface, such
+// as one reading a custom X-Load header
+type HintParserFunc func(statusCode int, headers http.Header, attempt int) (float64, bool)
+
+// Parse calls f(statusCode, headers, attempt)
+func (f HintParserFunc) Parse(statusCode int, headers http.Header, attempt int) (float64, bool) {
+	return f(statusCode, headers, attempt)
+}
+
+// HintOption configures optional behaviour of a server hint backoff
+type HintOption func(*serverHintBackoff)
+
+// WithHintBounds clamps the scaled waits to at least minInterval and at most
+// maxInterval, which is a minute by default
+func WithHintBounds(minInterval, maxInterval time.Duration) HintOption {
+	return func(b *serverHintBackoff) {
+		b.minInterval = minInterval
+		b.maxInterval = maxInterval
+	}
+}
+
+type serverHintBackoff struct {
+	base        Backoff
+	hints       HintParser
+	minInterval time.Duration
+	maxInterval time.Duration
+
+	mu    sync.Mutex
+	scale float64
+}
+
+// NewServerHintBackoff returns a backoff waiting as base does, scaled by the
+// load hints hints reads from the response of the attempt before each wait:
+// longer waits for an upstream short of quota or slow to answer, the waits
+// of base for a healthy one or a response without hints. Scaled waits are
+// clamped to the bounds of WithHintBounds. It adapts through NewRetrier,
+// which shows it every failed attempt, and keeps the hints of each request
+// apart.
+func NewServerHintBackoff(base Backoff, hints HintParser, opts ...HintOption) Backoff {
+	b := &serverHintBackoff{base: base, hints: hints, maxInterval: defaultMaxHintInterval, scale: 1}
+	for _, opt := range opts {
+		opt(b)
+	}
+
+	return b
+}
+
+// NewRequestBackoff returns a copy of the backoff without hints, over a
+// fresh base backoff when base keeps state
+func (b *serverHintBackoff) NewRequestBackoff() Backoff {
+	base := b.base
+	if factory, ok := base.(BackoffFactory); ok {
+		base = factory.NewRequestBackoff()
+	}
+
+	return &serverHintBackoff{base: base, hints: b.hints, minInterval: b.minInterval, maxInterval: b.maxInterval, scale: 1}
+}
+
+// ObserveAttempt scales the next wait by the hints of the attempt
+func (b *serverHintBackoff) ObserveAttempt(attempt, statusCode int, headers http.Header) {
+	scale, ok := b.hints.Parse(statusCode, headers, attempt)
+	if !ok || !(scale >= 1) {
+		scale = 1
+	}
+
+	b.mu.Lock()
+	b.scale = scale
+	b.mu.Unlock()
+}
+
+// Next returns the wait of the base backoff scaled by the last hints
+func (b *serverHintBackoff) Next(retry int) time.Duration {
+	b.mu.Lock()
+	scale := b.scale
+	b.mu.Unlock()
+
+	scaled := float64(b.base.Next(retry)) * scale
+	if scaled >= float64(b.maxInterval) {
+		return b.maxInterval
+	}
+	if interval := time.Duration(scaled); interval > b.minInterval {
+		return interval
+	}
+
+	return b.minInterval
+}
+
+type rateLimitHints struct{}
+
+// NewRateLimitHintParser returns a parser reading the X-RateLimit-Remaining
+// and X-RateLimit-Limit headers, or their RateLimit-Remaining and
+// RateLimit-Limit equivalents. An upstream with more than half of its quota
+// left is healthy; below that the wait grows as the quota shrinks, doubling
+// at a quarter left, and is as long as the bounds allow once none is left.
+func NewRateLimitHintParser() HintParser {
+	return rateLimitHints{}
+}
+
+func (rateLimitHints) Parse(statusCode int, headers http.Header, attempt int) (float64, bool) {
+	remaining, ok := rateLimitValue(headers, "X-RateLimit-Remaining", "RateLimit-Remaining")
+	if !ok {
+		return 0, false
+	}
+	if remaining <= 0 {
+		return math.Inf(1), true
+	}
+
+	limit, ok := rateLimitValue(headers, "X-RateLimit-Limit", "RateLimit-Limit")
+	if !ok || limit <= 0 {
+		return 1, true
+	}
+	if fraction := remaining / limit; fraction < healthyQuotaFraction {
+		return healthyQuotaFraction / fraction, true
+	}
+
+	return 1, true
+}
+
+// rateLimitValue returns the number the first of the headers named starts
+// with, ignoring quota policies such as `100, 100;w=60` after it
+func rateLimitValue(headers http.Header, names ...string) (float64, bool) {
+	for _, name := range names {
+		value := headers.Get(name)
+		if value == "" {
+			continue
+		}
+		if end := strings.IndexAny(value, ",;"); end >= 0 {
+			value = value[:end]
+		}
+
+		number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		return number, err == nil
+	}
+
+	return 0, false
+}
+
+type serverTimingHints struct {
+	metric  string
+	healthy time.Duration
+}
+
+// NewServerTimingHintParser returns a parser reading the duration of metric
+// from the Server-Timing header, or the sum of the durations of every metric
+// when metric is empty. Durations up to healthy leave the wait as it is, and
+// longer ones scale it by how many times longer than healthy they are.
+func NewServerTimingHintParser(metric string, healthy time.Duration) HintParser {
+	return serverTimingHints{metric: metric, healthy: healthy}
+}
+
+func (h serverTimingHints) Parse(statusCode int, headers http.Header, attempt int) (float64, bool) {
+	total, found := 0.0, false
+	for _, header := range headers.Values("Server-Timing") {
+		for _, entry := range splitLinks(header) {
+			name, duration, ok := parseServerTiming(entry)
+			if ok && (h.metric == "" || strings.EqualFold(name, h.metric)) {
+				total += duration
+				found = true
+			}
+		}
+	}
+	if !found || h.healthy <= 0 {
+		return 0, false
+	}
+
+	elapsed := time.Duration(total * float64(time.Millisecond))
+	if elapsed <= h.healthy {
+		return 1, true
+	}
+
+	return float64(elapsed) / float64(h.healthy), true
+}
+
+// parseServerTiming returns the name and duration, in milliseconds, of a
+// Server-Timing metric such as `db;dur=53.2;desc="Database"`, reporting false
+// for metrics without a duration
+func parseServerTiming(entry string) (string, float64, bool) {
+	params := strings.Split(entry, ";")
+	name := strings.TrimSpace(params[0])
+	for _, param := range params[1:] {
+		key, value := param, ""
+		if i := strings.IndexByte(param, '='); i >= 0 {
+			key, value = param[:i], param[i+1:]
+		}
+		if !strings.EqualFold(strings.TrimSpace(key), "dur") {
+			continue
+		}
+
+		duration, err := strconv.ParseFloat(strings.Trim(strings.TrimSpace(value), `"`), 64)
+		return name, duration, err == nil && duration >= 0
+	}
+
+	return name, 0, false
+}
@@ -0,0 +1,161 @@
+package heimdall
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gojektech/heimdall/fakeclock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// steadyBackoff waits the same for every retry, the first included
+type steadyBackoff time.Duration
+
+func (b steadyBackoff) Next(retry int) time.Duration {
+	return time.Duration(b)
+}
+
+func rateLimitHeaders(remaining, limit string) http.Header {
+	return http.Header{"X-Ratelimit-Remaining": {remaining}, "X-Ratelimit-Limit": {limit}}
+}
+
+func TestServerHintBackoffScalesByTheLastHints(t *testing.T) {
+	backoff := NewServerHintBackoff(steadyBackoff(100*time.Millisecond), NewRateLimitHintParser(),
+		WithHintBounds(50*time.Millisecond, time.Second))
+	observer, ok := backoff.(AttemptObserver)
+	require.True(t, ok)
+
+	assert.Equal(t, 100*time.Millisecond, backoff.Next(0), "without hints the base backoff is used")
+
+	for _, step := range []struct {
+		headers  http.Header
+		interval time.Duration
+	}{
+		{headers: rateLimitHeaders("80", "100"), interval: 100 * time.Millisecond},
+		{headers: rateLimitHeaders("50", "100"), interval: 100 * time.Millisecond},
+		{headers: rateLimitHeaders("25", "100"), interval: 200 * time.Millisecond},
+		{headers: rateLimitHeaders("10", "100"), interval: 500 * time.Millisecond},
+		{headers: rateLimitHeaders("2", "100"), interval: time.Second},
+		{headers: rateLimitHeaders("0", "100"), interval: time.Second},
+		{headers: http.Header{}, interval: 100 * time.Millisecond},
+		{headers: rateLimitHeaders("90", "100"), interval: 100 * time.Millisecond},
+	} {
+		observer.ObserveAttempt(0, http.StatusTooManyRequests, step.headers)
+		assert.Equal(t, step.interval, backoff.Next(1), "%v", step.headers)
+	}
+}
+
+func TestServerHintBackoffBounds(t *testing.T) {
+	backoff := NewServerHintBackoff(NewConstantBackoff(10), NewRateLimitHintParser(),
+		WithHintBounds(30*time.Millisecond, 2*time.Second))
+
+	assert.Equal(t, 30*time.Millisecond, backoff.Next(1), "waits are raised to the minimum")
+
+	backoff.(AttemptObserver).ObserveAttempt(0, http.StatusTooManyRequests, http.Header{"Ratelimit-Remaining": {"0"}})
+	assert.Equal(t, 2*time.Second, backoff.Next(1), "an exhausted quota waits for the maximum")
+
+	unbounded := NewServerHintBackoff(NewConstantBackoff(10), NewRateLimitHintParser())
+	unbounded.(AttemptObserver).ObserveAttempt(0, http.StatusTooManyRequests, rateLimitHeaders("0", "100"))
+	assert.Equal(t, defaultMaxHintInterval, unbounded.Next(1))
+}
+
+func TestServerHintBackoffIgnoresScalesBelowOne(t *testing.T) {
+	for _, scale := range []float64{0.2, 0, -3, math.NaN()} {
+		backoff := NewServerHintBackoff(steadyBackoff(time.Second), HintParserFunc(func(int, http.Header, int) (float64, bool) {
+			return scale, true
+		}))
+		backoff.(AttemptObserver).ObserveAttempt(0, http.StatusServiceUnavailable, nil)
+		assert.Equal(t, time.Second, backoff.Next(1), "%v", scale)
+	}
+}
+
+func TestServerHintBackoffPassesTheAttemptToTheParser(t *testing.T) {
+	var seen []int
+	backoff := NewServerHintBackoff(steadyBackoff(time.Second), HintParserFunc(func(status int, headers http.Header, attempt int) (float64, bool) {
+		seen = append(seen, status, attempt)
+		return float64(attempt + 1), true
+	}))
+
+	backoff.(AttemptObserver).ObserveAttempt(2, http.StatusBadGateway, nil)
+	assert.Equal(t, 3*time.Second, backoff.Next(3))
+	assert.Equal(t, []int{http.StatusBadGateway, 2}, seen)
+}
+
+func TestRateLimitHintParser(t *testing.T) {
+	parser := NewRateLimitHintParser()
+	for _, tc := range []struct {
+		headers http.Header
+		scale   float64
+		ok      bool
+	}{
+		{headers: http.Header{}},
+		{headers: rateLimitHeaders("many", "100")},
+		{headers: rateLimitHeaders("60", "100"), scale: 1, ok: true},
+		{headers: rateLimitHeaders("20", "100"), scale: 2.5, ok: true},
+		{headers: rateLimitHeaders("0", "100"), scale: math.Inf(1), ok: true},
+		{headers: http.Header{"X-Ratelimit-Remaining": {"3"}}, scale: 1, ok: true},
+		{headers: http.Header{"Ratelimit-Remaining": {"10"}, "Ratelimit-Limit": {"100, 100;w=60"}}, scale: 5, ok: true},
+	} {
+		scale, ok := parser.Parse(http.StatusTooManyRequests, tc.headers, 0)
+		assert.Equal(t, tc.ok, ok, "%v", tc.headers)
+		if tc.ok {
+			assert.Equal(t, tc.scale, scale, "%v", tc.headers)
+		}
+	}
+}
+
+func TestServerTimingHintParser(t *testing.T) {
+	headers := http.Header{"Server-Timing": {`cache;desc="Cache Read";dur=50, db;dur=900;desc="Database"`, "app;dur=150, miss"}}
+
+	scale, ok := NewServerTimingHintParser("db", 300*time.Millisecond).Parse(http.StatusOK, headers, 0)
+	require.True(t, ok)
+	assert.Equal(t, 3.0, scale)
+
+	scale, ok = NewServerTimingHintParser("", 100*time.Millisecond).Parse(http.StatusOK, headers, 0)
+	require.True(t, ok, "without a metric every duration is summed")
+	assert.Equal(t, 11.0, scale)
+
+	scale, ok = NewServerTimingHintParser("APP", 200*time.Millisecond).Parse(http.StatusOK, headers, 0)
+	require.True(t, ok)
+	assert.Equal(t, 1.0, scale, "durations up to the healthy one leave the wait as it is")
+
+	_, ok = NewServerTimingHintParser("miss", time.Second).Parse(http.StatusOK, headers, 0)
+	assert.False(t, ok, "metrics without a duration are no hint")
+
+	_, ok = NewServerTimingHintParser("db", time.Second).Parse(0, nil, 0)
+	assert.False(t, ok)
+}
+
+func TestServerHintBackoffAdaptsToEachResponse(t *testing.T) {
+	remaining := []string{"40", "10", "0"}
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := int(atomic.AddInt32(&calls, 1)) - 1
+		if call == len(remaining) {
+			return
+		}
+		w.Header().Set("X-RateLimit-Remaining", remaining[call])
+		w.Header().Set("X-RateLimit-Limit", "100")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	for kind, newClient := range retryClients {
+		atomic.StoreInt32(&calls, 0)
+		clock := fakeclock.New(time.Now())
+		client := newClient("server_hint_backoff_"+kind, clock)
+		client.SetRetryCount(3)
+		client.SetRetrier(NewRetrier(NewServerHintBackoff(steadyBackoff(100*time.Millisecond), NewRateLimitHintParser(),
+			WithHintBounds(0, 2*time.Second))))
+
+		response, err := client.Get(server.URL, http.Header{})
+		require.NoError(t, err, kind)
+		assert.Equal(t, http.StatusOK, response.StatusCode(), kind)
+		assert.Equal(t, []time.Duration{125 * time.Millisecond, 500 * time.Millisecond, 2 * time.Second}, clock.Sleeps(), kind)
+	}
+}
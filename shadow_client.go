@@ -0,0 +1,240 @@
+package heimdall
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const defaultMaxShadowRequests int = 16
+
+type shadowClient struct {
+	primary Client
+	shadow  Client
+
+	sampleRate float64
+	random     func() float64
+
+	slots    chan struct{}
+	inFlight sync.WaitGroup
+}
+
+// NewShadowClient returns a Client which serves every call from primary and
+// mirrors a sampleRate fraction of them to shadow in the background. Shadow
+// results are discarded, and when too many shadow requests are already in
+// flight the mirrored request is dropped so the primary never waits.
+// SetRetryCount and SetRetrier are applied to the primary only; configure the
+// shadow directly.
+func NewShadowClient(primary, shadow Client, sampleRate float64) Client {
+	return &shadowClient{
+		primary:    primary,
+		shadow:     shadow,
+		sampleRate: sampleRate,
+		random:     rand.Float64,
+		slots:      make(chan struct{}, defaultMaxShadowRequests),
+	}
+}
+
+// Derive returns a shadow client over clients derived from the primary and
+// the shadow, mirroring at the same sample rate with its own in-flight limit
+func (sc *shadowClient) Derive(opts ...Option) Client {
+	return &shadowClient{
+		primary:    deriveClient(sc.primary, opts),
+		shadow:     deriveClient(sc.shadow, opts),
+		sampleRate: sc.sampleRate,
+		random:     sc.random,
+		slots:      make(chan struct{}, cap(sc.slots)),
+	}
+}
+
+// With returns a view of sc setting the defaults of opts on every request
+// sent through it
+func (sc *shadowClient) With(opts ...RequestOption) Client {
+	return newScopedClient(sc, requestDefaults{}, opts)
+}
+
+// SetRetryCount sets the retry count of the primary client
+func (sc *shadowClient) SetRetryCount(count int) {
+	sc.primary.SetRetryCount(count)
+}
+
+// SetRetrier sets the retry strategy of the primary client
+func (sc *shadowClient) SetRetrier(retrier Retriable) {
+	sc.primary.SetRetrier(retrier)
+}
+
+// Stats returns the stats of the primary client
+func (sc *shadowClient) Stats() ClientStats {
+	return statsOf(sc.primary)
+}
+
+// Get makes a HTTP GET request through the primary, mirroring it when sampled
+func (sc *shadowClient) Get(url string, headers http.Header) (Response, error) {
+	sc.mirror(func(c Client) { c.Get(url, headers) })
+
+	return sc.primary.Get(url, headers)
+}
+
+// Post makes a HTTP POST request through the primary, mirroring it when sampled
+func (sc *shadowClient) Post(url string, body io.Reader, headers http.Header) (Response, error) {
+	data, err := readShadowBody(body)
+	if err != nil {
+		return Response{}, errors.Wrap(err, "POST - request body read failed")
+	}
+
+	sc.mirror(func(c Client) { c.Post(url, shadowBody(data), headers) })
+
+	return sc.primary.Post(url, shadowBody(data), headers)
+}
+
+// Put makes a HTTP PUT request through the primary, mirroring it when sampled
+func (sc *shadowClient) Put(url string, body io.Reader, headers http.Header) (Response, error) {
+	data, err := readShadowBody(body)
+	if err != nil {
+		return Response{}, errors.Wrap(err, "PUT - request body read failed")
+	}
+
+	sc.mirror(func(c Client) { c.Put(url, shadowBody(data), headers) })
+
+	return sc.primary.Put(url, shadowBody(data), headers)
+}
+
+// Patch makes a HTTP PATCH request through the primary, mirroring it when sampled
+func (sc *shadowClient) Patch(url string, body io.Reader, headers http.Header) (Response, error) {
+	data, err := readShadowBody(body)
+	if err != nil {
+		return Response{}, errors.Wrap(err, "PATCH - request body read failed")
+	}
+
+	sc.mirror(func(c Client) { c.Patch(url, shadowBody(data), headers) })
+
+	return sc.primary.Patch(url, shadowBody(data), headers)
+}
+
+// Delete makes a HTTP DELETE request through the primary, mirroring it when sampled
+func (sc *shadowClient) Delete(url string, headers http.Header) (Response, error) {
+	sc.mirror(func(c Client) { c.Delete(url, headers) })
+
+	return sc.primary.Delete(url, headers)
+}
+
+// Invoke makes a HTTP request with method through the primary, mirroring it
+// when sampled
+func (sc *shadowClient) Invoke(method, url string, body io.Reader, headers http.Header) (Response, error) {
+	data, err := readShadowBody(body)
+	if err != nil {
+		return Response{}, errors.Wrapf(err, "%s - request body read failed", method)
+	}
+
+	sc.mirror(func(c Client) { invoke(c, method, url, shadowBody(data), headers) })
+
+	return invoke(sc.primary, method, url, shadowBody(data), headers)
+}
+
+// Do sends the request through the primary, mirroring a copy when sampled.
+// The copy is detached from the request context, so cancelling the primary
+// request does not cancel the shadow one.
+func (sc *shadowClient) Do(request *http.Request) (Response, error) {
+	data, err := readShadowBody(request.Body)
+	if err != nil {
+		return Response{}, errors.Wrap(err, "request body read failed")
+	}
+
+	sc.mirror(func(c Client) {
+		SendRequest(c, withShadowBody(request.WithContext(context.Background()), data))
+	})
+
+	return SendRequest(sc.primary, withShadowBody(request.WithContext(request.Context()), data))
+}
+
+// NewRequest returns a builder for a request sent through the primary and copied to the shadow
+func (sc *shadowClient) NewRequest(method, template string) *RequestBuilder {
+	return newRequestBuilder(sc, method, template)
+}
+
+// PostAsync queues the request on the primary only
+func (sc *shadowClient) PostAsync(url string, body []byte, headers http.Header) error {
+	return postAsync(sc.primary, url, body, headers)
+}
+
+// Flush waits for the async queue of the primary
+func (sc *shadowClient) Flush(ctx context.Context) error {
+	return flushClient(ctx, sc.primary)
+}
+
+// Shutdown shuts the primary client down
+func (sc *shadowClient) Shutdown(ctx context.Context) error {
+	return shutdownClient(ctx, sc.primary)
+}
+
+// GetSSE opens the event stream on the primary only
+func (sc *shadowClient) GetSSE(ctx context.Context, url string, headers http.Header) (<-chan Event, func(), error) {
+	return getSSE(ctx, sc.primary, url, headers)
+}
+
+// mirror fires call against the shadow in the background when the request is
+// sampled and a slot is free
+func (sc *shadowClient) mirror(call func(c Client)) {
+	if sc.random() >= sc.sampleRate {
+		return
+	}
+
+	select {
+	case sc.slots <- struct{}{}:
+	default:
+		return
+	}
+
+	sc.inFlight.Add(1)
+	go func() {
+		defer func() {
+			<-sc.slots
+			sc.inFlight.Done()
+		}()
+
+		call(sc.shadow)
+	}()
+}
+
+// wait blocks until all shadow requests in flight have finished
+func (sc *shadowClient) wait() {
+	sc.inFlight.Wait()
+}
+
+func readShadowBody(body io.Reader) ([]byte, error) {
+	if body == nil {
+		return nil, nil
+	}
+
+	return ioutil.ReadAll(body)
+}
+
+func shadowBody(data []byte) io.Reader {
+	if data == nil {
+		return nil
+	}
+
+	return bytes.NewReader(data)
+}
+
+// withShadowBody gives request, a copy made for one client, its own reader
+// over data and its own headers
+func withShadowBody(request *http.Request, data []byte) *http.Request {
+	request.Header = copyHeader(request.Header)
+	request.Body = nil
+	request.GetBody = nil
+	if data != nil {
+		request.Body = ioutil.NopCloser(bytes.NewReader(data))
+		request.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(data)), nil
+		}
+	}
+
+	return request
+}
@@ -0,0 +1,143 @@
+package heimdall
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newMarkedShadowClient(timeoutInMillis int) Client {
+	client := NewHTTPClient(timeoutInMillis)
+	client.AddRequestMutator(RequestMutatorFunc(func(request *http.Request) error {
+		request.Header.Set("X-Shadow", "true")
+		return nil
+	}))
+
+	return client
+}
+
+func TestShadowClientSamplesRoughlyAtConfiguredRate(t *testing.T) {
+	var primaryCalls, shadowCalls int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Shadow") != "" {
+			atomic.AddInt32(&shadowCalls, 1)
+			return
+		}
+		atomic.AddInt32(&primaryCalls, 1)
+	}))
+	defer server.Close()
+
+	client := NewShadowClient(NewHTTPClient(100), newMarkedShadowClient(100), 0.25)
+	sc := client.(*shadowClient)
+	sc.random = rand.New(rand.NewSource(42)).Float64
+	sc.slots = make(chan struct{}, 1000)
+
+	total := 1000
+	for i := 0; i < total; i++ {
+		_, err := client.Get(server.URL, http.Header{})
+		require.NoError(t, err)
+	}
+	sc.wait()
+
+	assert.Equal(t, int32(total), atomic.LoadInt32(&primaryCalls))
+	assert.InDelta(t, 250, atomic.LoadInt32(&shadowCalls), 50)
+}
+
+func TestShadowClientReturnsPrimaryResultWhenShadowFails(t *testing.T) {
+	shadowBodies := make(chan string, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		if r.Header.Get("X-Shadow") != "" {
+			shadowBodies <- string(body)
+			time.Sleep(200 * time.Millisecond)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Write(append([]byte("primary:"), body...))
+	}))
+	defer server.Close()
+
+	client := NewShadowClient(NewHTTPClient(100), newMarkedShadowClient(1000), 1)
+
+	start := time.Now()
+	response, err := client.Post(server.URL, bytes.NewReader([]byte("payload")), http.Header{})
+	elapsed := time.Since(start)
+
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode())
+	assert.Equal(t, "primary:payload", string(response.Body()))
+	assert.True(t, elapsed < 150*time.Millisecond, "shadow latency leaked into primary: %s", elapsed)
+
+	assert.Equal(t, "payload", <-shadowBodies)
+	client.(*shadowClient).wait()
+}
+
+func TestShadowClientDropsShadowRequestsWhenSaturated(t *testing.T) {
+	release := make(chan struct{})
+	var shadowCalls int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Shadow") != "" {
+			atomic.AddInt32(&shadowCalls, 1)
+			<-release
+		}
+	}))
+	defer server.Close()
+
+	client := NewShadowClient(NewHTTPClient(100), newMarkedShadowClient(1000), 1)
+	client.(*shadowClient).slots = make(chan struct{}, 2)
+
+	for i := 0; i < 5; i++ {
+		_, err := client.Get(server.URL, http.Header{})
+		require.NoError(t, err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	client.(*shadowClient).wait()
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&shadowCalls))
+}
+
+func TestShadowClientDoMirrorsRequestDetachedFromContext(t *testing.T) {
+	shadowBodies := make(chan string, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		if r.Header.Get("X-Shadow") != "" {
+			shadowBodies <- string(body)
+			return
+		}
+
+		w.Write(append([]byte("primary:"), body...))
+	}))
+	defer server.Close()
+
+	client := NewShadowClient(NewHTTPClient(100), newMarkedShadowClient(1000), 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	request, err := http.NewRequest(http.MethodPut, server.URL, bytes.NewReader([]byte("payload")))
+	require.NoError(t, err)
+
+	response, err := SendRequest(client, request.WithContext(ctx))
+	cancel()
+
+	require.NoError(t, err)
+	assert.Equal(t, "primary:payload", string(response.Body()))
+	assert.Equal(t, "payload", <-shadowBodies)
+	client.(*shadowClient).wait()
+}
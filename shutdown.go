@@ -0,0 +1,225 @@
+package heimdall
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// ErrClientClosed is returned for requests made, and PostAsync jobs queued,
+// once Shutdown was called
+var ErrClientClosed = errors.New("client closed")
+
+// ErrShutdownIncomplete is returned by Shutdown when it cut requests in flight
+// short. It unwraps to the error of the context of Shutdown when that was done
+// before the requests were.
+type ErrShutdownIncomplete struct {
+	// Drained is the number of requests in flight at Shutdown that finished
+	Drained int64
+	// Aborted is the number of those cut short
+	Aborted int64
+	err     error
+}
+
+func (e *ErrShutdownIncomplete) Error() string {
+	message := fmt.Sprintf("shutdown cut %d requests short, drained %d", e.Aborted, e.Drained)
+	if e.err != nil {
+		message += ": " + e.err.Error()
+	}
+
+	return message
+}
+
+// Unwrap returns the error of the context of Shutdown, if it was done
+func (e *ErrShutdownIncomplete) Unwrap() error {
+	return e.err
+}
+
+// shutdownGate admits the requests of a client until Shutdown closes it, and
+// counts those it drains. It is only updated and read atomically, so admitting
+// a request costs no locks.
+type shutdownGate struct {
+	closing atomic.Bool
+	// expired is set once the context of Shutdown is done
+	expired atomic.Bool
+	// deadline is the deadline of the context of Shutdown in Unix nanoseconds,
+	// 0 when it has none
+	deadline atomic.Int64
+	active   atomic.Int64
+	// left counts the requests that finished while closing, including those
+	// cut short, which aborted counts
+	left    atomic.Int64
+	aborted atomic.Int64
+	idle    chan struct{}
+	// closingCh is closed once closing, waking the retries in backoff
+	closingCh chan struct{}
+}
+
+func newShutdownGate() *shutdownGate {
+	return &shutdownGate{idle: make(chan struct{}, 1), closingCh: make(chan struct{})}
+}
+
+// enter admits a request, reporting false once the gate is closing
+func (g *shutdownGate) enter() bool {
+	g.active.Add(1)
+	if g.closing.Load() {
+		g.release()
+		return false
+	}
+
+	return true
+}
+
+// admit admits a request accepted before the gate was closing, such as a
+// queued PostAsync job
+func (g *shutdownGate) admit() {
+	g.active.Add(1)
+}
+
+// leave releases a request admitted by enter or admit
+func (g *shutdownGate) leave() {
+	if g.closing.Load() {
+		g.left.Add(1)
+	}
+	g.release()
+}
+
+// release wakes up Shutdown, if it waits, once the last request has left
+func (g *shutdownGate) release() {
+	if g.active.Add(-1) == 0 && g.closing.Load() {
+		select {
+		case g.idle <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// closed reports whether the gate stopped admitting requests
+func (g *shutdownGate) closed() bool {
+	return g.closing.Load()
+}
+
+// close stops admitting requests, holding their retries to the deadline of
+// ctx
+func (g *shutdownGate) close(ctx context.Context) {
+	if deadline, ok := ctx.Deadline(); ok {
+		g.deadline.Store(deadline.UnixNano())
+	}
+	if g.closing.CompareAndSwap(false, true) {
+		close(g.closingCh)
+	}
+}
+
+// cutsShort reports whether a retry waiting until at would outlast the
+// deadline of Shutdown, counting the request as aborted when it does
+func (g *shutdownGate) cutsShort(at time.Time) bool {
+	if g == nil || !g.closing.Load() {
+		return false
+	}
+
+	deadline := g.deadline.Load()
+	if !g.expired.Load() && (deadline == 0 || at.UnixNano() < deadline) {
+		return false
+	}
+	g.aborted.Add(1)
+
+	return true
+}
+
+// backoff waits interval before the next attempt of a request with ctx, as
+// clock.Sleep does, returning false instead when Shutdown was called and the
+// wait would outlast its deadline. Retries already in backoff when Shutdown
+// is called are woken up to be checked.
+func (g *shutdownGate) backoff(clock Clock, ctx context.Context, interval time.Duration) bool {
+	wakeAt := clock.Now().Add(interval)
+	if g == nil {
+		clock.Sleep(ctx, interval)
+		return true
+	}
+	if g.closed() {
+		if ctx.Err() == nil && g.cutsShort(wakeAt) {
+			return false
+		}
+		clock.Sleep(ctx, interval)
+		return true
+	}
+	if interval <= 0 {
+		clock.Sleep(ctx, interval)
+		return true
+	}
+
+	sleepCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-g.closingCh:
+			cancel()
+		case <-sleepCtx.Done():
+		}
+	}()
+	clock.Sleep(sleepCtx, interval)
+	if ctx.Err() != nil || !g.closed() {
+		return true
+	}
+
+	return g.backoff(clock, ctx, wakeAt.Sub(clock.Now()))
+}
+
+// drop counts a request the gate would have admitted had Shutdown not expired
+func (g *shutdownGate) drop() bool {
+	if !g.expired.Load() {
+		return false
+	}
+	g.aborted.Add(1)
+	g.left.Add(1)
+
+	return true
+}
+
+// wait waits until the requests admitted have left. Once ctx is done, those
+// that are still in flight are cancelled with cancel, which returns how many
+// it cancelled, and waited for in turn. It returns the error of ctx when it
+// was done first.
+func (g *shutdownGate) wait(ctx context.Context, cancel func() int) error {
+	for g.active.Load() > 0 {
+		select {
+		case <-g.idle:
+		case <-ctx.Done():
+			g.expired.Store(true)
+			g.aborted.Add(int64(cancel()))
+			for g.active.Load() > 0 {
+				<-g.idle
+			}
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// counts returns the requests drained and aborted since Shutdown was called
+func (g *shutdownGate) counts() (drained, aborted int64) {
+	aborted = g.aborted.Load()
+	return g.left.Load() - aborted, aborted
+}
+
+// result returns the error of Shutdown, given the error of waiting
+func (g *shutdownGate) result(err error) error {
+	drained, aborted := g.counts()
+	if aborted == 0 && err == nil {
+		return nil
+	}
+
+	return &ErrShutdownIncomplete{Drained: drained, Aborted: aborted, err: err}
+}
+
+// closeIdleConnections closes the idle connections of the transport of client,
+// if it can
+func closeIdleConnections(client *http.Client) {
+	if transport, ok := client.Transport.(interface{ CloseIdleConnections() }); ok {
+		transport.CloseIdleConnections()
+	}
+}
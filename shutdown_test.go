@@ -0,0 +1,168 @@
+package heimdall
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyServer answers the first failures requests with 503 and the others
+// with 200, counting them into hits
+func flakyServer(failures int32, hits *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(hits, 1) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+}
+
+type shutdownResult struct {
+	response Response
+	err      error
+}
+
+// getInBackoff starts a GET with client and returns once its first attempt
+// was answered, leaving it in backoff
+func getInBackoff(t *testing.T, client Client, url string, hits *int32) <-chan shutdownResult {
+	done := make(chan shutdownResult, 1)
+	go func() {
+		response, err := client.Get(url, http.Header{})
+		done <- shutdownResult{response: response, err: err}
+	}()
+	require.Eventually(t, func() bool { return atomic.LoadInt32(hits) == 1 }, time.Second, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+
+	return done
+}
+
+func TestShutdownRejectsNewRequests(t *testing.T) {
+	var hits int32
+	server := flakyServer(0, &hits)
+	defer server.Close()
+
+	for kind, newClient := range retryClients {
+		client := newClient("shutdown_rejects_"+kind, realClock{})
+		require.NoError(t, client.Shutdown(context.Background()), kind)
+
+		_, err := client.Get(server.URL, http.Header{})
+		assert.True(t, errors.Is(err, ErrClientClosed), "%s: %v", kind, err)
+		assert.True(t, errors.Is(client.PostAsync(server.URL, nil, http.Header{}), ErrClientClosed), kind)
+		assert.NoError(t, client.Shutdown(context.Background()), "%s: shutting down again is harmless", kind)
+
+		stats := client.Stats()
+		assert.Zero(t, stats.ShutdownDrained, kind)
+		assert.Zero(t, stats.ShutdownAborted, kind)
+	}
+	assert.Zero(t, atomic.LoadInt32(&hits))
+}
+
+func TestShutdownDrainsRetriesThatFitTheDeadline(t *testing.T) {
+	for kind, newClient := range retryClients {
+		var hits int32
+		server := flakyServer(1, &hits)
+		defer server.Close()
+
+		client := newClient("shutdown_drains_"+kind, realClock{})
+		client.SetRetryCount(2)
+		client.SetRetrier(&fixedRetrier{interval: 200 * time.Millisecond})
+		done := getInBackoff(t, client, server.URL, &hits)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		require.NoError(t, client.Shutdown(ctx), kind)
+
+		result := <-done
+		require.NoError(t, result.err, kind)
+		assert.Equal(t, http.StatusOK, result.response.StatusCode(), "%s: the retry was sent", kind)
+		assert.Equal(t, int32(2), atomic.LoadInt32(&hits), kind)
+
+		stats := client.Stats()
+		assert.Equal(t, int64(1), stats.ShutdownDrained, kind)
+		assert.Zero(t, stats.ShutdownAborted, kind)
+	}
+}
+
+func TestShutdownCutsShortRetriesThatOutlastTheDeadline(t *testing.T) {
+	for kind, newClient := range retryClients {
+		var hits int32
+		server := flakyServer(3, &hits)
+		defer server.Close()
+
+		client := newClient("shutdown_cuts_"+kind, realClock{})
+		client.SetRetryCount(2)
+		client.SetRetrier(&fixedRetrier{interval: 5 * time.Second})
+		done := getInBackoff(t, client, server.URL, &hits)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		err := client.Shutdown(ctx)
+		assert.Less(t, int64(time.Since(start)), int64(200*time.Millisecond), "%s: the request in backoff is given up at once", kind)
+
+		var incomplete *ErrShutdownIncomplete
+		require.True(t, errors.As(err, &incomplete), "%s: %v", kind, err)
+		assert.Equal(t, int64(1), incomplete.Aborted, kind)
+		assert.Zero(t, incomplete.Drained, kind)
+		assert.False(t, errors.Is(err, context.DeadlineExceeded), "%s: the request was done before the deadline", kind)
+
+		result := <-done
+		var exhausted *RetriesExhaustedError
+		require.True(t, errors.As(result.err, &exhausted), "%s: the last error is returned: %v", kind, result.err)
+		assert.Equal(t, http.StatusServiceUnavailable, result.response.StatusCode(), kind)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&hits), "%s: no retry was sent", kind)
+		assert.Equal(t, int64(1), client.Stats().ShutdownAborted, kind)
+	}
+}
+
+func TestShutdownCancelsAttemptsAtTheDeadline(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client := NewHTTPClient(10000)
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.Get(server.URL, http.Header{})
+		done <- err
+	}()
+	require.Eventually(t, func() bool { return len(client.InFlight()) == 1 }, time.Second, time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := client.Shutdown(ctx)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "%v", err)
+	var incomplete *ErrShutdownIncomplete
+	require.True(t, errors.As(err, &incomplete))
+	assert.Equal(t, int64(1), incomplete.Aborted)
+
+	assert.True(t, errors.Is(<-done, context.Canceled), "requests still in flight are cancelled")
+}
+
+func TestShutdownSendsQueuedAsyncJobs(t *testing.T) {
+	var hits int32
+	server := flakyServer(0, &hits)
+	defer server.Close()
+
+	client := NewHTTPClient(1000, WithAsyncQueue(10, 1))
+	for i := 0; i < 5; i++ {
+		require.NoError(t, client.PostAsync(server.URL, []byte("job"), http.Header{}))
+	}
+
+	require.NoError(t, client.Shutdown(context.Background()))
+	assert.Equal(t, int32(5), atomic.LoadInt32(&hits), "queued jobs are sent before the client closes")
+	assert.Equal(t, int64(5), client.Stats().Requests)
+	assert.Zero(t, client.Stats().ShutdownAborted)
+}
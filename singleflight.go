@@ -0,0 +1,91 @@
+package heimdall
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var defaultSingleflightHeaders = []string{"Authorization", "Accept"}
+
+// flightGroup coalesces identical GET and HEAD requests in flight at the same
+// time into a single call
+type flightGroup struct {
+	varyHeaders []string
+
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+type flight struct {
+	done     sync.WaitGroup
+	waiters  int
+	response Response
+	err      error
+}
+
+func newFlightGroup(varyHeaders []string) *flightGroup {
+	if len(varyHeaders) == 0 {
+		varyHeaders = defaultSingleflightHeaders
+	}
+
+	return &flightGroup{
+		varyHeaders: varyHeaders,
+		flights:     map[string]*flight{},
+	}
+}
+
+// do sends the request through send, unless an identical request is already
+// in flight, in which case it waits for that request and shares its outcome.
+// Every caller receives its own copy of the response. A nil group sends every
+// request.
+func (g *flightGroup) do(request *http.Request, send func(*http.Request) (Response, error)) (Response, error) {
+	if g == nil || !coalescable(request) {
+		return send(request)
+	}
+
+	key := g.key(request)
+
+	g.mu.Lock()
+	if f, ok := g.flights[key]; ok {
+		f.waiters++
+		g.mu.Unlock()
+
+		f.done.Wait()
+		return f.response.clone(), f.err
+	}
+
+	f := &flight{}
+	f.done.Add(1)
+	g.flights[key] = f
+	g.mu.Unlock()
+
+	f.response, f.err = send(request)
+
+	g.mu.Lock()
+	delete(g.flights, key)
+	g.mu.Unlock()
+	f.done.Done()
+
+	return f.response.clone(), f.err
+}
+
+// key identifies requests expected to get the same response: the method, the
+// URL and the headers the response varies by
+func (g *flightGroup) key(request *http.Request) string {
+	parts := []string{request.Method, request.URL.String()}
+	for _, name := range g.varyHeaders {
+		parts = append(parts, strings.Join(request.Header[http.CanonicalHeaderKey(name)], ","))
+	}
+
+	return strings.Join(parts, "\n")
+}
+
+// coalescable reports whether request is a GET or HEAD without a body
+func coalescable(request *http.Request) bool {
+	if request.Method != http.MethodGet && request.Method != http.MethodHead {
+		return false
+	}
+
+	return request.Body == nil || request.Body == http.NoBody
+}
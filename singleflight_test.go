@@ -0,0 +1,175 @@
+package heimdall
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// waitForWaiters blocks until n callers are waiting on the only flight in g
+func waitForWaiters(t *testing.T, g *flightGroup, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		g.mu.Lock()
+		waiting := 0
+		for _, f := range g.flights {
+			waiting += f.waiters
+		}
+		g.mu.Unlock()
+
+		if waiting == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	require.FailNow(t, "timed out waiting for coalesced requests")
+}
+
+func testSingleflightCoalescesGets(t *testing.T, client Client, flights *flightGroup) {
+	var calls int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		w.Write([]byte(`{ "response": "ok" }`))
+	}))
+	defer server.Close()
+
+	concurrency := 100
+	responses := make([]Response, concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			response, err := client.Get(server.URL, http.Header{})
+			assert.NoError(t, err)
+			responses[i] = response
+		}(i)
+	}
+
+	waitForWaiters(t, flights, concurrency-1)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	for _, response := range responses {
+		assert.Equal(t, `{ "response": "ok" }`, string(response.Body()))
+	}
+
+	responses[0].Body()[0] = 'X'
+	assert.Equal(t, `{ "response": "ok" }`, string(responses[1].Body()), "responses should not share memory")
+}
+
+func TestHTTPClientSingleflightCoalescesConcurrentGets(t *testing.T) {
+	client := NewHTTPClient(5000, WithSingleflight())
+
+	testSingleflightCoalescesGets(t, client, client.options.flights)
+}
+
+func TestHystrixHTTPClientSingleflightCoalescesConcurrentGets(t *testing.T) {
+	client := NewHystrixHTTPClient(5000, NewHystrixConfig("singleflight_command", HystrixCommandConfig{
+		Timeout:               5000,
+		MaxConcurrentRequests: 10,
+	}), WithSingleflight())
+
+	testSingleflightCoalescesGets(t, client, client.options.flights)
+}
+
+func TestSingleflightPropagatesErrorsToAllWaiters(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(5000, WithSingleflight())
+
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			_, err := client.Get(server.URL, http.Header{})
+			errs <- err
+		}()
+	}
+
+	waitForWaiters(t, client.options.flights, 9)
+	close(release)
+
+	for i := 0; i < 10; i++ {
+		err := <-errs
+		require.Error(t, err)
+		assert.Equal(t, "server error: 500", err.Error())
+	}
+}
+
+func TestSingleflightKeyVariesByConfiguredHeaders(t *testing.T) {
+	g := newFlightGroup(nil)
+
+	request := func(method string, headers map[string]string) *http.Request {
+		r, err := http.NewRequest(method, "http://example.com/items", nil)
+		require.NoError(t, err)
+		for name, value := range headers {
+			r.Header.Set(name, value)
+		}
+		return r
+	}
+
+	base := g.key(request(http.MethodGet, map[string]string{"Authorization": "a"}))
+
+	assert.Equal(t, base, g.key(request(http.MethodGet, map[string]string{"Authorization": "a", "X-Request-Id": "1"})))
+	assert.NotEqual(t, base, g.key(request(http.MethodGet, map[string]string{"Authorization": "b"})))
+	assert.NotEqual(t, base, g.key(request(http.MethodGet, map[string]string{"Authorization": "a", "Accept": "text/csv"})))
+	assert.NotEqual(t, base, g.key(request(http.MethodHead, map[string]string{"Authorization": "a"})))
+
+	custom := newFlightGroup([]string{"x-tenant"})
+	assert.NotEqual(t,
+		custom.key(request(http.MethodGet, map[string]string{"X-Tenant": "1"})),
+		custom.key(request(http.MethodGet, map[string]string{"X-Tenant": "2"})))
+}
+
+func TestSingleflightNeverCoalescesRequestsWithBodies(t *testing.T) {
+	post, _ := http.NewRequest(http.MethodPost, "http://example.com", nil)
+	getWithBody, _ := http.NewRequest(http.MethodGet, "http://example.com", bytes.NewBufferString("{}"))
+	get, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	head, _ := http.NewRequest(http.MethodHead, "http://example.com", nil)
+
+	assert.False(t, coalescable(post))
+	assert.False(t, coalescable(getWithBody))
+	assert.True(t, coalescable(get))
+	assert.True(t, coalescable(head))
+}
+
+func TestSingleflightDoesNotCoalescePosts(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(50 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(5000, WithSingleflight())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := client.Post(server.URL, bytes.NewBufferString("{}"), http.Header{})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(5), atomic.LoadInt32(&calls))
+}
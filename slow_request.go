@@ -0,0 +1,159 @@
+package heimdall
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// SlowRequestReport describes a request that took longer than the threshold
+// given to SetSlowRequestHook
+type SlowRequestReport struct {
+	Method string
+	// URL is the request URL with any password redacted, and the values of
+	// its query parameters too when the client was made with
+	// WithSlowRequestRedactQuery
+	URL       string
+	RequestID string
+	// Duration is how long the request took, retries and backoffs included
+	Duration time.Duration
+	// StatusCode is the final status, 0 when no response was received
+	StatusCode int
+	// Error is the message of the error the request failed with, if any
+	Error string
+	// Attempts are the attempts of the request, broken down by phase when
+	// the client was made with WithPhaseTimings
+	Attempts []AttemptTrace
+	// Suppressed counts the slow requests left unreported since the previous
+	// report because the per-minute cap was reached
+	Suppressed int64
+}
+
+// WithSlowRequestRedactQuery redacts the values of the query parameters of
+// the URLs in slow request reports, keeping their names
+func WithSlowRequestRedactQuery() Option {
+	return func(options *clientOptions) {
+		options.slowRedactQuery = true
+	}
+}
+
+// slowRequestLog reports requests slower than a threshold, at most a number
+// of them each minute of the clock
+type slowRequestLog struct {
+	threshold    time.Duration
+	maxPerMinute int
+	hook         func(SlowRequestReport)
+
+	// window holds the minute being counted in its upper 32 bits and the
+	// reports made in it in the lower ones, so that a report is counted
+	// against the cap with a single compare and swap
+	window     uint64
+	suppressed int64
+}
+
+// newSlowRequestLog returns nil, reporting nothing, when hook is nil
+func newSlowRequestLog(threshold time.Duration, maxPerMinute int, hook func(SlowRequestReport)) *slowRequestLog {
+	if hook == nil {
+		return nil
+	}
+
+	return &slowRequestLog{threshold: threshold, maxPerMinute: maxPerMinute, hook: hook}
+}
+
+// clone returns a log with the settings of l and a cap of its own
+func (l *slowRequestLog) clone() *slowRequestLog {
+	if l == nil {
+		return nil
+	}
+
+	return newSlowRequestLog(l.threshold, l.maxPerMinute, l.hook)
+}
+
+// observe reports request when it took longer than the threshold, returning
+// an *ErrCallbackPanic in place of err when the hook panics
+func (l *slowRequestLog) observe(request *http.Request, response Response, err error, elapsed time.Duration, now time.Time, redactQuery bool) error {
+	if l == nil || elapsed <= l.threshold {
+		return err
+	}
+	if !l.allow(now) {
+		atomic.AddInt64(&l.suppressed, 1)
+		return err
+	}
+
+	report := SlowRequestReport{
+		Method:     request.Method,
+		URL:        slowRequestURL(request.URL, redactQuery),
+		RequestID:  response.RequestID(),
+		Duration:   elapsed,
+		StatusCode: response.StatusCode(),
+		Attempts:   response.Trace().Attempts,
+		Suppressed: atomic.SwapInt64(&l.suppressed, 0),
+	}
+	if err != nil {
+		report.Error = err.Error()
+	}
+
+	if hookErr := l.report(report); hookErr != nil {
+		return hookErr
+	}
+
+	return err
+}
+
+func (l *slowRequestLog) report(report SlowRequestReport) (err error) {
+	defer recoverCallback("slow request hook", &err)
+
+	l.hook(report)
+	return nil
+}
+
+// allow counts a report against the cap of the minute of now, reporting
+// false once the cap is reached. A cap of zero or less allows every report.
+func (l *slowRequestLog) allow(now time.Time) bool {
+	if l.maxPerMinute <= 0 {
+		return true
+	}
+
+	minute := uint64(now.Unix()/60) << 32
+	for {
+		window := atomic.LoadUint64(&l.window)
+		count := window & 0xffffffff
+		if window&^0xffffffff != minute {
+			count = 0
+		}
+		if count >= uint64(l.maxPerMinute) {
+			return false
+		}
+		if atomic.CompareAndSwapUint64(&l.window, window, minute|(count+1)) {
+			return true
+		}
+	}
+}
+
+// slowRequestURL renders u for a slow request report
+func slowRequestURL(u *url.URL, redactQuery bool) string {
+	if !redactQuery || u.RawQuery == "" {
+		return redactUserinfo(u.String())
+	}
+
+	query := u.Query()
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var pairs []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			pairs = append(pairs, url.QueryEscape(name)+"="+redactValue(value))
+		}
+	}
+	redacted := *u
+	redacted.RawQuery = strings.Join(pairs, "&")
+
+	return redactUserinfo(redacted.String())
+}
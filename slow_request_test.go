@@ -0,0 +1,190 @@
+package heimdall
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gojektech/heimdall/fakeclock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// slowServer advances clock by a second while answering paths starting with
+// /slow, failing those starting with /slow/fail
+func slowServer(clock *fakeclock.Clock) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/slow") {
+			clock.Advance(time.Second)
+		}
+		if strings.HasPrefix(r.URL.Path, "/slow/fail") {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+}
+
+// slowReports collects the reports of a slow request hook
+type slowReports struct {
+	mu      sync.Mutex
+	reports []SlowRequestReport
+}
+
+func (s *slowReports) hook(report SlowRequestReport) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.reports = append(s.reports, report)
+}
+
+func (s *slowReports) all() []SlowRequestReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]SlowRequestReport(nil), s.reports...)
+}
+
+func TestClientsReportSlowRequests(t *testing.T) {
+	for kind, newClient := range retryClients {
+		t.Run(kind, func(t *testing.T) {
+			clock := fakeclock.New(time.Date(2018, time.January, 19, 22, 0, 0, 0, time.UTC))
+			server := slowServer(clock)
+			defer server.Close()
+
+			reports := &slowReports{}
+			client := newClient("slow_request_"+kind, clock)
+			client.SetRetryCount(1)
+			client.SetSlowRequestHook(500*time.Millisecond, 10, reports.hook)
+
+			_, err := client.Get(server.URL+"/fast", http.Header{})
+			require.NoError(t, err)
+			assert.Empty(t, reports.all(), "fast requests are not reported")
+
+			response, err := client.Get(server.URL+"/slow/fail", http.Header{})
+			require.Error(t, err)
+
+			all := reports.all()
+			require.Len(t, all, 1)
+			report := all[0]
+			assert.Equal(t, http.MethodGet, report.Method)
+			assert.Equal(t, server.URL+"/slow/fail", report.URL)
+			assert.Equal(t, response.RequestID(), report.RequestID)
+			assert.Equal(t, 2*time.Second, report.Duration)
+			assert.Equal(t, http.StatusBadGateway, report.StatusCode)
+			assert.Equal(t, err.Error(), report.Error)
+			require.Len(t, report.Attempts, 2)
+			assert.Equal(t, Duration(time.Second), report.Attempts[1].Duration)
+			assert.Nil(t, report.Attempts[1].Phases, "phases are only timed with WithPhaseTimings")
+		})
+	}
+}
+
+func TestSlowRequestHookCapsReportsPerMinute(t *testing.T) {
+	for kind, newClient := range retryClients {
+		t.Run(kind, func(t *testing.T) {
+			clock := fakeclock.New(time.Date(2018, time.January, 19, 22, 0, 0, 0, time.UTC))
+			server := slowServer(clock)
+			defer server.Close()
+
+			reports := &slowReports{}
+			client := newClient("slow_request_flood_"+kind, clock)
+			client.SetSlowRequestHook(500*time.Millisecond, 5, reports.hook)
+
+			var wg sync.WaitGroup
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < 5; j++ {
+						client.Get(server.URL+"/slow", http.Header{})
+					}
+				}()
+			}
+			wg.Wait()
+
+			assert.Len(t, reports.all(), 5, "20 slow requests within a minute are capped")
+
+			clock.Advance(time.Minute)
+			client.Get(server.URL+"/slow", http.Header{})
+
+			all := reports.all()
+			require.Len(t, all, 6)
+			assert.Equal(t, int64(15), all[5].Suppressed)
+		})
+	}
+}
+
+func TestSlowRequestHookRedactsURL(t *testing.T) {
+	clock := fakeclock.New(time.Now())
+	server := slowServer(clock)
+	defer server.Close()
+
+	url := strings.Replace(server.URL, "http://", "http://ci:secret@", 1) + "/slow?token=abc&id=42&id=43"
+
+	reports := &slowReports{}
+	client := NewHTTPClient(1000, WithClock(clock))
+	client.SetSlowRequestHook(0, 0, reports.hook)
+	client.Get(url, http.Header{})
+
+	redacting := NewHTTPClient(1000, WithClock(clock), WithSlowRequestRedactQuery())
+	redacting.SetSlowRequestHook(0, 0, reports.hook)
+	redacting.Get(url, http.Header{})
+
+	all := reports.all()
+	require.Len(t, all, 2)
+	host := strings.TrimPrefix(server.URL, "http://")
+	assert.Equal(t, "http://ci:xxxxx@"+host+"/slow?token=abc&id=42&id=43", all[0].URL)
+	assert.Equal(t, "http://ci:xxxxx@"+host+"/slow?id="+redactValue("42")+"&id="+redactValue("43")+"&token="+redactValue("abc"), all[1].URL)
+}
+
+func TestSlowRequestHookPanicFailsRequest(t *testing.T) {
+	clock := fakeclock.New(time.Now())
+	server := slowServer(clock)
+	defer server.Close()
+
+	client := NewHTTPClient(1000, WithClock(clock))
+	client.SetSlowRequestHook(time.Millisecond, 0, func(SlowRequestReport) {
+		panic("report sink is gone")
+	})
+
+	_, err := client.Get(server.URL+"/slow", http.Header{})
+
+	var panicked *ErrCallbackPanic
+	require.True(t, errors.As(err, &panicked), "%v", err)
+	assert.Equal(t, "slow request hook", panicked.Callback)
+	assert.Equal(t, int64(1), client.Stats().Failures)
+}
+
+func TestSlowRequestHookRemoved(t *testing.T) {
+	clock := fakeclock.New(time.Now())
+	server := slowServer(clock)
+	defer server.Close()
+
+	reports := &slowReports{}
+	client := NewHTTPClient(1000, WithClock(clock))
+	client.SetSlowRequestHook(time.Millisecond, 0, reports.hook)
+	client.SetSlowRequestHook(time.Millisecond, 0, nil)
+	client.Get(server.URL+"/slow", http.Header{})
+
+	assert.Empty(t, reports.all())
+}
+
+func TestDerivedClientCapsSlowRequestsOnItsOwn(t *testing.T) {
+	clock := fakeclock.New(time.Date(2018, time.January, 19, 22, 0, 0, 0, time.UTC))
+	server := slowServer(clock)
+	defer server.Close()
+
+	reports := &slowReports{}
+	client := NewHTTPClient(1000, WithClock(clock))
+	client.SetSlowRequestHook(time.Millisecond, 1, reports.hook)
+	derived := client.Derive()
+
+	client.Get(server.URL+"/slow", http.Header{})
+	client.Get(server.URL+"/slow", http.Header{})
+	derived.Get(server.URL+"/slow", http.Header{})
+
+	assert.Len(t, reports.all(), 2)
+}
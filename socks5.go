@@ -0,0 +1,291 @@
+package heimdall
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SOCKS5Auth are the username and password a SOCKS5 proxy is authenticated
+// to with, as in RFC 1929
+type SOCKS5Auth struct {
+	User     string
+	Password string
+}
+
+// SOCKS5Option configures optional behaviour of WithSOCKS5Proxy
+type SOCKS5Option func(*socks5Proxy)
+
+// WithSOCKS5LocalResolution resolves the hosts of targets on the client, with
+// the resolver given with WithResolver, and asks the proxy for the resolved
+// address, so that private network blocking can check it. By default the
+// proxy resolves them.
+func WithSOCKS5LocalResolution() SOCKS5Option {
+	return func(p *socks5Proxy) {
+		p.resolveLocally = true
+	}
+}
+
+// WithSOCKS5Proxy sends every request through a connection opened by the
+// SOCKS5 proxy at addr, a host and port, such as the "ssh -D" of a bastion,
+// instead of through the proxy given with WithProxy or set in the
+// environment; SetProxyBypass exempts hosts from it. The proxy is
+// authenticated to with auth, if not nil. https targets get their TLS
+// handshake over the connection, end to end. Failures to set up the
+// connection are returned as *ErrProxyConnect. Unless
+// WithSOCKS5LocalResolution is given, the proxy resolves the host of the
+// target, and private network blocking cannot check the addresses it
+// resolves. The proxy is a setting of the transport, so clients made with
+// Derive keep that of the client they derive from.
+func WithSOCKS5Proxy(addr string, auth *SOCKS5Auth, opts ...SOCKS5Option) Option {
+	return func(options *clientOptions) {
+		proxy := &socks5Proxy{address: addr, auth: auth}
+		for _, opt := range opts {
+			opt(proxy)
+		}
+		options.proxy = proxy
+	}
+}
+
+const (
+	socks5Version = 0x05
+
+	socks5NoAuth       = 0x00
+	socks5PasswordAuth = 0x02
+	socks5NoAcceptable = 0xff
+
+	socks5Connect = 0x01
+
+	socks5IPv4   = 0x01
+	socks5Domain = 0x03
+	socks5IPv6   = 0x04
+)
+
+// socks5Replies are the messages of the reply codes of RFC 1928
+var socks5Replies = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+type socks5Proxy struct {
+	address        string
+	auth           *SOCKS5Auth
+	resolveLocally bool
+
+	// resolver and guard resolve and check targets with resolveLocally, set
+	// by newTransport with resolving
+	resolver *net.Resolver
+	guard    *hostGuard
+}
+
+// resolving returns a copy of p resolving targets with resolver and checking
+// them with guard
+func (p *socks5Proxy) resolving(resolver *net.Resolver, guard *hostGuard) *socks5Proxy {
+	resolving := *p
+	resolving.resolver, resolving.guard = resolver, guard
+
+	return &resolving
+}
+
+// dial opens a connection to target through the proxy, dialing the proxy
+// with dial
+func (p *socks5Proxy) dial(ctx context.Context, dial func(ctx context.Context, network, address string) (net.Conn, error), network, target string) (net.Conn, error) {
+	address := target
+	if p.resolveLocally {
+		resolved, err := p.resolve(ctx, network, target)
+		if err != nil {
+			return nil, err
+		}
+		address = resolved
+	}
+
+	conn, err := dial(ctx, network, p.address)
+	if err != nil {
+		return nil, &ErrProxyConnect{Proxy: p.address, Target: target, err: err}
+	}
+	if err := p.connect(ctx, conn, address); err != nil {
+		conn.Close()
+		return nil, &ErrProxyConnect{Proxy: p.address, Target: target, err: err}
+	}
+
+	return conn, nil
+}
+
+// resolve returns target with its host resolved to an address of network,
+// failing for addresses private network blocking forbids
+func (p *socks5Proxy) resolve(ctx context.Context, network, target string) (string, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", &connectError{err: err}
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		resolver := p.resolver
+		if resolver == nil {
+			resolver = net.DefaultResolver
+		}
+		addrs, err := resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return "", &connectError{err: err}
+		}
+		for _, addr := range addrs {
+			if (network != "tcp4" || addr.IP.To4() != nil) && (network != "tcp6" || addr.IP.To4() == nil) {
+				ip = addr.IP
+				break
+			}
+		}
+		if ip == nil {
+			return "", &connectError{err: errors.Errorf("no %s address for %s", network, host)}
+		}
+	}
+
+	address := net.JoinHostPort(ip.String(), port)
+	if err := p.guard.control(network, address, nil); err != nil {
+		return "", err
+	}
+
+	return address, nil
+}
+
+// connect authenticates to the proxy over conn and asks it to connect to
+// target, as in RFC 1928
+func (p *socks5Proxy) connect(ctx context.Context, conn net.Conn, target string) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	request, err := socks5ConnectRequest(target)
+	if err != nil {
+		return err
+	}
+
+	method := byte(socks5NoAuth)
+	if p.auth != nil {
+		method = socks5PasswordAuth
+	}
+	if _, err := conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return errors.Errorf("unexpected SOCKS version %d", reply[0])
+	}
+	if reply[1] != method {
+		return errors.New("SOCKS5 proxy accepted none of the authentication methods offered")
+	}
+	if method == socks5PasswordAuth {
+		if err := p.authenticate(conn); err != nil {
+			return err
+		}
+	}
+
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	return socks5ReadReply(conn)
+}
+
+// authenticate sends the username and password of p over conn, as in RFC
+// 1929
+func (p *socks5Proxy) authenticate(conn net.Conn) error {
+	if len(p.auth.User) > 255 || len(p.auth.Password) > 255 {
+		return errors.New("SOCKS5 username or password longer than 255 bytes")
+	}
+
+	request := append([]byte{0x01, byte(len(p.auth.User))}, p.auth.User...)
+	request = append(append(request, byte(len(p.auth.Password))), p.auth.Password...)
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0x00 {
+		return errors.New("SOCKS5 proxy rejected the username and password")
+	}
+
+	return nil
+}
+
+// socks5ConnectRequest returns the CONNECT request for target
+func socks5ConnectRequest(target string) ([]byte, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	portNumber, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, errors.Errorf("invalid port %q", port)
+	}
+
+	request := []byte{socks5Version, socks5Connect, 0x00}
+	switch ip := net.ParseIP(host); {
+	case ip.To4() != nil:
+		request = append(append(request, socks5IPv4), ip.To4()...)
+	case ip != nil:
+		request = append(append(request, socks5IPv6), ip.To16()...)
+	case len(host) > 255:
+		return nil, errors.Errorf("host %q too long for SOCKS5", host)
+	default:
+		request = append(append(request, socks5Domain, byte(len(host))), host...)
+	}
+
+	return append(request, byte(portNumber>>8), byte(portNumber)), nil
+}
+
+// socks5ReadReply reads the reply of the proxy to a CONNECT request, failing
+// unless the connection succeeded
+func socks5ReadReply(conn net.Conn) error {
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return errors.Errorf("unexpected SOCKS version %d", reply[0])
+	}
+	if reply[1] != 0x00 {
+		message, ok := socks5Replies[reply[1]]
+		if !ok {
+			message = "reply " + strconv.Itoa(int(reply[1]))
+		}
+		return errors.Errorf("SOCKS5 proxy failed to connect: %s", message)
+	}
+
+	// The bound address is of no use, but has to be read past
+	var size int
+	switch reply[3] {
+	case socks5IPv4:
+		size = net.IPv4len
+	case socks5IPv6:
+		size = net.IPv6len
+	case socks5Domain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return err
+		}
+		size = int(length[0])
+	default:
+		return errors.Errorf("unexpected SOCKS5 address type %d", reply[3])
+	}
+	_, err := io.ReadFull(conn, make([]byte, size+2))
+
+	return err
+}
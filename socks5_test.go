@@ -0,0 +1,243 @@
+package heimdall
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// socks5Server is a SOCKS5 proxy serving CONNECT, asking for user and
+// password when user is set. It records the target of every CONNECT.
+type socks5Server struct {
+	listener       net.Listener
+	user, password string
+
+	mu      sync.Mutex
+	targets []string
+}
+
+func newSOCKS5Server(t *testing.T, user, password string) *socks5Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	proxy := &socks5Server{listener: listener, user: user, password: password}
+	go proxy.serve()
+	t.Cleanup(func() { listener.Close() })
+
+	return proxy
+}
+
+func (p *socks5Server) addr() string {
+	return p.listener.Addr().String()
+}
+
+func (p *socks5Server) serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		go p.handle(conn)
+	}
+}
+
+func (p *socks5Server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(conn, greeting); err != nil {
+		return
+	}
+	methods := make([]byte, greeting[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	method := byte(socks5NoAuth)
+	if p.user != "" {
+		method = socks5PasswordAuth
+	}
+	if !strings.Contains(string(methods), string([]byte{method})) {
+		conn.Write([]byte{socks5Version, socks5NoAcceptable})
+		return
+	}
+	conn.Write([]byte{socks5Version, method})
+
+	if method == socks5PasswordAuth {
+		user, password := p.readCredentials(conn)
+		if user != p.user || password != p.password {
+			conn.Write([]byte{0x01, 0x01})
+			return
+		}
+		conn.Write([]byte{0x01, 0x00})
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+	var host string
+	switch header[3] {
+	case socks5IPv4, socks5IPv6:
+		ip := make(net.IP, map[byte]int{socks5IPv4: net.IPv4len, socks5IPv6: net.IPv6len}[header[3]])
+		io.ReadFull(conn, ip)
+		host = ip.String()
+	case socks5Domain:
+		length := make([]byte, 1)
+		io.ReadFull(conn, length)
+		name := make([]byte, length[0])
+		io.ReadFull(conn, name)
+		host = string(name)
+	}
+	port := make([]byte, 2)
+	io.ReadFull(conn, port)
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+
+	p.mu.Lock()
+	p.targets = append(p.targets, target)
+	p.mu.Unlock()
+
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		conn.Write([]byte{socks5Version, 0x05, 0x00, socks5IPv4, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer upstream.Close()
+
+	conn.Write([]byte{socks5Version, 0x00, 0x00, socks5IPv4, 127, 0, 0, 1, 0, 0})
+	go io.Copy(upstream, conn)
+	io.Copy(conn, upstream)
+}
+
+func (p *socks5Server) readCredentials(conn net.Conn) (string, string) {
+	field := func() string {
+		length := make([]byte, 1)
+		io.ReadFull(conn, length)
+		value := make([]byte, length[0])
+		io.ReadFull(conn, value)
+		return string(value)
+	}
+
+	io.ReadFull(conn, make([]byte, 1))
+	return field(), field()
+}
+
+func (p *socks5Server) connects() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]string(nil), p.targets...)
+}
+
+// localhostURL returns the URL of server with the host name localhost, for
+// the proxy to resolve
+func localhostURL(server *httptest.Server) string {
+	return strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+}
+
+func TestSOCKS5ProxyResolvesTargets(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("through socks"))
+	}))
+	defer server.Close()
+	proxy := newSOCKS5Server(t, "bastion", "s3cret")
+
+	client := NewHTTPClient(1000, WithSOCKS5Proxy(proxy.addr(), &SOCKS5Auth{User: "bastion", Password: "s3cret"}))
+	response, err := client.Get(localhostURL(server)+"/users", http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, "through socks", string(response.Body()))
+
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	assert.Equal(t, []string{"localhost:" + port}, proxy.connects(), "the proxy resolves the host")
+}
+
+func TestSOCKS5ProxyCarriesTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	proxy := newSOCKS5Server(t, "", "")
+
+	client := NewHTTPClient(1000, WithSOCKS5Proxy(proxy.addr(), nil))
+	client.current.client.Transport.(*http.Transport).TLSClientConfig = server.Client().Transport.(*http.Transport).TLSClientConfig
+
+	response, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode())
+	assert.Equal(t, []string{server.Listener.Addr().String()}, proxy.connects())
+}
+
+func TestSOCKS5LocalResolution(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	proxy := newSOCKS5Server(t, "", "")
+
+	client := NewHTTPClient(1000, WithSOCKS5Proxy(proxy.addr(), nil, WithSOCKS5LocalResolution()), WithIPv4Only())
+	_, err := client.Get(localhostURL(server), http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{server.Listener.Addr().String()}, proxy.connects(), "the proxy is asked for the resolved address")
+
+	client.SetBlockPrivateNetworks(true)
+	_, err = client.Get(localhostURL(server), http.Header{})
+	var forbidden *ErrForbiddenHost
+	require.True(t, errors.As(err, &forbidden), "%v", err)
+	assert.Equal(t, "private network address", forbidden.Reason)
+
+	client.SetBlockPrivateNetworks(false)
+	client.SetAllowedHosts([]string{"*.example.com"})
+	_, err = client.Get(localhostURL(server), http.Header{})
+	require.True(t, errors.As(err, &forbidden), "%v", err)
+	assert.Len(t, proxy.connects(), 1, "forbidden hosts never reach the proxy")
+}
+
+func TestSOCKS5FailuresAreProxyConnectErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	proxy := newSOCKS5Server(t, "bastion", "s3cret")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closed := listener.Addr().String()
+	listener.Close()
+
+	for name, tc := range map[string]struct {
+		proxy, target string
+		auth          *SOCKS5Auth
+		message       string
+	}{
+		"wrong password":    {proxy: proxy.addr(), target: server.URL, auth: &SOCKS5Auth{User: "bastion", Password: "guess"}, message: "SOCKS5 proxy rejected the username and password"},
+		"no credentials":    {proxy: proxy.addr(), target: server.URL, message: "SOCKS5 proxy accepted none of the authentication methods offered"},
+		"target refused":    {proxy: proxy.addr(), target: "http://" + closed, auth: &SOCKS5Auth{User: "bastion", Password: "s3cret"}, message: "SOCKS5 proxy failed to connect: connection refused"},
+		"proxy unreachable": {proxy: closed, target: server.URL, message: "connection refused"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewHTTPClient(1000, WithSOCKS5Proxy(tc.proxy, tc.auth)).Get(tc.target, http.Header{})
+			require.Error(t, err)
+
+			var proxyErr *ErrProxyConnect
+			require.True(t, errors.As(err, &proxyErr), "%v", err)
+			assert.Equal(t, tc.proxy, proxyErr.Proxy)
+			assert.Contains(t, proxyErr.Error(), tc.message)
+			assert.False(t, errors.Is(err, ErrConnect), "the target is not to blame")
+		})
+	}
+}
+
+func TestSOCKS5ProxyBypass(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	proxy := newSOCKS5Server(t, "", "")
+
+	client := NewHTTPClient(1000, WithSOCKS5Proxy(proxy.addr(), nil))
+	require.NoError(t, client.SetProxyBypass([]string{"127.0.0.0/8"}))
+	_, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+	assert.Empty(t, proxy.connects())
+}
@@ -0,0 +1,376 @@
+package heimdall
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const sseContentType = "text/event-stream"
+
+// Event is a single server-sent event
+type Event struct {
+	ID   string
+	Type string
+	Data string
+	// Err is set on the last event of a stream ended by an error it does not
+	// reconnect from, such as an *ErrSSELineTooLong, which has no other field
+	// set
+	Err error
+}
+
+// ErrSSELineTooLong ends an event stream carrying a line longer than the
+// limit set with WithMaxSSELineSize. The stream is not resumed, since the
+// event would be lost again on every reconnect.
+type ErrSSELineTooLong struct {
+	Limit int
+}
+
+func (e *ErrSSELineTooLong) Error() string {
+	return fmt.Sprintf("SSE - line longer than %d bytes", e.Limit)
+}
+
+// Unwrap returns bufio.ErrTooLong
+func (e *ErrSSELineTooLong) Unwrap() error {
+	return bufio.ErrTooLong
+}
+
+// WithMaxSSELineSize sets the longest line, and so the longest single data
+// field, an event stream opened with GetSSE may carry, 64KB by default. A
+// longer line ends the stream with an *ErrSSELineTooLong.
+func WithMaxSSELineSize(bytes int) Option {
+	return func(options *clientOptions) {
+		options.sseMaxLineSize = bytes
+	}
+}
+
+type sseStream struct {
+	// settings are those of the client when the stream was opened. Its
+	// plugins, stats and slow request log observe every connect as a request
+	// ending once the response headers are in.
+	settings attemptSettings
+	doer     Doer
+	url      string
+	headers  http.Header
+	guard    *hostGuard
+	base     *baseURL
+	clock    Clock
+	maxLine  int
+
+	apdex       time.Duration
+	redactQuery bool
+
+	lastEventID    string
+	reconnectDelay time.Duration
+}
+
+// newSSEStream returns the stream at url of a client with settings and
+// options, connecting through the middlewares of the client without its
+// overall timeout
+func newSSEStream(url string, headers http.Header, settings attemptSettings, options clientOptions, guard *hostGuard, base *baseURL) *sseStream {
+	settings.client = streamingClient(settings.client)
+
+	return &sseStream{
+		settings:    settings,
+		doer:        buildDoer(options, settings),
+		url:         url,
+		headers:     headers,
+		guard:       guard,
+		base:        base,
+		clock:       options.clock,
+		maxLine:     options.sseMaxLineSize,
+		apdex:       options.apdex,
+		redactQuery: options.slowRedactQuery,
+	}
+}
+
+// streamingClient returns a copy of client without the overall timeout, as
+// event streams are expected to stay open until the caller cancels them
+func streamingClient(client *http.Client) *http.Client {
+	return &http.Client{
+		Transport:     client.Transport,
+		CheckRedirect: client.CheckRedirect,
+		Jar:           client.Jar,
+	}
+}
+
+// openSSE connects to an event stream and keeps it connected, reconnecting with
+// the retrier's backoff whenever the connection drops. The initial connection is
+// made synchronously so that its failure is reported to the caller.
+func openSSE(ctx context.Context, s *sseStream) (<-chan Event, func(), error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	body, err := s.connect(ctx)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	events := make(chan Event)
+	go s.run(ctx, body, events)
+
+	return events, cancel, nil
+}
+
+func (s *sseStream) connect(ctx context.Context) (io.ReadCloser, error) {
+	request, err := newRequest(http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.base != nil {
+		if request.URL, err = s.base.resolve(request.URL); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := checkRequestURL(request.URL); err != nil {
+		return nil, err
+	}
+
+	if s.guard != nil {
+		if err := s.guard.checkURL(request.URL); err != nil {
+			return nil, err
+		}
+	}
+
+	request = request.WithContext(withRequestTrace(ctx, s.clock))
+	request.Header = copyHeader(s.headers)
+	request.Header.Set("Accept", sseContentType)
+	request.Header.Set("Cache-Control", "no-cache")
+	if s.lastEventID != "" {
+		request.Header.Set("Last-Event-ID", s.lastEventID)
+	}
+
+	if request, err = prepareAttempt(request, 0, s.settings.requestMutators); err != nil {
+		return nil, err
+	}
+
+	response, err := s.send(request)
+	if err != nil {
+		return nil, err
+	}
+
+	return response.Body, nil
+}
+
+// send sends request, a connect of the stream, through the doer, reporting it
+// to the plugins, stats and slow request log of the client like its other
+// requests. The response is returned with its body unread.
+func (s *sseStream) send(request *http.Request) (*http.Response, error) {
+	s.settings.stats.begin()
+
+	began := s.clock.Now()
+	var response *http.Response
+	err := s.settings.plugins.start(request)
+	if err == nil {
+		response, err = s.doer.Do(request)
+	}
+	observed := Response{requestID: RequestIDFromContext(request.Context())}
+	if err == nil {
+		observed.statusCode, observed.headers, observed.finalURL = response.StatusCode, response.Header, responseURL(response, request)
+		err = checkSSEResponse(response)
+	}
+	now := s.clock.Now()
+	err = s.settings.slow.observe(request, observed, err, now.Sub(began), now, s.redactQuery)
+	err = s.settings.deprecations.observe(request, observed, err, now, s.settings.expvar)
+	err = s.settings.plugins.end(request, observed, err)
+	s.settings.stats.end(observed, err, now.Sub(began), s.apdex, now)
+
+	if err != nil {
+		if response != nil {
+			response.Body.Close()
+		}
+		return nil, err
+	}
+
+	return response, nil
+}
+
+// checkSSEResponse fails the connect of a stream answered with response
+// unless it is an event stream
+func checkSSEResponse(response *http.Response) error {
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("SSE - unexpected status code: %d", response.StatusCode)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if mediaType != sseContentType {
+		return fmt.Errorf("SSE - unexpected content type: %q", response.Header.Get("Content-Type"))
+	}
+
+	return nil
+}
+
+func (s *sseStream) run(ctx context.Context, body io.ReadCloser, events chan<- Event) {
+	defer close(events)
+
+	for {
+		err := s.read(ctx, body, events)
+		body.Close()
+		if _, tooLong := err.(*ErrSSELineTooLong); tooLong {
+			select {
+			case events <- Event{Err: err}:
+			case <-ctx.Done():
+			}
+			return
+		}
+
+		body, err = s.reconnect(ctx)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *sseStream) reconnect(ctx context.Context) (io.ReadCloser, error) {
+	retrier := requestRetrier(s.settings.retrier)
+	for attempt := 1; attempt <= s.settings.retryCount+1; attempt++ {
+		backoff := retrier.NextInterval(attempt)
+		if s.reconnectDelay > 0 {
+			backoff = s.reconnectDelay
+		}
+
+		wait, stop := s.clock.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			stop()
+			return nil, ctx.Err()
+		case <-wait:
+		}
+
+		body, err := s.connect(ctx)
+		if err == nil {
+			return body, nil
+		}
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+
+	return nil, errors.New("SSE - reconnection attempts exhausted")
+}
+
+// read parses the stream as described in the SSE specification, dispatching
+// events until the connection ends or the context is cancelled. It returns
+// the error the connection ended with, nil at the end of the stream.
+func (s *sseStream) read(ctx context.Context, body io.Reader, events chan<- Event) error {
+	maxLine := s.maxLine
+	if maxLine <= 0 {
+		maxLine = bufio.MaxScanTokenSize
+	}
+	initial := 4096
+	if maxLine < initial {
+		initial = maxLine
+	}
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, initial), maxLine)
+	scanner.Split(scanSSELines)
+
+	var eventType string
+	var data bytes.Buffer
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if line == "" {
+			if data.Len() == 0 {
+				eventType = ""
+				continue
+			}
+
+			event := Event{
+				ID:   s.lastEventID,
+				Type: eventType,
+				Data: strings.TrimSuffix(data.String(), "\n"),
+			}
+			if event.Type == "" {
+				event.Type = "message"
+			}
+
+			eventType = ""
+			data.Reset()
+
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			continue
+		}
+
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+
+		field, value := line, ""
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+
+		switch field {
+		case "event":
+			eventType = value
+		case "data":
+			data.WriteString(value)
+			data.WriteByte('\n')
+		case "id":
+			if !strings.ContainsRune(value, 0) {
+				s.lastEventID = value
+			}
+		case "retry":
+			if millis, err := strconv.ParseUint(value, 10, 64); err == nil {
+				s.reconnectDelay = time.Duration(millis) * time.Millisecond
+			}
+		}
+	}
+	if scanner.Err() == bufio.ErrTooLong {
+		return &ErrSSELineTooLong{Limit: maxLine}
+	}
+
+	return scanner.Err()
+}
+
+// scanSSELines splits on CRLF, LF or a lone CR, as all three are valid line
+// endings in an event stream
+func scanSSELines(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		if data[i] == '\n' {
+			return i + 1, data[:i], nil
+		}
+
+		if i+1 < len(data) {
+			if data[i+1] == '\n' {
+				return i + 2, data[:i], nil
+			}
+			return i + 1, data[:i], nil
+		}
+
+		if atEOF {
+			return i + 1, data[:i], nil
+		}
+
+		// A trailing CR may be followed by LF in the next read
+		return 0, nil, nil
+	}
+
+	if atEOF {
+		return len(data), data, nil
+	}
+
+	return 0, nil, nil
+}
@@ -0,0 +1,265 @@
+package heimdall
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sseTestServer(t *testing.T) (*httptest.Server, *[]string) {
+	var mu sync.Mutex
+	var lastEventIDs []string
+	connections := 0
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "text/event-stream", r.Header.Get("Accept"))
+		assert.Equal(t, "secret", r.Header.Get("Authorization"))
+
+		mu.Lock()
+		connections++
+		connection := connections
+		lastEventIDs = append(lastEventIDs, r.Header.Get("Last-Event-ID"))
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		flusher := w.(http.Flusher)
+
+		if connection == 1 {
+			fmt.Fprint(w, ": keep-alive comment\n\n")
+			fmt.Fprint(w, "id: 1\ndata: first line\ndata: second line\n\n")
+			fmt.Fprint(w, "id: 2\nevent: update\ndata:{\"a\":1}\n\n")
+			flusher.Flush()
+			return
+		}
+
+		fmt.Fprint(w, "id: 3\nevent: update\ndata: resumed\n\n")
+		flusher.Flush()
+		<-r.Context().Done()
+	}
+
+	return httptest.NewServer(http.HandlerFunc(handler)), &lastEventIDs
+}
+
+func receiveEvent(t *testing.T, events <-chan Event) Event {
+	select {
+	case event, ok := <-events:
+		require.True(t, ok, "events channel closed unexpectedly")
+		return event
+	case <-time.After(time.Second):
+		require.FailNow(t, "timed out waiting for event")
+	}
+
+	return Event{}
+}
+
+func testGetSSEReconnects(t *testing.T, client testClient) {
+	server, lastEventIDs := sseTestServer(t)
+	defer server.Close()
+
+	client.SetRetryCount(2)
+	client.SetRetrier(NewRetrier(NewConstantBackoff(1)))
+
+	headers := http.Header{}
+	headers.Set("Authorization", "secret")
+
+	events, cancel, err := client.GetSSE(context.Background(), server.URL, headers)
+	require.NoError(t, err)
+
+	assert.Equal(t, Event{ID: "1", Type: "message", Data: "first line\nsecond line"}, receiveEvent(t, events))
+	assert.Equal(t, Event{ID: "2", Type: "update", Data: `{"a":1}`}, receiveEvent(t, events))
+	assert.Equal(t, Event{ID: "3", Type: "update", Data: "resumed"}, receiveEvent(t, events))
+
+	cancel()
+
+	select {
+	case _, ok := <-events:
+		assert.False(t, ok, "events channel should be closed after cancel")
+	case <-time.After(time.Second):
+		assert.Fail(t, "events channel was not closed after cancel")
+	}
+
+	assert.Equal(t, []string{"", "2"}, *lastEventIDs)
+}
+
+func TestHTTPClientGetSSEReconnectsWithLastEventID(t *testing.T) {
+	testGetSSEReconnects(t, NewHTTPClient(10))
+}
+
+func TestHystrixHTTPClientGetSSEReconnectsWithLastEventID(t *testing.T) {
+	client := NewHystrixHTTPClient(10, NewHystrixConfig("sse_command", HystrixCommandConfig{}))
+
+	testGetSSEReconnects(t, client)
+}
+
+func TestGetSSEConnectsAreObservedLikeRequests(t *testing.T) {
+	for kind, newClient := range retryClients {
+		t.Run(kind, func(t *testing.T) {
+			server, _ := sseTestServer(t)
+			defer server.Close()
+
+			client := newClient(t.Name(), realClock{})
+			client.SetRetryCount(2)
+			client.SetRetrier(NewRetrier(NewConstantBackoff(1)))
+			plugin := &recordingPlugin{}
+			addPlugin(client, plugin)
+			var sent int32
+			client.Use(func(next Doer) Doer {
+				return DoerFunc(func(request *http.Request) (*http.Response, error) {
+					atomic.AddInt32(&sent, 1)
+					return next.Do(request)
+				})
+			})
+
+			headers := http.Header{}
+			headers.Set("Authorization", "secret")
+			events, cancel, err := client.GetSSE(context.Background(), server.URL, headers)
+			require.NoError(t, err)
+			for i := 0; i < 3; i++ {
+				receiveEvent(t, events)
+			}
+			cancel()
+
+			hooks, _ := plugin.recorded()
+			assert.Equal(t, []string{"start", "end", "start", "end"}, hooks, "the connect and the reconnect reach the plugins")
+			assert.Equal(t, int32(2), atomic.LoadInt32(&sent), "connects go through the middlewares")
+			stats := client.(interface{ Stats() ClientStats }).Stats()
+			assert.Equal(t, int64(2), stats.Requests)
+			assert.Equal(t, int64(2), stats.Successes)
+
+			server.Close()
+			_, _, err = client.GetSSE(context.Background(), server.URL, headers)
+			require.Error(t, err)
+			hooks, errs := plugin.recorded()
+			assert.Equal(t, []string{"start", "end", "start", "end", "start", "error"}, hooks)
+			require.Len(t, errs, 1)
+			assert.Equal(t, err, errs[0])
+		})
+	}
+}
+
+func TestGetSSEClosesStreamWhenContextIsCancelled(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events, _, err := NewHTTPClient(10).GetSSE(ctx, server.URL, nil)
+	require.NoError(t, err)
+
+	cancel()
+
+	select {
+	case _, ok := <-events:
+		assert.False(t, ok)
+	case <-time.After(time.Second):
+		assert.Fail(t, "events channel was not closed after context cancellation")
+	}
+}
+
+func TestGetSSEReturnsErrorOnUnexpectedStatus(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	_, _, err := NewHTTPClient(10).GetSSE(context.Background(), server.URL, nil)
+	require.Error(t, err)
+
+	assert.Equal(t, "SSE - unexpected status code: 401", err.Error())
+}
+
+func TestSSEParsingFollowsSpec(t *testing.T) {
+	stream := "retry: 1500\r\n" +
+		"data\r\n\r\n" +
+		":comment\rdata: cr line\r\r" +
+		"id: 7\nevent: custom\ndata:  leading space\ndata\n\n" +
+		"data: no id change\n\n" +
+		"event: ignored\n\n" +
+		"data: incomplete"
+
+	events := make(chan Event, 10)
+	s := &sseStream{}
+	s.read(context.Background(), strings.NewReader(stream), events)
+	close(events)
+
+	var received []Event
+	for event := range events {
+		received = append(received, event)
+	}
+
+	assert.Equal(t, []Event{
+		{Type: "message", Data: ""},
+		{Type: "message", Data: "cr line"},
+		{ID: "7", Type: "custom", Data: " leading space\n"},
+		{ID: "7", Type: "message", Data: "no id change"},
+	}, received)
+	assert.Equal(t, 1500*time.Millisecond, s.reconnectDelay)
+}
+
+func TestGetSSEEndsStreamOnOversizedLine(t *testing.T) {
+	var connections int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&connections, 1)
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "id: 1\ndata: small\n\n")
+		fmt.Fprint(w, "id: 2\ndata: "+strings.Repeat("x", 100)+"\n\n")
+		fmt.Fprint(w, "id: 3\ndata: after\n\n")
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(1000, WithMaxSSELineSize(64))
+	client.SetRetryCount(3)
+	events, cancel, err := client.GetSSE(context.Background(), server.URL, nil)
+	require.NoError(t, err)
+	defer cancel()
+
+	assert.Equal(t, Event{ID: "1", Type: "message", Data: "small"}, receiveEvent(t, events))
+
+	ended := receiveEvent(t, events)
+	var tooLong *ErrSSELineTooLong
+	require.True(t, errors.As(ended.Err, &tooLong), "%v", ended.Err)
+	assert.Equal(t, 64, tooLong.Limit)
+	assert.True(t, errors.Is(ended.Err, bufio.ErrTooLong))
+	assert.Empty(t, ended.Data)
+
+	select {
+	case _, ok := <-events:
+		assert.False(t, ok, "no event follows the error")
+	case <-time.After(time.Second):
+		require.FailNow(t, "events channel was not closed")
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&connections), "the stream is not resumed past the oversized line")
+}
+
+func TestSSEDefaultLineLimit(t *testing.T) {
+	events := make(chan Event, 10)
+	s := &sseStream{}
+	err := s.read(context.Background(), strings.NewReader("data: "+strings.Repeat("x", bufio.MaxScanTokenSize)+"\n\n"), events)
+	assert.Equal(t, &ErrSSELineTooLong{Limit: bufio.MaxScanTokenSize}, err)
+	assert.Empty(t, events)
+
+	big := strings.Repeat("x", bufio.MaxScanTokenSize)
+	s = &sseStream{maxLine: 2 * bufio.MaxScanTokenSize}
+	require.NoError(t, s.read(context.Background(), strings.NewReader("data: "+big+"\n\n"), events))
+	assert.Equal(t, big, (<-events).Data, "lines up to the configured limit are read whole")
+}
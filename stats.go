@@ -0,0 +1,256 @@
+package heimdall
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Circuit states reported in ClientStats.Circuit
+const (
+	CircuitClosed = "closed"
+	CircuitOpen   = "open"
+)
+
+// ClientStats is a point-in-time view of the requests made by a client since
+// it was created or its stats were last reset, for rendering on admin and
+// debug endpoints. It marshals to JSON as it is.
+type ClientStats struct {
+	// Name is the name given to the client with WithName
+	Name string `json:"name,omitempty"`
+	// Since is when counting started
+	Since time.Time `json:"since"`
+
+	// Requests is the number of requests that completed, successfully or not
+	Requests  int64 `json:"requests"`
+	Successes int64 `json:"successes"`
+	Failures  int64 `json:"failures"`
+	// SuccessRate is Successes over Requests, 1 before any request completed
+	SuccessRate float64 `json:"success_rate"`
+	// Attempts counts the attempts sent, Retries those after the first
+	Attempts int64 `json:"attempts"`
+	Retries  int64 `json:"retries"`
+
+	// InFlight is the number of requests in progress, which a reset keeps
+	InFlight int64 `json:"in_flight"`
+	// ConcurrencyLimit is the adaptive concurrency limit, or the maximum
+	// concurrent requests of the hystrix command, zero when unlimited
+	ConcurrencyLimit int `json:"concurrency_limit,omitempty"`
+	// Circuit is CircuitClosed or CircuitOpen for hystrix clients, empty for
+	// clients without a circuit breaker
+	Circuit string `json:"circuit,omitempty"`
+
+	// LastError is the message of the latest failed request
+	LastError   string    `json:"last_error,omitempty"`
+	LastErrorAt time.Time `json:"last_error_at"`
+
+	// RetryCount and Backoff are the retry settings requests start with now.
+	// Backoff is nil for clients that do not wait between retries and for
+	// custom retriers and backoffs.
+	RetryCount int            `json:"retry_count"`
+	Backoff    *BackoffConfig `json:"backoff,omitempty"`
+
+	// Connections describe how attempts got their connections
+	Connections ConnectionStats `json:"connections"`
+
+	// Outcomes counts the requests by outcome, such as OutcomeServerError,
+	// leaving out outcomes no request had
+	Outcomes map[string]int64 `json:"outcomes,omitempty"`
+	// Apdex scores the requests when WithApdex is given
+	Apdex *ApdexStats `json:"apdex,omitempty"`
+	// Hedges count the hedged attempts when WithHedging is given
+	Hedges *HedgeStats `json:"hedges,omitempty"`
+	// Queue describes the attempts that waited for the adaptive concurrency
+	// limit when WithConcurrencyQueue is given
+	Queue *QueueStats `json:"queue,omitempty"`
+	// FaultsInjected counts the faults injected into attempts by a
+	// NewFaultInjectingClient by effect, such as FaultStatus
+	FaultsInjected map[string]int64 `json:"faults_injected,omitempty"`
+	// Tenants are the attempts sent on behalf of each tenant, see
+	// SetTenantLimits
+	Tenants map[string]TenantStats `json:"tenants,omitempty"`
+	// BodyBytesInFlight are the bytes of the request bodies counted against
+	// SetMaxInFlightBodyBytes
+	BodyBytesInFlight int64 `json:"body_bytes_in_flight,omitempty"`
+	// ShutdownDrained and ShutdownAborted count the requests in flight when
+	// Shutdown was called that finished and that it cut short
+	ShutdownDrained int64 `json:"shutdown_drained,omitempty"`
+	ShutdownAborted int64 `json:"shutdown_aborted,omitempty"`
+}
+
+// clientStats are the counters behind ClientStats. They are only updated and
+// read atomically, so counting costs requests no locks.
+type clientStats struct {
+	requests  int64
+	successes int64
+	failures  int64
+	attempts  int64
+	retries   int64
+	inFlight  int64
+
+	connections *connectionStats
+	outcomes    [len(outcomes)]int64
+	apdex       apdexCounts
+	hedges      hedgeCounts
+	queue       *queueCounts
+	faults      [len(faultEffects)]int64
+
+	since     atomic.Value // time.Time
+	lastError atomic.Value // statsError
+}
+
+type statsError struct {
+	message string
+	at      time.Time
+}
+
+func newClientStats(now time.Time) *clientStats {
+	stats := &clientStats{connections: newConnectionStats(), queue: newQueueCounts()}
+	stats.reset(now)
+
+	return stats
+}
+
+// begin counts a request in progress
+func (s *clientStats) begin() {
+	atomic.AddInt64(&s.inFlight, 1)
+}
+
+// end counts the outcome of a request counted by begin, which took elapsed
+// and is scored against apdex when set
+func (s *clientStats) end(response Response, err error, elapsed, apdex time.Duration, now time.Time) {
+	atomic.AddInt64(&s.inFlight, -1)
+	atomic.AddInt64(&s.requests, 1)
+	atomic.AddInt64(&s.outcomes[requestOutcome(response, err)], 1)
+	if apdex > 0 {
+		s.apdex.observe(apdex, elapsed, err)
+	}
+	if err == nil {
+		atomic.AddInt64(&s.successes, 1)
+		return
+	}
+
+	atomic.AddInt64(&s.failures, 1)
+	s.lastError.Store(statsError{message: err.Error(), at: now})
+}
+
+// attempt counts attempt number attempt of a request being sent
+func (s *clientStats) attempt(attempt int) {
+	if s == nil {
+		return
+	}
+
+	atomic.AddInt64(&s.attempts, 1)
+	if attempt > 0 {
+		atomic.AddInt64(&s.retries, 1)
+	}
+}
+
+// reset zeroes the counters, but for the requests in progress
+func (s *clientStats) reset(now time.Time) {
+	atomic.StoreInt64(&s.requests, 0)
+	atomic.StoreInt64(&s.successes, 0)
+	atomic.StoreInt64(&s.failures, 0)
+	atomic.StoreInt64(&s.attempts, 0)
+	atomic.StoreInt64(&s.retries, 0)
+	s.connections.reset()
+	for i := range s.outcomes {
+		atomic.StoreInt64(&s.outcomes[i], 0)
+	}
+	s.apdex.reset()
+	s.hedges.reset()
+	s.queue.reset()
+	for i := range s.faults {
+		atomic.StoreInt64(&s.faults[i], 0)
+	}
+	s.lastError.Store(statsError{})
+	s.since.Store(now)
+}
+
+// snapshot returns the counters. They are read one by one, so a snapshot
+// taken under traffic may count a request in one counter and not yet in
+// another.
+func (s *clientStats) snapshot(settings attemptSettings, options clientOptions) ClientStats {
+	lastError := s.lastError.Load().(statsError)
+	stats := ClientStats{
+		Name:        options.name,
+		Since:       s.since.Load().(time.Time),
+		Requests:    atomic.LoadInt64(&s.requests),
+		Successes:   atomic.LoadInt64(&s.successes),
+		Failures:    atomic.LoadInt64(&s.failures),
+		Attempts:    atomic.LoadInt64(&s.attempts),
+		Retries:     atomic.LoadInt64(&s.retries),
+		InFlight:    atomic.LoadInt64(&s.inFlight),
+		LastError:   lastError.message,
+		LastErrorAt: lastError.at,
+		RetryCount:  settings.retryCount,
+		Backoff:     retrierBackoffConfig(settings.retrier),
+		Connections: s.connections.snapshot(options.pool),
+	}
+
+	stats.SuccessRate = 1
+	if stats.Requests > 0 {
+		stats.SuccessRate = float64(stats.Successes) / float64(stats.Requests)
+	}
+	if options.concurrency != nil {
+		stats.ConcurrencyLimit, _ = options.concurrency.snapshot()
+	}
+	for i, outcome := range outcomes {
+		if count := atomic.LoadInt64(&s.outcomes[i]); count > 0 {
+			if stats.Outcomes == nil {
+				stats.Outcomes = map[string]int64{}
+			}
+			stats.Outcomes[outcome] = count
+		}
+	}
+	if options.apdex > 0 {
+		stats.Apdex = s.apdex.snapshot(options.apdex)
+	}
+	if options.hedging != nil {
+		stats.Hedges = s.hedges.snapshot(options.hedging.delay)
+	}
+	if options.queue != nil && options.concurrency != nil {
+		stats.Queue = s.queue.snapshot(options.concurrency.queueDepth())
+	}
+	for i, effect := range faultEffects {
+		if count := atomic.LoadInt64(&s.faults[i]); count > 0 {
+			if stats.FaultsInjected == nil {
+				stats.FaultsInjected = map[string]int64{}
+			}
+			stats.FaultsInjected[effect] = count
+		}
+	}
+
+	return stats
+}
+
+// retrierBackoffConfig describes the backoff of retrier as configuration
+func retrierBackoffConfig(r Retriable) *BackoffConfig {
+	if rejection, ok := r.(*rejectionRetrier); ok {
+		r = rejection.Retriable
+	}
+
+	configured, ok := r.(*retrier)
+	if !ok {
+		return nil
+	}
+
+	switch backoff := configured.backoff.(type) {
+	case *constantBackoff:
+		return &BackoffConfig{Type: BackoffConstant, Interval: Duration(time.Duration(backoff.backoffInterval) * time.Millisecond)}
+	case *exponentialBackoff:
+		return &BackoffConfig{
+			Type:        BackoffExponential,
+			Interval:    Duration(time.Duration(backoff.initialTimeout) * time.Millisecond),
+			MaxInterval: Duration(time.Duration(backoff.maxTimeout) * time.Millisecond),
+			Factor:      backoff.exponentFactor,
+		}
+	case *linearBackoff:
+		return &BackoffConfig{Type: BackoffLinear, Interval: Duration(backoff.step), MaxInterval: Duration(backoff.maxInterval), Jitter: backoff.options.jitter}
+	case *fibonacciBackoff:
+		return &BackoffConfig{Type: BackoffFibonacci, Interval: Duration(backoff.baseInterval), MaxInterval: Duration(backoff.maxInterval), Jitter: backoff.options.jitter}
+	case *decorrelatedJitterBackoff:
+		return &BackoffConfig{Type: BackoffDecorrelatedJitter, Interval: Duration(backoff.baseInterval), MaxInterval: Duration(backoff.maxInterval)}
+	}
+
+	return nil
+}
@@ -0,0 +1,217 @@
+package heimdall
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gojektech/heimdall/fakeclock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// statsServer fails requests to paths starting with /fail
+func statsServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/fail") {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+}
+
+func TestClientsCountStats(t *testing.T) {
+	for kind, newClient := range retryClients {
+		t.Run(kind, func(t *testing.T) {
+			server := statsServer()
+			defer server.Close()
+
+			start := time.Date(2018, time.January, 19, 22, 0, 0, 0, time.UTC)
+			clock := fakeclock.New(start)
+			client := newClient("stats_"+kind, clock)
+			client.SetRetryCount(2)
+			client.SetRetrier(NewRetrier(NewConstantBackoff(5)))
+
+			for _, path := range []string{"/ok", "/fail", "/ok", "/fail", "/ok"} {
+				client.Get(server.URL+path, http.Header{})
+			}
+
+			stats := client.Stats()
+			assert.Equal(t, start, stats.Since)
+			assert.Equal(t, int64(5), stats.Requests)
+			assert.Equal(t, int64(3), stats.Successes)
+			assert.Equal(t, int64(2), stats.Failures)
+			assert.Equal(t, 0.6, stats.SuccessRate)
+			assert.Equal(t, int64(9), stats.Attempts)
+			assert.Equal(t, int64(4), stats.Retries)
+			assert.Equal(t, int64(0), stats.InFlight)
+			assert.Contains(t, stats.LastError, "500")
+			assert.Equal(t, start.Add(10*time.Millisecond), stats.LastErrorAt, "each failed request waits 0 and 5ms")
+			assert.Equal(t, 2, stats.RetryCount)
+			assert.Equal(t, &BackoffConfig{Type: BackoffConstant, Interval: Duration(5 * time.Millisecond)}, stats.Backoff)
+
+			if kind == "hystrix" {
+				assert.Equal(t, CircuitClosed, stats.Circuit)
+				assert.Equal(t, 10, stats.ConcurrencyLimit)
+			} else {
+				assert.Equal(t, "", stats.Circuit)
+				assert.Equal(t, 0, stats.ConcurrencyLimit)
+			}
+		})
+	}
+}
+
+func TestClientsResetStats(t *testing.T) {
+	for kind, newClient := range retryClients {
+		t.Run(kind, func(t *testing.T) {
+			server := statsServer()
+			defer server.Close()
+
+			clock := fakeclock.New(time.Now())
+			client := newClient("stats_reset_"+kind, clock)
+			client.Get(server.URL+"/fail", http.Header{})
+
+			clock.Advance(time.Minute)
+			client.ResetStats()
+
+			stats := client.Stats()
+			assert.Equal(t, clock.Now(), stats.Since)
+			assert.Equal(t, int64(0), stats.Requests)
+			assert.Equal(t, int64(0), stats.Failures)
+			assert.Equal(t, int64(0), stats.Attempts)
+			assert.Equal(t, 1.0, stats.SuccessRate)
+			assert.Equal(t, "", stats.LastError)
+			assert.True(t, stats.LastErrorAt.IsZero())
+
+			client.Get(server.URL+"/ok", http.Header{})
+			assert.Equal(t, int64(1), client.Stats().Successes)
+		})
+	}
+}
+
+func TestHystrixStatsReportOpenCircuit(t *testing.T) {
+	server := statsServer()
+	defer server.Close()
+
+	client := NewHystrixHTTPClient(1000, openOnFirstFailure("stats_open_circuit_command"))
+	tripCircuit(t, client, server.URL+"/fail")
+
+	assert.Equal(t, CircuitOpen, client.Stats().Circuit)
+}
+
+func TestStatsReportAdaptiveConcurrencyLimit(t *testing.T) {
+	client := NewHTTPClient(1000, WithAdaptiveConcurrency(8, 2, 32))
+
+	assert.Equal(t, 8, client.Stats().ConcurrencyLimit)
+}
+
+func TestDerivedClientCountsStatsOnItsOwn(t *testing.T) {
+	server := statsServer()
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+	derived := client.Derive()
+	derived.Get(server.URL, http.Header{})
+
+	assert.Equal(t, int64(0), client.Stats().Requests)
+	assert.Equal(t, int64(1), derived.Stats().Requests)
+}
+
+func TestStatsMarshalToJSON(t *testing.T) {
+	server := statsServer()
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+	client.SetRetrier(NewRetrier(NewExponentialBackoff(2*time.Millisecond, time.Second, 2)))
+	client.Get(server.URL+"/fail", http.Header{})
+
+	data, err := json.Marshal(client.Stats())
+	require.NoError(t, err)
+
+	var decoded map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, float64(1), decoded["failures"])
+	assert.Equal(t, float64(0), decoded["success_rate"])
+	assert.Equal(t, map[string]interface{}{"type": "exponential", "interval": "2ms", "max_interval": "1s", "factor": float64(2)}, decoded["backoff"])
+}
+
+func TestStatsUnderConcurrentTraffic(t *testing.T) {
+	for kind, newClient := range retryClients {
+		t.Run(kind, func(t *testing.T) {
+			server := statsServer()
+			defer server.Close()
+
+			client := newClient("stats_race_"+kind, realClock{})
+			client.SetRetryCount(1)
+
+			var wg sync.WaitGroup
+			done := make(chan struct{})
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					for j := 0; j < 10; j++ {
+						path := "/ok"
+						if (i+j)%2 == 0 {
+							path = "/fail"
+						}
+						client.Get(server.URL+path, http.Header{})
+					}
+				}(i)
+			}
+
+			go func() {
+				wg.Wait()
+				close(done)
+			}()
+
+			for polling := true; polling; {
+				select {
+				case <-done:
+					polling = false
+				default:
+					stats := client.Stats()
+					assert.True(t, stats.Successes+stats.Failures <= 40)
+				}
+			}
+
+			stats := client.Stats()
+			assert.Equal(t, int64(40), stats.Requests)
+			assert.Equal(t, int64(20), stats.Successes)
+			assert.Equal(t, int64(20), stats.Failures)
+			assert.Equal(t, int64(60), stats.Attempts)
+			assert.Equal(t, int64(0), stats.InFlight)
+		})
+	}
+}
+
+func TestRetrierBackoffConfig(t *testing.T) {
+	cases := map[string]struct {
+		retrier Retriable
+		config  *BackoffConfig
+	}{
+		"none":   {NewNoRetrier(), nil},
+		"custom": {NewRetrier(panickingBackoff{}), nil},
+		"linear": {
+			NewRetrier(NewLinearBackoff(10*time.Millisecond, time.Second, WithBackoffJitter(0.2))),
+			&BackoffConfig{Type: BackoffLinear, Interval: Duration(10 * time.Millisecond), MaxInterval: Duration(time.Second), Jitter: 0.2},
+		},
+		"fibonacci": {
+			NewRetrier(NewFibonacciBackoff(10*time.Millisecond, time.Second)),
+			&BackoffConfig{Type: BackoffFibonacci, Interval: Duration(10 * time.Millisecond), MaxInterval: Duration(time.Second)},
+		},
+		"decorrelated_jitter_rejections": {
+			NewRejectionRetrier(NewRetrier(NewDecorrelatedJitterBackoff(10*time.Millisecond, time.Second))),
+			&BackoffConfig{Type: BackoffDecorrelatedJitter, Interval: Duration(10 * time.Millisecond), MaxInterval: Duration(time.Second)},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.config, retrierBackoffConfig(tc.retrier))
+		})
+	}
+}
@@ -0,0 +1,266 @@
+package heimdall
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gojektech/heimdall/fakeclock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCA issues the certificates of a mutual TLS test
+type testCA struct {
+	t    *testing.T
+	key  *ecdsa.PrivateKey
+	cert *x509.Certificate
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "heimdall test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return &testCA{t: t, key: key, cert: cert, pool: pool}
+}
+
+// issue returns a certificate with serial for usage signed by the CA
+func (ca *testCA) issue(serial int64, usage x509.ExtKeyUsage) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(ca.t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "heimdall test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(ca.t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// clientTransport returns the transport of an http or hystrix client
+func clientTransport(client testClient) *http.Transport {
+	switch c := client.(type) {
+	case *HTTPClient:
+		return c.settings().client.Transport.(*http.Transport)
+	case *HystrixHTTPClient:
+		return c.settings().client.Transport.(*http.Transport)
+	}
+
+	return nil
+}
+
+// transport returns a clone of the transport of client presenting cert
+func (ca *testCA) transport(client testClient, cert tls.Certificate) *http.Transport {
+	rotated := clientTransport(client).Clone()
+	rotated.TLSClientConfig = &tls.Config{RootCAs: ca.pool, Certificates: []tls.Certificate{cert}}
+
+	return rotated
+}
+
+// mutualTLSServer only serves clients presenting a certificate with one of
+// the allowed serials
+type mutualTLSServer struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	allowed map[int64]bool
+	served  map[int64]int
+	opened  map[string]int64
+	closed  map[int64]int
+}
+
+func newMutualTLSServer(ca *testCA, serials ...int64) *mutualTLSServer {
+	s := &mutualTLSServer{served: map[int64]int{}, opened: map[string]int64{}, closed: map[int64]int{}}
+	s.allow(serials...)
+
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serial := r.TLS.PeerCertificates[0].SerialNumber.Int64()
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if !s.allowed[serial] {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		s.served[serial]++
+		s.opened[r.RemoteAddr] = serial
+	}))
+	s.Server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state != http.StateClosed {
+			return
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if serial, ok := s.opened[conn.RemoteAddr().String()]; ok {
+			s.closed[serial]++
+		}
+	}
+	s.Server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(100, x509.ExtKeyUsageServerAuth)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool,
+	}
+	s.StartTLS()
+
+	return s
+}
+
+// allow replaces the serials the server accepts
+func (s *mutualTLSServer) allow(serials ...int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.allowed = map[int64]bool{}
+	for _, serial := range serials {
+		s.allowed[serial] = true
+	}
+}
+
+func (s *mutualTLSServer) servedWith(serial int64) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.served[serial]
+}
+
+// openConnections returns the connections that served serial and are open
+func (s *mutualTLSServer) openConnections(serial int64) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	open := -s.closed[serial]
+	for _, opened := range s.opened {
+		if opened == serial {
+			open++
+		}
+	}
+
+	return open
+}
+
+// sendTraffic keeps workers sending requests through client until stop is
+// closed, counting the requests that did not succeed
+func sendTraffic(client testClient, url string, workers int, stop <-chan struct{}) (wait func() int64) {
+	var failed int64
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				response, err := client.Get(url, http.Header{})
+				if err != nil || response.StatusCode() != http.StatusOK {
+					atomic.AddInt64(&failed, 1)
+				}
+			}
+		}()
+	}
+
+	return func() int64 {
+		wg.Wait()
+		return atomic.LoadInt64(&failed)
+	}
+}
+
+func TestClientsRotateClientCertificateWithoutDroppingRequests(t *testing.T) {
+	for kind, newClient := range retryClients {
+		t.Run(kind, func(t *testing.T) {
+			ca := newTestCA(t)
+			current, next := ca.issue(2, x509.ExtKeyUsageClientAuth), ca.issue(3, x509.ExtKeyUsageClientAuth)
+
+			server := newMutualTLSServer(ca, 2)
+			defer server.Close()
+
+			client := newClient("swap_transport_"+kind, realClock{})
+			client.SwapTransport(ca.transport(client, current))
+
+			stop := make(chan struct{})
+			wait := sendTraffic(client, server.URL, 4, stop)
+			time.Sleep(50 * time.Millisecond)
+
+			server.allow(2, 3)
+			client.SwapTransport(ca.transport(client, next))
+			time.Sleep(50 * time.Millisecond)
+
+			close(stop)
+			require.Equal(t, int64(0), wait(), "no request should fail while rotating")
+
+			server.allow(3)
+			served := server.servedWith(3)
+			for i := 0; i < 10; i++ {
+				response, err := client.Get(server.URL, http.Header{})
+				require.NoError(t, err)
+				assert.Equal(t, http.StatusOK, response.StatusCode())
+			}
+
+			assert.Equal(t, served+10, server.servedWith(3), "requests after the swap should present the new certificate")
+			assert.True(t, server.servedWith(2) > 0)
+		})
+	}
+}
+
+func TestSwapTransportClosesIdleConnectionsAfterGrace(t *testing.T) {
+	ca := newTestCA(t)
+	current, next := ca.issue(2, x509.ExtKeyUsageClientAuth), ca.issue(3, x509.ExtKeyUsageClientAuth)
+
+	server := newMutualTLSServer(ca, 2, 3)
+	defer server.Close()
+
+	clock := fakeclock.New(time.Now())
+	client := NewHTTPClient(1000, WithClock(clock), WithKeepAlive())
+	client.SwapTransport(ca.transport(client, current))
+	_, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+	require.Equal(t, 1, server.openConnections(2))
+
+	timers := clock.Timers()
+	client.SwapTransport(ca.transport(client, next))
+	assert.Equal(t, timers+1, clock.Timers(), "the swap starts the grace period")
+	assert.Equal(t, 1, server.openConnections(2), "idle connections are kept during the grace period")
+
+	clock.Advance(time.Second)
+	assert.Eventually(t, func() bool { return server.openConnections(2) == 0 }, time.Second, 5*time.Millisecond)
+}
@@ -0,0 +1,206 @@
+package heimdall
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Limits of ErrTenantQuotaExceeded
+const (
+	// TenantConcurrencyLimit is exceeded by an attempt while the tenant has
+	// MaxConcurrent attempts running
+	TenantConcurrencyLimit = "concurrency"
+	// TenantRateLimit is exceeded by an attempt once the tenant has used up
+	// its RequestsPerSecond
+	TenantRateLimit = "rate"
+)
+
+// TenantLimits bound the attempts a client sends on behalf of one tenant.
+// Zero fields do not limit.
+type TenantLimits struct {
+	// MaxConcurrent is the number of attempts of the tenant that may run at
+	// once
+	MaxConcurrent int `json:"max_concurrent,omitempty"`
+	// RequestsPerSecond is the rate attempts of the tenant may start at, in
+	// bursts of up to Burst attempts, RequestsPerSecond rounded up when zero
+	RequestsPerSecond float64 `json:"requests_per_second,omitempty"`
+	Burst             int     `json:"burst,omitempty"`
+}
+
+// burst returns the size of the token bucket
+func (l TenantLimits) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+
+	return math.Max(1, math.Ceil(l.RequestsPerSecond))
+}
+
+// ErrTenantQuotaExceeded is returned, without sending the attempt, when the
+// tenant of a request is over its limits. It is the tenant, not the server,
+// that is over quota, so callers usually answer it with 429 Too Many
+// Requests.
+type ErrTenantQuotaExceeded struct {
+	Tenant string
+	// Limit is TenantConcurrencyLimit or TenantRateLimit
+	Limit string
+	// RetryAfter is when the rate limit lets an attempt through again, zero for
+	// the concurrency limit
+	RetryAfter time.Duration
+}
+
+func (e *ErrTenantQuotaExceeded) Error() string {
+	if e.Limit == TenantRateLimit {
+		return fmt.Sprintf("tenant %q exceeded its %s quota, retry after %v", e.Tenant, e.Limit, e.RetryAfter)
+	}
+
+	return fmt.Sprintf("tenant %q exceeded its %s quota", e.Tenant, e.Limit)
+}
+
+type tenantKey struct{}
+
+// ContextWithTenant returns a copy of ctx making the requests sent with it
+// count against the limits of tenant, set with SetTenantLimits
+func ContextWithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant set with ContextWithTenant, or "" for
+// requests sent on behalf of no tenant
+func TenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// TenantStats are the attempts sent on behalf of a tenant, in
+// ClientStats.Tenants
+type TenantStats struct {
+	// InFlight is the number of attempts of the tenant running
+	InFlight int `json:"in_flight"`
+	// Attempts counts the attempts let through, Rejected those failed with an
+	// *ErrTenantQuotaExceeded
+	Attempts int64 `json:"attempts"`
+	Rejected int64 `json:"rejected"`
+}
+
+// tenantQuotas hold the limits and usage of the tenants of a client
+type tenantQuotas struct {
+	mu        sync.Mutex
+	defaults  TenantLimits
+	overrides map[string]TenantLimits
+	tenants   map[string]*tenantUsage
+}
+
+type tenantUsage struct {
+	stats  TenantStats
+	tokens float64
+	filled time.Time
+}
+
+func newTenantQuotas() *tenantQuotas {
+	return &tenantQuotas{tenants: map[string]*tenantUsage{}}
+}
+
+// set replaces the limits, keeping the usage of the tenants
+func (q *tenantQuotas) set(defaults TenantLimits, overrides map[string]TenantLimits) {
+	copied := make(map[string]TenantLimits, len(overrides))
+	for tenant, limits := range overrides {
+		copied[tenant] = limits
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.defaults, q.overrides = defaults, copied
+}
+
+// clone returns quotas with the limits of q and no usage
+func (q *tenantQuotas) clone() *tenantQuotas {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return &tenantQuotas{defaults: q.defaults, overrides: q.overrides, tenants: map[string]*tenantUsage{}}
+}
+
+// acquire lets an attempt of tenant through at now, unless it is over its
+// limits. Attempts on behalf of no tenant are not limited. An attempt let
+// through is released with release once it is done.
+func (q *tenantQuotas) acquire(tenant string, now time.Time) error {
+	if q == nil || tenant == "" {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	limits, ok := q.overrides[tenant]
+	if !ok {
+		limits = q.defaults
+	}
+	usage := q.tenants[tenant]
+	if usage == nil {
+		usage = &tenantUsage{tokens: limits.burst(), filled: now}
+		q.tenants[tenant] = usage
+	}
+
+	if limits.MaxConcurrent > 0 && usage.stats.InFlight >= limits.MaxConcurrent {
+		usage.stats.Rejected++
+		return &ErrTenantQuotaExceeded{Tenant: tenant, Limit: TenantConcurrencyLimit}
+	}
+	if limits.RequestsPerSecond > 0 {
+		usage.tokens = math.Min(limits.burst(), usage.tokens+now.Sub(usage.filled).Seconds()*limits.RequestsPerSecond)
+		usage.filled = now
+		if usage.tokens < 1 {
+			usage.stats.Rejected++
+			retryAfter := time.Duration((1 - usage.tokens) / limits.RequestsPerSecond * float64(time.Second))
+			return &ErrTenantQuotaExceeded{Tenant: tenant, Limit: TenantRateLimit, RetryAfter: retryAfter}
+		}
+		usage.tokens--
+	}
+
+	usage.stats.InFlight++
+	usage.stats.Attempts++
+	return nil
+}
+
+// release ends an attempt of tenant let through by acquire
+func (q *tenantQuotas) release(tenant string) {
+	if q == nil || tenant == "" {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.tenants[tenant].stats.InFlight--
+}
+
+// snapshot returns the usage of the tenants, nil before any attempt was sent
+// on behalf of one
+func (q *tenantQuotas) snapshot() map[string]TenantStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.tenants) == 0 {
+		return nil
+	}
+	stats := make(map[string]TenantStats, len(q.tenants))
+	for tenant, usage := range q.tenants {
+		stats[tenant] = usage.stats
+	}
+
+	return stats
+}
+
+// reset zeroes the counts of the tenants, keeping the attempts in flight
+func (q *tenantQuotas) reset() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, usage := range q.tenants {
+		usage.stats.Attempts, usage.stats.Rejected = 0, 0
+	}
+}
@@ -0,0 +1,130 @@
+package heimdall
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gojektech/heimdall/fakeclock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTenantConcurrencyQuota(t *testing.T) {
+	release := make(chan struct{})
+	var arrived sync.WaitGroup
+	arrived.Add(2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			arrived.Done()
+			<-release
+		}
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+	client.SetTenantLimits(TenantLimits{MaxConcurrent: 2}, nil)
+	acme := ContextWithTenant(context.Background(), "acme")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := client.NewRequest(http.MethodGet, server.URL+"/slow").Tenant("acme").Do(context.Background())
+			assert.NoError(t, err)
+		}()
+	}
+	arrived.Wait()
+
+	request, err := http.NewRequest(http.MethodGet, server.URL+"/fast", nil)
+	require.NoError(t, err)
+	_, err = client.Do(request.WithContext(acme))
+	var exceeded *ErrTenantQuotaExceeded
+	require.True(t, errors.As(err, &exceeded), "%v", err)
+	assert.Equal(t, &ErrTenantQuotaExceeded{Tenant: "acme", Limit: TenantConcurrencyLimit}, exceeded)
+
+	for i := 0; i < 3; i++ {
+		_, err = client.Do(request.WithContext(ContextWithTenant(context.Background(), "globex")))
+		require.NoError(t, err, "the other tenant is unaffected")
+	}
+	_, err = client.Get(server.URL+"/fast", http.Header{})
+	require.NoError(t, err, "requests on behalf of no tenant are not limited")
+
+	stats := client.Stats()
+	assert.Equal(t, map[string]TenantStats{
+		"acme":   {InFlight: 2, Attempts: 2, Rejected: 1},
+		"globex": {Attempts: 3},
+	}, stats.Tenants)
+	assert.Equal(t, int64(1), stats.Outcomes[OutcomeClientError])
+
+	close(release)
+	wg.Wait()
+	assert.Equal(t, 0, client.Stats().Tenants["acme"].InFlight)
+
+	client.ResetStats()
+	assert.Equal(t, TenantStats{}, client.Stats().Tenants["acme"])
+}
+
+func TestClientsEnforceTenantRates(t *testing.T) {
+	for kind, newClient := range retryClients {
+		t.Run(kind, func(t *testing.T) {
+			var hits int32
+			server := countingServer(&hits)
+			defer server.Close()
+
+			clock := fakeclock.New(time.Now())
+			client := newClient("tenant_rate_"+kind, clock)
+			client.SetTenantLimits(TenantLimits{}, map[string]TenantLimits{"acme": {RequestsPerSecond: 2}})
+
+			send := func(tenant string) error {
+				_, err := client.NewRequest(http.MethodGet, server.URL).Tenant(tenant).Do(context.Background())
+				return err
+			}
+
+			require.NoError(t, send("acme"))
+			require.NoError(t, send("acme"))
+
+			err := send("acme")
+			var exceeded *ErrTenantQuotaExceeded
+			require.True(t, errors.As(err, &exceeded), "%v", err)
+			assert.Equal(t, TenantRateLimit, exceeded.Limit)
+			assert.Equal(t, 500*time.Millisecond, exceeded.RetryAfter)
+			assert.Contains(t, err.Error(), `tenant "acme" exceeded its rate quota`)
+
+			for i := 0; i < 5; i++ {
+				require.NoError(t, send("globex"), "tenants without overrides get the unlimited defaults")
+			}
+
+			clock.Advance(500 * time.Millisecond)
+			require.NoError(t, send("acme"))
+
+			assert.Equal(t, int32(8), atomic.LoadInt32(&hits))
+			assert.Equal(t, TenantStats{Attempts: 3, Rejected: 1}, client.Stats().Tenants["acme"])
+		})
+	}
+}
+
+func TestTenantQuotasCountEveryAttempt(t *testing.T) {
+	server := failingServer(100)
+	defer server.Close()
+
+	client := NewHTTPClient(1000)
+	client.SetRetryCount(3)
+	client.SetTenantLimits(TenantLimits{RequestsPerSecond: 1, Burst: 2}, nil)
+
+	_, err := client.NewRequest(http.MethodGet, server.URL).Tenant("acme").Do(context.Background())
+	var exceeded *ErrTenantQuotaExceeded
+	require.True(t, errors.As(err, &exceeded), "the third attempt is over the burst: %v", err)
+	assert.Equal(t, TenantStats{Attempts: 2, Rejected: 1}, client.Stats().Tenants["acme"])
+
+	derived := client.Derive()
+	_, err = derived.NewRequest(http.MethodGet, server.URL).Tenant("acme").Do(context.Background())
+	require.True(t, errors.As(err, &exceeded), "derived clients keep the limits: %v", err)
+	assert.Equal(t, TenantStats{Attempts: 2, Rejected: 1}, derived.Stats().Tenants["acme"], "and count on their own")
+}
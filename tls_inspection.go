@@ -0,0 +1,93 @@
+package heimdall
+
+import (
+	"crypto/tls"
+	"net/http"
+	"time"
+)
+
+const defaultTLSExpiryWarning = 14 * 24 * time.Hour
+
+// TLSInfo describes the TLS connection an attempt was sent over
+type TLSInfo struct {
+	// Version is the negotiated protocol version, such as tls.VersionTLS13
+	Version uint16
+	// CipherSuite is the negotiated cipher suite, see tls.CipherSuiteName
+	CipherSuite uint16
+	// NotAfter is when the leaf certificate of the server expires
+	NotAfter time.Time
+	// DaysUntilExpiry is the number of whole days left until NotAfter,
+	// negative once the certificate has expired
+	DaysUntilExpiry int
+
+	// ExpiringSoon reports whether the leaf certificate expires within the
+	// threshold given to WithTLSInspection
+	ExpiringSoon bool
+	// WeakProtocol reports whether a version older than TLS 1.2 was negotiated
+	WeakProtocol bool
+
+	// RequestID is the ID of the request the attempt belongs to
+	RequestID string
+}
+
+// Warning reports whether the connection deserves attention, because the
+// certificate expires soon or the protocol is weak
+func (info TLSInfo) Warning() bool {
+	return info.ExpiringSoon || info.WeakProtocol
+}
+
+type tlsInspector struct {
+	onInfo    func(host string, info TLSInfo)
+	threshold time.Duration
+}
+
+// WithTLSInspection calls onInfo with the details of the TLS connection of
+// every attempt that got a response over TLS, flagging leaf certificates
+// expiring within threshold, 14 days when zero, and protocols older than
+// TLS 1.2. Such warnings are also counted in the "tls_warnings" expvar. The
+// hook runs on the requesting goroutine, so it should return quickly.
+func WithTLSInspection(onInfo func(host string, info TLSInfo), threshold time.Duration) Option {
+	return func(options *clientOptions) {
+		if threshold <= 0 {
+			threshold = defaultTLSExpiryWarning
+		}
+		options.tls = &tlsInspector{onInfo: onInfo, threshold: threshold}
+	}
+}
+
+// inspect reports the TLS connection of response, if any. It is a no-op when
+// TLS inspection is not enabled.
+func (i *tlsInspector) inspect(response *http.Response, request *http.Request, now time.Time, metrics *expvarMetrics) {
+	if i == nil || response.TLS == nil {
+		return
+	}
+
+	host := request.URL.Hostname()
+	if response.Request != nil {
+		host = response.Request.URL.Hostname()
+	}
+
+	info := i.info(*response.TLS, now)
+	info.RequestID = RequestIDFromContext(request.Context())
+	if info.Warning() {
+		metrics.warnTLS()
+	}
+	i.onInfo(host, info)
+}
+
+func (i *tlsInspector) info(state tls.ConnectionState, now time.Time) TLSInfo {
+	info := TLSInfo{
+		Version:      state.Version,
+		CipherSuite:  state.CipherSuite,
+		WeakProtocol: state.Version < tls.VersionTLS12,
+	}
+
+	if len(state.PeerCertificates) > 0 {
+		info.NotAfter = state.PeerCertificates[0].NotAfter
+		untilExpiry := info.NotAfter.Sub(now)
+		info.DaysUntilExpiry = int(untilExpiry / (24 * time.Hour))
+		info.ExpiringSoon = untilExpiry < i.threshold
+	}
+
+	return info
+}
@@ -0,0 +1,128 @@
+package heimdall
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"expvar"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// shortLivedTLSServer starts a TLS server with a self-signed certificate for
+// 127.0.0.1 expiring at notAfter, and returns a client trusting it
+func shortLivedTLSServer(t *testing.T, notAfter time.Time, opts ...Option) (*httptest.Server, *HTTPClient) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "heimdall test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secure"))
+	}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}}}
+	server.StartTLS()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	client := NewHTTPClient(1000, opts...)
+	client.current.client.Transport.(*http.Transport).TLSClientConfig = &tls.Config{RootCAs: roots}
+
+	return server, client
+}
+
+func TestTLSInspectionReportsExpiry(t *testing.T) {
+	prefix := uniqueName("heimdall_tls_inspection_test")
+	var hosts []string
+	var infos []TLSInfo
+	notAfter := time.Now().Add(72*time.Hour + time.Hour).Truncate(time.Second)
+
+	server, client := shortLivedTLSServer(t, notAfter, WithTLSInspection(func(host string, info TLSInfo) {
+		hosts = append(hosts, host)
+		infos = append(infos, info)
+	}, 7*24*time.Hour))
+	defer server.Close()
+	client.EnableExpvar(prefix)
+
+	response, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, "secure", string(response.Body()))
+
+	require.Len(t, infos, 1)
+	info := infos[0]
+	assert.Equal(t, "127.0.0.1", hosts[0])
+	assert.True(t, notAfter.Equal(info.NotAfter), "%v", info.NotAfter)
+	assert.Equal(t, 3, info.DaysUntilExpiry)
+	assert.True(t, info.ExpiringSoon)
+	assert.False(t, info.WeakProtocol)
+	assert.True(t, info.Version >= tls.VersionTLS12)
+	assert.NotEmpty(t, tls.CipherSuiteName(info.CipherSuite))
+
+	assert.Equal(t, "1", expvar.Get(prefix+".tls_warnings").String())
+}
+
+func TestTLSInspectionWithoutWarning(t *testing.T) {
+	var infos []TLSInfo
+	server, client := shortLivedTLSServer(t, time.Now().Add(90*24*time.Hour), WithTLSInspection(func(host string, info TLSInfo) {
+		infos = append(infos, info)
+	}, 0))
+	defer server.Close()
+
+	_, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+
+	require.Len(t, infos, 1)
+	assert.Equal(t, 89, infos[0].DaysUntilExpiry)
+	assert.False(t, infos[0].Warning())
+}
+
+func TestTLSInspectionSkipsPlainHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	calls := 0
+	client := NewHTTPClient(1000, WithTLSInspection(func(host string, info TLSInfo) { calls++ }, 0))
+
+	_, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+
+	assert.Equal(t, 0, calls)
+}
+
+func TestTLSInspectionFlagsWeakProtocols(t *testing.T) {
+	inspector := &tlsInspector{threshold: time.Hour}
+	now := time.Now()
+
+	info := inspector.info(tls.ConnectionState{
+		Version:          tls.VersionTLS11,
+		PeerCertificates: []*x509.Certificate{{NotAfter: now.Add(-25 * time.Hour)}},
+	}, now)
+
+	assert.True(t, info.WeakProtocol)
+	assert.True(t, info.ExpiringSoon)
+	assert.Equal(t, -1, info.DaysUntilExpiry)
+}
@@ -0,0 +1,40 @@
+package heimdall
+
+import "net/http"
+
+// AnnounceTrailers declares trailer headers to send after the body of
+// request, which is then sent chunked. The values are read once the body has
+// been sent, so a body reader can fill them in as it reaches EOF:
+//
+//	heimdall.AnnounceTrailers(request, "X-Checksum")
+//	request.Body = checksumReader(body, func(sum string) {
+//		request.Trailer.Set("X-Checksum", sum)
+//	})
+//
+// Requests without a body cannot carry trailers and are left unchanged.
+func AnnounceTrailers(request *http.Request, names ...string) {
+	if request.Body == nil || request.Body == http.NoBody || len(names) == 0 {
+		return
+	}
+
+	if request.Trailer == nil {
+		request.Trailer = http.Header{}
+	}
+	for _, name := range names {
+		name = http.CanonicalHeaderKey(name)
+		if _, ok := request.Trailer[name]; !ok {
+			request.Trailer[name] = nil
+		}
+	}
+	request.ContentLength = -1
+}
+
+// responseTrailers returns the trailers of response, which are only known
+// once its body has been read to EOF
+func responseTrailers(response *http.Response) http.Header {
+	if len(response.Trailer) == 0 {
+		return nil
+	}
+
+	return response.Trailer
+}
@@ -0,0 +1,128 @@
+package heimdall
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// checksumReader calls done with the checksum of everything read from r once
+// it reaches EOF
+type checksumReader struct {
+	r    io.Reader
+	read bytes.Buffer
+	done func(sum string)
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.read.Write(p[:n])
+	if err == io.EOF {
+		c.done(checksum(c.read.Bytes()))
+	}
+
+	return n, err
+}
+
+func checksumTrailerHandler(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	if sum := r.Trailer.Get("X-Checksum"); sum != "" && sum != checksum(body) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Trailer", "X-Checksum")
+	w.Write([]byte("chunked payload"))
+	w.Header().Set("X-Checksum", checksum([]byte("chunked payload")))
+}
+
+func TestResponseTrailersAreCaptured(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(checksumTrailerHandler))
+	defer server.Close()
+
+	clients := map[string]Client{
+		"http":    NewHTTPClient(1000),
+		"hystrix": NewHystrixHTTPClient(1000, NewHystrixConfig("trailer_command", HystrixCommandConfig{Timeout: 1000})),
+	}
+	for name, client := range clients {
+		t.Run(name, func(t *testing.T) {
+			response, err := client.Get(server.URL, http.Header{})
+			require.NoError(t, err)
+
+			assert.Equal(t, "chunked payload", string(response.Body()))
+			assert.Equal(t, checksum(response.Body()), response.Trailers().Get("X-Checksum"))
+			assert.Equal(t, "", response.Headers().Get("X-Checksum"))
+		})
+	}
+}
+
+func TestResponseWithoutTrailers(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("plain"))
+	}))
+	defer server.Close()
+
+	response, err := NewHTTPClient(1000).Get(server.URL, http.Header{})
+	require.NoError(t, err)
+
+	assert.Nil(t, response.Trailers())
+}
+
+func TestAnnouncedRequestTrailersAreSent(t *testing.T) {
+	var received http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, []string{"chunked"}, r.TransferEncoding)
+		checksumTrailerHandler(w, r)
+		received = r.Trailer
+	}))
+	defer server.Close()
+
+	payload := []byte(strings.Repeat("request payload ", 64))
+	request, err := http.NewRequest(http.MethodPost, server.URL, bytes.NewReader(payload))
+	require.NoError(t, err)
+
+	AnnounceTrailers(request, "x-checksum")
+	request.Body = ioutil.NopCloser(&checksumReader{r: bytes.NewReader(payload), done: func(sum string) {
+		request.Trailer.Set("X-Checksum", sum)
+	}})
+
+	response, err := NewHTTPClient(1000).Do(request)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, response.StatusCode())
+	assert.Equal(t, checksum(payload), received.Get("X-Checksum"))
+	assert.Equal(t, checksum(response.Body()), response.Trailers().Get("X-Checksum"))
+}
+
+func TestAnnounceTrailersSkipsRequestsWithoutBody(t *testing.T) {
+	request, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	require.NoError(t, err)
+
+	AnnounceTrailers(request, "X-Checksum")
+
+	assert.Nil(t, request.Trailer)
+	assert.Equal(t, int64(0), request.ContentLength)
+}
+
+func TestCloneCopiesTrailers(t *testing.T) {
+	response := Response{trailers: http.Header{"X-Checksum": {"abc"}}}
+
+	cloned := response.clone()
+	cloned.trailers.Set("X-Checksum", "def")
+
+	assert.Equal(t, "abc", response.Trailers().Get("X-Checksum"))
+}
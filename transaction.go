@@ -0,0 +1,211 @@
+package heimdall
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	defaultCompensationRetries = 2
+	defaultCompensationGrace   = 30 * time.Second
+)
+
+// Transaction runs requests as steps of a saga: each step runs once the one
+// before it succeeded, and when a step fails the steps that succeeded are
+// compensated, undone, in reverse order. Build it with NewTransaction and
+// Step, and run it with Run.
+type Transaction struct {
+	steps   []transactionStep
+	retries int
+	backoff Backoff
+	grace   time.Duration
+	clock   Clock
+}
+
+type transactionStep struct {
+	do         func(ctx context.Context, client Client) (Response, error)
+	compensate func(ctx context.Context, client Client, response Response) error
+}
+
+// NewTransaction returns a transaction without steps, compensating with two
+// retries and a grace period of 30 seconds
+func NewTransaction() *Transaction {
+	return &Transaction{
+		retries: defaultCompensationRetries,
+		backoff: NewConstantBackoff(0),
+		grace:   defaultCompensationGrace,
+		clock:   realClock{},
+	}
+}
+
+// Step adds a step sending its requests with do, undone by compensate, given
+// the response do returned, when a later step fails. A nil compensate leaves
+// the step as it is.
+func (t *Transaction) Step(do func(ctx context.Context, client Client) (Response, error), compensate func(ctx context.Context, client Client, response Response) error) *Transaction {
+	t.steps = append(t.steps, transactionStep{do: do, compensate: compensate})
+	return t
+}
+
+// WithCompensationRetries retries a failed compensation up to retries times,
+// waiting as backoff says between attempts, given the number of the attempt
+// that failed less one, as retriers are
+func (t *Transaction) WithCompensationRetries(retries int, backoff Backoff) *Transaction {
+	t.retries, t.backoff = retries, backoff
+	return t
+}
+
+// WithGracePeriod bounds the time compensations take, together, to grace.
+// Compensations run even once the context given to Run is done, for up to
+// grace, with its values but not its deadline.
+func (t *Transaction) WithGracePeriod(grace time.Duration) *Transaction {
+	t.grace = grace
+	return t
+}
+
+// WithClock measures the waits between compensation attempts and the grace
+// period on clock, which should be the clock the client was made with,
+// instead of the real clock
+func (t *Transaction) WithClock(clock Clock) *Transaction {
+	t.clock = clockOrReal(clock)
+	return t
+}
+
+// Run runs the steps of t in order through client, returning the responses of
+// the steps that succeeded. When a step fails, or ctx is done before a step
+// starts, the steps before it are compensated in reverse order and an
+// *ErrTransactionFailed describing the compensations is returned.
+func (t *Transaction) Run(ctx context.Context, client Client) ([]Response, error) {
+	responses := make([]Response, 0, len(t.steps))
+	for i, step := range t.steps {
+		err := ctx.Err()
+		if err == nil {
+			var response Response
+			response, err = step.do(ctx, client)
+			if err == nil {
+				responses = append(responses, response)
+				continue
+			}
+		}
+
+		return responses, &ErrTransactionFailed{Step: i, Compensations: t.compensate(ctx, client, responses), err: err}
+	}
+
+	return responses, nil
+}
+
+// compensate undoes the steps that returned responses, last first
+func (t *Transaction) compensate(ctx context.Context, client Client, responses []Response) []Compensation {
+	ctx, cancel := withClockTimeout(detachedContext{ctx}, t.clock, t.grace)
+	defer cancel()
+
+	var compensations []Compensation
+	for i := len(responses) - 1; i >= 0; i-- {
+		if t.steps[i].compensate == nil {
+			continue
+		}
+
+		compensation := Compensation{Step: i}
+		for compensation.Attempts <= t.retries {
+			if compensation.Err = ctx.Err(); compensation.Err != nil {
+				break
+			}
+			if compensation.Attempts > 0 {
+				t.clock.Sleep(ctx, t.backoff.Next(compensation.Attempts-1))
+			}
+
+			compensation.Attempts++
+			if compensation.Err = t.steps[i].compensate(ctx, client, responses[i]); compensation.Err == nil {
+				break
+			}
+		}
+		compensations = append(compensations, compensation)
+	}
+
+	return compensations
+}
+
+// Compensation is the outcome of undoing a step of a failed Transaction
+type Compensation struct {
+	// Step is the index of the step undone
+	Step int
+	// Attempts is the number of times the compensation ran
+	Attempts int
+	// Err is the error of the last attempt, nil when the step was undone
+	Err error
+}
+
+// ErrTransactionFailed is returned by Transaction.Run when a step failed. It
+// unwraps to the error of the step.
+type ErrTransactionFailed struct {
+	// Step is the index of the step that failed
+	Step int
+	// Compensations are the compensations run, in the order they ran, one
+	// for every step before Step that has one
+	Compensations []Compensation
+
+	err error
+}
+
+func (e *ErrTransactionFailed) Error() string {
+	var compensated, failed []string
+	for _, compensation := range e.Compensations {
+		if compensation.Err == nil {
+			compensated = append(compensated, fmt.Sprint(compensation.Step))
+		} else {
+			failed = append(failed, fmt.Sprintf("step %d after %d attempts: %v", compensation.Step, compensation.Attempts, compensation.Err))
+		}
+	}
+
+	message := fmt.Sprintf("transaction - step %d failed: %v", e.Step, e.err)
+	if len(compensated) > 0 {
+		message += "; compensated steps " + strings.Join(compensated, ", ")
+	}
+	if len(failed) > 0 {
+		message += "; compensation failed for " + strings.Join(failed, "; ")
+	}
+
+	return message
+}
+
+// RolledBack reports whether every compensation succeeded
+func (e *ErrTransactionFailed) RolledBack() bool {
+	for _, compensation := range e.Compensations {
+		if compensation.Err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Cause returns the error of the step that failed
+func (e *ErrTransactionFailed) Cause() error {
+	return e.err
+}
+
+// Unwrap returns the error of the step that failed
+func (e *ErrTransactionFailed) Unwrap() error {
+	return e.err
+}
+
+// detachedContext has the values of its context but is never done
+type detachedContext struct {
+	context.Context
+}
+
+// Deadline reports no deadline
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+// Done returns nil, as the context is never done
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+// Err returns nil
+func (detachedContext) Err() error {
+	return nil
+}
@@ -0,0 +1,194 @@
+package heimdall
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// resourceServer stores the bodies POSTed to /{kind}, answering with the path
+// of the created resource, and deletes them on DELETE. Kinds in failing
+// answer every request with the status given.
+type resourceServer struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	resources map[string]string
+	failing   map[string]int
+	log       []string
+}
+
+func newResourceServer() *resourceServer {
+	s := &resourceServer{resources: map[string]string{}, failing: map[string]int{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		s.log = append(s.log, r.Method+" "+r.URL.Path)
+		kind := strings.Split(strings.Trim(r.URL.Path, "/"), "/")[0]
+		if status := s.failing[r.Method+" "+kind]; status != 0 {
+			w.WriteHeader(status)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodPost:
+			body, _ := ioutil.ReadAll(r.Body)
+			path := fmt.Sprintf("/%s/%d", kind, len(s.log))
+			s.resources[path] = string(body)
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(path))
+		case http.MethodDelete:
+			delete(s.resources, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+
+	return s
+}
+
+func (s *resourceServer) fail(method, kind string, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failing[method+" "+kind] = status
+}
+
+func (s *resourceServer) stored() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := map[string]string{}
+	for path, body := range s.resources {
+		stored[path] = body
+	}
+
+	return stored
+}
+
+// errorStatus fails responses with a status of 400 or more
+func errorStatus(response Response, err error) (Response, error) {
+	if err == nil && response.StatusCode() >= http.StatusBadRequest {
+		err = fmt.Errorf("unexpected status %d", response.StatusCode())
+	}
+
+	return response, err
+}
+
+// create is a step POSTing body to kind and deleting what it created
+func (s *resourceServer) create(tx *Transaction, kind, body string) *Transaction {
+	return tx.Step(func(ctx context.Context, client Client) (Response, error) {
+		request, _ := http.NewRequest(http.MethodPost, s.URL+"/"+kind, strings.NewReader(body))
+		return errorStatus(SendRequest(client, request.WithContext(ctx)))
+	}, func(ctx context.Context, client Client, created Response) error {
+		request, _ := http.NewRequest(http.MethodDelete, s.URL+string(created.Body()), nil)
+		_, err := errorStatus(SendRequest(client, request.WithContext(ctx)))
+		return err
+	})
+}
+
+func TestTransactionRunsEveryStep(t *testing.T) {
+	server := newResourceServer()
+	defer server.Close()
+
+	tx := NewTransaction()
+	server.create(tx, "accounts", "acme")
+	server.create(tx, "invoices", "for acme")
+
+	responses, err := tx.Run(context.Background(), NewHTTPClient(1000))
+	require.NoError(t, err)
+	require.Len(t, responses, 2)
+	assert.Equal(t, map[string]string{"/accounts/1": "acme", "/invoices/2": "for acme"}, server.stored())
+}
+
+func TestTransactionCompensatesInReverseOrder(t *testing.T) {
+	server := newResourceServer()
+	defer server.Close()
+	server.fail(http.MethodPost, "invoices", http.StatusConflict)
+
+	tx := NewTransaction()
+	server.create(tx, "accounts", "acme")
+	server.create(tx, "contacts", "jane")
+	server.create(tx, "invoices", "for acme")
+	server.create(tx, "shipments", "never sent")
+
+	responses, err := tx.Run(context.Background(), NewHTTPClient(1000))
+	require.Len(t, responses, 2)
+
+	var failed *ErrTransactionFailed
+	require.True(t, errors.As(err, &failed), "%v", err)
+	assert.Equal(t, 2, failed.Step)
+	assert.True(t, failed.RolledBack())
+	assert.Equal(t, []Compensation{{Step: 1, Attempts: 1}, {Step: 0, Attempts: 1}}, failed.Compensations)
+	assert.EqualError(t, err, "transaction - step 2 failed: unexpected status 409; compensated steps 1, 0")
+
+	assert.Empty(t, server.stored())
+	assert.Equal(t, []string{"POST /accounts", "POST /contacts", "POST /invoices", "DELETE /contacts/2", "DELETE /accounts/1"}, server.log)
+}
+
+func TestTransactionReportsFailedCompensations(t *testing.T) {
+	server := newResourceServer()
+	defer server.Close()
+
+	tx := NewTransaction().WithCompensationRetries(3, NewConstantBackoff(1))
+	server.create(tx, "accounts", "acme")
+	tx.Step(func(ctx context.Context, client Client) (Response, error) {
+		return Response{}, nil
+	}, nil)
+	server.create(tx, "contacts", "jane")
+	server.create(tx, "invoices", "for acme")
+	server.fail(http.MethodPost, "invoices", http.StatusBadGateway)
+	server.fail(http.MethodDelete, "contacts", http.StatusServiceUnavailable)
+
+	_, err := tx.Run(context.Background(), NewHTTPClient(1000))
+	var failed *ErrTransactionFailed
+	require.True(t, errors.As(err, &failed), "%v", err)
+	assert.False(t, failed.RolledBack())
+	require.Len(t, failed.Compensations, 2, "steps without compensation are skipped")
+	assert.Equal(t, 2, failed.Compensations[0].Step)
+	assert.Equal(t, 4, failed.Compensations[0].Attempts, "the compensation is retried")
+	assert.EqualError(t, failed.Compensations[0].Err, "server error: 503")
+	assert.Equal(t, Compensation{Step: 0, Attempts: 1}, failed.Compensations[1], "a failed compensation does not stop the others")
+	assert.EqualError(t, err, "transaction - step 3 failed: server error: 502; compensated steps 0; compensation failed for step 2 after 4 attempts: server error: 503")
+
+	assert.Equal(t, map[string]string{"/contacts/2": "jane"}, server.stored())
+}
+
+func TestTransactionCompensatesOnceTheContextIsDone(t *testing.T) {
+	server := newResourceServer()
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(ContextWithTenant(context.Background(), "acme"))
+	tx := NewTransaction().WithGracePeriod(time.Second)
+	server.create(tx, "accounts", "acme")
+	tx.Step(func(ctx context.Context, client Client) (Response, error) {
+		cancel()
+		return Response{}, nil
+	}, func(ctx context.Context, client Client, response Response) error {
+		assert.Equal(t, "acme", TenantFromContext(ctx), "compensations keep the values of the context")
+		deadline, ok := ctx.Deadline()
+		assert.True(t, ok)
+		assert.WithinDuration(t, time.Now().Add(time.Second), deadline, 100*time.Millisecond, "within the grace period")
+		return nil
+	})
+	server.create(tx, "invoices", "never sent")
+
+	responses, err := tx.Run(ctx, NewHTTPClient(1000))
+	require.Len(t, responses, 2)
+	var failed *ErrTransactionFailed
+	require.True(t, errors.As(err, &failed), "%v", err)
+	assert.Equal(t, 2, failed.Step)
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.True(t, failed.RolledBack())
+	assert.Empty(t, server.stored(), "the cancelled transaction is still rolled back")
+}
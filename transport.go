@@ -0,0 +1,99 @@
+package heimdall
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// newTransport returns a transport with the same defaults as
+// http.DefaultTransport, dialing through guard so that private network
+// blocking is enforced on the resolved address of every connection. Dial
+// errors, other than forbidden hosts, match ErrConnect. With WithProxy or
+// WithSOCKS5Proxy, every connection is a tunnel through the proxy instead, but
+// for those to the hosts of the proxy bypass list, which skip the proxy of the
+// environment without it. Connections count their traffic for meter and count themselves
+// into the idle connections of options.pool.
+func newTransport(guard *hostGuard, options clientOptions) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:       30 * time.Second,
+		KeepAlive:     30 * time.Second,
+		FallbackDelay: options.fallbackDelay,
+		Resolver:      options.resolver,
+		Control:       guard.control,
+	}
+	if options.connectTimeout > 0 {
+		dialer.Timeout = options.connectTimeout
+	}
+
+	// The proxy usually lives on a private network, so it is dialed without
+	// the guard
+	proxyDialer := *dialer
+	proxyDialer.Control = nil
+	proxy := options.proxy
+	if socks, ok := proxy.(*socks5Proxy); ok {
+		proxy = socks.resolving(dialer.Resolver, guard)
+	}
+
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		if options.network != "" && network == "tcp" {
+			network = options.network
+		}
+
+		if proxy != nil && !guard.bypassesProxy(address) {
+			return proxy.dial(ctx, proxyDialer.DialContext, network, address)
+		}
+
+		conn, err := dialer.DialContext(ctx, network, address)
+		if err != nil && forbiddenHostError(err) == nil {
+			return nil, &connectError{err: err}
+		}
+
+		return conn, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+
+		return &meteredConn{Conn: conn, pool: options.pool}, nil
+	}
+	if proxy != nil {
+		transport.Proxy = nil
+	} else {
+		transport.Proxy = func(request *http.Request) (*url.URL, error) {
+			if guard.bypassesProxy(request.URL.Host) {
+				return nil, nil
+			}
+			return http.ProxyFromEnvironment(request)
+		}
+	}
+	if options.expectContinue > 0 {
+		transport.ExpectContinueTimeout = options.expectContinue
+	}
+	if options.maxResponseHeaderBytes > 0 {
+		transport.MaxResponseHeaderBytes = options.maxResponseHeaderBytes
+	}
+	if options.tlsServerName != "" {
+		setTLSServerName(transport, options.tlsServerName)
+	}
+
+	return transport
+}
+
+// expectContinue asks the server to confirm it wants the body of request
+// before it is sent, when enabled and the request has a body. The header is
+// set on a copy, leaving the caller's headers untouched.
+func expectContinue(request *http.Request, options clientOptions) {
+	if options.expectContinue <= 0 || request.Body == nil || request.Body == http.NoBody {
+		return
+	}
+
+	request.Header = copyHeader(request.Header)
+	request.Header.Set("Expect", "100-continue")
+}
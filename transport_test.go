@@ -0,0 +1,247 @@
+package heimdall
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingReader counts the bytes read from it, and has no GetBody so that
+// the transport cannot read it ahead of time
+type countingReader struct {
+	reader io.Reader
+	read   int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	atomic.AddInt64(&r.read, int64(n))
+
+	return n, err
+}
+
+func TestExpectContinueSkipsBodyWhenServerRejectsEarly(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "100-continue", r.Header.Get("Expect"))
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("missing credentials"))
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(5000, WithExpectContinue(5*time.Second))
+	assert.Equal(t, 5*time.Second, client.current.client.Transport.(*http.Transport).ExpectContinueTimeout)
+
+	body := &countingReader{reader: bytes.NewReader(make([]byte, 1<<20))}
+	headers := http.Header{}
+	began := time.Now()
+	response, err := client.Post(server.URL, body, headers)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusUnauthorized, response.StatusCode())
+	assert.Equal(t, "missing credentials", string(response.Body()))
+	assert.Equal(t, int64(0), atomic.LoadInt64(&body.read), "the body should not have been sent")
+	assert.True(t, time.Since(began) < time.Second, "the rejection should not wait for the continue timeout")
+	assert.Empty(t, headers.Get("Expect"), "the caller's headers should not be changed")
+}
+
+func TestExpectContinueSendsBodyWhenServerAccepts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "100-continue", r.Header.Get("Expect"))
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	client := NewHystrixHTTPClient(5000, NewHystrixConfig("expect_continue_command", HystrixCommandConfig{Timeout: 5000}),
+		WithExpectContinue(5*time.Second))
+
+	response, err := client.Put(server.URL, bytes.NewReader([]byte("payload")), http.Header{})
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, response.StatusCode())
+	assert.Equal(t, "payload", string(response.Body()))
+}
+
+func TestExpectContinueRewindsBodyOnRetry(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			// Rejected before the body is read
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(5000, WithExpectContinue(5*time.Second))
+	client.SetRetryCount(1)
+
+	response, err := client.Post(server.URL, bytes.NewReader([]byte("payload")), http.Header{})
+	require.NoError(t, err)
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&attempts))
+	assert.Equal(t, "payload", string(response.Body()))
+}
+
+func TestRequestsWithoutBodyDoNotExpectContinue(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get("Expect"))
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(5000, WithExpectContinue(time.Second))
+
+	_, err := client.Get(server.URL, http.Header{})
+	require.NoError(t, err)
+
+	_, err = NewHTTPClient(5000).Post(server.URL, bytes.NewReader([]byte("payload")), http.Header{})
+	require.NoError(t, err)
+}
+
+// stubResolver returns a resolver answering every A query with ipv4 and every
+// AAAA query with ipv6, served by a DNS server on the loopback interface
+func stubResolver(t *testing.T, ipv4, ipv6 net.IP) *net.Resolver {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if answer := dnsAnswer(buf[:n], ipv4, ipv6); answer != nil {
+				conn.WriteTo(answer, addr)
+			}
+		}
+	}()
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "udp", conn.LocalAddr().String())
+		},
+	}
+}
+
+// dnsAnswer builds the response to a single question DNS query
+func dnsAnswer(query []byte, ipv4, ipv6 net.IP) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+
+	end := 12
+	for end < len(query) && query[end] != 0 {
+		end += int(query[end]) + 1
+	}
+	end += 5
+	if end > len(query) {
+		return nil
+	}
+	question := query[12:end]
+
+	var rdata []byte
+	switch binary.BigEndian.Uint16(question[len(question)-4:]) {
+	case 1:
+		rdata = ipv4.To4()
+	case 28:
+		rdata = ipv6.To16()
+	}
+
+	answer := append([]byte(nil), query[:2]...)
+	answer = append(answer, 0x81, 0x80, 0, 1, 0, 0, 0, 0, 0, 0)
+	answer = append(answer, question...)
+	if rdata != nil {
+		answer[7] = 1
+		answer = append(answer, 0xc0, 12)
+		answer = append(answer, question[len(question)-4:]...)
+		answer = append(answer, 0, 0, 0, 60, 0, byte(len(rdata)))
+		answer = append(answer, rdata...)
+	}
+
+	return answer
+}
+
+// dualStackURL points server.URL at a host resolving to an unroutable IPv6
+// address and to the IPv4 address the server listens on
+func dualStackURL(server *httptest.Server) string {
+	return strings.Replace(server.URL, "127.0.0.1", "dual.heimdall.test", 1)
+}
+
+func TestFallbackDelayFallsBackToIPv4(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	resolver := stubResolver(t, net.ParseIP("127.0.0.1"), net.ParseIP("100::1"))
+	client := NewHTTPClient(5000, WithResolver(resolver), WithFallbackDelay(20*time.Millisecond))
+
+	response, err := client.Get(dualStackURL(server), http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(response.Body()))
+
+	response, err = NewHTTPClient(5000, WithResolver(resolver), WithIPv4Only()).Get(dualStackURL(server), http.Header{})
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(response.Body()))
+}
+
+func TestIPv6OnlyFailsWithConnectError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	resolver := stubResolver(t, net.ParseIP("127.0.0.1"), net.ParseIP("100::1"))
+	client := NewHTTPClient(5000, WithResolver(resolver), WithIPv6Only(), WithConnectTimeout(100*time.Millisecond))
+
+	began := time.Now()
+	_, err := client.Get(dualStackURL(server), http.Header{})
+	require.Error(t, err)
+
+	assert.True(t, errors.Is(err, ErrConnect), "%v", err)
+	assert.True(t, time.Since(began) < 2*time.Second)
+}
+
+func TestDialErrorsMatchErrConnect(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := listener.Addr().String()
+	listener.Close()
+
+	_, err = NewHystrixHTTPClient(1000, NewHystrixConfig("connect_error_command", HystrixCommandConfig{Timeout: 1000})).
+		Get("http://"+address, http.Header{})
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrConnect), "%v", err)
+
+	client := NewHTTPClient(1000)
+	client.SetBlockPrivateNetworks(true)
+	_, err = client.Get("http://"+address, http.Header{})
+	require.Error(t, err)
+	assert.False(t, errors.Is(err, ErrConnect), "forbidden hosts are not connect errors")
+}
+
+func TestDialerOptionsConfigureTransport(t *testing.T) {
+	transport := NewHTTPClient(1000, WithIPv4Only()).current.client.Transport.(*http.Transport)
+	assert.NotNil(t, transport.DialContext)
+
+	_, err := transport.DialContext(context.Background(), "tcp", "[::1]:1")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "tcp4")
+}
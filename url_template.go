@@ -0,0 +1,244 @@
+package heimdall
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrURLTemplate is returned for a URL template that does not parse, before
+// any request is sent
+type ErrURLTemplate struct {
+	Template string
+	// Reason is what is wrong, such as "unclosed expression"
+	Reason string
+}
+
+func (e *ErrURLTemplate) Error() string {
+	return fmt.Sprintf("invalid URL template %q: %s", e.Template, e.Reason)
+}
+
+// ErrMissingPathParam is returned, before any request is sent, when a
+// variable of a URL template outside its query expressions has no value
+type ErrMissingPathParam struct {
+	Template string
+	Name     string
+}
+
+func (e *ErrMissingPathParam) Error() string {
+	return fmt.Sprintf("URL template %q: missing path parameter %q", e.Template, e.Name)
+}
+
+// ExpandURLTemplate expands template as RFC 6570 describes, up to level 4,
+// with vars holding the values of its variables: one value for a string, any
+// number for a list. Variables without values are left out, as the RFC says,
+// except those outside the query ({?...} and {&...}) expressions, which fail
+// the expansion with an *ErrMissingPathParam. Templates that do not parse fail
+// with an *ErrURLTemplate. Associative array values are not supported.
+func ExpandURLTemplate(template string, vars map[string][]string) (string, error) {
+	return expandURLTemplate(template, vars, nil)
+}
+
+// expandURLTemplate expands template, recording the names of its variables
+// in used unless it is nil
+func expandURLTemplate(template string, vars map[string][]string, used map[string]bool) (string, error) {
+	var expanded strings.Builder
+	for rest := template; rest != ""; {
+		open := strings.IndexAny(rest, "{}")
+		if open < 0 {
+			expanded.WriteString(encodeTemplateLiteral(rest))
+			break
+		}
+		if rest[open] == '}' {
+			return "", &ErrURLTemplate{Template: template, Reason: "unopened expression"}
+		}
+		expanded.WriteString(encodeTemplateLiteral(rest[:open]))
+
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return "", &ErrURLTemplate{Template: template, Reason: "unclosed expression"}
+		}
+		if err := expandExpression(&expanded, template, rest[open+1:open+end], vars, used); err != nil {
+			return "", err
+		}
+		rest = rest[open+end+1:]
+	}
+
+	return expanded.String(), nil
+}
+
+// templateOperator is how the variables of an expression with an operator
+// expand, as tabled in appendix A of RFC 6570
+type templateOperator struct {
+	first, separator string
+	named            bool
+	ifEmpty          string
+	reserved         bool
+}
+
+var templateOperators = map[byte]templateOperator{
+	'+': {first: "", separator: ",", reserved: true},
+	'#': {first: "#", separator: ",", reserved: true},
+	'.': {first: ".", separator: "."},
+	'/': {first: "/", separator: "/"},
+	';': {first: ";", separator: ";", named: true},
+	'?': {first: "?", separator: "&", named: true, ifEmpty: "="},
+	'&': {first: "&", separator: "&", named: true, ifEmpty: "="},
+}
+
+// query reports whether the expression sets query parameters
+func (op templateOperator) query() bool {
+	return op.ifEmpty == "="
+}
+
+// expandExpression writes the expansion of expression, the text between the
+// braces
+func expandExpression(expanded *strings.Builder, template, expression string, vars map[string][]string, used map[string]bool) error {
+	op := templateOperator{separator: ","}
+	if expression != "" {
+		if operator, ok := templateOperators[expression[0]]; ok {
+			op = operator
+			expression = expression[1:]
+		} else if strings.IndexByte("=,!@|", expression[0]) >= 0 {
+			return &ErrURLTemplate{Template: template, Reason: fmt.Sprintf("reserved operator %q", expression[0])}
+		}
+	}
+	if expression == "" {
+		return &ErrURLTemplate{Template: template, Reason: "empty expression"}
+	}
+
+	first := true
+	for _, spec := range strings.Split(expression, ",") {
+		name, explode, prefix, err := parseVarSpec(template, spec)
+		if err != nil {
+			return err
+		}
+		if used != nil {
+			used[name] = true
+		}
+
+		values, defined := vars[name]
+		if !defined || len(values) == 0 {
+			if !op.query() {
+				return &ErrMissingPathParam{Template: template, Name: name}
+			}
+			continue
+		}
+
+		if first {
+			expanded.WriteString(op.first)
+			first = false
+		} else {
+			expanded.WriteString(op.separator)
+		}
+		expandVariable(expanded, op, name, values, explode, prefix)
+	}
+
+	return nil
+}
+
+// parseVarSpec splits a variable of an expression into its name and
+// modifiers
+func parseVarSpec(template, spec string) (string, bool, int, error) {
+	name, explode, prefix := spec, false, 0
+	if strings.HasSuffix(name, "*") {
+		name, explode = strings.TrimSuffix(name, "*"), true
+	} else if colon := strings.IndexByte(name, ':'); colon >= 0 {
+		length, err := strconv.Atoi(name[colon+1:])
+		if err != nil || length <= 0 || length >= 10000 {
+			return "", false, 0, &ErrURLTemplate{Template: template, Reason: fmt.Sprintf("invalid prefix in %q", spec)}
+		}
+		name, prefix = name[:colon], length
+	}
+
+	if name == "" {
+		return "", false, 0, &ErrURLTemplate{Template: template, Reason: "empty variable name"}
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		valid := c == '_' || c == '.' || c == '%' || c >= '0' && c <= '9' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z'
+		if !valid {
+			return "", false, 0, &ErrURLTemplate{Template: template, Reason: fmt.Sprintf("invalid variable name %q", name)}
+		}
+	}
+
+	return name, explode, prefix, nil
+}
+
+// expandVariable writes the expansion of one defined variable
+func expandVariable(expanded *strings.Builder, op templateOperator, name string, values []string, explode bool, prefix int) {
+	named := func(value string) {
+		if op.named {
+			expanded.WriteString(name)
+			if value == "" {
+				expanded.WriteString(op.ifEmpty)
+				return
+			}
+			expanded.WriteByte('=')
+		}
+		expanded.WriteString(encodeTemplateValue(value, op.reserved))
+	}
+
+	switch {
+	case len(values) == 1 && !explode:
+		value := values[0]
+		if prefix > 0 && utf8.RuneCountInString(value) > prefix {
+			value = string([]rune(value)[:prefix])
+		}
+		named(value)
+	case explode:
+		for i, value := range values {
+			if i > 0 {
+				expanded.WriteString(op.separator)
+			}
+			named(value)
+		}
+	default:
+		if op.named {
+			expanded.WriteString(name + "=")
+		}
+		for i, value := range values {
+			if i > 0 {
+				expanded.WriteByte(',')
+			}
+			expanded.WriteString(encodeTemplateValue(value, op.reserved))
+		}
+	}
+}
+
+// encodeTemplateValue percent-encodes value, keeping the unreserved
+// characters, and the reserved ones and existing escapes when reserved is set
+func encodeTemplateValue(value string, reserved bool) string {
+	var encoded strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case isUnreserved(c):
+			encoded.WriteByte(c)
+		case reserved && isReserved(c):
+			encoded.WriteByte(c)
+		case reserved && c == '%' && i+2 < len(value) && isHex(value[i+1]) && isHex(value[i+2]):
+			encoded.WriteString(value[i : i+3])
+			i += 2
+		default:
+			fmt.Fprintf(&encoded, "%%%02X", c)
+		}
+	}
+
+	return encoded.String()
+}
+
+// encodeTemplateLiteral percent-encodes the characters of the literal parts
+// of a template that may not appear in a URL
+func encodeTemplateLiteral(literal string) string {
+	return encodeTemplateValue(literal, true)
+}
+
+func isUnreserved(c byte) bool {
+	return c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+func isReserved(c byte) bool {
+	return strings.IndexByte(":/?#[]@!$&'()*+,;=", c) >= 0
+}
@@ -0,0 +1,116 @@
+package heimdall
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rfc6570Vars are the variables of the examples of RFC 6570
+var rfc6570Vars = map[string][]string{
+	"var":   {"value"},
+	"hello": {"Hello World!"},
+	"path":  {"/foo/bar"},
+	"empty": {""},
+	"x":     {"1024"},
+	"y":     {"768"},
+	"list":  {"red", "green", "blue"},
+}
+
+func TestExpandURLTemplateRFC6570Examples(t *testing.T) {
+	cases := map[string]string{
+		// Level 1
+		"{var}":   "value",
+		"{hello}": "Hello%20World%21",
+
+		// Level 2
+		"{+var}":           "value",
+		"{+hello}":         "Hello%20World!",
+		"{+path}/here":     "/foo/bar/here",
+		"here?ref={+path}": "here?ref=/foo/bar",
+		"X{#var}":          "X#value",
+		"X{#hello}":        "X#Hello%20World!",
+
+		// Level 3
+		"map?{x,y}":          "map?1024,768",
+		"{x,hello,y}":        "1024,Hello%20World%21,768",
+		"{+x,hello,y}":       "1024,Hello%20World!,768",
+		"{+path,x}/here":     "/foo/bar,1024/here",
+		"{#x,hello,y}":       "#1024,Hello%20World!,768",
+		"{#path,x}/here":     "#/foo/bar,1024/here",
+		"X{.var}":            "X.value",
+		"X{.x,y}":            "X.1024.768",
+		"{/var}":             "/value",
+		"{/var,x}/here":      "/value/1024/here",
+		"{;x,y}":             ";x=1024;y=768",
+		"{;x,y,empty}":       ";x=1024;y=768;empty",
+		"{?x,y}":             "?x=1024&y=768",
+		"{?x,y,empty}":       "?x=1024&y=768&empty=",
+		"?fixed=yes{&x}":     "?fixed=yes&x=1024",
+		"{&x,y,empty}":       "&x=1024&y=768&empty=",
+		"{?x,undef}":         "?x=1024",
+		"{?undef}{&undef}/a": "/a",
+
+		// Level 4
+		"{var:3}":           "val",
+		"{var:30}":          "value",
+		"{list}":            "red,green,blue",
+		"{list*}":           "red,green,blue",
+		"{+path:6}/here":    "/foo/b/here",
+		"{#list*}":          "#red,green,blue",
+		"X{.list*}":         "X.red.green.blue",
+		"{/var:1,var}":      "/v/value",
+		"{/list*,path:4}":   "/red/green/blue/%2Ffoo",
+		"{;hello:5}":        ";hello=Hello",
+		"{;list*}":          ";list=red;list=green;list=blue",
+		"{?var:3}":          "?var=val",
+		"{?list}":           "?list=red,green,blue",
+		"{?list*}":          "?list=red&list=green&list=blue",
+		"{&list*}":          "&list=red&list=green&list=blue",
+		"/literal%20kept é": "/literal%20kept%20%C3%A9",
+	}
+	for template, expected := range cases {
+		expanded, err := ExpandURLTemplate(template, rfc6570Vars)
+		require.NoError(t, err, template)
+		assert.Equal(t, expected, expanded, template)
+	}
+}
+
+func TestExpandURLTemplateEncodesValues(t *testing.T) {
+	vars := map[string][]string{
+		"owner": {"ünïcode"},
+		"repo":  {"a/b c"},
+		"path":  {"docs/read me.md"},
+		"q":     {"x=1&y=2", "%41"},
+	}
+	cases := map[string]string{
+		"/repos/{owner}/{repo}": "/repos/%C3%BCn%C3%AFcode/a%2Fb%20c",
+		"/raw/{+path}":          "/raw/docs/read%20me.md",
+		"/search{?q}":           "/search?q=x%3D1%26y%3D2,%2541",
+		"/search{?q*}":          "/search?q=x%3D1%26y%3D2&q=%2541",
+		"{+q}":                  "x=1&y=2,%41",
+		"/{owner:2}":            "/%C3%BCn",
+	}
+	for template, expected := range cases {
+		expanded, err := ExpandURLTemplate(template, vars)
+		require.NoError(t, err, template)
+		assert.Equal(t, expected, expanded, template)
+	}
+}
+
+func TestExpandURLTemplateErrors(t *testing.T) {
+	_, err := ExpandURLTemplate("/repos/{owner}/{repo}{?state}", map[string][]string{"owner": {"o"}})
+
+	var missing *ErrMissingPathParam
+	require.True(t, errors.As(err, &missing), "%v", err)
+	assert.Equal(t, "repo", missing.Name)
+
+	for _, template := range []string{"/a/{b", "/a/b}", "/a/{}", "/{=b}", "/{b:0}", "/{b:x}", "/{b c}", "/{,}"} {
+		_, err := ExpandURLTemplate(template, map[string][]string{"b": {"1"}})
+
+		var invalid *ErrURLTemplate
+		assert.True(t, errors.As(err, &invalid), "%s: %v", template, err)
+	}
+}
@@ -0,0 +1,146 @@
+package heimdall
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrInvalidURL is returned, before any attempt is sent, for a request URL
+// that cannot be sent
+type ErrInvalidURL struct {
+	// URL is the offending input, with any password in it redacted
+	URL    string
+	Reason string
+}
+
+func (e *ErrInvalidURL) Error() string {
+	return fmt.Sprintf("invalid URL %q: %s", e.URL, e.Reason)
+}
+
+func invalidURL(raw, reason string) *ErrInvalidURL {
+	return &ErrInvalidURL{URL: redactUserinfo(raw), Reason: reason}
+}
+
+// newRequest builds the request of a client method, normalizing rawURL first
+func newRequest(method, rawURL string, body io.Reader) (*http.Request, error) {
+	normalized, err := normalizeURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := http.NewRequest(method, normalized, body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s - request creation failed", method)
+	}
+
+	return request, nil
+}
+
+// normalizeURL trims surrounding whitespace from raw and percent-encodes the
+// characters that may not appear in the path, query or fragment, such as
+// spaces and non-ASCII letters. Existing escapes are kept. Whitespace left
+// in the scheme or host is an error, as is any URL that does not parse.
+func normalizeURL(raw string) (string, error) {
+	trimmed := strings.TrimSpace(raw)
+	if trimmed == "" {
+		return "", invalidURL(raw, "empty URL")
+	}
+
+	rest := 0
+	if i := strings.Index(trimmed, "://"); i > 0 && !strings.ContainsAny(trimmed[:i], "/?#") {
+		rest = i + 3
+		if end := strings.IndexAny(trimmed[rest:], "/?#"); end >= 0 {
+			rest += end
+		} else {
+			rest = len(trimmed)
+		}
+
+		if strings.IndexFunc(trimmed[:rest], isIllegalURLRune) >= 0 {
+			return "", invalidURL(raw, "illegal character in scheme or host")
+		}
+	}
+
+	normalized := trimmed[:rest] + escapeIllegal(trimmed[rest:])
+	if _, err := url.Parse(normalized); err != nil {
+		reason := err.Error()
+		if urlErr, ok := err.(*url.Error); ok {
+			reason = urlErr.Err.Error()
+		}
+		if rest == 0 && strings.Contains(strings.SplitN(normalized, "/", 2)[0], ":") {
+			// A host and port such as "localhost:8080/x" without a scheme
+			reason = "missing scheme"
+		}
+		return "", invalidURL(raw, reason)
+	}
+
+	return normalized, nil
+}
+
+// checkRequestURL reports an *ErrInvalidURL unless u, once resolved against
+// the base URL, is an absolute http or https URL
+func checkRequestURL(u *url.URL) error {
+	switch {
+	case u.Scheme == "":
+		return invalidURL(u.String(), "missing scheme, and no base URL is set")
+	case u.Scheme != "http" && u.Scheme != "https":
+		return invalidURL(u.String(), fmt.Sprintf("unsupported scheme %q", u.Scheme))
+	case u.Host == "":
+		return invalidURL(u.String(), "missing host")
+	}
+
+	return nil
+}
+
+// escapeIllegal percent-encodes the bytes of s that are never valid in a URL,
+// along with any % not starting an escape
+func escapeIllegal(s string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '%' && i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]):
+			escaped.WriteByte(c)
+		case c == '%' || c <= ' ' || c >= 0x7f || strings.IndexByte("\"<>\\^`{|}", c) >= 0:
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		default:
+			escaped.WriteByte(c)
+		}
+	}
+
+	return escaped.String()
+}
+
+func isIllegalURLRune(r rune) bool {
+	return r <= ' ' || r == 0x7f
+}
+
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+// redactUserinfo replaces the password of a URL with "xxxxx", also in URLs
+// that do not parse
+func redactUserinfo(raw string) string {
+	i := strings.Index(raw, "://")
+	if i < 0 {
+		return raw
+	}
+
+	authority := raw[i+3:]
+	if end := strings.IndexAny(authority, "/?#"); end >= 0 {
+		authority = authority[:end]
+	}
+
+	at := strings.LastIndex(authority, "@")
+	colon := strings.Index(authority, ":")
+	if at < 0 || colon < 0 || colon > at {
+		return raw
+	}
+
+	return raw[:i+3] + authority[:colon+1] + "xxxxx" + raw[i+3+at:]
+}
@@ -0,0 +1,60 @@
+package heimdall
+
+import "net/http"
+
+// RequestValidator checks a request before it is sent. Returning an error
+// rejects the request without any network activity. It is given a copy of
+// the request, so changes it makes are not sent.
+type RequestValidator func(request *http.Request) error
+
+// ErrRequestRejected is returned when a request validator rejects a request.
+// It wraps the validator error, which errors.As can extract.
+type ErrRequestRejected struct {
+	err error
+}
+
+func (e *ErrRequestRejected) Error() string {
+	return "request rejected: " + e.err.Error()
+}
+
+// Cause returns the validator error
+func (e *ErrRequestRejected) Cause() error {
+	return e.err
+}
+
+// Unwrap returns the validator error
+func (e *ErrRequestRejected) Unwrap() error {
+	return e.err
+}
+
+// ChainValidators returns a validator running each of validators in order,
+// stopping at the first that rejects the request
+func ChainValidators(validators ...RequestValidator) RequestValidator {
+	return func(request *http.Request) error {
+		for _, validator := range validators {
+			if validator == nil {
+				continue
+			}
+
+			if err := validator(request); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+// validateRequest runs validator, if any, wrapping its error
+func validateRequest(validator RequestValidator, request *http.Request) (err error) {
+	if validator == nil {
+		return nil
+	}
+	defer recoverCallback("request validator", &err)
+
+	if err := validator(hookCopy(request)); err != nil {
+		return &ErrRequestRejected{err: err}
+	}
+
+	return nil
+}
@@ -0,0 +1,136 @@
+package heimdall
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type errMissingHeader struct {
+	name string
+}
+
+func (e *errMissingHeader) Error() string {
+	return fmt.Sprintf("missing %s header", e.name)
+}
+
+func requireHeader(name string) RequestValidator {
+	return func(request *http.Request) error {
+		if request.Header.Get(name) == "" {
+			return &errMissingHeader{name: name}
+		}
+		return nil
+	}
+}
+
+func maxBodySize(limit int64) RequestValidator {
+	return func(request *http.Request) error {
+		if request.ContentLength > limit {
+			return fmt.Errorf("body of %d bytes exceeds %d", request.ContentLength, limit)
+		}
+		return nil
+	}
+}
+
+func countingServer(hits *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+	}))
+}
+
+func testRequestValidatorRejects(t *testing.T, client testClient) {
+	var hits int32
+	server := countingServer(&hits)
+	defer server.Close()
+
+	client.SetRetryCount(3)
+	client.SetRequestValidator(ChainValidators(requireHeader("X-Tenant-ID"), maxBodySize(5)))
+
+	_, err := client.Get(server.URL, http.Header{})
+	require.Error(t, err)
+	assert.Equal(t, "request rejected: missing X-Tenant-ID header", err.Error())
+
+	var rejected *ErrRequestRejected
+	require.True(t, errors.As(err, &rejected))
+
+	var missing *errMissingHeader
+	require.True(t, errors.As(err, &missing))
+	assert.Equal(t, "X-Tenant-ID", missing.name)
+
+	headers := http.Header{}
+	headers.Set("X-Tenant-ID", "acme")
+	_, err = client.Post(server.URL, bytes.NewBufferString("too large"), headers)
+	require.Error(t, err)
+	assert.Equal(t, "request rejected: body of 9 bytes exceeds 5", err.Error())
+
+	assert.Equal(t, int32(0), atomic.LoadInt32(&hits))
+}
+
+func TestHTTPClientRequestValidatorRejectsWithoutSending(t *testing.T) {
+	testRequestValidatorRejects(t, NewHTTPClient(100))
+}
+
+func TestHystrixHTTPClientRequestValidatorRejectsWithoutSending(t *testing.T) {
+	testRequestValidatorRejects(t, NewHystrixHTTPClient(100, NewHystrixConfig("validator_command", HystrixCommandConfig{})))
+}
+
+func TestRequestValidatorRunsOncePerRequest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	calls := 0
+	client := NewHTTPClient(100)
+	client.SetRetryCount(2)
+	client.SetRequestValidator(func(request *http.Request) error {
+		calls++
+		return nil
+	})
+
+	_, err := client.Get(server.URL, http.Header{})
+	require.Error(t, err)
+
+	var rejected *ErrRequestRejected
+	assert.False(t, errors.As(err, &rejected))
+	assert.Equal(t, 1, calls)
+}
+
+func TestRequestValidatorPassesValidRequests(t *testing.T) {
+	var hits int32
+	server := countingServer(&hits)
+	defer server.Close()
+
+	client := NewHTTPClient(100)
+	client.SetRequestValidator(ChainValidators(requireHeader("X-Tenant-ID"), nil, maxBodySize(5<<20)))
+
+	headers := http.Header{}
+	headers.Set("X-Tenant-ID", "acme")
+
+	response, err := client.Post(server.URL, bytes.NewBufferString("{}"), headers)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits))
+}
+
+func TestChainValidatorsStopsAtFirstRejection(t *testing.T) {
+	var ran []string
+	validator := func(name string, err error) RequestValidator {
+		return func(request *http.Request) error {
+			ran = append(ran, name)
+			return err
+		}
+	}
+
+	chain := ChainValidators(validator("first", nil), validator("second", errors.New("no")), validator("third", nil))
+
+	assert.EqualError(t, chain(&http.Request{}), "no")
+	assert.Equal(t, []string{"first", "second"}, ran)
+}
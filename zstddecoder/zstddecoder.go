@@ -0,0 +1,27 @@
+// Package zstddecoder provides a heimdall.ContentDecoder for zstd bodies.
+//
+// It lives outside the heimdall package so that clients which never receive
+// zstd do not depend on the decoder:
+//
+//	heimdall.RegisterContentDecoder(zstddecoder.Encoding, zstddecoder.Decode)
+package zstddecoder
+
+import (
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Encoding is the content encoding the decoder is registered for
+const Encoding = "zstd"
+
+// Decode returns a reader of the decoded content of the zstd stream r.
+// Bodies are decoded as they are read, on the goroutine reading them.
+func Decode(r io.Reader) (io.ReadCloser, error) {
+	decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+
+	return decoder.IOReadCloser(), nil
+}